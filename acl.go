@@ -0,0 +1,356 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrAuth         = errors.New("invalid username, password or token")
+	ErrNoAuth       = errors.New("authentication required")
+	ErrPermission   = errors.New("permission denied")
+	ErrUserExist    = errors.New("user already exists")
+	ErrUserNotExist = errors.New("user not exists")
+)
+
+// Perm is the set of operations granted on keys.
+type Perm uint8
+
+const (
+	PermRead Perm = 1 << iota
+	PermWrite
+)
+
+const (
+	aclSaltSize = 16
+	// aclHashRounds is the number of rounds of salted sha256 to slow down brute force attacks.
+	aclHashRounds = 10000
+	aclTokenSize  = 32
+)
+
+// Grant permits the operations on keys with the prefix.
+type Grant struct {
+	Prefix string `json:"prefix"`
+	Perm   Perm   `json:"perm"`
+}
+
+// User is the account of servers. Admin users can access all keys and manage users.
+type User struct {
+	Name  string `json:"name"`
+	Admin bool   `json:"admin,omitempty"`
+	// Salt and Password are hex encoded. Password is empty if password login is disabled.
+	Salt     string   `json:"salt,omitempty"`
+	Password string   `json:"password,omitempty"`
+	Tokens   []string `json:"tokens,omitempty"`
+	Grants   []Grant  `json:"grants,omitempty"`
+}
+
+// ACL is the user accounts and their grants persisted in the JSON file. Servers keep only the
+// name of authenticated user, so that changes of grants apply to existing sessions immediately.
+type ACL struct {
+	path  string
+	mu    sync.RWMutex
+	users map[string]*User
+}
+
+// LoadACL loads users from the file at path. The file is created when users are modified.
+func LoadACL(path string) (*ACL, error) {
+	a := &ACL{path: path, users: make(map[string]*User)}
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return a, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var users []*User
+	if err = json.Unmarshal(buf, &users); err != nil {
+		return nil, fmt.Errorf("broken ACL file : %w", err)
+	}
+	for _, u := range users {
+		a.users[u.Name] = u
+	}
+	return a, nil
+}
+
+// save writes all users into the file atomically. a.mu must be locked.
+func (a *ACL) save() error {
+	users := make([]*User, 0, len(a.users))
+	for _, name := range a.names() {
+		users = append(users, a.users[name])
+	}
+	buf, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := a.path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(buf); err != nil {
+		f.Close()
+		return err
+	} else if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	} else if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, a.path)
+}
+
+func (a *ACL) names() []string {
+	names := make([]string, 0, len(a.users))
+	for name := range a.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// update applies fn to the user and saves users. changes are discarded if failed.
+func (a *ACL) update(name string, fn func(u *User) error) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	u, ok := a.users[name]
+	if !ok {
+		return ErrUserNotExist
+	}
+	old := *u
+	old.Tokens = append([]string(nil), u.Tokens...)
+	old.Grants = append([]Grant(nil), u.Grants...)
+	if err := fn(u); err != nil {
+		*u = old
+		return err
+	} else if err = a.save(); err != nil {
+		*u = old
+		return err
+	}
+	return nil
+}
+
+func hashSecret(salt []byte, secret string) []byte {
+	h := sha256.Sum256(append(salt, secret...))
+	for i := 1; i < aclHashRounds; i++ {
+		h = sha256.Sum256(h[:])
+	}
+	return h[:]
+}
+
+// hashToken hashes the token without salt to look it up. tokens are random enough.
+func hashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+func randomHex(size int) (string, error) {
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// AddUser adds the user without grants. empty password disables password login.
+func (a *ACL) AddUser(name, password string, admin bool) error {
+	if name == "" || strings.ContainsAny(name, " \t\r\n") {
+		return fmt.Errorf("invalid user name %q", name)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.users[name]; ok {
+		return ErrUserExist
+	}
+	u := &User{Name: name, Admin: admin}
+	if err := u.setPassword(password); err != nil {
+		return err
+	}
+	a.users[name] = u
+	if err := a.save(); err != nil {
+		delete(a.users, name)
+		return err
+	}
+	return nil
+}
+
+func (u *User) setPassword(password string) error {
+	if password == "" {
+		u.Salt, u.Password = "", ""
+		return nil
+	}
+	salt, err := randomHex(aclSaltSize)
+	if err != nil {
+		return err
+	}
+	rawSalt, _ := hex.DecodeString(salt)
+	u.Salt, u.Password = salt, hex.EncodeToString(hashSecret(rawSalt, password))
+	return nil
+}
+
+func (a *ACL) SetPassword(name, password string) error {
+	return a.update(name, func(u *User) error {
+		return u.setPassword(password)
+	})
+}
+
+func (a *ACL) SetAdmin(name string, admin bool) error {
+	return a.update(name, func(u *User) error {
+		u.Admin = admin
+		return nil
+	})
+}
+
+// NewToken generates the token to authenticate the user. Only the hash of token is stored.
+func (a *ACL) NewToken(name string) (string, error) {
+	token, err := randomHex(aclTokenSize)
+	if err != nil {
+		return "", err
+	}
+	err = a.update(name, func(u *User) error {
+		u.Tokens = append(u.Tokens, hashToken(token))
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Grant adds perm on keys with the prefix to the user.
+func (a *ACL) Grant(name, prefix string, perm Perm) error {
+	return a.update(name, func(u *User) error {
+		for i := range u.Grants {
+			if u.Grants[i].Prefix == prefix {
+				u.Grants[i].Perm |= perm
+				return nil
+			}
+		}
+		u.Grants = append(u.Grants, Grant{Prefix: prefix, Perm: perm})
+		return nil
+	})
+}
+
+// Revoke removes all grants of the user.
+func (a *ACL) Revoke(name string) error {
+	return a.update(name, func(u *User) error {
+		u.Grants = nil
+		return nil
+	})
+}
+
+func (a *ACL) DeleteUser(name string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	u, ok := a.users[name]
+	if !ok {
+		return ErrUserNotExist
+	}
+	delete(a.users, name)
+	if err := a.save(); err != nil {
+		a.users[name] = u
+		return err
+	}
+	return nil
+}
+
+// Users returns the copies of users in order of names.
+func (a *ACL) Users() []User {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	var users []User
+	for _, name := range a.names() {
+		users = append(users, *a.users[name])
+	}
+	return users
+}
+
+// Authenticate authenticates the user by password.
+func (a *ACL) Authenticate(name, password string) error {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	u, ok := a.users[name]
+	if !ok || u.Password == "" {
+		return ErrAuth
+	}
+	salt, err := hex.DecodeString(u.Salt)
+	if err != nil {
+		return ErrAuth
+	}
+	expected, err := hex.DecodeString(u.Password)
+	if err != nil || subtle.ConstantTimeCompare(hashSecret(salt, password), expected) != 1 {
+		return ErrAuth
+	}
+	return nil
+}
+
+// AuthenticateToken returns the name of the user who has the token.
+func (a *ACL) AuthenticateToken(token string) (string, error) {
+	h := []byte(hashToken(token))
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, u := range a.users {
+		for _, t := range u.Tokens {
+			if subtle.ConstantTimeCompare(h, []byte(t)) == 1 {
+				return u.Name, nil
+			}
+		}
+	}
+	return "", ErrAuth
+}
+
+// Authorize checks that the authenticated user is permitted perm on the key.
+// nil ACL permits all operations. empty name means not authenticated.
+func (a *ACL) Authorize(name, key string, perm Perm) error {
+	if a == nil {
+		return nil
+	} else if name == "" {
+		return ErrNoAuth
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	u, ok := a.users[name]
+	if !ok {
+		return ErrPermission
+	} else if u.Admin {
+		return nil
+	}
+	// grants of matched prefixes are merged
+	var granted Perm
+	for _, g := range u.Grants {
+		if strings.HasPrefix(key, g.Prefix) {
+			granted |= g.Perm
+		}
+	}
+	if granted&perm != perm {
+		return ErrPermission
+	}
+	return nil
+}
+
+// IsAdmin returns true if the user can manage users. nil ACL permits all users.
+func (a *ACL) IsAdmin(name string) bool {
+	if a == nil {
+		return true
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	u, ok := a.users[name]
+	return ok && u.Admin
+}
+
+// EnableACL enforces authentication and grants of acl in servers.
+// stdio interface and subcommands are not restricted.
+func (s *Storage) EnableACL(acl *ACL) {
+	s.acl = acl
+}
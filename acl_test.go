@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestACL(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	path := filepath.Join(tmpdir, "test.acl")
+
+	acl, err := LoadACL(path)
+	if err != nil {
+		t.Fatalf("failed to load : %v", err)
+	}
+	if err = acl.AddUser("alice", "secret", false); err != nil {
+		t.Fatalf("failed to add user : %v", err)
+	} else if err = acl.AddUser("alice", "secret", false); err != ErrUserExist {
+		t.Errorf("add existing user : %v", err)
+	} else if err = acl.AddUser("root", "root", true); err != nil {
+		t.Fatal(err)
+	}
+	if err = acl.Grant("alice", "users/", PermRead); err != nil {
+		t.Fatal(err)
+	} else if err = acl.Grant("alice", "users/alice/", PermWrite); err != nil {
+		t.Fatal(err)
+	}
+	token, err := acl.NewToken("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// users are persisted
+	if acl, err = LoadACL(path); err != nil {
+		t.Fatalf("failed to reload : %v", err)
+	}
+	if err = acl.Authenticate("alice", "secret"); err != nil {
+		t.Errorf("failed to authenticate : %v", err)
+	} else if err = acl.Authenticate("alice", "wrong"); err != ErrAuth {
+		t.Errorf("authenticate with wrong password : %v", err)
+	} else if err = acl.Authenticate("bob", "secret"); err != ErrAuth {
+		t.Errorf("authenticate unknown user : %v", err)
+	}
+	if name, err := acl.AuthenticateToken(token); err != nil || name != "alice" {
+		t.Errorf("failed to authenticate token : %q %v", name, err)
+	} else if _, err = acl.AuthenticateToken("wrong"); err != ErrAuth {
+		t.Errorf("authenticate wrong token : %v", err)
+	}
+
+	for _, c := range []struct {
+		user     string
+		key      string
+		perm     Perm
+		expected error
+	}{
+		{"alice", "users/bob", PermRead, nil},
+		{"alice", "users/bob", PermWrite, ErrPermission},
+		{"alice", "users/alice/name", PermRead | PermWrite, nil},
+		{"alice", "items/1", PermRead, ErrPermission},
+		{"root", "items/1", PermRead | PermWrite, nil},
+		{"bob", "users/bob", PermRead, ErrPermission},
+		{"", "users/bob", PermRead, ErrNoAuth},
+	} {
+		if err := acl.Authorize(c.user, c.key, c.perm); err != c.expected {
+			t.Errorf("authorize %q on %q with %v : %v, expected %v", c.user, c.key, c.perm, err, c.expected)
+		}
+	}
+	if err = (*ACL)(nil).Authorize("", "any", PermWrite); err != nil {
+		t.Errorf("nil ACL denies : %v", err)
+	}
+
+	// revoke and delete apply immediately
+	if err = acl.Revoke("alice"); err != nil {
+		t.Fatal(err)
+	} else if err = acl.Authorize("alice", "users/bob", PermRead); err != ErrPermission {
+		t.Errorf("authorize after revoke : %v", err)
+	}
+	if err = acl.DeleteUser("alice"); err != nil {
+		t.Fatal(err)
+	} else if err = acl.Authenticate("alice", "secret"); err != ErrAuth {
+		t.Errorf("authenticate deleted user : %v", err)
+	}
+}
+
+func TestHandleRESP_ACL(t *testing.T) {
+	storage := createTestStorage(t)
+	defer storage.wal.Close()
+	acl, err := LoadACL(filepath.Join(tmpdir, "test.acl"))
+	if err != nil {
+		t.Fatal(err)
+	} else if err = acl.AddUser("admin", "admin", true); err != nil {
+		t.Fatal(err)
+	}
+	storage.EnableACL(acl)
+	if err = storage.Put("public/1", []byte("v1")); err != nil {
+		t.Fatal(err)
+	} else if err = storage.Put("secret/1", []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+
+	client, server := net.Pipe()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go HandleRESP(server, server, storage, &wg)
+	defer client.Close()
+	r := bufio.NewReader(client)
+	do := func(args ...string) string {
+		t.Helper()
+		cmd := fmt.Sprintf("*%d\r\n", len(args))
+		for _, arg := range args {
+			cmd += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+		}
+		if _, err := client.Write([]byte(cmd)); err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprint(readRESP(t, r))
+	}
+
+	for _, c := range []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"GET", "public/1"}, "NOAUTH Authentication required."},
+		{[]string{"AUTH", "admin", "wrong"}, "WRONGPASS invalid username-password pair or user is disabled."},
+		{[]string{"AUTH", "admin", "admin"}, "OK"},
+		{[]string{"ACL", "SETUSER", "alice", ">pass", "%R~public/*", "~alice/*"}, "OK"},
+		{[]string{"ACL", "LIST"}, "[user admin +@admin user alice %R~public/* ~alice/*]"},
+		{[]string{"AUTH", "alice", "pass"}, "OK"},
+		{[]string{"ACL", "WHOAMI"}, "alice"},
+		{[]string{"ACL", "LIST"}, "NOPERM this user has no permissions to run the 'acl' command"},
+		{[]string{"GET", "public/1"}, "v1"},
+		{[]string{"GET", "secret/1"}, "NOPERM this user has no permissions to access one of the keys used as arguments"},
+		{[]string{"SET", "public/1", "x"}, "NOPERM this user has no permissions to access one of the keys used as arguments"},
+		{[]string{"MSET", "alice/1", "a", "secret/2", "b"}, "NOPERM this user has no permissions to access one of the keys used as arguments"},
+		{[]string{"SET", "alice/1", "a"}, "OK"},
+		{[]string{"SCAN", "0"}, "[0 [alice/1 public/1]]"},
+		{[]string{"QUIT"}, "OK"},
+	} {
+		if reply := do(c.args...); reply != c.expected {
+			t.Errorf("reply of %v not match %q, expected %q", c.args, reply, c.expected)
+		}
+	}
+	wg.Wait()
+}
+
+func TestHandleMemcached_ACL(t *testing.T) {
+	storage := createTestStorage(t)
+	defer storage.wal.Close()
+	acl, err := LoadACL(filepath.Join(tmpdir, "test.acl"))
+	if err != nil {
+		t.Fatal(err)
+	} else if err = acl.AddUser("alice", "pass", false); err != nil {
+		t.Fatal(err)
+	} else if err = acl.Grant("alice", "alice/", PermRead|PermWrite); err != nil {
+		t.Fatal(err)
+	}
+	storage.EnableACL(acl)
+
+	client, server := net.Pipe()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go HandleMemcached(server, server, storage, &wg)
+	defer client.Close()
+	r := bufio.NewReader(client)
+	do := func(cmd string) string {
+		t.Helper()
+		if _, err := client.Write([]byte(cmd)); err != nil {
+			t.Fatal(err)
+		}
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSuffix(line, "\r\n")
+	}
+
+	for _, c := range []struct {
+		cmd      string
+		expected string
+	}{
+		{"get alice/1\r\n", "CLIENT_ERROR unauthenticated"},
+		{"set auth 0 0 10\r\nalice pass\r\n", "STORED"},
+		{"set alice/1 0 0 1\r\na\r\n", "STORED"},
+		{"set bob/1 0 0 1\r\nb\r\n", "CLIENT_ERROR permission denied"},
+		{"get bob/1\r\n", "CLIENT_ERROR permission denied"},
+		{"delete bob/1\r\n", "CLIENT_ERROR permission denied"},
+	} {
+		if reply := do(c.cmd); reply != c.expected {
+			t.Errorf("reply of %q not match %q, expected %q", c.cmd, reply, c.expected)
+		}
+	}
+	client.Write([]byte("quit\r\n"))
+	wg.Wait()
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+	"runtime"
+	rpprof "runtime/pprof"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AdminServer serves operational endpoints over HTTP. If ACL is enabled, admin users are
+// required by basic authentication or "Authorization: Bearer <token>" except public endpoints
+// for monitoring. Otherwise the endpoints to read all records, to run maintenance or to diagnose
+// the process are served only to clients on the loopback address.
+type AdminServer struct {
+	// MinDiskFree is the disk headroom in bytes required by /readyz. 0 disables the check.
+	MinDiskFree int64
+	// DumpDir is the directory which /debug/dump writes profiles into. os.TempDir() if empty.
+	DumpDir string
+	// compacting is 1 while compaction started by /compact is running.
+	compacting int32
+	// recovery is the last progress of recovery reported by ReportRecovery.
+	recovery atomic.Pointer[RecoveryProgress]
+
+	mu  sync.RWMutex
+	s   *Storage
+	mux *http.ServeMux
+}
+
+// NewAdminServer creates the admin server of s. s may be nil while recovering, and only health
+// endpoints are served until SetStorage is called.
+func NewAdminServer(s *Storage) *AdminServer {
+	a := &AdminServer{s: s, mux: http.NewServeMux()}
+	a.mux.HandleFunc("/backup", a.backup)
+	a.mux.HandleFunc("/restore", a.restore)
+	a.mux.HandleFunc("/metrics", a.metrics)
+	a.mux.HandleFunc("/healthz", a.healthz)
+	a.mux.HandleFunc("/readyz", a.readyz)
+	a.mux.HandleFunc("/stats", a.stats)
+	a.mux.HandleFunc("/slowlog", a.slowlog)
+	a.mux.Handle("/debug/vars", expvar.Handler())
+	a.mux.HandleFunc("/debug/pprof/", pprof.Index)
+	a.mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	a.mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	a.mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	a.mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	a.mux.HandleFunc("/debug/dump", a.operation(func(s *Storage) (interface{}, error) {
+		return a.dump()
+	}))
+	a.mux.HandleFunc("/checkpoint", a.operation(func(s *Storage) (interface{}, error) {
+		if err := s.Checkpoint(); err != nil {
+			return nil, err
+		}
+		s.muWAL.Lock()
+		defer s.muWAL.Unlock()
+		return map[string]uint64{"version": s.version}, nil
+	}))
+	a.mux.HandleFunc("/rotate-wal", a.operation(func(s *Storage) (interface{}, error) {
+		path, err := s.RotateWAL()
+		return map[string]string{"archive": path}, err
+	}))
+	a.mux.HandleFunc("/drop-caches", a.operation(func(s *Storage) (interface{}, error) {
+		n, err := s.DropCaches()
+		return map[string]int{"evicted_pages": n}, err
+	}))
+	a.mux.HandleFunc("/compact", a.compact)
+	a.mux.HandleFunc("/verify", a.verify)
+	return a
+}
+
+// SetStorage serves s after recovered.
+func (a *AdminServer) SetStorage(s *Storage) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.s = s
+}
+
+// ReportRecovery reports the progress of recovery by /healthz and /readyz until SetStorage is
+// called. It is used as Options.RecoveryProgress.
+func (a *AdminServer) ReportRecovery(p RecoveryProgress) {
+	a.recovery.Store(&p)
+}
+
+func (a *AdminServer) storage() *Storage {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.s
+}
+
+// publicPaths are served without authentication for monitoring systems.
+var publicPaths = map[string]bool{
+	"/metrics": true,
+	"/healthz": true,
+	"/readyz":  true,
+}
+
+// localPaths are served only to clients on the loopback address if ACL is not enabled, because
+// they read all records, overwrite the store or block writers. Diagnostics under /debug/ are
+// served only to them too, because profiles expose the command line and memory of the process.
+var localPaths = map[string]bool{
+	"/backup":      true,
+	"/restore":     true,
+	"/checkpoint":  true,
+	"/rotate-wal":  true,
+	"/drop-caches": true,
+	"/compact":     true,
+	"/verify":      true,
+}
+
+// localOnly reports whether the path is served only to clients on the loopback address without ACL.
+func localOnly(path string) bool {
+	return localPaths[path] || strings.HasPrefix(path, "/debug/")
+}
+
+// isLoopback reports whether the remote address of the request is the loopback address.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// healthPaths are served while recovering.
+var healthPaths = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+}
+
+func (a *AdminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s := a.storage()
+	if s == nil {
+		if !healthPaths[r.URL.Path] {
+			http.Error(w, "recovery is not finished", http.StatusServiceUnavailable)
+			return
+		}
+	} else if acl := s.acl; acl != nil && !publicPaths[r.URL.Path] {
+		var (
+			name string
+			err  = ErrNoAuth
+		)
+		if user, password, ok := r.BasicAuth(); ok {
+			name, err = user, acl.Authenticate(user, password)
+		} else if token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); token != r.Header.Get("Authorization") {
+			name, err = acl.AuthenticateToken(token)
+		}
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="txngo"`)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		} else if !acl.IsAdmin(name) {
+			http.Error(w, ErrPermission.Error(), http.StatusForbidden)
+			return
+		}
+	} else if acl == nil && localOnly(r.URL.Path) && !isLoopback(r.RemoteAddr) {
+		http.Error(w, "ACL is required to access from remote address", http.StatusForbidden)
+		return
+	}
+	a.mux.ServeHTTP(w, r)
+}
+
+// backup streams the hot backup which is restored by /restore.
+func (a *AdminServer) backup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="txngo.backup"`)
+	s := a.storage()
+	if _, err := s.Backup(w); err != nil {
+		// the response may be already sent partially. the client detects it by the checksum.
+		s.logger().Error("failed to backup", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// restore loads the backup in the request body into the empty storage.
+func (a *AdminServer) restore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s := a.storage()
+	version, err := s.Restore(r.Body)
+	if errors.Is(err, ErrNotEmpty) || errors.Is(err, ErrReplica) || errors.Is(err, ErrFenced) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if errors.Is(err, ErrInvalidBackup) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		s.logger().Error("failed to restore", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.logger().Info("backup is restored", "version", version)
+	fmt.Fprintf(w, "restored version %d\n", version)
+}
+
+// metrics exports metrics in Prometheus text exposition format.
+func (a *AdminServer) metrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s := a.storage()
+	if err := s.WriteMetrics(w); err != nil {
+		s.logger().Error("failed to write metrics", "err", err)
+	}
+}
+
+// health returns the health of the storage, or not recovered if the storage is not set yet.
+func (a *AdminServer) health() Health {
+	if s := a.storage(); s != nil {
+		return s.Health()
+	}
+	return Health{DiskFree: -1, Recovery: a.recovery.Load()}
+}
+
+func writeHealth(w http.ResponseWriter, h Health, ok bool) {
+	code := http.StatusOK
+	if !ok {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, h)
+}
+
+// healthz is the liveness probe which fails only if WAL is not writable, because restarting
+// does not help recovery in progress or the full disk, where reads are still served.
+func (a *AdminServer) healthz(w http.ResponseWriter, r *http.Request) {
+	h := a.health()
+	writeHealth(w, h, !h.Recovered || h.WALWritable || h.DiskFull)
+}
+
+// readyz is the readiness probe which succeeds after recovery if WAL is writable and the disk
+// has enough headroom. the fenced primary and the storage read only by the full disk are not
+// ready because they reject commits.
+func (a *AdminServer) readyz(w http.ResponseWriter, r *http.Request) {
+	h := a.health()
+	ok := h.Recovered && h.WALWritable && !h.DiskFull && h.Role != "fenced"
+	if a.MinDiskFree > 0 && h.DiskFree >= 0 && h.DiskFree < a.MinDiskFree {
+		ok = false
+	}
+	writeHealth(w, h, ok)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// stats returns the snapshot of statistics as JSON.
+func (a *AdminServer) stats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, a.storage().Stats())
+}
+
+// slowlog dumps the slow log from the newest as JSON, up to "count" entries if given. DELETE
+// resets the slow log.
+func (a *AdminServer) slowlog(w http.ResponseWriter, r *http.Request) {
+	s := a.storage()
+	switch r.Method {
+	case http.MethodGet:
+		n := -1
+		if count := r.URL.Query().Get("count"); count != "" {
+			var err error
+			if n, err = strconv.Atoi(count); err != nil || n < 0 {
+				http.Error(w, "invalid count", http.StatusBadRequest)
+				return
+			}
+		}
+		entries := s.SlowLog(n)
+		if entries == nil {
+			entries = []SlowTxn{}
+		}
+		writeJSON(w, http.StatusOK, entries)
+	case http.MethodDelete:
+		s.ResetSlowLog()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// dump writes the stacks of all goroutines and the heap profile into DumpDir, and returns the
+// paths of them.
+func (a *AdminServer) dump() (map[string]string, error) {
+	dir := a.DumpDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	prefix := filepath.Join(dir, "txngo-"+time.Now().UTC().Format("20060102T150405.000000000Z"))
+	paths := map[string]string{
+		"goroutine": prefix + ".goroutine.txt",
+		"heap":      prefix + ".heap.pb.gz",
+	}
+	for name, path := range paths {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		// stacks are dumped in the same format as panics
+		debug := 0
+		if name == "goroutine" {
+			debug = 2
+		} else {
+			runtime.GC()
+		}
+		err = rpprof.Lookup(name).WriteTo(f, debug)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	logger().Info("profiles are dumped", "goroutine", paths["goroutine"], "heap", paths["heap"])
+	return paths, nil
+}
+
+// operation returns the handler which runs the maintenance operation by POST and responds its
+// result as JSON.
+func (a *AdminServer) operation(fn func(s *Storage) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s := a.storage()
+		result, err := fn(s)
+		if errors.Is(err, ErrNotSupported) {
+			http.Error(w, err.Error(), http.StatusNotImplemented)
+			return
+		} else if err != nil {
+			s.logger().Error("failed to run maintenance operation", "operation", strings.TrimPrefix(r.URL.Path, "/"), "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, result)
+	}
+}
+
+// compact starts compaction which merges all tables and drops tombstones in background.
+// Only one compaction runs at a time.
+func (a *AdminServer) compact(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s := a.storage()
+	if _, ok := tombstoneOf(s.db); !ok {
+		http.Error(w, fmt.Sprintf("%v : engine does not compact tables", ErrNotSupported), http.StatusNotImplemented)
+		return
+	} else if !atomic.CompareAndSwapInt32(&a.compacting, 0, 1) {
+		http.Error(w, "compaction is already running", http.StatusConflict)
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&a.compacting, 0)
+		if stats, err := s.GC(); err != nil {
+			s.logger().Error("failed to compact", "err", err)
+		} else {
+			s.logger().Info("compaction finished", "tombstones", stats.Tombstones, "reclaimed_bytes", stats.ReclaimedBytes)
+		}
+	}()
+	writeJSON(w, http.StatusAccepted, map[string]bool{"started": true})
+}
+
+// verify checks the consistency of the storage online and returns the report as JSON. It
+// responds 500 with the report if any problem is found.
+func (a *AdminServer) verify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	report, err := a.storage().Verify(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	code := http.StatusOK
+	if !report.OK() {
+		code = http.StatusInternalServerError
+	}
+	writeJSON(w, code, report)
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestAdminServer_Backup(t *testing.T) {
+	storage := createTestStorage(t)
+	defer storage.wal.Close()
+	for _, key := range []string{"key1", "key2", "key3"} {
+		if err := storage.Put(key, []byte("value of "+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := storage.Delete("key2"); err != nil {
+		t.Fatal(err)
+	}
+	acl, err := LoadACL(filepath.Join(tmpdir, "test.acl"))
+	if err != nil {
+		t.Fatal(err)
+	} else if err = acl.AddUser("root", "root", true); err != nil {
+		t.Fatal(err)
+	} else if err = acl.AddUser("alice", "secret", false); err != nil {
+		t.Fatal(err)
+	}
+	storage.EnableACL(acl)
+	srv := httptest.NewServer(NewAdminServer(storage))
+	defer srv.Close()
+
+	request := func(method, path, user, password string, body io.Reader) (int, []byte) {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+path, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		data, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.StatusCode, data
+	}
+
+	// only admin users can backup
+	if code, _ := request(http.MethodGet, "/backup", "", "", nil); code != http.StatusUnauthorized {
+		t.Errorf("backup without authentication : %v", code)
+	} else if code, _ = request(http.MethodGet, "/backup", "alice", "secret", nil); code != http.StatusForbidden {
+		t.Errorf("backup by non-admin user : %v", code)
+	}
+	code, backup := request(http.MethodGet, "/backup", "root", "root", nil)
+	if code != http.StatusOK {
+		t.Fatalf("failed to backup : %v %s", code, backup)
+	}
+
+	// the backup is restored only into the empty storage
+	if code, body := request(http.MethodPost, "/restore", "root", "root", bytes.NewReader(backup)); code != http.StatusConflict {
+		t.Errorf("restore into non-empty storage : %v %s", code, body)
+	}
+	restored := createTestReplica(t, "restored")
+	restored.EnableACL(acl)
+	srv2 := httptest.NewServer(NewAdminServer(restored))
+	defer srv2.Close()
+	srv = srv2
+	broken := append([]byte{}, backup...)
+	broken[len(broken)-5] ^= 0xff
+	if code, body := request(http.MethodPost, "/restore", "root", "root", bytes.NewReader(broken)); code != http.StatusBadRequest {
+		t.Errorf("restore broken backup : %v %s", code, body)
+	} else if code, body = request(http.MethodPost, "/restore", "root", "root", bytes.NewReader(backup)); code != http.StatusOK {
+		t.Fatalf("failed to restore : %v %s", code, body)
+	}
+	for _, key := range []string{"key1", "key3"} {
+		if v, err := restored.Get(key); err != nil || string(v) != "value of "+key {
+			t.Errorf("restored %v : %q %v", key, v, err)
+		}
+	}
+	if _, err = restored.Get("key2"); err != ErrNotExist {
+		t.Errorf("deleted key is restored : %v", err)
+	}
+	restored.muWAL.Lock()
+	version := restored.version
+	restored.muWAL.Unlock()
+	if version != 4 {
+		t.Errorf("restored version : %v", version)
+	}
+}
+
+func TestAdminServer_Health(t *testing.T) {
+	admin := NewAdminServer(nil)
+	srv := httptest.NewServer(admin)
+	defer srv.Close()
+	probe := func(path string) (int, Health) {
+		t.Helper()
+		res, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var h Health
+		if err = json.NewDecoder(res.Body).Decode(&h); err != nil {
+			t.Fatal(err)
+		}
+		return res.StatusCode, h
+	}
+
+	// alive but not ready while recovering
+	if code, h := probe("/healthz"); code != http.StatusOK || h.Recovered {
+		t.Errorf("liveness while recovering : %v %+v", code, h)
+	} else if code, h = probe("/readyz"); code != http.StatusServiceUnavailable || h.Recovered {
+		t.Errorf("readiness while recovering : %v %+v", code, h)
+	}
+	admin.ReportRecovery(RecoveryProgress{BytesReplayed: 10, TotalBytes: 100})
+	if _, h := probe("/readyz"); h.Recovery == nil || h.Recovery.BytesReplayed != 10 {
+		t.Errorf("progress of recovery : %+v", h.Recovery)
+	}
+	if res, err := http.Get(srv.URL + "/metrics"); err != nil {
+		t.Fatal(err)
+	} else if res.Body.Close(); res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("metrics while recovering : %v", res.StatusCode)
+	}
+
+	storage := createTestStorage(t)
+	defer storage.wal.Close()
+	admin.SetStorage(storage)
+	if code, h := probe("/readyz"); code != http.StatusOK || !h.Recovered || !h.WALWritable || h.Role != "primary" {
+		t.Errorf("readiness after recovery : %v %+v", code, h)
+	}
+
+	// the disk without enough headroom is not ready
+	admin.MinDiskFree = math.MaxInt64
+	if code, h := probe("/readyz"); h.DiskFree >= 0 && code != http.StatusServiceUnavailable {
+		t.Errorf("readiness without disk headroom : %v %+v", code, h)
+	}
+	admin.MinDiskFree = 0
+
+	// the fenced primary is not ready
+	if err := storage.EnableReplication(ReplicationOptions{Dir: filepath.Join(tmpdir, "replication")}); err != nil {
+		t.Fatal(err)
+	}
+	storage.repl.fence(0, 1)
+	if code, h := probe("/readyz"); code != http.StatusServiceUnavailable || h.Role != "fenced" {
+		t.Errorf("readiness of fenced primary : %v %+v", code, h)
+	}
+
+	// failure of WAL makes the server not alive
+	storage.wal.Close()
+	if err := storage.SaveWAL([]RecordLog{{Action: LInsert, Record: Record{Key: "key1"}}}); err == nil {
+		t.Fatal("write to closed WAL succeeds")
+	}
+	if code, h := probe("/healthz"); code != http.StatusServiceUnavailable || h.WALWritable || h.WALError == "" {
+		t.Errorf("liveness after failure of WAL : %v %+v", code, h)
+	}
+}
+
+func TestAdminServer_Maintenance(t *testing.T) {
+	for _, engine := range []string{"map", "btree", "lsm"} {
+		t.Run(engine, func(t *testing.T) {
+			_ = os.RemoveAll(tmpdir)
+			_ = os.MkdirAll(tmpdir, 0777)
+			storage, err := Open(Options{WALPath: testWALPath, DBPath: testDBPath, Backend: engine, CachePages: defaultCachePages})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer storage.db.Close()
+			defer storage.wal.Close()
+			admin := NewAdminServer(storage)
+			srv := httptest.NewServer(admin)
+			defer srv.Close()
+			post := func(path string, v interface{}) int {
+				t.Helper()
+				res, err := http.Post(srv.URL+path, "application/json", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer res.Body.Close()
+				if res.StatusCode < 300 {
+					if err = json.NewDecoder(res.Body).Decode(v); err != nil {
+						t.Fatal(err)
+					}
+				}
+				return res.StatusCode
+			}
+			for i := 0; i < 10; i++ {
+				if err = storage.Put(fmt.Sprintf("key%d", i), []byte("value")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err = storage.Delete("key0"); err != nil {
+				t.Fatal(err)
+			}
+
+			var checkpoint map[string]uint64
+			if code := post("/checkpoint", &checkpoint); code != http.StatusOK || checkpoint["version"] != 11 {
+				t.Errorf("checkpoint : %v %v", code, checkpoint)
+			}
+			if err = storage.Put("key10", []byte("value")); err != nil {
+				t.Fatal(err)
+			}
+			var rotate map[string]string
+			if code := post("/rotate-wal", &rotate); code != http.StatusOK {
+				t.Fatalf("rotate WAL : %v", code)
+			} else if info, err := os.Stat(rotate["archive"]); err != nil || info.Size() == 0 {
+				t.Errorf("archive of WAL : %v %v", rotate, err)
+			} else if storage.Stats().WALSize != 0 {
+				t.Errorf("WAL is not cleared")
+			}
+
+			var evicted map[string]int
+			code := post("/drop-caches", &evicted)
+			if engine == "btree" && (code != http.StatusOK || evicted["evicted_pages"] == 0) {
+				t.Errorf("drop caches : %v %v", code, evicted)
+			} else if engine != "btree" && code != http.StatusNotImplemented {
+				t.Errorf("drop caches of %v engine : %v", engine, code)
+			}
+			var started map[string]bool
+			code = post("/compact", &started)
+			if engine == "lsm" && code != http.StatusAccepted {
+				t.Errorf("compact : %v", code)
+			} else if engine != "lsm" && code != http.StatusNotImplemented {
+				t.Errorf("compact %v engine : %v", engine, code)
+			}
+			waitRaft(t, "compaction finishes", func() bool { return atomic.LoadInt32(&admin.compacting) == 0 })
+
+			res, err := http.Get(srv.URL + "/stats")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			var stats Stats
+			if err = json.NewDecoder(res.Body).Decode(&stats); err != nil {
+				t.Fatal(err)
+			} else if stats.Version != 12 || stats.Keys != 10 || stats.Commits != 12 {
+				t.Errorf("stats : %+v", stats)
+			}
+
+			vres, err := http.Get(srv.URL + "/verify")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer vres.Body.Close()
+			var report VerifyReport
+			if err = json.NewDecoder(vres.Body).Decode(&report); err != nil {
+				t.Fatal(err)
+			} else if vres.StatusCode != http.StatusOK || !report.OK() || report.Records != 10 {
+				t.Errorf("verify : %v %+v", vres.StatusCode, report)
+			}
+			for i := 1; i <= 10; i++ {
+				if v, err := storage.Get(fmt.Sprintf("key%d", i)); err != nil || string(v) != "value" {
+					t.Errorf("key%d after maintenance : %q %v", i, v, err)
+				}
+			}
+		})
+	}
+}
+
+func TestAdminServer_Debug(t *testing.T) {
+	storage := createTestStorage(t)
+	defer storage.wal.Close()
+	acl, err := LoadACL(filepath.Join(tmpdir, "test.acl"))
+	if err != nil {
+		t.Fatal(err)
+	} else if err = acl.AddUser("root", "root", true); err != nil {
+		t.Fatal(err)
+	}
+	storage.EnableACL(acl)
+	admin := NewAdminServer(storage)
+	admin.DumpDir = tmpdir
+	srv := httptest.NewServer(admin)
+	defer srv.Close()
+	request := func(method, path string, auth bool) (int, []byte) {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if auth {
+			req.SetBasicAuth("root", "root")
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.StatusCode, body
+	}
+
+	if code, _ := request(http.MethodGet, "/debug/pprof/", false); code != http.StatusUnauthorized {
+		t.Errorf("pprof without authentication : %v", code)
+	} else if code, body := request(http.MethodGet, "/debug/pprof/", true); code != http.StatusOK || !bytes.Contains(body, []byte("goroutine")) {
+		t.Errorf("pprof index : %v %s", code, body)
+	} else if code, body = request(http.MethodGet, "/debug/pprof/goroutine?debug=1", true); code != http.StatusOK || !bytes.Contains(body, []byte("goroutine profile")) {
+		t.Errorf("goroutine profile : %v %s", code, body)
+	}
+
+	code, body := request(http.MethodPost, "/debug/dump", true)
+	var paths map[string]string
+	if code != http.StatusOK {
+		t.Fatalf("dump : %v %s", code, body)
+	} else if err = json.Unmarshal(body, &paths); err != nil {
+		t.Fatal(err)
+	}
+	if stacks, err := os.ReadFile(paths["goroutine"]); err != nil || !bytes.Contains(stacks, []byte("goroutine ")) || filepath.Dir(paths["goroutine"]) != tmpdir {
+		t.Errorf("dump of goroutines : %v %v", paths, err)
+	} else if info, err := os.Stat(paths["heap"]); err != nil || info.Size() == 0 {
+		t.Errorf("dump of heap : %v %v", paths, err)
+	}
+}
+
+func TestAdminServer_Remote(t *testing.T) {
+	storage := createTestStorage(t)
+	defer storage.wal.Close()
+	admin := NewAdminServer(storage)
+	serve := func(method, path, remote string, user string) int {
+		t.Helper()
+		req := httptest.NewRequest(method, path, nil)
+		req.RemoteAddr = remote
+		if user != "" {
+			req.SetBasicAuth(user, user)
+		}
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, req)
+		return w.Code
+	}
+	for _, path := range []string{"/backup", "/restore", "/checkpoint", "/rotate-wal", "/drop-caches", "/compact", "/verify", "/debug/vars", "/debug/pprof/", "/debug/pprof/cmdline", "/debug/dump"} {
+		if code := serve(http.MethodPost, path, "192.0.2.1:1234", ""); code != http.StatusForbidden {
+			t.Errorf("%v from remote without ACL : %v", path, code)
+		}
+	}
+	if code := serve(http.MethodGet, "/metrics", "192.0.2.1:1234", ""); code != http.StatusOK {
+		t.Errorf("/metrics from remote : %v", code)
+	}
+	for _, remote := range []string{"127.0.0.1:1234", "[::1]:1234"} {
+		if code := serve(http.MethodPost, "/checkpoint", remote, ""); code != http.StatusOK {
+			t.Errorf("/checkpoint from %v : %v", remote, code)
+		} else if code = serve(http.MethodGet, "/debug/pprof/cmdline", remote, ""); code != http.StatusOK {
+			t.Errorf("/debug/pprof/cmdline from %v : %v", remote, code)
+		}
+	}
+
+	acl, err := LoadACL(filepath.Join(tmpdir, "test.acl"))
+	if err != nil {
+		t.Fatal(err)
+	} else if err = acl.AddUser("root", "root", true); err != nil {
+		t.Fatal(err)
+	}
+	storage.EnableACL(acl)
+	if code := serve(http.MethodPost, "/checkpoint", "192.0.2.1:1234", "root"); code != http.StatusOK {
+		t.Errorf("/checkpoint from remote by admin : %v", code)
+	} else if code = serve(http.MethodPost, "/checkpoint", "192.0.2.1:1234", ""); code != http.StatusUnauthorized {
+		t.Errorf("/checkpoint from remote without auth : %v", code)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrOverloaded is returned by commits rejected by the admission control while WAL is not synced
+// or checkpointed fast enough. The transaction is still active, and can be retried or aborted.
+var ErrOverloaded = errors.New("storage is overloaded")
+
+// Overload policies decide how commits over the limits of AdmissionOptions wait.
+const (
+	// OverloadBlock waits until the commit is admitted. It is the default.
+	OverloadBlock = "block"
+	// OverloadTimeout waits up to AdmissionOptions.Timeout, and fails with ErrOverloaded.
+	OverloadTimeout = "timeout"
+	// OverloadReject fails with ErrOverloaded immediately.
+	OverloadReject = "reject"
+)
+
+// AdmissionOptions is the limits of commits in flight, so that memory and latency of commits do
+// not grow without bound while the syncer of CommitAsync or checkpoint falls behind. 0 disables
+// each limit.
+type AdmissionOptions struct {
+	// MaxPending is the number of commits writing WAL or waiting for the lock of WAL, and async
+	// commits waiting for the sync of WAL.
+	MaxPending int
+	// MaxWALSize is the WAL size in bytes beyond which commits wait for checkpoint to truncate
+	// it. It requires checkpoint by CheckpointSize or CheckpointInterval.
+	MaxWALSize int64
+	// Policy is OverloadBlock, OverloadTimeout or OverloadReject. OverloadBlock if empty.
+	Policy  string
+	Timeout time.Duration
+}
+
+// validate returns error if the policy is not supported.
+func (opts *AdmissionOptions) validate() error {
+	switch opts.Policy {
+	case "", OverloadBlock, OverloadReject:
+	case OverloadTimeout:
+		if opts.Timeout <= 0 {
+			return errors.New("timeout of overload policy must be positive")
+		}
+	default:
+		return fmt.Errorf("overload policy is not supported : %v", opts.Policy)
+	}
+	return nil
+}
+
+// admission counts commits in flight for the admission control.
+type admission struct {
+	opts AdmissionOptions
+	// walSize mirrors Storage.walSize to be read without muWAL.
+	walSize atomic.Int64
+	// mu protects writing, unsynced and wake. writing is the number of admitted commits which
+	// have not returned, and unsynced is the number of async commits waiting for the syncer.
+	// wake is closed and renewed when they decrease or WAL is truncated.
+	mu       sync.Mutex
+	writing  int
+	unsynced int
+	wake     chan struct{}
+}
+
+// full returns true if the next commit is over the limits. It must be called with mu locked.
+func (a *admission) full() bool {
+	return (a.opts.MaxPending > 0 && a.writing+a.unsynced >= a.opts.MaxPending) ||
+		(a.opts.MaxWALSize > 0 && a.walSize.Load() >= a.opts.MaxWALSize)
+}
+
+// notify wakes up commits waiting for admission. It must be called with mu locked.
+func (a *admission) notify() {
+	if a.wake != nil {
+		close(a.wake)
+		a.wake = nil
+	}
+}
+
+// admit waits until the commit is admitted by the overload policy, and the caller must call
+// finishCommit after the commit returns. It returns ErrOverloaded if the commit is rejected.
+func (s *Storage) admit() error {
+	a := &s.admission
+	if a.opts.MaxPending <= 0 && a.opts.MaxWALSize <= 0 {
+		return nil
+	}
+	var timeout <-chan time.Time
+	a.mu.Lock()
+	for a.full() {
+		if a.opts.Policy == OverloadReject {
+			a.mu.Unlock()
+			s.metrics.rejected.Inc()
+			return ErrOverloaded
+		} else if timeout == nil {
+			s.metrics.throttled.Inc()
+			if a.opts.Policy == OverloadTimeout {
+				timer := time.NewTimer(a.opts.Timeout)
+				defer timer.Stop()
+				timeout = timer.C
+			}
+		}
+		if a.wake == nil {
+			a.wake = make(chan struct{})
+		}
+		wake := a.wake
+		a.mu.Unlock()
+		select {
+		case <-wake:
+		case <-timeout:
+			s.metrics.rejected.Inc()
+			return ErrOverloaded
+		}
+		a.mu.Lock()
+	}
+	a.writing++
+	a.mu.Unlock()
+	return nil
+}
+
+// finishCommit releases the commit admitted by admit.
+func (s *Storage) finishCommit() {
+	a := &s.admission
+	if a.opts.MaxPending <= 0 && a.opts.MaxWALSize <= 0 {
+		return
+	}
+	a.mu.Lock()
+	a.writing--
+	a.notify()
+	a.mu.Unlock()
+}
+
+// trackUnsynced records the number of async commits waiting for the syncer. It must be called
+// with muWAL locked when Storage.unsynced changes.
+func (s *Storage) trackUnsynced(n int) {
+	a := &s.admission
+	if a.opts.MaxPending <= 0 {
+		return
+	}
+	a.mu.Lock()
+	if n < a.unsynced {
+		a.notify()
+	}
+	a.unsynced = n
+	a.mu.Unlock()
+}
+
+// trackWALSize records the size of WAL. It must be called with muWAL locked when WAL is written
+// or truncated.
+func (s *Storage) trackWALSize() {
+	a := &s.admission
+	if a.opts.MaxWALSize <= 0 {
+		return
+	}
+	if old := a.walSize.Swap(s.walSize); s.walSize < old {
+		a.mu.Lock()
+		a.notify()
+		a.mu.Unlock()
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// openAdmission opens the storage with the admission control of opts.
+func openAdmission(t *testing.T, opts AdmissionOptions) *Storage {
+	t.Helper()
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	storage, err := Open(Options{WALPath: testWALPath, DBPath: testDBPath, Admission: opts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storage
+}
+
+// setUnsynced pretends that n async commits are waiting for the syncer.
+func setUnsynced(s *Storage, n int) {
+	s.muWAL.Lock()
+	s.trackUnsynced(n)
+	s.muWAL.Unlock()
+}
+
+func TestStorage_admit(t *testing.T) {
+	t.Run("reject", func(t *testing.T) {
+		storage := openAdmission(t, AdmissionOptions{MaxPending: 1, Policy: OverloadReject})
+		defer storage.Close()
+		setUnsynced(storage, 1)
+		if err := storage.Put("key1", []byte("value")); err != ErrOverloaded {
+			t.Errorf("commit while overloaded : %v", err)
+		} else if _, err = storage.Get("key1"); err != ErrNotExist {
+			t.Errorf("rejected commit is applied : %v", err)
+		}
+
+		// the rejected transaction is retried
+		txn := storage.NewTxn()
+		if err := txn.Put("key1", []byte("value")); err != nil {
+			t.Fatal(err)
+		} else if err = txn.Commit(); err != ErrOverloaded {
+			t.Errorf("commit while overloaded : %v", err)
+		}
+		setUnsynced(storage, 0)
+		if err := txn.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		txn = storage.NewTxn()
+		assertValue(t, txn, "key1", []byte("value"))
+		txn.Abort()
+		if v := storage.metrics.rejected.Value(); v != 2 {
+			t.Errorf("rejected %v commits", v)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		storage := openAdmission(t, AdmissionOptions{MaxPending: 1, Policy: OverloadTimeout, Timeout: 20 * time.Millisecond})
+		defer storage.Close()
+		setUnsynced(storage, 1)
+		start := time.Now()
+		if err := storage.Put("key1", []byte("value")); err != ErrOverloaded {
+			t.Errorf("commit while overloaded : %v", err)
+		} else if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+			t.Errorf("rejected after %v", elapsed)
+		}
+	})
+
+	t.Run("block", func(t *testing.T) {
+		storage := openAdmission(t, AdmissionOptions{MaxPending: 1})
+		defer storage.Close()
+		setUnsynced(storage, 1)
+		done := make(chan error)
+		go func() { done <- storage.Put("key1", []byte("value")) }()
+		select {
+		case err := <-done:
+			t.Fatalf("commit is not blocked : %v", err)
+		case <-time.After(20 * time.Millisecond):
+		}
+		// the sync of async commits admits the commit
+		setUnsynced(storage, 0)
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		} else if v := storage.metrics.throttled.Value(); v != 1 {
+			t.Errorf("throttled %v commits", v)
+		}
+	})
+
+	t.Run("async", func(t *testing.T) {
+		storage := openAdmission(t, AdmissionOptions{MaxPending: 2})
+		defer storage.Close()
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				txn := storage.NewTxn()
+				if err := txn.Put(fmt.Sprintf("key%v", i), []byte("value")); err != nil {
+					t.Error(err)
+				} else if f, err := txn.CommitAsync(); err != nil {
+					t.Error(err)
+				} else if err = f.Wait(); err != nil {
+					t.Error(err)
+				}
+			}(i)
+		}
+		wg.Wait()
+		storage.admission.mu.Lock()
+		defer storage.admission.mu.Unlock()
+		if storage.admission.writing != 0 || storage.admission.unsynced != 0 {
+			t.Errorf("%v writing and %v unsynced commits are left", storage.admission.writing, storage.admission.unsynced)
+		}
+	})
+}
+
+func TestStorage_admitWALSize(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	opts := Options{WALPath: testWALPath, DBPath: testDBPath, Admission: AdmissionOptions{MaxWALSize: 1}}
+	if _, err := Open(opts); err == nil {
+		t.Fatal("max WAL size without checkpoint is opened")
+	}
+	opts.Admission.Policy = "drop"
+	opts.CheckpointInterval = 10 * time.Millisecond
+	if _, err := Open(opts); err == nil {
+		t.Fatal("unsupported overload policy is opened")
+	}
+	opts.Admission.Policy = ""
+	storage, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	// the second commit waits for the background checkpoint to truncate WAL
+	for i := 0; i < 2; i++ {
+		if err = storage.Put(fmt.Sprintf("key%v", i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v := storage.metrics.throttled.Value(); v != 1 {
+		t.Errorf("throttled %v commits", v)
+	}
+}
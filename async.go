@@ -0,0 +1,165 @@
+package main
+
+import "time"
+
+// Durability is the durability level of commits of the transaction set by Txn.SetDurability.
+type Durability int
+
+const (
+	// Durable syncs WAL before Commit returns, unless WAL is synced only at checkpoint by
+	// SyncNone or DisableWAL. It is the default.
+	Durable Durability = iota
+	// Lazy returns from Commit after logs are written into WAL and applied, and leaves the sync
+	// to the syncer of CommitAsync. The commit is lost by the crash before the sync, but never
+	// partially nor after the following Durable commit returns, because WAL is written in order.
+	Lazy
+)
+
+// SetDurability sets the durability level of commits of the transaction. It is kept when the
+// transaction is reused after Commit or Abort. The prepared transaction and the transaction
+// replicated by Raft are always committed as Durable.
+func (txn *Txn) SetDurability(d Durability) {
+	txn.durability = d
+}
+
+// CommitFuture is the commit acknowledged by CommitAsync before it is durable.
+type CommitFuture struct {
+	done chan struct{}
+	// err is the error of syncing WAL, which is set before done is closed.
+	err error
+}
+
+func newCommitFuture() *CommitFuture {
+	return &CommitFuture{done: make(chan struct{})}
+}
+
+// Done returns the channel closed when the commit is durable or failed to be synced.
+func (f *CommitFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait waits until WAL having the commit is synced, and returns the error of the sync. The commit
+// failed is still applied, and may be lost by the crash.
+func (f *CommitFuture) Wait() error {
+	<-f.done
+	return f.err
+}
+
+func (f *CommitFuture) resolve(err error) {
+	f.err = err
+	close(f.done)
+}
+
+// CommitAsync commits the transaction as Commit without waiting for the fsync of WAL, and returns
+// the future which is done when the commit is durable. Locks are released after logs are written
+// into WAL and applied, so that other transactions read the records before they are durable and
+// the commit is lost by the crash until the future is done. WAL is synced in background by one
+// fsync for all commits written meanwhile. The commit is also durable by the fsync of the
+// following Commit or by checkpoint, which is the only sync of SyncNone and DisableWAL.
+//
+// The prepared transaction and the transaction replicated by Raft are committed synchronously,
+// and the future returned is already done.
+func (txn *Txn) CommitAsync() (*CommitFuture, error) {
+	future := newCommitFuture()
+	if txn.gid != "" || txn.s.raft != nil {
+		if err := txn.commit(nil); err != nil {
+			return nil, err
+		}
+		future.resolve(nil)
+		return future, nil
+	}
+	if err := txn.commit(future); err != nil {
+		return nil, err
+	}
+	return future, nil
+}
+
+// deferSync registers the future of the commit written into WAL without sync, and wakes up the
+// syncer which is started at the first call. It must be called with muWAL locked.
+func (s *Storage) deferSync(future *CommitFuture) {
+	s.unsynced = append(s.unsynced, future)
+	if s.opts.DisableWAL || s.opts.SyncMode == SyncNone {
+		// WAL is synced only at checkpoint
+		return
+	}
+	s.trackUnsynced(len(s.unsynced))
+	if s.wakeSyncer == nil {
+		s.wakeSyncer, s.stopSyncer, s.syncerDone = make(chan struct{}, 1), make(chan struct{}), make(chan struct{})
+		go s.runSyncer(s.wakeSyncer, s.stopSyncer, s.syncerDone)
+	}
+	select {
+	case s.wakeSyncer <- struct{}{}:
+	default:
+		// the syncer is already woken up and takes this commit
+	}
+}
+
+// runSyncer syncs WAL each time it is woken up while commits are unsynced. WAL is synced without
+// muWAL so that commits are written during the fsync and synced together by the next one.
+func (s *Storage) runSyncer(wake, stop, done chan struct{}) {
+	defer close(done)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-wake:
+		}
+		s.muWAL.Lock()
+		futures, version := s.unsynced, s.version
+		s.unsynced = nil
+		s.trackUnsynced(0)
+		s.muWAL.Unlock()
+		if len(futures) == 0 {
+			// synced by Commit or checkpoint
+			continue
+		}
+
+		start := time.Now()
+		err := s.wal.Sync()
+		s.muWAL.Lock()
+		if err != nil {
+			s.walErr = err
+			s.logger().Error("failed to sync WAL of async commits", "commits", len(futures), "err", err)
+		} else {
+			s.observeFsync(time.Since(start))
+			if s.repl != nil {
+				s.repl.notify(version)
+			}
+		}
+		s.muWAL.Unlock()
+		for _, f := range futures {
+			f.resolve(err)
+		}
+	}
+}
+
+// stopSyncing stops the syncer if it is started. Unsynced commits are left to Shutdown.
+func (s *Storage) stopSyncing() {
+	s.muWAL.Lock()
+	stop, done := s.stopSyncer, s.syncerDone
+	s.muWAL.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// resolveUnsynced finishes all unsynced commits with err. Replicas are notified of them if they
+// are synced. It must be called with muWAL locked.
+func (s *Storage) resolveUnsynced(err error) {
+	if err == nil && len(s.unsynced) > 0 && s.repl != nil {
+		s.repl.notify(s.version)
+	}
+	for _, f := range s.unsynced {
+		f.resolve(err)
+	}
+	s.unsynced = nil
+	s.trackUnsynced(0)
+}
+
+// observeFsync records the latency of fsync of WAL. It must be called with muWAL locked.
+func (s *Storage) observeFsync(latency time.Duration) {
+	s.lastFsync = latency
+	s.metrics.fsync.observe(latency)
+	s.metrics.fsyncHist.ObserveDuration(latency)
+}
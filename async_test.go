@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+// gateFile blocks Sync until the gate is opened, and counts syncs.
+type gateFile struct {
+	File
+	gate  chan struct{}
+	err   error
+	syncs atomic.Int32
+}
+
+func (f *gateFile) Sync() error {
+	<-f.gate
+	f.syncs.Add(1)
+	if f.err != nil {
+		return f.err
+	}
+	return f.File.Sync()
+}
+
+// commitAsync puts the value by CommitAsync and returns the future.
+func commitAsync(t *testing.T, storage *Storage, key, value string) *CommitFuture {
+	t.Helper()
+	txn := storage.NewTxn()
+	if err := txn.Put(key, []byte(value)); err != nil {
+		t.Fatal(err)
+	}
+	future, err := txn.CommitAsync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return future
+}
+
+// isDone returns true if the future is done.
+func isDone(f *CommitFuture) bool {
+	select {
+	case <-f.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+func TestTxn_CommitAsync(t *testing.T) {
+	storage := createTestStorage(t)
+	wal := &gateFile{File: storage.wal, gate: make(chan struct{})}
+	storage.wal = wal
+	defer storage.Close()
+
+	// the syncer is blocked by the fsync of the first commit
+	futures := []*CommitFuture{commitAsync(t, storage, "key0", "value")}
+	for i := 1; i < 10; i++ {
+		futures = append(futures, commitAsync(t, storage, fmt.Sprintf("key%d", i), "value"))
+	}
+	// records are applied before they are durable
+	txn := storage.NewTxn()
+	for i := 0; i < 10; i++ {
+		assertValue(t, txn, fmt.Sprintf("key%d", i), []byte("value"))
+	}
+	txn.Abort()
+	for i, f := range futures {
+		if isDone(f) {
+			t.Errorf("commit %v is done before WAL is synced", i)
+		}
+	}
+
+	close(wal.gate)
+	for i, f := range futures {
+		if err := f.Wait(); err != nil {
+			t.Errorf("failed to sync commit %v : %v", i, err)
+		}
+	}
+	// commits written during the fsync of the first one are synced together
+	if syncs := wal.syncs.Load(); syncs < 1 || syncs > 2 {
+		t.Errorf("WAL is synced %v times for %v commits", syncs, len(futures))
+	}
+}
+
+func TestTxn_CommitAsync_SyncNone(t *testing.T) {
+	storage := createTestStorage(t)
+	storage.opts.SyncMode = SyncNone
+
+	// commits are durable only at checkpoint
+	future := commitAsync(t, storage, "key1", "value1")
+	if storage.wakeSyncer != nil || isDone(future) {
+		t.Errorf("WAL is synced by the syncer")
+	} else if err := storage.Checkpoint(); err != nil {
+		t.Fatal(err)
+	} else if err = future.Wait(); err != nil {
+		t.Errorf("failed to sync by checkpoint : %v", err)
+	}
+
+	future = commitAsync(t, storage, "key2", "value2")
+	if err := storage.Close(); err != nil {
+		t.Fatal(err)
+	} else if err = future.Wait(); err != nil {
+		t.Errorf("failed to sync by Close : %v", err)
+	}
+}
+
+func TestTxn_CommitAsync_SyncError(t *testing.T) {
+	storage := createTestStorage(t)
+	errSync := errors.New("sync")
+	gate := make(chan struct{})
+	close(gate)
+	storage.wal = &gateFile{File: storage.wal, gate: gate, err: errSync}
+	defer storage.wal.Close()
+
+	future := commitAsync(t, storage, "key1", "value1")
+	if err := future.Wait(); err != errSync {
+		t.Errorf("error of sync : %v", err)
+	}
+	storage.stopSyncing()
+	if storage.walErr != errSync {
+		t.Errorf("error of WAL : %v", storage.walErr)
+	}
+}
+
+func TestTxn_CommitAsync_Prepared(t *testing.T) {
+	storage := createTestStorage(t)
+	defer storage.Close()
+	txn := storage.NewTxn()
+	if err := txn.Put("key1", []byte("value1")); err != nil {
+		t.Fatal(err)
+	} else if err = txn.Prepare("gid1"); err != nil {
+		t.Fatal(err)
+	}
+	// the prepared transaction is committed synchronously
+	future, err := txn.CommitAsync()
+	if err != nil {
+		t.Fatal(err)
+	} else if !isDone(future) {
+		t.Errorf("commit of the prepared transaction is not done")
+	}
+	txn = storage.NewTxn()
+	defer txn.Abort()
+	assertValue(t, txn, "key1", []byte("value1"))
+}
+
+func TestTxn_CommitAsync_Replication(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	storage, err := Open(Options{WALPath: testWALPath, DBPath: testDBPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	if err = storage.EnableReplication(ReplicationOptions{Dir: filepath.Join(tmpdir, "replication")}); err != nil {
+		t.Fatal(err)
+	}
+	wal := &gateFile{File: storage.wal, gate: make(chan struct{})}
+	storage.wal = wal
+	durable := func() uint64 {
+		storage.repl.mu.RLock()
+		defer storage.repl.mu.RUnlock()
+		return storage.repl.durable
+	}
+
+	// followers do not read the commit until it is synced
+	future := commitAsync(t, storage, "key1", "value1")
+	if v := durable(); v != 0 {
+		t.Errorf("durable version before sync : %v", v)
+	}
+	close(wal.gate)
+	if err = future.Wait(); err != nil {
+		t.Fatal(err)
+	} else if v := durable(); v != 1 {
+		t.Errorf("durable version after sync : %v", v)
+	}
+}
+
+func TestTxn_SetDurability(t *testing.T) {
+	storage := createTestStorage(t)
+	wal := &gateFile{File: storage.wal, gate: make(chan struct{})}
+	storage.wal = wal
+	defer storage.Close()
+
+	// lazy commits return while the sync is blocked, and the level is kept after Commit
+	txn := storage.NewTxn()
+	txn.SetDurability(Lazy)
+	for i := 0; i < 3; i++ {
+		if err := txn.Put(fmt.Sprintf("key%d", i), []byte("lazy")); err != nil {
+			t.Fatal(err)
+		} else if err = txn.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the durable commit syncs lazy commits written before
+	close(wal.gate)
+	durable := storage.NewTxn()
+	if err := durable.Put("key3", []byte("durable")); err != nil {
+		t.Fatal(err)
+	} else if err = durable.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	storage.muWAL.Lock()
+	defer storage.muWAL.Unlock()
+	if len(storage.unsynced) != 0 {
+		t.Errorf("%v lazy commits are not synced by the durable commit", len(storage.unsynced))
+	}
+}
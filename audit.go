@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// auditHeadKey keeps "<seq> <hash>" of the last audit entry, written by the same WAL write as
+// the transaction, so that truncation of the audit log is detected.
+const auditHeadKey = internalPrefix + "audit"
+
+var ErrAuditBroken = errors.New("audit log is broken")
+
+// AuditEntry is the entry of the audit log for each committed transaction.
+type AuditEntry struct {
+	// Seq is the sequence number of the entry starting from 1.
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+	// Actor is the client which commits the transaction such as "user@addr".
+	Actor   string       `json:"actor"`
+	Version uint64       `json:"version"`
+	Writes  []AuditWrite `json:"writes"`
+	// Prev is the hash of the previous entry, and Hash is the SHA-256 of this entry with empty
+	// Hash in hex.
+	Prev string `json:"prev"`
+	Hash string `json:"hash"`
+}
+
+// AuditWrite is the write of the key. The value is recorded only by its hash.
+type AuditWrite struct {
+	Key string `json:"key"`
+	// Op is "set" or "del".
+	Op        string `json:"op"`
+	ValueHash string `json:"value_sha256,omitempty"`
+}
+
+func (e *AuditEntry) hash() string {
+	h := *e
+	h.Hash = ""
+	b, _ := json.Marshal(&h)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// AuditLog appends hash chained entries of committed transactions to the file. Commits fail if
+// the entry can not be written. Commits replicated by Raft are not audited yet.
+type AuditLog struct {
+	f    *os.File
+	sync bool
+	// seq and prev are the sequence number and the hash of the last entry. protected by
+	// Storage.muWAL after enabled.
+	seq  uint64
+	prev string
+}
+
+// OpenAuditLog verifies the audit log at path and opens it to append entries. If sync is true,
+// each entry is synced before the transaction is written into WAL.
+func OpenAuditLog(path string, sync bool) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	last, err := VerifyAuditLog(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &AuditLog{f: f, sync: sync, seq: last.Seq, prev: last.Hash}, nil
+}
+
+// VerifyAuditLog checks the hash chain of all entries in r, and returns the last entry.
+func VerifyAuditLog(r io.Reader) (AuditEntry, error) {
+	var (
+		last    AuditEntry
+		scanner = bufio.NewScanner(r)
+	)
+	scanner.Buffer(nil, 1<<30)
+	for scanner.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return last, fmt.Errorf("%w : entry after seq %d : %v", ErrAuditBroken, last.Seq, err)
+		} else if e.Seq != last.Seq+1 || e.Prev != last.Hash || e.Hash != e.hash() {
+			return last, fmt.Errorf("%w : entry of seq %d does not chain to seq %d", ErrAuditBroken, e.Seq, last.Seq)
+		}
+		last = e
+	}
+	return last, scanner.Err()
+}
+
+func (a *AuditLog) Close() error {
+	return a.f.Close()
+}
+
+// EnableAudit starts recording commits into the audit log. It fails if the audit log does not
+// contain the last entry recorded by the storage, which means the audit log is truncated or
+// replaced. Entries after it are of commits which failed to be written into WAL.
+func (s *Storage) EnableAudit(a *AuditLog) error {
+	// if the storage recorded no entry, all entries are of failed commits.
+	if head, err := s.Get(auditHeadKey); err != nil && err != ErrNotExist {
+		return err
+	} else if err == nil {
+		if err = a.contains(string(head)); err != nil {
+			return err
+		}
+	}
+	s.muWAL.Lock()
+	defer s.muWAL.Unlock()
+	s.audit = a
+	return nil
+}
+
+// contains checks that the entry of head is in the audit log.
+func (a *AuditLog) contains(head string) error {
+	var (
+		seq  uint64
+		hash string
+	)
+	if _, err := fmt.Sscanf(head, "%d %s", &seq, &hash); err != nil {
+		return fmt.Errorf("%w : invalid head %q", ErrAuditBroken, head)
+	} else if seq > a.seq {
+		return fmt.Errorf("%w : storage recorded seq %d but audit log has %d entries", ErrAuditBroken, seq, a.seq)
+	} else if seq == a.seq {
+		if hash != a.prev {
+			return fmt.Errorf("%w : last entry of seq %d is replaced", ErrAuditBroken, seq)
+		}
+		return nil
+	}
+	f, err := os.Open(a.f.Name())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<30)
+	for scanner.Scan() {
+		var e AuditEntry
+		if err = json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return err
+		} else if e.Seq == seq {
+			if e.Hash != hash {
+				return fmt.Errorf("%w : entry of seq %d is replaced", ErrAuditBroken, seq)
+			}
+			return nil
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("%w : entry of seq %d is not found", ErrAuditBroken, seq)
+}
+
+func auditHead(seq uint64, hash string) string {
+	return strconv.FormatUint(seq, 10) + " " + hash
+}
+
+// record appends the entry of logs committed by the version, and returns logs with the head of
+// the audit log. it is called with muWAL locked.
+func (a *AuditLog) record(logs []RecordLog, version uint64, actor string, now time.Time) ([]RecordLog, error) {
+	e := AuditEntry{Seq: a.seq + 1, Time: now.UTC(), Actor: actor, Version: version, Prev: a.prev}
+	for _, rlog := range logs {
+		if strings.HasPrefix(rlog.Key, internalPrefix) {
+			continue
+		}
+		switch rlog.Action {
+		case LInsert, LUpdate:
+			sum := sha256.Sum256(rlog.Value)
+			e.Writes = append(e.Writes, AuditWrite{Key: rlog.Key, Op: "set", ValueHash: hex.EncodeToString(sum[:])})
+		case LDelete:
+			e.Writes = append(e.Writes, AuditWrite{Key: rlog.Key, Op: "del"})
+		}
+	}
+	if len(e.Writes) == 0 {
+		return logs, nil
+	}
+	e.Hash = e.hash()
+	b, err := json.Marshal(&e)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = a.f.Write(append(b, '\n')); err != nil {
+		return nil, fmt.Errorf("failed to write audit log : %w", err)
+	} else if a.sync {
+		if err = a.f.Sync(); err != nil {
+			return nil, fmt.Errorf("failed to sync audit log : %w", err)
+		}
+	}
+	a.seq, a.prev = e.Seq, e.Hash
+	return append(logs, RecordLog{Action: LInsert, Record: Record{Key: auditHeadKey, Value: []byte(auditHead(e.Seq, e.Hash))}}), nil
+}
+
+// SetActor sets the client recorded by the audit log for commits of the transaction. It is kept
+// when the transaction is reused after Commit or Abort.
+func (txn *Txn) SetActor(actor string) {
+	txn.actor = actor
+}
+
+// remoteAddr returns the address of the client if r is the connection.
+func remoteAddr(r io.Reader) string {
+	if conn, ok := r.(net.Conn); ok {
+		return conn.RemoteAddr().String()
+	}
+	return ""
+}
+
+// actorOf returns the actor of the client as "user@addr", or the address if not authenticated.
+func actorOf(user, addr string) string {
+	if user == "" {
+		return addr
+	}
+	return user + "@" + addr
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStorage_EnableAudit(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	path := filepath.Join(tmpdir, "audit.log")
+	storage, err := Open(Options{WALPath: testWALPath, DBPath: testDBPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit, err := OpenAuditLog(path, true)
+	if err != nil {
+		t.Fatal(err)
+	} else if err = storage.EnableAudit(audit); err != nil {
+		t.Fatal(err)
+	}
+	txn := storage.NewTxn()
+	txn.SetActor("alice@127.0.0.1:1234")
+	if err = txn.Insert("key1", []byte("value1")); err != nil {
+		t.Fatal(err)
+	} else if err = txn.Insert("key2", []byte("value2")); err != nil {
+		t.Fatal(err)
+	} else if err = txn.Commit(); err != nil {
+		t.Fatal(err)
+	} else if err = storage.Delete("key1"); err != nil {
+		t.Fatal(err)
+	} else if _, err = storage.Get("key2"); err != nil {
+		t.Fatal(err)
+	}
+	// restart after crash
+	storage.wal.Close()
+	audit.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last, err := VerifyAuditLog(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	} else if last.Seq != 2 || last.Version != 2 || len(last.Writes) != 1 || last.Writes[0] != (AuditWrite{Key: "key1", Op: "del"}) {
+		t.Errorf("last entry : %+v", last)
+	}
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	if !bytes.Contains(lines[0], []byte(`"actor":"alice@127.0.0.1:1234"`)) || !bytes.Contains(lines[0], []byte(`"key":"key2","op":"set","value_sha256":`)) {
+		t.Errorf("first entry : %s", lines[0])
+	}
+
+	storage, err = Open(Options{WALPath: testWALPath, DBPath: testDBPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.wal.Close()
+	enable := func() error {
+		audit, err := OpenAuditLog(path, true)
+		if err != nil {
+			return err
+		}
+		defer audit.Close()
+		return storage.EnableAudit(audit)
+	}
+	if err = enable(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the head of the chain is not a record of users
+	storage.muDB.RLock()
+	_, err = storage.db.Get(auditHeadKey)
+	storage.muDB.RUnlock()
+	if err != nil {
+		t.Fatalf("head of the chain is not committed : %v", err)
+	}
+	txn = storage.NewTxn()
+	if key, _, err := txn.First(); err != nil || key != "key2" {
+		t.Errorf("first %q %v", key, err)
+	}
+	txn.Abort()
+	if n := storage.Stats().Keys; n != 1 {
+		t.Errorf("%v keys", n)
+	}
+
+	// truncation and modification are detected
+	if err = os.WriteFile(path, lines[0], 0600); err != nil {
+		t.Fatal(err)
+	} else if err = enable(); !errors.Is(err, ErrAuditBroken) {
+		t.Errorf("truncated audit log : %v", err)
+	}
+	modified := bytes.Replace(data, []byte("alice"), []byte("mallory"), 1)
+	if err = os.WriteFile(path, modified, 0600); err != nil {
+		t.Fatal(err)
+	} else if err = enable(); !errors.Is(err, ErrAuditBroken) {
+		t.Errorf("modified audit log : %v", err)
+	}
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// BackendFactory creates the backend which stores records at path.
+type BackendFactory func(path string, opts *Options) Backend
+
+var backends = map[string]BackendFactory{
+	"map": func(path string, opts *Options) Backend {
+		e := newMapEngine(path, opts.tmpPath(path))
+		e.fs = opts.fs()
+		e.log = opts.logger()
+		e.maxMemory = opts.MaxMemory
+		if opts.ValuesOnDisk && !opts.readOnly {
+			e.vlog = &valueLog{path: path + ".vlog", fs: e.fs}
+		}
+		return e
+	},
+	"btree": func(path string, opts *Options) Backend {
+		tree := newBTree(path, opts.CachePages)
+		tree.fs = opts.fs()
+		tree.useMmap = opts.Mmap
+		return tree
+	},
+	"hash": func(path string, opts *Options) Backend {
+		h := newHash(path, opts.CachePages)
+		h.fs = opts.fs()
+		h.useMmap = opts.Mmap
+		return h
+	},
+	"lsm": func(path string, opts *Options) Backend {
+		l := newLSM(path, lsmMemtableSize, opts.logger())
+		l.fs, l.vlog.fs = opts.fs(), opts.fs()
+		l.readOnly = opts.readOnly
+		return l
+	},
+}
+
+// RegisterBackend registers the backend selected by Options.Backend with the name.
+// It must be called before Open, typically in init.
+func RegisterBackend(name string, factory BackendFactory) {
+	backends[name] = factory
+}
+
+// Options is the options to open Storage.
+type Options struct {
+	// Dir is the data directory managed by the storage. Empty WALPath and DBPath are set to
+	// "wal/txngo.log" and "snapshots/txngo.db" in it, and Open creates the directory with tmp/ of
+	// temporary files, LOCK and MANIFEST. See layout.
+	Dir string
+	// WALPath is the file path of WAL file.
+	WALPath string
+	// DBPath is the file path of data file, or the directory of lsm backend.
+	DBPath string
+	// MustExist fails to open if data file is not found instead of initial start.
+	MustExist bool
+	// Backend is the name of registered backend. "map" if empty.
+	Backend string
+	// CachePages is the number of pages cached in buffer pool for btree and hash. 0 disables it.
+	CachePages int
+	// Mmap reads data file via mmap instead of buffer pool for btree and hash.
+	Mmap bool
+	// MaxMemory is the memory budget in bytes for values of map. 0 is unlimited.
+	MaxMemory int64
+	// ValuesOnDisk keeps only keys in memory and reads values from disk on demand for map.
+	ValuesOnDisk bool
+	// ColdTier is the slower tier which records not accessed recently are demoted into from the
+	// backend at checkpoint by TierPolicy, "file" for the compressed file at "<DBPath>.cold" or
+	// the URL of the object store opened by OpenObjectStore. Records read from ColdTier are
+	// promoted back into the backend. Tiering is disabled if empty.
+	ColdTier   string
+	TierPolicy TierPolicy
+	// MasterKey is the 32 bytes key to encrypt values in data file and WAL. nil disables encryption.
+	MasterKey []byte
+	// Compress compresses large values in data file.
+	Compress bool
+	// Partitions is the number of hash partitions which have their own data files.
+	Partitions int
+	// ColumnFamilies is the column families which have their own backends and data files.
+	ColumnFamilies []FamilyOptions
+	// CheckpointSize is the WAL size in bytes which triggers checkpoint. 0 disables it.
+	CheckpointSize int64
+	// CheckpointInterval is the interval of checkpoint in background while WAL grows. 0
+	// disables it.
+	CheckpointInterval time.Duration
+	// IdempotencyRetention is how long idempotency keys set by Txn.SetIdempotencyKey are kept
+	// after the commit. Expired keys are deleted at checkpoint. 24 hours if 0.
+	IdempotencyRetention time.Duration
+	// ExpireInterval is the interval of the background expiration which deletes records whose
+	// TTL set by Txn.Expire passes. 1 second if 0. Negative disables it, and expired records are
+	// only hidden from reads.
+	ExpireInterval time.Duration
+	// ExpireBatch is the maximum number of records deleted by each commit of the background
+	// expiration, which bounds its rate with ExpireInterval. 100 if 0.
+	ExpireBatch int
+	// Admission throttles commits while the syncer of CommitAsync or checkpoint falls behind.
+	// Zero disables it.
+	Admission AdmissionOptions
+	// Quotas limits records of prefixes checked at commit. See Storage.SetQuota.
+	Quotas []Quota
+	// SyncMode decides when WAL is synced. SyncAlways if empty.
+	SyncMode string
+	// DisableWAL runs the storage without WAL file, and WALPath is ignored. Commits are applied
+	// without durability, and survive restart only if saved into data files by checkpoint or
+	// Close. Records are kept only in memory if DBPath is empty with map backend.
+	DisableWAL bool
+	// RecoveryProgress is called with the progress of replaying WAL at the interval of
+	// RecoveryProgressInterval (1 second if 0), and with the final summary at the end.
+	RecoveryProgress         func(RecoveryProgress)
+	RecoveryProgressInterval time.Duration
+	// RecoveryPolicy decides how corrupt logs in WAL are replayed. RecoveryStrict if empty.
+	// WAL with corrupt logs is copied into "<WALPath>.corrupt" for forensics before cleared.
+	RecoveryPolicy string
+	// FS opens WAL, data files of backends, the cold tier of "file" and files of the data
+	// directory including MANIFEST. The file system of the operating system is used if nil.
+	FS FS
+	// Now returns the time recorded by changes of feeds and entries of the audit log. time.Now
+	// if nil. Simulation tests replace it with the mock clock.
+	Now func() time.Time
+	// CompactOnOpen rewrites the storage into its minimal form by Storage.Compact before Open
+	// returns, after large deletions or before the data files are copied elsewhere.
+	CompactOnOpen bool
+	// SelfCheck verifies the storage at the end of Open by SelfCheckFast or SelfCheckThorough.
+	// SelfCheckOff if empty. Problems found are logged, and Open fails with ErrSelfCheck only if
+	// SelfCheckStrict is set and a fatal problem is found.
+	SelfCheck       string
+	SelfCheckStrict bool
+	// PanicOnCorruption panics when logs written into WAL fail to be applied to the backend.
+	// Otherwise the error wrapping ErrCorrupted is returned, and writes and checkpoint fail
+	// until the storage is reopened and WAL is replayed.
+	PanicOnCorruption bool
+	// Name identifies the storage among storages opened in the process. Logs have the "store"
+	// field of it, and expvar exports counters in "txngo.stores" by it.
+	Name string
+	// Logger receives logs of the storage. The logger set by SetLogger is used if nil.
+	Logger Logger
+
+	// legacyDir is true if WALPath and DBPath are the loose files in Dir written before the
+	// layout of the data directory.
+	legacyDir bool
+	// readOnly loads data files without writing them, and records are written into memory over
+	// the backends. it is used by OpenReadOnly and to analyze recovery.
+	readOnly bool
+}
+
+// policies of recovery from corrupt logs in WAL. The torn log at the tail of WAL by crash is
+// discarded by any policy.
+const (
+	// RecoveryStrict refuses to open the storage with corrupt logs.
+	RecoveryStrict = "strict"
+	// RecoveryTruncate replays logs before the first corrupt log, and discards all after it.
+	RecoveryTruncate = "truncate"
+	// RecoverySkip skips corrupt logs until the next valid log and replays the rest. The
+	// transaction which includes skipped bytes is discarded not to apply it partially.
+	RecoverySkip = "skip"
+)
+
+// modes of syncing WAL.
+const (
+	// SyncAlways syncs WAL at each commit before it returns.
+	SyncAlways = "always"
+	// SyncNone leaves writing back WAL to the OS, and syncs it only at checkpoint and Close.
+	// Commits survive the crash of the process, but may be lost by the crash of the OS.
+	SyncNone = "none"
+)
+
+// FamilyOptions is the options of a column family.
+type FamilyOptions struct {
+	Name string
+	// Backend is the name of registered backend. Options.Backend if empty.
+	Backend  string
+	Compress bool
+}
+
+func (opts *Options) factory(name string) (BackendFactory, error) {
+	if name == "" {
+		name = opts.Backend
+	}
+	if name == "" {
+		name = "map"
+	}
+	factory, ok := backends[name]
+	if !ok {
+		return nil, fmt.Errorf("backend is not supported : %v", name)
+	}
+	return factory, nil
+}
+
+// Open opens the WAL file and the backend, and recovers committed records from them.
+// The WAL is cleared after recovered records are saved into the backend. WAL and LOCK of the
+// data directory are locked until Close so that other processes fail to open them with
+// ErrLocked.
+func Open(opts Options) (*Storage, error) {
+	newBackend, err := opts.factory("")
+	if err != nil {
+		return nil, err
+	}
+	opts.layout()
+	if err = opts.validate(); err != nil {
+		return nil, err
+	}
+	var dirLock File
+	if opts.Dir != "" {
+		if dirLock, err = opts.openDataDir(); err != nil {
+			return nil, err
+		}
+	}
+	wal, err := opts.openWAL()
+	if err != nil {
+		closeDirLock(dirLock)
+		return nil, err
+	}
+
+	storage := newStorage(wal, opts.newDB(newBackend))
+	storage.opts = opts
+	storage.opts.MasterKey = nil
+	storage.admission.opts = opts.Admission
+	storage.quotas = newQuotas(opts.Quotas)
+	storage.dirLock = dirLock
+	err = storage.open(&opts)
+	if err == nil && opts.CompactOnOpen {
+		err = storage.compactOnOpen()
+	}
+	if err == nil && opts.SelfCheck != "" && opts.SelfCheck != SelfCheckOff {
+		err = storage.selfCheck(&opts)
+	}
+	if err != nil {
+		storage.db.Close()
+		wal.Close()
+		closeDirLock(dirLock)
+		return nil, err
+	}
+	if opts.CheckpointInterval > 0 && !opts.readOnly {
+		storage.startCheckpointer(opts.CheckpointInterval)
+	}
+	if opts.ExpireInterval >= 0 && !opts.readOnly {
+		interval, batch := opts.ExpireInterval, opts.ExpireBatch
+		if interval == 0 {
+			interval = defaultExpireInterval
+		}
+		if batch <= 0 {
+			batch = defaultExpireBatch
+		}
+		storage.startExpirer(interval, batch)
+	}
+	publishExpvar(storage)
+	return storage, nil
+}
+
+// openWAL opens and locks the WAL file, or returns nullFile if WAL is disabled.
+func (opts *Options) openWAL() (File, error) {
+	if opts.DisableWAL {
+		return nullFile{}, nil
+	}
+	flag := os.O_CREATE | os.O_APPEND | os.O_RDWR
+	if opts.readOnly {
+		flag = os.O_RDONLY
+	}
+	wal, err := opts.fs().OpenFile(opts.WALPath, flag, 0600)
+	if err != nil {
+		return nil, err
+	} else if err = lockFile(wal, !opts.readOnly); err != nil {
+		wal.Close()
+		return nil, err
+	}
+	return wal, nil
+}
+
+// fs returns FS, or the file system of the operating system if it is nil.
+func (opts *Options) fs() FS {
+	if opts.FS == nil {
+		return osFS{}
+	}
+	return opts.FS
+}
+
+// validate returns error if RecoveryPolicy, SyncMode or the overload policy is not supported,
+// or options are not supported without WAL and data file.
+func (opts *Options) validate() error {
+	switch opts.RecoveryPolicy {
+	case "", RecoveryStrict, RecoveryTruncate, RecoverySkip:
+	default:
+		return fmt.Errorf("recovery policy is not supported : %v", opts.RecoveryPolicy)
+	}
+	switch opts.SyncMode {
+	case "", SyncAlways, SyncNone:
+	default:
+		return fmt.Errorf("sync mode is not supported : %v", opts.SyncMode)
+	}
+	if opts.CompactOnOpen && opts.readOnly {
+		return errors.New("read only storage is not compacted")
+	} else if err := opts.Admission.validate(); err != nil {
+		return err
+	}
+	switch opts.SelfCheck {
+	case "", SelfCheckOff, SelfCheckFast, SelfCheckThorough:
+	default:
+		return fmt.Errorf("self-check is not supported : %v", opts.SelfCheck)
+	}
+	if opts.DisableWAL && opts.DBPath == "" {
+		if opts.Backend != "" && opts.Backend != "map" {
+			return fmt.Errorf("backend %v requires data file", opts.Backend)
+		} else if opts.MaxMemory > 0 || opts.ValuesOnDisk || opts.Partitions > 1 || len(opts.ColumnFamilies) > 0 || opts.MasterKey != nil || opts.ColdTier != "" {
+			return errors.New("records in memory do not support max memory, values on disk, partitions, column families, encryption and cold tier")
+		}
+	}
+	return nil
+}
+
+// newDB creates the backend at DBPath, or the partitions of it.
+func (opts *Options) newDB(newBackend BackendFactory) Backend {
+	if opts.Partitions > 1 {
+		p := newPartitionEngine(opts.Partitions, func(i int) Backend {
+			return opts.backend(newBackend, fmt.Sprintf("%s.%d", opts.DBPath, i))
+		})
+		p.log = opts.logger()
+		return p
+	}
+	return opts.backend(newBackend, opts.DBPath)
+}
+
+// backend creates the backend at path, over which records are written in memory if readOnly.
+func (opts *Options) backend(newBackend BackendFactory, path string) Backend {
+	db := newBackend(path, opts)
+	if opts.readOnly {
+		db = newOverlayEngine(db)
+	}
+	return db
+}
+
+// addFamilies adds the backends of ColumnFamilies.
+func (s *Storage) addFamilies(opts *Options) error {
+	for _, family := range opts.ColumnFamilies {
+		newBackend, err := opts.factory(family.Backend)
+		if err != nil {
+			return err
+		}
+		db := opts.backend(newBackend, opts.DBPath+"."+family.Name)
+		if family.Compress {
+			db = newCompressEngine(db)
+		}
+		if err = s.AddColumnFamily(family.Name, db); err != nil {
+			db.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+// setupEngines adds column families and wraps the backend by the cold tier, encryption and
+// compression of opts.
+func (s *Storage) setupEngines(opts *Options) error {
+	if err := s.addFamilies(opts); err != nil {
+		return err
+	}
+	// map saves data file only at shutdown. modified values can be evicted after
+	// checkpoint, and value log is truncated at checkpoint.
+	if (opts.Backend != "" && opts.Backend != "map") || opts.MaxMemory > 0 || opts.ValuesOnDisk || opts.ColdTier != "" {
+		s.checkpointSize = opts.CheckpointSize
+	}
+	// commits over the max WAL size wait for checkpoint forever without it
+	if max := opts.Admission.MaxWALSize; max > 0 && (s.checkpointSize <= 0 || s.checkpointSize > max) && opts.CheckpointInterval <= 0 {
+		return errors.New("max WAL size of admission requires checkpoint size not larger than it or checkpoint interval")
+	}
+	// cold records are kept encrypted and compressed by the tier
+	if opts.ColdTier != "" {
+		cold, err := openColdTier(opts.fs(), opts.ColdTier, opts.DBPath)
+		if err != nil {
+			return err
+		}
+		db := newTieredEngine(s.db, cold, opts.TierPolicy, s.metrics.registry)
+		tier, _ := tierOf(db)
+		tier.readOnly, tier.now = opts.readOnly, s.now
+		s.metrics.registry.GaugeFunc("txngo_tier_records", "Number of records in each tier.", func() []Sample {
+			s.muDB.RLock()
+			stats := tier.stats()
+			s.muDB.RUnlock()
+			return []Sample{
+				{Labels: map[string]string{"tier": "hot"}, Value: float64(stats.HotRecords)},
+				{Labels: map[string]string{"tier": "cold"}, Value: float64(stats.ColdRecords)},
+			}
+		})
+		s.db = db
+	}
+	if opts.MasterKey != nil {
+		if err := s.EnableEncryption(opts.DBPath+".keys", opts.MasterKey); err != nil {
+			return err
+		}
+	}
+	// values are compressed before encryption
+	if opts.Compress {
+		s.db = newCompressEngine(s.db)
+	}
+	return nil
+}
+
+func (s *Storage) open(opts *Options) error {
+	if err := s.setupEngines(opts); err != nil {
+		return err
+	}
+
+	s.logger().Info("loading data file")
+	if err := s.LoadCheckPoint(); os.IsNotExist(err) && !opts.MustExist {
+		s.logger().Info("db file is not found. this is initial start")
+	} else if err != nil {
+		return fmt.Errorf("failed to load data file : %w", err)
+	}
+
+	s.logger().Info("loading WAL file")
+	if nlogs, err := s.LoadWAL(); err != nil {
+		return fmt.Errorf("failed to load WAL file : %w", err)
+	} else if info, err := s.wal.Stat(); err != nil {
+		return fmt.Errorf("failed to stat WAL file : %w", err)
+	} else if (nlogs != 0 || info.Size() != 0) && !opts.readOnly {
+		// WAL which has only the torn log is also cleared not to append logs after it.
+		s.logger().Warn("previous shutdown is not success")
+		if len(s.corruptLogs) > 0 {
+			path := opts.WALPath + ".corrupt"
+			if err = copyWAL(opts.fs(), s.wal, path); err != nil {
+				return fmt.Errorf("failed to copy corrupt WAL file : %w", err)
+			}
+			s.logger().Warn("corrupt WAL file is copied", "path", path, "corrupt_logs", len(s.corruptLogs))
+		}
+		s.logger().Info("update data file")
+		if err = s.SaveCheckPoint(); err != nil {
+			return fmt.Errorf("failed to save checkpoint : %w", err)
+		}
+		s.logger().Info("clear WAL file")
+		if err = s.ClearWAL(); err != nil {
+			return fmt.Errorf("failed to clear WAL file : %w", err)
+		}
+	}
+	return nil
+}
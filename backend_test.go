@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// countBackend counts records put into the underlying backend.
+type countBackend struct {
+	Backend
+	puts int
+}
+
+func (c *countBackend) Put(r Record) error {
+	c.puts++
+	return c.Backend.Put(r)
+}
+
+func TestOpen(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	var counter *countBackend
+	RegisterBackend("count", func(path string, opts *Options) Backend {
+		counter = &countBackend{Backend: newBTree(path, opts.CachePages)}
+		return counter
+	})
+	defer delete(backends, "count")
+
+	if _, err := Open(Options{WALPath: testWALPath, DBPath: testDBPath, Backend: "none"}); err == nil {
+		t.Errorf("unknown backend is opened")
+	} else if _, err = Open(Options{WALPath: testWALPath, DBPath: testDBPath, MustExist: true}); err == nil {
+		t.Errorf("not existing data file is opened with MustExist")
+	}
+
+	opts := Options{
+		WALPath:        testWALPath,
+		DBPath:         testDBPath,
+		Backend:        "count",
+		CachePages:     8,
+		CheckpointSize: 4096,
+		ColumnFamilies: []FamilyOptions{{Name: "mem", Backend: "map", Compress: true}},
+	}
+	storage, err := Open(opts)
+	if err != nil {
+		t.Fatalf("failed to open : %v", err)
+	}
+	txn := storage.NewTxn()
+	mem, err := txn.Family("mem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err = txn.Insert(fmt.Sprintf("key%02d", i), []byte("value")); err != nil {
+			t.Fatal(err)
+		} else if err = mem.Insert(fmt.Sprintf("key%02d", i), []byte("mem")); err != nil {
+			t.Fatal(err)
+		} else if err = txn.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if counter.puts != 100 || storage.db.Len() != 200 {
+		t.Errorf("records not match : %v puts, %v records", counter.puts, storage.db.Len())
+	}
+	// crash without shutdown
+	storage.wal.Close()
+	storage.db.Close()
+
+	storage, err = Open(opts)
+	if err != nil {
+		t.Fatalf("failed to reopen : %v", err)
+	}
+	defer storage.wal.Close()
+	defer storage.db.Close()
+	txn = storage.NewTxn()
+	mem, _ = txn.Family("mem")
+	for i := 0; i < 100; i++ {
+		assertValue(t, txn, fmt.Sprintf("key%02d", i), []byte("value"))
+		if v, err := mem.Read(fmt.Sprintf("key%02d", i)); err != nil || string(v) != "mem" {
+			t.Errorf("value in mem not match %q : %v", v, err)
+		}
+	}
+	if info, err := os.Stat(testWALPath); err != nil {
+		t.Fatal(err)
+	} else if info.Size() != 0 {
+		t.Errorf("WAL is not cleared after recovery : %v bytes", info.Size())
+	}
+}
+
+func TestOpen_CheckpointInterval(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	storage, err := Open(Options{WALPath: testWALPath, DBPath: testDBPath, Backend: "btree", CheckpointInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	if err = storage.Put("key1", []byte("value1")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		storage.muWAL.Lock()
+		size := storage.walSize
+		storage.muWAL.Unlock()
+		if size == 0 {
+			break
+		} else if i == 100 {
+			t.Fatalf("WAL is not checkpointed : %v bytes", size)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if info, err := os.Stat(testWALPath); err != nil || info.Size() != 0 {
+		t.Errorf("WAL is not cleared : %v", err)
+	}
+}
+
+func TestOpen_DisableWAL(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+
+	// records only in memory
+	storage, err := Open(Options{DisableWAL: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	txn := storage.NewTxn()
+	if err = txn.Insert("key1", []byte("value1")); err != nil {
+		t.Fatal(err)
+	} else if err = txn.Prepare("gid1"); err != nil {
+		t.Fatal(err)
+	} else if err = storage.CommitPrepared("gid1"); err != nil {
+		t.Fatal(err)
+	}
+	txn = storage.NewTxn()
+	assertValue(t, txn, "key1", []byte("value1"))
+	if err = txn.Update("key1", []byte("value2")); err != nil {
+		t.Fatal(err)
+	}
+	txn.Abort()
+	assertValue(t, txn, "key1", []byte("value1"))
+	txn.Abort()
+	if err = storage.EnableReplication(ReplicationOptions{Dir: tmpdir + "/replication"}); err == nil {
+		t.Errorf("replication is enabled without WAL")
+	} else if err = storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if files, err := os.ReadDir(tmpdir); err != nil || len(files) != 0 {
+		t.Errorf("files are created : %v %v", files, err)
+	}
+	if storage, err = Open(Options{DisableWAL: true}); err != nil {
+		t.Fatal(err)
+	} else if storage.db.Len() != 0 {
+		t.Errorf("records in memory survive : %v", storage.db.Len())
+	}
+	storage.Close()
+
+	// commits survive only by checkpoint
+	opts := Options{WALPath: testWALPath, DBPath: testDBPath, DisableWAL: true}
+	if storage, err = Open(opts); err != nil {
+		t.Fatal(err)
+	} else if err = storage.Put("key1", []byte("value1")); err != nil {
+		t.Fatal(err)
+	}
+	storage.db.Close()
+	if storage, err = Open(opts); err != nil {
+		t.Fatal(err)
+	} else if storage.db.Len() != 0 {
+		t.Errorf("commit survives crash without checkpoint : %v", storage.db.Len())
+	} else if err = storage.Put("key1", []byte("value1")); err != nil {
+		t.Fatal(err)
+	} else if err = storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if storage, err = Open(opts); err != nil {
+		t.Fatal(err)
+	}
+	txn = storage.NewTxn()
+	assertValue(t, txn, "key1", []byte("value1"))
+	txn.Abort()
+	storage.Close()
+	if _, err = os.Stat(testWALPath); !os.IsNotExist(err) {
+		t.Errorf("WAL file is created : %v", err)
+	}
+
+	if _, err = Open(Options{DisableWAL: true, Backend: "btree"}); err == nil {
+		t.Errorf("btree is opened without data file")
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+var (
+	ErrNotEmpty      = errors.New("storage is not empty")
+	ErrInvalidBackup = errors.New("invalid backup")
+)
+
+// backupMagic is the head of backup stream, which is followed by [8 version][4 count], count
+// serialized Records and [4 crc32] of all preceding bytes.
+const backupMagic = "TXNGOBK1"
+
+// Backup writes all committed records and the version applied to them into w while running.
+// Commits are blocked only while copying records.
+// TODO: stream records without copying all of them in memory
+func (s *Storage) Backup(w io.Writer) (uint64, error) {
+	records, version, err := s.snapshotRecords()
+	if err != nil {
+		return 0, err
+	}
+	hash := crc32.NewIEEE()
+	bw := bufio.NewWriter(io.MultiWriter(w, hash))
+	if _, err = bw.WriteString(backupMagic); err != nil {
+		return 0, err
+	} else if err = writeSnapshot(bw, records, version); err != nil {
+		return 0, err
+	} else if err = bw.Flush(); err != nil {
+		return 0, err
+	}
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], hash.Sum32())
+	if _, err = w.Write(sum[:]); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// Restore loads the backup written by Backup into the empty storage, and checkpoints it.
+// ErrNotEmpty is returned if the storage has any record or commit.
+func (s *Storage) Restore(r io.Reader) (uint64, error) {
+	if err := s.writable(); err != nil {
+		return 0, err
+	} else if s.raft != nil {
+		return 0, errors.New("restore is not supported with raft")
+	}
+	hash := crc32.NewIEEE()
+	br := bufio.NewReader(r)
+	hr := io.TeeReader(br, hash)
+	var head [len(backupMagic) + 12]byte
+	if _, err := io.ReadFull(hr, head[:]); err != nil {
+		return 0, fmt.Errorf("%w : failed to read header : %v", ErrInvalidBackup, err)
+	} else if string(head[:len(backupMagic)]) != backupMagic {
+		return 0, fmt.Errorf("%w : magic does not match", ErrInvalidBackup)
+	}
+	version := binary.BigEndian.Uint64(head[len(backupMagic):])
+	count := binary.BigEndian.Uint32(head[len(backupMagic)+8:])
+	records, err := readRecords(hr, count)
+	if err != nil {
+		return 0, fmt.Errorf("%w : failed to read record : %v", ErrInvalidBackup, err)
+	}
+	var sum [4]byte
+	if _, err := io.ReadFull(br, sum[:]); err != nil {
+		return 0, fmt.Errorf("%w : failed to read checksum : %v", ErrInvalidBackup, err)
+	} else if binary.BigEndian.Uint32(sum[:]) != hash.Sum32() {
+		return 0, fmt.Errorf("%w : %v", ErrInvalidBackup, ErrChecksum)
+	}
+
+	s.muWAL.Lock()
+	defer s.muWAL.Unlock()
+	s.muDB.Lock()
+	defer s.muDB.Unlock()
+	if err := s.checkEmpty(); err != nil {
+		return 0, err
+	}
+	return version, s.restoreRecords(records, version)
+}
+
+// checkEmpty returns ErrNotEmpty if the storage has any record or commit. It must be called
+// with muWAL and muDB locked.
+func (s *Storage) checkEmpty() error {
+	empty := s.version == 0 && len(s.prepared) == 0
+	if err := s.db.Keys("", func(string) bool {
+		empty = false
+		return false
+	}); err != nil {
+		return err
+	} else if !empty {
+		return ErrNotEmpty
+	}
+	return nil
+}
+
+// maxPrealloc is the max number of entries or bytes allocated before they are read, so that
+// the count or the size claimed by corrupt input does not allocate huge memory at once.
+const maxPrealloc = 1 << 16
+
+// readRecords reads count serialized Records.
+func readRecords(r io.Reader, count uint32) ([]Record, error) {
+	records := make([]Record, 0, min(count, maxPrealloc))
+	for i := uint32(0); i < count; i++ {
+		rec, err := readRecord(r)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// readRecord reads one serialized Record. the size is known from the header of record.
+func readRecord(r io.Reader) (Record, error) {
+	var (
+		rec  Record
+		head [13]byte
+	)
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return rec, err
+	}
+	buf, err := readSized(r, head[:], int64(len(head))+int64(head[0])+int64(binary.BigEndian.Uint32(head[1:])))
+	if err != nil {
+		return rec, err
+	}
+	// buf is allocated for the record
+	_, err = rec.DeserializeUnsafe(buf)
+	return rec, err
+}
+
+// readSized reads the rest of the entry of size bytes which starts with head. Large entries
+// are buffered as they are read instead of allocated by the claimed size.
+func readSized(r io.Reader, head []byte, size int64) ([]byte, error) {
+	if size <= maxPrealloc {
+		buf := make([]byte, size)
+		copy(buf, head)
+		_, err := io.ReadFull(r, buf[len(head):])
+		return buf, err
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, maxPrealloc))
+	buf.Write(head)
+	if _, err := io.CopyN(buf, r, size-int64(len(head))); err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
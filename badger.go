@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// The badger importer reads the backup of Badger written by "badger backup" or DB.Backup, which
+// is the stream of the 8 bytes little endian length and pb.KVList of that length. Only the backup
+// is supported, and the data directory of Badger is rejected with ErrBadgerDirectory because LSM
+// tables and value logs are not stable across versions. Run "badger backup" against the directory
+// to import it.
+const (
+	// pb.KVList.kv and fields of pb.KV
+	badgerFieldKVList    = 1
+	badgerFieldKey       = 1
+	badgerFieldValue     = 2
+	badgerFieldExpiresAt = 5
+	badgerFieldMeta      = 6
+
+	// badgerBitDelete is the bit of pb.KV.meta of the deleted key.
+	badgerBitDelete = 0x01
+
+	// maxBadgerList is the max size of pb.KVList in the backup.
+	maxBadgerList = 1 << 30
+)
+
+var (
+	ErrInvalidBadger   = errors.New("invalid badger backup")
+	ErrBadgerDirectory = errors.New("data directory of badger is not supported, import the file written by \"badger backup\"")
+)
+
+// badgerIterator iterates records in the backup of Badger. Deleted and expired keys are skipped.
+type badgerIterator struct {
+	r    io.Reader
+	kvs  [][]byte
+	now  func() time.Time
+	list int
+}
+
+func newBadgerIterator(r io.Reader) *badgerIterator {
+	return &badgerIterator{r: r, now: time.Now}
+}
+
+func (it *badgerIterator) Next() (string, []byte, error) {
+	for {
+		for len(it.kvs) > 0 {
+			kv := it.kvs[0]
+			it.kvs = it.kvs[1:]
+			var (
+				key, value []byte
+				expiresAt  uint64
+				deleted    bool
+			)
+			err := readProto(kv, func(field int, v uint64, buf []byte) {
+				switch field {
+				case badgerFieldKey:
+					key = buf
+				case badgerFieldValue:
+					value = buf
+				case badgerFieldExpiresAt:
+					expiresAt = v
+				case badgerFieldMeta:
+					deleted = len(buf) > 0 && buf[0]&badgerBitDelete != 0
+				}
+			})
+			if err != nil {
+				return "", nil, fmt.Errorf("kv list %d : %w", it.list, err)
+			} else if deleted || (expiresAt != 0 && expiresAt <= uint64(it.now().Unix())) {
+				continue
+			}
+			return string(key), append([]byte(nil), value...), nil
+		}
+
+		var head [8]byte
+		if _, err := io.ReadFull(it.r, head[:]); err == io.EOF {
+			return "", nil, io.EOF
+		} else if err != nil {
+			return "", nil, fmt.Errorf("failed to read kv list %d : %w", it.list+1, err)
+		}
+		size := binary.LittleEndian.Uint64(head[:])
+		if size > maxBadgerList {
+			return "", nil, fmt.Errorf("kv list of %d bytes : %w", size, ErrInvalidBadger)
+		}
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(it.r, buf); err != nil {
+			return "", nil, fmt.Errorf("failed to read kv list %d : %w", it.list+1, err)
+		}
+		it.list++
+		if err := readProto(buf, func(field int, v uint64, b []byte) {
+			if field == badgerFieldKVList && b != nil {
+				it.kvs = append(it.kvs, b)
+			}
+		}); err != nil {
+			return "", nil, fmt.Errorf("kv list %d : %w", it.list, err)
+		}
+	}
+}
+
+// readProto calls fn for each field of the protocol buffers message. v is the value of varint and
+// fixed fields, and buf is the bytes of length delimited fields.
+func readProto(msg []byte, fn func(field int, v uint64, buf []byte)) error {
+	for len(msg) > 0 {
+		tag, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return ErrInvalidBadger
+		}
+		msg = msg[n:]
+		field := int(tag >> 3)
+		switch tag & 7 {
+		case 0:
+			v, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return ErrInvalidBadger
+			}
+			msg = msg[n:]
+			fn(field, v, nil)
+		case 1:
+			if len(msg) < 8 {
+				return ErrInvalidBadger
+			}
+			fn(field, binary.LittleEndian.Uint64(msg), nil)
+			msg = msg[8:]
+		case 2:
+			size, n := binary.Uvarint(msg)
+			if n <= 0 || size > uint64(len(msg)-n) {
+				return ErrInvalidBadger
+			}
+			fn(field, 0, msg[n:n+int(size)])
+			msg = msg[n+int(size):]
+		case 5:
+			if len(msg) < 4 {
+				return ErrInvalidBadger
+			}
+			fn(field, uint64(binary.LittleEndian.Uint32(msg)), nil)
+			msg = msg[4:]
+		default:
+			return ErrInvalidBadger
+		}
+	}
+	return nil
+}
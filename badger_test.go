@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+)
+
+type testBadgerKV struct {
+	key, value []byte
+	expiresAt  uint64
+	meta       byte
+}
+
+func appendProtoBytes(buf []byte, field int, b []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(field)<<3|2)
+	buf = binary.AppendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+// writeTestBadgerBackup encodes the backup of Badger with pb.KVList of each kvs.
+func writeTestBadgerBackup(lists ...[]testBadgerKV) []byte {
+	var backup []byte
+	for _, kvs := range lists {
+		var list []byte
+		for _, kv := range kvs {
+			var msg []byte
+			msg = appendProtoBytes(msg, badgerFieldKey, kv.key)
+			msg = appendProtoBytes(msg, badgerFieldValue, kv.value)
+			msg = appendProtoBytes(msg, 3, []byte{0})
+			// version
+			msg = binary.AppendUvarint(msg, 4<<3)
+			msg = binary.AppendUvarint(msg, 100)
+			if kv.expiresAt != 0 {
+				msg = binary.AppendUvarint(msg, badgerFieldExpiresAt<<3)
+				msg = binary.AppendUvarint(msg, kv.expiresAt)
+			}
+			msg = appendProtoBytes(msg, badgerFieldMeta, []byte{kv.meta})
+			list = appendProtoBytes(list, badgerFieldKVList, msg)
+		}
+		// alloc_ref
+		list = binary.AppendUvarint(list, 10<<3)
+		list = binary.AppendUvarint(list, 1)
+		backup = binary.LittleEndian.AppendUint64(backup, uint64(len(list)))
+		backup = append(backup, list...)
+	}
+	return backup
+}
+
+func TestBadgerIterator(t *testing.T) {
+	now := time.Unix(1000, 0)
+	backup := writeTestBadgerBackup(
+		[]testBadgerKV{
+			{key: []byte("key1"), value: []byte("value1")},
+			{key: []byte("deleted"), meta: badgerBitDelete},
+			{key: []byte("expired"), value: []byte("value"), expiresAt: 999},
+		},
+		nil,
+		[]testBadgerKV{
+			{key: []byte("key2"), value: []byte("value2"), expiresAt: 1001, meta: 0x40},
+		},
+	)
+	it := newBadgerIterator(bytes.NewReader(backup))
+	it.now = func() time.Time { return now }
+	var keys []string
+	for {
+		key, value, err := it.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		} else if string(value) != "value"+key[3:] {
+			t.Errorf("value of %v : %q", key, value)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) != 2 || keys[0] != "key1" || keys[1] != "key2" {
+		t.Errorf("keys : %q", keys)
+	}
+
+	for _, broken := range [][]byte{backup[:len(backup)-1], append(backup, 1, 2, 3), append(binary.LittleEndian.AppendUint64(nil, 2), 0x0a, 0x05)} {
+		it = newBadgerIterator(bytes.NewReader(broken))
+		var err error
+		for err == nil {
+			_, _, err = it.Next()
+		}
+		if err == io.EOF {
+			t.Errorf("broken backup of %v bytes is read", len(broken))
+		}
+	}
+}
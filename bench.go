@@ -0,0 +1,455 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// operations of benchmark workloads
+const (
+	benchRead = iota
+	benchUpdate
+	benchInsert
+	benchScan
+	benchReadModifyWrite
+	benchOps
+)
+
+var benchOpNames = [benchOps]string{"read", "update", "insert", "scan", "read-modify-write"}
+
+// BenchWorkload is the mix of operations and the distribution of keys of the benchmark.
+type BenchWorkload struct {
+	Name string
+	// Proportions is the weight of each operation indexed by benchRead, benchUpdate, ...
+	Proportions [benchOps]float64
+	// Distribution chooses keys of operations. "uniform", "zipfian" or "latest" which prefers
+	// recently inserted keys.
+	Distribution string
+}
+
+// benchWorkloads are the workloads of YCSB core workloads A to F and the write heavy one.
+var benchWorkloads = []BenchWorkload{
+	{Name: "update-heavy", Proportions: [benchOps]float64{benchRead: 0.5, benchUpdate: 0.5}, Distribution: "zipfian"},
+	{Name: "read-heavy", Proportions: [benchOps]float64{benchRead: 0.95, benchUpdate: 0.05}, Distribution: "zipfian"},
+	{Name: "read-only", Proportions: [benchOps]float64{benchRead: 1}, Distribution: "zipfian"},
+	{Name: "read-latest", Proportions: [benchOps]float64{benchRead: 0.95, benchInsert: 0.05}, Distribution: "latest"},
+	{Name: "scan", Proportions: [benchOps]float64{benchScan: 0.95, benchInsert: 0.05}, Distribution: "zipfian"},
+	{Name: "read-modify-write", Proportions: [benchOps]float64{benchRead: 0.5, benchReadModifyWrite: 0.5}, Distribution: "zipfian"},
+	{Name: "write-heavy", Proportions: [benchOps]float64{benchRead: 0.1, benchUpdate: 0.5, benchInsert: 0.4}, Distribution: "uniform"},
+}
+
+func findBenchWorkload(name string) (BenchWorkload, bool) {
+	for _, w := range benchWorkloads {
+		if w.Name == name {
+			return w, true
+		}
+	}
+	return BenchWorkload{}, false
+}
+
+// BenchConfig is the configuration of the benchmark.
+type BenchConfig struct {
+	Workload BenchWorkload
+	// Records is the number of records loaded before operations.
+	Records int
+	// Operations is the number of operations run by all clients. If Duration is not 0,
+	// operations run until the duration passes instead.
+	Operations int
+	Duration   time.Duration
+	Clients    int
+	// ValueSize and MaxValueSize are the range of the size of values which is chosen uniformly.
+	ValueSize    int
+	MaxValueSize int
+	// ScanLength is the max number of records read by a scan. the length is chosen uniformly.
+	ScanLength int
+	Seed       int64
+}
+
+// BenchResult is the throughput and the latency of operations of the benchmark.
+type BenchResult struct {
+	Workload   string
+	Operations int
+	Elapsed    time.Duration
+	// Throughput is the number of operations per second.
+	Throughput float64
+	// Ops is the statistics of each operation in the workload.
+	Ops []BenchOpStats
+}
+
+// BenchOpStats is the latency percentiles of succeeded operations. Errors counts operations
+// failed by ErrDeadLock or other errors.
+type BenchOpStats struct {
+	Name   string
+	Count  int
+	Errors int
+	P50    time.Duration
+	P90    time.Duration
+	P99    time.Duration
+	P999   time.Duration
+	Max    time.Duration
+}
+
+// zipfian generates ranks in [0, items) by the zipfian distribution of the constant theta,
+// which is the algorithm of "Quickly Generating Billion-Record Synthetic Databases" used by YCSB.
+type zipfian struct {
+	items               uint64
+	theta, alpha, zetan float64
+	eta, zeta2          float64
+}
+
+// benchZipfianTheta is the zipfian constant of YCSB.
+const benchZipfianTheta = 0.99
+
+func newZipfian(items uint64, theta float64) *zipfian {
+	z := &zipfian{items: items, theta: theta, alpha: 1 / (1 - theta)}
+	for i := uint64(1); i <= items; i++ {
+		z.zetan += 1 / math.Pow(float64(i), theta)
+	}
+	z.zeta2 = 1 + 1/math.Pow(2, theta)
+	z.eta = (1 - math.Pow(2/float64(items), 1-theta)) / (1 - z.zeta2/z.zetan)
+	return z
+}
+
+func (z *zipfian) next(r *rand.Rand) uint64 {
+	if z.items < 2 {
+		return 0
+	}
+	u := r.Float64()
+	uz := u * z.zetan
+	if uz < 1 {
+		return 0
+	} else if uz < z.zeta2 {
+		return 1
+	}
+	v := uint64(float64(z.items) * math.Pow(z.eta*u-z.eta+1, z.alpha))
+	if v >= z.items {
+		v = z.items - 1
+	}
+	return v
+}
+
+// scramble spreads the rank over the key space so that popular keys are not adjacent. it is
+// FNV-1a of the 8 bytes of n.
+func scramble(n uint64) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < 8; i++ {
+		h ^= n & 0xff
+		h *= 1099511628211
+		n >>= 8
+	}
+	return h
+}
+
+func benchKey(n uint64) string {
+	return fmt.Sprintf("user%012d", n)
+}
+
+// benchRunner generates operations of the workload against the storage.
+type benchRunner struct {
+	s       *Storage
+	cfg     BenchConfig
+	zipf    *zipfian
+	weights float64
+	// inserted is the number of keys inserted including loaded records.
+	inserted atomic.Uint64
+	// remaining is the number of operations which are not started.
+	remaining atomic.Int64
+}
+
+func newBenchRunner(s *Storage, cfg BenchConfig) (*benchRunner, error) {
+	if cfg.Records <= 0 {
+		return nil, fmt.Errorf("records must be positive : %v", cfg.Records)
+	} else if cfg.Clients <= 0 {
+		cfg.Clients = 1
+	}
+	if cfg.MaxValueSize < cfg.ValueSize {
+		cfg.MaxValueSize = cfg.ValueSize
+	}
+	if cfg.ScanLength <= 0 {
+		cfg.ScanLength = 1
+	}
+	r := &benchRunner{s: s, cfg: cfg}
+	for _, p := range cfg.Workload.Proportions {
+		r.weights += p
+	}
+	if r.weights <= 0 {
+		return nil, fmt.Errorf("workload %q has no operation", cfg.Workload.Name)
+	}
+	switch cfg.Workload.Distribution {
+	case "uniform":
+	case "zipfian", "latest":
+		r.zipf = newZipfian(uint64(cfg.Records), benchZipfianTheta)
+	default:
+		return nil, fmt.Errorf("unknown distribution %q", cfg.Workload.Distribution)
+	}
+	r.inserted.Store(uint64(cfg.Records))
+	return r, nil
+}
+
+// value returns the value of random size sliced from buf of MaxValueSize random bytes.
+func (r *benchRunner) value(rnd *rand.Rand, buf []byte) []byte {
+	size := r.cfg.ValueSize
+	if r.cfg.MaxValueSize > size {
+		size += rnd.Intn(r.cfg.MaxValueSize - size + 1)
+	}
+	off := rnd.Intn(len(buf) - size + 1)
+	return buf[off : off+size]
+}
+
+// key chooses the existing key by the distribution. keys of uniform and zipfian are chosen
+// from loaded records.
+func (r *benchRunner) key(rnd *rand.Rand) string {
+	switch r.cfg.Workload.Distribution {
+	case "zipfian":
+		return benchKey(scramble(r.zipf.next(rnd)) % uint64(r.cfg.Records))
+	case "latest":
+		last := r.inserted.Load()
+		n := r.zipf.next(rnd)
+		if n >= last {
+			n = last - 1
+		}
+		return benchKey(last - 1 - n)
+	}
+	return benchKey(uint64(rnd.Int63n(int64(r.cfg.Records))))
+}
+
+func (r *benchRunner) chooseOp(rnd *rand.Rand) int {
+	x := rnd.Float64() * r.weights
+	for op, p := range r.cfg.Workload.Proportions {
+		if x -= p; x < 0 {
+			return op
+		}
+	}
+	return benchRead
+}
+
+// load inserts records of keys [0, Records) in batches.
+func (r *benchRunner) load() error {
+	const batch = 1000
+	rnd := rand.New(rand.NewSource(r.cfg.Seed))
+	buf := make([]byte, r.cfg.MaxValueSize)
+	rnd.Read(buf)
+	for start := 0; start < r.cfg.Records; start += batch {
+		if err := r.s.autoCommit(func(txn *Txn) error {
+			for i := start; i < start+batch && i < r.cfg.Records; i++ {
+				if err := txn.Put(benchKey(uint64(i)), r.value(rnd, buf)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			return fmt.Errorf("failed to load records : %w", err)
+		}
+	}
+	return nil
+}
+
+func (r *benchRunner) do(op int, rnd *rand.Rand, buf []byte) error {
+	switch op {
+	case benchRead:
+		if _, err := r.s.Get(r.key(rnd)); err != nil && err != ErrNotExist {
+			return err
+		}
+		return nil
+	case benchUpdate:
+		return r.s.Put(r.key(rnd), r.value(rnd, buf))
+	case benchInsert:
+		key := benchKey(r.inserted.Add(1) - 1)
+		return r.s.autoCommit(func(txn *Txn) error {
+			return txn.Insert(key, r.value(rnd, buf))
+		})
+	case benchScan:
+		keys, _, err := r.s.ScanKeys(encodeCursor(r.key(rnd)), "", 1+rnd.Intn(r.cfg.ScanLength), nil)
+		if err != nil {
+			return err
+		}
+		return r.s.autoCommit(func(txn *Txn) error {
+			for _, key := range keys {
+				if _, err := txn.Read(key); err != nil && err != ErrNotExist {
+					return err
+				}
+			}
+			return nil
+		})
+	case benchReadModifyWrite:
+		key := r.key(rnd)
+		return r.s.autoCommit(func(txn *Txn) error {
+			if _, err := txn.Read(key); err != nil && err != ErrNotExist {
+				return err
+			}
+			return txn.Put(key, r.value(rnd, buf))
+		})
+	}
+	return fmt.Errorf("unknown operation %v", op)
+}
+
+// run runs operations by clients concurrently and returns the result.
+func (r *benchRunner) run() *BenchResult {
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		latencies [benchOps][]time.Duration
+		errs      [benchOps]int
+		deadline  time.Time
+	)
+	if r.cfg.Duration > 0 {
+		deadline = time.Now().Add(r.cfg.Duration)
+		r.remaining.Store(math.MaxInt64)
+	} else {
+		r.remaining.Store(int64(r.cfg.Operations))
+	}
+	start := time.Now()
+	for client := 0; client < r.cfg.Clients; client++ {
+		wg.Add(1)
+		go func(client int) {
+			defer wg.Done()
+			var (
+				rnd   = rand.New(rand.NewSource(r.cfg.Seed + int64(client) + 1))
+				buf   = make([]byte, r.cfg.MaxValueSize)
+				local [benchOps][]time.Duration
+				lerrs [benchOps]int
+			)
+			rnd.Read(buf)
+			for r.remaining.Add(-1) >= 0 && (deadline.IsZero() || time.Now().Before(deadline)) {
+				op := r.chooseOp(rnd)
+				t := time.Now()
+				if err := r.do(op, rnd, buf); err != nil {
+					lerrs[op]++
+					continue
+				}
+				local[op] = append(local[op], time.Since(t))
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for op := range local {
+				latencies[op] = append(latencies[op], local[op]...)
+				errs[op] += lerrs[op]
+			}
+		}(client)
+	}
+	wg.Wait()
+
+	result := &BenchResult{Workload: r.cfg.Workload.Name, Elapsed: time.Since(start)}
+	for op, ls := range latencies {
+		if len(ls) == 0 && errs[op] == 0 {
+			continue
+		}
+		sort.Slice(ls, func(i, j int) bool { return ls[i] < ls[j] })
+		stats := BenchOpStats{Name: benchOpNames[op], Count: len(ls), Errors: errs[op]}
+		if len(ls) > 0 {
+			stats.P50 = ls[int(0.5*float64(len(ls)-1))]
+			stats.P90 = ls[int(0.9*float64(len(ls)-1))]
+			stats.P99 = ls[int(0.99*float64(len(ls)-1))]
+			stats.P999 = ls[int(0.999*float64(len(ls)-1))]
+			stats.Max = ls[len(ls)-1]
+		}
+		result.Operations += len(ls) + errs[op]
+		result.Ops = append(result.Ops, stats)
+	}
+	result.Throughput = float64(result.Operations) / result.Elapsed.Seconds()
+	return result
+}
+
+// WriteText writes the result as the table of operations.
+func (r *BenchResult) WriteText(w io.Writer) error {
+	fmt.Fprintf(w, "%s : %d ops in %v, %.1f ops/s\n", r.Workload, r.Operations, r.Elapsed.Round(time.Millisecond), r.Throughput)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "op\tcount\terrors\tp50\tp90\tp99\tp99.9\tmax")
+	for _, op := range r.Ops {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%v\t%v\t%v\t%v\t%v\n", op.Name, op.Count, op.Errors, op.P50, op.P90, op.P99, op.P999, op.Max)
+	}
+	return tw.Flush()
+}
+
+// runBenchCommand runs "txngo [flags] bench [bench flags]" and returns the exit status.
+// The storage opened by opts is created in a temporary directory unless -dir is given, so that
+// the benchmark never writes into the data file of the server.
+func runBenchCommand(opts Options, args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var names []string
+	for _, w := range benchWorkloads {
+		names = append(names, w.Name)
+	}
+	workload := fs.String("workload", "read-heavy", "workload ("+strings.Join(names, ", ")+")")
+	dist := fs.String("dist", "", "distribution of keys overriding the workload (uniform, zipfian or latest)")
+	records := fs.Int("records", 10000, "number of records loaded before operations")
+	ops := fs.Int("ops", 100000, "number of operations")
+	duration := fs.Duration("duration", 0, "run operations for the duration instead of -ops (0 disables)")
+	clients := fs.Int("clients", 8, "number of concurrent clients")
+	valueSize := fs.Int("value-size", 100, "size of values in bytes")
+	maxValueSize := fs.Int("value-max", 0, "max size of values to choose the size uniformly from -value-size (0 is -value-size)")
+	scanLength := fs.Int("scan-length", 100, "max number of records read by a scan")
+	seed := fs.Int64("seed", 1, "seed of random operations")
+	dir := fs.String("dir", "", "directory of WAL and data files of the benchmark (default temporary directory removed at exit)")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	w, ok := findBenchWorkload(*workload)
+	if !ok {
+		fmt.Fprintf(stderr, "unknown workload : %v\n", *workload)
+		return exitUsage
+	} else if *dist != "" {
+		w.Distribution = *dist
+	}
+
+	if *dir == "" {
+		tmp, err := ioutil.TempDir("", "txngo-bench")
+		if err != nil {
+			fmt.Fprintf(stderr, "failed to create directory : %v\n", err)
+			return exitFailure
+		}
+		defer os.RemoveAll(tmp)
+		*dir = tmp
+	}
+	// the benchmark does not touch the data directory
+	opts.Dir, opts.legacyDir = "", false
+	opts.WALPath, opts.DBPath = filepath.Join(*dir, "bench.log"), filepath.Join(*dir, "bench.db")
+	log.SetOutput(ioutil.Discard)
+	storage, err := Open(opts)
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to open : %v\n", err)
+		return exitFailure
+	}
+	defer storage.wal.Close()
+	defer storage.db.Close()
+
+	runner, err := newBenchRunner(storage, BenchConfig{
+		Workload:     w,
+		Records:      *records,
+		Operations:   *ops,
+		Duration:     *duration,
+		Clients:      *clients,
+		ValueSize:    *valueSize,
+		MaxValueSize: *maxValueSize,
+		ScanLength:   *scanLength,
+		Seed:         *seed,
+	})
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	}
+	start := time.Now()
+	if err = runner.load(); err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitFailure
+	}
+	fmt.Fprintf(stdout, "loaded %d records in %v\n", *records, time.Since(start).Round(time.Millisecond))
+	if err = runner.run().WriteText(stdout); err != nil {
+		return exitFailure
+	}
+	return exitOK
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestZipfian(t *testing.T) {
+	const items = 1000
+	z := newZipfian(items, benchZipfianTheta)
+	rnd := rand.New(rand.NewSource(1))
+	counts := make([]int, items)
+	for i := 0; i < 100000; i++ {
+		n := z.next(rnd)
+		if n >= items {
+			t.Fatalf("rank %d is out of range", n)
+		}
+		counts[n]++
+	}
+	// popular ranks are chosen more frequently
+	if counts[0] < counts[1] || counts[1] < counts[10] || counts[10] < counts[500] {
+		t.Errorf("counts of ranks 0, 1, 10, 500 : %v %v %v %v", counts[0], counts[1], counts[10], counts[500])
+	} else if counts[0] < 100000/20 {
+		t.Errorf("rank 0 is chosen only %d times", counts[0])
+	}
+}
+
+func TestRunBenchCommand(t *testing.T) {
+	for _, w := range benchWorkloads {
+		var stdout, stderr bytes.Buffer
+		args := []string{"-workload", w.Name, "-records", "100", "-ops", "200", "-clients", "4", "-value-max", "300", "-scan-length", "10"}
+		if status := runBenchCommand(Options{}, args, &stdout, &stderr); status != exitOK {
+			t.Fatalf("status of %v : %v (%s)", w.Name, status, stderr.String())
+		}
+		for op, p := range w.Proportions {
+			if p > 0 && !strings.Contains(stdout.String(), "\n"+benchOpNames[op]+" ") {
+				t.Errorf("%v of %v is not reported :\n%s", benchOpNames[op], w.Name, stdout.String())
+			}
+		}
+	}
+
+	for _, args := range [][]string{
+		{"-workload", "none"},
+		{"-dist", "none"},
+		{"-records", "0"},
+		{"-unknown"},
+	} {
+		var stdout, stderr bytes.Buffer
+		if status := runBenchCommand(Options{}, args, &stdout, &stderr); status != exitUsage {
+			t.Errorf("status of %v : %v", args, status)
+		}
+	}
+}
+
+func BenchmarkWorkload(b *testing.B) {
+	for _, engine := range []string{"map", "btree", "lsm"} {
+		for _, w := range benchWorkloads {
+			b.Run(engine+"/"+w.Name, func(b *testing.B) {
+				_ = os.RemoveAll(tmpdir)
+				_ = os.MkdirAll(tmpdir, 0777)
+				storage, err := Open(Options{WALPath: testWALPath, DBPath: testDBPath, Backend: engine, CachePages: defaultCachePages})
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer storage.db.Close()
+				defer storage.wal.Close()
+				runner, err := newBenchRunner(storage, BenchConfig{
+					Workload:   w,
+					Records:    10000,
+					Operations: b.N,
+					Clients:    8,
+					ValueSize:  100,
+					ScanLength: 100,
+					Seed:       1,
+				})
+				if err != nil {
+					b.Fatal(err)
+				} else if err = runner.load(); err != nil {
+					b.Fatal(err)
+				}
+				b.ResetTimer()
+				result := runner.run()
+				b.StopTimer()
+				for _, op := range result.Ops {
+					b.ReportMetric(float64(op.P99.Microseconds()), op.Name+"-p99-µs")
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkStorage_Get(b *testing.B) {
+	storage := createTestStorage(b)
+	defer storage.wal.Close()
+	runner, err := newBenchRunner(storage, BenchConfig{Workload: benchWorkloads[0], Records: 10000, ValueSize: 100})
+	if err != nil {
+		b.Fatal(err)
+	} else if err = runner.load(); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		rnd := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			if _, err := storage.Get(runner.key(rnd)); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkStorage_View(b *testing.B) {
+	storage := createTestStorage(b)
+	defer storage.wal.Close()
+	runner, err := newBenchRunner(storage, BenchConfig{Workload: benchWorkloads[0], Records: 10000, ValueSize: 100})
+	if err != nil {
+		b.Fatal(err)
+	} else if err = runner.load(); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		rnd := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			if err := storage.View(runner.key(rnd), func([]byte) error { return nil }); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkStorage_Put(b *testing.B) {
+	storage := createTestStorage(b)
+	defer storage.wal.Close()
+	value := make([]byte, 100)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := storage.Put(benchKey(uint64(i)), value); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkTxn_CommitAsync(b *testing.B) {
+	storage := createTestStorage(b)
+	defer storage.Close()
+	value := make([]byte, 100)
+	futures := make([]*CommitFuture, 0, b.N)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		txn := storage.NewTxn()
+		if err := txn.Put(benchKey(uint64(i)), value); err != nil {
+			b.Fatal(err)
+		}
+		future, err := txn.CommitAsync()
+		if err != nil {
+			b.Fatal(err)
+		}
+		futures = append(futures, future)
+	}
+	for _, f := range futures {
+		if err := f.Wait(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRecordLog_Serialize(b *testing.B) {
+	rlog := RecordLog{Action: LUpdate, Record: Record{Key: benchKey(1), Value: make([]byte, 100), Version: 1}}
+	buf := make([]byte, 4096)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := rlog.Serialize(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkStorage_Import(b *testing.B) {
+	storage := createTestStorage(b)
+	defer storage.wal.Close()
+	value := make([]byte, 100)
+	i := 0
+	it := ImportFunc(func() (string, []byte, error) {
+		if i == b.N {
+			return "", nil, io.EOF
+		}
+		i++
+		return benchKey(uint64(i)), value, nil
+	})
+	b.ResetTimer()
+	if _, err := storage.Import(it, ImportOptions{}); err != nil {
+		b.Fatal(err)
+	}
+}
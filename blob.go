@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	// blobChunkSize is the size of each chunk. a chunk record fits in the pooled WAL buffer.
+	blobChunkSize = 3 << 10
+	// blobMaxKeyLen is the max length of blob key which leaves room for the chunk suffix.
+	blobMaxKeyLen = 255 - 9
+)
+
+const (
+	blobInline = iota
+	blobChunked
+)
+
+var ErrBlobKey = errors.New("blob key is too long")
+
+// blob header layout stored in the record of the blob key :
+//   inline  : flag(1) | value
+//   chunked : flag(1) | size(8) | chunkSize(4)
+// chunks are stored under the derived keys of blobChunkKey.
+
+// blobChunkKey returns the key of i th chunk of the blob. keys with the same prefix and
+// "\x00" followed by 8 bytes must not be used by other records.
+func blobChunkKey(key string, i int64) string {
+	var buf [255]byte
+	n := copy(buf[:], key)
+	buf[n] = 0
+	binary.BigEndian.PutUint64(buf[n+1:], uint64(i))
+	return string(buf[:n+9])
+}
+
+// blobHeader parses the header and returns the size, the chunk size and the inline value.
+func blobHeader(header []byte) (int64, int, []byte, error) {
+	if len(header) == 0 {
+		return 0, 0, nil, ErrBrokenValue
+	}
+	switch header[0] {
+	case blobInline:
+		return int64(len(header) - 1), 0, header[1:], nil
+	case blobChunked:
+		if len(header) != 13 {
+			return 0, 0, nil, ErrBrokenValue
+		}
+		chunkSize := int(binary.BigEndian.Uint32(header[9:]))
+		if chunkSize == 0 {
+			return 0, 0, nil, ErrBrokenValue
+		}
+		return int64(binary.BigEndian.Uint64(header[1:])), chunkSize, nil, nil
+	default:
+		return 0, 0, nil, ErrBrokenValue
+	}
+}
+
+// blobChunks returns the number of chunks of the blob.
+func blobChunks(size int64, chunkSize int) int64 {
+	if chunkSize == 0 {
+		return 0
+	}
+	return (size + int64(chunkSize) - 1) / int64(chunkSize)
+}
+
+// PutBlob inserts or replaces the blob read from r and returns the size.
+// the blob larger than blobChunkSize is split into chunks, so that the whole blob is never held
+// in one contiguous buffer. chunks are written in this transaction and become visible at commit.
+func (txn *Txn) PutBlob(key string, r io.Reader) (int64, error) {
+	if len(key) > blobMaxKeyLen {
+		return 0, ErrBlobKey
+	}
+	// chunks of the old blob which are not overwritten are deleted
+	var oldChunks int64
+	if header, err := txn.Read(key); err == nil {
+		size, chunkSize, _, err := blobHeader(header)
+		if err != nil {
+			return 0, err
+		}
+		oldChunks = blobChunks(size, chunkSize)
+	} else if err != ErrNotExist {
+		return 0, err
+	}
+
+	var (
+		size   int64
+		chunks int64
+		buf    = make([]byte, blobChunkSize)
+	)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			break
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		if chunks == 0 && err == io.ErrUnexpectedEOF {
+			// small blob is stored inline
+			if err = txn.Put(key, append([]byte{blobInline}, buf[:n]...)); err != nil {
+				return 0, err
+			}
+			return int64(n), txn.deleteChunks(key, 0, oldChunks)
+		}
+		if err := txn.Put(blobChunkKey(key, chunks), buf[:n]); err != nil {
+			return 0, err
+		}
+		size += int64(n)
+		chunks++
+		if n < blobChunkSize {
+			break
+		}
+	}
+	if chunks == 0 {
+		if err := txn.Put(key, []byte{blobInline}); err != nil {
+			return 0, err
+		}
+		return 0, txn.deleteChunks(key, 0, oldChunks)
+	}
+
+	var header [13]byte
+	header[0] = blobChunked
+	binary.BigEndian.PutUint64(header[1:], uint64(size))
+	binary.BigEndian.PutUint32(header[9:], blobChunkSize)
+	if err := txn.Put(key, header[:]); err != nil {
+		return 0, err
+	}
+	return size, txn.deleteChunks(key, chunks, oldChunks)
+}
+
+// GetBlob returns the reader of the blob and its size. chunks are read lazily by the reader,
+// which must be used before the transaction finishes.
+func (txn *Txn) GetBlob(key string) (io.Reader, int64, error) {
+	header, err := txn.Read(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	size, chunkSize, inline, err := blobHeader(header)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &blobReader{
+		txn:    txn,
+		key:    key,
+		chunks: blobChunks(size, chunkSize),
+		buf:    inline,
+	}, size, nil
+}
+
+// DeleteBlob deletes the blob and all of its chunks.
+func (txn *Txn) DeleteBlob(key string) error {
+	header, err := txn.Read(key)
+	if err != nil {
+		return err
+	}
+	size, chunkSize, _, err := blobHeader(header)
+	if err != nil {
+		return err
+	}
+	if err = txn.Delete(key); err != nil {
+		return err
+	}
+	return txn.deleteChunks(key, 0, blobChunks(size, chunkSize))
+}
+
+// deleteChunks deletes chunks in [from, to).
+func (txn *Txn) deleteChunks(key string, from, to int64) error {
+	for i := from; i < to; i++ {
+		if err := txn.Delete(blobChunkKey(key, i)); err != nil && err != ErrNotExist {
+			return err
+		}
+	}
+	return nil
+}
+
+// blobReader reads chunks of the blob one by one.
+type blobReader struct {
+	txn    *Txn
+	key    string
+	chunks int64
+	next   int64
+	// buf is the unread part of current chunk or inline value.
+	buf []byte
+}
+
+func (r *blobReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.next >= r.chunks {
+			return 0, io.EOF
+		}
+		chunk, err := r.txn.Read(blobChunkKey(r.key, r.next))
+		if err == ErrNotExist {
+			return 0, ErrBrokenValue
+		} else if err != nil {
+			return 0, err
+		}
+		r.buf = chunk
+		r.next++
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
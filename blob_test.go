@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func assertBlob(t *testing.T, txn *Txn, key string, expected []byte) {
+	t.Helper()
+	r, size, err := txn.GetBlob(key)
+	if err != nil {
+		t.Fatalf("failed to get blob %q : %v", key, err)
+	} else if size != int64(len(expected)) {
+		t.Errorf("size of blob %q not match %v, expected %v", key, size, len(expected))
+	}
+	if value, err := ioutil.ReadAll(r); err != nil {
+		t.Fatalf("failed to read blob %q : %v", key, err)
+	} else if !bytes.Equal(value, expected) {
+		t.Errorf("blob %q not match (len %v), expected len %v", key, len(value), len(expected))
+	}
+}
+
+func TestTxn_Blob(t *testing.T) {
+	storage := createTestStorage(t)
+	defer storage.wal.Close()
+	txn := storage.NewTxn()
+
+	rnd := rand.New(rand.NewSource(1))
+	large := make([]byte, 10*blobChunkSize+100)
+	rnd.Read(large)
+	for _, value := range [][]byte{large, large[:blobChunkSize], []byte("small"), nil, large[:3*blobChunkSize]} {
+		if size, err := txn.PutBlob("blob", bytes.NewReader(value)); err != nil {
+			t.Fatalf("failed to put blob : %v", err)
+		} else if size != int64(len(value)) {
+			t.Errorf("put size not match %v, expected %v", size, len(value))
+		}
+		assertBlob(t, txn, "blob", value)
+		if err := txn.Commit(); err != nil {
+			t.Fatalf("failed to commit : %v", err)
+		}
+		assertBlob(t, txn, "blob", value)
+	}
+	// chunks of old larger blobs are deleted
+	if n := storage.db.Len(); n != 4 {
+		t.Errorf("records not match %v, expected header and 3 chunks", n)
+	}
+
+	if err := txn.DeleteBlob("blob"); err != nil {
+		t.Fatalf("failed to delete blob : %v", err)
+	} else if err = txn.Commit(); err != nil {
+		t.Fatalf("failed to commit : %v", err)
+	}
+	if _, _, err := txn.GetBlob("blob"); err != ErrNotExist {
+		t.Errorf("deleted blob is not (not exist) : %v", err)
+	} else if n := storage.db.Len(); n != 0 {
+		t.Errorf("chunks are not deleted : %v records", n)
+	}
+
+	if _, err := txn.PutBlob(string(make([]byte, blobMaxKeyLen+1)), bytes.NewReader(nil)); err != ErrBlobKey {
+		t.Errorf("too long key is not (blob key) : %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+// bloomBitsPerKey is the number of bits per key of bloom filter. about 1% false positive.
+const bloomBitsPerKey = 10
+
+// bloomFilter tells that the key is definitely not in the set without reading the set.
+type bloomFilter struct {
+	bits []byte
+	// k is the number of hash functions
+	k uint8
+}
+
+// newBloomFilter creates bloom filter from hashes of keys by hashKey.
+func newBloomFilter(hashes []uint64, bitsPerKey int) *bloomFilter {
+	nbits := len(hashes) * bitsPerKey
+	// too small filter have high false positive rate
+	if nbits < 64 {
+		nbits = 64
+	}
+	// k = ln2 * bitsPerKey minimizes false positive rate
+	k := uint8(float64(bitsPerKey) * 0.69)
+	if k < 1 {
+		k = 1
+	} else if k > 30 {
+		k = 30
+	}
+	b := &bloomFilter{bits: make([]byte, (nbits+7)/8), k: k}
+	for _, h := range hashes {
+		b.add(h)
+	}
+	return b
+}
+
+// add sets k bits generated by double hashing of h.
+func (b *bloomFilter) add(h uint64) {
+	nbits := uint64(len(b.bits) * 8)
+	h1, h2 := h, h>>33|h<<31
+	for i := uint8(0); i < b.k; i++ {
+		pos := h1 % nbits
+		b.bits[pos/8] |= 1 << (pos % 8)
+		h1 += h2
+	}
+}
+
+func (b *bloomFilter) mayContain(h uint64) bool {
+	nbits := uint64(len(b.bits) * 8)
+	if nbits == 0 {
+		return true
+	}
+	h1, h2 := h, h>>33|h<<31
+	for i := uint8(0); i < b.k; i++ {
+		pos := h1 % nbits
+		if b.bits[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+		h1 += h2
+	}
+	return true
+}
+
+// serialize returns bits followed by k.
+func (b *bloomFilter) serialize() []byte {
+	return append(append([]byte(nil), b.bits...), b.k)
+}
+
+func deserializeBloomFilter(buf []byte) (*bloomFilter, error) {
+	if len(buf) < 1 {
+		return nil, ErrBrokenTable
+	}
+	return &bloomFilter{bits: buf[:len(buf)-1], k: buf[len(buf)-1]}, nil
+}
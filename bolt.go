@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+)
+
+// bbolt file format read by the bolt importer. A file is pages of the page size written in the
+// meta page. Page 0 and 1 are meta pages, and the meta with greater txid is used. Integers are
+// little endian.
+const (
+	boltMagic    = 0xED0CDAED
+	boltVersion  = 2
+	boltPageHead = 16
+	boltElemSize = 16
+	boltMetaSize = 64
+
+	boltBranchPage = 0x01
+	boltLeafPage   = 0x02
+	boltMetaPage   = 0x04
+
+	// boltBucketLeaf is the flag of the leaf element whose value is a bucket.
+	boltBucketLeaf = 0x01
+)
+
+var ErrInvalidBolt = errors.New("invalid bbolt file")
+
+// boltPage is the page of bbolt. The inline bucket is the page in the value of the bucket.
+type boltPage []byte
+
+func (p boltPage) flags() uint16 { return binary.LittleEndian.Uint16(p[8:]) }
+func (p boltPage) count() int    { return int(binary.LittleEndian.Uint16(p[10:])) }
+
+// elem returns the key and value of the leaf element or the key and child page of the branch
+// element.
+func (p boltPage) elem(i int) (flags uint32, key, value []byte, child uint64, err error) {
+	off := boltPageHead + i*boltElemSize
+	if off+boltElemSize > len(p) {
+		return 0, nil, nil, 0, ErrInvalidBolt
+	}
+	e := p[off : off+boltElemSize]
+	if p.flags()&boltBranchPage != 0 {
+		pos, ksize := int(binary.LittleEndian.Uint32(e)), int(binary.LittleEndian.Uint32(e[4:]))
+		if off+pos+ksize > len(p) {
+			return 0, nil, nil, 0, ErrInvalidBolt
+		}
+		return 0, p[off+pos : off+pos+ksize], nil, binary.LittleEndian.Uint64(e[8:]), nil
+	}
+	flags = binary.LittleEndian.Uint32(e)
+	pos, ksize, vsize := int(binary.LittleEndian.Uint32(e[4:])), int(binary.LittleEndian.Uint32(e[8:])), int(binary.LittleEndian.Uint32(e[12:]))
+	if off+pos+ksize+vsize > len(p) {
+		return 0, nil, nil, 0, ErrInvalidBolt
+	}
+	return flags, p[off+pos : off+pos+ksize], p[off+pos+ksize : off+pos+ksize+vsize], 0, nil
+}
+
+// boltCursor is the position in the page of the bucket.
+type boltCursor struct {
+	page   boltPage
+	i      int
+	prefix string
+}
+
+// boltIterator iterates all records of buckets in the bbolt file in the order of bbolt. Keys are
+// joined with the names of nested buckets by "/", e.g. "users/1" for the key "1" in the bucket
+// "users".
+type boltIterator struct {
+	r        io.ReaderAt
+	pageSize int
+	stack    []boltCursor
+}
+
+func newBoltIterator(r io.ReaderAt) (*boltIterator, error) {
+	it := &boltIterator{r: r}
+	root, err := it.meta()
+	if err != nil {
+		return nil, err
+	}
+	page, err := it.readPage(root)
+	if err != nil {
+		return nil, err
+	}
+	it.stack = []boltCursor{{page: page}}
+	return it, nil
+}
+
+// meta returns the root page of the valid meta page with the greater txid. The second meta page
+// is found by the page size of the first one, or the OS page size if the first one is broken.
+func (it *boltIterator) meta() (uint64, error) {
+	pageSize, root, txid, ok := readBoltMeta(it.r, 0)
+	off := int64(os.Getpagesize())
+	if ok {
+		off = int64(pageSize)
+	}
+	if ps, r, t, ok1 := readBoltMeta(it.r, off); ok1 && (!ok || t > txid) {
+		pageSize, root, ok = ps, r, true
+	}
+	if !ok || pageSize < boltPageHead+boltMetaSize {
+		return 0, ErrInvalidBolt
+	}
+	it.pageSize = pageSize
+	return root, nil
+}
+
+// readBoltMeta reads the meta page at off and returns its page size, root page and txid.
+func readBoltMeta(r io.ReaderAt, off int64) (pageSize int, root, txid uint64, ok bool) {
+	buf := make([]byte, boltPageHead+boltMetaSize)
+	if _, err := r.ReadAt(buf, off); err != nil {
+		return 0, 0, 0, false
+	}
+	m := buf[boltPageHead:]
+	h := fnv.New64a()
+	_, _ = h.Write(m[:56])
+	if boltPage(buf).flags()&boltMetaPage == 0 || binary.LittleEndian.Uint32(m) != boltMagic ||
+		binary.LittleEndian.Uint32(m[4:]) != boltVersion || h.Sum64() != binary.LittleEndian.Uint64(m[56:]) {
+		return 0, 0, 0, false
+	}
+	return int(binary.LittleEndian.Uint32(m[8:])), binary.LittleEndian.Uint64(m[16:]), binary.LittleEndian.Uint64(m[48:]), true
+}
+
+// readPage reads the page with its overflow pages.
+func (it *boltIterator) readPage(id uint64) (boltPage, error) {
+	head := make([]byte, boltPageHead)
+	if _, err := it.r.ReadAt(head, int64(id)*int64(it.pageSize)); err != nil {
+		return nil, fmt.Errorf("failed to read page %d : %w", id, err)
+	}
+	page := make(boltPage, (int(binary.LittleEndian.Uint32(head[12:]))+1)*it.pageSize)
+	if _, err := it.r.ReadAt(page, int64(id)*int64(it.pageSize)); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read page %d : %w", id, err)
+	}
+	if page.flags()&(boltBranchPage|boltLeafPage) == 0 {
+		return nil, fmt.Errorf("page %d is not branch or leaf : %w", id, ErrInvalidBolt)
+	}
+	return page, nil
+}
+
+func (it *boltIterator) Next() (string, []byte, error) {
+	for len(it.stack) > 0 {
+		c := &it.stack[len(it.stack)-1]
+		if c.i >= c.page.count() {
+			it.stack = it.stack[:len(it.stack)-1]
+			continue
+		}
+		flags, key, value, child, err := c.page.elem(c.i)
+		c.i++
+		prefix := c.prefix
+		if err != nil {
+			return "", nil, err
+		} else if c.page.flags()&boltBranchPage != 0 {
+			page, err := it.readPage(child)
+			if err != nil {
+				return "", nil, err
+			}
+			it.stack = append(it.stack, boltCursor{page: page, prefix: prefix})
+			continue
+		} else if flags&boltBucketLeaf == 0 {
+			return prefix + string(key), append([]byte(nil), value...), nil
+		}
+		// the bucket is inline in the value if its root page is 0
+		if len(value) < 16 {
+			return "", nil, ErrInvalidBolt
+		}
+		page := boltPage(value[16:])
+		if root := binary.LittleEndian.Uint64(value); root != 0 {
+			if page, err = it.readPage(root); err != nil {
+				return "", nil, err
+			}
+		} else if len(page) < boltPageHead {
+			return "", nil, ErrInvalidBolt
+		}
+		it.stack = append(it.stack, boltCursor{page: page, prefix: prefix + string(key) + "/"})
+	}
+	return "", nil, io.EOF
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testBoltPageSize is small to overflow pages by values smaller than the buffer of WAL.
+const testBoltPageSize = 1024
+
+type testBoltElem struct {
+	key, value []byte
+	// bucket is the inline bucket or root page of the bucket if not nil or 0
+	bucket []testBoltElem
+	root   uint64
+	child  uint64
+}
+
+// testBoltPage encodes the page of id with the elements.
+func testBoltPage(id uint64, flags uint16, elems []testBoltElem) []byte {
+	var data []byte
+	page := make([]byte, boltPageHead+len(elems)*boltElemSize)
+	binary.LittleEndian.PutUint64(page, id)
+	binary.LittleEndian.PutUint16(page[8:], flags)
+	binary.LittleEndian.PutUint16(page[10:], uint16(len(elems)))
+	for i, e := range elems {
+		off := boltPageHead + i*boltElemSize
+		pos := len(page) + len(data) - off
+		value := e.value
+		if e.bucket != nil || e.root != 0 {
+			value = make([]byte, 16)
+			binary.LittleEndian.PutUint64(value, e.root)
+			if e.root == 0 {
+				value = append(value, testBoltPage(0, boltLeafPage, e.bucket)...)
+			}
+		}
+		if flags&boltBranchPage != 0 {
+			binary.LittleEndian.PutUint32(page[off:], uint32(pos))
+			binary.LittleEndian.PutUint32(page[off+4:], uint32(len(e.key)))
+			binary.LittleEndian.PutUint64(page[off+8:], e.child)
+		} else {
+			if e.bucket != nil || e.root != 0 {
+				binary.LittleEndian.PutUint32(page[off:], boltBucketLeaf)
+			}
+			binary.LittleEndian.PutUint32(page[off+4:], uint32(pos))
+			binary.LittleEndian.PutUint32(page[off+8:], uint32(len(e.key)))
+			binary.LittleEndian.PutUint32(page[off+12:], uint32(len(value)))
+		}
+		data = append(data, e.key...)
+		data = append(data, value...)
+	}
+	return append(page, data...)
+}
+
+func testBoltMeta(id, root, txid uint64) []byte {
+	page := make([]byte, boltPageHead+boltMetaSize)
+	binary.LittleEndian.PutUint64(page, id)
+	binary.LittleEndian.PutUint16(page[8:], boltMetaPage)
+	m := page[boltPageHead:]
+	binary.LittleEndian.PutUint32(m, boltMagic)
+	binary.LittleEndian.PutUint32(m[4:], boltVersion)
+	binary.LittleEndian.PutUint32(m[8:], testBoltPageSize)
+	binary.LittleEndian.PutUint64(m[16:], root)
+	binary.LittleEndian.PutUint64(m[48:], txid)
+	h := fnv.New64a()
+	_, _ = h.Write(m[:56])
+	binary.LittleEndian.PutUint64(m[56:], h.Sum64())
+	return page
+}
+
+// writeTestBolt writes the bbolt file with the bucket "inline" and the bucket "users" whose root is
+// the branch page over 2 leaf pages, the first of which overflows to 2 pages for the large value and the
+// second of which has the nested bucket "admin".
+func writeTestBolt(t *testing.T, path string) map[string][]byte {
+	large := bytes.Repeat([]byte("x"), 2000)
+	pages := map[uint64][]byte{
+		0: testBoltMeta(0, 3, 1),
+		1: testBoltMeta(1, 3, 2),
+		2: testBoltPage(2, 0x10, nil),
+		3: testBoltPage(3, boltLeafPage, []testBoltElem{
+			{key: []byte("inline"), bucket: []testBoltElem{{key: []byte("a"), value: []byte("1")}, {key: []byte("b"), value: []byte("2")}}},
+			{key: []byte("users"), root: 4},
+		}),
+		4: testBoltPage(4, boltBranchPage, []testBoltElem{{key: []byte("1"), child: 5}, {key: []byte("3"), child: 8}}),
+		5: testBoltPage(5, boltLeafPage, []testBoltElem{{key: []byte("1"), value: []byte("alice")}, {key: []byte("2"), value: large}}),
+		8: testBoltPage(8, boltLeafPage, []testBoltElem{
+			{key: []byte("3"), value: []byte("carol")},
+			{key: []byte("admin"), bucket: []testBoltElem{{key: []byte("1"), value: []byte{}}}},
+		}),
+	}
+	buf := make([]byte, 9*testBoltPageSize)
+	for id, page := range pages {
+		binary.LittleEndian.PutUint32(page[12:], uint32((len(page)-1)/testBoltPageSize))
+		copy(buf[id*testBoltPageSize:], page)
+	}
+	if err := ioutil.WriteFile(path, buf, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return map[string][]byte{
+		"inline/a": []byte("1"), "inline/b": []byte("2"),
+		"users/1": []byte("alice"), "users/2": large, "users/3": []byte("carol"), "users/admin/1": {},
+	}
+}
+
+func TestBoltIterator(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	path := filepath.Join(tmpdir, "bolt.db")
+	expected := writeTestBolt(t, path)
+	readAll := func() (map[string][]byte, []string, error) {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		it, err := newBoltIterator(f)
+		if err != nil {
+			return nil, nil, err
+		}
+		records := make(map[string][]byte)
+		var keys []string
+		for {
+			key, value, err := it.Next()
+			if err == io.EOF {
+				return records, keys, nil
+			} else if err != nil {
+				return records, keys, err
+			}
+			records[key] = value
+			keys = append(keys, key)
+		}
+	}
+	records, keys, err := readAll()
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(keys, []string{"inline/a", "inline/b", "users/1", "users/2", "users/3", "users/admin/1"}) {
+		t.Errorf("order of keys : %q", keys)
+	}
+	for key, value := range expected {
+		if !bytes.Equal(records[key], value) {
+			t.Errorf("value of %v : %q", key, records[key])
+		}
+	}
+
+	// the older meta is used if the newer one is broken
+	corruptFile(t, path, testBoltPageSize+boltPageHead+20)
+	if records, _, err = readAll(); err != nil || len(records) != len(expected) {
+		t.Errorf("read by older meta : %v records, %v", len(records), err)
+	}
+	corruptFile(t, path, boltPageHead+20)
+	if _, _, err = readAll(); err != ErrInvalidBolt {
+		t.Errorf("both meta pages are broken : %v", err)
+	}
+}
@@ -0,0 +1,679 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	btreeMagic = 0x74786e67 // "txng"
+
+	nodeHeaderSize = slottedHeaderSize
+)
+
+// bnode is the in-memory representation of a leaf or branch page.
+type bnode struct {
+	// pgid is the page id on disk. 0 if the node is not written yet.
+	pgid  uint64
+	leaf  bool
+	dirty bool
+	keys  []string
+
+	// leaf entries
+	versions []uint64
+	// values is nil for the value stored in overflow pages and not loaded.
+	values [][]byte
+	// overflow is the first overflow page id of the value. 0 if the value is inline.
+	overflow []uint64
+	// valueLens is the length of values stored in overflow pages.
+	valueLens []uint32
+
+	// branch entries
+	children []uint64
+	// nodes is the loaded children. only nodes on the written path are kept.
+	nodes []*bnode
+}
+
+// entrySize returns the size of the record and its slot in slotted page.
+func (n *bnode) entrySize(i int) int {
+	if !n.leaf {
+		return slotSize + 1 + len(n.keys[i]) + 8
+	}
+	size := slotSize + 1 + len(n.keys[i]) + 8 + 1 + 4
+	if n.overflow[i] != 0 || len(n.values[i]) > overflowThreshold {
+		return size + 8
+	}
+	return size + len(n.values[i])
+}
+
+func (n *bnode) size() int {
+	size := nodeHeaderSize
+	for i := range n.keys {
+		size += n.entrySize(i)
+	}
+	return size
+}
+
+// search returns the index of the first key which is not less than the key.
+func (n *bnode) search(key string) int {
+	return sort.SearchStrings(n.keys, key)
+}
+
+// childIndex returns the index of the child which may contain the key.
+func (n *bnode) childIndex(key string) int {
+	i := sort.Search(len(n.keys), func(i int) bool { return n.keys[i] > key })
+	if i == 0 {
+		return 0
+	}
+	return i - 1
+}
+
+// BTree is the disk-backed B+tree engine. Modified pages are written into new pages
+// (copy on write) at checkpoint and the meta page is switched atomically,
+// so the data file is always consistent with the last checkpoint.
+type BTree struct {
+	pager
+	root  *bnode
+	count int
+}
+
+func newBTree(path string, cachePages int) *BTree {
+	return &BTree{
+		pager: pager{path: path, magic: btreeMagic, fs: osFS{}, cachePages: cachePages},
+		root:  &bnode{leaf: true, dirty: true},
+	}
+}
+
+func (t *BTree) readNode(pgid uint64) (*bnode, error) {
+	var buf [pageSize]byte
+	page, err := t.view(pgid, buf[:])
+	if err != nil {
+		return nil, err
+	}
+	sp := slottedPage(page)
+	if err = sp.verify(); err != nil {
+		return nil, err
+	}
+	n := &bnode{pgid: pgid}
+	switch page[0] {
+	case pageLeaf:
+		n.leaf = true
+	case pageBranch:
+	default:
+		return nil, ErrBrokenPage
+	}
+	// record layout : keyLen(1) | key | child(8) for branch,
+	// keyLen(1) | key | version(8) | overflow(1) | valueLen(4) | value or overflow pgid(8) for leaf
+	for i := 0; i < sp.count(); i++ {
+		rec := sp.record(i)
+		if len(rec) < 1 || len(rec) < 1+int(rec[0]) {
+			return nil, ErrBrokenPage
+		}
+		keyLen := int(rec[0])
+		n.keys = append(n.keys, string(rec[1:1+keyLen]))
+		rec = rec[1+keyLen:]
+		if !n.leaf {
+			if len(rec) != 8 {
+				return nil, ErrBrokenPage
+			}
+			n.children = append(n.children, binary.BigEndian.Uint64(rec))
+			n.nodes = append(n.nodes, nil)
+			continue
+		}
+
+		if len(rec) < 13 {
+			return nil, ErrBrokenPage
+		}
+		n.versions = append(n.versions, binary.BigEndian.Uint64(rec))
+		isOverflow := rec[8] == 1
+		valueLen := binary.BigEndian.Uint32(rec[9:])
+		rec = rec[13:]
+		if isOverflow {
+			if len(rec) != 8 {
+				return nil, ErrBrokenPage
+			}
+			n.values = append(n.values, nil)
+			n.overflow = append(n.overflow, binary.BigEndian.Uint64(rec))
+			n.valueLens = append(n.valueLens, valueLen)
+		} else {
+			if len(rec) != int(valueLen) {
+				return nil, ErrBrokenPage
+			}
+			n.values = append(n.values, clone(rec))
+			n.overflow = append(n.overflow, 0)
+			n.valueLens = append(n.valueLens, valueLen)
+		}
+	}
+	return n, nil
+}
+
+func (t *BTree) writeNode(n *bnode) error {
+	var buf [pageSize]byte
+	typ := uint8(pageBranch)
+	if n.leaf {
+		typ = pageLeaf
+	}
+	sp := initSlottedPage(buf[:], typ)
+	var rec [1 + 255 + 21 + overflowThreshold]byte
+	for i, key := range n.keys {
+		rec[0] = uint8(len(key))
+		p := 1 + copy(rec[1:], key)
+		if !n.leaf {
+			binary.BigEndian.PutUint64(rec[p:], n.children[i])
+			p += 8
+		} else {
+			binary.BigEndian.PutUint64(rec[p:], n.versions[i])
+			if n.overflow[i] == 0 && len(n.values[i]) > overflowThreshold {
+				pgid, err := t.writeOverflow(n.values[i])
+				if err != nil {
+					return err
+				}
+				n.overflow[i] = pgid
+				n.valueLens[i] = uint32(len(n.values[i]))
+				// large value is loaded from overflow pages on demand
+				n.values[i] = nil
+			}
+			if n.overflow[i] != 0 {
+				rec[p+8] = 1
+				binary.BigEndian.PutUint32(rec[p+9:], n.valueLens[i])
+				binary.BigEndian.PutUint64(rec[p+13:], n.overflow[i])
+				p += 21
+			} else {
+				rec[p+8] = 0
+				binary.BigEndian.PutUint32(rec[p+9:], uint32(len(n.values[i])))
+				p += 13 + copy(rec[p+13:], n.values[i])
+			}
+		}
+		if err := sp.insert(i, rec[:p]); err != nil {
+			return err
+		}
+	}
+	// the page is versioned by the checkpoint which writes it
+	sp.seal(t.txid + 1)
+	n.pgid = t.allocate()
+	n.dirty = false
+	return t.writePage(n.pgid, buf[:])
+}
+
+// child returns i th child of the branch node. if attach is true, the loaded node is kept in n.
+func (t *BTree) child(n *bnode, i int, attach bool) (*bnode, error) {
+	if c := n.nodes[i]; c != nil {
+		return c, nil
+	}
+	c, err := t.readNode(n.children[i])
+	if err != nil {
+		return nil, err
+	}
+	if attach {
+		n.nodes[i] = c
+	}
+	return c, nil
+}
+
+// touch marks the node dirty. the page of the node is released because it is rewritten at checkpoint.
+func (t *BTree) touch(n *bnode) {
+	if n.dirty {
+		return
+	}
+	if n.pgid != 0 {
+		t.release(n.pgid)
+		n.pgid = 0
+	}
+	n.dirty = true
+}
+
+func (t *BTree) Get(key string) (Record, error) {
+	n := t.root
+	for !n.leaf {
+		var err error
+		if n, err = t.child(n, n.childIndex(key), false); err != nil {
+			return Record{}, err
+		}
+	}
+	i := n.search(key)
+	if i == len(n.keys) || n.keys[i] != key {
+		return Record{}, ErrNotExist
+	}
+	value := n.values[i]
+	if value == nil {
+		var err error
+		if value, err = t.readOverflow(n.overflow[i], n.valueLens[i]); err != nil {
+			return Record{}, err
+		}
+	}
+	return Record{Key: n.keys[i], Value: value, Version: n.versions[i]}, nil
+}
+
+// writePath loads and marks dirty the nodes from root to the leaf which may contain the key.
+func (t *BTree) writePath(key string) ([]*bnode, []int, error) {
+	var (
+		nodes   = []*bnode{t.root}
+		indexes []int
+	)
+	t.touch(t.root)
+	for n := t.root; !n.leaf; {
+		i := n.childIndex(key)
+		c, err := t.child(n, i, true)
+		if err != nil {
+			return nil, nil, err
+		}
+		t.touch(c)
+		nodes = append(nodes, c)
+		indexes = append(indexes, i)
+		n = c
+	}
+	return nodes, indexes, nil
+}
+
+func (t *BTree) Put(r Record) error {
+	nodes, indexes, err := t.writePath(r.Key)
+	if err != nil {
+		return err
+	}
+	leaf := nodes[len(nodes)-1]
+	i := leaf.search(r.Key)
+	if i < len(leaf.keys) && leaf.keys[i] == r.Key {
+		// replace value
+		if leaf.overflow[i] != 0 {
+			if err = t.releaseOverflow(leaf.overflow[i]); err != nil {
+				return err
+			}
+		}
+		leaf.versions[i] = r.Version
+		leaf.values[i] = r.Value
+		leaf.overflow[i] = 0
+		leaf.valueLens[i] = 0
+	} else {
+		leaf.keys = insertString(leaf.keys, i, r.Key)
+		leaf.versions = insertUint64(leaf.versions, i, r.Version)
+		leaf.values = insertBytes(leaf.values, i, r.Value)
+		leaf.overflow = insertUint64(leaf.overflow, i, 0)
+		leaf.valueLens = insertUint32(leaf.valueLens, i, 0)
+		t.count++
+	}
+
+	// split nodes from leaf to root
+	for depth := len(nodes) - 1; depth >= 0; depth-- {
+		n := nodes[depth]
+		if n.size() <= pageSize {
+			break
+		}
+		siblings := split(n)
+		if depth == 0 {
+			// grow new root
+			root := &bnode{dirty: true}
+			for _, c := range siblings {
+				root.keys = append(root.keys, c.keys[0])
+				root.children = append(root.children, 0)
+				root.nodes = append(root.nodes, c)
+			}
+			t.root = root
+			break
+		}
+		parent, idx := nodes[depth-1], indexes[depth-1]
+		for j, c := range siblings[1:] {
+			parent.keys = insertString(parent.keys, idx+1+j, c.keys[0])
+			parent.children = insertUint64(parent.children, idx+1+j, 0)
+			parent.nodes = insertNode(parent.nodes, idx+1+j, c)
+		}
+	}
+	return nil
+}
+
+// split divides the node into nodes fit in a page. the first node is n itself.
+func split(n *bnode) []*bnode {
+	var (
+		nodes = []*bnode{n}
+		start int
+		size  = nodeHeaderSize
+	)
+	for i := range n.keys {
+		es := n.entrySize(i)
+		if size+es > pageSize && i > start {
+			nodes = append(nodes, n.slice(i, len(n.keys)))
+			start = i
+			size = nodeHeaderSize
+		}
+		size += es
+	}
+	// all nodes are sliced to the end. cut each node at the start of the next node.
+	for i := 0; i < len(nodes)-1; i++ {
+		nodes[i].truncate(len(nodes[i].keys) - len(nodes[i+1].keys))
+	}
+	return nodes
+}
+
+func (n *bnode) slice(from, to int) *bnode {
+	c := &bnode{leaf: n.leaf, dirty: true}
+	c.keys = append(c.keys, n.keys[from:to]...)
+	if n.leaf {
+		c.versions = append(c.versions, n.versions[from:to]...)
+		c.values = append(c.values, n.values[from:to]...)
+		c.overflow = append(c.overflow, n.overflow[from:to]...)
+		c.valueLens = append(c.valueLens, n.valueLens[from:to]...)
+	} else {
+		c.children = append(c.children, n.children[from:to]...)
+		c.nodes = append(c.nodes, n.nodes[from:to]...)
+	}
+	return c
+}
+
+func (n *bnode) truncate(size int) {
+	n.keys = n.keys[:size]
+	if n.leaf {
+		n.versions = n.versions[:size]
+		n.values = n.values[:size]
+		n.overflow = n.overflow[:size]
+		n.valueLens = n.valueLens[:size]
+	} else {
+		n.children = n.children[:size]
+		n.nodes = n.nodes[:size]
+	}
+}
+
+func (n *bnode) remove(i int) {
+	n.keys = append(n.keys[:i], n.keys[i+1:]...)
+	if n.leaf {
+		n.versions = append(n.versions[:i], n.versions[i+1:]...)
+		n.values = append(n.values[:i], n.values[i+1:]...)
+		n.overflow = append(n.overflow[:i], n.overflow[i+1:]...)
+		n.valueLens = append(n.valueLens[:i], n.valueLens[i+1:]...)
+	} else {
+		n.children = append(n.children[:i], n.children[i+1:]...)
+		n.nodes = append(n.nodes[:i], n.nodes[i+1:]...)
+	}
+}
+
+func (t *BTree) Delete(key string) error {
+	nodes, indexes, err := t.writePath(key)
+	if err != nil {
+		return err
+	}
+	leaf := nodes[len(nodes)-1]
+	i := leaf.search(key)
+	if i == len(leaf.keys) || leaf.keys[i] != key {
+		return nil
+	}
+	if leaf.overflow[i] != 0 {
+		if err = t.releaseOverflow(leaf.overflow[i]); err != nil {
+			return err
+		}
+	}
+	leaf.remove(i)
+	t.count--
+
+	// remove empty nodes from leaf to root
+	// TODO: merge small nodes with siblings
+	for depth := len(nodes) - 1; depth > 0; depth-- {
+		if len(nodes[depth].keys) != 0 {
+			break
+		}
+		nodes[depth-1].remove(indexes[depth-1])
+	}
+	// shrink root which have only one child
+	for !t.root.leaf && len(t.root.keys) <= 1 {
+		if len(t.root.keys) == 0 {
+			t.root = &bnode{leaf: true, dirty: true}
+			break
+		}
+		c, err := t.child(t.root, 0, true)
+		if err != nil {
+			return err
+		}
+		t.touch(c)
+		t.root = c
+	}
+	return nil
+}
+
+func (t *BTree) Len() int {
+	return t.count
+}
+
+func (t *BTree) Keys(prefix string, fn func(key string) bool) error {
+	_, err := t.ascend(t.root, prefix, func(key string) bool {
+		return strings.HasPrefix(key, prefix) && fn(key)
+	})
+	return err
+}
+
+// ascend calls fn for each key not less than from in order until fn returns false.
+func (t *BTree) ascend(n *bnode, from string, fn func(key string) bool) (bool, error) {
+	if n.leaf {
+		for i := n.search(from); i < len(n.keys); i++ {
+			if !fn(n.keys[i]) {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+	for i := n.childIndex(from); i < len(n.keys); i++ {
+		c, err := t.child(n, i, false)
+		if err != nil {
+			return false, err
+		}
+		if ok, err := t.ascend(c, from, fn); err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (t *BTree) KeysReverse(prefix string, fn func(key string) bool) error {
+	_, err := t.descend(t.root, prefixEnd(prefix), func(key string) bool {
+		return strings.HasPrefix(key, prefix) && fn(key)
+	})
+	return err
+}
+
+// descend calls fn for each key less than upper in descending order until fn returns false.
+// if upper is empty, all keys are visited.
+func (t *BTree) descend(n *bnode, upper string, fn func(key string) bool) (bool, error) {
+	if n.leaf {
+		i := len(n.keys)
+		if upper != "" {
+			i = n.search(upper)
+		}
+		for i--; i >= 0; i-- {
+			if !fn(n.keys[i]) {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+	i := len(n.keys) - 1
+	if upper != "" {
+		i = n.childIndex(upper)
+	}
+	for ; i >= 0; i-- {
+		c, err := t.child(n, i, false)
+		if err != nil {
+			return false, err
+		}
+		if ok, err := t.descend(c, upper, fn); err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// writeDirty writes all dirty nodes under n and detaches loaded children.
+func (t *BTree) writeDirty(n *bnode) error {
+	if !n.dirty {
+		return nil
+	}
+	for i, c := range n.nodes {
+		if c == nil {
+			continue
+		}
+		if err := t.writeDirty(c); err != nil {
+			return err
+		}
+		n.children[i] = c.pgid
+		n.nodes[i] = nil
+	}
+	return t.writeNode(n)
+}
+
+// Save writes dirty pages and switches the meta page.
+func (t *BTree) Save(version uint64) error {
+	if err := t.create(); err != nil {
+		return err
+	}
+	if err := t.writeDirty(t.root); err != nil {
+		return err
+	}
+	// meta payload : root(8) | version(8) | count(8)
+	var payload [24]byte
+	binary.BigEndian.PutUint64(payload[0:8], t.root.pgid)
+	binary.BigEndian.PutUint64(payload[8:16], version)
+	binary.BigEndian.PutUint64(payload[16:24], uint64(t.count))
+	return t.commit(payload[:])
+}
+
+// Load opens the data file and reads the newest valid meta page.
+func (t *BTree) Load() (uint64, error) {
+	payload, err := t.open()
+	if err != nil {
+		return 0, err
+	} else if len(payload) != 24 {
+		return 0, ErrBrokenPage
+	}
+	root := binary.BigEndian.Uint64(payload[0:8])
+	t.count = int(binary.BigEndian.Uint64(payload[16:24]))
+	if root == 0 {
+		t.root = &bnode{leaf: true, dirty: true}
+	} else if t.root, err = t.readNode(root); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(payload[8:16]), nil
+}
+
+func (t *BTree) Close() error {
+	return t.close()
+}
+
+// Verify walks all nodes from the root and checks checksums of pages, the order of keys against
+// separators of parents, the depth of leaves, overflow values and the count of records.
+func (t *BTree) Verify(ctx context.Context, problem func(VerifyProblem)) (int, error) {
+	v := btreeVerifier{t: t, ctx: ctx, problem: problem, leafDepth: -1, pages: make(map[uint64]bool)}
+	if err := v.node(t.root, "", "", 0); err != nil {
+		return v.nodes, err
+	}
+	if v.records != t.count {
+		problem(VerifyProblem{Check: "btree", Detail: fmt.Sprintf("leaves have %d records, but counted %d", v.records, t.count)})
+	}
+	return v.nodes, nil
+}
+
+type btreeVerifier struct {
+	t         *BTree
+	ctx       context.Context
+	problem   func(VerifyProblem)
+	nodes     int
+	records   int
+	leafDepth int
+	// pages is the pages referred by nodes already visited.
+	pages map[uint64]bool
+}
+
+// node verifies the subtree of n whose keys must be in [lower, upper). upper "" is unbounded.
+func (v *btreeVerifier) node(n *bnode, lower, upper string, depth int) error {
+	if v.nodes++; v.nodes%64 == 0 {
+		if err := v.ctx.Err(); err != nil {
+			return err
+		}
+	}
+	report := func(key, format string, args ...interface{}) {
+		v.problem(VerifyProblem{Check: "btree", Key: key, Detail: fmt.Sprintf("page %d : ", n.pgid) + fmt.Sprintf(format, args...)})
+	}
+	for i, key := range n.keys {
+		if i > 0 && n.keys[i-1] >= key {
+			report(key, "key is not greater than previous key %q", n.keys[i-1])
+		} else if (n.leaf || i > 0) && (key < lower || (upper != "" && key >= upper)) {
+			// the first separator of branch may be less than keys of the first child
+			report(key, "key is out of range [%q, %q) of parent", lower, upper)
+		}
+	}
+	if n.leaf {
+		if v.leafDepth < 0 {
+			v.leafDepth = depth
+		} else if depth != v.leafDepth {
+			report("", "leaf is at depth %d, but others are at %d", depth, v.leafDepth)
+		}
+		v.records += len(n.keys)
+		for i := range n.keys {
+			if n.overflow[i] == 0 {
+				continue
+			} else if v.pages[n.overflow[i]] {
+				report(n.keys[i], "overflow page %d is referred twice", n.overflow[i])
+			} else if _, err := v.t.readOverflow(n.overflow[i], n.valueLens[i]); err != nil {
+				report(n.keys[i], "failed to read overflow value : %v", err)
+			}
+			v.pages[n.overflow[i]] = true
+		}
+		return nil
+	}
+	for i := range n.keys {
+		if pgid := n.children[i]; n.nodes[i] == nil && v.pages[pgid] {
+			report(n.keys[i], "child page %d is referred twice", pgid)
+			continue
+		} else if n.nodes[i] == nil {
+			v.pages[pgid] = true
+		}
+		c, err := v.t.child(n, i, false)
+		if err != nil {
+			report(n.keys[i], "failed to read child page %d : %v", n.children[i], err)
+			continue
+		}
+		clower, cupper := lower, upper
+		if i > 0 {
+			clower = n.keys[i]
+		}
+		if i+1 < len(n.keys) {
+			cupper = n.keys[i+1]
+		}
+		if err = v.node(c, clower, cupper, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func insertString(s []string, i int, v string) []string {
+	s = append(s, "")
+	copy(s[i+1:], s[i:])
+	s[i] = v
+	return s
+}
+
+func insertUint64(s []uint64, i int, v uint64) []uint64 {
+	s = append(s, 0)
+	copy(s[i+1:], s[i:])
+	s[i] = v
+	return s
+}
+
+func insertUint32(s []uint32, i int, v uint32) []uint32 {
+	s = append(s, 0)
+	copy(s[i+1:], s[i:])
+	s[i] = v
+	return s
+}
+
+func insertBytes(s [][]byte, i int, v []byte) [][]byte {
+	s = append(s, nil)
+	copy(s[i+1:], s[i:])
+	s[i] = v
+	return s
+}
+
+func insertNode(s []*bnode, i int, v *bnode) []*bnode {
+	s = append(s, nil)
+	copy(s[i+1:], s[i:])
+	s[i] = v
+	return s
+}
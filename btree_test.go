@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func createTestBTree(t *testing.T) *BTree {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	return newBTree(testDBPath, defaultCachePages)
+}
+
+func assertBTree(t *testing.T, tree *BTree, expected map[string][]byte) {
+	t.Helper()
+	if tree.Len() != len(expected) {
+		t.Errorf("count not match %v, expected %v", tree.Len(), len(expected))
+	}
+	for k, v := range expected {
+		if r, err := tree.Get(k); err != nil {
+			t.Fatalf("failed to get %q : %v", k, err)
+		} else if !bytes.Equal(r.Value, v) {
+			t.Fatalf("value for %q not match (len %v), expected len %v", k, len(r.Value), len(v))
+		}
+	}
+	var keys, expectedKeys []string
+	for k := range expected {
+		expectedKeys = append(expectedKeys, k)
+	}
+	sort.Strings(expectedKeys)
+	if err := tree.Keys("", func(key string) bool {
+		keys = append(keys, key)
+		return true
+	}); err != nil {
+		t.Fatalf("failed to iterate keys : %v", err)
+	}
+	if fmt.Sprint(keys) != fmt.Sprint(expectedKeys) {
+		t.Fatalf("keys not match %v, expected %v", len(keys), len(expectedKeys))
+	}
+}
+
+func TestBTree(t *testing.T) {
+	tree := createTestBTree(t)
+	defer func() { tree.Close() }()
+
+	rnd := rand.New(rand.NewSource(1))
+	expected := make(map[string][]byte)
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 2000; i++ {
+			key := fmt.Sprintf("key%05d", rnd.Intn(3000))
+			if rnd.Intn(4) == 0 {
+				if err := tree.Delete(key); err != nil {
+					t.Fatalf("failed to delete %q : %v", key, err)
+				}
+				delete(expected, key)
+				continue
+			}
+			// some values are larger than a page
+			value := bytes.Repeat([]byte{byte(i)}, rnd.Intn(100)+rnd.Intn(2)*rnd.Intn(3*pageSize))
+			if err := tree.Put(Record{Key: key, Value: value, Version: uint64(round)}); err != nil {
+				t.Fatalf("failed to put %q : %v", key, err)
+			}
+			expected[key] = value
+		}
+		assertBTree(t, tree, expected)
+
+		if err := tree.Save(uint64(round)); err != nil {
+			t.Fatalf("failed to save : %v", err)
+		}
+		assertBTree(t, tree, expected)
+
+		// reopen
+		tree.Close()
+		tree = newBTree(testDBPath, defaultCachePages)
+		if version, err := tree.Load(); err != nil {
+			t.Fatalf("failed to load : %v", err)
+		} else if version != uint64(round) {
+			t.Errorf("version not match %v, expected %v", version, round)
+		}
+		assertBTree(t, tree, expected)
+	}
+
+	// delete all keys and pages are reused
+	for k := range expected {
+		if err := tree.Delete(k); err != nil {
+			t.Fatalf("failed to delete %q : %v", k, err)
+		}
+		delete(expected, k)
+	}
+	assertBTree(t, tree, expected)
+	npages := tree.npages
+	for i := 0; i < 3; i++ {
+		if err := tree.Save(0); err != nil {
+			t.Fatalf("failed to save : %v", err)
+		}
+	}
+	if tree.npages > npages+2 {
+		t.Errorf("freed pages are not reused : %v pages, before %v pages", tree.npages, npages)
+	}
+}
+
+func TestBTree_Prefix(t *testing.T) {
+	tree := createTestBTree(t)
+	defer tree.Close()
+	for i := 0; i < 1000; i++ {
+		if err := tree.Put(Record{Key: fmt.Sprintf("%c%04d", 'a'+i%3, i), Value: []byte("v")}); err != nil {
+			t.Fatalf("failed to put : %v", err)
+		}
+	}
+	var keys []string
+	if err := tree.Keys("b00", func(key string) bool {
+		keys = append(keys, key)
+		return true
+	}); err != nil {
+		t.Fatalf("failed to iterate keys : %v", err)
+	}
+	if len(keys) != 33 || keys[0] != "b0001" || keys[len(keys)-1] != "b0097" {
+		t.Errorf("keys not match %v", keys)
+	}
+}
+
+func TestBTreeStorage(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	walPath := filepath.Join(tmpdir, "btree.log")
+	open := func() *Storage {
+		wal, err := os.OpenFile(walPath, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		storage := NewBTreeStorage(wal, testDBPath)
+		storage.checkpointSize = 2 * pageSize
+		if err = storage.LoadCheckPoint(); err != nil && !os.IsNotExist(err) {
+			t.Fatalf("failed to load checkpoint : %v", err)
+		} else if _, err = storage.LoadWAL(); err != nil {
+			t.Fatalf("failed to load WAL : %v", err)
+		}
+		return storage
+	}
+
+	storage := open()
+	txn := storage.NewTxn()
+	for i := 0; i < 500; i++ {
+		if err := txn.Insert(fmt.Sprintf("key%03d", i), []byte(fmt.Sprintf("value%03d", i))); err != nil {
+			t.Fatalf("failed to insert : %v", err)
+		}
+		if i%10 == 9 {
+			if err := txn.Commit(); err != nil {
+				t.Fatalf("failed to commit : %v", err)
+			}
+		}
+	}
+	if storage.db.(*BTree).txid == 0 {
+		t.Errorf("checkpoint is not triggered by WAL size")
+	}
+	// crash without checkpoint
+	storage.wal.Close()
+	storage.db.Close()
+
+	storage = open()
+	defer storage.wal.Close()
+	defer storage.db.Close()
+	txn = storage.NewTxn()
+	for i := 0; i < 500; i++ {
+		assertValue(t, txn, fmt.Sprintf("key%03d", i), []byte(fmt.Sprintf("value%03d", i)))
+	}
+}
+
+func TestBTree_Mmap(t *testing.T) {
+	tree := createTestBTree(t)
+	tree.useMmap = true
+	defer func() { tree.Close() }()
+
+	expected := make(map[string][]byte)
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 1000; i++ {
+			key := fmt.Sprintf("key%05d", i*(round+1))
+			value := bytes.Repeat([]byte{byte(round)}, i%3*overflowThreshold+10)
+			if err := tree.Put(Record{Key: key, Value: value}); err != nil {
+				t.Fatalf("failed to put %q : %v", key, err)
+			}
+			expected[key] = value
+		}
+		if err := tree.Save(uint64(round)); err != nil {
+			t.Fatalf("failed to save : %v", err)
+		}
+		if len(tree.data) != int(tree.npages)*pageSize {
+			t.Errorf("mapped size not match %v, expected %v", len(tree.data), tree.npages*pageSize)
+		}
+		assertBTree(t, tree, expected)
+
+		// reopen
+		tree.Close()
+		tree = newBTree(testDBPath, defaultCachePages)
+		tree.useMmap = true
+		if _, err := tree.Load(); err != nil {
+			t.Fatalf("failed to load : %v", err)
+		} else if tree.pool != nil {
+			t.Errorf("buffer pool is used with mmap")
+		}
+		assertBTree(t, tree, expected)
+	}
+}
+
+func TestBTree_KeysReverse(t *testing.T) {
+	tree := createTestBTree(t)
+	defer tree.Close()
+	for i := 0; i < 1000; i++ {
+		if err := tree.Put(Record{Key: fmt.Sprintf("%c%04d", 'a'+i%3, i), Value: []byte("v")}); err != nil {
+			t.Fatalf("failed to put : %v", err)
+		}
+	}
+	for _, prefix := range []string{"", "b00", "c", "d"} {
+		var keys, reversed []string
+		if err := tree.Keys(prefix, func(key string) bool {
+			keys = append(keys, key)
+			return true
+		}); err != nil {
+			t.Fatalf("failed to iterate keys : %v", err)
+		}
+		if err := tree.KeysReverse(prefix, func(key string) bool {
+			reversed = append([]string{key}, reversed...)
+			return true
+		}); err != nil {
+			t.Fatalf("failed to iterate keys in reverse : %v", err)
+		}
+		if fmt.Sprint(keys) != fmt.Sprint(reversed) {
+			t.Errorf("reversed keys with prefix %q not match (%v keys), expected %v keys", prefix, len(reversed), len(keys))
+		}
+	}
+}
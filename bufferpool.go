@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+// defaultCachePages is the default number of pages cached by buffer pool. (4 MiB)
+const defaultCachePages = 1024
+
+var ErrPoolExhausted = errors.New("all pages in buffer pool are pinned")
+
+// frame is a slot of buffer pool which holds a page.
+type frame struct {
+	pgid  uint64
+	buf   [pageSize]byte
+	valid bool
+	pin   int
+	dirty bool
+	// ref is the reference bit of clock algorithm.
+	ref bool
+}
+
+// bufferPool is the fixed size page cache between the data file and engines.
+// Fetched frames are pinned and never evicted until unpinned. Dirty frames are written back
+// to the data file when they are evicted or flushed. Victims are chosen by clock algorithm.
+// bufferPool is safe for concurrent use because engines read pages under shared lock.
+type bufferPool struct {
+	mu     sync.Mutex
+	f      File
+	frames []frame
+	table  map[uint64]int
+	hand   int
+}
+
+func newBufferPool(f File, size int) *bufferPool {
+	return &bufferPool{
+		f:      f,
+		frames: make([]frame, size),
+		table:  make(map[uint64]int, size),
+	}
+}
+
+// fetch returns the pinned frame of the page. if load is false, the page is not read from
+// the data file because it is overwritten by caller.
+func (bp *bufferPool) fetch(pgid uint64, load bool) (*frame, error) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	if i, ok := bp.table[pgid]; ok {
+		fr := &bp.frames[i]
+		fr.pin++
+		fr.ref = true
+		return fr, nil
+	}
+
+	i, err := bp.victim()
+	if err != nil {
+		return nil, err
+	}
+	fr := &bp.frames[i]
+	if load {
+		n, err := bp.f.ReadAt(fr.buf[:], int64(pgid)*pageSize)
+		if n != pageSize {
+			if err == nil {
+				err = ErrBrokenPage
+			}
+			return nil, err
+		}
+	}
+	fr.pgid, fr.valid, fr.pin, fr.dirty, fr.ref = pgid, true, 1, false, true
+	bp.table[pgid] = i
+	return fr, nil
+}
+
+// unpin releases the frame fetched by fetch. dirty should be true if the frame is modified.
+func (bp *bufferPool) unpin(fr *frame, dirty bool) {
+	bp.mu.Lock()
+	fr.pin--
+	if dirty {
+		fr.dirty = true
+	}
+	bp.mu.Unlock()
+}
+
+// victim returns the index of free frame, writing back and evicting the page if needed.
+func (bp *bufferPool) victim() (int, error) {
+	// the second round can evict frames whose reference bits are cleared in the first round
+	for n := 0; n < 2*len(bp.frames); n++ {
+		i := bp.hand
+		bp.hand = (bp.hand + 1) % len(bp.frames)
+		fr := &bp.frames[i]
+		if !fr.valid {
+			return i, nil
+		} else if fr.pin > 0 {
+			continue
+		} else if fr.ref {
+			fr.ref = false
+			continue
+		}
+		if fr.dirty {
+			if _, err := bp.f.WriteAt(fr.buf[:], int64(fr.pgid)*pageSize); err != nil {
+				return 0, err
+			}
+		}
+		delete(bp.table, fr.pgid)
+		fr.valid = false
+		return i, nil
+	}
+	return 0, ErrPoolExhausted
+}
+
+// flush writes back all dirty frames to the data file.
+func (bp *bufferPool) flush() error {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	for i := range bp.frames {
+		fr := &bp.frames[i]
+		if !fr.valid || !fr.dirty {
+			continue
+		}
+		if _, err := bp.f.WriteAt(fr.buf[:], int64(fr.pgid)*pageSize); err != nil {
+			return err
+		}
+		fr.dirty = false
+	}
+	return nil
+}
+
+// drop writes back dirty frames and evicts all frames which are not pinned. it returns the
+// number of evicted pages.
+func (bp *bufferPool) drop() (int, error) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	var n int
+	for i := range bp.frames {
+		fr := &bp.frames[i]
+		if !fr.valid || fr.pin > 0 {
+			continue
+		}
+		if fr.dirty {
+			if _, err := bp.f.WriteAt(fr.buf[:], int64(fr.pgid)*pageSize); err != nil {
+				return n, err
+			}
+		}
+		delete(bp.table, fr.pgid)
+		fr.valid, fr.dirty = false, false
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestBufferPool(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	f, err := os.OpenFile(testDBPath, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	bp := newBufferPool(f, 2)
+	for pgid := uint64(0); pgid < 4; pgid++ {
+		fr, err := bp.fetch(pgid, false)
+		if err != nil {
+			t.Fatalf("failed to fetch page %v : %v", pgid, err)
+		}
+		fr.buf[0] = uint8(pgid + 1)
+		bp.unpin(fr, true)
+	}
+	if len(bp.table) != 2 {
+		t.Errorf("buffer pool holds %v pages, expected 2", len(bp.table))
+	}
+
+	// evicted dirty pages are written back
+	for pgid := uint64(0); pgid < 4; pgid++ {
+		fr, err := bp.fetch(pgid, true)
+		if err != nil {
+			t.Fatalf("failed to fetch page %v : %v", pgid, err)
+		} else if fr.buf[0] != uint8(pgid+1) {
+			t.Errorf("page %v not match %v, expected %v", pgid, fr.buf[0], pgid+1)
+		}
+		bp.unpin(fr, false)
+	}
+
+	// pinned pages are not evicted
+	fr1, err := bp.fetch(0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fr2, err := bp.fetch(1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = bp.fetch(2, true); err != ErrPoolExhausted {
+		t.Errorf("fetch with all pages pinned is not (exhausted) : %v", err)
+	}
+	bp.unpin(fr1, false)
+	bp.unpin(fr2, false)
+	if _, err = bp.fetch(2, true); err != nil {
+		t.Errorf("failed to fetch after unpin : %v", err)
+	}
+
+	if err = bp.flush(); err != nil {
+		t.Fatalf("failed to flush : %v", err)
+	}
+	var buf [pageSize]byte
+	if _, err = f.ReadAt(buf[:], 3*pageSize); err != nil {
+		t.Fatal(err)
+	} else if buf[0] != 4 {
+		t.Errorf("flushed page not match %v, expected 4", buf[0])
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+)
+
+// bulkLoadBatch is the number of records committed by one WAL write of BulkLoader.
+const bulkLoadBatch = 4096
+
+var ErrSkipWAL = errors.New("WAL can not be skipped while replicating")
+
+// BulkLoader loads records for initial data migration. Records are buffered in a transaction
+// and committed in large groups. If WAL is skipped, each group is applied to db directly and
+// persisted by the checkpoint at Close or Abort, so that loaded records are lost if the process
+// crashes before that.
+type BulkLoader struct {
+	s       *Storage
+	skipWAL bool
+	// batch is the number of records committed by one WAL write.
+	batch int
+	txn   *Txn
+	// loaded is the number of committed records.
+	loaded uint64
+}
+
+// NewBulkLoader creates the loader. WAL can not be skipped if Raft or replication is enabled
+// because they ship WAL.
+func (s *Storage) NewBulkLoader(skipWAL bool) (*BulkLoader, error) {
+	if err := s.writable(); err != nil {
+		return nil, err
+	} else if skipWAL && (s.raft != nil || s.repl != nil) {
+		return nil, ErrSkipWAL
+	}
+	return &BulkLoader{s: s, skipWAL: skipWAL, batch: bulkLoadBatch, txn: s.NewTxn()}, nil
+}
+
+// Add inserts or updates the record. The buffered records are committed when they reach
+// the size of the group. If it fails, buffered records are discarded.
+func (b *BulkLoader) Add(key string, value []byte) error {
+	if err := b.txn.Put(key, value); err != nil {
+		b.txn.Abort()
+		b.txn = b.s.NewTxn()
+		return err
+	}
+	if len(b.txn.logs) >= b.batch {
+		return b.Flush()
+	}
+	return nil
+}
+
+// Flush commits the buffered records.
+func (b *BulkLoader) Flush() error {
+	txn, n := b.txn, uint64(len(b.txn.logs))
+	b.txn = b.s.NewTxn()
+	if n == 0 {
+		return nil
+	}
+	var err error
+	if b.skipWAL {
+		err = b.s.applyWithoutWAL(txn)
+	} else if err = txn.Commit(); err != nil {
+		txn.Abort()
+	}
+	if err == nil {
+		b.loaded += n
+	}
+	return err
+}
+
+// Loaded returns the number of committed records.
+func (b *BulkLoader) Loaded() uint64 {
+	return b.loaded
+}
+
+// Close commits the buffered records, and checkpoints if WAL is skipped.
+func (b *BulkLoader) Close() error {
+	if err := b.Flush(); err != nil {
+		return err
+	} else if b.skipWAL {
+		return b.s.Checkpoint()
+	}
+	return nil
+}
+
+// Abort discards the buffered records. Committed records are kept and checkpointed if WAL is
+// skipped.
+func (b *BulkLoader) Abort() error {
+	b.txn.Abort()
+	if b.skipWAL && b.loaded > 0 {
+		return b.s.Checkpoint()
+	}
+	return nil
+}
+
+// applyWithoutWAL applies logs of txn to db with the new commit version and releases locks.
+func (s *Storage) applyWithoutWAL(txn *Txn) error {
+	defer txn.end()
+	defer txn.release()
+	s.muWAL.Lock()
+	defer s.muWAL.Unlock()
+	if err := s.writable(); err != nil {
+		return err
+	}
+	s.assignVersion(txn.logs)
+	if err := s.ApplyLogs(txn.logs); err != nil {
+		return err
+	}
+	s.metrics.commits.Inc()
+	return nil
+}
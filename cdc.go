@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// internalPrefix is the prefix of keys used by the storage itself. changes of them are not fed.
+const internalPrefix = "\x00"
+
+const (
+	// outboxPrefix is the prefix of the outbox of each feed which keeps undelivered changes.
+	// keys are "<outboxPrefix><feed name>/<commit version in hex>" ordered by commit version.
+	outboxPrefix = internalPrefix + "outbox/"
+	// offsetPrefix is the prefix of the last commit version delivered by each feed.
+	offsetPrefix = internalPrefix + "offset/"
+)
+
+const (
+	defaultFeedRetry     = time.Second
+	defaultFeedMaxRetry  = time.Minute
+	defaultFeedBatchSize = 64
+)
+
+// Change is the change of the key committed by a transaction in change data capture (CDC).
+type Change struct {
+	Version uint64    `json:"version"`
+	Time    time.Time `json:"time"`
+	Key     string    `json:"key"`
+	// Value is nil if the key is deleted.
+	Value   []byte `json:"value,omitempty"`
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+// Sink receives changes from Feed in commit order. Changes are delivered at least once, so
+// that Write may receive changes which were written before crash again. FileSink and NATSSink
+// are bundled, and other producers like Kafka are plugged in by implementing Sink.
+type Sink interface {
+	// Write writes changes of one or more transactions. If it fails, the same changes are
+	// retried.
+	Write(changes []Change) error
+	Close() error
+}
+
+// FeedOptions is the options of Feed.
+type FeedOptions struct {
+	// Prefixes selects changes of keys with any of the prefixes. all keys if empty.
+	Prefixes []string
+	// BatchSize is the max number of transactions written to the sink at once.
+	BatchSize int
+	// RetryInterval is the first interval of retry after failure. It is doubled for each
+	// failure up to MaxRetryInterval.
+	RetryInterval    time.Duration
+	MaxRetryInterval time.Duration
+}
+
+// Feed delivers changes of commits to the sink. Changes are written into the outbox in the
+// store by the same WAL write as the transaction, and the outbox is deleted and the offset is
+// checkpointed in one transaction after the sink accepts them, so that delivery resumes after
+// crash. Transactions committed by Raft or two-phase commit are not fed yet.
+type Feed struct {
+	s    *Storage
+	name string
+	sink Sink
+	opts FeedOptions
+	// wake is notified by commits which write the outbox.
+	wake chan struct{}
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// StartFeed starts feeding changes to the sink. The name must be kept across restarts to
+// resume from the outbox.
+func StartFeed(s *Storage, name string, sink Sink, opts FeedOptions) (*Feed, error) {
+	if name == "" || strings.Contains(name, "/") {
+		return nil, fmt.Errorf("invalid name of feed : %q", name)
+	}
+	if opts.BatchSize == 0 {
+		opts.BatchSize = defaultFeedBatchSize
+	}
+	if opts.RetryInterval == 0 {
+		opts.RetryInterval = defaultFeedRetry
+	}
+	if opts.MaxRetryInterval == 0 {
+		opts.MaxRetryInterval = defaultFeedMaxRetry
+	}
+	f := &Feed{s: s, name: name, sink: sink, opts: opts, wake: make(chan struct{}, 1), stop: make(chan struct{})}
+	s.muWAL.Lock()
+	for _, feed := range s.feeds {
+		if feed.name == name {
+			s.muWAL.Unlock()
+			return nil, fmt.Errorf("feed is already started : %q", name)
+		}
+	}
+	s.feeds = append(s.feeds, f)
+	s.muWAL.Unlock()
+	f.wg.Add(1)
+	go f.run()
+	return f, nil
+}
+
+// Stop stops feeding and closes the sink. Undelivered changes are kept in the outbox. Stop is
+// called by Storage.Close too, and does nothing if the feed is already stopped.
+func (f *Feed) Stop() error {
+	f.s.muWAL.Lock()
+	stopped := true
+	for i, feed := range f.s.feeds {
+		if feed == f {
+			f.s.feeds = append(f.s.feeds[:i:i], f.s.feeds[i+1:]...)
+			stopped = false
+			break
+		}
+	}
+	f.s.muWAL.Unlock()
+	if stopped {
+		return nil
+	}
+	close(f.stop)
+	f.wg.Wait()
+	return f.sink.Close()
+}
+
+// Offset returns the last commit version delivered to the sink.
+func (f *Feed) Offset() (uint64, error) {
+	v, err := f.s.Get(offsetPrefix + f.name)
+	if err == ErrNotExist {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(string(v), 10, 64)
+}
+
+// outbox appends the outbox records of feeds interested in logs which are committed by
+// the version, and returns true if any is appended. it is called with muWAL locked.
+func (s *Storage) outbox(logs []RecordLog, version uint64) ([]RecordLog, bool, error) {
+	var (
+		now      = s.now().UTC()
+		appended bool
+	)
+	for _, f := range s.feeds {
+		var changes []Change
+		for _, rlog := range logs {
+			if strings.HasPrefix(rlog.Key, internalPrefix) || !f.matches(rlog.Key) {
+				continue
+			}
+			switch rlog.Action {
+			case LInsert, LUpdate:
+				changes = append(changes, Change{Version: version, Time: now, Key: rlog.Key, Value: rlog.Value})
+			case LDelete:
+				changes = append(changes, Change{Version: version, Time: now, Key: rlog.Key, Deleted: true})
+			}
+		}
+		if len(changes) == 0 {
+			continue
+		}
+		body, err := json.Marshal(changes)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to encode changes of feed %q : %w", f.name, err)
+		}
+		logs = append(logs, RecordLog{Action: LInsert, Record: Record{Key: outboxKey(f.name, version), Value: body}})
+		appended = true
+	}
+	return logs, appended, nil
+}
+
+// notifyFeeds wakes up feeds after the outbox is written. it is called with muWAL locked.
+func (s *Storage) notifyFeeds() {
+	for _, f := range s.feeds {
+		select {
+		case f.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func outboxKey(name string, version uint64) string {
+	return fmt.Sprintf("%s%s/%016x", outboxPrefix, name, version)
+}
+
+func (f *Feed) matches(key string) bool {
+	if len(f.opts.Prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range f.opts.Prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// run delivers the outbox in order of commit versions until stopped.
+func (f *Feed) run() {
+	defer f.wg.Done()
+	retry := f.opts.RetryInterval
+	for {
+		n, err := f.deliver()
+		if err == nil && n == 0 {
+			select {
+			case <-f.wake:
+				continue
+			case <-f.stop:
+				return
+			}
+		} else if err == nil {
+			retry = f.opts.RetryInterval
+			continue
+		}
+		f.s.logger().Error("failed to deliver changes", "feed", f.name, "err", err)
+		select {
+		case <-time.After(retry):
+		case <-f.stop:
+			return
+		}
+		if retry *= 2; retry > f.opts.MaxRetryInterval {
+			retry = f.opts.MaxRetryInterval
+		}
+	}
+}
+
+// deliver writes a batch of the outbox to the sink, and deletes it and checkpoints the offset.
+// it returns the number of delivered transactions.
+func (f *Feed) deliver() (int, error) {
+	keys, _, err := f.s.ScanKeys(scanStart, outboxPrefix+f.name+"/", f.opts.BatchSize, nil)
+	if err != nil || len(keys) == 0 {
+		return 0, err
+	}
+	var changes []Change
+	for _, key := range keys {
+		body, err := f.s.Get(key)
+		if err != nil {
+			return 0, err
+		}
+		var c []Change
+		if err = json.Unmarshal(body, &c); err != nil {
+			return 0, fmt.Errorf("broken outbox %q : %w", key, err)
+		}
+		changes = append(changes, c...)
+	}
+	if err = f.sink.Write(changes); err != nil {
+		return 0, err
+	}
+	offset := strconv.FormatUint(changes[len(changes)-1].Version, 10)
+	return len(keys), f.s.autoCommit(func(txn *Txn) error {
+		for _, key := range keys {
+			if err := txn.Delete(key); err != nil && err != ErrNotExist {
+				return err
+			}
+		}
+		return txn.Put(offsetPrefix+f.name, []byte(offset))
+	})
+}
+
+// FileSink appends changes to the file as JSON lines, and syncs the file for each Write.
+type FileSink struct {
+	f *os.File
+}
+
+func NewFileSink(path string) (*FileSink, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{f: f}, nil
+}
+
+func (s *FileSink) Write(changes []Change) error {
+	w := bufio.NewWriter(s.f)
+	enc := json.NewEncoder(w)
+	for i := range changes {
+		if err := enc.Encode(&changes[i]); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return s.f.Sync()
+}
+
+func (s *FileSink) Close() error {
+	return s.f.Close()
+}
+
+// natsTimeout is the deadline of each Write to the NATS server.
+const natsTimeout = 10 * time.Second
+
+// NATSSink publishes each change to the subject of the NATS server as a JSON message. Write
+// returns after the server answers PONG to the PING following the messages, so that the changes
+// are accepted by the server before the offset is checkpointed. The connection is dialed again on
+// the next Write after any error.
+type NATSSink struct {
+	addr    string
+	subject string
+	conn    net.Conn
+	r       *bufio.Reader
+}
+
+func NewNATSSink(addr, subject string) (*NATSSink, error) {
+	if subject == "" || strings.ContainsAny(subject, " \t\r\n") {
+		return nil, fmt.Errorf("invalid NATS subject %q", subject)
+	}
+	return &NATSSink{addr: addr, subject: subject}, nil
+}
+
+func (s *NATSSink) Write(changes []Change) error {
+	if err := s.write(changes); err != nil {
+		s.Close()
+		return err
+	}
+	return nil
+}
+
+func (s *NATSSink) write(changes []Change) error {
+	if s.conn == nil {
+		if err := s.connect(); err != nil {
+			return err
+		}
+	}
+	if err := s.conn.SetDeadline(time.Now().Add(natsTimeout)); err != nil {
+		return err
+	}
+	w := bufio.NewWriter(s.conn)
+	for i := range changes {
+		msg, err := json.Marshal(&changes[i])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "PUB %s %d\r\n", s.subject, len(msg))
+		w.Write(msg)
+		w.WriteString("\r\n")
+	}
+	w.WriteString("PING\r\n")
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return s.waitPong()
+}
+
+// connect dials the server and sends CONNECT after INFO from the server.
+func (s *NATSSink) connect() error {
+	conn, err := net.DialTimeout("tcp", s.addr, natsTimeout)
+	if err != nil {
+		return err
+	}
+	s.conn, s.r = conn, bufio.NewReader(conn)
+	if err = conn.SetDeadline(time.Now().Add(natsTimeout)); err != nil {
+		return err
+	}
+	line, err := s.r.ReadString('\n')
+	if err != nil {
+		return err
+	} else if !strings.HasPrefix(line, "INFO ") {
+		return fmt.Errorf("unexpected NATS greeting %q", strings.TrimSpace(line))
+	}
+	_, err = io.WriteString(conn, "CONNECT {\"verbose\":false,\"pedantic\":false,\"name\":\"txngo\"}\r\n")
+	return err
+}
+
+// waitPong reads lines from the server until PONG, answering PING of the server.
+func (s *NATSSink) waitPong() error {
+	for {
+		line, err := s.r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err = io.WriteString(s.conn, "PONG\r\n"); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("NATS server responds %v", line)
+		}
+	}
+}
+
+func (s *NATSSink) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn, s.r = nil, nil
+	return err
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testSink fails while failing is true.
+type testSink struct {
+	mu      sync.Mutex
+	failing bool
+	changes []Change
+}
+
+func (s *testSink) Write(changes []Change) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failing {
+		return errors.New("sink is not available")
+	}
+	s.changes = append(s.changes, changes...)
+	return nil
+}
+
+func (s *testSink) Close() error { return nil }
+
+func (s *testSink) received() []Change {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Change{}, s.changes...)
+}
+
+func TestFeed(t *testing.T) {
+	storage := createTestStorage(t)
+	defer storage.wal.Close()
+	opts := FeedOptions{Prefixes: []string{"a/"}, RetryInterval: 10 * time.Millisecond, MaxRetryInterval: 10 * time.Millisecond}
+	sink := &testSink{failing: true}
+	feed, err := StartFeed(storage, "test", sink, opts)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err = StartFeed(storage, "test", sink, opts); err == nil {
+		t.Fatal("feed of the same name is started twice")
+	}
+	if err = storage.Put("a/1", []byte("v1")); err != nil {
+		t.Fatal(err)
+	} else if err = storage.Put("b/1", []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if err = feed.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the feed resumes from the outbox
+	sink.failing = false
+	if feed, err = StartFeed(storage, "test", sink, opts); err != nil {
+		t.Fatal(err)
+	}
+	defer feed.Stop()
+	if err = storage.Delete("a/1"); err != nil {
+		t.Fatal(err)
+	}
+	waitRaft(t, "changes are delivered", func() bool { return len(sink.received()) == 2 })
+	changes := sink.received()
+	if c := changes[0]; c.Version != 1 || c.Key != "a/1" || string(c.Value) != "v1" || c.Deleted {
+		t.Errorf("first change : %+v", c)
+	} else if c = changes[1]; c.Version != 3 || c.Key != "a/1" || !c.Deleted {
+		t.Errorf("second change : %+v", c)
+	}
+	waitRaft(t, "offset is checkpointed", func() bool {
+		offset, err := feed.Offset()
+		return err == nil && offset == 3
+	})
+}
+
+func TestFileSink(t *testing.T) {
+	storage := createTestStorage(t)
+	defer storage.wal.Close()
+	path := filepath.Join(tmpdir, "cdc.jsonl")
+	sink, err := NewFileSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	feed, err := StartFeed(storage, "file", sink, FeedOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"key1", "key2"} {
+		if err = storage.Put(key, []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitRaft(t, "changes are delivered", func() bool {
+		offset, err := feed.Offset()
+		return err == nil && offset == 2
+	})
+	if err = feed.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var keys []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var c Change
+		if err = json.Unmarshal(scanner.Bytes(), &c); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, c.Key)
+	}
+	if len(keys) != 2 || keys[0] != "key1" || keys[1] != "key2" {
+		t.Errorf("changes in file : %v", keys)
+	}
+}
+
+// fakeNATS accepts messages after rejecting the first batch with -ERR.
+func fakeNATS(t *testing.T, subjects chan<- string, msgs chan<- Change) string {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		rejected := false
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				io.WriteString(conn, "INFO {\"server_id\":\"test\"}\r\n")
+				var batch []Change
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					fields := strings.Fields(line)
+					switch {
+					case len(fields) == 3 && fields[0] == "PUB":
+						n, _ := strconv.Atoi(fields[2])
+						payload := make([]byte, n+2)
+						if _, err = io.ReadFull(r, payload); err != nil {
+							return
+						}
+						var c Change
+						if err = json.Unmarshal(payload[:n], &c); err != nil {
+							io.WriteString(conn, "-ERR 'invalid payload'\r\n")
+							return
+						}
+						subjects <- fields[1]
+						batch = append(batch, c)
+					case len(fields) == 1 && fields[0] == "PING":
+						if !rejected {
+							rejected = true
+							io.WriteString(conn, "-ERR 'unavailable'\r\n")
+							return
+						}
+						for _, c := range batch {
+							msgs <- c
+						}
+						batch = nil
+						io.WriteString(conn, "PONG\r\n")
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestNATSSink(t *testing.T) {
+	if _, err := NewNATSSink("localhost:4222", "bad subject"); err == nil {
+		t.Error("subject with space is accepted")
+	}
+	storage := createTestStorage(t)
+	defer storage.wal.Close()
+	subjects, msgs := make(chan string, 10), make(chan Change, 10)
+	sink, err := NewNATSSink(fakeNATS(t, subjects, msgs), "txngo.changes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := FeedOptions{RetryInterval: 10 * time.Millisecond, MaxRetryInterval: 10 * time.Millisecond}
+	feed, err := StartFeed(storage, "nats", sink, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer feed.Stop()
+	for _, key := range []string{"key1", "key2"} {
+		if err = storage.Put(key, []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the rejected batch is published again after reconnecting
+	waitRaft(t, "changes are delivered", func() bool {
+		offset, err := feed.Offset()
+		return err == nil && offset == 2
+	})
+	if s := <-subjects; s != "txngo.changes" {
+		t.Errorf("subject : %v", s)
+	}
+	var keys []string
+	for len(msgs) > 0 {
+		c := <-msgs
+		if string(c.Value) != "value" {
+			t.Errorf("change : %+v", c)
+		}
+		keys = append(keys, c.Key)
+	}
+	if len(keys) < 2 || keys[len(keys)-2] != "key1" || keys[len(keys)-1] != "key2" {
+		t.Errorf("published changes : %v", keys)
+	}
+}
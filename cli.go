@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+)
+
+// exit status of subcommands
+const (
+	exitOK = iota
+	// exitNotFound is returned when the key is not found or scan matches no keys.
+	exitNotFound
+	exitUsage
+	exitFailure
+)
+
+type subcommand struct {
+	usage string
+	nargs int
+	write bool
+	run   func(txn *Txn, args []string, w io.Writer) error
+}
+
+var subcommands = map[string]subcommand{
+	"get": {usage: "get KEY", nargs: 1, run: func(txn *Txn, args []string, w io.Writer) error {
+		v, err := txn.Read(args[0])
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", v)
+		return err
+	}},
+	"put": {usage: "put KEY VALUE", nargs: 2, write: true, run: func(txn *Txn, args []string, w io.Writer) error {
+		return txn.Put(args[0], []byte(args[1]))
+	}},
+	"del": {usage: "del KEY", nargs: 1, write: true, run: func(txn *Txn, args []string, w io.Writer) error {
+		return txn.Delete(args[0])
+	}},
+	"scan": {usage: "scan PREFIX", nargs: 1, run: func(txn *Txn, args []string, w io.Writer) error {
+		found := false
+		err := txn.Scan(args[0], func(key string, value []byte) error {
+			found = true
+			_, err := fmt.Fprintf(w, "%s\t%s\n", key, value)
+			return err
+		})
+		if err == nil && !found {
+			return ErrNotExist
+		}
+		return err
+	}},
+}
+
+// runCommand opens the storage, runs the subcommand in one transaction and returns the exit status.
+// Written records are saved into data file and WAL is cleared before exit.
+func runCommand(opts Options, args []string, stdout, stderr io.Writer) int {
+	cmd, ok := subcommands[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "unknown command : %v\n", args[0])
+		return exitUsage
+	} else if len(args)-1 != cmd.nargs {
+		fmt.Fprintf(stderr, "usage : txngo [flags] %v\n", cmd.usage)
+		return exitUsage
+	}
+
+	// progress of recovery is not printed for scripting
+	log.SetOutput(ioutil.Discard)
+	storage, err := Open(opts)
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to open : %v\n", err)
+		return exitFailure
+	}
+	defer storage.wal.Close()
+	defer storage.db.Close()
+
+	err = storage.autoCommit(func(txn *Txn) error {
+		return cmd.run(txn, args[1:], stdout)
+	})
+	if err == ErrNotExist {
+		return exitNotFound
+	} else if err != nil {
+		fmt.Fprintf(stderr, "failed to %v : %v\n", args[0], err)
+		return exitFailure
+	}
+
+	if cmd.write {
+		if err = storage.SaveCheckPoint(); err != nil {
+			fmt.Fprintf(stderr, "failed to save data file : %v\n", err)
+			return exitFailure
+		} else if err = storage.ClearWAL(); err != nil {
+			fmt.Fprintf(stderr, "failed to clear WAL file : %v\n", err)
+			return exitFailure
+		}
+	}
+	return exitOK
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestRunCommand(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	opts := Options{WALPath: testWALPath, DBPath: testDBPath}
+
+	for _, c := range []struct {
+		args   []string
+		status int
+		output string
+	}{
+		{[]string{"put", "k1", "v1"}, exitOK, ""},
+		{[]string{"put", "k2", "v2"}, exitOK, ""},
+		{[]string{"get", "k1"}, exitOK, "v1\n"},
+		{[]string{"get", "none"}, exitNotFound, ""},
+		{[]string{"scan", "k"}, exitOK, "k1\tv1\nk2\tv2\n"},
+		{[]string{"scan", "none"}, exitNotFound, ""},
+		{[]string{"del", "k1"}, exitOK, ""},
+		{[]string{"del", "k1"}, exitNotFound, ""},
+		{[]string{"get", "k1"}, exitNotFound, ""},
+		{[]string{"get"}, exitUsage, ""},
+		{[]string{"foo"}, exitUsage, ""},
+	} {
+		var stdout, stderr bytes.Buffer
+		if status := runCommand(opts, c.args, &stdout, &stderr); status != c.status {
+			t.Errorf("status of %v : %v != %v (%s)", c.args, status, c.status, stderr.String())
+		} else if stdout.String() != c.output {
+			t.Errorf("output of %v : %q != %q", c.args, stdout.String(), c.output)
+		}
+	}
+
+	// written records are saved into data file
+	if info, err := os.Stat(testWALPath); err != nil {
+		t.Fatal(err)
+	} else if info.Size() != 0 {
+		t.Errorf("WAL is not cleared : %v bytes", info.Size())
+	}
+}
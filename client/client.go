@@ -0,0 +1,511 @@
+// Package client is the client of txngo tcp server which speaks the line based protocol of
+// the interactive interface. Each connection runs one transaction at a time, and connections
+// are pooled and reused after commit or abort.
+//
+// Keys and values must not contain spaces or line breaks, and values must not be empty,
+// because the protocol separates arguments by spaces.
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errors returned by server. messages are the same as the server.
+var (
+	ErrExist       = errors.New("record already exists")
+	ErrNotExist    = errors.New("record not exists")
+	ErrDeadLock    = errors.New("deadlock detected")
+	ErrVersion     = errors.New("version does not match")
+	ErrPermission  = errors.New("permission denied")
+	ErrNoAuth      = errors.New("authentication required")
+	ErrAuth        = errors.New("invalid username, password or token")
+	ErrPrepared    = errors.New("global transaction id is already prepared")
+	ErrNotPrepared = errors.New("global transaction id is not prepared")
+)
+
+var (
+	ErrInvalidArgument = errors.New("key or value contains spaces or line breaks, or is empty")
+	ErrProtocol        = errors.New("unexpected reply from server")
+	ErrTxnDone         = errors.New("transaction is already committed or aborted")
+	ErrClosed          = errors.New("client is closed")
+	// ErrCommitUnknown is returned when the connection is broken during commit.
+	// The transaction may or may not be committed.
+	ErrCommitUnknown = errors.New("connection is broken during commit")
+)
+
+var serverErrors = []error{ErrExist, ErrNotExist, ErrDeadLock, ErrVersion, ErrPermission, ErrNoAuth, ErrAuth, ErrPrepared, ErrNotPrepared}
+
+const prompt = ">> "
+
+// Options is the options of Client.
+type Options struct {
+	// Network is "tcp" or "unix". "tcp" if empty.
+	Network string
+	Addr    string
+	// TLSConfig enables TLS if not nil.
+	TLSConfig *tls.Config
+	// User and Password, or Token authenticate connections if ACL is enabled in the server.
+	User     string
+	Password string
+	Token    string
+	// MaxIdle is the number of idle connections kept in the pool. 2 if 0.
+	MaxIdle int
+	// MaxConns limits the number of open connections. 0 is unlimited.
+	MaxConns int
+	// MaxRetries is the number of retries of Do on deadlock or broken connection. 3 if 0.
+	MaxRetries int
+	// DialTimeout is the timeout to connect. 5 seconds if 0.
+	DialTimeout time.Duration
+}
+
+// Client is the pool of connections to the server. It is safe for concurrent use.
+type Client struct {
+	opts Options
+	idle chan *conn
+	// sem limits open connections if MaxConns is set.
+	sem    chan struct{}
+	mu     sync.Mutex
+	closed bool
+}
+
+func New(opts Options) *Client {
+	if opts.Network == "" {
+		opts.Network = "tcp"
+	}
+	if opts.MaxIdle == 0 {
+		opts.MaxIdle = 2
+	}
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = 3
+	}
+	if opts.DialTimeout == 0 {
+		opts.DialTimeout = 5 * time.Second
+	}
+	c := &Client{opts: opts, idle: make(chan *conn, opts.MaxIdle)}
+	if opts.MaxConns > 0 {
+		c.sem = make(chan struct{}, opts.MaxConns)
+	}
+	return c
+}
+
+// Close closes idle connections. Connections in use are closed when they are released.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	for {
+		select {
+		case cn := <-c.idle:
+			cn.close()
+			c.release()
+		default:
+			return nil
+		}
+	}
+}
+
+func (c *Client) release() {
+	if c.sem != nil {
+		<-c.sem
+	}
+}
+
+// get returns the idle connection or connects new one.
+func (c *Client) get(ctx context.Context) (*conn, error) {
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+	if closed {
+		return nil, ErrClosed
+	}
+	select {
+	case cn := <-c.idle:
+		return cn, nil
+	default:
+	}
+	if c.sem != nil {
+		select {
+		case c.sem <- struct{}{}:
+		case cn := <-c.idle:
+			return cn, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	cn, err := c.dial(ctx)
+	if err != nil {
+		c.release()
+		return nil, err
+	}
+	return cn, nil
+}
+
+// put returns the connection into the pool. broken connections are closed.
+func (c *Client) put(cn *conn) {
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+	if !cn.broken && !closed {
+		select {
+		case c.idle <- cn:
+			return
+		default:
+		}
+	}
+	cn.close()
+	c.release()
+}
+
+func (c *Client) dial(ctx context.Context) (*conn, error) {
+	dialer := &net.Dialer{Timeout: c.opts.DialTimeout}
+	var (
+		nc  net.Conn
+		err error
+	)
+	if c.opts.TLSConfig != nil {
+		nc, err = (&tls.Dialer{NetDialer: dialer, Config: c.opts.TLSConfig}).DialContext(ctx, c.opts.Network, c.opts.Addr)
+	} else {
+		nc, err = dialer.DialContext(ctx, c.opts.Network, c.opts.Addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	cn := &conn{nc: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+	if err = cn.readPrompt(ctx); err != nil {
+		cn.close()
+		return nil, err
+	}
+	if c.opts.Token != "" || c.opts.User != "" {
+		cmd := "auth " + c.opts.Token
+		if c.opts.Token == "" {
+			cmd = "auth " + c.opts.User + " " + c.opts.Password
+		}
+		if _, err = cn.expect(ctx, cmd, "authenticated as "); err != nil {
+			cn.close()
+			return nil, err
+		}
+	}
+	return cn, nil
+}
+
+// Begin starts the transaction on a connection from the pool.
+// The connection is returned to the pool by Commit or Abort.
+func (c *Client) Begin(ctx context.Context) (*Txn, error) {
+	cn, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &Txn{c: c, cn: cn, ctx: ctx}, nil
+}
+
+// Do runs fn in a transaction and commits it. The transaction is retried with backoff
+// if deadlock is detected or the connection is broken before commit.
+func (c *Client) Do(ctx context.Context, fn func(txn *Txn) error) error {
+	var err error
+	backoff := 10 * time.Millisecond
+	for i := 0; i <= c.opts.MaxRetries; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(backoff):
+				backoff *= 2
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		var txn *Txn
+		if txn, err = c.Begin(ctx); err != nil {
+			if isNetError(err) {
+				continue
+			}
+			return err
+		}
+		if err = fn(txn); err == nil {
+			err = txn.Commit()
+		}
+		if err == nil {
+			return nil
+		}
+		txn.Abort()
+		if err == ErrCommitUnknown || !(err == ErrDeadLock || isNetError(err)) {
+			return err
+		}
+	}
+	return err
+}
+
+// Get reads the committed value of the record.
+func (c *Client) Get(ctx context.Context, key string) ([]byte, error) {
+	var value []byte
+	err := c.Do(ctx, func(txn *Txn) (err error) {
+		value, err = txn.Read(key)
+		return err
+	})
+	return value, err
+}
+
+// Put inserts or updates the record and commits immediately.
+func (c *Client) Put(ctx context.Context, key string, value []byte) error {
+	return c.Do(ctx, func(txn *Txn) error {
+		return txn.Put(key, value)
+	})
+}
+
+// Delete deletes the record and commits immediately.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	return c.Do(ctx, func(txn *Txn) error {
+		return txn.Delete(key)
+	})
+}
+
+func isNetError(err error) bool {
+	var nerr net.Error
+	var operr *net.OpError
+	return errors.As(err, &nerr) || errors.As(err, &operr) || err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+// conn is the connection running one transaction at a time.
+type conn struct {
+	nc     net.Conn
+	r      *bufio.Reader
+	w      *bufio.Writer
+	broken bool
+}
+
+func (cn *conn) close() {
+	cn.w.WriteString("quit\n")
+	cn.w.Flush()
+	cn.nc.Close()
+}
+
+func (cn *conn) readPrompt(ctx context.Context) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		cn.nc.SetDeadline(deadline)
+	} else {
+		cn.nc.SetDeadline(time.Time{})
+	}
+	var buf [len(prompt)]byte
+	if _, err := io.ReadFull(cn.r, buf[:]); err != nil {
+		cn.broken = true
+		return err
+	} else if string(buf[:]) != prompt {
+		cn.broken = true
+		return ErrProtocol
+	}
+	return nil
+}
+
+// do sends the command and returns the reply line.
+func (cn *conn) do(ctx context.Context, cmd string) (string, error) {
+	if cn.broken {
+		return "", ErrProtocol
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		cn.nc.SetDeadline(deadline)
+	} else {
+		cn.nc.SetDeadline(time.Time{})
+	}
+	cn.w.WriteString(cmd + "\n")
+	if err := cn.w.Flush(); err != nil {
+		cn.broken = true
+		return "", err
+	}
+	line, err := cn.r.ReadString('\n')
+	if err != nil {
+		cn.broken = true
+		return "", err
+	}
+	if err = cn.readPrompt(ctx); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(line, "\n"), nil
+}
+
+// expect sends the command and returns the reply after the prefix of success.
+func (cn *conn) expect(ctx context.Context, cmd, prefix string) (string, error) {
+	line, err := cn.do(ctx, cmd)
+	if err != nil {
+		return "", err
+	}
+	return parseReply(line, prefix)
+}
+
+// parseReply returns the reply after the prefix of success, or the error of failure.
+func parseReply(line, prefix string) (string, error) {
+	if strings.HasPrefix(line, prefix) {
+		return line[len(prefix):], nil
+	} else if err := replyError(line); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("%w : %q", ErrProtocol, line)
+}
+
+// replyError converts the reply of failure into error. nil if the reply is not failure.
+func replyError(line string) error {
+	if strings.HasPrefix(line, ErrNoAuth.Error()+" : ") {
+		return ErrNoAuth
+	} else if !strings.HasPrefix(line, "failed to ") {
+		return nil
+	}
+	i := strings.Index(line, " : ")
+	if i < 0 {
+		return fmt.Errorf("%w : %q", ErrProtocol, line)
+	}
+	msg := line[i+3:]
+	for _, e := range serverErrors {
+		if msg == e.Error() {
+			return e
+		}
+	}
+	return errors.New(msg)
+}
+
+func validArg(s string) bool {
+	return s != "" && !strings.ContainsAny(s, " \t\r\n")
+}
+
+// Txn is the transaction running on the server.
+type Txn struct {
+	c   *Client
+	cn  *conn
+	ctx context.Context
+}
+
+func (txn *Txn) do(cmd, prefix string, args ...string) (string, error) {
+	if txn.cn == nil {
+		return "", ErrTxnDone
+	}
+	for _, arg := range args {
+		if !validArg(arg) {
+			return "", ErrInvalidArgument
+		}
+		cmd += " " + arg
+	}
+	return txn.cn.expect(txn.ctx, cmd, prefix)
+}
+
+func (txn *Txn) Read(key string) ([]byte, error) {
+	if txn.cn == nil {
+		return nil, ErrTxnDone
+	} else if !validArg(key) {
+		return nil, ErrInvalidArgument
+	}
+	line, err := txn.cn.do(txn.ctx, "read "+key)
+	if err != nil {
+		return nil, err
+	} else if err = replyError(line); err != nil {
+		return nil, err
+	}
+	return []byte(line), nil
+}
+
+// ReadVersioned reads the record with its commit version.
+func (txn *Txn) ReadVersioned(key string) ([]byte, uint64, error) {
+	if txn.cn == nil {
+		return nil, 0, ErrTxnDone
+	} else if !validArg(key) {
+		return nil, 0, ErrInvalidArgument
+	}
+	line, err := txn.cn.do(txn.ctx, "readv "+key)
+	if err != nil {
+		return nil, 0, err
+	} else if err = replyError(line); err != nil {
+		return nil, 0, err
+	}
+	i := strings.LastIndexByte(line, ' ')
+	if i < 0 {
+		return nil, 0, ErrProtocol
+	}
+	version, err := strconv.ParseUint(line[i+1:], 10, 64)
+	if err != nil {
+		return nil, 0, ErrProtocol
+	}
+	return []byte(line[:i]), version, nil
+}
+
+func (txn *Txn) Insert(key string, value []byte) error {
+	_, err := txn.do("insert", "success to insert ", key, string(value))
+	return err
+}
+
+func (txn *Txn) Update(key string, value []byte) error {
+	_, err := txn.do("update", "success to update ", key, string(value))
+	return err
+}
+
+// Put inserts or updates the record.
+func (txn *Txn) Put(key string, value []byte) error {
+	if _, err := txn.Read(key); err == ErrNotExist {
+		return txn.Insert(key, value)
+	} else if err != nil {
+		return err
+	}
+	return txn.Update(key, value)
+}
+
+func (txn *Txn) Delete(key string) error {
+	_, err := txn.do("delete", "success to delete ", key)
+	return err
+}
+
+// UpdateIfVersion updates the record only if its committed version is the expected one.
+func (txn *Txn) UpdateIfVersion(key string, value []byte, version uint64) error {
+	_, err := txn.do("updatev", "success to update ", key, string(value), strconv.FormatUint(version, 10))
+	return err
+}
+
+// SetIdempotencyKey sets the key identifying the transaction among retries. When Commit fails
+// with ErrCommitUnknown, the transaction retried with the same key is committed only if the
+// first one is not.
+func (txn *Txn) SetIdempotencyKey(key string) error {
+	_, err := txn.do("idempotency-key", "success to set idempotency key ", key)
+	return err
+}
+
+// Commit commits the transaction and returns the connection into the pool.
+func (txn *Txn) Commit() error {
+	return txn.commit()
+}
+
+// CommitLazy commits the transaction as Commit, but the server replies before WAL is synced, so
+// that the commit may be lost by the crash of the server.
+func (txn *Txn) CommitLazy() error {
+	return txn.commit("lazy")
+}
+
+func (txn *Txn) commit(args ...string) error {
+	if txn.cn == nil {
+		return ErrTxnDone
+	}
+	_, err := txn.do("commit", "committed", args...)
+	if err != nil && txn.cn.broken {
+		return ErrCommitUnknown
+	} else if err != nil {
+		return err
+	}
+	txn.c.put(txn.cn)
+	txn.cn = nil
+	return nil
+}
+
+// Abort aborts the transaction and returns the connection into the pool.
+// It can be called after Commit, and does nothing.
+func (txn *Txn) Abort() {
+	if txn.cn == nil {
+		return
+	}
+	if _, err := txn.do("abort", "aborted"); err != nil {
+		txn.cn.broken = true
+	}
+	txn.c.put(txn.cn)
+	txn.cn = nil
+}
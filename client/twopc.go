@@ -0,0 +1,240 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	// ErrAborted is returned when the global transaction is aborted because some participant
+	// failed to prepare.
+	ErrAborted = errors.New("global transaction is aborted")
+	// ErrIncomplete is returned when the global transaction is committed but some participants
+	// are not notified yet. They are notified by Recover.
+	ErrIncomplete = errors.New("global transaction is committed but not completed")
+)
+
+// Participant is the participant of two-phase commit. Txn is the participant of its server.
+// AbortPrepared must abort the transaction even if it is not prepared.
+type Participant interface {
+	Prepare(gid string) error
+	CommitPrepared(gid string) error
+	AbortPrepared(gid string) error
+}
+
+// Prepare prepares the transaction with the global transaction id, and returns the connection
+// into the pool. The prepared transaction is decided by CommitPrepared or AbortPrepared.
+func (txn *Txn) Prepare(gid string) error {
+	if txn.cn == nil {
+		return ErrTxnDone
+	}
+	if _, err := txn.do("prepare", "prepared ", gid); err != nil {
+		if txn.cn.broken {
+			// the server may have prepared the transaction. AbortPrepared asks it by gid.
+			txn.c.put(txn.cn)
+			txn.cn = nil
+		}
+		return err
+	}
+	txn.c.put(txn.cn)
+	txn.cn = nil
+	return nil
+}
+
+func (txn *Txn) CommitPrepared(gid string) error {
+	return txn.c.CommitPrepared(txn.ctx, gid)
+}
+
+// AbortPrepared aborts the prepared transaction, or the transaction itself if not prepared.
+func (txn *Txn) AbortPrepared(gid string) error {
+	if txn.cn != nil {
+		txn.Abort()
+		return nil
+	}
+	return txn.c.AbortPrepared(txn.ctx, gid)
+}
+
+// exec runs the command on a connection from the pool.
+func (c *Client) exec(ctx context.Context, cmd, prefix string, args ...string) (string, error) {
+	txn, err := c.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer txn.Abort()
+	return txn.do(cmd, prefix, args...)
+}
+
+// CommitPrepared commits the prepared transaction on the server.
+func (c *Client) CommitPrepared(ctx context.Context, gid string) error {
+	_, err := c.exec(ctx, "commit-prepared", "committed prepared ", gid)
+	return err
+}
+
+// AbortPrepared aborts the prepared transaction on the server.
+func (c *Client) AbortPrepared(ctx context.Context, gid string) error {
+	_, err := c.exec(ctx, "abort-prepared", "aborted prepared ", gid)
+	return err
+}
+
+// InDoubt returns the global transaction ids of prepared transactions on the server.
+func (c *Client) InDoubt(ctx context.Context) ([]string, error) {
+	line, err := c.exec(ctx, "in-doubt", "in doubt :")
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(line), nil
+}
+
+// NewGID generates the random global transaction id.
+func NewGID() (string, error) {
+	var buf [16]byte
+	if _, err := io.ReadFull(rand.Reader, buf[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf[:]), nil
+}
+
+// Coordinator drives two-phase commit across servers. Decisions to commit are persisted in
+// the log file before participants are notified, so that in-doubt transactions on servers are
+// resolved by Recover after crash. Transactions not in the log are presumed to be aborted.
+type Coordinator struct {
+	mu sync.Mutex
+	f  *os.File
+	// committed is the global transaction ids decided to commit but not completed.
+	committed map[string]bool
+}
+
+// OpenCoordinator opens the decision log at path.
+// TODO: compact the log which grows by completed transactions
+func OpenCoordinator(path string) (*Coordinator, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	c := &Coordinator{f: f, committed: make(map[string]bool)}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			// the last line may be broken by crash
+			continue
+		}
+		switch fields[0] {
+		case "commit":
+			c.committed[fields[1]] = true
+		case "done":
+			delete(c.committed, fields[1])
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Coordinator) Close() error {
+	return c.f.Close()
+}
+
+func (c *Coordinator) record(op, gid string, sync bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := fmt.Fprintf(c.f, "%s %s\n", op, gid); err != nil {
+		return err
+	} else if sync {
+		if err = c.f.Sync(); err != nil {
+			return err
+		}
+	}
+	if op == "commit" {
+		c.committed[gid] = true
+	} else {
+		delete(c.committed, gid)
+	}
+	return nil
+}
+
+// Commit commits the global transaction of participants atomically. If some participant
+// fails to prepare, all participants are aborted and ErrAborted is returned.
+func (c *Coordinator) Commit(gid string, participants ...Participant) error {
+	if !validArg(gid) {
+		return ErrInvalidArgument
+	}
+	for _, p := range participants {
+		if err := p.Prepare(gid); err != nil {
+			// the failed participant may be prepared, and the rest are not prepared yet
+			for _, p := range participants {
+				p.AbortPrepared(gid)
+			}
+			return fmt.Errorf("%w : %v", ErrAborted, err)
+		}
+	}
+
+	if err := c.record("commit", gid, true); err != nil {
+		// the decision is not durable. abort participants as presumed after crash.
+		for _, p := range participants {
+			p.AbortPrepared(gid)
+		}
+		return fmt.Errorf("%w : %v", ErrAborted, err)
+	}
+	var failed error
+	for _, p := range participants {
+		if err := p.CommitPrepared(gid); err != nil && failed == nil {
+			failed = err
+		}
+	}
+	if failed != nil {
+		return fmt.Errorf("%w : %v", ErrIncomplete, failed)
+	}
+	return c.record("done", gid, false)
+}
+
+// Recover resolves in-doubt transactions on the servers of clients by the decisions. clients
+// must be all participants, and Recover must not run with Commit concurrently, because
+// transactions in preparation are aborted.
+func (c *Coordinator) Recover(ctx context.Context, clients ...*Client) error {
+	c.mu.Lock()
+	committed := make(map[string]bool, len(c.committed))
+	for gid := range c.committed {
+		committed[gid] = true
+	}
+	c.mu.Unlock()
+
+	incomplete := make(map[string]bool)
+	for _, cl := range clients {
+		gids, err := cl.InDoubt(ctx)
+		if err != nil {
+			return err
+		}
+		for _, gid := range gids {
+			if committed[gid] {
+				err = cl.CommitPrepared(ctx, gid)
+			} else {
+				err = cl.AbortPrepared(ctx, gid)
+			}
+			if err != nil && err != ErrNotPrepared {
+				incomplete[gid] = true
+			}
+		}
+	}
+	for gid := range committed {
+		if !incomplete[gid] {
+			if err := c.record("done", gid, false); err != nil {
+				return err
+			}
+		}
+	}
+	if len(incomplete) > 0 {
+		return fmt.Errorf("%w : %d transactions are not resolved", ErrIncomplete, len(incomplete))
+	}
+	return nil
+}
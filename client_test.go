@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/kawasin73/txngo/client"
+)
+
+// startTestServer serves the tcp handler and returns the address and the function to close
+// all accepted connections.
+func startTestServer(t *testing.T, storage *Storage) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	var (
+		mu    sync.Mutex
+		conns []net.Conn
+		wg    sync.WaitGroup
+	)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+			wg.Add(1)
+			go HandleTxn(conn, conn, storage.NewTxn(), storage, true, &wg)
+		}
+	}()
+	return l.Addr().String(), func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+		conns = nil
+	}
+}
+
+func TestClient(t *testing.T) {
+	storage := createTestStorage(t)
+	defer storage.wal.Close()
+	addr, closeConns := startTestServer(t, storage)
+	ctx := context.Background()
+	c := client.New(client.Options{Addr: addr})
+	defer c.Close()
+
+	if err := c.Put(ctx, "k1", []byte("v1")); err != nil {
+		t.Fatalf("failed to put : %v", err)
+	} else if err = c.Put(ctx, "k1", []byte("v2")); err != nil {
+		t.Fatalf("failed to put existing key : %v", err)
+	}
+	if v, err := c.Get(ctx, "k1"); err != nil || string(v) != "v2" {
+		t.Fatalf("get : %q %v", v, err)
+	} else if _, err = c.Get(ctx, "none"); err != client.ErrNotExist {
+		t.Errorf("get not exist : %v", err)
+	} else if err = c.Put(ctx, "k 1", []byte("v")); err != client.ErrInvalidArgument {
+		t.Errorf("put invalid key : %v", err)
+	}
+
+	// transaction
+	txn, err := c.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = txn.Insert("k2", []byte("v2")); err != nil {
+		t.Fatalf("failed to insert : %v", err)
+	} else if err = txn.Insert("k1", []byte("v")); err != client.ErrExist {
+		t.Errorf("insert existing key : %v", err)
+	} else if err = txn.Delete("k1"); err != nil {
+		t.Fatalf("failed to delete : %v", err)
+	} else if err = txn.Commit(); err != nil {
+		t.Fatalf("failed to commit : %v", err)
+	} else if err = txn.Commit(); err != client.ErrTxnDone {
+		t.Errorf("commit twice : %v", err)
+	}
+	check := storage.NewTxn()
+	assertValue(t, check, "k2", []byte("v2"))
+	check.Abort()
+
+	txn, _ = c.Begin(ctx)
+	if err = txn.Insert("k3", []byte("v3")); err != nil {
+		t.Fatal(err)
+	}
+	txn.Abort()
+	if _, err = c.Get(ctx, "k3"); err != client.ErrNotExist {
+		t.Errorf("aborted value is visible : %v", err)
+	}
+
+	// lazy commit is replied before WAL is synced
+	txn, _ = c.Begin(ctx)
+	if err = txn.Insert("k4", []byte("v4")); err != nil {
+		t.Fatal(err)
+	} else if err = txn.CommitLazy(); err != nil {
+		t.Fatalf("failed to commit lazy : %v", err)
+	} else if v, err := c.Get(ctx, "k4"); err != nil || string(v) != "v4" {
+		t.Errorf("get lazy committed : %q %v", v, err)
+	}
+
+	// the transaction retried with the same idempotency key is committed once
+	for _, value := range []string{"v5", "v6"} {
+		txn, _ = c.Begin(ctx)
+		if err = txn.SetIdempotencyKey("req1"); err != nil {
+			t.Fatalf("failed to set idempotency key : %v", err)
+		} else if err = txn.Update("k4", []byte(value)); err != nil {
+			t.Fatal(err)
+		} else if err = txn.Commit(); err != nil {
+			t.Fatalf("failed to commit with idempotency key : %v", err)
+		}
+	}
+	if v, err := c.Get(ctx, "k4"); err != nil || string(v) != "v5" {
+		t.Errorf("get after retried commit : %q %v", v, err)
+	}
+
+	// optimistic update
+	err = c.Do(ctx, func(txn *client.Txn) error {
+		_, version, err := txn.ReadVersioned("k2")
+		if err != nil {
+			return err
+		}
+		return txn.UpdateIfVersion("k2", []byte("v22"), version)
+	})
+	if err != nil {
+		t.Fatalf("failed to update if version : %v", err)
+	}
+
+	// pooled connections are reconnected after the server closed them
+	closeConns()
+	if v, err := c.Get(ctx, "k2"); err != nil || string(v) != "v22" {
+		t.Fatalf("get after reconnect : %q %v", v, err)
+	}
+}
+
+func TestClient_ACL(t *testing.T) {
+	storage := createTestStorage(t)
+	defer storage.wal.Close()
+	acl, err := LoadACL(filepath.Join(tmpdir, "test.acl"))
+	if err != nil {
+		t.Fatal(err)
+	} else if err = acl.AddUser("alice", "pass", false); err != nil {
+		t.Fatal(err)
+	} else if err = acl.Grant("alice", "alice/", PermRead|PermWrite); err != nil {
+		t.Fatal(err)
+	}
+	storage.EnableACL(acl)
+	addr, _ := startTestServer(t, storage)
+	ctx := context.Background()
+
+	c := client.New(client.Options{Addr: addr, User: "alice", Password: "wrong"})
+	if err = c.Put(ctx, "alice/1", []byte("v")); err != client.ErrAuth {
+		t.Errorf("put with wrong password : %v", err)
+	}
+	c.Close()
+
+	c = client.New(client.Options{Addr: addr, User: "alice", Password: "pass"})
+	defer c.Close()
+	if err = c.Put(ctx, "alice/1", []byte("v")); err != nil {
+		t.Errorf("failed to put : %v", err)
+	} else if err = c.Put(ctx, "bob/1", []byte("v")); err != client.ErrPermission {
+		t.Errorf("put without permission : %v", err)
+	}
+}
+
+func TestCoordinator(t *testing.T) {
+	storage1 := createTestStorage(t)
+	defer storage1.wal.Close()
+	wal2, err := os.OpenFile(filepath.Join(tmpdir, "test2.wal"), os.O_CREATE|os.O_APPEND|os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage2 := NewStorage(wal2, filepath.Join(tmpdir, "test2.db"), filepath.Join(tmpdir, "test2.db.tmp"))
+	defer wal2.Close()
+	addr1, _ := startTestServer(t, storage1)
+	addr2, _ := startTestServer(t, storage2)
+	ctx := context.Background()
+	c1 := client.New(client.Options{Addr: addr1})
+	defer c1.Close()
+	c2 := client.New(client.Options{Addr: addr2})
+	defer c2.Close()
+	coord, err := client.OpenCoordinator(filepath.Join(tmpdir, "coordinator.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coord.Close()
+
+	transfer := func(gid string, from, to []byte) error {
+		txn1, err := c1.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		txn2, err := c2.Begin(ctx)
+		if err != nil {
+			txn1.Abort()
+			return err
+		}
+		if err = txn1.Put("account", from); err != nil {
+			return err
+		} else if err = txn2.Put("account", to); err != nil {
+			return err
+		}
+		return coord.Commit(gid, txn1, txn2)
+	}
+	if err = transfer("g1", []byte("90"), []byte("10")); err != nil {
+		t.Fatalf("failed to commit : %v", err)
+	}
+	if v, err := c1.Get(ctx, "account"); err != nil || string(v) != "90" {
+		t.Errorf("account of participant 1 : %q %v", v, err)
+	} else if v, err = c2.Get(ctx, "account"); err != nil || string(v) != "10" {
+		t.Errorf("account of participant 2 : %q %v", v, err)
+	}
+
+	// the gid is already prepared in participant 2, and all participants are aborted
+	txn := storage2.NewTxn()
+	if err = txn.Prepare("g2"); err != nil {
+		t.Fatal(err)
+	}
+	if err = transfer("g2", []byte("80"), []byte("20")); !errors.Is(err, client.ErrAborted) {
+		t.Fatalf("commit with failed participant : %v", err)
+	}
+	if v, err := c1.Get(ctx, "account"); err != nil || string(v) != "90" {
+		t.Errorf("account of aborted participant : %q %v", v, err)
+	}
+
+	// in-doubt transactions without the decision are aborted by recovery
+	if gids, err := c2.InDoubt(ctx); err != nil || !reflect.DeepEqual(gids, []string{"g2"}) {
+		t.Fatalf("in doubt : %v %v", gids, err)
+	} else if err = coord.Recover(ctx, c1, c2); err != nil {
+		t.Fatalf("failed to recover : %v", err)
+	} else if gids := storage2.Prepared(); len(gids) != 0 {
+		t.Errorf("in-doubt transactions are left : %v", gids)
+	}
+}
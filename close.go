@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	ErrClosed = errors.New("storage is closed")
+	ErrLocked = errors.New("WAL file is locked by another process")
+)
+
+// defaultCloseTimeout is the time Close waits for in-flight transactions.
+const defaultCloseTimeout = 30 * time.Second
+
+// Close shuts down the storage gracefully with the final checkpoint, waiting for in-flight
+// transactions up to 30 seconds. See Shutdown.
+func (s *Storage) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultCloseTimeout)
+	defer cancel()
+	return s.Shutdown(ctx, true)
+}
+
+// Shutdown rejects new transactions with ErrClosed, and waits for in-flight transactions until
+// ctx is done. Feeds, background expiration, background checkpoint, Raft, the replica and the
+// syncer of CommitAsync are stopped. Then WAL is synced, the final checkpoint is taken if
+// checkpoint is true and the storage is not read only, and the backend and WAL are closed,
+// which releases the lock of WAL taken by Open.
+//
+// Transactions still running when ctx is done are aborted. Their commits fail with ErrClosed
+// and are never written into WAL. Shutdown returns ctx.Err() in this case if nothing else
+// fails. Prepared transactions are not waited for, and survive in WAL until decided after
+// restart.
+func (s *Storage) Shutdown(ctx context.Context, checkpoint bool) error {
+	s.muClose.Lock()
+	if s.closing {
+		s.muClose.Unlock()
+		return ErrClosed
+	}
+	s.closing = true
+	s.muClose.Unlock()
+
+	// feeds run transactions to commit their offsets
+	s.muWAL.Lock()
+	feeds := append([]*Feed(nil), s.feeds...)
+	s.muWAL.Unlock()
+	for _, f := range feeds {
+		if err := f.Stop(); err != nil {
+			s.logger().Warn("failed to stop feed", "feed", f.name, "err", err)
+		}
+	}
+	// the background expiration runs transactions
+	if s.stopExpirer != nil {
+		close(s.stopExpirer)
+		<-s.expirerDone
+	}
+
+	s.muClose.Lock()
+	idle := make(chan struct{})
+	if s.active == 0 {
+		close(idle)
+	} else {
+		s.idle = idle
+	}
+	s.muClose.Unlock()
+	var aborted error
+	select {
+	case <-idle:
+	default:
+		// ctx already done does not abort the storage without in-flight transactions
+		select {
+		case <-idle:
+		case <-ctx.Done():
+			s.muClose.Lock()
+			active := s.active
+			s.muClose.Unlock()
+			s.logger().Warn("in-flight transactions are aborted", "active", active, "err", ctx.Err())
+			aborted = ctx.Err()
+		}
+	}
+
+	if s.stopCheckpointer != nil {
+		close(s.stopCheckpointer)
+		<-s.checkpointerDone
+	}
+	if s.raft != nil {
+		s.raft.Stop()
+	}
+	if s.replica != nil {
+		s.replica.Stop()
+	}
+	s.stopSyncing()
+
+	s.muWAL.Lock()
+	defer s.muWAL.Unlock()
+	var err error
+	if !s.opts.readOnly {
+		err = s.wal.Sync()
+		// commits of CommitAsync are durable by this sync
+		s.resolveUnsynced(err)
+		if err == nil && checkpoint {
+			err = s.checkpoint()
+		}
+	}
+	// commits of aborted transactions are rejected by writeWAL from now
+	s.closed = true
+
+	s.muDB.Lock()
+	if cerr := s.db.Close(); err == nil {
+		err = cerr
+	}
+	// aborted transactions may still read the closed backend
+	s.db = closedEngine{}
+	s.muDB.Unlock()
+	if cerr := s.wal.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := closeDirLock(s.dirLock); err == nil {
+		err = cerr
+	}
+	unpublishExpvar(s)
+	if err == nil {
+		err = aborted
+	}
+	return err
+}
+
+// enter registers the in-flight transaction, or returns ErrClosed after shutdown begins.
+func (s *Storage) enter() error {
+	s.muClose.Lock()
+	defer s.muClose.Unlock()
+	if s.closing {
+		return ErrClosed
+	}
+	s.active++
+	return nil
+}
+
+// leave unregisters the in-flight transaction, and wakes up Shutdown if it is the last one.
+func (s *Storage) leave() {
+	s.muClose.Lock()
+	defer s.muClose.Unlock()
+	s.active--
+	if s.active == 0 && s.idle != nil {
+		close(s.idle)
+		s.idle = nil
+	}
+}
+
+// leave stops waiting for the transaction by Shutdown. It is called by end, and by Prepare
+// because prepared transactions survive restart.
+func (txn *Txn) leave() {
+	if txn.active {
+		txn.active = false
+		txn.s.leave()
+	}
+}
+
+// closedEngine replaces the backend closed by Shutdown.
+type closedEngine struct{}
+
+func (closedEngine) Get(key string) (Record, error)                     { return Record{}, ErrClosed }
+func (closedEngine) Put(r Record) error                                 { return ErrClosed }
+func (closedEngine) Delete(key string) error                            { return ErrClosed }
+func (closedEngine) Len() int                                           { return 0 }
+func (closedEngine) Keys(prefix string, fn func(key string) bool) error { return ErrClosed }
+func (closedEngine) Save(version uint64) error                          { return ErrClosed }
+func (closedEngine) Load() (uint64, error)                              { return 0, ErrClosed }
+func (closedEngine) Close() error                                       { return ErrClosed }
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func openCloseTestStorage(t *testing.T) *Storage {
+	storage, err := Open(Options{WALPath: testWALPath, DBPath: testDBPath, Backend: "btree"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storage
+}
+
+// waitClosing waits until Shutdown rejects new transactions.
+func waitClosing(t *testing.T, s *Storage) {
+	for i := 0; i < 1000; i++ {
+		s.muClose.Lock()
+		closing := s.closing
+		s.muClose.Unlock()
+		if closing {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("shutdown does not begin")
+}
+
+func TestStorage_Close(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+
+	storage := openCloseTestStorage(t)
+	if err := storage.Put("key1", []byte("value1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(Options{WALPath: testWALPath, DBPath: testDBPath, Backend: "btree"}); err != ErrLocked {
+		t.Fatalf("WAL is opened twice : %v", err)
+	}
+
+	// Close waits for the in-flight transaction
+	txn := storage.NewTxn()
+	if err := txn.Insert("key2", []byte("value2")); err != nil {
+		t.Fatal(err)
+	}
+	chClosed := make(chan error, 1)
+	go func() {
+		chClosed <- storage.Close()
+	}()
+	waitClosing(t, storage)
+	if err := storage.Put("key3", []byte("value3")); err != ErrClosed {
+		t.Errorf("new transaction begins while closing : %v", err)
+	}
+	select {
+	case err := <-chClosed:
+		t.Fatalf("closed without waiting for transaction : %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-chClosed; err != nil {
+		t.Fatal(err)
+	} else if err = storage.Close(); err != ErrClosed {
+		t.Errorf("closed twice : %v", err)
+	} else if _, err = storage.Get("key1"); err != ErrClosed {
+		t.Errorf("get after close : %v", err)
+	}
+
+	// the final checkpoint clears WAL
+	if info, err := os.Stat(testWALPath); err != nil {
+		t.Fatal(err)
+	} else if info.Size() != 0 {
+		t.Errorf("WAL is not cleared : %v bytes", info.Size())
+	}
+	storage = openCloseTestStorage(t)
+	defer storage.Close()
+	for _, key := range []string{"key1", "key2"} {
+		if _, err := storage.Get(key); err != nil {
+			t.Errorf("failed to get %v : %v", key, err)
+		}
+	}
+	if _, err := storage.Get("key3"); err != ErrNotExist {
+		t.Errorf("key3 : %v", err)
+	}
+}
+
+func TestStorage_Shutdown(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+
+	storage := openCloseTestStorage(t)
+	prepared := storage.NewTxn()
+	if err := prepared.Insert("prepared", []byte("value")); err != nil {
+		t.Fatal(err)
+	} else if err = prepared.Prepare("gid1"); err != nil {
+		t.Fatal(err)
+	}
+	txn := storage.NewTxn()
+	if err := txn.Insert("aborted", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the in-flight transaction is waited, and aborted after timeout
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := storage.Shutdown(ctx, false); err != context.DeadlineExceeded {
+		t.Fatalf("shutdown : %v", err)
+	}
+	if err := txn.Commit(); err != ErrClosed {
+		t.Errorf("transaction is committed after shutdown : %v", err)
+	}
+	txn.Abort()
+	if info, err := os.Stat(testWALPath); err != nil {
+		t.Fatal(err)
+	} else if info.Size() == 0 {
+		t.Errorf("WAL is cleared without checkpoint")
+	}
+
+	storage = openCloseTestStorage(t)
+	defer storage.Close()
+	if _, err := storage.Get("aborted"); err != ErrNotExist {
+		t.Errorf("aborted transaction : %v", err)
+	} else if _, ok := storage.prepared["gid1"]; !ok {
+		t.Errorf("prepared transaction is lost")
+	} else if err = storage.CommitPrepared("gid1"); err != nil {
+		t.Fatal(err)
+	} else if _, err = storage.Get("prepared"); err != nil {
+		t.Errorf("prepared transaction is not committed : %v", err)
+	}
+}
+
+func TestStorage_Close_BulkLoader(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	storage := openCloseTestStorage(t)
+	loader, err := storage.NewBulkLoader(true)
+	if err != nil {
+		t.Fatal(err)
+	} else if err = loader.Add("key1", []byte("value1")); err != nil {
+		t.Fatal(err)
+	} else if err = loader.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// transactions applied without WAL are not in flight
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err = storage.Shutdown(ctx, true); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// compactEngine is the engine which rewrites its data files into the minimal size.
+type compactEngine interface {
+	Backend
+	// Compact rewrites data files saved with the commit version without free pages, tombstones
+	// and shadowed entries. It is called after Save with Storage.muDB locked.
+	Compact(version uint64) (GCStats, error)
+}
+
+// compactOf returns the compact engine under the wrappers.
+func compactOf(e Backend) (compactEngine, bool) {
+	for {
+		if c, ok := e.(compactEngine); ok {
+			return c, true
+		} else if w, ok := e.(unwrapper); ok {
+			e = w.unwrap()
+		} else {
+			return nil, false
+		}
+	}
+}
+
+// Compact rewrites the storage into its minimal form. All committed records are saved into data
+// files and WAL is truncated by checkpoint, and then btree, hash and lsm rewrite data files
+// without free pages, tombstones and shadowed entries, which map does by every checkpoint.
+// Commits are blocked until finished. It returns the tombstones dropped and the bytes reclaimed
+// from data files.
+func (s *Storage) Compact() (GCStats, error) {
+	if err := s.writable(); err != nil {
+		return GCStats{}, err
+	}
+	s.muWAL.Lock()
+	defer s.muWAL.Unlock()
+	if err := s.checkpoint(); err != nil {
+		return GCStats{}, err
+	}
+	c, ok := compactOf(s.db)
+	if !ok {
+		return GCStats{}, nil
+	}
+	s.muDB.Lock()
+	defer s.muDB.Unlock()
+	return c.Compact(s.version)
+}
+
+// compactOnOpen compacts the storage opened by Options.CompactOnOpen.
+func (s *Storage) compactOnOpen() error {
+	s.logger().Info("compacting storage")
+	stats, err := s.Compact()
+	if err != nil {
+		return fmt.Errorf("failed to compact : %w", err)
+	}
+	s.logger().Info("storage is compacted", "tombstones", stats.Tombstones, "reclaimed_bytes", stats.ReclaimedBytes)
+	return nil
+}
+
+// Compact merges all tables into one and drops tombstones older than the version.
+func (l *LSM) Compact(version uint64) (GCStats, error) {
+	return l.GC(version + 1)
+}
+
+// Compact rewrites the data file by copying all records into a fresh tree.
+func (t *BTree) Compact(version uint64) (GCStats, error) {
+	tmpPath := t.path + ".compact"
+	dst := newBTree(tmpPath, 0)
+	dst.fs = t.fs
+	stats, err := rebuild(t.fs, t, dst, t.path, tmpPath, version)
+	if err != nil {
+		return stats, err
+	}
+	fresh := newBTree(t.path, t.cachePages)
+	fresh.fs, fresh.useMmap = t.fs, t.useMmap
+	if err = t.Close(); err != nil {
+		return stats, err
+	}
+	*t = *fresh
+	_, err = t.Load()
+	return stats, err
+}
+
+// Compact rewrites the data file by copying all records into fresh buckets.
+func (h *Hash) Compact(version uint64) (GCStats, error) {
+	tmpPath := h.path + ".compact"
+	dst := newHash(tmpPath, 0)
+	dst.fs = h.fs
+	stats, err := rebuild(h.fs, h, dst, h.path, tmpPath, version)
+	if err != nil {
+		return stats, err
+	}
+	fresh := newHash(h.path, h.cachePages)
+	fresh.fs, fresh.useMmap = h.fs, h.useMmap
+	if err = h.Close(); err != nil {
+		return stats, err
+	}
+	*h = *fresh
+	_, err = h.Load()
+	return stats, err
+}
+
+// Compact compacts healthy partitions.
+func (p *partitionEngine) Compact(version uint64) (GCStats, error) {
+	stats := make([]GCStats, len(p.parts))
+	errs := p.each(func(i int, e Backend) (err error) {
+		c, ok := compactOf(e)
+		if p.broken[i] != nil || !ok {
+			return nil
+		}
+		stats[i], err = c.Compact(version)
+		return err
+	})
+	var total GCStats
+	for i, err := range errs {
+		if err != nil {
+			return total, fmt.Errorf("failed to compact partition %v : %w", i, err)
+		}
+		total.add(stats[i])
+	}
+	return total, nil
+}
+
+// Compact compacts the families which compact their data files.
+func (f *familyEngine) Compact(version uint64) (GCStats, error) {
+	var total GCStats
+	for _, e := range f.engines() {
+		if c, ok := compactOf(e); ok {
+			stats, err := c.Compact(version)
+			total.add(stats)
+			if err != nil {
+				return total, err
+			}
+		}
+	}
+	return total, nil
+}
+
+// rebuild copies all records of src into the empty engine dst at tmpPath, saves it with the
+// version, and replaces the data file at path by it in fs. src must be loaded again from path
+// after it succeeds.
+func rebuild(fs FS, src, dst Backend, path, tmpPath string, version uint64) (GCStats, error) {
+	// the temporary file left by the crash is discarded
+	if err := fs.Remove(tmpPath); err != nil && !os.IsNotExist(err) {
+		return GCStats{}, err
+	}
+	var keys []string
+	err := src.Keys("", func(key string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	for i := 0; err == nil && i < len(keys); i++ {
+		var r Record
+		if r, err = src.Get(keys[i]); err == nil {
+			err = dst.Put(r)
+		}
+	}
+	if err == nil {
+		err = dst.Save(version)
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	var before, after os.FileInfo
+	if err == nil {
+		before, err = fs.Stat(path)
+	}
+	if err == nil {
+		after, err = fs.Stat(tmpPath)
+	}
+	if err == nil {
+		err = fs.Rename(tmpPath, path)
+	}
+	if err != nil {
+		fs.Remove(tmpPath)
+		return GCStats{}, err
+	}
+	return GCStats{ReclaimedBytes: before.Size() - after.Size()}, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// fillAndDelete writes 500 records and deletes all but every tenth of them.
+func fillAndDelete(t *testing.T, storage *Storage) {
+	t.Helper()
+	value := []byte(strings.Repeat("v", 200))
+	for i := 0; i < 500; i++ {
+		if err := storage.Put(fmt.Sprintf("key%03d", i), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := storage.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i++ {
+		if i%10 == 0 {
+			continue
+		} else if err := storage.Delete(fmt.Sprintf("key%03d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestStorage_Compact(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		opts    Options
+		reclaim bool
+	}{
+		{"map", Options{}, false},
+		{"btree", Options{Backend: "btree", CachePages: 4}, true},
+		{"hash", Options{Backend: "hash"}, true},
+		{"lsm", Options{Backend: "lsm"}, true},
+		{"partitions", Options{Partitions: 3, Backend: "btree", Compress: true}, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_ = os.RemoveAll(tmpdir)
+			_ = os.MkdirAll(tmpdir, 0777)
+			opts := tt.opts
+			opts.WALPath, opts.DBPath = testWALPath, testDBPath
+			storage, err := Open(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer storage.wal.Close()
+			fillAndDelete(t, storage)
+
+			stats, err := storage.Compact()
+			if err != nil {
+				t.Fatal(err)
+			} else if tt.reclaim != (stats.ReclaimedBytes > 0) {
+				t.Errorf("stats : %+v", stats)
+			} else if storage.walSize != 0 {
+				t.Errorf("WAL is not truncated : %v bytes", storage.walSize)
+			}
+			report, err := storage.Verify(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			} else if !report.OK() || report.Records != 50 {
+				t.Errorf("report after compaction : %+v", report)
+			}
+			if err = storage.Put("key999", []byte("value")); err != nil {
+				t.Fatal(err)
+			}
+			txn := storage.NewTxn()
+			defer txn.Abort()
+			assertValue(t, txn, "key010", []byte(strings.Repeat("v", 200)))
+			assertValue(t, txn, "key999", []byte("value"))
+		})
+	}
+}
+
+func TestOpen_CompactOnOpen(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	opts := Options{WALPath: testWALPath, DBPath: testDBPath, Backend: "btree"}
+	storage, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillAndDelete(t, storage)
+	if err = storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(testDBPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts.CompactOnOpen = true
+	if _, err = OpenReadOnly(opts); err == nil {
+		t.Errorf("read only storage is compacted")
+	}
+	storage, err = Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	after, err := os.Stat(testDBPath)
+	if err != nil {
+		t.Fatal(err)
+	} else if after.Size() >= before.Size() {
+		t.Errorf("data file is %v bytes after compaction, %v bytes before", after.Size(), before.Size())
+	}
+	txn := storage.NewTxn()
+	defer txn.Abort()
+	assertValue(t, txn, "key490", []byte(strings.Repeat("v", 200)))
+	if _, err = txn.Read("key491"); err != ErrNotExist {
+		t.Errorf("read deleted key : %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io/ioutil"
+)
+
+// values larger than compressThreshold are compressed by compressEngine.
+const compressThreshold = 256
+
+const (
+	valueRaw = iota
+	valueDeflate
+)
+
+var ErrBrokenValue = errors.New("value is broken")
+
+// compressEngine compresses values before they are stored in the underlying engine.
+// Each stored value is prefixed with the flag which tells whether it is compressed,
+// so values which do not shrink are stored as is.
+type compressEngine struct {
+	Backend
+}
+
+func newCompressEngine(e Backend) *compressEngine {
+	return &compressEngine{Backend: e}
+}
+
+func (c *compressEngine) unwrap() Backend {
+	return c.Backend
+}
+
+func (c *compressEngine) Get(key string) (Record, error) {
+	r, err := c.Backend.Get(key)
+	if err != nil {
+		return r, err
+	}
+	r.Value, err = decompressValue(r.Value)
+	return r, err
+}
+
+func (c *compressEngine) Put(r Record) error {
+	r.Value = compressValue(r.Value)
+	return c.Backend.Put(r)
+}
+
+func compressValue(value []byte) []byte {
+	if len(value) > compressThreshold {
+		var buf bytes.Buffer
+		buf.WriteByte(valueDeflate)
+		w, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+		if _, err := w.Write(value); err == nil && w.Close() == nil && buf.Len() < len(value)+1 {
+			return buf.Bytes()
+		}
+	}
+	return append([]byte{valueRaw}, value...)
+}
+
+func decompressValue(value []byte) ([]byte, error) {
+	if len(value) == 0 {
+		return nil, ErrBrokenValue
+	}
+	switch value[0] {
+	case valueRaw:
+		return value[1:], nil
+	case valueDeflate:
+		v, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(value[1:])))
+		if err != nil {
+			return nil, ErrBrokenValue
+		}
+		return v, nil
+	default:
+		return nil, ErrBrokenValue
+	}
+}
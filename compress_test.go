@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCompressEngine(t *testing.T) {
+	e := newMapEngine(testDBPath, testTmpPath)
+	c := newCompressEngine(e)
+
+	values := map[string][]byte{
+		"small": []byte("value"),
+		"text":  bytes.Repeat([]byte(`{"name":"txngo","kind":"kvs"}`), 100),
+		"random": func() []byte {
+			// incompressible value is stored as is
+			v := make([]byte, 1000)
+			for i := range v {
+				v[i] = byte(i*7919 + i*i*31)
+			}
+			return v
+		}(),
+		"empty": {},
+	}
+	for k, v := range values {
+		if err := c.Put(Record{Key: k, Value: v}); err != nil {
+			t.Fatalf("failed to put %q : %v", k, err)
+		}
+	}
+	for k, v := range values {
+		if r, err := c.Get(k); err != nil {
+			t.Fatalf("failed to get %q : %v", k, err)
+		} else if !bytes.Equal(r.Value, v) {
+			t.Errorf("value for %q not match", k)
+		}
+	}
+
+	if r, _ := e.Get("text"); r.Value[0] != valueDeflate || len(r.Value) >= len(values["text"])/10 {
+		t.Errorf("text value is not compressed : flag %v, %v bytes", r.Value[0], len(r.Value))
+	}
+	if r, _ := e.Get("small"); r.Value[0] != valueRaw {
+		t.Errorf("small value is compressed")
+	}
+	if _, err := c.Get("not exist"); err != ErrNotExist {
+		t.Errorf("not existing key is not (not exist) : %v", err)
+	}
+}
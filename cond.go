@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Cmp is a condition of the record evaluated by CondTxn.
+type Cmp struct {
+	Key   string
+	Op    string
+	Value []byte
+}
+
+// Compare creates new condition of the record.
+// supported operators are "=", "!=", "<", ">" which compare the value
+// and "exists", "!exists" which do not need the value.
+func Compare(key, op string, value ...[]byte) Cmp {
+	c := Cmp{Key: key, Op: op}
+	if len(value) > 0 {
+		c.Value = value[0]
+	}
+	return c
+}
+
+const (
+	OpPut = 1 + iota
+	OpGet
+	OpDelete
+)
+
+// Op is an operation executed in the branch of CondTxn.
+type Op struct {
+	Action uint8
+	Key    string
+	Value  []byte
+}
+
+func Put(key string, value []byte) Op {
+	return Op{Action: OpPut, Key: key, Value: value}
+}
+
+func Get(key string) Op {
+	return Op{Action: OpGet, Key: key}
+}
+
+func Del(key string) Op {
+	return Op{Action: OpDelete, Key: key}
+}
+
+// CondResult is the result of CondTxn.
+type CondResult struct {
+	// Succeeded is true if all conditions are satisfied and Then branch is executed.
+	Succeeded bool
+	// Values is the read values for each Get operation in executed branch. nil for other operations.
+	Values [][]byte
+}
+
+// CondTxn is compare-and-commit transaction like etcd.
+// All conditions and executed operations are done in one transaction atomically.
+type CondTxn struct {
+	s    *Storage
+	cmps []Cmp
+	then []Op
+	els  []Op
+}
+
+func (s *Storage) If(cmps ...Cmp) *CondTxn {
+	return &CondTxn{s: s, cmps: cmps}
+}
+
+func (c *CondTxn) Then(ops ...Op) *CondTxn {
+	c.then = ops
+	return c
+}
+
+func (c *CondTxn) Else(ops ...Op) *CondTxn {
+	c.els = ops
+	return c
+}
+
+// Commit evaluates conditions and executes Then or Else branch, then commits them.
+// If any operation fails, the whole transaction is aborted.
+func (c *CondTxn) Commit() (*CondResult, error) {
+	var result *CondResult
+	err := c.s.autoCommit(func(txn *Txn) (err error) {
+		result, err = c.exec(txn)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (c *CondTxn) exec(txn *Txn) (*CondResult, error) {
+	result := &CondResult{Succeeded: true}
+	for _, cmp := range c.cmps {
+		ok, err := txn.evalCmp(cmp)
+		if err != nil {
+			return nil, err
+		} else if !ok {
+			result.Succeeded = false
+			break
+		}
+	}
+
+	ops := c.then
+	if !result.Succeeded {
+		ops = c.els
+	}
+	result.Values = make([][]byte, len(ops))
+	for i, op := range ops {
+		switch op.Action {
+		case OpPut:
+			if err := txn.Put(op.Key, op.Value); err != nil {
+				return nil, err
+			}
+
+		case OpGet:
+			v, err := txn.Read(op.Key)
+			if err == ErrNotExist {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			result.Values[i] = v
+
+		case OpDelete:
+			if err := txn.Delete(op.Key); err != nil && err != ErrNotExist {
+				return nil, err
+			}
+
+		default:
+			return nil, fmt.Errorf("operation is not supported : %v", op.Action)
+		}
+	}
+	return result, nil
+}
+
+func (txn *Txn) evalCmp(cmp Cmp) (bool, error) {
+	v, err := txn.Read(cmp.Key)
+	if err != nil && err != ErrNotExist {
+		return false, err
+	}
+	exists := err == nil
+
+	switch cmp.Op {
+	case "exists":
+		return exists, nil
+	case "!exists":
+		return !exists, nil
+	case "=":
+		return exists && bytes.Equal(v, cmp.Value), nil
+	case "!=":
+		return exists && !bytes.Equal(v, cmp.Value), nil
+	case "<":
+		return exists && bytes.Compare(v, cmp.Value) < 0, nil
+	case ">":
+		return exists && bytes.Compare(v, cmp.Value) > 0, nil
+	default:
+		return false, fmt.Errorf("compare operator is not supported : %q", cmp.Op)
+	}
+}
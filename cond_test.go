@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCondTxn_Commit(t *testing.T) {
+	storage := createTestStorage(t)
+	defer storage.wal.Close()
+	txn := storage.NewTxn()
+	if err := txn.Insert("key1", []byte("value1")); err != nil {
+		t.Errorf("failed to insert key1 : %v", err)
+	}
+	if err := txn.Commit(); err != nil {
+		t.Errorf("failed to commit : %v", err)
+	}
+
+	t.Run("then", func(t *testing.T) {
+		result, err := storage.If(
+			Compare("key1", "=", []byte("value1")),
+			Compare("key2", "!exists"),
+		).Then(
+			Put("key2", []byte("value2")),
+			Put("key1", []byte("value3")),
+			Get("key1"),
+		).Else(
+			Get("key1"),
+		).Commit()
+		if err != nil {
+			t.Fatalf("failed to commit : %v", err)
+		} else if !result.Succeeded {
+			t.Errorf("conditions are not satisfied")
+		} else if len(result.Values) != 3 || !bytes.Equal(result.Values[2], []byte("value3")) {
+			t.Errorf("values not match : %v", result.Values)
+		}
+		assertValue(t, txn, "key1", []byte("value3"))
+		assertValue(t, txn, "key2", []byte("value2"))
+		txn.Abort()
+	})
+
+	t.Run("else", func(t *testing.T) {
+		result, err := storage.If(
+			Compare("key1", "=", []byte("value1")),
+		).Then(
+			Del("key1"),
+		).Else(
+			Get("key1"),
+			Get("key3"),
+			Del("key2"),
+		).Commit()
+		if err != nil {
+			t.Fatalf("failed to commit : %v", err)
+		} else if result.Succeeded {
+			t.Errorf("conditions are unexpectedly satisfied")
+		} else if len(result.Values) != 3 || !bytes.Equal(result.Values[0], []byte("value3")) || result.Values[1] != nil {
+			t.Errorf("values not match : %v", result.Values)
+		}
+		assertValue(t, txn, "key1", []byte("value3"))
+		assertNotExist(t, txn, "key2")
+		txn.Abort()
+	})
+
+	t.Run("invalid operator", func(t *testing.T) {
+		if _, err := storage.If(Compare("key1", "~")).Then(Del("key1")).Commit(); err == nil {
+			t.Errorf("unexpectedly success to commit with invalid operator")
+		}
+		assertValue(t, txn, "key1", []byte("value3"))
+		txn.Abort()
+	})
+}
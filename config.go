@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// envPrefix is the prefix of environment variables which set flags of the server. For example,
+// TXNGO_SYNC_MODE sets -sync-mode.
+const envPrefix = "TXNGO_"
+
+// default names of files in the data directory given by -dir.
+const (
+	defaultWALName         = "txngo.log"
+	defaultDBName          = "txngo.db"
+	defaultReplicationName = "replication"
+	defaultRaftName        = "raft"
+)
+
+// envName returns the environment variable which sets the flag.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// setFlagsFromEnv sets flags of fs by environment variables found by lookup. It is called before
+// fs.Parse so that flags in the command line override environment variables.
+func setFlagsFromEnv(fs *flag.FlagSet, lookup func(key string) (string, bool)) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := lookup(envName(f.Name))
+		if !ok || err != nil {
+			return
+		}
+		if serr := f.Value.Set(value); serr != nil {
+			err = fmt.Errorf("invalid value %q of %v : %v", value, envName(f.Name), serr)
+		}
+	})
+	return err
+}
+
+// inDir returns path if given, or the file of name in the data directory.
+func inDir(dir, path, name string) string {
+	if path != "" {
+		return path
+	}
+	return filepath.Join(dir, name)
+}
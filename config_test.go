@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSetFlagsFromEnv(t *testing.T) {
+	env := map[string]string{
+		"TXNGO_DIR":                 "/var/lib/txngo",
+		"TXNGO_SYNC_MODE":           "none",
+		"TXNGO_CHECKPOINT_INTERVAL": "5m",
+		"TXNGO_LISTEN":              "localhost:3000",
+	}
+	lookup := func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}
+	fs := flag.NewFlagSet("txngo", flag.ContinueOnError)
+	dir := fs.String("dir", ".", "")
+	syncMode := fs.String("sync-mode", SyncAlways, "")
+	interval := fs.Duration("checkpoint-interval", 0, "")
+	listen := fs.String("listen", "", "")
+	wal := fs.String("wal", "", "")
+	if err := setFlagsFromEnv(fs, lookup); err != nil {
+		t.Fatal(err)
+	}
+	// the command line overrides environment variables
+	if err := fs.Parse([]string{"-listen", "localhost:4000"}); err != nil {
+		t.Fatal(err)
+	}
+	if *dir != "/var/lib/txngo" || *syncMode != SyncNone || *interval != 5*time.Minute || *listen != "localhost:4000" {
+		t.Errorf("flags : %v %v %v %v", *dir, *syncMode, *interval, *listen)
+	} else if path := inDir(*dir, *wal, defaultWALName); path != filepath.Join("/var/lib/txngo", "txngo.log") {
+		t.Errorf("WAL path : %v", path)
+	} else if path = inDir(*dir, "/tmp/txngo.log", defaultWALName); path != "/tmp/txngo.log" {
+		t.Errorf("given WAL path : %v", path)
+	}
+
+	env["TXNGO_CHECKPOINT_INTERVAL"] = "often"
+	fs = flag.NewFlagSet("txngo", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	fs.Duration("checkpoint-interval", 0, "")
+	if err := setFlagsFromEnv(fs, lookup); err == nil {
+		t.Errorf("invalid duration is set")
+	}
+}
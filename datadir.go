@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// names in the data directory managed by Options.Dir.
+const (
+	// dataDirWAL is the directory of WAL and copies of corrupt WAL.
+	dataDirWAL = "wal"
+	// dataDirSnapshots is the directory of data files saved by checkpoint.
+	dataDirSnapshots = "snapshots"
+	// dataDirTmp is the directory of temporary files, which is cleared by Open.
+	dataDirTmp = "tmp"
+	// dataDirLock is locked by the process using the directory.
+	dataDirLock = "LOCK"
+	// dataDirManifest records the layout and the backend the directory was created with.
+	dataDirManifest = "MANIFEST"
+	// dataDirUpgrade records the stage of the upgrade in progress to resume it.
+	dataDirUpgrade = "UPGRADE"
+)
+
+// manifestFormat is the version of the layout of the data directory.
+const manifestFormat = 1
+
+// manifest is the content of MANIFEST in JSON. Paths are relative to the data directory if
+// they are in it.
+type manifest struct {
+	Format     int       `json:"format"`
+	Backend    string    `json:"backend"`
+	Partitions int       `json:"partitions,omitempty"`
+	WAL        string    `json:"wal"`
+	Snapshot   string    `json:"snapshot"`
+	Created    time.Time `json:"created"`
+}
+
+// layout sets empty WALPath and DBPath to the files in the data directory Dir. If the directory
+// has no MANIFEST but the loose files written before the layout, both paths are set to them so
+// that they are read in place, and Open moves them into the layout. It does nothing if Dir is
+// empty, and may be called again.
+func (opts *Options) layout() {
+	if opts.Dir == "" || (opts.WALPath != "" && opts.DBPath != "") {
+		return
+	}
+	if opts.WALPath == "" && opts.DBPath == "" && isLegacyDir(opts.fs(), opts.Dir) {
+		opts.WALPath = filepath.Join(opts.Dir, defaultWALName)
+		opts.DBPath = filepath.Join(opts.Dir, defaultDBName)
+		opts.legacyDir = true
+		return
+	}
+	opts.WALPath = inDir(filepath.Join(opts.Dir, dataDirWAL), opts.WALPath, defaultWALName)
+	opts.DBPath = inDir(filepath.Join(opts.Dir, dataDirSnapshots), opts.DBPath, defaultDBName)
+}
+
+// isLegacyDir returns true if dir has WAL or data file of the default names but no MANIFEST.
+func isLegacyDir(fs FS, dir string) bool {
+	if _, err := fs.Stat(filepath.Join(dir, dataDirManifest)); !os.IsNotExist(err) {
+		return false
+	}
+	for _, name := range []string{defaultWALName, defaultDBName} {
+		if _, err := fs.Stat(filepath.Join(dir, name)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// tmpPath returns the temporary file to write the file at path atomically by rename.
+func (opts *Options) tmpPath(path string) string {
+	if opts.Dir == "" || opts.legacyDir {
+		return path + ".tmp"
+	}
+	return filepath.Join(opts.Dir, dataDirTmp, filepath.Base(path)+".tmp")
+}
+
+// openDataDir creates and validates the data directory Dir, and returns LOCK locked until the
+// storage is closed. Loose files written before the layout are moved into it, temporary files
+// left by the crash are removed, and MANIFEST is created at the first start. Read only
+// storages lock it shared and change nothing in it. Files are opened by Options.FS.
+func (opts *Options) openDataDir() (File, error) {
+	fs := opts.fs()
+	lockPath := filepath.Join(opts.Dir, dataDirLock)
+	if opts.readOnly {
+		lock, err := openFile(fs, lockPath)
+		if os.IsNotExist(err) {
+			// the directory is not written yet or written before the layout
+			return nil, opts.checkManifest()
+		} else if err != nil {
+			return nil, err
+		} else if err = lockFile(lock, false); err != nil {
+			lock.Close()
+			return nil, err
+		} else if err = opts.checkManifest(); err != nil {
+			lock.Close()
+			return nil, err
+		}
+		return lock, nil
+	}
+
+	for _, name := range []string{"", dataDirWAL, dataDirSnapshots, dataDirTmp} {
+		if err := fs.MkdirAll(filepath.Join(opts.Dir, name), 0700); err != nil {
+			return nil, err
+		}
+	}
+	lock, err := fs.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	} else if err = lockFile(lock, true); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	err = opts.migrateDataDir()
+	if err == nil {
+		err = opts.clearTmp()
+	}
+	if err == nil {
+		err = opts.checkManifest()
+	}
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return lock, nil
+}
+
+// closeDirLock releases LOCK of the data directory if it is locked.
+func closeDirLock(lock File) error {
+	if lock == nil {
+		return nil
+	}
+	return lock.Close()
+}
+
+// migrateDataDir moves loose files of WAL and data files in Dir into the layout. Files are
+// moved one by one by rename, so that the migration interrupted by the crash is resumed by the
+// next Open because MANIFEST is created after all of them are moved.
+func (opts *Options) migrateDataDir() error {
+	if !opts.legacyDir {
+		return nil
+	}
+	fs := opts.fs()
+	// the process which wrote the loose files may still use them
+	if wal, err := openFile(fs, opts.WALPath); err == nil {
+		err = lockFile(wal, true)
+		wal.Close()
+		if err != nil {
+			return err
+		}
+	}
+	entries, err := fs.ReadDir(opts.Dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		var sub string
+		switch name := entry.Name(); {
+		case strings.HasPrefix(name, defaultWALName):
+			sub = dataDirWAL
+		case name == defaultDBName+".tmp":
+			sub = dataDirTmp
+		case strings.HasPrefix(name, defaultDBName):
+			sub = dataDirSnapshots
+		default:
+			continue
+		}
+		from, to := filepath.Join(opts.Dir, entry.Name()), filepath.Join(opts.Dir, sub, entry.Name())
+		if err = fs.Rename(from, to); err != nil {
+			return fmt.Errorf("failed to move %v into the data directory : %w", from, err)
+		}
+		opts.logger().Info("file is moved into the data directory", "from", from, "to", to)
+	}
+	opts.legacyDir = false
+	opts.WALPath, opts.DBPath = "", ""
+	opts.layout()
+	return nil
+}
+
+// clearTmp removes temporary files left in tmp/ by the crash.
+func (opts *Options) clearTmp() error {
+	fs, dir := opts.fs(), filepath.Join(opts.Dir, dataDirTmp)
+	entries, err := fs.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err = fs.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newManifest returns the manifest of the data directory opened by opts.
+func (opts *Options) newManifest() manifest {
+	backend := opts.Backend
+	if backend == "" {
+		backend = "map"
+	}
+	rel := func(path string) string {
+		if r, err := filepath.Rel(opts.Dir, path); err == nil && !strings.HasPrefix(r, "..") {
+			return r
+		}
+		return path
+	}
+	m := manifest{Format: manifestFormat, Backend: backend, WAL: rel(opts.WALPath), Snapshot: rel(opts.DBPath), Created: time.Now().UTC()}
+	if opts.Partitions > 1 {
+		m.Partitions = opts.Partitions
+	}
+	return m
+}
+
+// readManifest reads MANIFEST of the data directory by fs.
+func readManifest(fs FS, dir string) (manifest, error) {
+	var m manifest
+	data, err := readFile(fs, filepath.Join(dir, dataDirManifest))
+	if err != nil {
+		return m, err
+	} else if err = json.Unmarshal(data, &m); err != nil {
+		return m, fmt.Errorf("%v is broken : %w", dataDirManifest, err)
+	}
+	return m, nil
+}
+
+// checkManifest fails if the data directory was created by the newer layout or with another
+// backend or number of partitions, which do not read the data files. MANIFEST is created if not
+// found and the storage is not read only.
+func (opts *Options) checkManifest() error {
+	expected := opts.newManifest()
+	m, err := readManifest(opts.fs(), opts.Dir)
+	if os.IsNotExist(err) {
+		if opts.readOnly {
+			return nil
+		}
+		return writeManifest(opts.fs(), opts.Dir, expected)
+	} else if err != nil {
+		return err
+	}
+	if m.Format > manifestFormat {
+		return fmt.Errorf("format %v of %v is not supported", m.Format, dataDirManifest)
+	} else if m.Backend != expected.Backend {
+		return fmt.Errorf("data directory is created with backend %v, not %v", m.Backend, expected.Backend)
+	} else if m.Partitions != expected.Partitions {
+		return fmt.Errorf("data directory is created with %v partitions, not %v", max(m.Partitions, 1), max(expected.Partitions, 1))
+	}
+	return nil
+}
+
+// writeManifest writes MANIFEST atomically through tmp/ by fs.
+func writeManifest(fs FS, dir string, m manifest) error {
+	return writeJSONFile(fs, dir, dataDirManifest, m)
+}
+
+// writeJSONFile writes v as JSON into the file of name in the data directory atomically through
+// tmp/ by fs.
+func writeJSONFile(fs FS, dir, name string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fs, filepath.Join(dir, name), filepath.Join(dir, dataDirTmp, name+".tmp"), append(data, '\n'))
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpen_Dir(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	dir := filepath.Join(tmpdir, "data")
+	storage, err := Open(Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = storage.Put("key1", []byte("value1")); err != nil {
+		t.Fatal(err)
+	} else if _, err = Open(Options{Dir: dir, WALPath: filepath.Join(tmpdir, "other.log")}); err != ErrLocked {
+		t.Errorf("open the locked directory : %v", err)
+	} else if err = storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"LOCK", "MANIFEST", "wal/txngo.log", "snapshots/txngo.db", "tmp"} {
+		if _, err = os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("%v is not created : %v", name, err)
+		}
+	}
+	m, err := readManifest(osFS{}, dir)
+	if err != nil {
+		t.Fatal(err)
+	} else if m.Format != manifestFormat || m.Backend != "map" || m.WAL != filepath.Join("wal", "txngo.log") || m.Snapshot != filepath.Join("snapshots", "txngo.db") {
+		t.Errorf("manifest : %+v", m)
+	}
+
+	// temporary files left by the crash are removed
+	tmpPath := filepath.Join(dir, "tmp", "txngo.db.tmp")
+	if err = ioutil.WriteFile(tmpPath, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Open(Options{Dir: dir, Backend: "btree"}); err == nil {
+		t.Fatalf("open the directory of map with btree")
+	}
+	storage, err = Open(Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	if _, err = os.Stat(tmpPath); !os.IsNotExist(err) {
+		t.Errorf("temporary file is not removed : %v", err)
+	}
+	txn := storage.NewTxn()
+	defer txn.Abort()
+	assertValue(t, txn, "key1", []byte("value1"))
+}
+
+func TestOpen_DirLegacy(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	storage, err := Open(Options{WALPath: filepath.Join(tmpdir, defaultWALName), DBPath: filepath.Join(tmpdir, defaultDBName)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = storage.Put("key1", []byte("value1")); err != nil {
+		t.Fatal(err)
+	} else if err = storage.SaveCheckPoint(); err != nil {
+		t.Fatal(err)
+	} else if err = storage.Put("key2", []byte("value2")); err != nil {
+		t.Fatal(err)
+	}
+	// the loose files are not moved while they are used
+	if _, err = Open(Options{Dir: tmpdir}); err != ErrLocked {
+		t.Fatalf("migrate the locked WAL : %v", err)
+	}
+	storage.wal.Close()
+	storage.db.Close()
+
+	// read only storages read the loose files in place
+	ro, err := OpenReadOnly(Options{Dir: tmpdir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	txn := ro.NewTxn()
+	assertValue(t, txn, "key2", []byte("value2"))
+	txn.Abort()
+	if err = ro.Close(); err != nil {
+		t.Fatal(err)
+	} else if _, err = os.Stat(filepath.Join(tmpdir, dataDirManifest)); !os.IsNotExist(err) {
+		t.Errorf("manifest is written by the read only storage : %v", err)
+	}
+
+	storage, err = Open(Options{Dir: tmpdir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	if storage.opts.WALPath != filepath.Join(tmpdir, "wal", defaultWALName) || storage.opts.DBPath != filepath.Join(tmpdir, "snapshots", defaultDBName) {
+		t.Errorf("paths after migration : %v, %v", storage.opts.WALPath, storage.opts.DBPath)
+	}
+	for _, name := range []string{defaultWALName, defaultDBName} {
+		if _, err = os.Stat(filepath.Join(tmpdir, name)); !os.IsNotExist(err) {
+			t.Errorf("%v is not moved : %v", name, err)
+		}
+	}
+	txn = storage.NewTxn()
+	defer txn.Abort()
+	assertValue(t, txn, "key1", []byte("value1"))
+	assertValue(t, txn, "key2", []byte("value2"))
+}
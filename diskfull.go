@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// ErrDiskFull is returned to writers while the storage is read only because WAL or checkpoint
+// failed by no space left on the disk. errors.Is(ErrDiskFull, ErrReadOnly) is true.
+var ErrDiskFull = fmt.Errorf("%w : no space left on device", ErrReadOnly)
+
+const (
+	// diskFullRetry is the interval to check the free space while the disk is full.
+	diskFullRetry = time.Second
+	// diskFullHeadroom is the free bytes required to resume writes if the free space is known.
+	diskFullHeadroom = 1 << 20
+)
+
+// isDiskFull returns true if err is caused by no space left on the disk.
+func isDiskFull(err error) bool {
+	return errors.Is(err, ErrDiskFull) || errors.Is(err, syscall.ENOSPC)
+}
+
+// setDiskFull makes the storage read only until the space is reclaimed.
+func (s *Storage) setDiskFull(err error) {
+	if s.diskFull.Swap(s.now().UnixNano()) == 0 {
+		s.logger().Error("storage is read only because disk is full", "err", err)
+	}
+}
+
+// resumeDiskFull resumes writes if the storage is read only by the full disk.
+func (s *Storage) resumeDiskFull() {
+	if s.diskFull.Swap(0) != 0 {
+		s.logger().Info("writes are resumed after disk is full")
+	}
+}
+
+// discardTornWAL truncates logs of the transaction partially written after size by the full
+// disk, so that WAL has no torn log in the middle when writes are resumed. muWAL must be locked.
+func (s *Storage) discardTornWAL(size int64, err error) error {
+	s.setDiskFull(err)
+	if terr := s.wal.Truncate(size); terr != nil {
+		s.logger().Error("failed to discard torn logs in WAL", "size", size, "err", terr)
+		return fmt.Errorf("%w (failed to discard torn logs : %v)", ErrDiskFull, terr)
+	}
+	s.walSize = size
+	return ErrDiskFull
+}
+
+// checkDiskFull returns ErrDiskFull while the disk is full. Every diskFullRetry, writes are
+// resumed if the file system of WAL has diskFullHeadroom or the free space is unknown, and the
+// storage becomes read only again if the next write still fails.
+func (s *Storage) checkDiskFull() error {
+	since := s.diskFull.Load()
+	if since == 0 {
+		return nil
+	}
+	now := s.now()
+	if now.Sub(time.Unix(0, since)) < diskFullRetry {
+		return ErrDiskFull
+	}
+	path := s.wal.Name()
+	if s.opts.DisableWAL {
+		path = s.opts.DBPath
+	}
+	if free, err := diskFree(filepath.Dir(path)); err == nil && free < diskFullHeadroom {
+		s.diskFull.CompareAndSwap(since, now.UnixNano())
+		return ErrDiskFull
+	}
+	if s.diskFull.CompareAndSwap(since, 0) {
+		s.logger().Info("writes are resumed after disk is full")
+	}
+	return nil
+}
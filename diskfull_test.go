@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStorage_DiskFull(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	fs := newFaultFS()
+	now := time.Unix(1000, 0)
+	opts := Options{WALPath: testWALPath, DBPath: testDBPath, FS: fs, Now: func() time.Time { return now }}
+	storage, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = storage.Put("key1", []byte("value1")); err != nil {
+		t.Fatal(err)
+	}
+	walSize := len(fs.files[testWALPath].data)
+	setFull := func(full bool) {
+		fs.mu.Lock()
+		fs.full = full
+		fs.mu.Unlock()
+	}
+
+	setFull(true)
+	if err = storage.Put("key2", []byte("value2")); err != ErrDiskFull || !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("put to the full disk : %v", err)
+	} else if len(fs.files[testWALPath].data) != walSize {
+		t.Errorf("torn logs are not discarded : %v bytes, expected %v", len(fs.files[testWALPath].data), walSize)
+	} else if h := storage.Health(); !h.DiskFull || h.WALWritable {
+		t.Errorf("health of the full disk : %+v", h)
+	}
+	txn := storage.NewTxn()
+	assertValue(t, txn, "key1", []byte("value1"))
+	txn.Abort()
+
+	// writes are resumed after the retry interval if space is reclaimed
+	setFull(false)
+	if err = storage.Put("key2", []byte("value2")); err != ErrDiskFull {
+		t.Errorf("put before the retry interval : %v", err)
+	}
+	now = now.Add(diskFullRetry)
+	if err = storage.Put("key2", []byte("value2")); err != nil {
+		t.Fatalf("put after space is reclaimed : %v", err)
+	} else if h := storage.Health(); h.DiskFull || !h.WALWritable {
+		t.Errorf("health after writes are resumed : %+v", h)
+	}
+
+	// writes are resumed when WAL is truncated by checkpoint
+	setFull(true)
+	if err = storage.Put("key3", []byte("value3")); err != ErrDiskFull {
+		t.Fatalf("put to the full disk : %v", err)
+	}
+	setFull(false)
+	if err = storage.Checkpoint(); err != nil {
+		t.Fatal(err)
+	} else if err = storage.Put("key3", []byte("value3")); err != nil {
+		t.Fatalf("put after checkpoint : %v", err)
+	} else if err = storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	storage, err = Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	txn = storage.NewTxn()
+	defer txn.Abort()
+	assertValue(t, txn, "key1", []byte("value1"))
+	assertValue(t, txn, "key2", []byte("value2"))
+	assertValue(t, txn, "key3", []byte("value3"))
+	if storage.version != 3 {
+		t.Errorf("version : %v", storage.version)
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	keyringMagic = 0x6b657973 // "keys"
+
+	dataKeySize  = 32
+	nonceSize    = 12
+	wrappedSize  = dataKeySize + 16
+	keyEntrySize = 4 + nonceSize + wrappedSize
+)
+
+var ErrDecrypt = errors.New("failed to decrypt")
+
+// keyring is the data keys wrapped by the master key and persisted in the key file.
+// Values are encrypted by the current data key and old data keys are kept to decrypt
+// values written before rotation.
+type keyring struct {
+	path string
+
+	mu      sync.RWMutex
+	master  []byte
+	keys    map[uint32]cipher.AEAD
+	raw     map[uint32][]byte
+	current uint32
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// loadKeyring loads the key file with the master key. new key file is created if not exist.
+func loadKeyring(path string, master []byte) (*keyring, error) {
+	if _, err := newAEAD(master); err != nil {
+		return nil, fmt.Errorf("invalid master key : %v", err)
+	}
+	k := &keyring{
+		path:   path,
+		master: master,
+		keys:   make(map[uint32]cipher.AEAD),
+		raw:    make(map[uint32][]byte),
+	}
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		if err = k.addDataKey(); err != nil {
+			return nil, err
+		}
+		return k, k.save()
+	} else if err != nil {
+		return nil, err
+	}
+
+	// key file layout : magic(4) | current(4) | count(4) | (id(4) | nonce(12) | wrapped(48)) * count | crc32(4)
+	if len(buf) < 16 || binary.BigEndian.Uint32(buf[0:4]) != keyringMagic {
+		return nil, fmt.Errorf("key file is broken")
+	} else if binary.BigEndian.Uint32(buf[len(buf)-4:]) != crc32.ChecksumIEEE(buf[:len(buf)-4]) {
+		return nil, ErrChecksum
+	}
+	k.current = binary.BigEndian.Uint32(buf[4:8])
+	count := int(binary.BigEndian.Uint32(buf[8:12]))
+	if len(buf) != 16+count*keyEntrySize {
+		return nil, fmt.Errorf("key file is broken")
+	}
+	kek, _ := newAEAD(master)
+	for i := 0; i < count; i++ {
+		entry := buf[12+i*keyEntrySize : 12+(i+1)*keyEntrySize]
+		id := binary.BigEndian.Uint32(entry[0:4])
+		dek, err := kek.Open(nil, entry[4:4+nonceSize], entry[4+nonceSize:], entry[0:4])
+		if err != nil {
+			return nil, ErrDecrypt
+		}
+		if err = k.setDataKey(id, dek); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := k.keys[k.current]; !ok {
+		return nil, fmt.Errorf("key file is broken : current data key %v not found", k.current)
+	}
+	return k, nil
+}
+
+func (k *keyring) setDataKey(id uint32, dek []byte) error {
+	aead, err := newAEAD(dek)
+	if err != nil {
+		return err
+	}
+	k.keys[id] = aead
+	k.raw[id] = dek
+	return nil
+}
+
+// addDataKey generates new data key and makes it current.
+func (k *keyring) addDataKey() error {
+	dek := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dek); err != nil {
+		return err
+	}
+	id := k.current + 1
+	if err := k.setDataKey(id, dek); err != nil {
+		return err
+	}
+	k.current = id
+	return nil
+}
+
+// save wraps all data keys with the master key and writes the key file atomically.
+func (k *keyring) save() error {
+	kek, err := newAEAD(k.master)
+	if err != nil {
+		return err
+	}
+	var buf []byte
+	buf = appendUint32(buf, keyringMagic)
+	buf = appendUint32(buf, k.current)
+	buf = appendUint32(buf, uint32(len(k.raw)))
+	for id, dek := range k.raw {
+		var entry [4 + nonceSize]byte
+		binary.BigEndian.PutUint32(entry[0:4], id)
+		if _, err = io.ReadFull(rand.Reader, entry[4:]); err != nil {
+			return err
+		}
+		buf = append(buf, entry[:]...)
+		buf = kek.Seal(buf, entry[4:], dek, entry[0:4])
+	}
+	buf = appendUint32(buf, crc32.ChecksumIEEE(buf))
+
+	tmpPath := k.path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(buf); err != nil {
+		f.Close()
+		return err
+	} else if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	} else if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, k.path)
+}
+
+// rotate re-wraps data keys with new master key. if newDataKey is true, new values are
+// encrypted by new data key and old values are re-encrypted lazily when they are updated.
+func (k *keyring) rotate(master []byte, newDataKey bool) error {
+	if _, err := newAEAD(master); err != nil {
+		return fmt.Errorf("invalid master key : %v", err)
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	oldMaster, oldCurrent := k.master, k.current
+	k.master = master
+	if newDataKey {
+		if err := k.addDataKey(); err != nil {
+			k.master = oldMaster
+			return err
+		}
+	}
+	if err := k.save(); err != nil {
+		// keep using the old key file
+		if newDataKey {
+			delete(k.keys, k.current)
+			delete(k.raw, k.current)
+		}
+		k.master, k.current = oldMaster, oldCurrent
+		return err
+	}
+	return nil
+}
+
+// seal layout : id(4) | nonce(12) | ciphertext. the record key is authenticated with the value.
+func (k *keyring) seal(key string, value []byte) ([]byte, error) {
+	k.mu.RLock()
+	id, aead := k.current, k.keys[k.current]
+	k.mu.RUnlock()
+	buf := make([]byte, 4+nonceSize, 4+nonceSize+len(value)+aead.Overhead())
+	binary.BigEndian.PutUint32(buf[0:4], id)
+	if _, err := io.ReadFull(rand.Reader, buf[4:]); err != nil {
+		return nil, err
+	}
+	return aead.Seal(buf, buf[4:], value, []byte(key)), nil
+}
+
+func (k *keyring) open(key string, value []byte) ([]byte, error) {
+	if len(value) < 4+nonceSize {
+		return nil, ErrDecrypt
+	}
+	k.mu.RLock()
+	aead, ok := k.keys[binary.BigEndian.Uint32(value[0:4])]
+	k.mu.RUnlock()
+	if !ok {
+		return nil, ErrDecrypt
+	}
+	v, err := aead.Open(nil, value[4:4+nonceSize], value[4+nonceSize:], []byte(key))
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return v, nil
+}
+
+// sealLog encrypts the value of the insert or update log written into WAL. The log is returned
+// as is if k is nil.
+func (k *keyring) sealLog(rlog RecordLog) (RecordLog, error) {
+	if k == nil || (rlog.Action != LInsert && rlog.Action != LUpdate) {
+		return rlog, nil
+	}
+	v, err := k.seal(rlog.Key, rlog.Value)
+	rlog.Value = v
+	return rlog, err
+}
+
+// openLog decrypts the value of the insert or update log read from WAL, which is sealed by
+// sealLog. The log is kept as is if k is nil.
+func (k *keyring) openLog(rlog *RecordLog) error {
+	if k == nil || (rlog.Action != LInsert && rlog.Action != LUpdate) {
+		return nil
+	}
+	v, err := k.open(rlog.Key, rlog.Value)
+	if err != nil {
+		return err
+	}
+	rlog.Value = v
+	return nil
+}
+
+// encryptEngine encrypts values before they are stored in the underlying engine.
+// keys of records and WAL are not encrypted, and values in WAL are sealed by sealLog.
+type encryptEngine struct {
+	Backend
+	ring *keyring
+}
+
+func (e *encryptEngine) unwrap() Backend {
+	return e.Backend
+}
+
+func (e *encryptEngine) Get(key string) (Record, error) {
+	r, err := e.Backend.Get(key)
+	if err != nil {
+		return r, err
+	}
+	r.Value, err = e.ring.open(key, r.Value)
+	return r, err
+}
+
+func (e *encryptEngine) Put(r Record) error {
+	v, err := e.ring.seal(r.Key, r.Value)
+	if err != nil {
+		return err
+	}
+	r.Value = v
+	return e.Backend.Put(r)
+}
+
+func readMasterKey(path string) ([]byte, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(strings.TrimSpace(string(buf)))
+}
+
+// EnableEncryption encrypts values in the data file and WAL with the data key in the key file
+// wrapped by the master key. it must be called before loading the data file and WAL.
+func (s *Storage) EnableEncryption(keyPath string, master []byte) error {
+	ring, err := loadKeyring(keyPath, master)
+	if err != nil {
+		return err
+	}
+	s.keyring = ring
+	s.db = &encryptEngine{Backend: s.db, ring: ring}
+	return nil
+}
+
+// RotateKey re-wraps data keys with new master key.
+// if newDataKey is true, the data key is also rotated for new values.
+func (s *Storage) RotateKey(master []byte, newDataKey bool) error {
+	if s.keyring == nil {
+		return errors.New("encryption is not enabled")
+	}
+	return s.keyring.rotate(master, newDataKey)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStorage_EnableEncryption(t *testing.T) {
+	storage := createTestStorage(t)
+	defer storage.wal.Close()
+	keyPath := filepath.Join(tmpdir, "txngo.keys")
+	master1 := bytes.Repeat([]byte{1}, 32)
+	master2 := bytes.Repeat([]byte{2}, 32)
+	if err := storage.EnableEncryption(keyPath, master1); err != nil {
+		t.Fatalf("failed to enable encryption : %v", err)
+	}
+
+	if err := storage.Put("key1", []byte("secret1")); err != nil {
+		t.Fatalf("failed to put : %v", err)
+	}
+	plain := storage.db.(*encryptEngine).Backend
+	if r, err := plain.Get("key1"); err != nil {
+		t.Fatalf("failed to get raw value : %v", err)
+	} else if bytes.Contains(r.Value, []byte("secret1")) {
+		t.Errorf("value is not encrypted")
+	}
+
+	// rotate master key and data key
+	if err := storage.RotateKey(master2, true); err != nil {
+		t.Fatalf("failed to rotate key : %v", err)
+	}
+	if err := storage.Put("key2", []byte("secret2")); err != nil {
+		t.Fatalf("failed to put : %v", err)
+	}
+	if err := storage.SaveCheckPoint(); err != nil {
+		t.Fatalf("failed to save checkpoint : %v", err)
+	}
+
+	// old master key can not unwrap data keys
+	if _, err := loadKeyring(keyPath, master1); err != ErrDecrypt {
+		t.Errorf("old master key is not (decrypt error) : %v", err)
+	}
+
+	wal, err := os.Open(testWALPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	storage2 := NewStorage(wal, testDBPath, testTmpPath)
+	if err = storage2.EnableEncryption(keyPath, master2); err != nil {
+		t.Fatalf("failed to enable encryption : %v", err)
+	} else if err = storage2.LoadCheckPoint(); err != nil {
+		t.Fatalf("failed to load checkpoint : %v", err)
+	}
+	assertValue(t, storage2.NewTxn(), "key1", []byte("secret1"))
+	assertValue(t, storage2.NewTxn(), "key2", []byte("secret2"))
+
+	// encrypted value can not be moved to another key
+	r, _ := plain.Get("key1")
+	if _, err = storage2.keyring.open("key2", r.Value); err != ErrDecrypt {
+		t.Errorf("value moved to another key is not (decrypt error) : %v", err)
+	}
+}
+
+func TestStorage_EncryptWAL(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	replDir := filepath.Join(tmpdir, "replication")
+	opts := Options{WALPath: testWALPath, DBPath: testDBPath, MasterKey: bytes.Repeat([]byte{1}, 32)}
+	storage, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	} else if err = storage.EnableReplication(ReplicationOptions{Dir: replDir}); err != nil {
+		t.Fatal(err)
+	}
+	// the follower retains the segment archived by checkpoint
+	f, err := storage.FollowWAL(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txn := storage.NewTxn()
+	if err = storage.Put("key1", []byte("secret1")); err != nil {
+		t.Fatal(err)
+	} else if err = txn.Insert("key3", []byte("secret3")); err != nil {
+		t.Fatal(err)
+	} else if err = txn.Prepare("g1"); err != nil {
+		t.Fatal(err)
+	}
+	// prepared logs are rewritten into cleared WAL
+	if err = storage.Checkpoint(); err != nil {
+		t.Fatal(err)
+	} else if err = storage.Put("key2", []byte("secret2")); err != nil {
+		t.Fatal(err)
+	}
+
+	// neither WAL nor retained segments have plaintext values
+	paths := []string{testWALPath}
+	segments, _ := filepath.Glob(filepath.Join(replDir, "*"))
+	if len(segments) == 0 {
+		t.Fatal("WAL is not archived into segment")
+	}
+	for _, path := range append(paths, segments...) {
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		} else if bytes.Contains(buf, []byte("secret")) {
+			t.Errorf("plaintext value is written into %v", path)
+		}
+	}
+
+	// followers read decrypted values
+	for _, value := range []string{"secret1", "secret2"} {
+		if commit, err := f.Next(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if len(commit.Events) != 1 || string(commit.Events[0].Value) != value {
+			t.Errorf("followed commit not match %+v, expected %v", commit, value)
+		}
+	}
+	f.Close()
+
+	// crash and decrypt values on replay
+	storage.wal.Close()
+	storage.db.Close()
+	if storage, err = Open(opts); err != nil {
+		t.Fatalf("failed to replay encrypted WAL : %v", err)
+	}
+	defer storage.Shutdown(context.Background(), false)
+	if err = storage.CommitPrepared("g1"); err != nil {
+		t.Fatalf("failed to commit prepared transaction : %v", err)
+	}
+	for key, value := range map[string]string{"key1": "secret1", "key2": "secret2", "key3": "secret3"} {
+		if v, err := storage.Get(key); err != nil || string(v) != value {
+			t.Errorf("value of %v not match %q, expected %q : %v", key, v, value, err)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"expvar"
+	"time"
+)
+
+// expvarMap is the "txngo" map of expvar which exports core counters of the storage opened last
+// by Open, so that services embedding the storage see them on /debug/vars without wiring.
+var expvarMap = expvar.NewMap("txngo")
+
+// expvarStores is the "stores" map in the "txngo" map which exports counters of storages with
+// Options.Name by the name instead, so that storages opened in the process do not replace
+// counters of each other.
+var expvarStores = new(expvar.Map)
+
+func init() {
+	expvarMap.Set("stores", expvarStores)
+}
+
+// publishExpvar replaces the entries of the "txngo" map with counters of s, or the entry of
+// the "stores" map if s is named.
+func publishExpvar(s *Storage) {
+	if s.opts.Name == "" {
+		setExpvar(expvarMap, s)
+		return
+	}
+	vars := new(expvar.Map)
+	setExpvar(vars, s)
+	expvarStores.Set(s.opts.Name, vars)
+}
+
+// unpublishExpvar removes counters of the named storage when it is closed.
+func unpublishExpvar(s *Storage) {
+	if s.opts.Name != "" {
+		expvarStores.Delete(s.opts.Name)
+	}
+}
+
+// setExpvar sets counters of s into vars.
+func setExpvar(vars *expvar.Map, s *Storage) {
+	m := &s.metrics
+	uint64Func := func(fn func() uint64) expvar.Func {
+		return func() interface{} { return fn() }
+	}
+	vars.Set("commits", uint64Func(m.commits.Value))
+	vars.Set("aborts", uint64Func(m.aborts.Value))
+	vars.Set("conflicts", uint64Func(m.conflicts.Value))
+	vars.Set("wal_written_bytes", uint64Func(m.walBytes.Value))
+	vars.Set("wal_fsyncs", uint64Func(func() uint64 {
+		_, count, _ := m.fsync.quantiles()
+		return count
+	}))
+	vars.Set("commit_version", uint64Func(func() uint64 {
+		s.muWAL.Lock()
+		defer s.muWAL.Unlock()
+		return s.version
+	}))
+	vars.Set("wal_size", expvar.Func(func() interface{} {
+		s.muWAL.Lock()
+		defer s.muWAL.Unlock()
+		return s.walSize
+	}))
+	vars.Set("keys", expvar.Func(func() interface{} {
+		s.muDB.RLock()
+		defer s.muDB.RUnlock()
+		return s.keyCount()
+	}))
+	vars.Set("uptime_seconds", expvar.Func(func() interface{} {
+		return int64(time.Since(s.started).Seconds())
+	}))
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"os"
+	"testing"
+)
+
+func TestPublishExpvar(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	storage, err := Open(Options{WALPath: testWALPath, DBPath: testDBPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.wal.Close()
+	if err = storage.Put("key1", []byte("value1")); err != nil {
+		t.Fatal(err)
+	} else if err = storage.Put("key2", []byte("value2")); err != nil {
+		t.Fatal(err)
+	} else if err = storage.Delete("key1"); err != nil {
+		t.Fatal(err)
+	}
+
+	var vars map[string]interface{}
+	if err = json.Unmarshal([]byte(expvar.Get("txngo").String()), &vars); err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]float64{
+		"commits":        3,
+		"aborts":         0,
+		"wal_fsyncs":     3,
+		"commit_version": 3,
+		"keys":           1,
+	} {
+		if vars[name] != expected {
+			t.Errorf("expvar %v : %v", name, vars[name])
+		}
+	}
+}
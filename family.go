@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+var ErrFamilyNotExist = errors.New("column family not exists")
+
+// familyKey returns the key of the record in the column family.
+// keys of the default family are not prefixed, and must not start with "\x00".
+func familyKey(name, key string) string {
+	if name == "" {
+		return key
+	}
+	return "\x00" + name + "\x00" + key
+}
+
+// splitFamilyKey returns the column family name and the key in the family.
+func splitFamilyKey(key string) (string, string) {
+	if !strings.HasPrefix(key, "\x00") {
+		return "", key
+	}
+	i := strings.IndexByte(key[1:], 0)
+	if i < 0 {
+		return "", key
+	}
+	return key[1 : 1+i], key[2+i:]
+}
+
+// familyEngine routes records to the engines of column families by the key prefix.
+// all column families share one WAL, so that a transaction over families commits atomically.
+type familyEngine struct {
+	def      Backend
+	families map[string]Backend
+	// names is sorted to save and load families in deterministic order.
+	names []string
+}
+
+func newFamilyEngine(def Backend) *familyEngine {
+	return &familyEngine{def: def, families: make(map[string]Backend)}
+}
+
+func (f *familyEngine) add(name string, e Backend) error {
+	if name == "" || strings.IndexByte(name, 0) >= 0 {
+		return fmt.Errorf("invalid column family name %q", name)
+	} else if _, ok := f.families[name]; ok {
+		return fmt.Errorf("column family %q already exists", name)
+	}
+	f.families[name] = e
+	f.names = append(f.names, name)
+	sort.Strings(f.names)
+	return nil
+}
+
+// route returns the engine and the key in it. unknown families are routed to default family.
+func (f *familyEngine) route(key string) (Backend, string) {
+	name, k := splitFamilyKey(key)
+	if e, ok := f.families[name]; ok {
+		return e, k
+	}
+	return f.def, key
+}
+
+func (f *familyEngine) Get(key string) (Record, error) {
+	e, k := f.route(key)
+	r, err := e.Get(k)
+	// Txn reuses the key of record as the lock key
+	r.Key = key
+	return r, err
+}
+
+func (f *familyEngine) Put(r Record) error {
+	e, k := f.route(r.Key)
+	r.Key = k
+	return e.Put(r)
+}
+
+func (f *familyEngine) Delete(key string) error {
+	e, k := f.route(key)
+	return e.Delete(k)
+}
+
+func (f *familyEngine) DeleteVersion(key string, version uint64) error {
+	e, k := f.route(key)
+	if t, ok := tombstoneOf(e); ok {
+		return t.DeleteVersion(k, version)
+	}
+	return e.Delete(k)
+}
+
+// GC collects tombstones of the families which keep tombstones.
+func (f *familyEngine) GC(horizon uint64) (GCStats, error) {
+	var total GCStats
+	for _, e := range f.engines() {
+		if t, ok := tombstoneOf(e); ok {
+			stats, err := t.GC(horizon)
+			total.add(stats)
+			if err != nil {
+				return total, err
+			}
+		}
+	}
+	return total, nil
+}
+
+// DropCaches evicts cached pages of the families which cache pages.
+func (f *familyEngine) DropCaches() (int, error) {
+	var total int
+	for _, e := range f.engines() {
+		if c, ok := cacheOf(e); ok {
+			n, err := c.DropCaches()
+			total += n
+			if err != nil {
+				return total, err
+			}
+		}
+	}
+	return total, nil
+}
+
+// Verify verifies the families which verify their structures. Keys of problems are prefixed by
+// the family name.
+func (f *familyEngine) Verify(ctx context.Context, problem func(VerifyProblem)) (int, error) {
+	var total int
+	for i, e := range f.engines() {
+		v, ok := verifyOf(e)
+		if !ok {
+			continue
+		}
+		name := ""
+		if i > 0 {
+			name = f.names[i-1]
+		}
+		n, err := v.Verify(ctx, func(p VerifyProblem) {
+			if p.Key != "" {
+				p.Key = familyKey(name, p.Key)
+			}
+			problem(p)
+		})
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func (f *familyEngine) Len() int {
+	var n int
+	for _, e := range f.engines() {
+		n += e.Len()
+	}
+	return n
+}
+
+// Keys iterates keys of the family of the prefix. keys of other families are not included.
+func (f *familyEngine) Keys(prefix string, fn func(key string) bool) error {
+	name, p := splitFamilyKey(prefix)
+	e, ok := f.families[name]
+	if !ok {
+		return f.def.Keys(prefix, fn)
+	}
+	return e.Keys(p, func(key string) bool {
+		return fn(familyKey(name, key))
+	})
+}
+
+// engines returns the default engine followed by the engines of families.
+func (f *familyEngine) engines() []Backend {
+	engines := []Backend{f.def}
+	for _, name := range f.names {
+		engines = append(engines, f.families[name])
+	}
+	return engines
+}
+
+func (f *familyEngine) Save(version uint64) error {
+	for i, e := range f.engines() {
+		if err := e.Save(version); err != nil {
+			if i > 0 {
+				return fmt.Errorf("failed to save column family %q : %w", f.names[i-1], err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Salvage salvages families one by one as partitionEngine.Salvage.
+func (f *familyEngine) Salvage(damage func(SnapshotDamage)) (uint64, error) {
+	engines := f.engines()
+	version, err := salvageEach(engines, func(i int) string {
+		if i == 0 {
+			return "default column family"
+		}
+		return fmt.Sprintf("column family %q", f.names[i-1])
+	}, damage)
+	f.def = engines[0]
+	for i, name := range f.names {
+		f.families[name] = engines[i+1]
+	}
+	return version, err
+}
+
+// Load loads all families and returns the oldest version of them.
+// families not found are initial, and os.IsNotExist error is returned only if all are not found.
+func (f *familyEngine) Load() (uint64, error) {
+	var (
+		version  uint64
+		loaded   bool
+		notExist error
+	)
+	for i, e := range f.engines() {
+		v, err := e.Load()
+		if os.IsNotExist(err) {
+			notExist = err
+			continue
+		} else if err != nil {
+			if i > 0 {
+				return 0, fmt.Errorf("failed to load column family %q : %w", f.names[i-1], err)
+			}
+			return 0, err
+		}
+		if !loaded || v < version {
+			version = v
+		}
+		loaded = true
+	}
+	if !loaded {
+		return 0, notExist
+	}
+	return version, nil
+}
+
+func (f *familyEngine) Close() error {
+	var err error
+	for _, e := range f.engines() {
+		if cerr := e.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// AddColumnFamily adds the column family stored in db. Records of families are written into
+// the shared WAL and committed atomically. Families must be added before loading checkpoint.
+func (s *Storage) AddColumnFamily(name string, db Backend) error {
+	if s.families == nil {
+		s.families = newFamilyEngine(s.db)
+		s.db = s.families
+	}
+	return s.families.add(name, db)
+}
+
+// Family is the view of the transaction for a column family.
+type Family struct {
+	txn  *Txn
+	name string
+}
+
+// Family returns the view of the transaction for the column family.
+func (txn *Txn) Family(name string) (*Family, error) {
+	if txn.s.families == nil {
+		return nil, ErrFamilyNotExist
+	} else if _, ok := txn.s.families.families[name]; !ok {
+		return nil, ErrFamilyNotExist
+	}
+	return &Family{txn: txn, name: name}, nil
+}
+
+func (f *Family) Read(key string) ([]byte, error) {
+	return f.txn.Read(familyKey(f.name, key))
+}
+
+func (f *Family) Insert(key string, value []byte) error {
+	return f.txn.Insert(familyKey(f.name, key), value)
+}
+
+func (f *Family) Update(key string, value []byte) error {
+	return f.txn.Update(familyKey(f.name, key), value)
+}
+
+func (f *Family) Put(key string, value []byte) error {
+	return f.txn.Put(familyKey(f.name, key), value)
+}
+
+func (f *Family) Delete(key string) error {
+	return f.txn.Delete(familyKey(f.name, key))
+}
+
+// Scan calls fn for each record with the prefix in the family in ascending order of keys.
+func (f *Family) Scan(prefix string, fn func(key string, value []byte) error) error {
+	return f.txn.Scan(familyKey(f.name, prefix), func(key string, value []byte) error {
+		_, k := splitFamilyKey(key)
+		return fn(k, value)
+	})
+}
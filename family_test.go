@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestColumnFamily(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	open := func() *Storage {
+		wal, err := os.OpenFile(testWALPath, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		storage := NewStorage(wal, testDBPath, testTmpPath)
+		if err = storage.AddColumnFamily("tree", newBTree(filepath.Join(tmpdir, "tree.db"), defaultCachePages)); err != nil {
+			t.Fatal(err)
+		}
+		mem := filepath.Join(tmpdir, "mem.db")
+		if err = storage.AddColumnFamily("mem", newCompressEngine(newMapEngine(mem, mem+".tmp"))); err != nil {
+			t.Fatal(err)
+		}
+		if err = storage.LoadCheckPoint(); err != nil && !os.IsNotExist(err) {
+			t.Fatalf("failed to load checkpoint : %v", err)
+		} else if _, err = storage.LoadWAL(); err != nil {
+			t.Fatalf("failed to load WAL : %v", err)
+		}
+		return storage
+	}
+
+	storage := open()
+	if err := storage.AddColumnFamily("tree", newMapEngine(testDBPath, testTmpPath)); err == nil {
+		t.Errorf("duplicated column family is added")
+	}
+	txn := storage.NewTxn()
+	tree, err := txn.Family("tree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem, err := txn.Family("mem")
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err = txn.Family("none"); err != ErrFamilyNotExist {
+		t.Errorf("unknown column family is not (not exist) : %v", err)
+	}
+
+	// a transaction writes into all families atomically
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key%v", i)
+		if err = txn.Insert(key, []byte("default")); err != nil {
+			t.Fatal(err)
+		} else if err = tree.Insert(key, []byte("tree")); err != nil {
+			t.Fatal(err)
+		} else if err = mem.Insert(key, []byte("mem")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = txn.Commit(); err != nil {
+		t.Fatalf("failed to commit : %v", err)
+	}
+	if err = tree.Delete("key0"); err != nil {
+		t.Fatal(err)
+	} else if err = mem.Update("key1", []byte("aborted")); err != nil {
+		t.Fatal(err)
+	}
+	txn.Abort()
+
+	assertFamilies := func(txn *Txn) {
+		t.Helper()
+		tree, _ := txn.Family("tree")
+		mem, _ := txn.Family("mem")
+		for i := 0; i < 10; i++ {
+			key := fmt.Sprintf("key%v", i)
+			assertValue(t, txn, key, []byte("default"))
+			if v, err := tree.Read(key); err != nil || string(v) != "tree" {
+				t.Errorf("value of %q in tree not match %q : %v", key, v, err)
+			}
+			if v, err := mem.Read(key); err != nil || string(v) != "mem" {
+				t.Errorf("value of %q in mem not match %q : %v", key, v, err)
+			}
+		}
+		// families are independent key spaces
+		var n int
+		if err := tree.Scan("", func(key string, value []byte) error {
+			if string(value) != "tree" {
+				t.Errorf("scan of tree returns %q : %q", key, value)
+			}
+			n++
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		} else if n != 10 {
+			t.Errorf("scan of tree returns %v records, expected 10", n)
+		}
+		n = 0
+		if err := txn.Scan("", func(key string, value []byte) error {
+			n++
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		} else if n != 10 {
+			t.Errorf("scan of default family returns %v records, expected 10", n)
+		}
+	}
+	assertFamilies(txn)
+
+	// recover from WAL
+	storage.wal.Close()
+	storage.db.Close()
+	storage = open()
+	assertFamilies(storage.NewTxn())
+
+	// recover from checkpoint
+	if err = storage.Checkpoint(); err != nil {
+		t.Fatalf("failed to checkpoint : %v", err)
+	}
+	storage.wal.Close()
+	storage.db.Close()
+	storage = open()
+	defer storage.wal.Close()
+	defer storage.db.Close()
+	assertFamilies(storage.NewTxn())
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// ErrFollowBehind is returned by FollowWAL if logs after the version are not retained.
+var ErrFollowBehind = errors.New("logs after the version are not retained in WAL")
+
+// WALCommit is the transaction committed in WAL. Events are changes of the transaction in the
+// order of logs, except keys used by the storage itself.
+type WALCommit struct {
+	Version uint64
+	Events  []Event
+}
+
+// WALFollower reads transactions committed after the version from WAL and retained segments, like
+// "tail -f" of WAL. Logs are verified by checksums, and transactions are returned in the order of
+// commit versions after they are durable. Segments are retained until the follower reads them or
+// ReplicationOptions.RetainBytes is exceeded. WALFollower must be closed after use.
+type WALFollower struct {
+	s      *Storage
+	cursor *walCursor
+	// version is the version of the last transaction returned. protected by repl.mu.
+	version uint64
+	// pending is the logs of the transaction being read, and prepared is the logs of prepared
+	// transactions by global transaction id.
+	pending  []RecordLog
+	prepared map[string][]RecordLog
+	// committed is the logs of the transaction read and not durable yet.
+	committed []RecordLog
+}
+
+// FollowWAL returns the follower of transactions committed after the version, which is used as
+// LSN. Logs of WAL are retained by EnableReplication. It fails with ErrFollowBehind if the
+// version is older than retained segments.
+func (s *Storage) FollowWAL(version uint64) (*WALFollower, error) {
+	r := s.repl
+	if r == nil {
+		return nil, errors.New("following WAL requires replication to retain WAL")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if version < r.base {
+		return nil, fmt.Errorf("%w : version %d is older than %d", ErrFollowBehind, version, r.base)
+	}
+	cursor := &walCursor{r: r}
+	var err error
+	if len(r.segments) > 0 {
+		err = cursor.open(r.segments[0].gen, 0)
+	} else {
+		err = cursor.open(r.gen, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+	f := &WALFollower{s: s, cursor: cursor, version: version, prepared: make(map[string][]RecordLog)}
+	r.followers[f] = struct{}{}
+	return f, nil
+}
+
+// Next waits for the next committed transaction until ctx is done.
+func (f *WALFollower) Next(ctx context.Context) (WALCommit, error) {
+	for {
+		logs, err := f.next(ctx)
+		if err != nil {
+			return WALCommit{}, err
+		}
+		commit := WALCommit{Version: logs[0].Version}
+		for _, rlog := range logs {
+			if strings.HasPrefix(rlog.Key, internalPrefix) {
+				continue
+			}
+			e := Event{Key: rlog.Key, Value: rlog.Value, Version: rlog.Version}
+			if rlog.Action == LDelete {
+				e.Value, e.Deleted = nil, true
+			}
+			commit.Events = append(commit.Events, e)
+		}
+		if len(commit.Events) > 0 {
+			return commit, nil
+		}
+	}
+}
+
+// next waits for logs of the next committed transaction including keys used by the storage.
+// The transaction read before it is durable is kept in committed, so that it is returned by the
+// next call if ctx is done while waiting.
+func (f *WALFollower) next(ctx context.Context) ([]RecordLog, error) {
+	for f.committed == nil {
+		rlog, err := f.cursor.next(ctx.Done(), time.Hour)
+		if err == errIdle {
+			continue
+		} else if err == io.EOF && ctx.Err() != nil {
+			return nil, ctx.Err()
+		} else if err != nil {
+			return nil, err
+		}
+		var logs []RecordLog
+		switch rlog.Action {
+		case LInsert, LUpdate, LDelete:
+			f.pending = append(f.pending, rlog)
+			continue
+		case LCommit:
+			logs = f.pending
+		case LPrepare:
+			// prepared logs are written again into WAL after checkpoint until the decision
+			f.prepared[rlog.Key] = f.pending
+		case LCommitPrepared:
+			logs = f.prepared[rlog.Key]
+			for i := range logs {
+				logs[i].Version = rlog.Version
+			}
+			delete(f.prepared, rlog.Key)
+		case LAbortPrepared:
+			delete(f.prepared, rlog.Key)
+		}
+		f.pending = nil
+		if len(logs) > 0 && logs[0].Version > f.version {
+			f.committed = logs
+		}
+	}
+	logs := f.committed
+	if err := f.waitDurable(ctx, logs[0].Version); err != nil {
+		return nil, err
+	}
+	f.committed = nil
+	r := f.s.repl
+	r.mu.Lock()
+	f.version = logs[0].Version
+	r.mu.Unlock()
+	return logs, nil
+}
+
+// waitDurable waits until logs of the version are synced, because logs are read from WAL while
+// they are being written.
+func (f *WALFollower) waitDurable(ctx context.Context, version uint64) error {
+	r := f.s.repl
+	for {
+		r.mu.RLock()
+		durable, changed := r.durable, r.changed
+		r.mu.RUnlock()
+		if version <= durable {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Close stops retaining segments for the follower.
+func (f *WALFollower) Close() error {
+	r := f.s.repl
+	r.mu.Lock()
+	delete(r.followers, f)
+	r.mu.Unlock()
+	return f.cursor.Close()
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// assertFollowed reads the next transaction of the follower and checks keys of its events.
+func assertFollowed(t *testing.T, f *WALFollower, version uint64, keys ...string) []Event {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	commit, err := f.Next(ctx)
+	if err != nil {
+		t.Fatal(err)
+	} else if commit.Version != version || len(commit.Events) != len(keys) {
+		t.Fatalf("commit : %+v, expected version %v of %q", commit, version, keys)
+	}
+	for i, e := range commit.Events {
+		if e.Key != keys[i] || e.Version != version {
+			t.Errorf("event %v : %+v", i, e)
+		}
+	}
+	return commit.Events
+}
+
+func TestStorage_FollowWAL(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	storage, err := Open(Options{WALPath: testWALPath, DBPath: testDBPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	if _, err = storage.FollowWAL(0); err == nil {
+		t.Errorf("WAL is followed without replication")
+	}
+	if err = storage.EnableReplication(ReplicationOptions{Dir: filepath.Join(tmpdir, "replication")}); err != nil {
+		t.Fatal(err)
+	}
+	if err = storage.Put("key1", []byte("value1")); err != nil {
+		t.Fatal(err)
+	} else if err = storage.Put("key2", []byte("value2")); err != nil {
+		t.Fatal(err)
+	}
+	f, err := storage.FollowWAL(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	from, err := storage.FollowWAL(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// WAL is archived and retained for followers
+	if err = storage.Checkpoint(); err != nil {
+		t.Fatal(err)
+	} else if len(storage.repl.segments) != 1 {
+		t.Errorf("%v segments are retained", len(storage.repl.segments))
+	}
+	txn := storage.NewTxn()
+	if err = txn.Delete("key1"); err != nil {
+		t.Fatal(err)
+	} else if err = txn.Insert("key3", []byte("value3")); err != nil {
+		t.Fatal(err)
+	} else if err = txn.Prepare("gid"); err != nil {
+		t.Fatal(err)
+	} else if err = storage.CommitPrepared("gid"); err != nil {
+		t.Fatal(err)
+	}
+
+	if events := assertFollowed(t, f, 1, "key1"); string(events[0].Value) != "value1" {
+		t.Errorf("value : %q", events[0].Value)
+	}
+	assertFollowed(t, f, 2, "key2")
+	if events := assertFollowed(t, f, 3, "key1", "key3"); !events[0].Deleted || events[1].Deleted {
+		t.Errorf("events : %+v", events)
+	}
+	assertFollowed(t, from, 2, "key2")
+	assertFollowed(t, from, 3, "key1", "key3")
+	if err = from.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the follower waits for new commits
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err = f.Next(ctx); err != context.DeadlineExceeded {
+		t.Errorf("next without commits : %v", err)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		storage.Put("key4", []byte("value4"))
+	}()
+	assertFollowed(t, f, 4, "key4")
+
+	// segments read by all followers are dropped
+	if err = storage.Checkpoint(); err != nil {
+		t.Fatal(err)
+	} else if len(storage.repl.segments) != 0 {
+		t.Errorf("%v segments are retained", len(storage.repl.segments))
+	}
+	if _, err = storage.FollowWAL(0); !errors.Is(err, ErrFollowBehind) {
+		t.Errorf("follow dropped logs : %v", err)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"embed"
+	"flag"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+)
+
+// formatFixtures is the data directories written by each format version. v1 is written by the
+// first release, and the current format is written by -format.update.
+//
+//go:embed testdata/format
+var formatFixtures embed.FS
+
+// fixtures have the WAL and data file at the default paths of the server.
+const (
+	fixtureWAL = "txngo.log"
+	fixtureDB  = "txngo.db"
+)
+
+var formatUpdate = flag.Bool("format.update", false, "write fixtures of the current format into testdata/format")
+
+// formatExpected is the records recovered from the fixtures of each format. All fixtures are
+// written by the same transactions :
+//
+//	insert key1 value1, insert key2 value2, insert key3 value3, commit, checkpoint
+//	update key1 value4, delete key2, insert key4 value5, commit
+//	insert key5 value6, abort
+//	update key3 value7, commit, crash
+//
+// records of formatV1 have no version in the data file, and are versioned from 1 by recovery.
+var formatExpected = map[string]struct {
+	version uint64
+	records []Record
+}{
+	"v1": {2, []Record{
+		{Key: "key1", Value: []byte("value4"), Version: 1},
+		{Key: "key3", Value: []byte("value7"), Version: 2},
+		{Key: "key4", Value: []byte("value5"), Version: 1},
+	}},
+	"v2": {3, []Record{
+		{Key: "key1", Value: []byte("value4"), Version: 2},
+		{Key: "key3", Value: []byte("value7"), Version: 3},
+		{Key: "key4", Value: []byte("value5"), Version: 2},
+	}},
+}
+
+func TestFormatFixtures(t *testing.T) {
+	if *formatUpdate {
+		for _, engine := range []string{"map", "btree", "hash", "lsm"} {
+			writeFormatFixture(t, engine)
+		}
+		t.Skip("fixtures are written. run again without -format.update to test them")
+	}
+
+	versions, err := formatFixtures.ReadDir("testdata/format")
+	if err != nil {
+		t.Fatal(err)
+	} else if len(versions) != currentFormat {
+		t.Fatalf("fixtures of %d formats are found, expected %d", len(versions), currentFormat)
+	}
+	for _, version := range versions {
+		expected, ok := formatExpected[version.Name()]
+		if !ok {
+			t.Fatalf("records of %v fixtures are not expected", version.Name())
+		}
+		engines, err := formatFixtures.ReadDir(path.Join("testdata/format", version.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, engine := range engines {
+			t.Run(version.Name()+"/"+engine.Name(), func(t *testing.T) {
+				loadFormatFixture(t, path.Join("testdata/format", version.Name(), engine.Name()))
+				opts := Options{WALPath: filepath.Join(tmpdir, fixtureWAL), DBPath: filepath.Join(tmpdir, fixtureDB), Backend: engine.Name()}
+				if report, err := AnalyzeRecovery(opts); err != nil {
+					t.Fatal(err)
+				} else if !report.OK() || report.Transactions != 2 || report.Records != 4 || report.LastVersion != expected.version {
+					t.Errorf("report : %+v", report)
+				}
+
+				// recovered records are written in the current format, and loaded again
+				for i := 0; i < 2; i++ {
+					storage, err := Open(opts)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if storage.version != expected.version {
+						t.Errorf("version : %v, expected %v", storage.version, expected.version)
+					} else if storage.db.Len() != len(expected.records) {
+						t.Errorf("%v records, expected %v", storage.db.Len(), len(expected.records))
+					}
+					for _, r := range expected.records {
+						if actual, err := storage.db.Get(r.Key); err != nil {
+							t.Errorf("failed to get %v : %v", r.Key, err)
+						} else if string(actual.Value) != string(r.Value) || actual.Version != r.Version {
+							t.Errorf("record : %+v, expected %+v", actual, r)
+						}
+					}
+					if err = storage.Checkpoint(); err != nil {
+						t.Error(err)
+					}
+					storage.db.Close()
+					storage.wal.Close()
+				}
+			})
+		}
+	}
+}
+
+// loadFormatFixture copies the fixture into tmpdir.
+func loadFormatFixture(t *testing.T, dir string) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	err := fs.WalkDir(formatFixtures, dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(tmpdir, filepath.FromSlash(name[len(dir):]))
+		if d.IsDir() {
+			return os.MkdirAll(dst, 0777)
+		}
+		buf, err := formatFixtures.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(dst, buf, 0600)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{fixtureWAL, fixtureDB} {
+		if _, err = os.Stat(filepath.Join(tmpdir, name)); err != nil {
+			t.Fatalf("fixture %v has no %v : %v", dir, name, err)
+		}
+	}
+}
+
+// writeFormatFixture writes the fixture of the engine in the current format, and leaves the
+// last transactions in WAL as crashed.
+func writeFormatFixture(t *testing.T, engine string) {
+	dir := filepath.Join("testdata", "format", fmt.Sprintf("v%d", currentFormat), engine)
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	} else if err = os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	storage, err := Open(Options{
+		WALPath: filepath.Join(dir, fixtureWAL),
+		DBPath:  filepath.Join(dir, fixtureDB),
+		Backend: engine,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.wal.Close()
+	defer storage.db.Close()
+
+	write := func(fn func(txn *Txn) error) {
+		if err := storage.autoCommit(fn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(func(txn *Txn) error {
+		for i := 1; i <= 3; i++ {
+			if err := txn.Insert(fmt.Sprintf("key%d", i), []byte(fmt.Sprintf("value%d", i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err = storage.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	write(func(txn *Txn) error {
+		if err := txn.Update("key1", []byte("value4")); err != nil {
+			return err
+		} else if err = txn.Delete("key2"); err != nil {
+			return err
+		}
+		return txn.Insert("key4", []byte("value5"))
+	})
+	txn := storage.NewTxn()
+	if err = txn.Insert("key5", []byte("value6")); err != nil {
+		t.Fatal(err)
+	}
+	txn.Abort()
+	write(func(txn *Txn) error {
+		return txn.Update("key3", []byte("value7"))
+	})
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fuzzLogs are the seeds of serialized logs including every action.
+var fuzzLogs = []RecordLog{
+	{Action: LInsert, Record: Record{Key: "key1", Value: []byte("value1"), Version: 1}},
+	{Action: LUpdate, Record: Record{Key: "key1", Value: []byte(""), Version: 2}},
+	{Action: LDelete, Record: Record{Key: "key1", Version: 3}},
+	{Action: LCommit},
+	{Action: LAbort},
+	{Action: LPrepare, Record: Record{Key: "gid"}},
+	{Action: LCommitPrepared, Record: Record{Key: "gid", Version: 4}},
+	{Action: LAbortPrepared, Record: Record{Key: "gid"}},
+	{Action: LEpoch, Record: Record{Version: 5}},
+}
+
+func serializeLog(t testing.TB, rlog RecordLog) []byte {
+	buf := make([]byte, 18+len(rlog.Key)+len(rlog.Value))
+	n, err := rlog.Serialize(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[:n]
+}
+
+// hugeRecord is the header of the record which claims the value of 4GB.
+func hugeRecord() []byte {
+	buf := make([]byte, 13)
+	buf[0] = 3
+	binary.BigEndian.PutUint32(buf[1:], 0xffffffff)
+	return append(buf, "key"...)
+}
+
+func FuzzRecordLog_Deserialize(f *testing.F) {
+	for _, rlog := range fuzzLogs {
+		b := serializeLog(f, rlog)
+		f.Add(b)
+		f.Add(b[:len(b)-1])
+	}
+	f.Add(append([]byte{LInsert}, hugeRecord()...))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var rlog RecordLog
+		n, err := rlog.Deserialize(data)
+		if err != nil {
+			return
+		} else if n > len(data) {
+			t.Fatalf("deserialized %d bytes from %d bytes", n, len(data))
+		}
+		// valid logs are serialized into the same bytes
+		if b := serializeLog(t, rlog); !bytes.Equal(b, data[:n]) {
+			t.Fatalf("serialized %x, expected %x", b, data[:n])
+		}
+	})
+}
+
+func FuzzReadRecordLog(f *testing.F) {
+	var stream []byte
+	for _, rlog := range fuzzLogs {
+		stream = append(stream, serializeLog(f, rlog)...)
+	}
+	f.Add(stream)
+	f.Add(stream[:len(stream)/2])
+	f.Add(append([]byte{LInsert, 0}, hugeRecord()...))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bytes.NewReader(data)
+		for {
+			if _, err := readRecordLog(r); err != nil {
+				return
+			}
+		}
+	})
+}
+
+func FuzzReadSnapshot(f *testing.F) {
+	var buf bytes.Buffer
+	records := []Record{{Key: "key1", Value: []byte("value1"), Version: 1}, {Key: "key2", Version: 2}}
+	if err := writeSnapshot(&buf, records, 2); err != nil {
+		f.Fatal(err)
+	}
+	f.Add(buf.Bytes())
+	f.Add(buf.Bytes()[:buf.Len()-1])
+	// huge count and huge value
+	f.Add([]byte{0, 0, 0, 0, 0, 0, 0, 1, 0xff, 0xff, 0xff, 0xff})
+	f.Add(append([]byte{0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 1}, hugeRecord()...))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if len(data) < 12 {
+			return
+		}
+		records, err := readRecords(bytes.NewReader(data[12:]), binary.BigEndian.Uint32(data[8:]))
+		if err == nil && len(records) != int(binary.BigEndian.Uint32(data[8:])) {
+			t.Fatalf("read %d records", len(records))
+		}
+	})
+}
+
+func FuzzMapEngine_Load(f *testing.F) {
+	var db []byte
+	db = binary.BigEndian.AppendUint32(db, 2)
+	db = binary.BigEndian.AppendUint64(db, 3)
+	for _, r := range []Record{{Key: "key1", Value: []byte("value1"), Version: 1}, {Key: "key2", Version: 3}} {
+		buf := make([]byte, 13+len(r.Key)+len(r.Value))
+		n, err := r.Serialize(buf)
+		if err != nil {
+			f.Fatal(err)
+		}
+		db = append(db, buf[:n]...)
+	}
+	f.Add(db)
+	f.Add(db[:len(db)-1])
+	f.Add(db[:12])
+	f.Add(append(db[:12:12], hugeRecord()...))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		path := filepath.Join(t.TempDir(), "test.db")
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		e := newMapEngine(path, path+".tmp")
+		if _, err := e.Load(); err != nil {
+			return
+		}
+		keys := 0
+		if err := e.Keys("", func(string) bool {
+			keys++
+			return true
+		}); err != nil {
+			t.Fatal(err)
+		} else if keys > int(binary.BigEndian.Uint32(data)) {
+			t.Fatalf("loaded %d keys more than header", keys)
+		}
+		if e.f != nil {
+			e.f.Close()
+		}
+	})
+}
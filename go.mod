@@ -1,5 +1,16 @@
 module github.com/kawasin73/txngo
 
-go 1.13
+go 1.21
 
-require github.com/kawasin73/umutex v0.2.1
+require (
+	github.com/kawasin73/umutex v0.2.1
+	google.golang.org/grpc v1.65.0
+	google.golang.org/protobuf v1.34.2
+)
+
+require (
+	golang.org/x/net v0.25.0 // indirect
+	golang.org/x/sys v0.20.0 // indirect
+	golang.org/x/text v0.15.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20240528184218-531527333157 // indirect
+)
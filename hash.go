@@ -0,0 +1,526 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"strings"
+)
+
+const (
+	hashMagic = 0x74786e68 // "txnh"
+
+	// header sizes of each page type
+	bucketHeaderSize    = 11
+	directoryHeaderSize = 13
+
+	// hashLoadFactor is the average number of records in a bucket which triggers bucket split.
+	hashLoadFactor = 32
+)
+
+// hbucket is the in-memory representation of a bucket and its overflow bucket pages.
+type hbucket struct {
+	// pgids is the page ids of the bucket on disk. empty if the bucket is not written yet.
+	pgids []uint64
+	dirty bool
+	keys  []string
+
+	versions []uint64
+	// values is nil for the value stored in overflow pages and not loaded.
+	values [][]byte
+	// overflow is the first overflow page id of the value. 0 if the value is inline.
+	overflow []uint64
+	// valueLens is the length of values stored in overflow pages.
+	valueLens []uint32
+}
+
+func (b *hbucket) search(key string) int {
+	for i, k := range b.keys {
+		if k == key {
+			return i
+		}
+	}
+	return -1
+}
+
+func (b *hbucket) entrySize(i int) int {
+	size := 1 + len(b.keys[i]) + 8 + 1 + 4
+	if b.overflow[i] != 0 || len(b.values[i]) > overflowThreshold {
+		return size + 8
+	}
+	return size + len(b.values[i])
+}
+
+func (b *hbucket) append(key string, version uint64, value []byte, overflow uint64, valueLen uint32) {
+	b.keys = append(b.keys, key)
+	b.versions = append(b.versions, version)
+	b.values = append(b.values, value)
+	b.overflow = append(b.overflow, overflow)
+	b.valueLens = append(b.valueLens, valueLen)
+}
+
+func (b *hbucket) remove(i int) {
+	last := len(b.keys) - 1
+	// the order of entries in a bucket does not matter
+	b.keys[i], b.versions[i], b.values[i] = b.keys[last], b.versions[last], b.values[last]
+	b.overflow[i], b.valueLens[i] = b.overflow[last], b.valueLens[last]
+	b.keys = b.keys[:last]
+	b.versions = b.versions[:last]
+	b.values = b.values[:last]
+	b.overflow = b.overflow[:last]
+	b.valueLens = b.valueLens[:last]
+}
+
+// Hash is the disk-backed linear hashing engine for point lookup heavy workloads.
+// Each bucket is stored in a primary page and is chained to overflow bucket pages only when
+// it is full, so that Get reads one or two pages. Buckets are split one by one in order
+// when the load factor grows. Modified buckets are kept in memory and written into new pages
+// at checkpoint like BTree. Keys are iterated in no particular order.
+type Hash struct {
+	pager
+	// the number of buckets is 2^level + split.
+	level uint
+	split uint64
+	// dir is the first page id of each bucket. 0 if the bucket is empty.
+	dir      []uint64
+	dirPages []uint64
+	// buckets is the modified buckets since the last checkpoint.
+	buckets map[uint64]*hbucket
+	count   int
+}
+
+func newHash(path string, cachePages int) *Hash {
+	return &Hash{
+		pager:   pager{path: path, magic: hashMagic, fs: osFS{}, cachePages: cachePages},
+		dir:     []uint64{0},
+		buckets: make(map[uint64]*hbucket),
+	}
+}
+
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// bucketIndex returns the bucket index of the key in current level and split pointer.
+func (h *Hash) bucketIndex(key string) uint64 {
+	sum := hashKey(key)
+	idx := sum & (1<<h.level - 1)
+	if idx < h.split {
+		idx = sum & (1<<(h.level+1) - 1)
+	}
+	return idx
+}
+
+func (h *Hash) readBucket(pgid uint64) (*hbucket, error) {
+	var buf [pageSize]byte
+	b := &hbucket{}
+	for pgid != 0 {
+		page, err := h.view(pgid, buf[:])
+		if err != nil {
+			return nil, err
+		} else if page[0] != pageBucket {
+			return nil, ErrBrokenPage
+		}
+		b.pgids = append(b.pgids, pgid)
+		count := int(binary.BigEndian.Uint16(page[9:11]))
+		p := bucketHeaderSize
+		for i := 0; i < count; i++ {
+			if p+1 > pageSize || p+1+int(page[p])+13 > pageSize {
+				return nil, ErrBrokenPage
+			}
+			keyLen := int(page[p])
+			key := string(page[p+1 : p+1+keyLen])
+			p += 1 + keyLen
+			version := binary.BigEndian.Uint64(page[p:])
+			isOverflow := page[p+8] == 1
+			valueLen := binary.BigEndian.Uint32(page[p+9:])
+			p += 13
+			if isOverflow {
+				if p+8 > pageSize {
+					return nil, ErrBrokenPage
+				}
+				b.append(key, version, nil, binary.BigEndian.Uint64(page[p:]), valueLen)
+				p += 8
+			} else {
+				if p+int(valueLen) > pageSize {
+					return nil, ErrBrokenPage
+				}
+				b.append(key, version, clone(page[p:p+int(valueLen)]), 0, valueLen)
+				p += int(valueLen)
+			}
+		}
+		pgid = binary.BigEndian.Uint64(page[1:9])
+	}
+	return b, nil
+}
+
+// writeBucket writes the bucket into new pages and returns the first page id.
+func (h *Hash) writeBucket(b *hbucket) (uint64, error) {
+	// move large values into overflow pages before packing entries
+	for i := range b.keys {
+		if b.overflow[i] == 0 && len(b.values[i]) > overflowThreshold {
+			pgid, err := h.writeOverflow(b.values[i])
+			if err != nil {
+				return 0, err
+			}
+			b.overflow[i] = pgid
+			b.valueLens[i] = uint32(len(b.values[i]))
+			b.values[i] = nil
+		}
+	}
+
+	// divide entries into pages
+	var (
+		starts = []int{0}
+		size   = bucketHeaderSize
+	)
+	for i := range b.keys {
+		es := b.entrySize(i)
+		if size+es > pageSize {
+			starts = append(starts, i)
+			size = bucketHeaderSize
+		}
+		size += es
+	}
+	if len(b.keys) == 0 {
+		return 0, nil
+	}
+	b.pgids = make([]uint64, len(starts))
+	for i := range b.pgids {
+		b.pgids[i] = h.allocate()
+	}
+
+	var buf [pageSize]byte
+	for i, start := range starts {
+		end := len(b.keys)
+		if i+1 < len(starts) {
+			end = starts[i+1]
+		}
+		var next uint64
+		if i+1 < len(b.pgids) {
+			next = b.pgids[i+1]
+		}
+		buf[0] = pageBucket
+		binary.BigEndian.PutUint64(buf[1:9], next)
+		binary.BigEndian.PutUint16(buf[9:11], uint16(end-start))
+		p := bucketHeaderSize
+		for j := start; j < end; j++ {
+			buf[p] = uint8(len(b.keys[j]))
+			copy(buf[p+1:], b.keys[j])
+			p += 1 + len(b.keys[j])
+			binary.BigEndian.PutUint64(buf[p:], b.versions[j])
+			if b.overflow[j] != 0 {
+				buf[p+8] = 1
+				binary.BigEndian.PutUint32(buf[p+9:], b.valueLens[j])
+				binary.BigEndian.PutUint64(buf[p+13:], b.overflow[j])
+				p += 21
+			} else {
+				buf[p+8] = 0
+				binary.BigEndian.PutUint32(buf[p+9:], uint32(len(b.values[j])))
+				copy(buf[p+13:], b.values[j])
+				p += 13 + len(b.values[j])
+			}
+		}
+		if err := h.writePage(b.pgids[i], buf[:]); err != nil {
+			return 0, err
+		}
+	}
+	b.dirty = false
+	return b.pgids[0], nil
+}
+
+// bucket returns the bucket. if touch is true, the bucket is kept in memory until next checkpoint.
+func (h *Hash) bucket(idx uint64, touch bool) (*hbucket, error) {
+	if b, ok := h.buckets[idx]; ok {
+		return b, nil
+	}
+	b, err := h.readBucket(h.dir[idx])
+	if err != nil {
+		return nil, err
+	}
+	if touch {
+		// pages of the bucket are rewritten at checkpoint
+		for _, pgid := range b.pgids {
+			h.release(pgid)
+		}
+		b.pgids = nil
+		b.dirty = true
+		h.buckets[idx] = b
+	}
+	return b, nil
+}
+
+func (h *Hash) Get(key string) (Record, error) {
+	b, err := h.bucket(h.bucketIndex(key), false)
+	if err != nil {
+		return Record{}, err
+	}
+	i := b.search(key)
+	if i < 0 {
+		return Record{}, ErrNotExist
+	}
+	value := b.values[i]
+	if value == nil && b.overflow[i] != 0 {
+		if value, err = h.readOverflow(b.overflow[i], b.valueLens[i]); err != nil {
+			return Record{}, err
+		}
+	}
+	return Record{Key: key, Value: value, Version: b.versions[i]}, nil
+}
+
+func (h *Hash) Put(r Record) error {
+	b, err := h.bucket(h.bucketIndex(r.Key), true)
+	if err != nil {
+		return err
+	}
+	if i := b.search(r.Key); i >= 0 {
+		// replace value
+		if b.overflow[i] != 0 {
+			if err = h.releaseOverflow(b.overflow[i]); err != nil {
+				return err
+			}
+		}
+		b.versions[i] = r.Version
+		b.values[i] = r.Value
+		b.overflow[i] = 0
+		b.valueLens[i] = 0
+		return nil
+	}
+	b.append(r.Key, r.Version, r.Value, 0, 0)
+	h.count++
+	if h.count > len(h.dir)*hashLoadFactor {
+		return h.splitBucket()
+	}
+	return nil
+}
+
+// splitBucket splits the bucket at split pointer into itself and the new bucket at the tail.
+func (h *Hash) splitBucket() error {
+	b, err := h.bucket(h.split, true)
+	if err != nil {
+		return err
+	}
+	h.split++
+	h.dir = append(h.dir, 0)
+	idx := uint64(len(h.dir) - 1)
+	nb := &hbucket{dirty: true}
+	h.buckets[idx] = nb
+	for i := 0; i < len(b.keys); {
+		if h.bucketIndex(b.keys[i]) != idx {
+			i++
+			continue
+		}
+		nb.append(b.keys[i], b.versions[i], b.values[i], b.overflow[i], b.valueLens[i])
+		b.remove(i)
+	}
+	if h.split == 1<<h.level {
+		h.level++
+		h.split = 0
+	}
+	return nil
+}
+
+func (h *Hash) Delete(key string) error {
+	b, err := h.bucket(h.bucketIndex(key), true)
+	if err != nil {
+		return err
+	}
+	i := b.search(key)
+	if i < 0 {
+		return nil
+	}
+	if b.overflow[i] != 0 {
+		if err = h.releaseOverflow(b.overflow[i]); err != nil {
+			return err
+		}
+	}
+	b.remove(i)
+	h.count--
+	// TODO: merge buckets when the load factor shrinks
+	return nil
+}
+
+func (h *Hash) Len() int {
+	return h.count
+}
+
+func (h *Hash) Keys(prefix string, fn func(key string) bool) error {
+	for idx := range h.dir {
+		b, err := h.bucket(uint64(idx), false)
+		if err != nil {
+			return err
+		}
+		for _, k := range b.keys {
+			if strings.HasPrefix(k, prefix) && !fn(k) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+func (h *Hash) writeDirectory() (uint64, error) {
+	const capacity = (pageSize - directoryHeaderSize) / 8
+	for _, pgid := range h.dirPages {
+		h.release(pgid)
+	}
+	pages := make([]uint64, (len(h.dir)+capacity-1)/capacity)
+	for i := range pages {
+		pages[i] = h.allocate()
+	}
+
+	var buf [pageSize]byte
+	for i, pgid := range pages {
+		chunk := h.dir[i*capacity:]
+		if len(chunk) > capacity {
+			chunk = chunk[:capacity]
+		}
+		var next uint64
+		if i+1 < len(pages) {
+			next = pages[i+1]
+		}
+		buf[0] = pageDirectory
+		binary.BigEndian.PutUint64(buf[1:9], next)
+		binary.BigEndian.PutUint32(buf[9:13], uint32(len(chunk)))
+		for j, id := range chunk {
+			binary.BigEndian.PutUint64(buf[directoryHeaderSize+j*8:], id)
+		}
+		if err := h.writePage(pgid, buf[:]); err != nil {
+			return 0, err
+		}
+	}
+	h.dirPages = pages
+	return pages[0], nil
+}
+
+func (h *Hash) readDirectory(pgid uint64, nbuckets uint64) error {
+	var buf [pageSize]byte
+	h.dir, h.dirPages = make([]uint64, 0, nbuckets), nil
+	for pgid != 0 {
+		if err := h.readPage(pgid, buf[:]); err != nil {
+			return err
+		} else if buf[0] != pageDirectory {
+			return ErrBrokenPage
+		}
+		count := int(binary.BigEndian.Uint32(buf[9:13]))
+		if directoryHeaderSize+count*8 > pageSize {
+			return ErrBrokenPage
+		}
+		for j := 0; j < count; j++ {
+			h.dir = append(h.dir, binary.BigEndian.Uint64(buf[directoryHeaderSize+j*8:]))
+		}
+		h.dirPages = append(h.dirPages, pgid)
+		pgid = binary.BigEndian.Uint64(buf[1:9])
+	}
+	if uint64(len(h.dir)) != nbuckets {
+		return ErrBrokenPage
+	}
+	return nil
+}
+
+// Save writes modified buckets and the directory, then switches the meta page.
+func (h *Hash) Save(version uint64) error {
+	if err := h.create(); err != nil {
+		return err
+	}
+	for idx, b := range h.buckets {
+		pgid, err := h.writeBucket(b)
+		if err != nil {
+			return err
+		}
+		h.dir[idx] = pgid
+	}
+	h.buckets = make(map[uint64]*hbucket)
+	dir, err := h.writeDirectory()
+	if err != nil {
+		return err
+	}
+
+	// meta payload : directory(8) | level(8) | split(8) | version(8) | count(8)
+	var payload [40]byte
+	binary.BigEndian.PutUint64(payload[0:8], dir)
+	binary.BigEndian.PutUint64(payload[8:16], uint64(h.level))
+	binary.BigEndian.PutUint64(payload[16:24], h.split)
+	binary.BigEndian.PutUint64(payload[24:32], version)
+	binary.BigEndian.PutUint64(payload[32:40], uint64(h.count))
+	return h.commit(payload[:])
+}
+
+// Load opens the data file and reads the directory of the newest valid meta page.
+func (h *Hash) Load() (uint64, error) {
+	payload, err := h.open()
+	if err != nil {
+		return 0, err
+	} else if len(payload) != 40 {
+		return 0, ErrBrokenPage
+	}
+	h.level = uint(binary.BigEndian.Uint64(payload[8:16]))
+	h.split = binary.BigEndian.Uint64(payload[16:24])
+	h.count = int(binary.BigEndian.Uint64(payload[32:40]))
+	h.buckets = make(map[uint64]*hbucket)
+	if h.level >= 64 || h.split >= 1<<h.level {
+		return 0, ErrBrokenPage
+	}
+	if err = h.readDirectory(binary.BigEndian.Uint64(payload[0:8]), 1<<h.level+h.split); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(payload[24:32]), nil
+}
+
+func (h *Hash) Close() error {
+	return h.close()
+}
+
+// Verify reads all buckets and checks that each key is in the bucket of its hash, that values in
+// overflow pages are readable and the count of records.
+func (h *Hash) Verify(ctx context.Context, problem func(VerifyProblem)) (int, error) {
+	var (
+		records int
+		pages   = make(map[uint64]bool)
+	)
+	for idx := range h.dir {
+		if idx%64 == 0 {
+			if err := ctx.Err(); err != nil {
+				return idx, err
+			}
+		}
+		report := func(key, format string, args ...interface{}) {
+			problem(VerifyProblem{Check: "hash", Key: key, Detail: fmt.Sprintf("bucket %d : ", idx) + fmt.Sprintf(format, args...)})
+		}
+		b, err := h.bucket(uint64(idx), false)
+		if err != nil {
+			report("", "failed to read : %v", err)
+			continue
+		}
+		for _, pgid := range b.pgids {
+			if pages[pgid] {
+				report("", "page %d is referred twice", pgid)
+			}
+			pages[pgid] = true
+		}
+		records += len(b.keys)
+		for i, key := range b.keys {
+			if j := b.search(key); j != i {
+				report(key, "key is stored twice")
+			}
+			if bidx := h.bucketIndex(key); bidx != uint64(idx) {
+				report(key, "key belongs to bucket %d", bidx)
+			}
+			if b.values[i] != nil || b.overflow[i] == 0 {
+				continue
+			} else if pages[b.overflow[i]] {
+				report(key, "overflow page %d is referred twice", b.overflow[i])
+			} else if _, err = h.readOverflow(b.overflow[i], b.valueLens[i]); err != nil {
+				report(key, "failed to read overflow value : %v", err)
+			}
+			pages[b.overflow[i]] = true
+		}
+	}
+	if records != h.count {
+		problem(VerifyProblem{Check: "hash", Detail: fmt.Sprintf("buckets have %d records, but counted %d", records, h.count)})
+	}
+	return len(h.dir), nil
+}
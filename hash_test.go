@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func createTestHash(t *testing.T) *Hash {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	return newHash(testDBPath, 8)
+}
+
+func TestHash(t *testing.T) {
+	h := createTestHash(t)
+	defer func() { h.Close() }()
+
+	rnd := rand.New(rand.NewSource(1))
+	expected := make(map[string][]byte)
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 3000; i++ {
+			key := fmt.Sprintf("key%05d", rnd.Intn(2000))
+			if rnd.Intn(3) == 0 {
+				if err := h.Delete(key); err != nil {
+					t.Fatalf("failed to delete %q : %v", key, err)
+				}
+				delete(expected, key)
+				continue
+			}
+			value := []byte(fmt.Sprintf("value%v-%v", round, i))
+			if i%100 == 0 {
+				// large value stored in overflow pages
+				value = bytes.Repeat(value, pageSize/len(value)+1)
+			}
+			if err := h.Put(Record{Key: key, Value: value}); err != nil {
+				t.Fatalf("failed to put %q : %v", key, err)
+			}
+			expected[key] = value
+		}
+		assertEngine(t, h, expected)
+		if h.Len() != len(expected) {
+			t.Errorf("len not match %v, expected %v", h.Len(), len(expected))
+		}
+		if _, err := h.Get("not exist"); err != ErrNotExist {
+			t.Errorf("not existing key is not (not exist) : %v", err)
+		}
+
+		if err := h.Save(uint64(round)); err != nil {
+			t.Fatalf("failed to save : %v", err)
+		}
+		if len(h.dir) < len(expected)/hashLoadFactor {
+			t.Errorf("buckets are not split : %v buckets", len(h.dir))
+		}
+		assertEngine(t, h, expected)
+
+		// reopen
+		npages := h.npages
+		h.Close()
+		h = newHash(testDBPath, 8)
+		if version, err := h.Load(); err != nil {
+			t.Fatalf("failed to load : %v", err)
+		} else if version != uint64(round) {
+			t.Errorf("version not match %v, expected %v", version, round)
+		}
+		if h.npages != npages {
+			t.Errorf("npages not match %v, expected %v", h.npages, npages)
+		}
+		assertEngine(t, h, expected)
+	}
+
+	// pages are reused after rewriting the same records
+	npages := h.npages
+	for k, v := range expected {
+		if err := h.Put(Record{Key: k, Value: v}); err != nil {
+			t.Fatalf("failed to put %q : %v", k, err)
+		}
+	}
+	if err := h.Save(5); err != nil {
+		t.Fatalf("failed to save : %v", err)
+	}
+	if h.npages > npages*2 {
+		t.Errorf("pages are not reused : %v pages, before %v", h.npages, npages)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+)
+
+// Health is the status of the storage reported by /healthz and /readyz of AdminServer.
+type Health struct {
+	// Recovered is true after the storage is opened and WAL is recovered.
+	Recovered bool `json:"recovered"`
+	// WALWritable is false if the last write to WAL failed.
+	WALWritable bool   `json:"wal_writable"`
+	WALError    string `json:"wal_error,omitempty"`
+	// DiskFree is the bytes available in the file system of WAL. -1 if unknown.
+	DiskFree int64 `json:"disk_free_bytes"`
+	// DiskFull is true while writes are rejected by ErrDiskFull.
+	DiskFull bool `json:"disk_full"`
+	// Role is "primary", "replica" or "fenced" which rejects commits after failover.
+	Role string `json:"role"`
+	// Recovery is the last progress of replaying WAL reported to the admin server while
+	// recovering.
+	Recovery *RecoveryProgress `json:"recovery,omitempty"`
+}
+
+// Health checks whether WAL is writable and the disk headroom.
+func (s *Storage) Health() Health {
+	h := Health{Recovered: true, WALWritable: true, DiskFree: -1, Role: "primary"}
+	s.muWAL.Lock()
+	walErr := s.walErr
+	s.muWAL.Unlock()
+	if free, err := diskFree(filepath.Dir(s.wal.Name())); err == nil {
+		h.DiskFree = free
+	}
+	if err := s.writable(); err == ErrReplica {
+		h.Role = "replica"
+	} else if err == ErrDiskFull {
+		h.DiskFull = true
+	} else if errors.Is(err, ErrCorrupted) {
+		// restarting replays WAL
+		walErr = err
+	} else if err != nil {
+		h.Role = "fenced"
+	}
+	if isDiskFull(walErr) && !h.DiskFull {
+		// writes are resumed
+		walErr = nil
+	}
+	if walErr == nil {
+		_, walErr = s.wal.Stat()
+	}
+	if walErr != nil {
+		h.WALWritable, h.WALError = false, walErr.Error()
+	}
+	return h
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// Hooks is called at each stage of lifecycle of transactions. Nil functions are skipped. Hooks
+// are called synchronously by the goroutine running the transaction, and must not use the
+// transaction. Internal transactions of the storage such as delivery of feeds call them too.
+type Hooks struct {
+	// OnBegin is called when the transaction accesses the first key.
+	OnBegin func(info *TxnInfo)
+	// OnPreCommit is called before the transaction is written into WAL or prepared. If it
+	// returns an error, Commit or Prepare fails with the error and the transaction can be
+	// aborted.
+	OnPreCommit func(info *TxnInfo) error
+	// OnPostCommit is called after the transaction is committed and applied.
+	OnPostCommit func(info *TxnInfo)
+	// OnAbort is called when the transaction is aborted. Read only transactions of Storage
+	// such as Get end with OnAbort.
+	OnAbort func(info *TxnInfo)
+	// OnRemove is called for each record removed by the storage itself with its final value,
+	// after the removal is committed, so that dependent caches and materializations can
+	// react. Only the storage running the background expiration calls it, and replicas do
+	// not.
+	OnRemove func(r Removal)
+}
+
+// RemovalReason is why the storage removes the record.
+type RemovalReason string
+
+// RemovedExpired is the removal of the record whose TTL set by Txn.Expire passes by the
+// background expiration. Eviction by Options.MaxMemory moves values into data file and does
+// not remove records.
+const RemovedExpired RemovalReason = "expired"
+
+// Removal is the record removed by the storage passed to OnRemove.
+type Removal struct {
+	Key    string
+	Value  []byte
+	Reason RemovalReason
+}
+
+// TxnInfo is the metadata of the transaction passed to hooks.
+type TxnInfo struct {
+	// ID is the number of the transaction unique in the storage.
+	ID    uint64
+	Start time.Time
+	// Reads is the keys read by the transaction in order. It is empty in OnBegin.
+	Reads []string
+	// Writes is the changes by the transaction in order of writes. It is empty in OnBegin.
+	Writes []Change
+	// Version is the commit version in OnPostCommit, or 0 if the transaction writes nothing or
+	// is replicated by Raft.
+	Version uint64
+}
+
+// SetHooks sets hooks called by transactions which begin after it. Zero Hooks removes hooks.
+func (s *Storage) SetHooks(h Hooks) {
+	if h.OnBegin == nil && h.OnPreCommit == nil && h.OnPostCommit == nil && h.OnAbort == nil && h.OnRemove == nil {
+		s.hooks.Store(nil)
+		return
+	}
+	s.hooks.Store(&h)
+}
+
+// begin starts tracing the transaction by the slow log and hooks at the first access of keys,
+// because Txn is reused for the next transaction after Commit or Abort. It returns ErrClosed
+// after the storage is shut down.
+func (txn *Txn) begin() error {
+	if txn.begun {
+		return nil
+	} else if err := txn.s.enter(); err != nil {
+		return err
+	}
+	txn.begun, txn.active = true, true
+	h := txn.s.hooks.Load()
+	if txn.s.slow.Load() != nil || h != nil {
+		txn.start = time.Now()
+	}
+	if h == nil {
+		return nil
+	}
+	// hooks are kept for the rest of the transaction
+	txn.hooks = h
+	txn.id = txn.s.txnID.Add(1)
+	if h.OnBegin != nil {
+		h.OnBegin(&TxnInfo{ID: txn.id, Start: txn.start})
+	}
+	return nil
+}
+
+// end finishes tracing the transaction.
+func (txn *Txn) end() {
+	txn.leave()
+	txn.begun, txn.start, txn.lockWait, txn.hooks, txn.id = false, time.Time{}, 0, nil, 0
+	txn.idempotencyKey, txn.ctx = "", nil
+}
+
+// info returns the metadata of the transaction.
+func (txn *Txn) info() *TxnInfo {
+	info := &TxnInfo{ID: txn.id, Start: txn.start}
+	for key := range txn.readSet {
+		info.Reads = append(info.Reads, key)
+	}
+	sort.Strings(info.Reads)
+	for _, rlog := range txn.logs {
+		switch rlog.Action {
+		case LInsert, LUpdate:
+			info.Writes = append(info.Writes, Change{Time: txn.start, Key: rlog.Key, Value: rlog.Value})
+		case LDelete:
+			info.Writes = append(info.Writes, Change{Time: txn.start, Key: rlog.Key, Deleted: true})
+		}
+	}
+	return info
+}
+
+// hookPreCommit calls OnPreCommit, and returns the metadata passed to OnPostCommit.
+func (txn *Txn) hookPreCommit() (*TxnInfo, error) {
+	if txn.hooks == nil {
+		return nil, nil
+	}
+	info := txn.info()
+	if txn.hooks.OnPreCommit != nil {
+		if err := txn.hooks.OnPreCommit(info); err != nil {
+			return nil, err
+		}
+	}
+	return info, nil
+}
+
+func (txn *Txn) hookPostCommit(info *TxnInfo, version uint64) {
+	if txn.hooks == nil || txn.hooks.OnPostCommit == nil {
+		return
+	}
+	if info == nil {
+		info = txn.info()
+	}
+	info.Version = version
+	for i := range info.Writes {
+		info.Writes[i].Version = version
+	}
+	txn.hooks.OnPostCommit(info)
+}
+
+func (txn *Txn) hookAbort() {
+	if txn.hooks != nil && txn.hooks.OnAbort != nil {
+		txn.hooks.OnAbort(txn.info())
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStorage_SetHooks(t *testing.T) {
+	storage := createTestStorage(t)
+	defer storage.wal.Close()
+	if err := storage.Put("key1", []byte("value1")); err != nil {
+		t.Fatal(err)
+	}
+
+	errForbidden := errors.New("forbidden prefix")
+	var events []string
+	storage.SetHooks(Hooks{
+		OnBegin: func(info *TxnInfo) {
+			events = append(events, fmt.Sprintf("begin %d", info.ID))
+		},
+		OnPreCommit: func(info *TxnInfo) error {
+			events = append(events, fmt.Sprintf("precommit %d %v %d", info.ID, info.Reads, len(info.Writes)))
+			for _, c := range info.Writes {
+				if strings.HasPrefix(c.Key, "forbidden/") {
+					return errForbidden
+				}
+			}
+			return nil
+		},
+		OnPostCommit: func(info *TxnInfo) {
+			events = append(events, fmt.Sprintf("postcommit %d v%d %+v", info.ID, info.Version, info.Writes[0]))
+		},
+		OnAbort: func(info *TxnInfo) {
+			events = append(events, fmt.Sprintf("abort %d %v %d", info.ID, info.Reads, len(info.Writes)))
+		},
+	})
+
+	// the transaction is reused after commit
+	txn := storage.NewTxn()
+	if _, err := txn.Read("key1"); err != nil {
+		t.Fatal(err)
+	} else if err = txn.Put("key2", []byte("value2")); err != nil {
+		t.Fatal(err)
+	} else if err = txn.Commit(); err != nil {
+		t.Fatal(err)
+	} else if err = txn.Delete("key1"); err != nil {
+		t.Fatal(err)
+	}
+	txn.Abort()
+
+	// the hook rejects the commit
+	if err := storage.Put("forbidden/key", []byte("value")); err != errForbidden {
+		t.Errorf("commit of forbidden key : %v", err)
+	} else if _, err = storage.Get("forbidden/key"); err != ErrNotExist {
+		t.Errorf("rejected commit is applied : %v", err)
+	}
+
+	expected := []string{
+		"begin 1",
+		"precommit 1 [key1] 1",
+		"postcommit 1 v2 {Version:2 Time:",
+		"begin 2",
+		"abort 2 [] 1",
+		"begin 3",
+		"precommit 3 [] 1",
+		"abort 3 [] 1",
+		"begin 4",
+		"abort 4 [forbidden/key] 0",
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("events : %q", events)
+	}
+	for i, e := range expected {
+		if !strings.HasPrefix(events[i], e) {
+			t.Errorf("event %d : %q", i, events[i])
+		}
+	}
+	if !strings.Contains(events[2], "Key:key2 Value:[118 97 108 117 101 50]") {
+		t.Errorf("written change : %q", events[2])
+	}
+
+	// zero hooks removes hooks
+	storage.SetHooks(Hooks{})
+	events = nil
+	if err := storage.Put("key3", []byte("value3")); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(events, []string(nil)) {
+		t.Errorf("events after hooks are removed : %q", events)
+	}
+}
+
+func TestHooks_OnRemove(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	storage, err := Open(Options{WALPath: testWALPath, DBPath: testDBPath, ExpireInterval: -1, Now: func() time.Time { return now }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	if err = storage.autoCommit(func(txn *Txn) error {
+		for _, key := range []string{"key1", "key2", "key3"} {
+			if err := txn.Insert(key, []byte("value of "+key)); err != nil {
+				return err
+			}
+		}
+		if err := txn.Expire("key1", time.Minute); err != nil {
+			return err
+		}
+		return txn.Expire("key2", time.Hour)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var removed []Removal
+	storage.SetHooks(Hooks{OnRemove: func(r Removal) {
+		// the removal is already committed
+		storage.muDB.RLock()
+		_, err := storage.db.Get(r.Key)
+		storage.muDB.RUnlock()
+		if err != ErrNotExist {
+			t.Errorf("%v is not removed before OnRemove : %v", r.Key, err)
+		}
+		removed = append(removed, r)
+	}})
+	// deletions by users are not removals
+	if err = storage.Delete("key3"); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Minute)
+	if _, err = storage.expire(10); err != nil {
+		t.Fatal(err)
+	}
+	expected := []Removal{{Key: "key1", Value: []byte("value of key1"), Reason: RemovedExpired}}
+	if !reflect.DeepEqual(removed, expected) {
+		t.Errorf("removed %+v, expected %+v", removed, expected)
+	}
+}
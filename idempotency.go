@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// idempotencyPrefix is the prefix of idempotency keys of committed transactions. Values are the
+// commit version and the commit time in unix nanoseconds.
+const idempotencyPrefix = internalPrefix + "idempotency/"
+
+// defaultIdempotencyRetention is the retention of idempotency keys if
+// Options.IdempotencyRetention is 0.
+const defaultIdempotencyRetention = 24 * time.Hour
+
+// errReplayedCommit is returned by commitLogs when the idempotency key is already committed.
+var errReplayedCommit = errors.New("transaction with the idempotency key is already committed")
+
+// SetIdempotencyKey sets the key which identifies the transaction among retries of the client.
+// The key is written with the records of the commit, and Commit of another transaction with the
+// same key does nothing and succeeds while the key is retained by Options.IdempotencyRetention,
+// so that the client retrying the commit whose result is unknown commits exactly once. The key
+// is cleared when the transaction ends. It is ignored by the prepared transaction, whose global
+// transaction id decides it once.
+func (txn *Txn) SetIdempotencyKey(key string) {
+	txn.idempotencyKey = key
+}
+
+// idempotencyRecord returns the log which records the idempotency key committed at the version.
+func idempotencyRecord(key string, version uint64, now time.Time) RecordLog {
+	value := make([]byte, 16)
+	binary.BigEndian.PutUint64(value, version)
+	binary.BigEndian.PutUint64(value[8:], uint64(now.UnixNano()))
+	return RecordLog{Action: LInsert, Record: Record{Key: idempotencyPrefix + key, Value: value}}
+}
+
+// idempotencyRetention returns Options.IdempotencyRetention or the default.
+func (s *Storage) idempotencyRetention() time.Duration {
+	if s.opts.IdempotencyRetention > 0 {
+		return s.opts.IdempotencyRetention
+	}
+	return defaultIdempotencyRetention
+}
+
+// committedKey returns the commit version of the idempotency key if it is retained. It must be
+// called with muWAL locked.
+func (s *Storage) committedKey(key string) (uint64, bool, error) {
+	s.muDB.RLock()
+	r, err := s.db.Get(idempotencyPrefix + key)
+	s.muDB.RUnlock()
+	if err == ErrNotExist {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	} else if s.expiredKey(r.Value, s.now()) {
+		// the expired key is overwritten by the new commit
+		return 0, false, nil
+	}
+	return binary.BigEndian.Uint64(r.Value), true, nil
+}
+
+// expiredKey returns true if the value of the idempotency key is committed before the retention.
+func (s *Storage) expiredKey(value []byte, now time.Time) bool {
+	if len(value) != 16 {
+		return true
+	}
+	committed := time.Unix(0, int64(binary.BigEndian.Uint64(value[8:])))
+	return now.Sub(committed) > s.idempotencyRetention()
+}
+
+// expireIdempotencyKeys deletes idempotency keys older than the retention by the internal
+// commit, so that checkpoint does not save them. Replicas and Raft delete them by the logs of
+// the primary and the leader. It must be called with muWAL locked.
+func (s *Storage) expireIdempotencyKeys() error {
+	if s.opts.readOnly || s.replica != nil || s.raft != nil {
+		return nil
+	}
+	var (
+		now  = s.now()
+		keys []string
+		logs []RecordLog
+	)
+	s.muDB.RLock()
+	err := s.db.Keys(idempotencyPrefix, func(key string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	for _, key := range keys {
+		if err != nil {
+			break
+		}
+		var r Record
+		if r, err = s.db.Get(key); err == ErrNotExist {
+			err = nil
+		} else if err == nil && s.expiredKey(r.Value, now) {
+			logs = append(logs, RecordLog{Action: LDelete, Record: Record{Key: key}})
+		}
+	}
+	s.muDB.RUnlock()
+	if err != nil || len(logs) == 0 {
+		return err
+	} else if err = s.saveWAL(logs, true); err != nil {
+		return err
+	}
+	s.logger().Info("idempotency keys are expired", "keys", len(logs))
+	return s.applyCommit(logs)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// commitWithKey puts the value by the transaction with the idempotency key.
+func commitWithKey(t *testing.T, storage *Storage, id, key, value string) {
+	t.Helper()
+	txn := storage.NewTxn()
+	txn.SetIdempotencyKey(id)
+	if err := txn.Put(key, []byte(value)); err != nil {
+		t.Fatal(err)
+	} else if err = txn.Commit(); err != nil {
+		t.Fatalf("failed to commit %v : %v", id, err)
+	} else if txn.idempotencyKey != "" {
+		t.Errorf("idempotency key is kept after commit")
+	}
+}
+
+func TestTxn_SetIdempotencyKey(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	opts := Options{WALPath: testWALPath, DBPath: testDBPath, IdempotencyRetention: time.Hour, Now: func() time.Time { return now }}
+	storage, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitWithKey(t, storage, "req1", "key1", "value1")
+	version := storage.version
+
+	// the replayed commit does nothing and releases locks
+	commitWithKey(t, storage, "req1", "key1", "value2")
+	commitWithKey(t, storage, "req2", "key2", "value2")
+	txn := storage.NewTxn()
+	assertValue(t, txn, "key1", []byte("value1"))
+	if err = txn.Put("key1", []byte("value3")); err != nil {
+		t.Fatalf("lock of the replayed commit is kept : %v", err)
+	}
+	txn.Abort()
+
+	// keys survive checkpoint and restart
+	if err = storage.Close(); err != nil {
+		t.Fatal(err)
+	} else if storage, err = Open(opts); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	commitWithKey(t, storage, "req1", "key1", "value4")
+	if v, _, err := storage.committedKey("req1"); err != nil || v != version {
+		t.Errorf("version of the key : %v %v, expected %v", v, err, version)
+	}
+	txn = storage.NewTxn()
+	assertValue(t, txn, "key1", []byte("value1"))
+	txn.Abort()
+
+	// commits after the retention are applied, and expired keys are deleted at checkpoint
+	now = now.Add(2 * time.Hour)
+	commitWithKey(t, storage, "req1", "key1", "value5")
+	if err = storage.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	txn = storage.NewTxn()
+	defer txn.Abort()
+	assertValue(t, txn, "key1", []byte("value5"))
+	if _, err = storage.db.Get(idempotencyPrefix + "req1"); err != nil {
+		t.Errorf("key committed again is deleted : %v", err)
+	} else if _, err = storage.db.Get(idempotencyPrefix + "req2"); err != ErrNotExist {
+		t.Errorf("expired key is not deleted : %v", err)
+	}
+
+	// idempotency keys are not records of users
+	if key, _, err := txn.First(); err != nil || key != "key1" {
+		t.Errorf("first %q %v", key, err)
+	}
+	var keys []string
+	if err = txn.Scan("", func(key string, value []byte) error {
+		keys = append(keys, key)
+		return nil
+	}); err != nil || len(keys) != 2 {
+		t.Errorf("scanned %q %v", keys, err)
+	} else if n := storage.Stats().Keys; n != 2 {
+		t.Errorf("%v keys", n)
+	}
+}
+
+func TestTxn_SetIdempotencyKey_CommitAsync(t *testing.T) {
+	storage := createTestStorage(t)
+	defer storage.Close()
+	commitWithKey(t, storage, "req1", "key1", "value1")
+
+	txn := storage.NewTxn()
+	txn.SetIdempotencyKey("req1")
+	if err := txn.Put("key1", []byte("value2")); err != nil {
+		t.Fatal(err)
+	}
+	future, err := txn.CommitAsync()
+	if err != nil {
+		t.Fatal(err)
+	} else if err = future.Wait(); err != nil {
+		t.Errorf("replayed commit is not synced : %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// ImportIterator yields records imported by Import.
+type ImportIterator interface {
+	// Next returns the next record, or io.EOF at the end.
+	Next() (key string, value []byte, err error)
+}
+
+// ImportFunc is the function used as ImportIterator.
+type ImportFunc func() (string, []byte, error)
+
+func (f ImportFunc) Next() (string, []byte, error) {
+	return f()
+}
+
+// ImportOptions is the options of Import.
+type ImportOptions struct {
+	// SkipWAL applies records without WAL and checkpoints at the end as BulkLoader.
+	SkipWAL bool
+	// BatchSize is the number of records committed by one WAL write. 4096 if 0.
+	BatchSize int
+	// Progress is called with the number of committed records after each group is committed.
+	Progress func(loaded uint64)
+}
+
+// Import inserts or updates all records of it by BulkLoader, committing them in large groups
+// instead of a transaction for each record. It returns the number of committed records. If it
+// fails, records committed before the failure are kept.
+func (s *Storage) Import(it ImportIterator, opts ImportOptions) (uint64, error) {
+	loader, err := s.NewBulkLoader(opts.SkipWAL)
+	if err != nil {
+		return 0, err
+	}
+	if opts.BatchSize > 0 {
+		loader.batch = opts.BatchSize
+	}
+	fail := func(err error) (uint64, error) {
+		if aerr := loader.Abort(); aerr != nil {
+			s.logger().Error("failed to checkpoint import", "err", aerr)
+		}
+		return loader.Loaded(), err
+	}
+	for {
+		key, value, err := it.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fail(err)
+		}
+		loaded := loader.Loaded()
+		if err = loader.Add(key, value); err != nil {
+			return fail(err)
+		} else if opts.Progress != nil && loader.Loaded() != loaded {
+			opts.Progress(loader.Loaded())
+		}
+	}
+	loaded := loader.Loaded()
+	if err = loader.Close(); err != nil {
+		return loader.Loaded(), err
+	} else if opts.Progress != nil && loader.Loaded() != loaded {
+		opts.Progress(loader.Loaded())
+	}
+	return loader.Loaded(), nil
+}
+
+// maxImportLine is the max size of a line of TSV read by the import command.
+const maxImportLine = 64 << 20
+
+// tsvIterator reads records from lines of "KEY<TAB>VALUE", which scan prints.
+type tsvIterator struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func newTSVIterator(r io.Reader) *tsvIterator {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxImportLine)
+	return &tsvIterator{scanner: scanner}
+}
+
+func (it *tsvIterator) Next() (string, []byte, error) {
+	if !it.scanner.Scan() {
+		if err := it.scanner.Err(); err != nil {
+			return "", nil, err
+		}
+		return "", nil, io.EOF
+	}
+	it.line++
+	line := it.scanner.Bytes()
+	i := bytes.IndexByte(line, '\t')
+	if i <= 0 {
+		return "", nil, fmt.Errorf("line %d is not KEY<TAB>VALUE", it.line)
+	}
+	return string(line[:i]), append([]byte(nil), line[i+1:]...), nil
+}
+
+// openImportSource opens the iterator of records in path by the format given by -from of the
+// import command. Records are read from stdin if path is "-" or empty, except for bbolt files
+// which are read at random. path of Badger is the backup, and its data directory fails with
+// ErrBadgerDirectory.
+func openImportSource(from, path string, stdin io.Reader) (ImportIterator, io.Closer, error) {
+	if path == "" || path == "-" {
+		switch from {
+		case "tsv":
+			return newTSVIterator(stdin), ioutil.NopCloser(nil), nil
+		case "badger":
+			return newBadgerIterator(stdin), ioutil.NopCloser(nil), nil
+		case "bolt":
+			return nil, nil, errors.New("bolt file is required")
+		}
+		return nil, nil, fmt.Errorf("unknown format %q", from)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var it ImportIterator
+	if info, serr := f.Stat(); serr != nil {
+		err = serr
+	} else if info.IsDir() && from == "badger" {
+		err = fmt.Errorf("%v : %w", path, ErrBadgerDirectory)
+	} else if info.IsDir() {
+		err = fmt.Errorf("%v is a directory", path)
+	} else {
+		switch from {
+		case "tsv":
+			it = newTSVIterator(f)
+		case "bolt":
+			it, err = newBoltIterator(f)
+		case "badger":
+			it = newBadgerIterator(f)
+		default:
+			err = fmt.Errorf("unknown format %q", from)
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return it, f, nil
+}
+
+// runImportCommand runs "txngo [flags] import [-from FORMAT] [-skip-wal] [-batch N] [FILE]" and
+// returns the exit status. Records are read from FILE, or stdin if FILE is "-" or not given, as
+// lines of "KEY<TAB>VALUE" by default, the bbolt file by -from=bolt, or the backup of Badger by
+// -from=badger.
+func runImportCommand(opts Options, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	from := fs.String("from", "tsv", "format of FILE : tsv, bolt or badger (the file written by \"badger backup\")")
+	skipWAL := fs.Bool("skip-wal", false, "apply records without WAL and checkpoint at the end")
+	batch := fs.Int("batch", bulkLoadBatch, "number of records committed by one WAL write")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	} else if fs.NArg() > 1 || *batch <= 0 {
+		fmt.Fprintln(stderr, "usage : txngo [flags] import [-from tsv|bolt|badger] [-skip-wal] [-batch N] [FILE]")
+		return exitUsage
+	}
+	it, closer, err := openImportSource(*from, fs.Arg(0), stdin)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitFailure
+	}
+	defer closer.Close()
+
+	log.SetOutput(ioutil.Discard)
+	storage, err := Open(opts)
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to open : %v\n", err)
+		return exitFailure
+	}
+	defer storage.Close()
+	loaded, err := storage.Import(it, ImportOptions{SkipWAL: *skipWAL, BatchSize: *batch})
+	fmt.Fprintf(stdout, "%d records imported\n", loaded)
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to import : %v\n", err)
+		return exitFailure
+	} else if err = storage.Close(); err != nil {
+		fmt.Fprintf(stderr, "failed to close : %v\n", err)
+		return exitFailure
+	}
+	return exitOK
+}
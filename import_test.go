@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// importRecords returns the iterator of n records "key<i>" and then err, or io.EOF if err is nil.
+func importRecords(n int, err error) ImportIterator {
+	i := 0
+	return ImportFunc(func() (string, []byte, error) {
+		if i == n {
+			if err == nil {
+				return "", nil, io.EOF
+			}
+			return "", nil, err
+		}
+		i++
+		return fmt.Sprintf("key%d", i), []byte(fmt.Sprintf("value%d", i)), nil
+	})
+}
+
+func TestStorage_Import(t *testing.T) {
+	for _, skipWAL := range []bool{false, true} {
+		t.Run(fmt.Sprintf("skipWAL=%v", skipWAL), func(t *testing.T) {
+			_ = os.RemoveAll(tmpdir)
+			_ = os.MkdirAll(tmpdir, 0777)
+			storage := openCloseTestStorage(t)
+			var progress []uint64
+			loaded, err := storage.Import(importRecords(25, nil), ImportOptions{
+				SkipWAL:   skipWAL,
+				BatchSize: 10,
+				Progress:  func(loaded uint64) { progress = append(progress, loaded) },
+			})
+			if err != nil {
+				t.Fatal(err)
+			} else if loaded != 25 {
+				t.Errorf("loaded : %v", loaded)
+			} else if !reflect.DeepEqual(progress, []uint64{10, 20, 25}) {
+				t.Errorf("progress : %v", progress)
+			}
+			if info, err := os.Stat(testWALPath); err != nil {
+				t.Fatal(err)
+			} else if skipWAL != (info.Size() == 0) {
+				t.Errorf("WAL size : %v", info.Size())
+			}
+
+			// the group failed in the middle is not committed
+			ierr := errors.New("broken source")
+			if loaded, err = storage.Import(importRecords(15, ierr), ImportOptions{SkipWAL: skipWAL, BatchSize: 10}); err != ierr {
+				t.Errorf("import error : %v", err)
+			} else if loaded != 10 {
+				t.Errorf("loaded before error : %v", loaded)
+			}
+			if err = storage.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			storage = openCloseTestStorage(t)
+			defer storage.Close()
+			if storage.db.Len() != 25 {
+				t.Errorf("%v records", storage.db.Len())
+			}
+			txn := storage.NewTxn()
+			defer txn.Abort()
+			assertValue(t, txn, "key1", []byte("value1"))
+			assertValue(t, txn, "key25", []byte("value25"))
+		})
+	}
+}
+
+func TestRunImportCommand(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	opts := Options{WALPath: testWALPath, DBPath: testDBPath}
+	var stdout, stderr bytes.Buffer
+	stdin := strings.NewReader("key1\tvalue1\nkey2\tvalue\twith tab\nkey3\t\n")
+	if status := runImportCommand(opts, nil, stdin, &stdout, &stderr); status != exitOK {
+		t.Fatalf("status : %v (%s)", status, stderr.String())
+	} else if stdout.String() != "3 records imported\n" {
+		t.Errorf("output : %q", stdout.String())
+	}
+
+	path := filepath.Join(tmpdir, "records.tsv")
+	if err := ioutil.WriteFile(path, []byte("key4\tvalue4\nbroken\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	stdout.Reset()
+	stderr.Reset()
+	if status := runImportCommand(opts, []string{"-skip-wal", "-batch", "1", path}, nil, &stdout, &stderr); status != exitFailure {
+		t.Errorf("status of broken line : %v", status)
+	} else if stdout.String() != "1 records imported\n" || !strings.Contains(stderr.String(), "line 2 is not KEY<TAB>VALUE") {
+		t.Errorf("output : %q %q", stdout.String(), stderr.String())
+	}
+
+	for _, args := range [][]string{{"-unknown"}, {"-batch", "0"}, {"a", "b"}} {
+		if status := runImportCommand(opts, args, nil, &stdout, &stderr); status != exitUsage {
+			t.Errorf("status of %v : %v", args, status)
+		}
+	}
+
+	// bbolt file and the backup of Badger
+	boltPath := filepath.Join(tmpdir, "bolt.db")
+	writeTestBolt(t, boltPath)
+	stdout.Reset()
+	if status := runImportCommand(opts, []string{"-from=bolt", boltPath}, nil, &stdout, &stderr); status != exitOK {
+		t.Fatalf("status of bolt : %v (%s)", status, stderr.String())
+	} else if stdout.String() != "6 records imported\n" {
+		t.Errorf("output : %q", stdout.String())
+	}
+	stdout.Reset()
+	backup := bytes.NewReader(writeTestBadgerBackup([]testBadgerKV{{key: []byte("key5"), value: []byte("value5")}}))
+	if status := runImportCommand(opts, []string{"--from=badger"}, backup, &stdout, &stderr); status != exitOK {
+		t.Fatalf("status of badger : %v (%s)", status, stderr.String())
+	} else if stdout.String() != "1 records imported\n" {
+		t.Errorf("output : %q", stdout.String())
+	}
+	// the data directory of Badger is rejected
+	stderr.Reset()
+	if status := runImportCommand(opts, []string{"-from=badger", tmpdir}, nil, &stdout, &stderr); status != exitFailure {
+		t.Errorf("status of badger directory : %v", status)
+	} else if !strings.Contains(stderr.String(), ErrBadgerDirectory.Error()) {
+		t.Errorf("output of badger directory : %q", stderr.String())
+	}
+	if _, _, err := openImportSource("badger", tmpdir, nil); !errors.Is(err, ErrBadgerDirectory) {
+		t.Errorf("open badger directory : %v", err)
+	}
+	for _, args := range [][]string{{"-from=bolt"}, {"-from=tsv", tmpdir}, {"-from=unknown", path}} {
+		if status := runImportCommand(opts, args, nil, &stdout, &stderr); status != exitFailure {
+			t.Errorf("status of %v : %v", args, status)
+		}
+	}
+
+	storage, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	txn := storage.NewTxn()
+	defer txn.Abort()
+	assertValue(t, txn, "key1", []byte("value1"))
+	assertValue(t, txn, "key2", []byte("value\twith tab"))
+	assertValue(t, txn, "key3", []byte{})
+	assertValue(t, txn, "key4", []byte("value4"))
+	assertValue(t, txn, "users/1", []byte("alice"))
+	assertValue(t, txn, "users/admin/1", []byte{})
+	assertValue(t, txn, "key5", []byte("value5"))
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// serverVersion is the version reported to clients and by INFO.
+const serverVersion = "0.0.0"
+
+// infoSections is the sections of Info in the order of output.
+var infoSections = []string{"server", "engine", "replication", "stats", "keyspace"}
+
+// Info writes the state of the server and the storage in the sectioned format of Redis INFO.
+// Each section starts with "# Name" line followed by "field:value" lines and an empty line.
+// All sections are written if no section is given.
+func (s *Storage) Info(w io.Writer, sections ...string) error {
+	if len(sections) == 0 || (len(sections) == 1 && (sections[0] == "all" || sections[0] == "everything")) {
+		sections = infoSections
+	}
+	stats := s.Stats()
+	bw := bufio.NewWriter(w)
+	field := func(name string, v interface{}) {
+		fmt.Fprintf(bw, "%s:%v\r\n", name, v)
+	}
+	for _, section := range sections {
+		section = strings.ToLower(section)
+		switch section {
+		case "server":
+			bw.WriteString("# Server\r\n")
+			field("txngo_version", serverVersion)
+			field("go_version", runtime.Version())
+			field("os", runtime.GOOS+" "+runtime.GOARCH)
+			field("process_id", os.Getpid())
+			field("uptime_in_seconds", int64(time.Since(s.started).Seconds()))
+			field("wal_path", s.wal.Name())
+			field("data_dir", filepath.Dir(s.wal.Name()))
+
+		case "engine":
+			opts := s.opts
+			if opts.Backend == "" {
+				opts.Backend = "map"
+			}
+			bw.WriteString("# Engine\r\n")
+			field("backend", opts.Backend)
+			field("db_path", opts.DBPath)
+			field("cache_pages", opts.CachePages)
+			field("mmap", infoBool(opts.Mmap))
+			field("max_memory", opts.MaxMemory)
+			field("values_on_disk", infoBool(opts.ValuesOnDisk))
+			field("encryption", infoBool(s.keyring != nil))
+			field("compress", infoBool(opts.Compress))
+			field("partitions", opts.Partitions)
+			field("column_families", len(opts.ColumnFamilies))
+			field("checkpoint_size", s.checkpointSize)
+
+		case "replication":
+			role := s.Health().Role
+			if s.raft != nil {
+				role = "raft"
+			}
+			bw.WriteString("# Replication\r\n")
+			field("role", role)
+			field("epoch", stats.Epoch)
+			if s.raft != nil {
+				field("raft_leader", s.raft.Leader())
+			}
+			var connected int
+			for _, r := range stats.Replicas {
+				if r.Connected {
+					connected++
+				}
+			}
+			field("connected_replicas", connected)
+			for i, r := range stats.Replicas {
+				field(fmt.Sprintf("replica%d", i), fmt.Sprintf("id=%s,connected=%d,acked=%d,lag=%d", r.ID, infoBool(r.Connected), r.Acked, r.Lag))
+			}
+
+		case "stats":
+			bw.WriteString("# Stats\r\n")
+			field("total_commits", stats.Commits)
+			field("total_aborts", stats.Aborts)
+			field("total_conflicts", stats.Conflicts)
+			field("wal_written_bytes", stats.WALBytes)
+			field("wal_size", stats.WALSize)
+			field("prepared_transactions", stats.Prepared)
+			field("used_memory", stats.HeapBytes)
+
+		case "keyspace":
+			bw.WriteString("# Keyspace\r\n")
+			field("db0", fmt.Sprintf("keys=%d", stats.Keys))
+			field("commit_version", stats.Version)
+
+		default:
+			continue
+		}
+		bw.WriteString("\r\n")
+	}
+	return bw.Flush()
+}
+
+func infoBool(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
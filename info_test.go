@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestStorage_Info(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	storage, err := Open(Options{WALPath: testWALPath, DBPath: testDBPath, Backend: "btree", CachePages: 16, MasterKey: make([]byte, 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.db.Close()
+	defer storage.wal.Close()
+	if err = storage.Put("key1", []byte("value1")); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err = storage.Info(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, line := range []string{
+		"# Server\r\ntxngo_version:" + serverVersion + "\r\n",
+		"# Engine\r\nbackend:btree\r\n",
+		"cache_pages:16\r\n",
+		"encryption:1\r\n",
+		"# Replication\r\nrole:primary\r\n",
+		"total_commits:1\r\n",
+		"# Keyspace\r\ndb0:keys=1\r\ncommit_version:1\r\n",
+	} {
+		if !strings.Contains(out, line) {
+			t.Errorf("info does not contain %q :\n%v", line, out)
+		}
+	}
+
+	buf.Reset()
+	if err = storage.Info(&buf, "keyspace", "unknown"); err != nil {
+		t.Fatal(err)
+	} else if out = buf.String(); out != "# Keyspace\r\ndb0:keys=1\r\ncommit_version:1\r\n\r\n" {
+		t.Errorf("info of keyspace : %q", out)
+	}
+}
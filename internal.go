@@ -0,0 +1,65 @@
+package main
+
+import "strings"
+
+// hiddenKey returns true if the key is used by the storage itself or belongs to another column
+// family, and is hidden from users iterating keys with the prefix. Keys of the default family
+// do not start with internalPrefix, so only prefixes of the default family hide them.
+func hiddenKey(prefix, key string) bool {
+	return strings.HasPrefix(key, internalPrefix) && !strings.HasPrefix(prefix, internalPrefix)
+}
+
+// internalKey returns true if the key is used by the storage itself. Keys of column families
+// also start with internalPrefix, but they are records of users.
+func (s *Storage) internalKey(key string) bool {
+	if !strings.HasPrefix(key, internalPrefix) {
+		return false
+	} else if s.families == nil {
+		return true
+	}
+	name, _ := splitFamilyKey(key)
+	_, ok := s.families.families[name]
+	return !ok
+}
+
+// keyCount returns the number of records of users. It must be called with muDB locked.
+func (s *Storage) keyCount() int {
+	return s.db.Len() - s.internalKeys
+}
+
+// countInternal counts internal keys after records of db are replaced. If keys of the broken db
+// fail to be listed, all records are counted as records of users. It must be called with muDB
+// locked or before the storage is used.
+func (s *Storage) countInternal() {
+	n := 0
+	// internal keys are routed to the default family
+	if err := s.db.Keys(internalPrefix, func(key string) bool {
+		if s.internalKey(key) {
+			n++
+		}
+		return true
+	}); err != nil {
+		s.logger().Warn("failed to count internal keys", "err", err)
+		n = 0
+	}
+	s.internalKeys = n
+}
+
+// trackInternal updates the number of internal keys by the log before it is applied. It must be
+// called with muDB locked.
+func (s *Storage) trackInternal(rlog *RecordLog) error {
+	if !s.internalKey(rlog.Key) {
+		return nil
+	}
+	_, err := s.db.Get(rlog.Key)
+	if err == ErrNotExist {
+		if rlog.Action != LDelete {
+			s.internalKeys++
+		}
+	} else if err != nil {
+		return err
+	} else if rlog.Action == LDelete {
+		s.internalKeys--
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestStorage_internalKeys(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	opts := Options{WALPath: testWALPath, DBPath: testDBPath}
+	storage, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { storage.Close() }()
+	if err = storage.autoCommit(func(txn *Txn) error {
+		for _, key := range []string{"key1", "key2", offsetPrefix + "feed", outboxPrefix + "feed/1"} {
+			if err := txn.Insert(key, []byte("value")); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	assertKeys := func(expected ...string) {
+		t.Helper()
+		txn := storage.NewTxn()
+		defer txn.Abort()
+		var keys []string
+		if err := txn.Scan("", func(key string, value []byte) error {
+			keys = append(keys, key)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		} else if len(keys) != len(expected) {
+			t.Errorf("scanned %q, expected %q", keys, expected)
+			return
+		}
+		for i := range keys {
+			if keys[i] != expected[i] {
+				t.Errorf("scanned %q, expected %q", keys, expected)
+				return
+			}
+		}
+		if key, _, err := txn.First(); err != nil || key != expected[0] {
+			t.Errorf("first %q %v", key, err)
+		}
+		storage.muDB.RLock()
+		n := storage.keyCount()
+		storage.muDB.RUnlock()
+		if n != len(expected) {
+			t.Errorf("%v keys, expected %v", n, len(expected))
+		}
+		if keys, _, err := storage.ScanKeys(scanStart, "", 10, nil); err != nil || len(keys) != len(expected) {
+			t.Errorf("ScanKeys %q %v", keys, err)
+		}
+	}
+	assertKeys("key1", "key2")
+
+	// internal keys are visible by their own prefix
+	txn := storage.NewTxn()
+	var n int
+	if err = txn.Scan(internalPrefix, func(key string, value []byte) error {
+		n++
+		return nil
+	}); err != nil || n != 2 {
+		t.Errorf("scanned %v internal keys : %v", n, err)
+	}
+	// internal keys written by the transaction are skipped too
+	if err = txn.Put(outboxPrefix+"feed/2", []byte("value")); err != nil {
+		t.Fatal(err)
+	} else if key, _, err := txn.First(); err != nil || key != "key1" {
+		t.Errorf("first %q %v", key, err)
+	} else if err = txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err = storage.Delete(outboxPrefix + "feed/1"); err != nil {
+		t.Fatal(err)
+	}
+	assertKeys("key1", "key2")
+
+	// internal keys are counted again after restart
+	if err = storage.Close(); err != nil {
+		t.Fatal(err)
+	} else if storage, err = Open(opts); err != nil {
+		t.Fatal(err)
+	}
+	assertKeys("key1", "key2")
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// histOp is the operation recorded in the history of concurrent clients. call and ret are the
+// logical times of the invocation and the response.
+type histOp struct {
+	client    int
+	call, ret int64
+	actions   []histAction
+}
+
+// histAction is the read or the write of the key by the operation in order. value of the read
+// is the value read, and value nil means the key does not exist. value nil of the write means
+// the deletion.
+type histAction struct {
+	key   string
+	write bool
+	value *string
+}
+
+func (a histAction) String() string {
+	op, v := "read", "<nil>"
+	if a.write {
+		op = "write"
+	}
+	if a.value != nil {
+		v = *a.value
+	}
+	return op + " " + a.key + "=" + v
+}
+
+// history records operations from concurrent clients.
+type history struct {
+	clock atomic.Int64
+	mu    sync.Mutex
+	ops   []histOp
+}
+
+// call returns the time of the invocation.
+func (h *history) call() int64 {
+	return h.clock.Add(1)
+}
+
+// record records the operation which is invoked at call and has returned now. Operations which
+// are aborted must not be recorded because they have no effect.
+func (h *history) record(client int, call int64, actions []histAction) {
+	ret := h.clock.Add(1)
+	h.mu.Lock()
+	h.ops = append(h.ops, histOp{client: client, call: call, ret: ret, actions: actions})
+	h.mu.Unlock()
+}
+
+// stepKV applies actions to the state of the KV model, and returns the new state if all reads
+// match the state. state is not modified.
+func stepKV(state map[string]string, actions []histAction) (map[string]string, bool) {
+	next, copied := state, false
+	for _, a := range actions {
+		v, ok := next[a.key]
+		if !a.write {
+			if ok != (a.value != nil) || (ok && v != *a.value) {
+				return nil, false
+			}
+			continue
+		}
+		if !copied {
+			next, copied = make(map[string]string, len(state)+1), true
+			for k, v := range state {
+				next[k] = v
+			}
+		}
+		if a.value == nil {
+			delete(next, a.key)
+		} else {
+			next[a.key] = *a.value
+		}
+	}
+	return next, true
+}
+
+func encodeKV(state map[string]string) string {
+	keys := make([]string, 0, len(state))
+	for k := range state {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%q=%q;", k, state[k])
+	}
+	return b.String()
+}
+
+// linEntry is the call or the return event of the operation in the linked list of the history.
+type linEntry struct {
+	id         int
+	call       bool
+	time       int64
+	match      *linEntry
+	prev, next *linEntry
+}
+
+// lift removes the call and its return from the list.
+func (e *linEntry) lift() {
+	e.prev.next = e.next
+	e.next.prev = e.prev
+	m := e.match
+	m.prev.next = m.next
+	if m.next != nil {
+		m.next.prev = m.prev
+	}
+}
+
+// unlift restores the call and its return removed by lift.
+func (e *linEntry) unlift() {
+	m := e.match
+	m.prev.next = m
+	if m.next != nil {
+		m.next.prev = m
+	}
+	e.prev.next = e
+	e.next.prev = e
+}
+
+// checkLinearizable checks that ops are linearizable against the KV model starting from the
+// empty state by the Wing & Gong search with memoization of linearized sets, which is the
+// algorithm of Porcupine. For operations of multiple keys, it checks strict serializability.
+func checkLinearizable(ops []histOp) bool {
+	events := make([]*linEntry, 0, 2*len(ops))
+	for i, op := range ops {
+		call := &linEntry{id: i, call: true, time: op.call}
+		ret := &linEntry{id: i, time: op.ret}
+		call.match = ret
+		events = append(events, call, ret)
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].time < events[j].time })
+	head := &linEntry{}
+	prev := head
+	for _, e := range events {
+		prev.next, e.prev = e, prev
+		prev = e
+	}
+
+	type frame struct {
+		entry *linEntry
+		state map[string]string
+	}
+	var (
+		stack      []frame
+		state      = map[string]string{}
+		linearized = make([]byte, (len(ops)+7)/8)
+		cache      = make(map[string]bool)
+		entry      = head.next
+	)
+	for head.next != nil {
+		if !entry.call {
+			// the operation returned before any remaining one is linearized. backtrack.
+			if len(stack) == 0 {
+				return false
+			}
+			top := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			entry, state = top.entry, top.state
+			linearized[entry.id/8] &^= 1 << (entry.id % 8)
+			entry.unlift()
+			entry = entry.next
+			continue
+		}
+		if next, ok := stepKV(state, ops[entry.id].actions); ok {
+			linearized[entry.id/8] |= 1 << (entry.id % 8)
+			if key := string(linearized) + encodeKV(next); !cache[key] {
+				cache[key] = true
+				stack = append(stack, frame{entry: entry, state: state})
+				state = next
+				entry.lift()
+				entry = head.next
+				continue
+			}
+			linearized[entry.id/8] &^= 1 << (entry.id % 8)
+		}
+		entry = entry.next
+	}
+	return true
+}
+
+// partitionByKey splits operations of single key by the key, which are checked independently.
+func partitionByKey(ops []histOp) map[string][]histOp {
+	parts := make(map[string][]histOp)
+	for _, op := range ops {
+		parts[op.actions[0].key] = append(parts[op.actions[0].key], op)
+	}
+	return parts
+}
+
+func dumpHistory(ops []histOp) string {
+	sorted := append([]histOp(nil), ops...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].call < sorted[j].call })
+	var b strings.Builder
+	for _, op := range sorted {
+		fmt.Fprintf(&b, "client %d [%d, %d] %v\n", op.client, op.call, op.ret, op.actions)
+	}
+	return b.String()
+}
+
+func strp(s string) *string {
+	return &s
+}
+
+func TestCheckLinearizable(t *testing.T) {
+	put := func(call, ret int64, key, value string) histOp {
+		return histOp{call: call, ret: ret, actions: []histAction{{key: key, write: true, value: strp(value)}}}
+	}
+	get := func(call, ret int64, key string, value *string) histOp {
+		return histOp{call: call, ret: ret, actions: []histAction{{key: key, value: value}}}
+	}
+	for _, tt := range []struct {
+		name string
+		ops  []histOp
+		ok   bool
+	}{
+		{"sequential", []histOp{put(1, 2, "x", "1"), get(3, 4, "x", strp("1"))}, true},
+		{"stale read", []histOp{put(1, 2, "x", "1"), get(3, 4, "x", nil)}, false},
+		{"concurrent read", []histOp{put(1, 4, "x", "1"), get(2, 3, "x", strp("1")), get(5, 6, "x", strp("1"))}, true},
+		{"read goes back", []histOp{put(1, 6, "x", "1"), get(2, 3, "x", strp("1")), get(4, 5, "x", nil)}, false},
+		{"lost update", []histOp{put(1, 2, "x", "1"), put(3, 4, "x", "2"), get(5, 6, "x", strp("1"))}, false},
+		{"write skew", []histOp{
+			{call: 1, ret: 3, actions: []histAction{{key: "x"}, {key: "y", write: true, value: strp("1")}}},
+			{call: 2, ret: 4, actions: []histAction{{key: "y"}, {key: "x", write: true, value: strp("1")}}},
+		}, false},
+		{"serial transactions", []histOp{
+			{call: 1, ret: 3, actions: []histAction{{key: "x"}, {key: "y", write: true, value: strp("1")}}},
+			{call: 2, ret: 4, actions: []histAction{{key: "y", value: strp("1")}, {key: "x", write: true, value: strp("1")}}},
+		}, true},
+	} {
+		if ok := checkLinearizable(tt.ops); ok != tt.ok {
+			t.Errorf("%s : %v, expected %v\n%s", tt.name, ok, tt.ok, dumpHistory(tt.ops))
+		}
+	}
+}
+
+func TestStorage_Linearizable(t *testing.T) {
+	storage := createTestStorage(t)
+	defer storage.wal.Close()
+	var (
+		h  history
+		wg sync.WaitGroup
+	)
+	for client := 0; client < 8; client++ {
+		wg.Add(1)
+		go func(client int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(int64(client)))
+			for i := 0; i < 50; i++ {
+				key := fmt.Sprintf("key%d", rnd.Intn(3))
+				call := h.call()
+				switch n := rnd.Intn(10); {
+				case n < 5:
+					v, err := storage.Get(key)
+					if err == ErrNotExist {
+						h.record(client, call, []histAction{{key: key}})
+					} else if err == nil {
+						h.record(client, call, []histAction{{key: key, value: strp(string(v))}})
+					}
+				case n < 8:
+					value := fmt.Sprintf("value%d-%d", client, i)
+					if err := storage.Put(key, []byte(value)); err == nil {
+						h.record(client, call, []histAction{{key: key, write: true, value: &value}})
+					}
+				default:
+					if err := storage.Delete(key); err == ErrNotExist {
+						h.record(client, call, []histAction{{key: key}})
+					} else if err == nil {
+						h.record(client, call, []histAction{{key: key, write: true}})
+					}
+				}
+			}
+		}(client)
+	}
+	wg.Wait()
+	for key, ops := range partitionByKey(h.ops) {
+		if !checkLinearizable(ops) {
+			t.Fatalf("history of %s is not linearizable\n%s", key, dumpHistory(ops))
+		}
+	}
+}
+
+func TestTxn_StrictSerializable(t *testing.T) {
+	storage := createTestStorage(t)
+	defer storage.wal.Close()
+	var (
+		h    history
+		wg   sync.WaitGroup
+		keys = []string{"key0", "key1", "key2", "key3"}
+	)
+	for client := 0; client < 6; client++ {
+		wg.Add(1)
+		go func(client int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(int64(client)))
+			txn := storage.NewTxn()
+			for i := 0; i < 30; i++ {
+				call := h.call()
+				var actions []histAction
+				// access keys in order not to deadlock without detection
+				err := func() error {
+					for _, key := range keys {
+						if rnd.Intn(2) == 0 {
+							continue
+						}
+						v, err := txn.Read(key)
+						if err == ErrNotExist {
+							actions = append(actions, histAction{key: key})
+						} else if err != nil {
+							return err
+						} else {
+							actions = append(actions, histAction{key: key, value: strp(string(v))})
+						}
+						switch rnd.Intn(4) {
+						case 0:
+							value := fmt.Sprintf("value%d-%d", client, i)
+							if err = txn.Put(key, []byte(value)); err != nil {
+								return err
+							}
+							actions = append(actions, histAction{key: key, write: true, value: &value})
+						case 1:
+							if err = txn.Delete(key); err == nil {
+								actions = append(actions, histAction{key: key, write: true})
+							} else if err != ErrNotExist {
+								return err
+							}
+						}
+					}
+					return txn.Commit()
+				}()
+				if err != nil {
+					if err != ErrDeadLock {
+						t.Errorf("client %d : %v", client, err)
+					}
+					txn.Abort()
+					continue
+				}
+				h.record(client, call, actions)
+			}
+		}(client)
+	}
+	wg.Wait()
+	if !checkLinearizable(h.ops) {
+		t.Fatalf("history is not strictly serializable\n%s", dumpHistory(h.ops))
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !darwin && !freebsd
+
+package main
+
+// lockFile does not lock the file because file locks are not supported on this platform.
+func lockFile(f File, exclusive bool) error {
+	return nil
+}
@@ -0,0 +1,24 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import "syscall"
+
+// lockFile locks the file by flock(2) without blocking, exclusively or shared. The lock is
+// released when the file is closed.
+func lockFile(f File, exclusive bool) error {
+	fd, ok := f.(interface{ Fd() uintptr })
+	if !ok {
+		// files of simulated file systems are not shared with other processes
+		return nil
+	}
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	err := syscall.Flock(int(fd.Fd()), how|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return ErrLocked
+	}
+	return err
+}
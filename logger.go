@@ -0,0 +1,80 @@
+package main
+
+import (
+	"log/slog"
+	"sync/atomic"
+)
+
+// Logger receives logs of the storage. args are alternating keys and values of fields like
+// slog, and *slog.Logger implements Logger.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// defaultLogger writes logs by slog.Default at each call, so that slog.SetDefault of the
+// application is respected.
+type defaultLogger struct{}
+
+func (defaultLogger) Debug(msg string, args ...any) { slog.Default().Debug(msg, args...) }
+func (defaultLogger) Info(msg string, args ...any)  { slog.Default().Info(msg, args...) }
+func (defaultLogger) Warn(msg string, args ...any)  { slog.Default().Warn(msg, args...) }
+func (defaultLogger) Error(msg string, args ...any) { slog.Default().Error(msg, args...) }
+
+// currentLogger is the Logger set by SetLogger.
+var currentLogger atomic.Pointer[Logger]
+
+// SetLogger routes logs of storages without Options.Logger to l. nil restores the default
+// logger of slog.
+func SetLogger(l Logger) {
+	if l == nil {
+		l = defaultLogger{}
+	}
+	currentLogger.Store(&l)
+}
+
+func logger() Logger {
+	if l := currentLogger.Load(); l != nil {
+		return *l
+	}
+	return defaultLogger{}
+}
+
+// storeLogger writes logs of the storage into Options.Logger, or the logger set by SetLogger if
+// it is nil, with the name of the storage if Options.Name is set. The zero value writes logs of
+// the storage without name.
+type storeLogger struct {
+	l    Logger
+	name string
+}
+
+func (l storeLogger) Debug(msg string, args ...any) { l.logger().Debug(msg, l.with(args)...) }
+func (l storeLogger) Info(msg string, args ...any)  { l.logger().Info(msg, l.with(args)...) }
+func (l storeLogger) Warn(msg string, args ...any)  { l.logger().Warn(msg, l.with(args)...) }
+func (l storeLogger) Error(msg string, args ...any) { l.logger().Error(msg, l.with(args)...) }
+
+func (l storeLogger) logger() Logger {
+	if l.l != nil {
+		return l.l
+	}
+	return logger()
+}
+
+func (l storeLogger) with(args []any) []any {
+	if l.name == "" {
+		return args
+	}
+	return append([]any{"store", l.name}, args...)
+}
+
+// logger returns the logger of the storage opened by opts.
+func (opts *Options) logger() Logger {
+	return storeLogger{l: opts.Logger, name: opts.Name}
+}
+
+// logger returns the logger of the storage.
+func (s *Storage) logger() Logger {
+	return s.opts.logger()
+}
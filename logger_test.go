@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// testLogger records messages and fields of logs.
+type testLogger struct {
+	mu   sync.Mutex
+	logs []string
+}
+
+func (l *testLogger) log(level, msg string, args ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.logs = append(l.logs, fmt.Sprint(level, " ", msg, args))
+}
+
+func (l *testLogger) Debug(msg string, args ...any) { l.log("DEBUG", msg, args...) }
+func (l *testLogger) Info(msg string, args ...any)  { l.log("INFO", msg, args...) }
+func (l *testLogger) Warn(msg string, args ...any)  { l.log("WARN", msg, args...) }
+func (l *testLogger) Error(msg string, args ...any) { l.log("ERROR", msg, args...) }
+
+func TestSetLogger(t *testing.T) {
+	l := &testLogger{}
+	SetLogger(l)
+	defer SetLogger(nil)
+
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	storage, err := Open(Options{WALPath: testWALPath, DBPath: testDBPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.wal.Close()
+	expected := []string{
+		"INFO loading data file[]",
+		"INFO db file is not found. this is initial start[]",
+		"INFO loading WAL file[]",
+	}
+	if fmt.Sprint(l.logs) != fmt.Sprint(expected) {
+		t.Errorf("logs not match %q, expected %q", l.logs, expected)
+	}
+
+	SetLogger(nil)
+	if _, ok := logger().(defaultLogger); !ok {
+		t.Errorf("logger is not restored : %T", logger())
+	}
+}
+
+func TestOpen_Named(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	var storages [2]*Storage
+	var loggers [2]testLogger
+	for i := range storages {
+		dir := filepath.Join(tmpdir, fmt.Sprint("store", i))
+		_ = os.MkdirAll(dir, 0777)
+		storage, err := Open(Options{
+			WALPath: filepath.Join(dir, "txngo.log"),
+			DBPath:  filepath.Join(dir, "txngo.db"),
+			Name:    fmt.Sprint("store", i),
+			Logger:  &loggers[i],
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		storages[i] = storage
+	}
+	if err := storages[0].Put("key", []byte("value0")); err != nil {
+		t.Fatal(err)
+	} else if err = storages[1].Put("key", []byte("value1")); err != nil {
+		t.Fatal(err)
+	} else if err = storages[1].Put("key2", []byte("value2")); err != nil {
+		t.Fatal(err)
+	}
+
+	var vars struct {
+		Stores map[string]map[string]interface{} `json:"stores"`
+	}
+	if err := json.Unmarshal([]byte(expvar.Get("txngo").String()), &vars); err != nil {
+		t.Fatal(err)
+	}
+	for i, storage := range storages {
+		name := fmt.Sprint("store", i)
+		if v := vars.Stores[name]["commits"]; v != float64(i+1) {
+			t.Errorf("commits of %v : %v", name, v)
+		}
+		txn := storage.NewTxn()
+		assertValue(t, txn, "key", []byte(fmt.Sprint("value", i)))
+		txn.Abort()
+		expected := fmt.Sprint("INFO loading data file[store ", name, "]")
+		if len(loggers[i].logs) == 0 || loggers[i].logs[0] != expected {
+			t.Errorf("logs of %v : %q", name, loggers[i].logs)
+		}
+	}
+
+	if err := storages[0].Close(); err != nil {
+		t.Fatal(err)
+	} else if expvarStores.Get("store0") != nil || expvarStores.Get("store1") == nil {
+		t.Errorf("expvar after close : %v", expvarStores)
+	} else if err = storages[1].Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,1018 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	sstableMagic  = 0x73737462 // "sstb"
+	manifestMagic = 0x6d616e66 // "manf"
+
+	// every sstableIndexInterval th entry is indexed in memory.
+	sstableIndexInterval = 16
+	sstableFooterSize    = 28
+
+	// compaction is triggered when level 0 have lsmL0Tables tables or
+	// level n (n >= 1) is larger than lsmLevelBase * 10^(n-1).
+	lsmL0Tables  = 4
+	lsmLevelBase = 8 << 20
+
+	// Put flushes memtables by itself when background flush can not keep up with.
+	lsmMaxImmutables = 4
+
+	// lsmMemtableSize is the default size of memtable to be flushed.
+	lsmMemtableSize = 4 << 20
+)
+
+var ErrBrokenTable = errors.New("sstable is broken")
+
+// lsmEntry is a record or a tombstone of deleted record.
+type lsmEntry struct {
+	Record
+	deleted bool
+	// pointer is true if Value is the encoded valuePointer of the value in value log.
+	pointer bool
+}
+
+const (
+	entryDeleted = 1 << iota
+	entryPointer
+)
+
+func (e *lsmEntry) size() int {
+	return 14 + len(e.Key) + len(e.Value)
+}
+
+// memtable is the mutable in-memory table of entries sorted by skiplist.
+type memtable struct {
+	list *skiplist
+	size int
+}
+
+func newMemtable() *memtable {
+	return &memtable{list: newSkiplist()}
+}
+
+type indexEntry struct {
+	key    string
+	offset int64
+}
+
+// sstable is an immutable sorted file of entries.
+type sstable struct {
+	num     uint64
+	path    string
+	f       File
+	size    int64
+	count   uint64
+	index   []indexEntry
+	dataEnd int64
+	// bloom skips reading the file for the key not in the table.
+	bloom *bloomFilter
+}
+
+// entry layout : keyLen(1) | key | version(8) | flags(1) | valueLen(4) | value
+func writeEntry(w io.Writer, e *lsmEntry) (int, error) {
+	var hdr [1 + 255 + 13]byte
+	hdr[0] = uint8(len(e.Key))
+	n := 1 + copy(hdr[1:], e.Key)
+	binary.BigEndian.PutUint64(hdr[n:], e.Version)
+	if e.deleted {
+		hdr[n+8] |= entryDeleted
+	}
+	if e.pointer {
+		hdr[n+8] |= entryPointer
+	}
+	binary.BigEndian.PutUint32(hdr[n+9:], uint32(len(e.Value)))
+	if _, err := w.Write(hdr[:n+13]); err != nil {
+		return 0, err
+	} else if _, err = w.Write(e.Value); err != nil {
+		return 0, err
+	}
+	return n + 13 + len(e.Value), nil
+}
+
+func readEntry(r *bufio.Reader, e *lsmEntry) (int, error) {
+	keyLen, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	var buf [255 + 13]byte
+	if _, err = io.ReadFull(r, buf[:int(keyLen)+13]); err != nil {
+		return 0, ErrBrokenTable
+	}
+	e.Key = string(buf[:keyLen])
+	e.Version = binary.BigEndian.Uint64(buf[keyLen:])
+	e.deleted = buf[keyLen+8]&entryDeleted != 0
+	e.pointer = buf[keyLen+8]&entryPointer != 0
+	valueLen := binary.BigEndian.Uint32(buf[keyLen+9:])
+	e.Value = make([]byte, valueLen)
+	if _, err = io.ReadFull(r, e.Value); err != nil {
+		return 0, ErrBrokenTable
+	}
+	return 1 + int(keyLen) + 13 + int(valueLen), nil
+}
+
+// GCStats is the statistics of garbage collection of tombstones.
+type GCStats struct {
+	// Tombstones is the number of dropped tombstones.
+	Tombstones int64
+	// ReclaimedBytes is the size of table files reclaimed by dropping tombstones and shadowed entries.
+	ReclaimedBytes int64
+}
+
+func (s *GCStats) add(o GCStats) {
+	s.Tombstones += o.Tombstones
+	s.ReclaimedBytes += o.ReclaimedBytes
+}
+
+// writeTable writes all entries from iter into new sstable file created by fs.
+// tombstones whose version is older than horizon are dropped and counted in stats.
+// if vlog is not nil, large values are appended to vlog and the pointers are written instead.
+func writeTable(fs FS, num uint64, path string, iter lsmIter, horizon uint64, stats *GCStats, vlog *valueLog) (*sstable, error) {
+	f, err := createFile(fs, path)
+	if err != nil {
+		return nil, err
+	}
+	t := &sstable{num: num, path: path, f: f}
+	w := bufio.NewWriter(f)
+	var hashes []uint64
+	for {
+		var (
+			ok bool
+			n  int
+		)
+		if ok, err = iter.next(); err != nil {
+			goto ERROR
+		} else if !ok {
+			break
+		}
+		e := iter.entry()
+		if e.deleted && e.Version < horizon {
+			stats.Tombstones++
+			continue
+		}
+		if vlog != nil && !e.deleted && !e.pointer && len(e.Value) > vlogThreshold {
+			var p valuePointer
+			if p, err = vlog.append(e.Value); err != nil {
+				goto ERROR
+			}
+			pe := *e
+			pe.Value, pe.pointer = p.encode(), true
+			e = &pe
+		}
+		if t.count%sstableIndexInterval == 0 {
+			t.index = append(t.index, indexEntry{key: e.Key, offset: t.dataEnd})
+		}
+		if n, err = writeEntry(w, e); err != nil {
+			goto ERROR
+		}
+		t.dataEnd += int64(n)
+		t.count++
+		hashes = append(hashes, hashKey(e.Key))
+	}
+
+	// write index, bloom filter and footer
+	t.size = t.dataEnd
+	for _, idx := range t.index {
+		var buf [1 + 255 + 8]byte
+		buf[0] = uint8(len(idx.key))
+		n := 1 + copy(buf[1:], idx.key)
+		binary.BigEndian.PutUint64(buf[n:], uint64(idx.offset))
+		if _, err = w.Write(buf[:n+8]); err != nil {
+			goto ERROR
+		}
+		t.size += int64(n + 8)
+	}
+	t.bloom = newBloomFilter(hashes, bloomBitsPerKey)
+	{
+		bloom := t.bloom.serialize()
+		if _, err = w.Write(bloom); err != nil {
+			goto ERROR
+		}
+		t.size += int64(len(bloom))
+
+		var footer [sstableFooterSize]byte
+		binary.BigEndian.PutUint64(footer[0:8], uint64(t.dataEnd))
+		binary.BigEndian.PutUint64(footer[8:16], t.count)
+		binary.BigEndian.PutUint32(footer[16:20], uint32(len(t.index)))
+		binary.BigEndian.PutUint32(footer[20:24], uint32(len(bloom)))
+		binary.BigEndian.PutUint32(footer[24:28], sstableMagic)
+		if _, err = w.Write(footer[:]); err != nil {
+			goto ERROR
+		}
+		t.size += sstableFooterSize
+	}
+	if err = w.Flush(); err != nil {
+		goto ERROR
+	} else if err = f.Sync(); err != nil {
+		goto ERROR
+	}
+	// values must be durable before the table refers them
+	if vlog != nil {
+		if err = vlog.sync(); err != nil {
+			goto ERROR
+		}
+	}
+	return t, nil
+
+ERROR:
+	f.Close()
+	if rerr := fs.Remove(path); rerr != nil {
+		err = fmt.Errorf("%w (failed to remove broken sstable : %v)", err, rerr)
+	}
+	return nil, err
+}
+
+func openTable(fs FS, num uint64, path string) (*sstable, error) {
+	f, err := openFile(fs, path)
+	if err != nil {
+		return nil, err
+	}
+	t := &sstable{num: num, path: path, f: f}
+	if err = t.readIndex(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *sstable) readIndex() error {
+	info, err := t.f.Stat()
+	if err != nil {
+		return err
+	}
+	t.size = info.Size()
+	if t.size < sstableFooterSize {
+		return ErrBrokenTable
+	}
+	var footer [sstableFooterSize]byte
+	if _, err = t.f.ReadAt(footer[:], t.size-sstableFooterSize); err != nil {
+		return err
+	} else if binary.BigEndian.Uint32(footer[24:28]) != sstableMagic {
+		return ErrBrokenTable
+	}
+	t.dataEnd = int64(binary.BigEndian.Uint64(footer[0:8]))
+	t.count = binary.BigEndian.Uint64(footer[8:16])
+	nindex := int(binary.BigEndian.Uint32(footer[16:20]))
+	bloomStart := t.size - sstableFooterSize - int64(binary.BigEndian.Uint32(footer[20:24]))
+	if t.dataEnd > bloomStart {
+		return ErrBrokenTable
+	}
+
+	bloom := make([]byte, t.size-sstableFooterSize-bloomStart)
+	if _, err = t.f.ReadAt(bloom, bloomStart); err != nil {
+		return err
+	} else if t.bloom, err = deserializeBloomFilter(bloom); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(t.f, t.dataEnd, bloomStart-t.dataEnd))
+	t.index = make([]indexEntry, nindex)
+	for i := range t.index {
+		keyLen, err := r.ReadByte()
+		if err != nil {
+			return ErrBrokenTable
+		}
+		var buf [255 + 8]byte
+		if _, err = io.ReadFull(r, buf[:int(keyLen)+8]); err != nil {
+			return ErrBrokenTable
+		}
+		t.index[i] = indexEntry{
+			key:    string(buf[:keyLen]),
+			offset: int64(binary.BigEndian.Uint64(buf[keyLen:])),
+		}
+	}
+	return nil
+}
+
+// seek returns the iterator of entries not less than the key.
+func (t *sstable) seek(key string) *tableIter {
+	// find the last indexed key which is not greater than the key
+	i := sort.Search(len(t.index), func(i int) bool { return t.index[i].key > key })
+	var offset int64
+	if i > 0 {
+		offset = t.index[i-1].offset
+	}
+	return &tableIter{
+		r:    bufio.NewReader(io.NewSectionReader(t.f, offset, t.dataEnd-offset)),
+		from: key,
+	}
+}
+
+func (t *sstable) get(key string) (*lsmEntry, error) {
+	if len(t.index) == 0 || key < t.index[0].key {
+		return nil, nil
+	} else if !t.bloom.mayContain(hashKey(key)) {
+		return nil, nil
+	}
+	iter := t.seek(key)
+	if ok, err := iter.next(); err != nil || !ok {
+		return nil, err
+	}
+	if e := iter.entry(); e.Key == key {
+		return e, nil
+	}
+	return nil, nil
+}
+
+func (t *sstable) close() error {
+	return t.f.Close()
+}
+
+// lsmIter iterates entries in key order.
+type lsmIter interface {
+	// next advances the iterator and returns false at the end.
+	next() (bool, error)
+	entry() *lsmEntry
+}
+
+type tableIter struct {
+	r    *bufio.Reader
+	from string
+	e    lsmEntry
+}
+
+func (it *tableIter) next() (bool, error) {
+	for {
+		if _, err := readEntry(it.r, &it.e); err == io.EOF {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		if it.e.Key >= it.from {
+			return true, nil
+		}
+	}
+}
+
+func (it *tableIter) entry() *lsmEntry {
+	return &it.e
+}
+
+// mergeIter merges iterators. iters are ordered from the newest and the newest entry of
+// the same key is returned.
+type mergeIter struct {
+	iters []lsmIter
+	valid []bool
+	init  bool
+	cur   *lsmEntry
+}
+
+func (it *mergeIter) next() (bool, error) {
+	if !it.init {
+		it.valid = make([]bool, len(it.iters))
+		for i, iter := range it.iters {
+			ok, err := iter.next()
+			if err != nil {
+				return false, err
+			}
+			it.valid[i] = ok
+		}
+		it.init = true
+	} else if it.cur != nil {
+		// advance all iterators on the current key
+		key := it.cur.Key
+		for i, iter := range it.iters {
+			for it.valid[i] && iter.entry().Key == key {
+				ok, err := iter.next()
+				if err != nil {
+					return false, err
+				}
+				it.valid[i] = ok
+			}
+		}
+	}
+
+	it.cur = nil
+	for i, iter := range it.iters {
+		if it.valid[i] && (it.cur == nil || iter.entry().Key < it.cur.Key) {
+			it.cur = iter.entry()
+		}
+	}
+	if it.cur == nil {
+		return false, nil
+	}
+	// copy entry because the entry of iterator is overwritten when it advances
+	e := *it.cur
+	it.cur = &e
+	return true, nil
+}
+
+func (it *mergeIter) entry() *lsmEntry {
+	return it.cur
+}
+
+// LSM is the log-structured merge-tree engine. Mutations are kept in memtable and
+// full memtables are flushed into sorted table files in background. Tables are merged
+// into deeper levels by background compaction.
+type LSM struct {
+	dir string
+	// fs opens tables, the manifest and the value log in dir.
+	fs           FS
+	memtableSize int
+
+	// memtable is protected by Storage.muDB
+	mem *memtable
+
+	// mu protects immutables, levels and files of tables
+	mu         sync.RWMutex
+	immutables []*memtable
+	// levels[0] is ordered from the newest and the tables may overlap.
+	// levels[n] (n >= 1) have at most one table.
+	levels  [][]*sstable
+	nextNum uint64
+	version uint64
+	vlog    *valueLog
+	// gcStats is the total statistics of dropped tombstones.
+	gcStats GCStats
+
+	// flushMu serializes flushes and compactions
+	flushMu sync.Mutex
+	chFlush chan struct{}
+	chDone  chan struct{}
+	bgErr   error
+	// readOnly keeps files of tables not listed in manifest at Load.
+	readOnly bool
+	// log receives logs of the storage, including failures of the background.
+	log Logger
+}
+
+func newLSM(dir string, memtableSize int, log Logger) *LSM {
+	l := &LSM{
+		log:          log,
+		dir:          dir,
+		fs:           osFS{},
+		memtableSize: memtableSize,
+		mem:          newMemtable(),
+		levels:       make([][]*sstable, 1),
+		nextNum:      1,
+		vlog:         &valueLog{path: filepath.Join(dir, "values.vlog"), fs: osFS{}},
+		chFlush:      make(chan struct{}, 1),
+		chDone:       make(chan struct{}),
+	}
+	go l.background()
+	return l
+}
+
+func (l *LSM) tablePath(num uint64) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%06d.sst", num))
+}
+
+func (l *LSM) manifestPath() string {
+	return filepath.Join(l.dir, "MANIFEST")
+}
+
+func (l *LSM) Get(key string) (Record, error) {
+	return l.get(key, nil)
+}
+
+// get returns the record of the latest entry of the key. The value in value log is read into
+// buf if it is not nil.
+func (l *LSM) get(key string, buf *[]byte) (Record, error) {
+	if e, ok := l.mem.list.get(key); ok {
+		return l.result(&e, buf)
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for i := len(l.immutables) - 1; i >= 0; i-- {
+		if e, ok := l.immutables[i].list.get(key); ok {
+			return l.result(&e, buf)
+		}
+	}
+	for _, tables := range l.levels {
+		for _, t := range tables {
+			e, err := t.get(key)
+			if err != nil {
+				return Record{}, err
+			} else if e != nil {
+				return l.result(e, buf)
+			}
+		}
+	}
+	return Record{}, ErrNotExist
+}
+
+// result returns the record of the entry, reading the value from value log into buf if needed.
+func (l *LSM) result(e *lsmEntry, buf *[]byte) (Record, error) {
+	if e.deleted {
+		return Record{}, ErrNotExist
+	} else if !e.pointer {
+		return e.Record, nil
+	}
+	p, err := decodeValuePointer(e.Value)
+	if err != nil {
+		return Record{}, err
+	}
+	r := e.Record
+	if r.Value, err = l.vlog.readInto(p, buf); err != nil {
+		return Record{}, err
+	}
+	return r, nil
+}
+
+func (l *LSM) set(e lsmEntry) error {
+	if old, ok := l.mem.list.set(e); ok {
+		l.mem.size -= old.size()
+	}
+	l.mem.size += e.size()
+	if l.mem.size < l.memtableSize {
+		return nil
+	}
+
+	// switch to new memtable and flush in background
+	l.mu.Lock()
+	l.immutables = append(l.immutables, l.mem)
+	nimmutables := len(l.immutables)
+	l.mu.Unlock()
+	l.mem = newMemtable()
+	if nimmutables >= lsmMaxImmutables {
+		return l.flush()
+	}
+	select {
+	case l.chFlush <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (l *LSM) Put(r Record) error {
+	return l.set(lsmEntry{Record: r})
+}
+
+func (l *LSM) Delete(key string) error {
+	return l.DeleteVersion(key, 0)
+}
+
+// DeleteVersion writes the tombstone of the key deleted by the commit version.
+func (l *LSM) DeleteVersion(key string, version uint64) error {
+	return l.set(lsmEntry{Record: Record{Key: key, Version: version}, deleted: true})
+}
+
+func (l *LSM) Len() int {
+	var count int
+	_ = l.Keys("", func(string) bool {
+		count++
+		return true
+	})
+	return count
+}
+
+func (l *LSM) Keys(prefix string, fn func(key string) bool) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	iters := []lsmIter{l.mem.list.seek(prefix)}
+	for i := len(l.immutables) - 1; i >= 0; i-- {
+		iters = append(iters, l.immutables[i].list.seek(prefix))
+	}
+	for _, tables := range l.levels {
+		for _, t := range tables {
+			iters = append(iters, t.seek(prefix))
+		}
+	}
+
+	iter := &mergeIter{iters: iters}
+	for {
+		ok, err := iter.next()
+		if err != nil {
+			return err
+		} else if !ok {
+			return nil
+		}
+		e := iter.entry()
+		if !strings.HasPrefix(e.Key, prefix) {
+			return nil
+		} else if e.deleted {
+			continue
+		}
+		if !fn(e.Key) {
+			return nil
+		}
+	}
+}
+
+// flush writes all immutable memtables into level 0 tables.
+func (l *LSM) flush() error {
+	l.flushMu.Lock()
+	defer l.flushMu.Unlock()
+	for {
+		l.mu.Lock()
+		if len(l.immutables) == 0 {
+			l.mu.Unlock()
+			return nil
+		}
+		m := l.immutables[0]
+		num := l.nextNum
+		l.nextNum++
+		l.mu.Unlock()
+
+		if err := l.fs.MkdirAll(l.dir, 0700); err != nil {
+			return err
+		}
+		t, err := writeTable(l.fs, num, l.tablePath(num), m.list.seek(""), 0, &GCStats{}, l.vlog)
+		if err != nil {
+			return err
+		}
+
+		l.mu.Lock()
+		l.immutables = l.immutables[1:]
+		l.levels[0] = append([]*sstable{t}, l.levels[0]...)
+		err = l.writeManifest()
+		l.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// compact merges a level into the next level if needed.
+func (l *LSM) compact() error {
+	l.flushMu.Lock()
+	defer l.flushMu.Unlock()
+	for {
+		l.mu.Lock()
+		level := -1
+		if len(l.levels[0]) >= lsmL0Tables {
+			level = 0
+		} else {
+			limit := int64(lsmLevelBase)
+			for i := 1; i < len(l.levels); i++ {
+				if len(l.levels[i]) > 0 && l.levels[i][0].size > limit {
+					level = i
+					break
+				}
+				limit *= 10
+			}
+		}
+		if level < 0 {
+			l.mu.Unlock()
+			return nil
+		}
+		inputs := append([]*sstable(nil), l.levels[level]...)
+		if level+1 < len(l.levels) {
+			inputs = append(inputs, l.levels[level+1]...)
+		}
+		// tombstones are not needed if there are no deeper tables
+		horizon := uint64(math.MaxUint64)
+		for i := level + 2; i < len(l.levels); i++ {
+			if len(l.levels[i]) > 0 {
+				horizon = 0
+			}
+		}
+		num := l.nextNum
+		l.nextNum++
+		l.mu.Unlock()
+
+		var iters []lsmIter
+		for _, t := range inputs {
+			iters = append(iters, t.seek(""))
+		}
+		var stats GCStats
+		t, err := writeTable(l.fs, num, l.tablePath(num), &mergeIter{iters: iters}, horizon, &stats, nil)
+		if err != nil {
+			return err
+		}
+
+		l.mu.Lock()
+		if stats.Tombstones > 0 {
+			stats.ReclaimedBytes = tablesSize(inputs) - t.size
+			l.gcStats.add(stats)
+		}
+		// level 0 may have new flushed tables
+		l.levels[level] = removeTables(l.levels[level], inputs)
+		if level+1 == len(l.levels) {
+			l.levels = append(l.levels, nil)
+		}
+		l.levels[level+1] = []*sstable{t}
+		err = l.writeManifest()
+		l.mu.Unlock()
+		if err != nil {
+			return err
+		}
+
+		for _, t := range inputs {
+			t.close()
+			if err = l.fs.Remove(t.path); err != nil {
+				l.log.Error("failed to remove compacted sstable", "err", err)
+			}
+		}
+	}
+}
+
+// GC merges all tables into the bottom level and drops tombstones whose version is older than
+// horizon, which is the version of the oldest active snapshot. Tombstones in memtables are
+// collected after they are flushed.
+func (l *LSM) GC(horizon uint64) (GCStats, error) {
+	l.flushMu.Lock()
+	defer l.flushMu.Unlock()
+
+	l.mu.Lock()
+	var inputs []*sstable
+	for _, tables := range l.levels {
+		inputs = append(inputs, tables...)
+	}
+	if len(inputs) == 0 {
+		l.mu.Unlock()
+		return GCStats{}, nil
+	}
+	num := l.nextNum
+	l.nextNum++
+	l.mu.Unlock()
+
+	// inputs are ordered from the newest
+	var iters []lsmIter
+	for _, t := range inputs {
+		iters = append(iters, t.seek(""))
+	}
+	var stats GCStats
+	t, err := writeTable(l.fs, num, l.tablePath(num), &mergeIter{iters: iters}, horizon, &stats, nil)
+	if err != nil {
+		return GCStats{}, err
+	}
+
+	l.mu.Lock()
+	stats.ReclaimedBytes = tablesSize(inputs) - t.size
+	l.gcStats.add(stats)
+	// level 0 may have new flushed tables which are newer than the merged table
+	l.levels[0] = removeTables(l.levels[0], inputs)
+	bottom := len(l.levels) - 1
+	if bottom == 0 {
+		l.levels = append(l.levels, nil)
+		bottom = 1
+	}
+	for i := 1; i < bottom; i++ {
+		l.levels[i] = nil
+	}
+	l.levels[bottom] = []*sstable{t}
+	err = l.writeManifest()
+	l.mu.Unlock()
+	if err != nil {
+		return GCStats{}, err
+	}
+
+	for _, t := range inputs {
+		t.close()
+		if err = l.fs.Remove(t.path); err != nil {
+			l.log.Error("failed to remove collected sstable", "err", err)
+		}
+	}
+	return stats, nil
+}
+
+// GCStats returns the total statistics of tombstones dropped by GC and compaction.
+func (l *LSM) GCStats() GCStats {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.gcStats
+}
+
+func tablesSize(tables []*sstable) int64 {
+	var size int64
+	for _, t := range tables {
+		size += t.size
+	}
+	return size
+}
+
+func removeTables(tables, inputs []*sstable) []*sstable {
+	var result []*sstable
+	for _, t := range tables {
+		found := false
+		for _, in := range inputs {
+			if t == in {
+				found = true
+			}
+		}
+		if !found {
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+func (l *LSM) background() {
+	for range l.chFlush {
+		if err := l.flush(); err != nil {
+			l.log.Error("failed to flush memtable", "err", err)
+			l.mu.Lock()
+			l.bgErr = err
+			l.mu.Unlock()
+		} else if err = l.compact(); err != nil {
+			l.log.Error("failed to compact sstables", "err", err)
+			l.mu.Lock()
+			l.bgErr = err
+			l.mu.Unlock()
+		}
+	}
+	close(l.chDone)
+}
+
+// writeManifest writes the list of tables atomically. l.mu must be locked.
+func (l *LSM) writeManifest() error {
+	var buf []byte
+	buf = appendUint32(buf, manifestMagic)
+	buf = appendUint64(buf, l.version)
+	buf = appendUint64(buf, l.nextNum)
+	buf = appendUint32(buf, uint32(len(l.levels)))
+	for _, tables := range l.levels {
+		buf = appendUint32(buf, uint32(len(tables)))
+		for _, t := range tables {
+			buf = appendUint64(buf, t.num)
+		}
+	}
+	buf = appendUint32(buf, crc32.ChecksumIEEE(buf))
+
+	return writeFileAtomic(l.fs, l.manifestPath(), l.manifestPath()+".tmp", buf)
+}
+
+// Save flushes the memtable and records the commit version in the manifest.
+func (l *LSM) Save(version uint64) error {
+	l.mu.Lock()
+	if err := l.bgErr; err != nil {
+		l.mu.Unlock()
+		return err
+	}
+	if l.mem.list.len() > 0 {
+		l.immutables = append(l.immutables, l.mem)
+		l.mem = newMemtable()
+	}
+	l.mu.Unlock()
+
+	if err := l.flush(); err != nil {
+		return err
+	} else if err = l.fs.MkdirAll(l.dir, 0700); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.version = version
+	return l.writeManifest()
+}
+
+// Load opens tables listed in the manifest and removes tables not listed.
+func (l *LSM) Load() (uint64, error) {
+	buf, err := readFile(l.fs, l.manifestPath())
+	if err != nil {
+		return 0, err
+	}
+	if len(buf) < 28 || binary.BigEndian.Uint32(buf) != manifestMagic {
+		return 0, fmt.Errorf("manifest is broken")
+	} else if binary.BigEndian.Uint32(buf[len(buf)-4:]) != crc32.ChecksumIEEE(buf[:len(buf)-4]) {
+		return 0, ErrChecksum
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.version = binary.BigEndian.Uint64(buf[4:12])
+	l.nextNum = binary.BigEndian.Uint64(buf[12:20])
+	nlevels := int(binary.BigEndian.Uint32(buf[20:24]))
+	p := 24
+	listed := make(map[string]bool)
+	l.levels = make([][]*sstable, nlevels)
+	for i := 0; i < nlevels; i++ {
+		if p+4 > len(buf)-4 {
+			return 0, fmt.Errorf("manifest is broken")
+		}
+		ntables := int(binary.BigEndian.Uint32(buf[p:]))
+		p += 4
+		for j := 0; j < ntables; j++ {
+			if p+8 > len(buf)-4 {
+				return 0, fmt.Errorf("manifest is broken")
+			}
+			num := binary.BigEndian.Uint64(buf[p:])
+			p += 8
+			t, err := openTable(l.fs, num, l.tablePath(num))
+			if err != nil {
+				return 0, err
+			}
+			l.levels[i] = append(l.levels[i], t)
+			listed[filepath.Base(t.path)] = true
+		}
+	}
+	if len(l.levels) == 0 {
+		l.levels = make([][]*sstable, 1)
+	}
+
+	if l.readOnly {
+		return l.version, nil
+	}
+
+	// remove tables which are written but not listed in manifest by crash
+	entries, err := l.fs.ReadDir(l.dir)
+	if err != nil {
+		return 0, err
+	}
+	for _, entry := range entries {
+		if name := entry.Name(); filepath.Ext(name) == ".sst" && !listed[name] {
+			if err = l.fs.Remove(filepath.Join(l.dir, name)); err != nil {
+				l.log.Error("failed to remove unused sstable", "err", err)
+			}
+		}
+	}
+	return l.version, nil
+}
+
+func (l *LSM) Close() error {
+	close(l.chFlush)
+	<-l.chDone
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, tables := range l.levels {
+		for _, t := range tables {
+			t.close()
+		}
+	}
+	return l.vlog.close()
+}
+
+// Verify reads all entries of all tables, and checks the order of keys, the sparse index, the
+// bloom filter, the count in the footer and values in value log.
+func (l *LSM) Verify(ctx context.Context, problem func(VerifyProblem)) (int, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	var ntables int
+	for level, tables := range l.levels {
+		for _, t := range tables {
+			if err := ctx.Err(); err != nil {
+				return ntables, err
+			}
+			t.verify(l.vlog, func(key, format string, args ...interface{}) {
+				problem(VerifyProblem{Check: "lsm", Key: key, Detail: fmt.Sprintf("level %d table %06d : ", level, t.num) + fmt.Sprintf(format, args...)})
+			})
+			ntables++
+		}
+	}
+	return ntables, nil
+}
+
+// verify reads entries of the table sequentially and cross-checks them with the index and the footer.
+func (t *sstable) verify(vlog *valueLog, report func(key, format string, args ...interface{})) {
+	var (
+		r      = bufio.NewReader(io.NewSectionReader(t.f, 0, t.dataEnd))
+		e      lsmEntry
+		prev   string
+		offset int64
+		count  uint64
+	)
+	for ; ; count++ {
+		n, err := readEntry(r, &e)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			report("", "failed to read entry at offset %d : %v", offset, err)
+			return
+		}
+		if count > 0 && e.Key <= prev {
+			report(e.Key, "key is not greater than previous key %q", prev)
+		}
+		if count%sstableIndexInterval == 0 {
+			if i := int(count / sstableIndexInterval); i >= len(t.index) {
+				report(e.Key, "entry %d is not indexed", count)
+			} else if idx := t.index[i]; idx.key != e.Key || idx.offset != offset {
+				report(e.Key, "index %d points %q at offset %d, but entry at offset %d", i, idx.key, idx.offset, offset)
+			}
+		}
+		if !t.bloom.mayContain(hashKey(e.Key)) {
+			report(e.Key, "bloom filter does not contain key")
+		}
+		if e.pointer {
+			if p, err := decodeValuePointer(e.Value); err != nil {
+				report(e.Key, "broken value pointer : %v", err)
+			} else if _, err = vlog.read(p); err != nil {
+				report(e.Key, "failed to read value log : %v", err)
+			}
+		}
+		prev = e.Key
+		offset += int64(n)
+	}
+	if count != t.count {
+		report("", "table has %d entries, but footer counts %d", count, t.count)
+	} else if want := int((count + sstableIndexInterval - 1) / sstableIndexInterval); len(t.index) != want {
+		report("", "index has %d entries, expected %d", len(t.index), want)
+	}
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	return append(buf, b[:]...)
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	return append(buf, b[:]...)
+}
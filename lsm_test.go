@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func createTestLSM(t *testing.T, memtableSize int) *LSM {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	return newLSM(testDBPath, memtableSize, storeLogger{})
+}
+
+func assertEngine(t *testing.T, e Backend, expected map[string][]byte) {
+	t.Helper()
+	for k, v := range expected {
+		if r, err := e.Get(k); err != nil {
+			t.Fatalf("failed to get %q : %v", k, err)
+		} else if !bytes.Equal(r.Value, v) {
+			t.Fatalf("value for %q not match %v, expected %v", k, r.Value, v)
+		}
+	}
+	var keys, expectedKeys []string
+	for k := range expected {
+		expectedKeys = append(expectedKeys, k)
+	}
+	sort.Strings(expectedKeys)
+	if err := e.Keys("", func(key string) bool {
+		keys = append(keys, key)
+		return true
+	}); err != nil {
+		t.Fatalf("failed to iterate keys : %v", err)
+	}
+	// the order of keys depends on the engine
+	sort.Strings(keys)
+	if fmt.Sprint(keys) != fmt.Sprint(expectedKeys) {
+		t.Fatalf("keys not match %v, expected %v", len(keys), len(expectedKeys))
+	}
+}
+
+func TestLSM(t *testing.T) {
+	lsm := createTestLSM(t, 4096)
+	defer func() { lsm.Close() }()
+
+	rnd := rand.New(rand.NewSource(1))
+	expected := make(map[string][]byte)
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 3000; i++ {
+			key := fmt.Sprintf("key%05d", rnd.Intn(2000))
+			if rnd.Intn(3) == 0 {
+				if err := lsm.Delete(key); err != nil {
+					t.Fatalf("failed to delete %q : %v", key, err)
+				}
+				delete(expected, key)
+				continue
+			}
+			value := []byte(fmt.Sprintf("value%v-%v", round, i))
+			if err := lsm.Put(Record{Key: key, Value: value}); err != nil {
+				t.Fatalf("failed to put %q : %v", key, err)
+			}
+			expected[key] = value
+		}
+		assertEngine(t, lsm, expected)
+		if _, err := lsm.Get("not exist"); err != ErrNotExist {
+			t.Errorf("not existing key is not (not exist) : %v", err)
+		}
+
+		if err := lsm.Save(uint64(round)); err != nil {
+			t.Fatalf("failed to save : %v", err)
+		}
+		if err := lsm.compact(); err != nil {
+			t.Fatalf("failed to compact : %v", err)
+		}
+		if len(lsm.levels) < 2 {
+			t.Errorf("tables are not compacted into deeper level")
+		}
+		if len(lsm.levels[0]) >= lsmL0Tables {
+			t.Errorf("level 0 is not compacted : %v tables", len(lsm.levels[0]))
+		}
+		assertEngine(t, lsm, expected)
+
+		// reopen
+		lsm.Close()
+		lsm = newLSM(testDBPath, 4096, storeLogger{})
+		if version, err := lsm.Load(); err != nil {
+			t.Fatalf("failed to load : %v", err)
+		} else if version != uint64(round) {
+			t.Errorf("version not match %v, expected %v", version, round)
+		}
+		assertEngine(t, lsm, expected)
+	}
+}
+
+func TestLSM_Load(t *testing.T) {
+	lsm := createTestLSM(t, 4096)
+	if _, err := lsm.Load(); !os.IsNotExist(err) {
+		t.Errorf("manifest unexpectedly exists : %v", err)
+	}
+	if err := lsm.Put(Record{Key: "key1", Value: []byte("value1")}); err != nil {
+		t.Fatalf("failed to put : %v", err)
+	}
+	if err := lsm.Save(1); err != nil {
+		t.Fatalf("failed to save : %v", err)
+	}
+	lsm.Close()
+
+	// table not listed in manifest by crash
+	orphan := filepath.Join(testDBPath, "999999.sst")
+	if err := os.WriteFile(orphan, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	lsm = newLSM(testDBPath, 4096, storeLogger{})
+	defer lsm.Close()
+	if _, err := lsm.Load(); err != nil {
+		t.Fatalf("failed to load : %v", err)
+	}
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Errorf("orphan table is not removed : %v", err)
+	}
+	assertEngine(t, lsm, map[string][]byte{"key1": []byte("value1")})
+}
+
+func TestLSM_Bloom(t *testing.T) {
+	lsm := createTestLSM(t, 1<<20)
+	defer func() { lsm.Close() }()
+	for i := 0; i < 1000; i++ {
+		if err := lsm.Put(Record{Key: fmt.Sprintf("key%04d", i), Value: []byte("v")}); err != nil {
+			t.Fatalf("failed to put : %v", err)
+		}
+	}
+	if err := lsm.Save(1); err != nil {
+		t.Fatalf("failed to save : %v", err)
+	}
+
+	// reopen to read bloom filter from file
+	lsm.Close()
+	lsm = newLSM(testDBPath, 1<<20, storeLogger{})
+	if _, err := lsm.Load(); err != nil {
+		t.Fatalf("failed to load : %v", err)
+	}
+	table := lsm.levels[0][0]
+	for i := 0; i < 1000; i++ {
+		if !table.bloom.mayContain(hashKey(fmt.Sprintf("key%04d", i))) {
+			t.Fatalf("bloom filter does not contain existing key%04d", i)
+		}
+	}
+	var fp int
+	for i := 1000; i < 11000; i++ {
+		if table.bloom.mayContain(hashKey(fmt.Sprintf("key%04d", i))) {
+			fp++
+		}
+	}
+	if fp > 500 {
+		t.Errorf("false positive rate is too high : %v / 10000", fp)
+	}
+	if _, err := lsm.Get("key5000"); err != ErrNotExist {
+		t.Errorf("not existing key is not (not exist) : %v", err)
+	}
+}
+
+func TestLSM_ValueLog(t *testing.T) {
+	lsm := createTestLSM(t, 64<<10)
+	defer func() { lsm.Close() }()
+
+	expected := make(map[string][]byte)
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("key%04d", i%150)
+		value := bytes.Repeat([]byte{byte(i)}, vlogThreshold+i)
+		if i%3 == 0 {
+			value = []byte("small")
+		}
+		if err := lsm.Put(Record{Key: key, Value: value}); err != nil {
+			t.Fatalf("failed to put : %v", err)
+		}
+		expected[key] = value
+	}
+	if err := lsm.Save(1); err != nil {
+		t.Fatalf("failed to save : %v", err)
+	} else if err = lsm.compact(); err != nil {
+		t.Fatalf("failed to compact : %v", err)
+	}
+	assertEngine(t, lsm, expected)
+
+	// tables keep only pointers of large values
+	var tableSize int64
+	for _, tables := range lsm.levels {
+		for _, table := range tables {
+			tableSize += table.size
+		}
+	}
+	if tableSize > lsm.vlog.size/10 {
+		t.Errorf("large values are written into tables : tables %v bytes, value log %v bytes", tableSize, lsm.vlog.size)
+	}
+
+	// reopen
+	lsm.Close()
+	lsm = newLSM(testDBPath, 64<<10, storeLogger{})
+	if _, err := lsm.Load(); err != nil {
+		t.Fatalf("failed to load : %v", err)
+	}
+	assertEngine(t, lsm, expected)
+}
+
+func TestLSM_GC(t *testing.T) {
+	lsm := createTestLSM(t, 1<<20)
+	defer func() { lsm.Close() }()
+
+	expected := make(map[string][]byte)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		if err := lsm.Put(Record{Key: key, Value: bytes.Repeat([]byte("v"), 100), Version: 1}); err != nil {
+			t.Fatalf("failed to put : %v", err)
+		}
+		expected[key] = bytes.Repeat([]byte("v"), 100)
+	}
+	if err := lsm.Save(1); err != nil {
+		t.Fatalf("failed to save : %v", err)
+	}
+	for i := 0; i < 500; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		// tombstones of version 3 may be seen by the snapshot of version 2
+		if err := lsm.DeleteVersion(key, uint64(2+i%2)); err != nil {
+			t.Fatalf("failed to delete : %v", err)
+		}
+		delete(expected, key)
+	}
+	if err := lsm.Save(3); err != nil {
+		t.Fatalf("failed to save : %v", err)
+	}
+
+	stats, err := lsm.GC(3)
+	if err != nil {
+		t.Fatalf("failed to gc : %v", err)
+	} else if stats.Tombstones != 250 {
+		t.Errorf("dropped tombstones %v, expected 250", stats.Tombstones)
+	} else if stats.ReclaimedBytes < 500*100 {
+		t.Errorf("reclaimed bytes %v is too small", stats.ReclaimedBytes)
+	}
+	assertEngine(t, lsm, expected)
+	for i := 0; i < 500; i++ {
+		if _, err = lsm.Get(fmt.Sprintf("key%04d", i)); err != ErrNotExist {
+			t.Fatalf("deleted key%04d is not (not exist) : %v", i, err)
+		}
+	}
+
+	// remaining tombstones are dropped by next gc
+	if stats, err = lsm.GC(4); err != nil {
+		t.Fatalf("failed to gc : %v", err)
+	} else if stats.Tombstones != 250 {
+		t.Errorf("dropped tombstones %v, expected 250", stats.Tombstones)
+	} else if total := lsm.GCStats(); total.Tombstones != 500 {
+		t.Errorf("total dropped tombstones %v, expected 500", total.Tombstones)
+	}
+
+	// reopen
+	lsm.Close()
+	lsm = newLSM(testDBPath, 1<<20, storeLogger{})
+	if _, err = lsm.Load(); err != nil {
+		t.Fatalf("failed to load : %v", err)
+	}
+	assertEngine(t, lsm, expected)
+}
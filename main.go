@@ -2,6 +2,10 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/tls"
 	"encoding/binary"
 	"errors"
 	"flag"
@@ -10,13 +14,19 @@ import (
 	"io"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/kawasin73/umutex"
+	"google.golang.org/grpc"
 )
 
 const (
@@ -26,6 +36,24 @@ const (
 	LRead
 	LCommit
 	LAbort
+	// LPrepare, LCommitPrepared and LAbortPrepared have the global transaction id in Key, and
+	// LCommitPrepared have the commit version in Version.
+	LPrepare
+	LCommitPrepared
+	LAbortPrepared
+	// LEpoch is the header of WAL which has the epoch of replication in Version.
+	LEpoch
+)
+
+// formats of logs in WAL and records in the data file of map. WAL and data files written by
+// older releases are replayed and loaded, and written in currentFormat after recovery.
+const (
+	// formatV1 is the format of the first release, whose records have no commit version.
+	formatV1 = 1 + iota
+	// formatV2 adds the commit version to records and the header of the data file.
+	formatV2
+
+	currentFormat = formatV2
 )
 
 var (
@@ -34,17 +62,19 @@ var (
 	ErrBufferShort = errors.New("buffer size is not enough to deserialize")
 	ErrChecksum    = errors.New("checksum does not match")
 	ErrDeadLock    = errors.New("deadlock detected")
+	ErrVersion     = errors.New("version does not match")
+	ErrCorrupted   = errors.New("records are inconsistent with WAL")
 )
 
 type Record struct {
 	Key   string
 	Value []byte
+	// Version is the commit version of the transaction which wrote the record last.
+	Version uint64
 }
 
 func (r *Record) Serialize(buf []byte) (int, error) {
-	key := []byte(r.Key)
-	value := r.Value
-	total := 5 + len(key) + len(value)
+	total := 13 + len(r.Key) + len(r.Value)
 
 	// check buffer size
 	if len(buf) < total {
@@ -53,41 +83,83 @@ func (r *Record) Serialize(buf []byte) (int, error) {
 
 	// serialize
 	// TODO: support NULL value
-	buf[0] = uint8(len(key))
+	buf[0] = uint8(len(r.Key))
 	binary.BigEndian.PutUint32(buf[1:], uint32(len(r.Value)))
-	copy(buf[5:], key)
-	copy(buf[5+len(key):], r.Value)
+	binary.BigEndian.PutUint64(buf[5:], r.Version)
+	copy(buf[13:], r.Key)
+	copy(buf[13+len(r.Key):], r.Value)
 
 	return total, nil
 }
 
 func (r *Record) Deserialize(buf []byte) (int, error) {
-	if len(buf) < 5 {
+	return r.deserialize(buf, currentFormat)
+}
+
+// DeserializeUnsafe is Deserialize without copying the value, which refers to buf. buf must not
+// be modified or reused while the record is used.
+func (r *Record) DeserializeUnsafe(buf []byte) (int, error) {
+	return r.decode(buf, currentFormat)
+}
+
+func (r *Record) deserialize(buf []byte, format int) (int, error) {
+	n, err := r.decode(buf, format)
+	if err == nil {
+		// TODO: support NULL value
+		r.Value = clone(r.Value)
+	}
+	return n, err
+}
+
+// decode parses the record of the format in buf, whose value refers to buf.
+func (r *Record) decode(buf []byte, format int) (int, error) {
+	header := recordHeaderSize(format)
+	if len(buf) < header {
 		return 0, ErrBufferShort
 	}
 
 	// parse length
 	keyLen := buf[0]
 	valueLen := binary.BigEndian.Uint32(buf[1:])
-	total := 5 + int(keyLen) + int(valueLen)
-	if len(buf) < total {
+	// compare in uint64 not to overflow int by huge valueLen
+	if uint64(len(buf)) < uint64(header)+uint64(keyLen)+uint64(valueLen) {
 		return 0, ErrBufferShort
 	}
+	total := header + int(keyLen) + int(valueLen)
 
 	// copy key and value from buffer
-	r.Key = string(buf[5 : 5+keyLen])
-	// TODO: support NULL value
-	r.Value = make([]byte, valueLen)
-	copy(r.Value, buf[5+keyLen:total])
+	r.Version = 0
+	if format != formatV1 {
+		r.Version = binary.BigEndian.Uint64(buf[5:])
+	}
+	r.Key = string(buf[header : header+int(keyLen)])
+	r.Value = buf[header+int(keyLen) : total : total]
 
 	return total, nil
 }
 
+// recordHeaderSize returns the size of key length, value length and version of the record
+// serialized in the format.
+func recordHeaderSize(format int) int {
+	if format == formatV1 {
+		return 5
+	}
+	return 13
+}
+
 type RecordLog struct {
 	Action uint8
 	Record
 }
 
+// size returns the size of the serialized log.
+func (r *RecordLog) size() int {
+	if r.Action == LCommit || r.Action == LAbort {
+		return 5
+	}
+	return 5 + 13 + len(r.Key) + len(r.Value)
+}
+
 func (r *RecordLog) Serialize(buf []byte) (int, error) {
 	if len(buf) < 5 {
 		return 0, ErrBufferShort
@@ -95,8 +167,8 @@ func (r *RecordLog) Serialize(buf []byte) (int, error) {
 
 	buf[0] = r.Action
 	var total = 1
-	if r.Action > LRead {
-		// LCommit or LAbort
+	if r.Action == LCommit || r.Action == LAbort {
+		// no record content
 	} else {
 		// serialize record content first (check buffer size)
 		n, err := r.Record.Serialize(buf[1:])
@@ -110,26 +182,26 @@ func (r *RecordLog) Serialize(buf []byte) (int, error) {
 	}
 
 	// generate checksum
-	hash := crc32.NewIEEE()
-	if _, err := hash.Write(buf[:total]); err != nil {
-		return 0, err
-	}
-	binary.BigEndian.PutUint32(buf[total:], hash.Sum32())
+	binary.BigEndian.PutUint32(buf[total:], crc32.ChecksumIEEE(buf[:total]))
 
 	return total + 4, nil
 }
 
 func (r *RecordLog) Deserialize(buf []byte) (int, error) {
+	return r.deserialize(buf, currentFormat)
+}
+
+func (r *RecordLog) deserialize(buf []byte, format int) (int, error) {
 	if len(buf) < 5 {
 		return 0, ErrBufferShort
 	}
 	r.Action = buf[0]
 	var total = 1
 	switch r.Action {
-	case LCommit:
+	case LCommit, LAbort:
 
-	case LInsert, LUpdate, LDelete:
-		n, err := r.Record.Deserialize(buf[1:])
+	case LInsert, LUpdate, LDelete, LPrepare, LCommitPrepared, LAbortPrepared, LEpoch:
+		n, err := r.Record.deserialize(buf[1:], format)
 		if err != nil {
 			return 0, err
 		}
@@ -138,13 +210,12 @@ func (r *RecordLog) Deserialize(buf []byte) (int, error) {
 	default:
 		return 0, fmt.Errorf("action is not supported : %v", r.Action)
 	}
+	if len(buf) < total+4 {
+		return 0, ErrBufferShort
+	}
 
 	// validate checksum
-	hash := crc32.NewIEEE()
-	if _, err := hash.Write(buf[:total]); err != nil {
-		return 0, err
-	}
-	if binary.BigEndian.Uint32(buf[total:]) != hash.Sum32() {
+	if binary.BigEndian.Uint32(buf[total:]) != crc32.ChecksumIEEE(buf[:total]) {
 		return 0, ErrChecksum
 	}
 
@@ -228,274 +299,1360 @@ func (l *Locker) Downgrade(key string) {
 	rec.mu.Downgrade()
 }
 
+// LockContext is Lock which gives up waiting with the error of ctx when ctx is done.
+func (l *Locker) LockContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	rec := l.refLock(key)
+	_, err := waitLock(ctx, func() bool {
+		rec.mu.Lock()
+		return true
+	}, func(bool) { l.Unlock(key) })
+	return err
+}
+
+// RLockContext is RLock which gives up waiting with the error of ctx when ctx is done.
+func (l *Locker) RLockContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	rec := l.refLock(key)
+	_, err := waitLock(ctx, func() bool {
+		rec.mu.RLock()
+		return true
+	}, func(bool) { l.RUnlock(key) })
+	return err
+}
+
+// UpgradeContext is Upgrade which gives up waiting with the error of ctx when ctx is done. The
+// read lock is released if it gives up.
+func (l *Locker) UpgradeContext(ctx context.Context, key string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		l.RUnlock(key)
+		return false, err
+	}
+	rec := l.getLock(key)
+	return waitLock(ctx, rec.mu.Upgrade, func(upgraded bool) {
+		if upgraded {
+			l.Unlock(key)
+		} else {
+			l.RUnlock(key)
+		}
+	})
+}
+
+// waitLock waits for acquire to return until ctx is done. If ctx is done first, the lock is
+// released by abandon with the result of acquire after it returns in background.
+func waitLock(ctx context.Context, acquire func() bool, abandon func(bool)) (bool, error) {
+	if ctx.Done() == nil {
+		return acquire(), nil
+	}
+	ch := make(chan bool, 1)
+	go func() { ch <- acquire() }()
+	select {
+	case ok := <-ch:
+		return ok, nil
+	case <-ctx.Done():
+		go func() { abandon(<-ch) }()
+		return false, ctx.Err()
+	}
+}
+
+// Backend keeps committed records and persists them at checkpoint. Backends are registered by
+// RegisterBackend and selected by Options.Backend, so that the transaction layer does not depend
+// on the implementation. Backend is protected by Storage.muDB.
+type Backend interface {
+	// Get returns the record or ErrNotExist.
+	Get(key string) (Record, error)
+	Put(r Record) error
+	Delete(key string) error
+	Len() int
+	// Keys calls fn for each key with the prefix until fn returns false.
+	// The order of keys depends on the engine.
+	Keys(prefix string, fn func(key string) bool) error
+	// Save persists all records with the commit version.
+	Save(version uint64) error
+	// Load loads persisted records and returns the commit version.
+	Load() (uint64, error)
+	Close() error
+}
+
+// orderedEngine is the engine whose Keys calls fn in ascending order of keys.
+type orderedEngine interface {
+	Backend
+	// KeysReverse calls fn for each key with the prefix in descending order until fn returns false.
+	KeysReverse(prefix string, fn func(key string) bool) error
+}
+
+// tombstoneEngine is the engine which keeps tombstones of deleted records until GC.
+type tombstoneEngine interface {
+	Backend
+	// DeleteVersion writes the tombstone of the key deleted by the commit version.
+	DeleteVersion(key string, version uint64) error
+	// GC drops tombstones whose version is older than horizon and reclaims their space.
+	GC(horizon uint64) (GCStats, error)
+}
+
+// unwrapper is implemented by the engine which wraps another engine without changing keys.
+type unwrapper interface {
+	unwrap() Backend
+}
+
+// orderedOf returns the ordered engine under the wrappers.
+func orderedOf(e Backend) (orderedEngine, bool) {
+	for {
+		if o, ok := e.(orderedEngine); ok {
+			return o, true
+		} else if w, ok := e.(unwrapper); ok {
+			e = w.unwrap()
+		} else {
+			return nil, false
+		}
+	}
+}
+
+// tombstoneOf returns the tombstone engine under the wrappers.
+func tombstoneOf(e Backend) (tombstoneEngine, bool) {
+	for {
+		if t, ok := e.(tombstoneEngine); ok {
+			return t, true
+		} else if w, ok := e.(unwrapper); ok {
+			e = w.unwrap()
+		} else {
+			return nil, false
+		}
+	}
+}
+
+// prefixEnd returns the smallest key larger than all keys with the prefix.
+// empty if there is no such key.
+func prefixEnd(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return ""
+}
+
 type Storage struct {
+	// metrics is the metrics of the storage exported by WriteMetrics.
+	metrics metrics
 	muWAL   sync.Mutex
 	muDB    sync.RWMutex
-	dbPath  string
-	tmpPath string
-	wal     *os.File
-	db      map[string]Record
+	wal     File
+	db      Backend
 	lock    *Locker
+	// dirLock is LOCK of the data directory of Options.Dir, or nil.
+	dirLock File
+	// version is the last commit version. protected by muWAL.
+	version uint64
+	// walSize is the size of WAL file. protected by muWAL.
+	walSize int64
+	// snapshotVersion is the version of the data file loaded by the last LoadCheckPoint.
+	snapshotVersion uint64
+	// corruptLogs is the corrupt ranges of WAL truncated or skipped by the last LoadWAL.
+	corruptLogs []CorruptLog
+	// lsnProblems is the problems of commit versions replayed by the last LoadWAL.
+	lsnProblems []VerifyProblem
+	// tornBytes is the size of the torn log discarded, and discardedTxns is the number of
+	// transactions discarded with skipped logs by the last LoadWAL.
+	tornBytes     int64
+	discardedTxns int
+	// walErr is the error of the last write to WAL. protected by muWAL.
+	walErr error
+	// checkpointSize is the WAL size which triggers checkpoint at commit. 0 disables it.
+	checkpointSize int64
+	// keyring is the data keys for encryption. nil if encryption is disabled.
+	keyring *keyring
+	// families routes records to column families. nil if no column family is added.
+	families *familyEngine
+	// acl authenticates users of servers. nil if ACL is disabled.
+	acl *ACL
+	// prepared is the prepared transactions waiting for the decision by global transaction id.
+	// protected by muWAL.
+	prepared map[string]*Txn
+	// raft replicates commits if Raft is enabled.
+	raft *RaftNode
+	// repl retains WAL for replicas if this is the primary of replication.
+	repl *replication
+	// replica pulls logs from the primary if this is the replica.
+	replica *Replica
+	// epoch is incremented when the replica is promoted. protected by muWAL.
+	epoch uint64
+	// watch notifies watchers of applied logs.
+	watch watchHub
+	// opts is the options opened by Open without MasterKey. zero if created by NewStorage.
+	opts Options
+	// started is the time when the storage is created.
+	started time.Time
+	// feeds writes changes of commits into the outbox. protected by muWAL.
+	feeds []*Feed
+	// audit records commits if the audit log is enabled. protected by muWAL.
+	audit *AuditLog
+	// lastFsync is the latency of the last fsync of WAL. protected by muWAL.
+	lastFsync time.Duration
+	// unsynced is the commits of CommitAsync written into WAL which is not synced yet.
+	// protected by muWAL.
+	unsynced []*CommitFuture
+	// wakeSyncer wakes up the syncer of CommitAsync, stopSyncer stops it, and syncerDone is
+	// closed when it is stopped. nil until the first CommitAsync starts it. protected by muWAL.
+	wakeSyncer, stopSyncer, syncerDone chan struct{}
+	// slow records slow transactions. nil if the slow log is disabled.
+	slow atomic.Pointer[slowLog]
+	// hooks is called by transactions. nil if no hook is set.
+	hooks atomic.Pointer[Hooks]
+	// txnID is the last id of transactions assigned if hooks are set.
+	txnID atomic.Uint64
+	// diskFull is the unix time in nanoseconds when the last write failed by no space left on
+	// the disk. writers fail with ErrDiskFull while it is not 0.
+	diskFull atomic.Int64
+	// corrupted is the error wrapping ErrCorrupted after logs written into WAL failed to be
+	// applied. writes and checkpoint fail with it until reopened. nil if not corrupted.
+	corrupted atomic.Pointer[error]
+	// muClose protects closing and active. closing rejects new transactions after Shutdown
+	// begins, active is the number of in-flight transactions, and idle is closed when they
+	// finish while Shutdown waits for them.
+	muClose sync.Mutex
+	closing bool
+	active  int
+	idle    chan struct{}
+	// closed rejects writes into WAL after Shutdown. protected by muWAL.
+	closed bool
+	// stopCheckpointer stops checkpoint at Options.CheckpointInterval, and checkpointerDone is
+	// closed when it is stopped. nil if disabled.
+	stopCheckpointer chan struct{}
+	checkpointerDone chan struct{}
+	// admission throttles commits by Options.Admission.
+	admission admission
+	// quotas is the quotas of prefixes sorted by prefix and their usage. protected by muDB, and
+	// replaced by SetQuota with muWAL locked too.
+	quotas []*QuotaUsage
+	// internalKeys is the number of internal keys in db, which are not counted as records of
+	// users. protected by muDB.
+	internalKeys int
+	// expiring is true after any TTL of records is written, so that reads look up TTLs.
+	expiring atomic.Bool
+	// stopExpirer stops the background expiration, and expirerDone is closed when it is
+	// stopped. nil if disabled.
+	stopExpirer chan struct{}
+	expirerDone chan struct{}
 }
 
-func NewStorage(wal *os.File, dbPath, tmpPath string) *Storage {
-	return &Storage{
-		dbPath:  dbPath,
-		tmpPath: tmpPath,
-		wal:     wal,
-		db:      make(map[string]Record),
-		lock:    NewLocker(),
+// NewStorage creates Storage with in-memory map engine.
+func NewStorage(wal File, dbPath, tmpPath string) *Storage {
+	return newStorage(wal, newMapEngine(dbPath, tmpPath))
+}
+
+// NewBTreeStorage creates Storage with disk-backed B+tree engine.
+func NewBTreeStorage(wal File, dbPath string) *Storage {
+	return newStorage(wal, newBTree(dbPath, defaultCachePages))
+}
+
+// NewHashStorage creates Storage with disk-backed linear hashing engine for point lookups.
+func NewHashStorage(wal File, dbPath string) *Storage {
+	return newStorage(wal, newHash(dbPath, defaultCachePages))
+}
+
+// NewLSMStorage creates Storage with LSM-tree engine which stores tables in the directory.
+func NewLSMStorage(wal File, dir string) *Storage {
+	return newStorage(wal, newLSM(dir, lsmMemtableSize, storeLogger{}))
+}
+
+func newStorage(wal File, db Backend) *Storage {
+	s := &Storage{
+		wal:      wal,
+		db:       db,
+		lock:     NewLocker(),
+		prepared: make(map[string]*Txn),
+		started:  time.Now(),
+	}
+	s.initMetrics()
+	return s
+}
+
+// applyCommit applies logs of the commit written into WAL, and observes the latency of apply.
+func (s *Storage) applyCommit(logs []RecordLog) error {
+	start := time.Now()
+	err := s.ApplyLogs(logs)
+	s.metrics.apply.ObserveDuration(time.Since(start))
+	return err
+}
+
+// corrupt makes the storage reject writes and checkpoint because logs already written into WAL
+// are not applied, and returns the error wrapping ErrCorrupted. The logs are applied by recovery
+// when reopened. It panics instead if Options.PanicOnCorruption is true.
+func (s *Storage) corrupt(err error) error {
+	s.logger().Error("records are inconsistent with WAL", "err", err)
+	if s.opts.PanicOnCorruption {
+		panic(err)
 	}
+	err = fmt.Errorf("%w : %w", ErrCorrupted, err)
+	s.corrupted.CompareAndSwap(nil, &err)
+	return err
 }
 
-func (s *Storage) ApplyLogs(logs []RecordLog) {
+// ApplyLogs applies logs written into WAL to the backend. If it fails, the storage is corrupted
+// and the error wraps ErrCorrupted.
+func (s *Storage) ApplyLogs(logs []RecordLog) error {
 	s.muDB.Lock()
 	defer s.muDB.Unlock()
 	// TODO: optimize when duplicate keys in logs
 	for _, rlog := range logs {
+		if err := s.trackQuotas(&rlog); err != nil {
+			return s.corrupt(fmt.Errorf("failed to read record %q to count quotas : %w", rlog.Key, err))
+		} else if err = s.trackInternal(&rlog); err != nil {
+			return s.corrupt(fmt.Errorf("failed to read record %q to count internal keys : %w", rlog.Key, err))
+		}
+		var err error
 		switch rlog.Action {
 		case LInsert:
-			s.db[rlog.Key] = rlog.Record
+			s.markTTL(rlog.Key)
+			err = s.db.Put(rlog.Record)
 
 		case LUpdate:
 			// reuse Key string in db and Key in rlog will be GCed.
-			r, ok := s.db[rlog.Key]
-			if !ok {
+			r, gerr := s.db.Get(rlog.Key)
+			if gerr == ErrNotExist {
 				// record in db may be sometimes deleted. complete with rlog.Key for idempotency.
 				r.Key = rlog.Key
+			} else if gerr != nil {
+				return s.corrupt(fmt.Errorf("failed to read record %q to apply logs : %w", rlog.Key, gerr))
 			}
 			r.Value = rlog.Value
-			s.db[r.Key] = r
+			r.Version = rlog.Version
+			err = s.db.Put(r)
 
 		case LDelete:
-			delete(s.db, rlog.Key)
+			if t, ok := tombstoneOf(s.db); ok {
+				err = t.DeleteVersion(rlog.Key, rlog.Version)
+			} else {
+				err = s.db.Delete(rlog.Key)
+			}
+		}
+		if err != nil {
+			// logs are already written to WAL. db must not be checkpointed inconsistent with WAL.
+			return s.corrupt(fmt.Errorf("failed to apply logs of %q : %w", rlog.Key, err))
+		}
+	}
+	s.watch.notify(logs)
+	return nil
+}
+
+// commitLogs writes logs committed by the actor into WAL and applies them, and returns the
+// latency of fsync of WAL. Logs are applied in WAL lock so that checkpoint does not clear logs
+// which are not applied yet. If future is not nil, WAL is not synced and future is done when the
+// syncer of CommitAsync syncs it. If key is not empty, it is committed as the idempotency key, or
+// errReplayedCommit is returned without writing logs if it is already committed.
+func (s *Storage) commitLogs(logs []RecordLog, actor, key string, future *CommitFuture) (time.Duration, error) {
+	s.muWAL.Lock()
+	defer s.muWAL.Unlock()
+
+	if key != "" && len(logs) > 0 {
+		if version, ok, err := s.committedKey(key); err != nil {
+			return 0, err
+		} else if ok {
+			s.logger().Info("replayed commit is ignored", "idempotency_key", key, "version", version)
+			if future != nil {
+				// the original commit may not be synced yet
+				s.deferSync(future)
+			}
+			return 0, errReplayedCommit
+		}
+		logs = append(logs, idempotencyRecord(key, s.version+1, s.now()))
+	}
+
+	if err := s.checkQuotas(logs); err != nil {
+		return 0, err
+	}
+
+	var fed bool
+	if len(s.feeds) > 0 && len(logs) > 0 {
+		var err error
+		if logs, fed, err = s.outbox(logs, s.version+1); err != nil {
+			return 0, err
+		}
+	}
+	if s.audit != nil && len(logs) > 0 {
+		var err error
+		if logs, err = s.audit.record(logs, s.version+1, actor, s.now()); err != nil {
+			return 0, err
+		}
+	}
+	err := s.saveWAL(logs, future == nil)
+	s.trackWALSize()
+	if err != nil {
+		return 0, err
+	} else if err = s.applyCommit(logs); err != nil {
+		// the transaction is durable in WAL, and applied when the storage is reopened
+		return 0, err
+	}
+	if future != nil {
+		s.deferSync(future)
+	}
+	if fed {
+		s.notifyFeeds()
+	}
+
+	if s.checkpointSize > 0 && s.walSize >= s.checkpointSize {
+		// this transaction is already durable in WAL. just report failure of checkpoint.
+		if err := s.checkpoint(); err != nil {
+			s.logger().Error("failed to checkpoint", "err", err)
 		}
 	}
+	if future != nil {
+		return 0, nil
+	}
+	return s.lastFsync, nil
 }
 
 func (s *Storage) SaveWAL(logs []RecordLog) error {
 	// prevent parallel WAL writing by unexpected context switch
 	s.muWAL.Lock()
 	defer s.muWAL.Unlock()
+	return s.saveWAL(logs, true)
+}
+
+// saveWAL assigns the commit version to logs and writes them into WAL, which is synced if sync
+// is true.
+func (s *Storage) saveWAL(logs []RecordLog, sync bool) error {
+	size := s.walSize
+	s.assignVersion(logs)
+	err := s.appendWAL(logs, RecordLog{Action: LCommit}, sync)
+	if err != nil && len(logs) > 0 && s.walSize == size {
+		// the transaction is discarded from WAL, and the version is assigned again by the next
+		// commit
+		s.version--
+	}
+	return err
+}
+
+// now returns the current time by Options.Now.
+func (s *Storage) now() time.Time {
+	if s.opts.Now != nil {
+		return s.opts.Now()
+	}
+	return time.Now()
+}
+
+// assignVersion assigns the commit version to all records written by the transaction.
+func (s *Storage) assignVersion(logs []RecordLog) {
+	if len(logs) > 0 {
+		s.version++
+		for i := range logs {
+			logs[i].Version = s.version
+		}
+	}
+}
 
+// writeWAL writes logs followed by the end log which decides the transaction, and syncs WAL.
+func (s *Storage) writeWAL(logs []RecordLog, end RecordLog) error {
+	return s.appendWAL(logs, end, true)
+}
+
+// appendWAL is writeWAL which leaves WAL unsynced if sync is false. If it fails, logs written
+// partially are truncated so that the failed transaction is not replayed.
+func (s *Storage) appendWAL(logs []RecordLog, end RecordLog, sync bool) (err error) {
+	if s.closed {
+		return ErrClosed
+	} else if s.opts.readOnly {
+		return ErrReadOnly
+	} else if s.opts.DisableWAL {
+		// commits are durable only after checkpoint
+		return nil
+	}
+	size := s.walSize
+	defer func() {
+		if isDiskFull(err) {
+			err = s.discardTornWAL(size, err)
+		} else if err != nil {
+			err = s.discardFailedWAL(size, err)
+		}
+		if err != ErrBufferShort {
+			s.walErr = err
+		}
+	}()
+	pooled := walBuffers.Get().(*[walBufferSize]byte)
+	defer walBuffers.Put(pooled)
 	var (
-		i   int
-		buf [4096]byte
+		// serialize and write are the total time of each phase for all logs.
+		serialize, write time.Duration
 	)
 
 	for _, rlog := range logs {
-		n, err := rlog.Serialize(buf[i:])
-		if err == ErrBufferShort {
-			// TODO: use writev
+		start := time.Now()
+		if rlog, err = s.keyring.sealLog(rlog); err != nil {
 			return err
-		} else if err != nil {
+		}
+		// the log larger than the pooled buffer is serialized into the buffer allocated for it
+		buf := growBuffer(pooled[:], rlog.size())
+		n, err := rlog.Serialize(buf)
+		if err != nil {
 			return err
 		}
+		serialize += time.Since(start)
 
 		// TODO: delay write and combine multi log into one buffer
+		start = time.Now()
 		_, err = s.wal.Write(buf[:n])
 		if err != nil {
 			return err
 		}
+		write += time.Since(start)
+		s.walSize += int64(n)
+		s.metrics.walBytes.Add(uint64(n))
 	}
 
 	// write commit log
-	n, err := (&RecordLog{Action: LCommit}).Serialize(buf[:])
+	start := time.Now()
+	buf := growBuffer(pooled[:], end.size())
+	n, err := end.Serialize(buf)
 	if err != nil {
-		// commit log serialization must not fail
-		log.Panic(err)
+		return err
 	}
+	serialize += time.Since(start)
+	start = time.Now()
 	_, err = s.wal.Write(buf[:n])
 	if err != nil {
 		return err
 	}
+	write += time.Since(start)
+	s.walSize += int64(n)
+	s.metrics.walBytes.Add(uint64(n))
+	s.metrics.serialize.ObserveDuration(serialize)
+	s.metrics.write.ObserveDuration(write)
 
 	// sync this transaction
-	err = s.wal.Sync()
-	if err != nil {
-		return err
+	if sync && s.opts.SyncMode != SyncNone {
+		start = time.Now()
+		err = s.wal.Sync()
+		if err != nil {
+			return err
+		}
+		s.observeFsync(time.Since(start))
+		// commits of CommitAsync written before are synced together
+		s.resolveUnsynced(nil)
 	}
 
+	if s.repl != nil && (sync || s.opts.SyncMode == SyncNone) {
+		// logs not synced are notified by the syncer of CommitAsync
+		version := end.Version
+		if len(logs) > 0 {
+			version = logs[0].Version
+		}
+		s.repl.notify(version)
+	}
 	return nil
 }
 
+// discardFailedWAL truncates logs of the transaction written after size before it failed by err.
+// muWAL must be locked.
+func (s *Storage) discardFailedWAL(size int64, err error) error {
+	if terr := s.wal.Truncate(size); terr != nil {
+		s.logger().Error("failed to discard logs of failed commit in WAL", "size", size, "err", terr)
+		return fmt.Errorf("%w (failed to discard logs : %v)", err, terr)
+	}
+	s.walSize = size
+	return err
+}
+
+// LoadWAL replays committed transactions in WAL. Corrupt logs are handled by
+// Options.RecoveryPolicy, and the torn log at the tail by crash is discarded.
 func (s *Storage) LoadWAL() (int, error) {
+	format, err := s.walFormat()
+	if err != nil {
+		return 0, err
+	} else if format != currentFormat {
+		s.logger().Info("WAL of old format is replayed", "format", format)
+	}
 	if _, err := s.wal.Seek(0, io.SeekStart); err != nil {
 		return 0, err
 	}
 
 	var (
 		logs  []RecordLog
-		buf   [4096]byte
+		buf   = make([]byte, walBufferSize)
 		head  int
 		size  int
 		nlogs int
+		eof   bool
+		// offset is the offset of buf[head] in WAL.
+		offset int64
+		// skipFrom is the offset of the first corrupt byte while skipping. -1 if not skipping.
+		skipFrom int64 = -1
+		skipErr  error
+		// damaged is true if logs of the current transaction may be skipped.
+		damaged bool
+		// prepared is the logs of prepared transactions by global transaction id.
+		prepared = make(map[string][]RecordLog)
+		reporter *recoveryReporter
+		policy   = s.opts.RecoveryPolicy
+		lsn      = lsnChecker{last: s.version}
 	)
+	s.corruptLogs, s.tornBytes, s.discardedTxns = nil, 0, 0
+	corrupt := func(msg string, c CorruptLog) {
+		s.logger().Warn(msg, "offset", c.Offset, "bytes", c.Bytes, "err", c.Err)
+		s.corruptLogs = append(s.corruptLogs, c)
+		reporter.corrupt()
+	}
+	// the epoch and prepared transactions kept while WAL is cleared are replayed before WAL
+	if err := s.loadEpoch(); err != nil {
+		return 0, err
+	} else if err = s.loadPrepared(prepared); err != nil {
+		return 0, err
+	}
+	if fn := s.opts.RecoveryProgress; fn != nil {
+		info, err := s.wal.Stat()
+		if err != nil {
+			return 0, err
+		}
+		reporter = newRecoveryReporter(fn, s.opts.RecoveryProgressInterval, info.Size())
+	}
 
 	// redo all record logs in WAL file
+REPLAY:
 	for {
 		var rlog RecordLog
-		n, err := rlog.Deserialize(buf[head:size])
-		if err == ErrBufferShort {
+		n, err := rlog.deserialize(buf[head:size], format)
+		if err == ErrBufferShort && !eof && size-head < len(buf) {
 			// move data to head
-			copy(buf[:], buf[head:size])
+			copy(buf, buf[head:size])
 			size -= head
-
-			if size == 4096 {
-				// buffer size (4096) is too short for this log
-				// TODO: allocate and read directly to db buffer
-				return 0, err
-			}
+			head = 0
 
 			// read more log data to buffer
 			n, err = s.wal.Read(buf[size:])
 			size += n
 			if err == io.EOF {
-				break
+				eof = true
 			} else if err != nil {
 				return 0, err
 			}
 			continue
+		} else if err == ErrBufferShort && (head == size || (eof && skipFrom < 0)) {
+			if head < size {
+				s.tornBytes = int64(size - head)
+				s.logger().Warn("torn log at the tail of WAL is discarded", "offset", offset, "bytes", s.tornBytes)
+			}
+			break
+		} else if err == ErrBufferShort && !eof {
+			// the log is larger than the whole buffer. grow the buffer to read the rest of it.
+			buf = append(buf, make([]byte, len(buf))...)
+			continue
 		} else if err != nil {
-			return 0, err
+			switch policy {
+			case RecoveryTruncate:
+				discarded := int64(size - head)
+				if info, err := s.wal.Stat(); err == nil {
+					discarded = info.Size() - offset
+				}
+				corrupt("WAL is truncated at corrupt log", CorruptLog{Offset: offset, Bytes: discarded, Action: "truncated", Err: err.Error()})
+				break REPLAY
+			case RecoverySkip:
+				// find the next valid log byte by byte
+				if skipFrom < 0 {
+					skipFrom, skipErr = offset, err
+				}
+				head++
+				offset++
+				continue
+			default:
+				return 0, fmt.Errorf("corrupt log at offset %v : %w", offset, err)
+			}
+		}
+		if skipFrom >= 0 {
+			corrupt("corrupt logs in WAL are skipped", CorruptLog{Offset: skipFrom, Bytes: offset - skipFrom, Action: "skipped", Err: skipErr.Error()})
+			skipFrom, damaged = -1, true
 		}
+		logOffset := offset
 		head += n
+		offset += int64(n)
 		nlogs++
+		s.walSize += int64(n)
+		reporter.logged(int64(n), nlogs)
+		if rlog.Action == LEpoch {
+			s.epoch = rlog.Version
+		} else if rlog.Version > s.version {
+			s.version = rlog.Version
+		}
 
 		switch rlog.Action {
 		case LInsert, LUpdate, LDelete:
+			if err := s.keyring.openLog(&rlog); err != nil {
+				return 0, fmt.Errorf("failed to decrypt log at offset %v : %w", logOffset, err)
+			}
 			// append log
 			logs = append(logs, rlog)
 
 		case LCommit:
+			if format == formatV1 {
+				// logs of formatV1 have no commit version
+				s.version++
+				for i := range logs {
+					logs[i].Version = s.version
+				}
+			} else if len(logs) > 0 {
+				lsn.commit(logs[0].Version, logOffset)
+			}
 			// redo record logs
-			s.ApplyLogs(logs)
+			if damaged {
+				s.logger().Warn("transaction whose logs may be skipped is discarded", "offset", logOffset, "records", len(logs))
+				s.discardedTxns++
+			} else {
+				if err := s.ApplyLogs(logs); err != nil {
+					return 0, err
+				}
+				reporter.applied(len(logs))
+			}
 
 			// clear logs
-			logs = nil
+			logs, damaged = nil, false
 
 		case LAbort:
 			// clear logs
-			logs = nil
+			logs, damaged = nil, false
+
+		case LPrepare:
+			// keep logs until the decision
+			if damaged {
+				s.logger().Warn("prepared transaction whose logs may be skipped is discarded", "offset", logOffset, "gid", rlog.Key, "records", len(logs))
+				s.discardedTxns++
+			} else {
+				prepared[rlog.Key] = logs
+			}
+			logs, damaged = nil, false
+
+		case LCommitPrepared:
+			lsn.commit(rlog.Version, logOffset)
+			for i := range prepared[rlog.Key] {
+				prepared[rlog.Key][i].Version = rlog.Version
+			}
+			if err := s.ApplyLogs(prepared[rlog.Key]); err != nil {
+				return 0, err
+			}
+			reporter.applied(len(prepared[rlog.Key]))
+			delete(prepared, rlog.Key)
+
+		case LAbortPrepared:
+			delete(prepared, rlog.Key)
 
 		default:
 			// skip
 		}
 	}
+	if skipFrom >= 0 {
+		corrupt("corrupt logs at the tail of WAL are skipped", CorruptLog{Offset: skipFrom, Bytes: offset + int64(size-head) - skipFrom, Action: "skipped", Err: skipErr.Error()})
+	}
+
+	// transactions without decision are in doubt. hold their locks until they are resolved.
+	for gid, logs := range prepared {
+		s.restorePrepared(gid, logs)
+	}
+	s.lsnProblems = lsn.problems
+	reporter.done()
 
 	return nlogs, nil
 }
 
-func (s *Storage) ClearWAL() error {
-	if _, err := s.wal.Seek(0, io.SeekStart); err != nil {
-		return err
-	} else if err = s.wal.Truncate(0); err != nil {
-		return err
-		// it is not obvious that ftruncate(2) sync the change to disk or not. sync explicitly for safe.
-	} else if err = s.wal.Sync(); err != nil {
-		return err
+// walFormat detects the format of WAL by the first log with a record. WAL has logs of one
+// format because it is cleared after replayed.
+func (s *Storage) walFormat() (int, error) {
+	var buf [4096]byte
+	n, err := s.wal.ReadAt(buf[:], 0)
+	if err != nil && err != io.EOF {
+		return 0, err
 	}
-	return nil
+	for head := 0; head < n; {
+		var rlog RecordLog
+		m, err := rlog.Deserialize(buf[head:n])
+		if err == nil && (rlog.Action == LCommit || rlog.Action == LAbort) {
+			// logs without record are the same in all formats
+			head += m
+			continue
+		} else if err != nil {
+			if _, err = rlog.deserialize(buf[head:n], formatV1); err == nil {
+				return formatV1, nil
+			}
+		}
+		break
+	}
+	return currentFormat, nil
 }
 
-func (s *Storage) SaveCheckPoint() error {
-	// create temporary checkout file
-	f, err := os.Create(s.tmpPath)
+func (s *Storage) ClearWAL() error {
+	truncate := func() error {
+		if _, err := s.wal.Seek(0, io.SeekStart); err != nil {
+			return err
+		} else if err = s.wal.Truncate(0); err != nil {
+			return err
+			// it is not obvious that ftruncate(2) sync the change to disk or not. sync explicitly for safe.
+		} else if err = s.wal.Sync(); err != nil {
+			return err
+		}
+		return nil
+	}
+	// the epoch and prepared transactions must survive clearing WAL
+	if err := s.keepEpoch(); err != nil {
+		return err
+	}
+	err := s.keepPrepared()
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-
-	var buf [4096]byte
-	// write header
-	binary.BigEndian.PutUint32(buf[:4], uint32(len(s.db)))
-	_, err = f.Write(buf[:4])
+	if s.repl != nil {
+		// WAL is retained as the segment for replicas
+		err = s.repl.archive(s.wal, s.version, truncate)
+	} else {
+		err = truncate()
+	}
 	if err != nil {
-		goto ERROR
+		return err
 	}
+	s.walSize = 0
+	s.trackWALSize()
+	if err = s.writeEpoch(); err != nil {
+		return err
+	}
+	return s.savePrepared()
+}
 
-	// write all data
-	for _, r := range s.db {
-		// FIXME: key order in map will be randomized
-		n, err := r.Serialize(buf[:])
-		if err == ErrBufferShort {
-			// TODO: use writev
-			goto ERROR
-		} else if err != nil {
-			goto ERROR
+// Checkpoint saves all committed records into data file and clears WAL file while running.
+// Commits of other transactions are blocked until checkpoint finishes.
+func (s *Storage) Checkpoint() error {
+	s.muWAL.Lock()
+	defer s.muWAL.Unlock()
+	return s.checkpoint()
+}
+
+// startCheckpointer checkpoints in background at the interval if any transaction is committed
+// since the last checkpoint. It is stopped by Shutdown.
+func (s *Storage) startCheckpointer(interval time.Duration) {
+	s.stopCheckpointer, s.checkpointerDone = make(chan struct{}), make(chan struct{})
+	// version is the commit version of the last checkpoint
+	s.muWAL.Lock()
+	version := s.version
+	s.muWAL.Unlock()
+	go func() {
+		defer close(s.checkpointerDone)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stopCheckpointer:
+				return
+			case <-ticker.C:
+			}
+			s.muWAL.Lock()
+			if s.version > version {
+				if err := s.checkpoint(); err != nil {
+					s.logger().Error("failed to checkpoint", "err", err)
+				}
+				version = s.version
+			}
+			s.muWAL.Unlock()
 		}
+	}()
+}
 
-		// TODO: delay write and combine multi log into one buffer
-		_, err = f.Write(buf[:n])
-		if err != nil {
-			goto ERROR
+// checkpoint must be called with muWAL locked.
+func (s *Storage) checkpoint() error {
+	if s.corrupted.Load() == nil {
+		if err := s.expireIdempotencyKeys(); err != nil {
+			// expired keys are ignored, and deleted by the next checkpoint
+			s.logger().Warn("failed to expire idempotency keys", "err", err)
 		}
 	}
+	if err := s.corrupted.Load(); err != nil {
+		// WAL is kept to recover records not applied
+		return *err
+	}
+	s.muDB.Lock()
+	defer s.muDB.Unlock()
+	err := s.db.Save(s.version)
+	if err == nil {
+		err = s.ClearWAL()
+	}
+	if isDiskFull(err) {
+		s.setDiskFull(err)
+		return ErrDiskFull
+	} else if err == nil {
+		// WAL is truncated, and commits of CommitAsync are durable in the data file
+		s.resumeDiskFull()
+		s.resolveUnsynced(nil)
+	}
+	return err
+}
+
+// GC drops tombstones which no transaction can see and returns the statistics.
+// all transactions read the latest committed records, so that the oldest active snapshot
+// is the next commit version.
+func (s *Storage) GC() (GCStats, error) {
+	t, ok := tombstoneOf(s.db)
+	if !ok {
+		return GCStats{}, errors.New("engine does not keep tombstones")
+	}
+	s.muWAL.Lock()
+	horizon := s.version + 1
+	s.muWAL.Unlock()
+	return t.GC(horizon)
+}
+
+func (s *Storage) SaveCheckPoint() error {
+	return s.db.Save(s.version)
+}
+
+func (s *Storage) LoadCheckPoint() error {
+	version, err := s.db.Load()
+	if err != nil {
+		return err
+	}
+	s.version, s.snapshotVersion = version, version
+	s.detectTTL()
+	s.countInternal()
+	return s.recountQuotas()
+}
+
+// mapEngine keeps all records in memory and saves them into the data file at checkpoint.
+type mapEngine struct {
+	dbPath  string
+	tmpPath string
+	// fs opens the data file and the temporary file of checkpoint.
+	fs FS
+	// mu protects entries because Get under shared lock moves values between memory and disk.
+	mu sync.Mutex
+	// records is the prefix compressed tree of all records including cold records.
+	// the structure of records is modified only under Storage.muDB, so that Keys does not lock mu.
+	records *radixTree
+
+	// maxMemory is the budget of value bytes kept in memory. 0 means unlimited.
+	maxMemory int64
+	memory    int64
+	// f is the data file which evicted values are reloaded from.
+	f File
+	// vlog is the log of values written after the last checkpoint. if vlog is not nil,
+	// only keys and pointers of values are kept in memory and values are read on demand.
+	vlog *valueLog
+	// lru is the list of *mapEntry which is not modified since the last checkpoint and
+	// can be evicted. ncold is the number of records whose values are on disk.
+	lru   *list.List
+	ncold int
+	// format is the format of the data file loaded last, or 0 if it is not loaded.
+	format int
+	// log receives logs of the storage.
+	log Logger
+}
+
+// mapEntry is the record in mapEngine. the key is held by radixTree.
+type mapEntry struct {
+	value   []byte
+	version uint64
+	// elem is the element in lru if the value is clean and in memory.
+	elem *list.Element
+	// cold is true if the value is evicted. offset and size locate the value in the data file,
+	// or in the value log if inLog is true.
+	cold   bool
+	inLog  bool
+	offset int64
+	size   uint32
+	// newOffset is the offset of the value in the data file being saved.
+	newOffset int64
+}
+
+func newMapEngine(dbPath, tmpPath string) *mapEngine {
+	return &mapEngine{
+		dbPath:  dbPath,
+		tmpPath: tmpPath,
+		fs:      osFS{},
+		records: newRadixTree(),
+		lru:     list.New(),
+		log:     storeLogger{},
+	}
+}
+
+func (e *mapEngine) Get(key string) (Record, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ent := e.records.get(key)
+	if ent == nil {
+		return Record{}, ErrNotExist
+	} else if !ent.cold {
+		if ent.elem != nil {
+			e.lru.MoveToFront(ent.elem)
+		}
+		return Record{Key: key, Value: ent.value, Version: ent.version}, nil
+	}
+
+	// reload evicted value
+	value, err := e.readValue(ent)
+	if err != nil {
+		return Record{}, err
+	} else if e.vlog != nil {
+		// values are not cached in memory
+		return Record{Key: key, Value: value, Version: ent.version}, nil
+	}
+	ent.value, ent.cold = value, false
+	e.ncold--
+	e.memory += int64(len(value))
+	ent.elem = e.lru.PushFront(ent)
+	e.evict()
+	return Record{Key: key, Value: value, Version: ent.version}, nil
+}
+
+// readValue reads the value of cold entry from the value log or the data file.
+func (e *mapEngine) readValue(ent *mapEntry) ([]byte, error) {
+	return e.readValueInto(ent, nil)
+}
+
+// readValueInto is readValue into the buffer *reuse if it is not nil, which is grown if it is
+// short.
+func (e *mapEngine) readValueInto(ent *mapEntry, reuse *[]byte) ([]byte, error) {
+	if ent.inLog {
+		return e.vlog.readInto(valuePointer{offset: ent.offset, length: ent.size}, reuse)
+	}
+	var value []byte
+	if reuse == nil {
+		value = make([]byte, ent.size)
+	} else {
+		if cap(*reuse) < int(ent.size) {
+			*reuse = make([]byte, ent.size)
+		}
+		value = (*reuse)[:ent.size]
+	}
+	if _, err := e.f.ReadAt(value, ent.offset); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func (e *mapEngine) Put(r Record) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.vlog != nil {
+		// value log is not synced because values are durable in WAL until checkpoint
+		p, err := e.vlog.append(r.Value)
+		if err != nil {
+			return err
+		}
+		e.remove(e.records.set(r.Key, &mapEntry{version: r.Version, cold: true, inLog: true, offset: p.offset, size: p.length}))
+		e.ncold++
+		return nil
+	}
+	e.remove(e.records.set(r.Key, &mapEntry{value: r.Value, version: r.Version}))
+	e.memory += int64(len(r.Value))
+	e.evict()
+	return nil
+}
+
+func (e *mapEngine) Delete(key string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.remove(e.records.delete(key))
+	return nil
+}
+
+// remove releases the memory and LRU element of the entry removed from records.
+func (e *mapEngine) remove(ent *mapEntry) {
+	if ent == nil {
+		return
+	}
+	if ent.cold {
+		e.ncold--
+	} else {
+		e.memory -= int64(len(ent.value))
+	}
+	if ent.elem != nil {
+		e.lru.Remove(ent.elem)
+	}
+}
+
+// evict evicts least recently used clean values until memory usage fits in the budget.
+// modified values are kept in memory until next checkpoint.
+func (e *mapEngine) evict() {
+	if e.maxMemory == 0 {
+		return
+	}
+	for e.memory > e.maxMemory && e.lru.Len() > 0 {
+		ent := e.lru.Remove(e.lru.Back()).(*mapEntry)
+		e.memory -= int64(len(ent.value))
+		ent.size = uint32(len(ent.value))
+		ent.value, ent.elem, ent.cold = nil, nil, true
+		e.ncold++
+	}
+}
+
+func (e *mapEngine) Len() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.records.len()
+}
+
+func (e *mapEngine) Keys(prefix string, fn func(key string) bool) error {
+	return e.iterate(prefix, false, fn)
+}
+
+func (e *mapEngine) KeysReverse(prefix string, fn func(key string) bool) error {
+	return e.iterate(prefix, true, fn)
+}
+
+func (e *mapEngine) iterate(prefix string, reverse bool, fn func(key string) bool) error {
+	e.records.walk(prefix, reverse, func(key string, _ *mapEntry) bool {
+		return fn(key)
+	})
+	return nil
+}
+
+func (e *mapEngine) Close() error {
+	var err error
+	if e.vlog != nil {
+		err = e.vlog.close()
+	}
+	if e.f == nil {
+		return err
+	} else if cerr := e.f.Close(); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+func (e *mapEngine) Save(version uint64) error {
+	if e.dbPath == "" {
+		// records are kept only in memory
+		return nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// create temporary checkout file
+	f, err := createFile(e.fs, e.tmpPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var (
+		buf    [4096]byte
+		offset = int64(12)
+	)
+	// write header
+	binary.BigEndian.PutUint32(buf[:4], uint32(e.records.len()))
+	binary.BigEndian.PutUint64(buf[4:12], version)
+	_, err = f.Write(buf[:12])
+	if err != nil {
+		goto ERROR
+	}
+
+	// write all data in key order. offsets of values in new data file are kept in newOffset
+	// not to break cold entries until the new data file is swapped.
+	e.records.walk("", false, func(key string, ent *mapEntry) bool {
+		r := Record{Key: key, Value: ent.value, Version: ent.version}
+		if ent.cold {
+			if r.Value, err = e.readValue(ent); err != nil {
+				return false
+			}
+		}
+		err = e.saveRecord(f, buf[:], r, &offset, ent)
+		return err == nil
+	})
+	if err != nil {
+		goto ERROR
+	}
 
 	if err = f.Sync(); err != nil {
 		goto ERROR
 	}
 
 	// swap dbfile and temporary file
-	err = os.Rename(s.tmpPath, s.dbPath)
+	err = e.fs.Rename(e.tmpPath, e.dbPath)
 	if err != nil {
 		goto ERROR
 	}
 
+	if e.maxMemory > 0 || e.vlog != nil {
+		return e.reopen()
+	}
 	return nil
 
 ERROR:
-	if rerr := os.Remove(s.tmpPath); rerr != nil {
-		log.Println("failed to remove temporary file for checkpoint :", rerr)
+	if rerr := e.fs.Remove(e.tmpPath); rerr != nil {
+		e.log.Error("failed to remove temporary file for checkpoint", "err", rerr)
 	}
 	return err
 }
 
-func (s *Storage) LoadCheckPoint() error {
-	f, err := os.Open(s.dbPath)
+func (e *mapEngine) saveRecord(f File, buf []byte, r Record, offset *int64, ent *mapEntry) error {
+	// the record larger than buf is serialized into the buffer allocated for it
+	buf = growBuffer(buf, 13+len(r.Key)+len(r.Value))
+	n, err := r.Serialize(buf)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 
-	var buf [4096]byte
+	// TODO: delay write and combine multi log into one buffer
+	if _, err = f.Write(buf[:n]); err != nil {
+		return err
+	}
+	ent.newOffset = *offset + 13 + int64(len(r.Key))
+	*offset += int64(n)
+	return nil
+}
 
-	// read and parse header
-	n, err := f.Read(buf[:])
+// reopen opens new data file and marks all records clean after checkpoint.
+func (e *mapEngine) reopen() error {
+	if e.f != nil {
+		e.f.Close()
+	}
+	f, err := openFile(e.fs, e.dbPath)
 	if err != nil {
+		e.f = nil
 		return err
-	} else if n < 4 {
-		return fmt.Errorf("file header size is too short : %v", n)
+	}
+	e.f = f
+	e.lru.Init()
+	e.records.walk("", false, func(_ string, ent *mapEntry) bool {
+		ent.offset, ent.inLog = ent.newOffset, false
+		if !ent.cold {
+			ent.elem = e.lru.PushFront(ent)
+		}
+		return true
+	})
+	e.evict()
+	if e.vlog != nil {
+		// all values are moved into the data file
+		return e.vlog.truncate()
+	}
+	return nil
+}
+
+func (e *mapEngine) Load() (uint64, error) {
+	if e.dbPath == "" {
+		return 0, os.ErrNotExist
+	}
+	if e.vlog != nil {
+		// values after the last checkpoint are written again by WAL
+		if err := e.vlog.truncate(); err != nil {
+			return 0, err
+		}
+	}
+	f, err := openFile(e.fs, e.dbPath)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		// data file is kept open to reload evicted values
+		if e.f != f {
+			f.Close()
+		}
+	}()
+
+	version, err := e.load(f, currentFormat)
+	if err == nil {
+		e.format = currentFormat
+		return version, nil
+	}
+	// data file of old format is rewritten in the current format at the next checkpoint
+	e.records, e.memory, e.ncold = newRadixTree(), 0, 0
+	e.lru.Init()
+	if _, serr := f.Seek(0, io.SeekStart); serr != nil {
+		return 0, serr
+	} else if version, lerr := e.load(f, formatV1); lerr == nil {
+		e.log.Info("data file of old format is loaded", "format", formatV1)
+		e.format = formatV1
+		return version, nil
+	}
+	return 0, err
+}
+
+// Salvage loads records before the first broken record of the data file, and reports the records
+// lost after it by the count in the header. The data file of old format is loaded as Load.
+func (e *mapEngine) Salvage(damage func(SnapshotDamage)) (uint64, error) {
+	version, err := e.Load()
+	if err == nil || os.IsNotExist(err) {
+		return version, err
+	}
+	f, oerr := openFile(e.fs, e.dbPath)
+	if oerr != nil {
+		return 0, err
+	}
+	e.records, e.memory, e.ncold = newRadixTree(), 0, 0
+	e.lru.Init()
+	var head [12]byte
+	if _, herr := f.ReadAt(head[:], 0); herr != nil {
+		f.Close()
+		damage(SnapshotDamage{Source: e.dbPath, Lost: -1, Err: err.Error()})
+		return 0, nil
+	}
+	if _, lerr := e.load(f, currentFormat); lerr != nil {
+		err = lerr
+	}
+	total, salvaged := int(binary.BigEndian.Uint32(head[:4])), e.records.len()
+	lost := total - salvaged
+	if lost < 0 {
+		lost = 0
+	}
+	damage(SnapshotDamage{Source: e.dbPath, Salvaged: salvaged, Lost: lost, Err: err.Error()})
+	if e.maxMemory > 0 || e.vlog != nil {
+		// evicted values are reloaded from the data file
+		e.f = f
+	} else {
+		f.Close()
+	}
+	return binary.BigEndian.Uint64(head[4:]), nil
+}
+
+// load reads all records from the data file of the format.
+func (e *mapEngine) load(f File, format int) (uint64, error) {
+	buf := make([]byte, walBufferSize)
+
+	// read and parse header. the header of formatV1 has no version.
+	headerSize := 12
+	if format == formatV1 {
+		headerSize = 4
+	}
+	n, err := f.Read(buf[:])
+	if err != nil {
+		return 0, err
+	} else if n < headerSize {
+		return 0, fmt.Errorf("file header size is too short : %v", n)
 	}
 	total := binary.BigEndian.Uint32(buf[:4])
+	var version uint64
+	if format != formatV1 {
+		version = binary.BigEndian.Uint64(buf[4:12])
+	}
 	if total == 0 {
-		if n == 4 {
-			return nil
+		if n == headerSize {
+			return version, nil
 		} else {
-			return fmt.Errorf("total is 0. but db file have some data")
+			return 0, fmt.Errorf("total is 0. but db file have some data")
 		}
 	}
 
 	var (
-		head   = 4
+		head   = headerSize
 		size   = n
 		loaded uint32
+		// base is the offset of buf in the data file
+		base int64
 	)
 
 	// read all data
 	for {
 		var r Record
-		n, err = r.Deserialize(buf[head:size])
+		n, err = r.deserialize(buf[head:size], format)
 		if err == ErrBufferShort {
-			if size-head == 4096 {
-				// buffer size (4096) is too short for this log
-				// TODO: allocate and read directly to db buffer
-				return err
+			if size-head == len(buf) {
+				// the record is larger than the whole buffer. grow the buffer to read the rest of it.
+				buf = append(buf, make([]byte, len(buf))...)
 			}
 
 			// move data to head
-			copy(buf[:], buf[head:size])
+			copy(buf, buf[head:size])
+			base += int64(head)
 			size -= head
+			head = 0
 
 			// read more log data to buffer
 			n, err = f.Read(buf[size:])
@@ -503,15 +1660,25 @@ func (s *Storage) LoadCheckPoint() error {
 			if err == io.EOF {
 				break
 			} else if err != nil {
-				return err
+				return 0, err
 			}
 			continue
 		} else if err != nil {
-			return err
+			return 0, err
 		}
 
 		// set data
-		s.db[r.Key] = r
+		ent := &mapEntry{value: r.Value, version: r.Version}
+		e.remove(e.records.set(r.Key, ent))
+		if e.vlog != nil {
+			ent.value, ent.cold, ent.size = nil, true, uint32(len(r.Value))
+			ent.offset = base + int64(head) + int64(recordHeaderSize(format)+len(r.Key))
+			e.ncold++
+		} else if e.memory += int64(len(r.Value)); e.maxMemory > 0 {
+			ent.offset = base + int64(head) + int64(recordHeaderSize(format)+len(r.Key))
+			ent.elem = e.lru.PushFront(ent)
+			e.evict()
+		}
 		loaded++
 		head += n
 
@@ -522,18 +1689,47 @@ func (s *Storage) LoadCheckPoint() error {
 	}
 
 	if loaded != total {
-		return fmt.Errorf("db file is broken : total %v records but actually %v records", total, loaded)
+		return 0, fmt.Errorf("db file is broken : total %v records but actually %v records", total, loaded)
 	} else if size != 0 {
-		return fmt.Errorf("db file is broken : file size is larger than expected")
+		return 0, fmt.Errorf("db file is broken : file size is larger than expected")
 	}
-	return nil
+	if e.maxMemory > 0 || e.vlog != nil {
+		e.f = f
+	}
+	return version, nil
 }
 
 type Txn struct {
-	s        *Storage
-	logs     []RecordLog
+	s    *Storage
+	logs []RecordLog
+	// pooled is the logs taken from logsPool which logs are appended to, or nil.
+	pooled   *[]RecordLog
 	readSet  map[string]*Record
 	writeSet map[string]int
+	// gid is the global transaction id if the transaction is prepared.
+	gid string
+	// begun is true after the first access of keys until Commit or Abort.
+	begun bool
+	// active is true while Shutdown waits for the transaction.
+	active bool
+	// start is the time when the transaction starts if it is traced by the slow log or hooks.
+	start time.Time
+	// lockWait is the total time waiting for record locks if traced by the slow log.
+	lockWait time.Duration
+	// hooks is the hooks set when the transaction is created, and id is its id for hooks.
+	hooks *Hooks
+	id    uint64
+	// actor is the client recorded by the audit log.
+	actor string
+	// durability is the durability level of commits of the transaction.
+	durability Durability
+	// idempotencyKey identifies the transaction among retries of the client, or empty.
+	idempotencyKey string
+	// sweeping is true if the transaction is the background expiration which reads expired
+	// records to delete them.
+	sweeping bool
+	// ctx aborts waits for record locks when it is done, or nil.
+	ctx context.Context
 }
 
 func (s *Storage) NewTxn() *Txn {
@@ -544,7 +1740,103 @@ func (s *Storage) NewTxn() *Txn {
 	}
 }
 
+// SetContext sets the context which aborts waits of the transaction for record locks with its
+// error when it is done, so that the deadline of the client is kept while the transaction is
+// blocked by other transactions. The transaction is still active, and should be aborted. It is
+// cleared after Commit or Abort.
+func (txn *Txn) SetContext(ctx context.Context) {
+	txn.ctx = ctx
+}
+
+// lock locks the record for write, waiting until the context of the transaction is done.
+func (txn *Txn) lock(key string) error {
+	start := txn.waitStart()
+	defer txn.waited(start)
+	if txn.ctx == nil {
+		txn.s.lock.Lock(key)
+		return nil
+	}
+	return txn.s.lock.LockContext(txn.ctx, key)
+}
+
+// rlock locks the record for read, waiting until the context of the transaction is done.
+func (txn *Txn) rlock(key string) error {
+	start := txn.waitStart()
+	defer txn.waited(start)
+	if txn.ctx == nil {
+		txn.s.lock.RLock(key)
+		return nil
+	}
+	return txn.s.lock.RLockContext(txn.ctx, key)
+}
+
+// upgrade upgrades the read lock of the record in readSet. If the context of the transaction is
+// done, the read lock is released and the record is removed from readSet.
+func (txn *Txn) upgrade(key string) (bool, error) {
+	start := txn.waitStart()
+	defer txn.waited(start)
+	if txn.ctx == nil {
+		return txn.s.lock.Upgrade(key), nil
+	}
+	upgraded, err := txn.s.lock.UpgradeContext(txn.ctx, key)
+	if err != nil {
+		delete(txn.readSet, key)
+	}
+	return upgraded, err
+}
+
+// autoCommit executes fn in a new transaction and commits it.
+// If fn or commit fails, the transaction is aborted.
+func (s *Storage) autoCommit(fn func(txn *Txn) error) error {
+	return s.autoCommitAs("", fn)
+}
+
+// autoCommitAs is autoCommit by the actor recorded by the audit log.
+func (s *Storage) autoCommitAs(actor string, fn func(txn *Txn) error) error {
+	txn := s.newPooledTxn()
+	defer putTxn(txn)
+	txn.SetActor(actor)
+	if err := fn(txn); err != nil {
+		txn.Abort()
+		return err
+	} else if len(txn.logs) == 0 {
+		// read only transaction does not need to write WAL
+		txn.Abort()
+		return nil
+	}
+	if err := txn.Commit(); err != nil {
+		txn.Abort()
+		return err
+	}
+	return nil
+}
+
+// Get reads the committed value of the record in a single operation transaction.
+func (s *Storage) Get(key string) ([]byte, error) {
+	txn := s.newPooledTxn()
+	defer putTxn(txn)
+	defer txn.Abort()
+	return txn.Read(key)
+}
+
+// Put inserts or updates the record in a single operation transaction and commits immediately.
+func (s *Storage) Put(key string, value []byte) error {
+	return s.autoCommit(func(txn *Txn) error {
+		return txn.Put(key, value)
+	})
+}
+
+// Delete deletes the record in a single operation transaction and commits immediately.
+func (s *Storage) Delete(key string) error {
+	return s.autoCommit(func(txn *Txn) error {
+		return txn.Delete(key)
+	})
+}
+
 func (txn *Txn) Read(key string) ([]byte, error) {
+	if err := txn.begin(); err != nil {
+		return nil, err
+	}
 	if r, ok := txn.readSet[key]; ok {
 		if r == nil {
 			return nil, ErrNotExist
@@ -559,20 +1851,205 @@ func (txn *Txn) Read(key string) ([]byte, error) {
 	}
 
 	// read lock
-	txn.s.lock.RLock(key)
+	if err := txn.rlock(key); err != nil {
+		return nil, err
+	}
 
 	txn.s.muDB.RLock()
-	r, ok := txn.s.db[key]
+	r, err := txn.getLive(key)
 	txn.s.muDB.RUnlock()
-	if !ok {
+	if err == ErrNotExist {
 		txn.readSet[key] = nil
 		return nil, ErrNotExist
+	} else if err != nil {
+		txn.s.lock.RUnlock(key)
+		return nil, err
 	}
 
 	txn.readSet[r.Key] = &r
 	return r.Value, nil
 }
 
+// First returns the smallest key and its value visible from the transaction.
+// Keys inserted or deleted by the transaction itself are taken into account, and internal keys
+// of the storage and keys of column families are skipped.
+// The returned key is read locked, but insertion of smaller keys by other transactions is not prevented.
+func (txn *Txn) First() (string, []byte, error) {
+	return txn.edge(false)
+}
+
+// Last returns the largest key and its value visible from the transaction.
+// Same as First, insertion of larger keys by other transactions is not prevented.
+func (txn *Txn) Last() (string, []byte, error) {
+	return txn.edge(true)
+}
+
+// edge finds the smallest or the largest (reverse) key and reads it.
+// if the engine is ordered, keys in db are visited only from the edge.
+func (txn *Txn) edge(reverse bool) (string, []byte, error) {
+	before := func(a, b string) bool { return a < b }
+	if reverse {
+		before = func(a, b string) bool { return a > b }
+	}
+	for {
+		var (
+			key   string
+			found bool
+		)
+
+		// keys written by this transaction
+		for k, idx := range txn.writeSet {
+			if txn.logs[idx].Action == LDelete || !txn.sameFamily(k, "") || hiddenKey("", k) {
+				continue
+			}
+			if !found || before(k, key) {
+				key, found = k, true
+			}
+		}
+
+		// keys committed in db
+		keys, ordered := txn.s.db.Keys, false
+		if e, ok := orderedOf(txn.s.db); ok {
+			ordered = true
+			if reverse {
+				keys = e.KeysReverse
+			}
+		}
+		txn.s.muDB.RLock()
+		err := keys("", func(k string) bool {
+			if hiddenKey("", k) {
+				return true
+			} else if idx, ok := txn.writeSet[k]; ok && txn.logs[idx].Action == LDelete {
+				return true
+			} else if r, ok := txn.readSet[k]; ok && r == nil {
+				// the expired record is read as not exist until deleted
+				return true
+			}
+			if !found || before(k, key) {
+				key, found = k, true
+			}
+			// following keys of ordered engine are not before k
+			return !ordered
+		})
+		txn.s.muDB.RUnlock()
+
+		if err != nil {
+			return "", nil, err
+		} else if !found {
+			return "", nil, ErrNotExist
+		}
+
+		v, err := txn.Read(key)
+		if err == ErrNotExist {
+			// the key is deleted by other transaction before read lock. retry.
+			continue
+		} else if err != nil {
+			return "", nil, err
+		}
+		return key, v, nil
+	}
+}
+
+// sameFamily returns whether key belongs to the column family of prefix.
+func (txn *Txn) sameFamily(key, prefix string) bool {
+	if txn.s.families == nil {
+		return true
+	}
+	name, _ := splitFamilyKey(key)
+	pname, _ := splitFamilyKey(prefix)
+	return name == pname
+}
+
+// Scan calls fn for each record whose key has the prefix in key order.
+// Each record is read locked, but insertion of new keys by other transactions is not prevented.
+// Internal keys of the storage are not visited unless prefix is internal.
+// If fn returns error, Scan stops and returns it.
+func (txn *Txn) Scan(prefix string, fn func(key string, value []byte) error) error {
+	var keys []string
+
+	// keys written by this transaction
+	for k, idx := range txn.writeSet {
+		if txn.logs[idx].Action != LDelete && strings.HasPrefix(k, prefix) && txn.sameFamily(k, prefix) && !hiddenKey(prefix, k) {
+			keys = append(keys, k)
+		}
+	}
+
+	// keys committed in db
+	txn.s.muDB.RLock()
+	err := txn.s.db.Keys(prefix, func(k string) bool {
+		if _, ok := txn.writeSet[k]; !ok && !hiddenKey(prefix, k) {
+			keys = append(keys, k)
+		}
+		return true
+	})
+	txn.s.muDB.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	sort.Strings(keys)
+	for _, k := range keys {
+		v, err := txn.Read(k)
+		if err == ErrNotExist {
+			// the key is deleted by other transaction before read lock
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err = fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UpdateIfVersion updates the record only if its committed version is the expected one.
+// It fails fast with ErrVersion and keeps the read lock, so that clients can retry optimistically
+// with the version read in another transaction.
+func (txn *Txn) UpdateIfVersion(key string, value []byte, version uint64) error {
+	if _, err := txn.Read(key); err != nil {
+		return err
+	}
+	if v, err := txn.committedVersion(key); err != nil {
+		return err
+	} else if v != version {
+		txn.s.metrics.conflict()
+		return ErrVersion
+	}
+	return txn.Update(key, value)
+}
+
+// committedVersion returns the committed version of the record read or written by this transaction.
+// The record must be locked by the transaction.
+func (txn *Txn) committedVersion(key string) (uint64, error) {
+	if r, ok := txn.readSet[key]; ok {
+		if r == nil {
+			return 0, nil
+		}
+		return r.Version, nil
+	}
+	txn.s.muDB.RLock()
+	r, err := txn.s.db.Get(key)
+	txn.s.muDB.RUnlock()
+	if err != nil && err != ErrNotExist {
+		return 0, err
+	}
+	return r.Version, nil
+}
+
+// ReadVersioned reads the record and returns its value with the commit version.
+// The version of the record written by this transaction is 0 because it is not committed yet.
+func (txn *Txn) ReadVersioned(key string) ([]byte, uint64, error) {
+	v, err := txn.Read(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, ok := txn.writeSet[key]; ok {
+		return v, 0, nil
+	}
+	return v, txn.readSet[key].Version, nil
+}
+
 func clone(v []byte) []byte {
 	// TODO: support NULL value
 	v2 := make([]byte, len(v))
@@ -583,6 +2060,9 @@ func clone(v []byte) []byte {
 // ensureNotExist check readSet and writeSet step by step that there IS NOT the record.
 // This method is used by Insert.
 func (txn *Txn) ensureNotExist(key string) (string, error) {
+	if err := txn.begin(); err != nil {
+		return "", err
+	}
 	if r, ok := txn.readSet[key]; ok {
 		if r != nil {
 			return "", ErrExist
@@ -590,7 +2070,10 @@ func (txn *Txn) ensureNotExist(key string) (string, error) {
 		// reallocate string
 		key = string(key)
 
-		if !txn.s.lock.Upgrade(key) {
+		if upgraded, err := txn.upgrade(key); err != nil {
+			return "", err
+		} else if !upgraded {
+			txn.s.metrics.conflict()
 			return "", ErrDeadLock
 		}
 		// move record from readSet to writeSet
@@ -604,19 +2087,24 @@ func (txn *Txn) ensureNotExist(key string) (string, error) {
 		key = rec.Key
 	} else {
 		// lock record
-		txn.s.lock.Lock(key)
+		if err := txn.lock(key); err != nil {
+			return "", err
+		}
 
 		// reallocate string
 		key = string(key)
 
 		// check that the key not exists in db
 		txn.s.muDB.RLock()
-		r, ok := txn.s.db[key]
+		r, err := txn.getLive(key)
 		txn.s.muDB.RUnlock()
-		if ok {
+		if err == nil {
 			txn.readSet[key] = &r
 			txn.s.lock.Downgrade(key)
 			return "", ErrExist
+		} else if err != ErrNotExist {
+			txn.s.lock.Unlock(key)
+			return "", err
 		}
 	}
 
@@ -626,6 +2114,9 @@ func (txn *Txn) ensureNotExist(key string) (string, error) {
 // ensureExist check readSet and writeSet step by step that there IS the record.
 // This method is used by Update, Delete.
 func (txn *Txn) ensureExist(key string) (newKey string, err error) {
+	if err = txn.begin(); err != nil {
+		return "", err
+	}
 	if r, ok := txn.readSet[key]; ok {
 		if r == nil {
 			return "", ErrNotExist
@@ -633,7 +2124,10 @@ func (txn *Txn) ensureExist(key string) (newKey string, err error) {
 
 		// reuse key in readSet
 		key = r.Key
-		if !txn.s.lock.Upgrade(key) {
+		if upgraded, err := txn.upgrade(key); err != nil {
+			return "", err
+		} else if !upgraded {
+			txn.s.metrics.conflict()
 			return "", ErrDeadLock
 		}
 		// move record from readSet to writeSet
@@ -647,17 +2141,22 @@ func (txn *Txn) ensureExist(key string) (newKey string, err error) {
 		key = rec.Key
 	} else {
 		// lock record
-		txn.s.lock.Lock(key)
+		if err := txn.lock(key); err != nil {
+			return "", err
+		}
 
 		// check that the key exists in db
 		txn.s.muDB.RLock()
-		r, ok := txn.s.db[key]
+		r, err := txn.getLive(key)
 		txn.s.muDB.RUnlock()
-		if !ok {
+		if err == ErrNotExist {
 			key = string(key)
 			txn.readSet[key] = nil
 			txn.s.lock.Downgrade(key)
 			return "", ErrNotExist
+		} else if err != nil {
+			txn.s.lock.Unlock(key)
+			return "", err
 		}
 		// reuse key in db
 		key = r.Key
@@ -670,13 +2169,15 @@ func (txn *Txn) Insert(key string, value []byte) error {
 	key, err := txn.ensureNotExist(key)
 	if err != nil {
 		return err
+	} else if err = txn.clearTTL(key); err != nil {
+		return err
 	}
 
 	// clone value to prevent injection after transaction
 	value = clone(value)
 
 	// add insert log
-	txn.logs = append(txn.logs, RecordLog{
+	txn.appendLog(RecordLog{
 		Action: LInsert,
 		Record: Record{
 			Key:   key,
@@ -699,7 +2200,7 @@ func (txn *Txn) Update(key string, value []byte) error {
 	value = clone(value)
 
 	// add update log
-	txn.logs = append(txn.logs, RecordLog{
+	txn.appendLog(RecordLog{
 		Action: LUpdate,
 		Record: Record{
 			Key:   key,
@@ -712,14 +2213,70 @@ func (txn *Txn) Update(key string, value []byte) error {
 	return nil
 }
 
+// Put inserts the record if not exists, or updates it.
+func (txn *Txn) Put(key string, value []byte) error {
+	if err := txn.Update(key, value); err != ErrNotExist {
+		return err
+	}
+	return txn.Insert(key, value)
+}
+
+// SetNX inserts the record only if it does not exist, and returns whether it is inserted.
+func (txn *Txn) SetNX(key string, value []byte) (bool, error) {
+	if err := txn.Insert(key, value); err == ErrExist {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// GetSet replaces the value of the record and returns the old value.
+// If the record does not exist, the record is inserted and nil is returned.
+func (txn *Txn) GetSet(key string, value []byte) ([]byte, error) {
+	var old []byte
+	err := txn.GetAndUpdate(key, func(v []byte) ([]byte, error) {
+		old = v
+		return value, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return old, nil
+}
+
+// GetAndUpdate reads the record, applies fn to the value and writes back the result.
+// If the record does not exist, fn is called with nil value and the result is inserted.
+// The error returned from fn is returned as it is, and nothing is written.
+func (txn *Txn) GetAndUpdate(key string, fn func(old []byte) ([]byte, error)) error {
+	old, err := txn.Read(key)
+	if err == ErrNotExist {
+		old = nil
+	} else if err != nil {
+		return err
+	}
+
+	value, err := fn(old)
+	if err != nil {
+		return err
+	}
+
+	if old == nil {
+		return txn.Insert(key, value)
+	}
+	return txn.Update(key, value)
+}
+
 func (txn *Txn) Delete(key string) error {
 	key, err := txn.ensureExist(key)
 	if err != nil {
 		return err
+	} else if err = txn.clearTTL(key); err != nil {
+		return err
 	}
 
 	// add delete log
-	txn.logs = append(txn.logs, RecordLog{
+	txn.appendLog(RecordLog{
 		Action: LDelete,
 		Record: Record{
 			Key: key,
@@ -732,35 +2289,108 @@ func (txn *Txn) Delete(key string) error {
 	return nil
 }
 
+// Commit commits the transaction. WAL is synced before it returns if the durability of the
+// transaction is Durable, or synced in background as CommitAsync if Lazy.
 func (txn *Txn) Commit() error {
+	if txn.durability == Lazy {
+		_, err := txn.CommitAsync()
+		return err
+	}
+	return txn.commit(nil)
+}
+
+// commit commits the transaction, whose WAL is synced by the syncer of CommitAsync if future is
+// not nil.
+func (txn *Txn) commit(future *CommitFuture) error {
+	if txn.gid != "" {
+		return txn.s.CommitPrepared(txn.gid)
+	} else if len(txn.logs) > 0 {
+		if err := txn.s.writable(); err != nil {
+			return err
+		}
+	}
+	info, err := txn.hookPreCommit()
+	if err != nil {
+		return err
+	}
+
+	// the rejected transaction keeps locks to be retried
+	admitted := len(txn.logs) > 0 && txn.s.raft == nil
+	if admitted {
+		if err = txn.s.admit(); err != nil {
+			return err
+		}
+	}
+
+	reads, writes := len(txn.readSet), len(txn.writeSet)
 	// clearnup readSet before save WAL (S2PL)
 	for key := range txn.readSet {
 		txn.s.lock.RUnlock(key)
 		delete(txn.readSet, key)
 	}
 
-	err := txn.s.SaveWAL(txn.logs)
-	if err != nil {
+	// write WAL and write back writeSet to db
+	var fsync time.Duration
+	if txn.s.raft == nil {
+		fsync, err = txn.s.commitLogs(txn.logs, txn.actor, txn.idempotencyKey, future)
+		if admitted {
+			txn.s.finishCommit()
+		}
+	} else if txn.idempotencyKey != "" {
+		err = errors.New("idempotency keys are not supported by Raft")
+	} else if len(txn.logs) > 0 {
+		// the leader writes WAL when the entry is applied
+		err = txn.s.raft.propose(txn.logs)
+	}
+	if err == errReplayedCommit {
+		// nothing is written, and the transaction ends as aborted
+		txn.traceEnd(reads, writes, 0, 0, false)
+		txn.hookAbort()
+		txn.end()
+		txn.release()
+		return nil
+	} else if err != nil {
 		return err
 	}
 
-	// write back writeSet to db (in memory)
-	txn.s.ApplyLogs(txn.logs)
-
 	// cleanup writeSet
 	for key := range txn.writeSet {
 		txn.s.lock.Unlock(key)
 		delete(txn.writeSet, key)
 	}
+	var version uint64
+	if len(txn.logs) > 0 {
+		txn.s.metrics.commits.Inc()
+		version = txn.logs[0].Version
+	}
+	txn.traceEnd(reads, writes, version, fsync, true)
+	txn.hookPostCommit(info, version)
+	txn.end()
 
-	// clear logs
-	// TODO: clear all key and value pointer and reuse logs memory
-	txn.logs = nil
+	// clear all keys and values, and reuse logs memory
+	txn.recycleLogs()
 
 	return nil
 }
 
 func (txn *Txn) Abort() {
+	if txn.gid != "" {
+		if err := txn.s.AbortPrepared(txn.gid); err != nil {
+			txn.s.logger().Error("failed to abort prepared transaction", "err", err)
+		}
+		return
+	}
+	if len(txn.logs) > 0 {
+		txn.s.metrics.aborts.Inc()
+	}
+	txn.traceEnd(len(txn.readSet), len(txn.writeSet), 0, 0, false)
+	txn.hookAbort()
+	txn.end()
+	txn.release()
+}
+
+// release releases all locks and discards logs.
+func (txn *Txn) release() {
 	for key := range txn.readSet {
 		txn.s.lock.RUnlock(key)
 		delete(txn.readSet, key)
@@ -769,7 +2399,7 @@ func (txn *Txn) Abort() {
 		txn.s.lock.Unlock(key)
 		delete(txn.writeSet, key)
 	}
-	txn.logs = nil
+	txn.recycleLogs()
 }
 
 func HandleTxn(r io.Reader, w io.WriteCloser, txn *Txn, storage *Storage, closeOnExit bool, wg *sync.WaitGroup) error {
@@ -778,11 +2408,18 @@ func HandleTxn(r io.Reader, w io.WriteCloser, txn *Txn, storage *Storage, closeO
 		defer wg.Done()
 	}
 	reader := bufio.NewReader(r)
+	// user is the name of authenticated user if ACL is enabled.
+	var user string
+	addr := remoteAddr(r)
+	authorize := func(key string, perm Perm) error {
+		return storage.acl.Authorize(user, key, perm)
+	}
 	for {
 		fmt.Fprintf(w, ">> ")
 		txt, err := reader.ReadString('\n')
 		if err != nil {
 			fmt.Fprintf(w, "failed to read command : %v\n", err)
+			txn.Abort()
 			return err
 		}
 
@@ -791,10 +2428,40 @@ func HandleTxn(r io.Reader, w io.WriteCloser, txn *Txn, storage *Storage, closeO
 		if len(cmd) == 0 || len(cmd[0]) == 0 {
 			continue
 		}
-		switch strings.ToLower(cmd[0]) {
+		op := strings.ToLower(cmd[0])
+		// txn is replaced after prepare, and user may be changed by auth
+		txn.SetActor(actorOf(user, addr))
+		if storage.acl != nil && user == "" && op != "auth" && op != "quit" && op != "exit" && op != "q" {
+			fmt.Fprintf(w, "%v : auth <user> <password> or auth <token>\n", ErrNoAuth)
+			continue
+		}
+		switch op {
+		case "auth":
+			if storage.acl == nil {
+				fmt.Fprintf(w, "failed to auth : ACL is not enabled\n")
+			} else if len(cmd) == 3 {
+				if err = storage.acl.Authenticate(cmd[1], cmd[2]); err != nil {
+					fmt.Fprintf(w, "failed to auth : %v\n", err)
+				} else {
+					user = cmd[1]
+					fmt.Fprintf(w, "authenticated as %q\n", user)
+				}
+			} else if len(cmd) == 2 {
+				if name, err := storage.acl.AuthenticateToken(cmd[1]); err != nil {
+					fmt.Fprintf(w, "failed to auth : %v\n", err)
+				} else {
+					user = name
+					fmt.Fprintf(w, "authenticated as %q\n", user)
+				}
+			} else {
+				fmt.Fprintf(w, "invalid command : auth <user> <password> or auth <token>\n")
+			}
+
 		case "insert":
 			if len(cmd) != 3 {
 				fmt.Fprintf(w, "invalid command : insert <key> <value>\n")
+			} else if err = authorize(cmd[1], PermWrite); err != nil {
+				fmt.Fprintf(w, "failed to insert : %v\n", err)
 			} else if err = txn.Insert(cmd[1], []byte(cmd[2])); err != nil {
 				fmt.Fprintf(w, "failed to insert : %v\n", err)
 			} else {
@@ -804,6 +2471,8 @@ func HandleTxn(r io.Reader, w io.WriteCloser, txn *Txn, storage *Storage, closeO
 		case "update":
 			if len(cmd) != 3 {
 				fmt.Fprintf(w, "invalid command : update <key> <value>\n")
+			} else if err = authorize(cmd[1], PermWrite); err != nil {
+				fmt.Fprintf(w, "failed to update : %v\n", err)
 			} else if err = txn.Update(cmd[1], []byte(cmd[2])); err != nil {
 				fmt.Fprintf(w, "failed to update : %v\n", err)
 			} else {
@@ -813,6 +2482,8 @@ func HandleTxn(r io.Reader, w io.WriteCloser, txn *Txn, storage *Storage, closeO
 		case "delete":
 			if len(cmd) != 2 {
 				fmt.Fprintf(w, "invalid command : delete <key>\n")
+			} else if err = authorize(cmd[1], PermWrite); err != nil {
+				fmt.Fprintf(w, "failed to delete : %v\n", err)
 			} else if err = txn.Delete(cmd[1]); err != nil {
 				fmt.Fprintf(w, "failed to delete : %v\n", err)
 			} else {
@@ -822,15 +2493,80 @@ func HandleTxn(r io.Reader, w io.WriteCloser, txn *Txn, storage *Storage, closeO
 		case "read":
 			if len(cmd) != 2 {
 				fmt.Fprintf(w, "invalid command : read <key>\n")
+			} else if err = authorize(cmd[1], PermRead); err != nil {
+				fmt.Fprintf(w, "failed to read : %v\n", err)
 			} else if v, err := txn.Read(cmd[1]); err != nil {
 				fmt.Fprintf(w, "failed to read : %v\n", err)
 			} else {
 				fmt.Fprintf(w, "%v\n", string(v))
 			}
 
-		case "commit":
+		case "readv":
+			if len(cmd) != 2 {
+				fmt.Fprintf(w, "invalid command : readv <key>\n")
+			} else if err = authorize(cmd[1], PermRead); err != nil {
+				fmt.Fprintf(w, "failed to read : %v\n", err)
+			} else if v, version, err := txn.ReadVersioned(cmd[1]); err != nil {
+				fmt.Fprintf(w, "failed to read : %v\n", err)
+			} else {
+				fmt.Fprintf(w, "%v %v\n", string(v), version)
+			}
+
+		case "updatev":
+			if len(cmd) != 4 {
+				fmt.Fprintf(w, "invalid command : updatev <key> <value> <version>\n")
+			} else if err = authorize(cmd[1], PermRead|PermWrite); err != nil {
+				fmt.Fprintf(w, "failed to update : %v\n", err)
+			} else if version, err := strconv.ParseUint(cmd[3], 10, 64); err != nil {
+				fmt.Fprintf(w, "invalid version : %v\n", err)
+			} else if err = txn.UpdateIfVersion(cmd[1], []byte(cmd[2]), version); err != nil {
+				fmt.Fprintf(w, "failed to update : %v\n", err)
+			} else {
+				fmt.Fprintf(w, "success to update %q\n", cmd[1])
+			}
+
+		case "first":
+			if len(cmd) != 1 {
+				fmt.Fprintf(w, "invalid command : first\n")
+			} else if err = authorize("", PermRead); err != nil {
+				// the first key is unknown before read
+				fmt.Fprintf(w, "failed to read first : %v\n", err)
+			} else if k, v, err := txn.First(); err != nil {
+				fmt.Fprintf(w, "failed to read first : %v\n", err)
+			} else {
+				fmt.Fprintf(w, "%s %s\n", k, string(v))
+			}
+
+		case "last":
 			if len(cmd) != 1 {
-				fmt.Fprintf(w, "invalid command : commit\n")
+				fmt.Fprintf(w, "invalid command : last\n")
+			} else if err = authorize("", PermRead); err != nil {
+				fmt.Fprintf(w, "failed to read last : %v\n", err)
+			} else if k, v, err := txn.Last(); err != nil {
+				fmt.Fprintf(w, "failed to read last : %v\n", err)
+			} else {
+				fmt.Fprintf(w, "%s %s\n", k, string(v))
+			}
+
+		case "idempotency-key":
+			// the commit of the transaction with the committed key is replied as committed
+			if len(cmd) != 2 {
+				fmt.Fprintf(w, "invalid command : idempotency-key <key>\n")
+			} else {
+				txn.SetIdempotencyKey(cmd[1])
+				fmt.Fprintf(w, "success to set idempotency key %s\n", cmd[1])
+			}
+
+		case "commit":
+			// "commit lazy" commits without waiting for the sync of WAL
+			if len(cmd) > 2 || len(cmd) == 2 && cmd[1] != "lazy" {
+				fmt.Fprintf(w, "invalid command : commit [lazy]\n")
+			} else if len(cmd) == 2 {
+				if _, err = txn.CommitAsync(); err != nil {
+					fmt.Fprintf(w, "failed to commit : %v\n", err)
+				} else {
+					fmt.Fprintf(w, "committed\n")
+				}
 			} else if err = txn.Commit(); err != nil {
 				fmt.Fprintf(w, "failed to commit : %v\n", err)
 			} else {
@@ -845,14 +2581,94 @@ func HandleTxn(r io.Reader, w io.WriteCloser, txn *Txn, storage *Storage, closeO
 				fmt.Fprintf(w, "aborted\n")
 			}
 
+		case "prepare":
+			if len(cmd) != 2 {
+				fmt.Fprintf(w, "invalid command : prepare <gid>\n")
+			} else if err = txn.Prepare(cmd[1]); err != nil {
+				fmt.Fprintf(w, "failed to prepare : %v\n", err)
+			} else {
+				// the prepared transaction is decided by commit-prepared or abort-prepared
+				// from any connection. this connection continues with a new transaction.
+				txn = storage.NewTxn()
+				fmt.Fprintf(w, "prepared %q\n", cmd[1])
+			}
+
+		case "commit-prepared":
+			if len(cmd) != 2 {
+				fmt.Fprintf(w, "invalid command : commit-prepared <gid>\n")
+			} else if err = storage.CommitPrepared(cmd[1]); err != nil {
+				fmt.Fprintf(w, "failed to commit prepared : %v\n", err)
+			} else {
+				fmt.Fprintf(w, "committed prepared %q\n", cmd[1])
+			}
+
+		case "abort-prepared":
+			if len(cmd) != 2 {
+				fmt.Fprintf(w, "invalid command : abort-prepared <gid>\n")
+			} else if err = storage.AbortPrepared(cmd[1]); err != nil {
+				fmt.Fprintf(w, "failed to abort prepared : %v\n", err)
+			} else {
+				fmt.Fprintf(w, "aborted prepared %q\n", cmd[1])
+			}
+
+		case "in-doubt":
+			if len(cmd) != 1 {
+				fmt.Fprintf(w, "invalid command : in-doubt\n")
+			} else {
+				fmt.Fprintf(w, "in doubt :%s\n", strings.Join(append([]string{""}, storage.Prepared()...), " "))
+			}
+
 		case "keys":
 			if len(cmd) != 1 {
 				fmt.Fprintf(w, "invalid command : keys\n")
 			} else {
 				fmt.Fprintf(w, ">>> show keys commited <<<\n")
-				for k, _ := range storage.db {
+				var keys []string
+				storage.muDB.RLock()
+				err = storage.db.Keys("", func(k string) bool {
+					if !hiddenKey("", k) && authorize(k, PermRead) == nil {
+						keys = append(keys, k)
+					}
+					return true
+				})
+				if err == nil {
+					keys, err = storage.liveKeys(keys)
+				}
+				storage.muDB.RUnlock()
+				for _, k := range keys {
+					fmt.Fprintf(w, "%s\n", k)
+				}
+				if err != nil {
+					fmt.Fprintf(w, "failed to read keys : %v\n", err)
+				}
+			}
+
+		case "info":
+			var buf bytes.Buffer
+			if err = storage.Info(&buf, cmd[1:]...); err != nil {
+				fmt.Fprintf(w, "failed to get info : %v\n", err)
+			} else {
+				fmt.Fprint(w, strings.ReplaceAll(buf.String(), "\r\n", "\n"))
+			}
+
+		case "scan":
+			count := 10
+			if len(cmd) == 3 {
+				if count, err = strconv.Atoi(cmd[2]); err != nil || count < 1 {
+					count = 0
+				}
+			}
+			if (len(cmd) != 2 && len(cmd) != 3) || count == 0 {
+				fmt.Fprintf(w, "invalid command : scan <cursor> [<count>]\n")
+			} else if keys, next, err := storage.ScanKeys(cmd[1], "", count, func(k string) bool {
+				return authorize(k, PermRead) == nil
+			}); err != nil {
+				fmt.Fprintf(w, "failed to scan keys : %v\n", err)
+			} else {
+				for _, k := range keys {
 					fmt.Fprintf(w, "%s\n", k)
 				}
+				fmt.Fprintf(w, "next cursor %s\n", next)
 			}
 
 		case "quit", "exit", "q":
@@ -866,107 +2682,595 @@ func HandleTxn(r io.Reader, w io.WriteCloser, txn *Txn, storage *Storage, closeO
 	}
 }
 
+// listenUnix listens the unix socket at path and restricts access to it by mode.
+// The stale socket left by crash is removed, but other files are not.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("unix socket is in use : %v", path)
+		}
+		if err = os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
 func main() {
-	walPath := flag.String("wal", "./txngo.log", "file path of WAL file")
-	dbPath := flag.String("db", "./txngo.db", "file path of data file")
+	dataDir := flag.String("dir", ".", "data directory of WAL, data file, replication and raft files, created if not exist")
+	walPath := flag.String("wal", "", "file path of WAL file (default <dir>/wal/txngo.log)")
+	dbPath := flag.String("db", "", "file path of data file (default <dir>/snapshots/txngo.db)")
 	isInit := flag.Bool("init", true, "create data file if not exist")
-	tcpaddr := flag.String("tcp", "", "tcp handler address (e.g. localhost:3000)")
-
+	listenAddr := flag.String("listen", "", "tcp address of transaction handler (e.g. localhost:3000)")
+	flag.StringVar(listenAddr, "tcp", "", "alias of -listen")
+	respAddr := flag.String("resp", "", "tcp address of Redis protocol (RESP) server (e.g. localhost:6379)")
+	memcachedAddr := flag.String("memcached", "", "tcp address of memcached text protocol server (e.g. localhost:11211)")
+	grpcAddr := flag.String("grpc", "", "tcp address of gRPC server of Txngo service in proto/txngo.proto (e.g. localhost:50051)")
+	tlsCert := flag.String("tls-cert", "", "file path of PEM encoded certificate to serve tcp servers over TLS")
+	tlsKey := flag.String("tls-key", "", "file path of PEM encoded private key of -tls-cert")
+	tlsClientCA := flag.String("tls-client-ca", "", "file path of PEM encoded CA certificates to require and verify client certificates")
+	unixPath := flag.String("unix", "", "file path of unix domain socket server")
+	adminAddr := flag.String("admin", "", "http address of admin server with /backup, /restore, /metrics, /healthz, /readyz, /stats, /slowlog, /debug/vars, /debug/pprof/, /debug/dump and maintenance endpoints (e.g. localhost:8080)")
+	dumpDir := flag.String("dump-dir", "", "directory which /debug/dump of admin server writes goroutine and heap profiles into (default temporary directory)")
+	minDiskFree := flag.Int64("min-disk-free", 64<<20, "disk headroom in bytes of WAL required by /readyz of admin server (0 disables)")
+	aclPath := flag.String("acl", "", "file path of users and grants to require authentication in servers")
+	unixProtocol := flag.String("unix-protocol", "txn", "protocol served over unix domain socket (txn, resp or memcached)")
+	unixMode := flag.Uint("unix-mode", 0600, "file permission of unix domain socket")
+	engineName := flag.String("engine", "map", "storage engine (map, btree, hash or lsm)")
+	cachePages := flag.Int("cache-pages", defaultCachePages, "number of pages cached in buffer pool for btree and hash engine (0 disables)")
+	useMmap := flag.Bool("mmap", false, "read data file via mmap instead of buffer pool for btree and hash engine")
+	maxMemory := flag.Int64("max-memory", 0, "memory budget in bytes for values of map engine. cold values are evicted to data file (0 is unlimited)")
+	valuesOnDisk := flag.Bool("values-on-disk", false, "keep only keys in memory and read values from disk on demand for map engine")
+	coldTier := flag.String("cold-tier", "", "slower tier which records not accessed recently are demoted into at checkpoint, file for compressed <db>.cold or URL of object store as -ship-to")
+	coldAfter := flag.Duration("cold-after", defaultColdAfter, "demote records into -cold-tier which are not accessed for the duration (0 disables)")
+	maxHotRecords := flag.Int("max-hot-records", 0, "demote least recently accessed records into -cold-tier beyond the number (0 is unlimited)")
+	masterKeyPath := flag.String("master-key", "", "file path of hex encoded 32 bytes master key to encrypt values in data file and WAL")
+	compress := flag.Bool("compress", false, "compress large values in data file (data file must be created with this option)")
+	columnFamilies := flag.String("column-families", "", "comma separated column families as name=engine[+compress] which have their own data files (e.g. cache=map,logs=lsm+compress)")
+	partitions := flag.Int("partitions", 1, "number of hash partitions which have their own data files")
+	replicationAddr := flag.String("replication", "", "tcp address to stream WAL to replicas as the primary (e.g. localhost:4500)")
+	replicationDir := flag.String("replication-dir", "", "directory of WAL segments retained for replicas (default <dir>/replication)")
+	replicationRetain := flag.Int64("replication-retain-bytes", 1<<30, "max total size of WAL segments retained for replicas (0 is unlimited)")
+	shipTo := flag.String("ship-to", "", "object store to ship WAL segments and snapshots to as s3://bucket/prefix?endpoint=url&region=region or file:///dir (credentials are AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY)")
+	shipSegmentInterval := flag.Duration("ship-segment-interval", defaultSegmentInterval, "max interval to upload WAL segments being filled, which bounds commits lost with the disk")
+	shipSnapshotInterval := flag.Duration("ship-snapshot-interval", defaultSnapshotInterval, "interval of uploading snapshots to the object store")
+	replicaOf := flag.String("replica-of", "", "replication address of the primary to replicate from. SIGUSR1 promotes the replica")
+	replicaID := flag.String("replica-id", "", "id of this replica tracked by the primary (default hostname)")
+	failoverTimeout := flag.Duration("replica-failover-timeout", 0, "promote the replica automatically when the primary does not respond for the duration (0 disables)")
+	auditPath := flag.String("audit-log", "", "file path of hash chained audit log of committed mutations")
+	auditSync := flag.Bool("audit-sync", true, "sync the audit log for each commit")
+	cdcFile := flag.String("cdc-file", "", "file path to append changes of commits as JSON lines by change data capture")
+	cdcNATS := flag.String("cdc-nats", "", "address of NATS server to publish changes of commits as JSON messages by change data capture")
+	cdcNATSSubject := flag.String("cdc-nats-subject", "txngo.changes", "subject of NATS messages of -cdc-nats")
+	webhookDefs := flag.String("webhooks", "", "comma separated webhooks as name=url[+prefix...] which receive summaries of commits writing keys with the prefixes (e.g. orders=http://localhost:9000/hook+order/)")
+	raftID := flag.String("raft-id", "", "id of this node in -raft-peers to replicate transactions by Raft")
+	raftPeers := flag.String("raft-peers", "", "comma separated members of Raft cluster as id=host:port including this node (e.g. n1=10.0.0.1:4000,n2=10.0.0.2:4000,n3=10.0.0.3:4000)")
+	raftDir := flag.String("raft-dir", "", "directory of Raft state and log files (default <dir>/raft)")
+	raftSnapshotEntries := flag.Uint64("raft-snapshot-entries", 10000, "number of applied Raft entries which triggers checkpoint and compaction of Raft log (0 disables)")
+	slowTxn := flag.Duration("slow-txn", 0, "record transactions longer than the duration into the slow log (0 disables)")
+	slowLockWait := flag.Duration("slow-lock-wait", 0, "record transactions waiting for locks longer than the duration into the slow log (0 disables)")
+	slowFsync := flag.Duration("slow-fsync", 0, "record commits whose fsync of WAL is longer than the duration into the slow log (0 disables)")
+	checkpointSize := flag.Int64("checkpoint-size", 64<<20, "WAL size in bytes which triggers checkpoint for btree, hash and lsm engine (0 disables)")
+	checkpointInterval := flag.Duration("checkpoint-interval", 0, "interval of checkpoint in background while WAL grows (0 disables)")
+	expireInterval := flag.Duration("expire-interval", defaultExpireInterval, "interval of background expiration which deletes records whose TTL passes (negative disables)")
+	expireBatch := flag.Int("expire-batch", defaultExpireBatch, "maximum number of records deleted by each round of background expiration")
+	maxPendingCommits := flag.Int("max-pending-commits", 0, "number of commits writing WAL or waiting for its sync beyond which commits are throttled (0 is unlimited)")
+	maxWALSize := flag.Int64("max-wal-size", 0, "WAL size in bytes beyond which commits are throttled until checkpoint (0 is unlimited)")
+	overload := flag.String("overload", OverloadBlock, "how throttled commits wait (block, timeout or reject)")
+	overloadTimeout := flag.Duration("overload-timeout", time.Second, "time throttled commits wait for -overload timeout")
+	noWAL := flag.Bool("no-wal", false, "run without WAL file. commits are durable only after checkpoint at shutdown or by -checkpoint-interval")
+	inMemory := flag.Bool("in-memory", false, "keep records only in memory without WAL and data file for caches (map engine)")
+	syncMode := flag.String("sync-mode", SyncAlways, "when WAL is synced (always at each commit, or none to leave it to the OS until checkpoint)")
+	recoveryPolicy := flag.String("recovery-policy", RecoveryStrict, "how corrupt logs in WAL are recovered (strict, truncate or skip)")
+	compactOnOpen := flag.Bool("compact-on-open", false, "rewrite data files into the minimal size and truncate WAL at start before serving")
+	selfCheck := flag.String("self-check", SelfCheckOff, "verification on start (off, fast to spot-check records, commit versions and MANIFEST, or thorough to verify everything)")
+	selfCheckStrict := flag.Bool("self-check-strict", false, "refuse to start if -self-check finds fatal problems")
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintf(flag.CommandLine.Output(), "Each flag is also set by the environment variable %sFLAG_NAME (e.g. %s for -sync-mode).\n", envPrefix, envName("sync-mode"))
+	}
+	// flags are set by environment variables such as TXNGO_DIR, and overridden by the command line
+	if err := setFlagsFromEnv(flag.CommandLine, os.LookupEnv); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitUsage)
+	}
 	flag.Parse()
+	if err := os.MkdirAll(*dataDir, 0700); err != nil {
+		log.Println("failed to create data directory :", err)
+		return
+	}
+	*replicationDir = inDir(*dataDir, *replicationDir, defaultReplicationName)
+	*raftDir = inDir(*dataDir, *raftDir, defaultRaftName)
+
+	opts := Options{
+		Dir:                *dataDir,
+		WALPath:            *walPath,
+		DBPath:             *dbPath,
+		MustExist:          !*isInit,
+		Backend:            *engineName,
+		CachePages:         *cachePages,
+		Mmap:               *useMmap,
+		MaxMemory:          *maxMemory,
+		ValuesOnDisk:       *valuesOnDisk,
+		ColdTier:           *coldTier,
+		TierPolicy:         TierPolicy{ColdAfter: *coldAfter, MaxHotRecords: *maxHotRecords},
+		Compress:           *compress,
+		Partitions:         *partitions,
+		CheckpointSize:     *checkpointSize,
+		CheckpointInterval: *checkpointInterval,
+		ExpireInterval:     *expireInterval,
+		ExpireBatch:        *expireBatch,
+		Admission:          AdmissionOptions{MaxPending: *maxPendingCommits, MaxWALSize: *maxWALSize, Policy: *overload, Timeout: *overloadTimeout},
+		SyncMode:           *syncMode,
+		RecoveryPolicy:     *recoveryPolicy,
+		CompactOnOpen:      *compactOnOpen,
+		SelfCheck:          *selfCheck,
+		SelfCheckStrict:    *selfCheckStrict,
+		DisableWAL:         *noWAL || *inMemory,
+	}
+	if *inMemory {
+		opts.Dir, opts.DBPath = "", ""
+	}
+	// subcommands read WAL and data files in the data directory before Open
+	opts.layout()
+	if *columnFamilies != "" {
+		for _, def := range strings.Split(*columnFamilies, ",") {
+			// name=engine[+compress]
+			family := FamilyOptions{Name: def}
+			if i := strings.IndexByte(def, '='); i >= 0 {
+				opts := strings.Split(def[i+1:], "+")
+				family.Name, family.Backend = def[:i], opts[0]
+				for _, opt := range opts[1:] {
+					if opt != "compress" {
+						log.Printf("option of column family %q is not supported : %v\n", family.Name, opt)
+						return
+					}
+					family.Compress = true
+				}
+			}
+			opts.ColumnFamilies = append(opts.ColumnFamilies, family)
+		}
+	}
+	if *masterKeyPath != "" {
+		master, err := readMasterKey(*masterKeyPath)
+		if err != nil {
+			log.Println("failed to read master key :", err)
+			return
+		}
+		opts.MasterKey = master
+	}
 
-	wal, err := os.OpenFile(*walPath, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0600)
-	if err != nil {
-		log.Panic(err)
+	var tlsConfig *tlsReloader
+	if *tlsCert != "" || *tlsKey != "" {
+		var err error
+		if tlsConfig, err = newTLSReloader(*tlsCert, *tlsKey, *tlsClientCA); err != nil {
+			log.Println("failed to load TLS certificate :", err)
+			return
+		}
+	} else if *tlsClientCA != "" {
+		log.Println("-tls-client-ca requires -tls-cert and -tls-key")
+		return
 	}
-	defer wal.Close()
 
-	storage := NewStorage(wal, *dbPath, *dbPath+".tmp")
+	if flag.Arg(0) == "bench" {
+		// txngo [flags] bench -workload read-heavy
+		os.Exit(runBenchCommand(opts, flag.Args()[1:], os.Stdout, os.Stderr))
+	} else if flag.Arg(0) == "recover" {
+		// txngo [flags] recover -dry-run
+		os.Exit(runRecoverCommand(opts, flag.Args()[1:], os.Stdout, os.Stderr))
+	} else if flag.Arg(0) == "repair" {
+		// txngo [flags] repair -out /var/lib/txngo.repaired
+		os.Exit(runRepairCommand(opts, flag.Args()[1:], os.Stdout, os.Stderr))
+	} else if flag.Arg(0) == "import" {
+		// txngo [flags] import -from=bolt -skip-wal bolt.db
+		os.Exit(runImportCommand(opts, flag.Args()[1:], os.Stdin, os.Stdout, os.Stderr))
+	} else if flag.Arg(0) == "export" {
+		// txngo [flags] export -format=sqlite out.db
+		os.Exit(runExportCommand(opts, flag.Args()[1:], os.Stdout, os.Stderr))
+	} else if flag.Arg(0) == "upgrade" {
+		// txngo [flags] upgrade -backup /var/lib/txngo.backup /var/lib/txngo
+		os.Exit(runUpgradeCommand(opts, flag.Args()[1:], os.Stdout, os.Stderr))
+	} else if flag.Arg(0) == "bootstrap" {
+		// txngo [flags] bootstrap s3://backups/node1?region=ap-northeast-1
+		os.Exit(runBootstrapCommand(opts, flag.Args()[1:], os.Stdout, os.Stderr))
+	} else if flag.Arg(0) == "stats" {
+		// txngo [flags] stats -depth 2 -json
+		os.Exit(runStatsCommand(opts, *replicationDir, flag.Args()[1:], os.Stdout, os.Stderr))
+	} else if flag.NArg() > 0 {
+		// txngo [flags] get KEY
+		os.Exit(runCommand(opts, flag.Args(), os.Stdout, os.Stderr))
+	}
 
-	log.Println("loading data file...")
-	if err = storage.LoadCheckPoint(); os.IsNotExist(err) && *isInit {
-		log.Println("db file is not found. this is initial start.")
-	} else if err != nil {
-		log.Printf("failed to load data file : %v\n", err)
-		return
+	// the admin server reports health while recovering
+	var (
+		admin       *http.Server
+		adminServer *AdminServer
+	)
+	if *adminAddr != "" {
+		l, err := net.Listen("tcp", *adminAddr)
+		if err != nil {
+			log.Println("failed to listen admin server :", err)
+			return
+		} else if tlsConfig != nil {
+			l = tls.NewListener(l, tlsConfig.Config())
+		}
+		adminServer = NewAdminServer(nil)
+		adminServer.MinDiskFree = *minDiskFree
+		adminServer.DumpDir = *dumpDir
+		admin = &http.Server{Handler: adminServer}
+		go admin.Serve(l)
 	}
 
-	log.Println("loading WAL file...")
-	if nlogs, err := storage.LoadWAL(); err != nil {
-		log.Printf("failed to load WAL file : %v\n", err)
+	opts.RecoveryProgress = func(p RecoveryProgress) {
+		if p.Done {
+			log.Printf("recovered %d records of %d transactions from %d bytes of WAL in %v\n", p.Records, p.Transactions, p.TotalBytes, p.Elapsed)
+		} else {
+			log.Printf("recovering WAL : %d / %d bytes, %d records applied, %v remaining\n", p.BytesReplayed, p.TotalBytes, p.Records, p.Remaining.Round(time.Second))
+		}
+		if adminServer != nil {
+			adminServer.ReportRecovery(p)
+		}
+	}
+	storage, err := Open(opts)
+	if err != nil {
+		log.Println("failed to open :", err)
 		return
-	} else if nlogs != 0 {
-		log.Println("previous shutdown is not success...")
-		log.Println("update data file...")
-		if err = storage.SaveCheckPoint(); err != nil {
-			log.Printf("failed to save checkpoint %v\n", err)
+	}
+	// early returns by errors below close the storage too
+	defer storage.Close()
+
+	var raftNode *RaftNode
+	if *raftID != "" {
+		addrs := make(map[string]string)
+		var peers []string
+		for _, member := range strings.Split(*raftPeers, ",") {
+			i := strings.IndexByte(member, '=')
+			if i < 0 {
+				log.Println("invalid raft member :", member)
+				return
+			}
+			addrs[member[:i]] = member[i+1:]
+			if member[:i] != *raftID {
+				peers = append(peers, member[:i])
+			}
+		}
+		addr, ok := addrs[*raftID]
+		if !ok {
+			log.Printf("raft id %q is not in -raft-peers\n", *raftID)
+			return
+		}
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			log.Println("failed to listen raft :", err)
 			return
 		}
-		log.Println("clear WAL file...")
-		if err = storage.ClearWAL(); err != nil {
-			log.Printf("failed to clear WAL file %v\n", err)
+		defer l.Close()
+		raftNode, err = StartRaft(storage, RaftConfig{
+			ID:              *raftID,
+			Peers:           peers,
+			Dir:             *raftDir,
+			Transport:       NewHTTPRaftTransport(addrs),
+			SnapshotEntries: *raftSnapshotEntries,
+		})
+		if err != nil {
+			log.Println("failed to start raft :", err)
 			return
 		}
+		go http.Serve(l, raftNode)
 	}
 
-	log.Println("start transactions")
-
-	if *tcpaddr == "" {
-		// stdio handler
-		txn := storage.NewTxn()
-		err = HandleTxn(os.Stdin, os.Stdout, txn, storage, false, nil)
+	if *replicationAddr != "" || *shipTo != "" {
+		err = storage.EnableReplication(ReplicationOptions{Dir: *replicationDir, RetainBytes: *replicationRetain})
 		if err != nil {
-			log.Println("failed to handle", err)
+			log.Println("failed to enable replication :", err)
+			return
 		}
-		log.Println("shutdown...")
-	} else {
-		// tcp handler
-		l, err := net.Listen("tcp", *tcpaddr)
+	}
+	if *shipTo != "" {
+		store, prefix, err := OpenObjectStore(*shipTo)
+		if err != nil {
+			log.Println("failed to open object store :", err)
+			return
+		}
+		shipper, err := storage.StartShipping(store, ShippingOptions{
+			Prefix:           prefix,
+			SegmentInterval:  *shipSegmentInterval,
+			SnapshotInterval: *shipSnapshotInterval,
+		})
 		if err != nil {
-			log.Println("failed to listen tcp :", err)
+			log.Println("failed to start shipping :", err)
 			return
 		}
-		var wg sync.WaitGroup
+		defer shipper.Stop()
+	}
+	if *slowTxn > 0 || *slowLockWait > 0 || *slowFsync > 0 {
+		if err = storage.EnableSlowLog(SlowLogOptions{Duration: *slowTxn, LockWait: *slowLockWait, Fsync: *slowFsync}); err != nil {
+			log.Println("failed to enable slow log :", err)
+			return
+		}
+	}
+	if *auditPath != "" {
+		audit, err := OpenAuditLog(*auditPath, *auditSync)
+		if err != nil {
+			log.Println("failed to open audit log :", err)
+			return
+		}
+		defer audit.Close()
+		if err = storage.EnableAudit(audit); err != nil {
+			log.Println("failed to enable audit log :", err)
+			return
+		}
+	}
+	if *cdcFile != "" {
+		sink, err := NewFileSink(*cdcFile)
+		if err != nil {
+			log.Println("failed to open CDC file :", err)
+			return
+		}
+		feed, err := StartFeed(storage, "file", sink, FeedOptions{})
+		if err != nil {
+			sink.Close()
+			log.Println("failed to start CDC :", err)
+			return
+		}
+		defer feed.Stop()
+	}
+	if *cdcNATS != "" {
+		sink, err := NewNATSSink(*cdcNATS, *cdcNATSSubject)
+		if err != nil {
+			log.Println("failed to create NATS sink :", err)
+			return
+		}
+		feed, err := StartFeed(storage, "nats", sink, FeedOptions{})
+		if err != nil {
+			log.Println("failed to start CDC :", err)
+			return
+		}
+		defer feed.Stop()
+	}
+	if *webhookDefs != "" {
+		var hooks []Webhook
+		for _, def := range strings.Split(*webhookDefs, ",") {
+			// name=url[+prefix...]
+			i := strings.IndexByte(def, '=')
+			if i < 0 {
+				log.Printf("webhook must be name=url : %v\n", def)
+				return
+			}
+			fields := strings.Split(def[i+1:], "+")
+			hooks = append(hooks, Webhook{Name: def[:i], URL: fields[0], Prefixes: fields[1:]})
+		}
+		webhooks, err := StartWebhooks(storage, hooks, WebhookOptions{})
+		if err != nil {
+			log.Println("failed to start webhooks :", err)
+			return
+		}
+		defer webhooks.Stop()
+	}
+	var replica *Replica
+	if *replicaOf != "" {
+		id := *replicaID
+		if id == "" {
+			if id, err = os.Hostname(); err != nil {
+				log.Println("failed to get hostname :", err)
+				return
+			}
+		}
+		dial := func() (net.Conn, error) {
+			if tlsConfig != nil {
+				return tls.Dial("tcp", *replicaOf, tlsConfig.ClientConfig())
+			}
+			return net.Dial("tcp", *replicaOf)
+		}
+		replica = StartReplica(storage, id, dial, ReplicaOptions{FailoverTimeout: *failoverTimeout})
+		chusr := make(chan os.Signal, 1)
+		if len(promoteSignals) > 0 {
+			signal.Notify(chusr, promoteSignals...)
+		}
+		go func() {
+			<-chusr
+			if err := replica.Promote(); err != nil {
+				log.Println("failed to promote replica :", err)
+			}
+		}()
+	}
+
+	log.Println("start transactions")
+
+	var (
+		wg        sync.WaitGroup
+		listeners []net.Listener
+	)
+	// serve accepts connections in background until the listener is closed
+	serve := func(network, addr string, handle func(conn net.Conn)) bool {
+		var (
+			l   net.Listener
+			err error
+		)
+		if network == "unix" {
+			l, err = listenUnix(addr, os.FileMode(*unixMode)&os.ModePerm)
+		} else {
+			l, err = net.Listen(network, addr)
+		}
+		if err == nil && network == "tcp" && tlsConfig != nil {
+			l = tls.NewListener(l, tlsConfig.Config())
+		}
+		if err != nil {
+			log.Printf("failed to listen %v : %v\n", network, err)
+			return false
+		}
+		listeners = append(listeners, l)
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
 			for {
 				conn, err := l.Accept()
 				if err != nil {
-					log.Println("failed to accept tcp :", err)
+					log.Println("failed to accept :", err)
 					break
 				}
 				log.Println("accept new conn :", conn.RemoteAddr())
-				txn := storage.NewTxn()
 				wg.Add(1)
-				go HandleTxn(conn, conn, txn, storage, true, &wg)
+				go handle(conn)
 			}
 		}()
+		return true
+	}
+
+	handlers := map[string]func(conn net.Conn){
+		"txn": func(conn net.Conn) {
+			HandleTxn(conn, conn, storage.NewTxn(), storage, true, &wg)
+		},
+		"resp": func(conn net.Conn) {
+			HandleRESP(conn, conn, storage, &wg)
+		},
+		"memcached": func(conn net.Conn) {
+			HandleMemcached(conn, conn, storage, &wg)
+		},
+		"replication": func(conn net.Conn) {
+			HandleReplication(conn, storage, &wg)
+		},
+	}
+
+	if *listenAddr == "" && *respAddr == "" && *memcachedAddr == "" && *grpcAddr == "" && *unixPath == "" && *replicationAddr == "" && *adminAddr == "" {
+		// stdio handler
+		txn := storage.NewTxn()
+		err = HandleTxn(os.Stdin, os.Stdout, txn, storage, false, nil)
+		if err != nil {
+			log.Println("failed to handle", err)
+		}
+		log.Println("shutdown...")
+	} else {
+		if *aclPath != "" {
+			acl, err := LoadACL(*aclPath)
+			if err != nil {
+				log.Println("failed to load ACL :", err)
+				return
+			} else if len(acl.Users()) == 0 {
+				// the initial admin user manages other users by ACL command of RESP
+				password, err := randomHex(16)
+				if err == nil {
+					err = acl.AddUser("admin", password, true)
+				}
+				if err != nil {
+					log.Println("failed to create admin user :", err)
+					return
+				}
+				log.Printf("admin user is created with password %q\n", password)
+			}
+			storage.EnableACL(acl)
+		}
+		if *listenAddr != "" && !serve("tcp", *listenAddr, handlers["txn"]) {
+			return
+		}
+		if *respAddr != "" && !serve("tcp", *respAddr, handlers["resp"]) {
+			return
+		}
+		if *memcachedAddr != "" && !serve("tcp", *memcachedAddr, handlers["memcached"]) {
+			return
+		}
+		if *replicationAddr != "" && !serve("tcp", *replicationAddr, handlers["replication"]) {
+			return
+		}
+		var grpcServer *grpc.Server
+		if *grpcAddr != "" {
+			l, err := net.Listen("tcp", *grpcAddr)
+			if err != nil {
+				log.Println("failed to listen grpc :", err)
+				return
+			}
+			var opts []grpc.ServerOption
+			if tlsConfig != nil {
+				opts = append(opts, grpc.Creds(grpcCredentials(tlsConfig.Config())))
+			}
+			grpcServer = NewGRPCServer(storage, opts...)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := grpcServer.Serve(l); err != nil {
+					log.Println("failed to serve grpc :", err)
+				}
+			}()
+		}
+		if *unixPath != "" {
+			handle, ok := handlers[*unixProtocol]
+			if !ok {
+				log.Println("unix protocol is not supported :", *unixProtocol)
+				return
+			}
+			if !serve("unix", *unixPath, handle) {
+				return
+			}
+		}
+		if adminServer != nil {
+			// ready after servers start
+			adminServer.SetStorage(storage)
+		}
 
 		signal.Reset()
-		chsig := make(chan os.Signal)
+		chsig := make(chan os.Signal, 1)
 		signal.Notify(chsig, os.Interrupt)
+		if tlsConfig != nil {
+			// SIGHUP reloads certificates for new connections
+			chhup := make(chan os.Signal, 1)
+			signal.Notify(chhup, syscall.SIGHUP)
+			go func() {
+				for range chhup {
+					if err := tlsConfig.reload(); err != nil {
+						log.Println("failed to reload TLS certificate :", err)
+					} else {
+						log.Println("TLS certificate is reloaded")
+					}
+				}
+			}()
+		}
 		<-chsig
 		log.Println("shutdown...")
-		l.Close()
+		for _, l := range listeners {
+			l.Close()
+		}
+		if admin != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			if err := admin.Shutdown(ctx); err != nil {
+				log.Println("failed to shutdown admin server :", err)
+			}
+			cancel()
+		}
 
 		chDone := make(chan struct{})
 		go func() {
+			if grpcServer != nil {
+				// waits for calls and streams in flight
+				grpcServer.GracefulStop()
+			}
 			wg.Wait()
 			chDone <- struct{}{}
 		}()
 		select {
-		case <-time.After(30 * time.Second):
+		case <-time.After(defaultCloseTimeout):
+			// Close aborts transactions of connections which do not quit
 			log.Println("connection not quit. shutdown forcibly.")
-			return
+			if grpcServer != nil {
+				grpcServer.Stop()
+			}
 		case <-chDone:
 		}
 	}
 
 	log.Println("save checkpoint")
-	if err = storage.SaveCheckPoint(); err != nil {
-		log.Printf("failed to save data file : %v\n", err)
-	} else if err = storage.ClearWAL(); err != nil {
-		log.Printf("failed to clear WAL file : %v\n", err)
+	if err = storage.Close(); err != nil {
+		log.Printf("failed to close storage : %v\n", err)
 	} else {
 		log.Println("success to save data")
 	}
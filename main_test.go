@@ -2,12 +2,18 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 const (
@@ -20,7 +26,7 @@ var (
 	testTmpPath = filepath.Join(tmpdir, "test.tmp")
 )
 
-func createTestStorage(t *testing.T) *Storage {
+func createTestStorage(t testing.TB) *Storage {
 	_ = os.RemoveAll(tmpdir)
 	_ = os.MkdirAll(tmpdir, 0777)
 	file, err := os.OpenFile(testWALPath, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0600)
@@ -140,6 +146,154 @@ func TestTxn_Update(t *testing.T) {
 	}
 }
 
+func TestTxn_UpdateIfVersion(t *testing.T) {
+	storage := createTestStorage(t)
+	defer storage.wal.Close()
+	txn := storage.NewTxn()
+	if err := txn.UpdateIfVersion("key1", []byte("value1"), 0); err != ErrNotExist {
+		t.Errorf("key1 is not (not exist) : %v", err)
+	}
+	if err := txn.Insert("key1", []byte("value1")); err != nil {
+		t.Errorf("failed to insert key1 : %v", err)
+	}
+	if err := txn.Commit(); err != nil {
+		t.Errorf("failed to commit : %v", err)
+	}
+
+	// version of key1 is 1 by first commit
+	if err := txn.UpdateIfVersion("key1", []byte("value2"), 2); err != ErrVersion {
+		t.Errorf("unexpectedly success to update with wrong version : %v", err)
+	}
+	if err := txn.UpdateIfVersion("key1", []byte("value2"), 1); err != nil {
+		t.Errorf("failed to update with version : %v", err)
+	}
+	if err := txn.Commit(); err != nil {
+		t.Errorf("failed to commit : %v", err)
+	}
+	assertValue(t, txn, "key1", []byte("value2"))
+
+	// version is updated by commit
+	if err := txn.UpdateIfVersion("key1", []byte("value3"), 1); err != ErrVersion {
+		t.Errorf("unexpectedly success to update with old version : %v", err)
+	}
+	if err := txn.UpdateIfVersion("key1", []byte("value3"), 2); err != nil {
+		t.Errorf("failed to update with version : %v", err)
+	}
+	txn.Abort()
+
+	if _, version, err := txn.ReadVersioned("key1"); err != nil {
+		t.Errorf("failed to read versioned key1 : %v", err)
+	} else if version != 2 {
+		t.Errorf("version of key1 is %v, expected 2", version)
+	}
+	if err := txn.Update("key1", []byte("value4")); err != nil {
+		t.Errorf("failed to update key1 : %v", err)
+	}
+	if v, version, err := txn.ReadVersioned("key1"); err != nil {
+		t.Errorf("failed to read versioned key1 : %v", err)
+	} else if version != 0 || !bytes.Equal(v, []byte("value4")) {
+		t.Errorf("uncommitted key1 is %v (version %v), expected version 0", v, version)
+	}
+}
+
+func TestTxn_GetAndUpdate(t *testing.T) {
+	storage := createTestStorage(t)
+	defer storage.wal.Close()
+	txn := storage.NewTxn()
+	appendValue := func(old []byte) ([]byte, error) {
+		if old == nil {
+			return []byte("a"), nil
+		}
+		return append(clone(old), 'a'), nil
+	}
+	if err := txn.GetAndUpdate("key1", appendValue); err != nil {
+		t.Errorf("failed to update not existing key1 : %v", err)
+	}
+	assertValue(t, txn, "key1", []byte("a"))
+	if err := txn.Commit(); err != nil {
+		t.Errorf("failed to commit : %v", err)
+	}
+	if err := txn.GetAndUpdate("key1", appendValue); err != nil {
+		t.Errorf("failed to update key1 : %v", err)
+	}
+	assertValue(t, txn, "key1", []byte("aa"))
+
+	errAbort := errors.New("abort")
+	if err := txn.GetAndUpdate("key1", func(old []byte) ([]byte, error) { return nil, errAbort }); err != errAbort {
+		t.Errorf("error from fn is not returned : %v", err)
+	}
+	assertValue(t, txn, "key1", []byte("aa"))
+}
+
+func TestTxn_SetNX(t *testing.T) {
+	storage := createTestStorage(t)
+	defer storage.wal.Close()
+	txn := storage.NewTxn()
+	if ok, err := txn.SetNX("key1", []byte("value1")); err != nil {
+		t.Errorf("failed to setnx key1 : %v", err)
+	} else if !ok {
+		t.Errorf("key1 is not set")
+	}
+	if ok, err := txn.SetNX("key1", []byte("value2")); err != nil {
+		t.Errorf("failed to setnx key1 : %v", err)
+	} else if ok {
+		t.Errorf("existing key1 is unexpectedly set")
+	}
+	assertValue(t, txn, "key1", []byte("value1"))
+}
+
+func TestTxn_GetSet(t *testing.T) {
+	storage := createTestStorage(t)
+	defer storage.wal.Close()
+	txn := storage.NewTxn()
+	if old, err := txn.GetSet("key1", []byte("value1")); err != nil {
+		t.Errorf("failed to getset key1 : %v", err)
+	} else if old != nil {
+		t.Errorf("old value of not existing key1 is not nil : %v", old)
+	}
+	if err := txn.Commit(); err != nil {
+		t.Errorf("failed to commit : %v", err)
+	}
+	if old, err := txn.GetSet("key1", []byte("value2")); err != nil {
+		t.Errorf("failed to getset key1 : %v", err)
+	} else if !bytes.Equal(old, []byte("value1")) {
+		t.Errorf("old value is not match %v", old)
+	}
+	assertValue(t, txn, "key1", []byte("value2"))
+}
+
+func TestStorage_AutoCommit(t *testing.T) {
+	storage := createTestStorage(t)
+	defer storage.wal.Close()
+	if _, err := storage.Get("key1"); err != ErrNotExist {
+		t.Errorf("key1 is not (not exist) : %v", err)
+	}
+	if err := storage.Put("key1", []byte("value1")); err != nil {
+		t.Errorf("failed to put key1 : %v", err)
+	}
+	if err := storage.Put("key1", []byte("value2")); err != nil {
+		t.Errorf("failed to put existing key1 : %v", err)
+	}
+	if v, err := storage.Get("key1"); err != nil {
+		t.Errorf("failed to get key1 : %v", err)
+	} else if !bytes.Equal(v, []byte("value2")) {
+		t.Errorf("value is not match %v", v)
+	}
+
+	// committed by other transaction
+	txn := storage.NewTxn()
+	assertValue(t, txn, "key1", []byte("value2"))
+	txn.Abort()
+
+	if err := storage.Delete("key1"); err != nil {
+		t.Errorf("failed to delete key1 : %v", err)
+	}
+	if err := storage.Delete("key1"); err != ErrNotExist {
+		t.Errorf("deleted key1 must not exist : %v", err)
+	}
+	assertNotExist(t, txn, "key1")
+}
+
 func TestTxn_Delete(t *testing.T) {
 	var (
 		value1 = []byte("value1")
@@ -186,6 +340,93 @@ func TestTxn_Delete(t *testing.T) {
 	})
 }
 
+func TestTxn_FirstLast(t *testing.T) {
+	storage := createTestStorage(t)
+	defer storage.wal.Close()
+	txn := storage.NewTxn()
+	if _, _, err := txn.First(); err != ErrNotExist {
+		t.Errorf("first of empty db is not (not exist) : %v", err)
+	}
+	if _, _, err := txn.Last(); err != ErrNotExist {
+		t.Errorf("last of empty db is not (not exist) : %v", err)
+	}
+
+	for _, key := range []string{"key2", "key1", "key3"} {
+		if err := txn.Insert(key, []byte("v"+key)); err != nil {
+			t.Errorf("failed to insert %v : %v", key, err)
+		}
+	}
+	if k, v, err := txn.First(); err != nil {
+		t.Errorf("failed to read first : %v", err)
+	} else if k != "key1" || !bytes.Equal(v, []byte("vkey1")) {
+		t.Errorf("first is not match %v %v", k, v)
+	}
+	if err := txn.Commit(); err != nil {
+		t.Errorf("failed to commit : %v", err)
+	}
+
+	// deleted in transaction
+	if err := txn.Delete("key3"); err != nil {
+		t.Errorf("failed to delete key3 : %v", err)
+	}
+	if k, v, err := txn.Last(); err != nil {
+		t.Errorf("failed to read last : %v", err)
+	} else if k != "key2" || !bytes.Equal(v, []byte("vkey2")) {
+		t.Errorf("last is not match %v %v", k, v)
+	}
+
+	// inserted in transaction
+	if err := txn.Insert("key0", []byte("vkey0")); err != nil {
+		t.Errorf("failed to insert key0 : %v", err)
+	}
+	if k, _, err := txn.First(); err != nil {
+		t.Errorf("failed to read first : %v", err)
+	} else if k != "key0" {
+		t.Errorf("first is not match %v, expected key0", k)
+	}
+	txn.Abort()
+
+	if k, _, err := txn.Last(); err != nil {
+		t.Errorf("failed to read last after abort : %v", err)
+	} else if k != "key3" {
+		t.Errorf("last is not match %v, expected key3", k)
+	}
+}
+
+func TestTxn_Scan(t *testing.T) {
+	storage := createTestStorage(t)
+	defer storage.wal.Close()
+	txn := storage.NewTxn()
+	for _, key := range []string{"b2", "a1", "b1", "b3"} {
+		if err := txn.Insert(key, []byte("v"+key)); err != nil {
+			t.Errorf("failed to insert %v : %v", key, err)
+		}
+	}
+	if err := txn.Commit(); err != nil {
+		t.Errorf("failed to commit : %v", err)
+	}
+	if err := txn.Delete("b2"); err != nil {
+		t.Errorf("failed to delete b2 : %v", err)
+	}
+	if err := txn.Insert("b0", []byte("vb0")); err != nil {
+		t.Errorf("failed to insert b0 : %v", err)
+	}
+
+	var keys []string
+	if err := txn.Scan("b", func(key string, value []byte) error {
+		if !bytes.Equal(value, []byte("v"+key)) {
+			t.Errorf("value for %v not match %v", key, value)
+		}
+		keys = append(keys, key)
+		return nil
+	}); err != nil {
+		t.Errorf("failed to scan : %v", err)
+	}
+	if !reflect.DeepEqual(keys, []string{"b0", "b1", "b3"}) {
+		t.Errorf("scanned keys not match %v", keys)
+	}
+}
+
 func TestTxn_Commit(t *testing.T) {
 	storage := createTestStorage(t)
 	defer storage.wal.Close()
@@ -238,6 +479,89 @@ func TestTxn_Commit(t *testing.T) {
 	}
 }
 
+// faultBackend fails Put of the underlying backend while fail is true.
+type faultBackend struct {
+	Backend
+	fail bool
+}
+
+func (f *faultBackend) Put(r Record) error {
+	if f.fail {
+		return errInjected
+	}
+	return f.Backend.Put(r)
+}
+
+func TestTxn_Commit_Corrupted(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	var fault *faultBackend
+	RegisterBackend("fault", func(path string, opts *Options) Backend {
+		fault = &faultBackend{Backend: newBTree(path, opts.CachePages)}
+		return fault
+	})
+	defer delete(backends, "fault")
+	opts := Options{WALPath: testWALPath, DBPath: testDBPath, Backend: "fault"}
+	storage, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = storage.Put("key1", []byte("value1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the commit written into WAL is not applied
+	fault.fail = true
+	if err = storage.Put("key2", []byte("value2")); !errors.Is(err, ErrCorrupted) || !errors.Is(err, errInjected) {
+		t.Fatalf("commit not applied : %v", err)
+	}
+	fault.fail = false
+	if err = storage.Put("key3", []byte("value3")); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("commit after corrupted : %v", err)
+	} else if err = storage.Checkpoint(); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("checkpoint after corrupted : %v", err)
+	} else if h := storage.Health(); h.WALWritable {
+		t.Errorf("health after corrupted : %+v", h)
+	}
+	if err = storage.Close(); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("close after corrupted : %v", err)
+	}
+
+	// WAL is replayed when reopened
+	storage, err = Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txn := storage.NewTxn()
+	assertValue(t, txn, "key1", []byte("value1"))
+	assertValue(t, txn, "key2", []byte("value2"))
+	if _, err = txn.Read("key3"); err != ErrNotExist {
+		t.Errorf("key3 : %v", err)
+	}
+	txn.Abort()
+	if err = storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	opts.PanicOnCorruption = true
+	storage, err = Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Close waits for the transaction which panics
+	defer storage.db.Close()
+	defer storage.wal.Close()
+	fault.fail = true
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("commit not applied does not panic with PanicOnCorruption")
+			}
+		}()
+		_ = storage.Put("key3", []byte("value3"))
+	}()
+}
+
 func TestTxn_Abort(t *testing.T) {
 	var (
 		value1 = []byte("value1")
@@ -319,7 +643,7 @@ func assertNotExist(t *testing.T, txn *Txn, key string) {
 	}
 }
 
-func clearFile(t *testing.T, file *os.File) {
+func clearFile(t *testing.T, file File) {
 	if _, err := file.Seek(0, io.SeekStart); err != nil {
 		t.Errorf("failed to seek : %v", err)
 	} else if err = file.Truncate(0); err != nil {
@@ -327,7 +651,7 @@ func clearFile(t *testing.T, file *os.File) {
 	}
 }
 
-func writeLogs(t *testing.T, file *os.File, logs []RecordLog) {
+func writeLogs(t *testing.T, file File, logs []RecordLog) {
 	var buf [4096]byte
 	for i, rlog := range logs {
 		if n, err := rlog.Serialize(buf[:]); err != nil {
@@ -338,6 +662,17 @@ func writeLogs(t *testing.T, file *os.File, logs []RecordLog) {
 	}
 }
 
+func corruptFile(t *testing.T, path string, offset int64) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err = f.WriteAt([]byte("X"), offset); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func readLogs(t *testing.T, filename string) ([]byte, []RecordLog) {
 	buf, err := ioutil.ReadFile(filename)
 	if err != nil {
@@ -387,24 +722,76 @@ func applyLogs(t *testing.T, txn *Txn, logs []RecordLog) {
 	}
 }
 
+func TestTxn_SetContext(t *testing.T) {
+	storage := createTestStorage(t)
+	defer storage.wal.Close()
+	if err := storage.Put("key1", []byte("value1")); err != nil {
+		t.Fatal(err)
+	}
+	timeout := func(fn func(txn *Txn) error) {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		txn := storage.NewTxn()
+		txn.SetContext(ctx)
+		if err := fn(txn); err != context.DeadlineExceeded {
+			t.Errorf("wait for lock : %v", err)
+		}
+		txn.Abort()
+	}
+
+	// waits for read lock and write lock
+	holder := storage.NewTxn()
+	if err := holder.Update("key1", []byte("value2")); err != nil {
+		t.Fatal(err)
+	}
+	timeout(func(txn *Txn) error {
+		_, err := txn.Read("key1")
+		return err
+	})
+	timeout(func(txn *Txn) error { return txn.Delete("key1") })
+	timeout(func(txn *Txn) error { return txn.Insert("key1", []byte("value3")) })
+	holder.Abort()
+
+	// waits for upgrade of read lock
+	if _, err := holder.Read("key1"); err != nil {
+		t.Fatal(err)
+	}
+	timeout(func(txn *Txn) error {
+		if _, err := txn.Read("key1"); err != nil {
+			return err
+		}
+		return txn.Update("key1", []byte("value3"))
+	})
+	holder.Abort()
+
+	// locks acquired after the deadline are released
+	if err := storage.Put("key1", []byte("value4")); err != nil {
+		t.Fatal(err)
+	}
+	txn := storage.NewTxn()
+	defer txn.Abort()
+	assertValue(t, txn, "key1", []byte("value4"))
+}
+
 func TestWAL(t *testing.T) {
 	storage := createTestStorage(t)
 	defer storage.wal.Close()
 	txn := storage.NewTxn()
 	logs := []RecordLog{
 		{Action: LCommit},
-		{Action: LInsert, Record: Record{Key: "key1", Value: []byte("value1")}},
-		{Action: LInsert, Record: Record{Key: "key2", Value: []byte("value2")}},
-		{Action: LInsert, Record: Record{Key: "key3", Value: []byte("value3")}},
-		{Action: LInsert, Record: Record{Key: "key4", Value: []byte("value4")}},
-		{Action: LUpdate, Record: Record{Key: "key2", Value: []byte("value5")}},
-		{Action: LDelete, Record: Record{Key: "key3", Value: []byte("")}}, // TODO: delete log not need to have value
-		{Action: LUpdate, Record: Record{Key: "key4", Value: []byte("value6")}},
-		{Action: LUpdate, Record: Record{Key: "key4", Value: []byte("value7")}},
+		{Action: LInsert, Record: Record{Key: "key1", Value: []byte("value1"), Version: 1}},
+		{Action: LInsert, Record: Record{Key: "key2", Value: []byte("value2"), Version: 1}},
+		{Action: LInsert, Record: Record{Key: "key3", Value: []byte("value3"), Version: 1}},
+		{Action: LInsert, Record: Record{Key: "key4", Value: []byte("value4"), Version: 1}},
+		{Action: LUpdate, Record: Record{Key: "key2", Value: []byte("value5"), Version: 1}},
+		{Action: LDelete, Record: Record{Key: "key3", Value: []byte(""), Version: 1}}, // TODO: delete log not need to have value
+		{Action: LUpdate, Record: Record{Key: "key4", Value: []byte("value6"), Version: 1}},
+		{Action: LUpdate, Record: Record{Key: "key4", Value: []byte("value7"), Version: 1}},
 		{Action: LCommit},
-		{Action: LUpdate, Record: Record{Key: "key1", Value: []byte("value8")}},
-		{Action: LDelete, Record: Record{Key: "key2", Value: []byte("")}}, // TODO: delete log not need to have value
-		{Action: LInsert, Record: Record{Key: "key3", Value: []byte("value8")}},
+		{Action: LUpdate, Record: Record{Key: "key1", Value: []byte("value8"), Version: 2}},
+		{Action: LDelete, Record: Record{Key: "key2", Value: []byte(""), Version: 2}}, // TODO: delete log not need to have value
+		{Action: LInsert, Record: Record{Key: "key3", Value: []byte("value8"), Version: 2}},
 		{Action: LCommit},
 	}
 	applyLogs(t, txn, logs)
@@ -527,6 +914,141 @@ func TestStorage_LoadWAL(t *testing.T) {
 	})
 }
 
+func TestStorage_LoadWAL_RecoveryPolicy(t *testing.T) {
+	txns := [][]RecordLog{
+		{
+			{Action: LInsert, Record: Record{Key: "key1", Value: []byte("value1"), Version: 1}},
+			{Action: LCommit, Record: Record{Version: 1}},
+		},
+		{
+			{Action: LInsert, Record: Record{Key: "key2", Value: []byte("value2"), Version: 2}},
+			{Action: LInsert, Record: Record{Key: "key3", Value: []byte("value3"), Version: 2}},
+			{Action: LCommit, Record: Record{Version: 2}},
+		},
+		{
+			{Action: LInsert, Record: Record{Key: "key4", Value: []byte("value4"), Version: 3}},
+			{Action: LCommit, Record: Record{Version: 3}},
+		},
+	}
+	// writeWAL writes txns and corrupts the first log of the second transaction
+	writeWAL := func(t *testing.T, storage *Storage) int64 {
+		writeLogs(t, storage.wal, txns[0])
+		info, err := storage.wal.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeLogs(t, storage.wal, txns[1])
+		writeLogs(t, storage.wal, txns[2])
+		corruptFile(t, testWALPath, info.Size()+10)
+		return info.Size()
+	}
+
+	for _, policy := range []string{"", RecoveryStrict} {
+		storage := createTestStorage(t)
+		storage.opts.RecoveryPolicy = policy
+		offset := writeWAL(t, storage)
+		if _, err := storage.LoadWAL(); err == nil {
+			t.Errorf("corrupt WAL is loaded by %q policy", policy)
+		} else if !errors.Is(err, ErrChecksum) || !strings.Contains(err.Error(), fmt.Sprintf("offset %d", offset)) {
+			t.Errorf("error of %q policy : %v", policy, err)
+		}
+		storage.wal.Close()
+	}
+
+	t.Run("truncate", func(t *testing.T) {
+		storage := createTestStorage(t)
+		defer storage.wal.Close()
+		storage.opts.RecoveryPolicy = RecoveryTruncate
+		writeWAL(t, storage)
+		if n, err := storage.LoadWAL(); err != nil {
+			t.Fatal(err)
+		} else if n != len(txns[0]) || len(storage.corruptLogs) != 1 {
+			t.Errorf("load %v logs with %v corrupt logs", n, len(storage.corruptLogs))
+		}
+		txn := storage.NewTxn()
+		assertValue(t, txn, "key1", []byte("value1"))
+		assertNotExist(t, txn, "key2")
+		assertNotExist(t, txn, "key3")
+		assertNotExist(t, txn, "key4")
+	})
+
+	t.Run("skip", func(t *testing.T) {
+		storage := createTestStorage(t)
+		defer storage.wal.Close()
+		storage.opts.RecoveryPolicy = RecoverySkip
+		writeWAL(t, storage)
+		if n, err := storage.LoadWAL(); err != nil {
+			t.Fatal(err)
+		} else if n != len(txns[0])+len(txns[1])-1+len(txns[2]) || len(storage.corruptLogs) != 1 {
+			t.Errorf("load %v logs with %v corrupt logs", n, len(storage.corruptLogs))
+		} else if storage.version != 3 {
+			t.Errorf("version : %v", storage.version)
+		}
+		txn := storage.NewTxn()
+		assertValue(t, txn, "key1", []byte("value1"))
+		// the transaction with the corrupt log is not applied partially
+		assertNotExist(t, txn, "key2")
+		assertNotExist(t, txn, "key3")
+		assertValue(t, txn, "key4", []byte("value4"))
+	})
+
+	t.Run("skip at tail", func(t *testing.T) {
+		storage := createTestStorage(t)
+		defer storage.wal.Close()
+		storage.opts.RecoveryPolicy = RecoverySkip
+		writeLogs(t, storage.wal, txns[0])
+		writeLogs(t, storage.wal, txns[1])
+		info, err := storage.wal.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		corruptFile(t, testWALPath, info.Size()-2)
+		if n, err := storage.LoadWAL(); err != nil {
+			t.Fatal(err)
+		} else if n != len(txns[0])+len(txns[1])-1 || len(storage.corruptLogs) != 1 {
+			t.Errorf("load %v logs with %v corrupt logs", n, len(storage.corruptLogs))
+		}
+		txn := storage.NewTxn()
+		assertValue(t, txn, "key1", []byte("value1"))
+		assertNotExist(t, txn, "key2")
+	})
+
+	t.Run("open", func(t *testing.T) {
+		storage := createTestStorage(t)
+		writeWAL(t, storage)
+		storage.wal.Close()
+		expected, err := ioutil.ReadFile(testWALPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = Open(Options{WALPath: testWALPath, DBPath: testDBPath, RecoveryPolicy: "none"}); err == nil {
+			t.Fatal("open with unknown recovery policy")
+		} else if _, err = Open(Options{WALPath: testWALPath, DBPath: testDBPath}); err == nil {
+			t.Fatal("open corrupt WAL by strict policy")
+		}
+		storage, err = Open(Options{WALPath: testWALPath, DBPath: testDBPath, RecoveryPolicy: RecoverySkip})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer storage.wal.Close()
+		txn := storage.NewTxn()
+		assertValue(t, txn, "key1", []byte("value1"))
+		assertNotExist(t, txn, "key2")
+		assertValue(t, txn, "key4", []byte("value4"))
+		// corrupt WAL is kept for forensics
+		if buf, err := ioutil.ReadFile(testWALPath + ".corrupt"); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(buf, expected) {
+			t.Errorf("copy of corrupt WAL does not match")
+		} else if info, err := storage.wal.Stat(); err != nil {
+			t.Fatal(err)
+		} else if info.Size() != 0 {
+			t.Errorf("WAL is not cleared : %v", info.Size())
+		}
+	})
+}
+
 func TestStorage_ClearWAL(t *testing.T) {
 	logs := []RecordLog{
 		{Action: LInsert, Record: Record{Key: "key1", Value: []byte("value1")}},
@@ -558,6 +1080,69 @@ func TestStorage_ClearWAL(t *testing.T) {
 	}
 }
 
+func TestStorage_LargeValue(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		opts Options
+	}{
+		{"map", Options{}},
+		{"btree", Options{Backend: "btree", CachePages: 4}},
+		{"hash", Options{Backend: "hash"}},
+		{"lsm", Options{Backend: "lsm"}},
+		{"values on disk", Options{ValuesOnDisk: true}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_ = os.RemoveAll(tmpdir)
+			_ = os.MkdirAll(tmpdir, 0777)
+			opts := tt.opts
+			opts.WALPath, opts.DBPath = testWALPath, testDBPath
+			storage, err := Open(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// values much larger than walBufferSize
+			expected := map[string][]byte{
+				"large":  bytes.Repeat([]byte("0123456789abcdef"), 1<<16),
+				"larger": bytes.Repeat([]byte("fedcba9876543210"), 3<<16),
+				"huge":   bytes.Repeat([]byte("0011223344556677"), 1<<20),
+				"small":  []byte("small"),
+			}
+			for _, key := range []string{"large", "small", "larger", "huge"} {
+				if err = storage.Put(key, expected[key]); err != nil {
+					t.Fatalf("failed to put %q : %v", key, err)
+				}
+			}
+			assertLarge := func(storage *Storage) {
+				t.Helper()
+				for key, value := range expected {
+					if v, err := storage.Get(key); err != nil {
+						t.Errorf("failed to get %q : %v", key, err)
+					} else if !bytes.Equal(v, value) {
+						t.Errorf("value of %q not match : %v bytes, expected %v bytes", key, len(v), len(value))
+					}
+				}
+			}
+
+			// crash without checkpoint and replay WAL
+			storage.wal.Close()
+			storage.db.Close()
+			if storage, err = Open(opts); err != nil {
+				t.Fatalf("failed to replay WAL : %v", err)
+			}
+			assertLarge(storage)
+
+			// load values from data file
+			if err = storage.Shutdown(context.Background(), true); err != nil {
+				t.Fatal(err)
+			} else if storage, err = Open(opts); err != nil {
+				t.Fatalf("failed to load data file : %v", err)
+			}
+			defer storage.Shutdown(context.Background(), false)
+			assertLarge(storage)
+		})
+	}
+}
+
 func TestStorage_SaveCheckPoint(t *testing.T) {
 	logs := []RecordLog{
 		{Action: LCommit},
@@ -596,4 +1181,185 @@ func TestStorage_SaveCheckPoint(t *testing.T) {
 	if !reflect.DeepEqual(storage2.db, storage2.db) {
 		t.Errorf("loaded records not match")
 	}
+	if storage2.version != storage.version {
+		t.Errorf("loaded version not match %v, expected %v", storage2.version, storage.version)
+	}
+}
+
+func TestMapEngine_Keys(t *testing.T) {
+	e := newMapEngine(testDBPath, testTmpPath)
+	for _, k := range []string{"b2", "a1", "c1", "b1", "b3", "a2"} {
+		if err := e.Put(Record{Key: k, Value: []byte("v")}); err != nil {
+			t.Fatalf("failed to put : %v", err)
+		}
+	}
+	if err := e.Delete("b3"); err != nil {
+		t.Fatalf("failed to delete : %v", err)
+	}
+	collect := func(keys func(string, func(string) bool) error, prefix string) string {
+		var result []string
+		if err := keys(prefix, func(k string) bool {
+			result = append(result, k)
+			return true
+		}); err != nil {
+			t.Fatalf("failed to iterate keys : %v", err)
+		}
+		return fmt.Sprint(result)
+	}
+	for _, c := range []struct {
+		prefix, keys, reversed string
+	}{
+		{"", "[a1 a2 b1 b2 c1]", "[c1 b2 b1 a2 a1]"},
+		{"b", "[b1 b2]", "[b2 b1]"},
+		{"d", "[]", "[]"},
+	} {
+		if keys := collect(e.Keys, c.prefix); keys != c.keys {
+			t.Errorf("keys with prefix %q not match %v, expected %v", c.prefix, keys, c.keys)
+		}
+		if keys := collect(e.KeysReverse, c.prefix); keys != c.reversed {
+			t.Errorf("reversed keys with prefix %q not match %v, expected %v", c.prefix, keys, c.reversed)
+		}
+	}
+}
+
+func TestMapEngine_MaxMemory(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	e := newMapEngine(testDBPath, testTmpPath)
+	e.maxMemory = 100
+	defer func() { e.Close() }()
+
+	expected := make(map[string][]byte)
+	for i := 0; i < 50; i++ {
+		key, value := fmt.Sprintf("key%02d", i), []byte(fmt.Sprintf("value%02d", i))
+		if err := e.Put(Record{Key: key, Value: value}); err != nil {
+			t.Fatalf("failed to put : %v", err)
+		}
+		expected[key] = value
+	}
+	// modified values are not evicted before checkpoint
+	if e.ncold != 0 {
+		t.Errorf("%v dirty values are evicted", e.ncold)
+	}
+	if err := e.Save(1); err != nil {
+		t.Fatalf("failed to save : %v", err)
+	}
+	if e.memory > e.maxMemory || e.ncold == 0 {
+		t.Errorf("values are not evicted : memory %v, cold %v", e.memory, e.ncold)
+	}
+	assertEngine(t, e, expected)
+	if e.memory > e.maxMemory {
+		t.Errorf("memory %v exceeds the budget after reloading", e.memory)
+	}
+
+	// save again with evicted values and reload with the budget
+	if err := e.Put(Record{Key: "key00", Value: []byte("updated")}); err != nil {
+		t.Fatalf("failed to put : %v", err)
+	}
+	expected["key00"] = []byte("updated")
+	if err := e.Save(2); err != nil {
+		t.Fatalf("failed to save : %v", err)
+	}
+	e.Close()
+	e = newMapEngine(testDBPath, testTmpPath)
+	e.maxMemory = 100
+	if version, err := e.Load(); err != nil {
+		t.Fatalf("failed to load : %v", err)
+	} else if version != 2 {
+		t.Errorf("version not match %v, expected 2", version)
+	}
+	if e.memory > e.maxMemory || e.Len() != len(expected) {
+		t.Errorf("loaded engine not match : memory %v, len %v", e.memory, e.Len())
+	}
+	assertEngine(t, e, expected)
+}
+
+func TestMapEngine_ValuesOnDisk(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	vlogPath := filepath.Join(tmpdir, "test.vlog")
+	e := newMapEngine(testDBPath, testTmpPath)
+	e.vlog = &valueLog{path: vlogPath, fs: osFS{}}
+	defer func() { e.Close() }()
+
+	expected := make(map[string][]byte)
+	for i := 0; i < 100; i++ {
+		key, value := fmt.Sprintf("key%02d", i%50), bytes.Repeat([]byte{byte(i)}, 1000)
+		if err := e.Put(Record{Key: key, Value: value}); err != nil {
+			t.Fatalf("failed to put : %v", err)
+		}
+		expected[key] = value
+	}
+	if err := e.Delete("key00"); err != nil {
+		t.Fatalf("failed to delete : %v", err)
+	}
+	delete(expected, "key00")
+	assertEngine(t, e, expected)
+	if e.memory != 0 || e.ncold != len(expected) {
+		t.Errorf("values are kept in memory : memory %v, on disk %v", e.memory, e.ncold)
+	}
+
+	// values are moved into data file at checkpoint
+	if err := e.Save(1); err != nil {
+		t.Fatalf("failed to save : %v", err)
+	} else if e.vlog.size != 0 {
+		t.Errorf("value log is not truncated : %v bytes", e.vlog.size)
+	}
+	assertEngine(t, e, expected)
+	if err := e.Put(Record{Key: "key01", Value: []byte("updated")}); err != nil {
+		t.Fatalf("failed to put : %v", err)
+	}
+	expected["key01"] = []byte("updated")
+	assertEngine(t, e, expected)
+
+	// values after checkpoint are lost and recovered by WAL
+	e.Close()
+	e = newMapEngine(testDBPath, testTmpPath)
+	e.vlog = &valueLog{path: vlogPath, fs: osFS{}}
+	if _, err := e.Load(); err != nil {
+		t.Fatalf("failed to load : %v", err)
+	} else if e.memory != 0 || e.vlog.size != 0 {
+		t.Errorf("loaded engine not match : memory %v, value log %v bytes", e.memory, e.vlog.size)
+	}
+	expected["key01"] = bytes.Repeat([]byte{51}, 1000)
+	assertEngine(t, e, expected)
+}
+
+func TestListenUnix(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	path := filepath.Join(tmpdir, "test.sock")
+
+	l, err := listenUnix(path, 0600)
+	if err != nil {
+		t.Fatalf("failed to listen : %v", err)
+	}
+	if info, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if info.Mode().Perm() != 0600 {
+		t.Errorf("permission %v != 0600", info.Mode().Perm())
+	}
+
+	// socket in use is not removed
+	if _, err = listenUnix(path, 0600); err == nil {
+		t.Error("listen socket in use")
+	}
+
+	// stale socket is removed
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	if l, err = listenUnix(path, 0660); err != nil {
+		t.Fatalf("failed to listen over stale socket : %v", err)
+	}
+	l.Close()
+
+	// other files are not removed
+	if err = ioutil.WriteFile(path, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = listenUnix(path, 0600); err == nil {
+		t.Error("listen over regular file")
+	} else if _, err = os.Stat(path); err != nil {
+		t.Errorf("regular file is removed : %v", err)
+	}
 }
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+)
+
+var ErrNotSupported = errors.New("operation is not supported by engine")
+
+// cacheEngine is the engine which caches pages in memory.
+type cacheEngine interface {
+	Backend
+	// DropCaches writes back dirty pages and evicts all cached pages which are not in use.
+	// It returns the number of evicted pages.
+	DropCaches() (int, error)
+}
+
+// cacheOf returns the cache engine under the wrappers.
+func cacheOf(e Backend) (cacheEngine, bool) {
+	for {
+		if c, ok := e.(cacheEngine); ok {
+			return c, true
+		} else if w, ok := e.(unwrapper); ok {
+			e = w.unwrap()
+		} else {
+			return nil, false
+		}
+	}
+}
+
+// DropCaches evicts pages cached by the engine while running and returns the number of evicted
+// pages. The data file is read again on demand.
+func (s *Storage) DropCaches() (int, error) {
+	c, ok := cacheOf(s.db)
+	if !ok {
+		return 0, fmt.Errorf("%w : engine does not cache pages", ErrNotSupported)
+	}
+	s.muDB.Lock()
+	defer s.muDB.Unlock()
+	return c.DropCaches()
+}
+
+// RotateWAL checkpoints all committed records and moves WAL into the archive file named by the
+// last commit version, and returns the path of the archive. Commits are blocked until finished.
+func (s *Storage) RotateWAL() (string, error) {
+	s.muWAL.Lock()
+	defer s.muWAL.Unlock()
+	s.muDB.Lock()
+	defer s.muDB.Unlock()
+	if err := s.db.Save(s.version); err != nil {
+		return "", err
+	}
+	path := fmt.Sprintf("%s.%016x", s.wal.Name(), s.version)
+	if err := copyWAL(s.opts.fs(), s.wal, path); err != nil {
+		return "", err
+	}
+	return path, s.ClearWAL()
+}
+
+// copyWAL copies the content of WAL into the file at path in fs and syncs it.
+func copyWAL(fs FS, wal File, path string) error {
+	info, err := wal.Stat()
+	if err != nil {
+		return err
+	}
+	f, err := fs.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, io.NewSectionReader(wal, 0, info.Size())); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fs.Remove(path)
+	}
+	return err
+}
+
+// Stats is the snapshot of statistics of the storage.
+type Stats struct {
+	Version   uint64 `json:"version"`
+	Epoch     uint64 `json:"epoch"`
+	Keys      int    `json:"keys"`
+	WALSize   int64  `json:"wal_size"`
+	WALBytes  uint64 `json:"wal_written_bytes"`
+	Commits   uint64 `json:"commits"`
+	Aborts    uint64 `json:"aborts"`
+	Conflicts uint64 `json:"conflicts"`
+	// Prepared is the number of prepared transactions waiting for the decision.
+	Prepared  int             `json:"prepared"`
+	HeapBytes uint64          `json:"heap_bytes"`
+	Replicas  []ReplicaStatus `json:"replicas,omitempty"`
+}
+
+// Stats returns the snapshot of statistics.
+func (s *Storage) Stats() Stats {
+	s.muWAL.Lock()
+	stats := Stats{
+		Version:  s.version,
+		Epoch:    s.epoch,
+		WALSize:  s.walSize,
+		Prepared: len(s.prepared),
+	}
+	s.muWAL.Unlock()
+	s.muDB.RLock()
+	stats.Keys = s.keyCount()
+	s.muDB.RUnlock()
+	stats.WALBytes = s.metrics.walBytes.Value()
+	stats.Commits = s.metrics.commits.Value()
+	stats.Aborts = s.metrics.aborts.Value()
+	stats.Conflicts = s.metrics.conflicts.Value()
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	stats.HeapBytes = mem.HeapAlloc
+	stats.Replicas = s.Replicas()
+	return stats
+}
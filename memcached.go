@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// memcachedFlagsSize is the size of client flags stored before the data of the value.
+	memcachedFlagsSize = 4
+	memcachedMaxKeyLen = 250
+	memcachedMaxData   = 1 << 20
+	// memcachedMaxRelative is the max exptime in seconds relative to now. Larger exptime is the
+	// unix time.
+	memcachedMaxRelative = 30 * 24 * 60 * 60
+)
+
+var memcachedStorageCommands = map[string]bool{"set": true, "add": true, "replace": true, "cas": true}
+
+// memcachedConn is the connection speaking memcached text protocol.
+type memcachedConn struct {
+	r       *bufio.Reader
+	w       *bufio.Writer
+	storage *Storage
+	// user is the name of authenticated user if ACL is enabled.
+	user string
+	// addr is the address of the client recorded by the audit log.
+	addr string
+}
+
+// HandleMemcached serves memcached clients with text protocol. Each command is executed in its
+// own transaction, and the commit version of record is used as the cas unique.
+// Values are stored with 4 bytes client flags, so they are not shared with RESP clients.
+// If ACL is enabled, the data of the first storage command must be "<username> <password>" or
+// "<token>" to authenticate like memcached.
+func HandleMemcached(r io.Reader, w io.WriteCloser, storage *Storage, wg *sync.WaitGroup) error {
+	defer wg.Done()
+	defer w.Close()
+	c := &memcachedConn{r: bufio.NewReader(r), w: bufio.NewWriter(w), storage: storage, addr: remoteAddr(r)}
+	for {
+		line, err := c.r.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			c.w.WriteString("ERROR\r\n")
+		} else if args[0] == "quit" {
+			return c.w.Flush()
+		} else if err = c.handle(args); err != nil {
+			c.w.Flush()
+			return err
+		}
+		// flush replies when there are no more pipelined commands
+		if c.r.Buffered() == 0 {
+			if err = c.w.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// handle executes the command and writes the reply. error is returned only if the connection
+// can not be continued.
+func (c *memcachedConn) handle(args []string) error {
+	cmd := args[0]
+	noreply := len(args) > 1 && args[len(args)-1] == "noreply"
+	if noreply {
+		args = args[:len(args)-1]
+	}
+	var reply string
+	if c.storage.acl != nil && c.user == "" && !memcachedStorageCommands[cmd] && cmd != "version" {
+		c.w.WriteString("CLIENT_ERROR unauthenticated\r\n")
+		return nil
+	}
+	switch cmd {
+	case "get", "gets":
+		if len(args) < 2 {
+			reply = "ERROR"
+			break
+		}
+		return c.get(args[1:], cmd == "gets")
+	case "set", "add", "replace", "cas":
+		if c.storage.acl != nil && c.user == "" {
+			return c.auth(args, noreply)
+		}
+		return c.store(cmd, args, noreply)
+	case "delete":
+		if len(args) != 2 {
+			reply = "ERROR"
+			break
+		}
+		reply = c.reply(c.storage.autoCommitAs(actorOf(c.user, c.addr), func(txn *Txn) error {
+			if err := c.storage.acl.Authorize(c.user, args[1], PermWrite); err != nil {
+				return err
+			}
+			return txn.Delete(args[1])
+		}), "DELETED")
+	case "incr", "decr":
+		if len(args) != 3 {
+			reply = "ERROR"
+			break
+		}
+		reply = c.incr(args[1], args[2], cmd == "decr")
+	case "touch":
+		if len(args) != 3 {
+			reply = "ERROR"
+			break
+		}
+		reply = c.touch(args[1], args[2])
+	case "version":
+		reply = "VERSION " + serverVersion
+	default:
+		reply = "ERROR"
+	}
+	if !noreply {
+		c.w.WriteString(reply + "\r\n")
+	}
+	return nil
+}
+
+// reply converts the result of the command into reply line.
+func (c *memcachedConn) reply(err error, ok string) string {
+	switch err {
+	case nil:
+		return ok
+	case ErrNotExist:
+		return "NOT_FOUND"
+	case ErrExist:
+		return "NOT_STORED"
+	case ErrVersion:
+		return "EXISTS"
+	case ErrPermission, ErrNoAuth:
+		return "CLIENT_ERROR " + err.Error()
+	}
+	if strings.HasPrefix(err.Error(), "CLIENT_ERROR") {
+		return err.Error()
+	}
+	return "SERVER_ERROR " + err.Error()
+}
+
+func (c *memcachedConn) get(keys []string, withCas bool) error {
+	type item struct {
+		key     string
+		value   []byte
+		version uint64
+	}
+	var items []item
+	err := c.storage.autoCommitAs(actorOf(c.user, c.addr), func(txn *Txn) error {
+		for _, key := range keys {
+			if err := c.storage.acl.Authorize(c.user, key, PermRead); err != nil {
+				return err
+			}
+			v, version, err := txn.ReadVersioned(key)
+			if err == ErrNotExist {
+				continue
+			} else if err != nil {
+				return err
+			} else if len(v) < memcachedFlagsSize {
+				return errors.New("broken value of " + key)
+			}
+			items = append(items, item{key: key, value: v, version: version})
+		}
+		return nil
+	})
+	if err != nil {
+		c.w.WriteString(c.reply(err, "") + "\r\n")
+		return nil
+	}
+	for _, it := range items {
+		flags := binary.BigEndian.Uint32(it.value)
+		data := it.value[memcachedFlagsSize:]
+		line := "VALUE " + it.key + " " + strconv.FormatUint(uint64(flags), 10) + " " + strconv.Itoa(len(data))
+		if withCas {
+			line += " " + strconv.FormatUint(it.version, 10)
+		}
+		c.w.WriteString(line + "\r\n")
+		c.w.Write(data)
+		c.w.WriteString("\r\n")
+	}
+	c.w.WriteString("END\r\n")
+	return nil
+}
+
+// store supports <command> <key> <flags> <exptime> <bytes> [<cas unique>] [noreply].
+// exptime is set as the TTL of the record by Txn.Expire, and 0 clears it.
+func (c *memcachedConn) store(cmd string, args []string, noreply bool) error {
+	nargs := 5
+	if cmd == "cas" {
+		nargs = 6
+	}
+	if len(args) != nargs {
+		c.w.WriteString("ERROR\r\n")
+		return nil
+	}
+	value, reply, err := c.readData(args[4], memcachedFlagsSize)
+	if err != nil || value == nil {
+		c.w.WriteString(reply + "\r\n")
+		return err
+	}
+
+	reply = c.validate(args)
+	if reply == "" {
+		flags, _ := strconv.ParseUint(args[2], 10, 32)
+		binary.BigEndian.PutUint32(value, uint32(flags))
+		key := args[1]
+		exptime, _ := strconv.ParseInt(args[3], 10, 64)
+		reply = c.reply(c.storage.autoCommitAs(actorOf(c.user, c.addr), func(txn *Txn) error {
+			if err := c.storage.acl.Authorize(c.user, key, PermWrite); err != nil {
+				return err
+			}
+			var err error
+			switch cmd {
+			case "add":
+				err = txn.Insert(key, value)
+			case "replace":
+				// replace of missing record is not stored rather than not found
+				if err = txn.Update(key, value); err == ErrNotExist {
+					err = ErrExist
+				}
+			case "cas":
+				cas, _ := strconv.ParseUint(args[5], 10, 64)
+				err = txn.UpdateIfVersion(key, value, cas)
+			default:
+				err = txn.Put(key, value)
+			}
+			if err != nil {
+				return err
+			}
+			return c.expire(txn, key, exptime)
+		}), "STORED")
+	}
+	if !noreply {
+		c.w.WriteString(reply + "\r\n")
+	}
+	return nil
+}
+
+// readData reads the data block of bytes after reserved space. nil data is returned with the
+// error reply if the data block is invalid. The data block is read even if the command is invalid
+// to keep the stream in sync.
+func (c *memcachedConn) readData(bytes string, reserved int) ([]byte, string, error) {
+	size, err := strconv.Atoi(bytes)
+	if err != nil || size < 0 || size > memcachedMaxData {
+		return nil, "CLIENT_ERROR bad data chunk", nil
+	}
+	data := make([]byte, reserved+size+2)
+	if _, err = io.ReadFull(c.r, data[reserved:]); err != nil {
+		return nil, "", err
+	} else if data[len(data)-2] != '\r' || data[len(data)-1] != '\n' {
+		// skip the rest of the data block which is longer than bytes
+		if data[len(data)-1] != '\n' {
+			if _, err = c.r.ReadString('\n'); err != nil {
+				return nil, "", err
+			}
+		}
+		return nil, "CLIENT_ERROR bad data chunk", nil
+	}
+	return data[:len(data)-2], "", nil
+}
+
+// auth authenticates the user by the data of storage command.
+func (c *memcachedConn) auth(args []string, noreply bool) error {
+	if len(args) < 5 {
+		c.w.WriteString("ERROR\r\n")
+		return nil
+	}
+	data, reply, err := c.readData(args[4], 0)
+	if err != nil || data == nil {
+		c.w.WriteString(reply + "\r\n")
+		return err
+	}
+	reply = "STORED"
+	if fields := strings.Fields(string(data)); len(fields) == 2 {
+		if err = c.storage.acl.Authenticate(fields[0], fields[1]); err == nil {
+			c.user = fields[0]
+		}
+	} else if len(fields) == 1 {
+		c.user, err = c.storage.acl.AuthenticateToken(fields[0])
+	} else {
+		err = ErrAuth
+	}
+	if err != nil {
+		reply = "CLIENT_ERROR authentication failure"
+	}
+	if !noreply {
+		c.w.WriteString(reply + "\r\n")
+	}
+	return nil
+}
+
+// validate returns the error reply of the arguments of storage commands, or empty if valid.
+func (c *memcachedConn) validate(args []string) string {
+	key := args[1]
+	if len(key) > memcachedMaxKeyLen || strings.IndexFunc(key, func(r rune) bool { return r < 0x21 || r == 0x7f }) >= 0 {
+		return "CLIENT_ERROR bad command line format"
+	} else if _, err := strconv.ParseUint(args[2], 10, 32); err != nil {
+		return "CLIENT_ERROR bad command line format"
+	} else if _, err := strconv.ParseInt(args[3], 10, 64); err != nil {
+		return "CLIENT_ERROR bad command line format"
+	}
+	if len(args) == 6 {
+		if _, err := strconv.ParseUint(args[5], 10, 64); err != nil {
+			return "CLIENT_ERROR bad command line format"
+		}
+	}
+	return ""
+}
+
+// expire sets exptime of memcached as the TTL of the stored record. exptime larger than 30 days
+// is the unix time, and negative exptime or the unix time in the past deletes the record as
+// expired immediately.
+func (c *memcachedConn) expire(txn *Txn, key string, exptime int64) error {
+	ttl := time.Duration(exptime) * time.Second
+	if exptime > memcachedMaxRelative {
+		ttl = time.Unix(exptime, 0).Sub(c.storage.now())
+	}
+	if exptime != 0 && ttl <= 0 {
+		return txn.Delete(key)
+	}
+	return txn.Expire(key, ttl)
+}
+
+// touch supports touch <key> <exptime> [noreply], which updates the TTL of the record.
+func (c *memcachedConn) touch(key, exptime string) string {
+	n, err := strconv.ParseInt(exptime, 10, 64)
+	if err != nil {
+		return "CLIENT_ERROR invalid exptime argument"
+	}
+	return c.reply(c.storage.autoCommitAs(actorOf(c.user, c.addr), func(txn *Txn) error {
+		if err := c.storage.acl.Authorize(c.user, key, PermWrite); err != nil {
+			return err
+		} else if _, err = txn.Read(key); err != nil {
+			return err
+		}
+		return c.expire(txn, key, n)
+	}), "TOUCHED")
+}
+
+// incr increments or decrements the 64 bit unsigned decimal value. incr wraps around on
+// overflow and decr does not go below 0 like memcached.
+func (c *memcachedConn) incr(key, delta string, decr bool) string {
+	d, err := strconv.ParseUint(delta, 10, 64)
+	if err != nil {
+		return "CLIENT_ERROR invalid numeric delta argument"
+	}
+	var n uint64
+	err = c.storage.autoCommitAs(actorOf(c.user, c.addr), func(txn *Txn) error {
+		if err := c.storage.acl.Authorize(c.user, key, PermRead|PermWrite); err != nil {
+			return err
+		}
+		return txn.GetAndUpdate(key, func(old []byte) ([]byte, error) {
+			if old == nil {
+				return nil, ErrNotExist
+			} else if len(old) < memcachedFlagsSize {
+				return nil, errors.New("broken value of " + key)
+			}
+			var err error
+			n, err = strconv.ParseUint(string(old[memcachedFlagsSize:]), 10, 64)
+			if err != nil {
+				return nil, errors.New("CLIENT_ERROR cannot increment or decrement non-numeric value")
+			}
+			if !decr {
+				n += d
+			} else if n < d {
+				n = 0
+			} else {
+				n -= d
+			}
+			return strconv.AppendUint(old[:memcachedFlagsSize:memcachedFlagsSize], n, 10), nil
+		})
+	})
+	return c.reply(err, strconv.FormatUint(n, 10))
+}
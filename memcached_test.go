@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHandleMemcached(t *testing.T) {
+	storage := createTestStorage(t)
+	defer storage.wal.Close()
+	client, server := net.Pipe()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go HandleMemcached(server, server, storage, &wg)
+	defer client.Close()
+	r := bufio.NewReader(client)
+
+	// do sends the command and reads reply lines until the line terminating the reply.
+	do := func(cmd string) string {
+		t.Helper()
+		if _, err := client.Write([]byte(cmd)); err != nil {
+			t.Fatal(err)
+		}
+		var lines []string
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatalf("failed to read reply : %v", err)
+			}
+			line = strings.TrimSuffix(line, "\r\n")
+			lines = append(lines, line)
+			if !strings.HasPrefix(line, "VALUE ") && (len(lines) == 1 || !strings.HasPrefix(lines[len(lines)-2], "VALUE ")) {
+				return strings.Join(lines, "|")
+			}
+		}
+	}
+
+	for _, c := range []struct {
+		cmd      string
+		expected string
+	}{
+		{"set k1 5 0 2\r\nv1\r\n", "STORED"},
+		{"get k1\r\n", "VALUE k1 5 2|v1|END"},
+		{"get none\r\n", "END"},
+		{"add k1 0 0 2\r\nv2\r\n", "NOT_STORED"},
+		{"add k2 0 0 2\r\nv2\r\n", "STORED"},
+		{"replace k3 0 0 2\r\nv3\r\n", "NOT_STORED"},
+		{"replace k2 1 0 3\r\nv22\r\n", "STORED"},
+		{"get k1 none k2\r\n", "VALUE k1 5 2|v1|VALUE k2 1 3|v22|END"},
+		{"gets k1\r\n", "VALUE k1 5 2 1|v1|END"},
+		{"cas k1 0 0 2 100\r\nv3\r\n", "EXISTS"},
+		{"cas k1 0 0 2 1\r\nv3\r\n", "STORED"},
+		{"cas none 0 0 2 1\r\nv3\r\n", "NOT_FOUND"},
+		{"get k1\r\n", "VALUE k1 0 2|v3|END"},
+		{"delete k2\r\n", "DELETED"},
+		{"delete k2\r\n", "NOT_FOUND"},
+		{"set n 0 0 2\r\n10\r\n", "STORED"},
+		{"incr n 5\r\n", "15"},
+		{"decr n 20\r\n", "0"},
+		{"set n 0 0 20\r\n18446744073709551615\r\n", "STORED"},
+		{"incr n 2\r\n", "1"},
+		{"incr k1 1\r\n", "CLIENT_ERROR cannot increment or decrement non-numeric value"},
+		{"incr none 1\r\n", "NOT_FOUND"},
+		{"set k4 0 0 2 noreply\r\nv4\r\nget k4\r\n", "VALUE k4 0 2|v4|END"},
+		{"set k5 0 -1 2\r\nv5\r\n", "STORED"},
+		{"set k5 0 abc 2\r\nv5\r\n", "CLIENT_ERROR bad command line format"},
+		{"set k5 0 0 2\r\nv55\r\n", "CLIENT_ERROR bad data chunk"},
+		{"foo\r\n", "ERROR"},
+		{"version\r\n", "VERSION 0.0.0"},
+	} {
+		if reply := do(c.cmd); reply != c.expected {
+			t.Errorf("reply of %q not match %q, expected %q", c.cmd, reply, c.expected)
+		}
+	}
+	client.Write([]byte("quit\r\n"))
+	wg.Wait()
+
+	// committed records are in storage
+	txn := storage.NewTxn()
+	assertValue(t, txn, "k1", []byte("\x00\x00\x00\x00v3"))
+	assertNotExist(t, txn, "k2")
+	assertNotExist(t, txn, "k5")
+}
+
+func TestHandleMemcached_Expire(t *testing.T) {
+	storage := createTestStorage(t)
+	defer storage.wal.Close()
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	storage.opts.Now = func() time.Time { return now }
+	client, server := net.Pipe()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go HandleMemcached(server, server, storage, &wg)
+	defer client.Close()
+	r := bufio.NewReader(client)
+
+	for _, c := range []struct {
+		cmd      string
+		expected string
+		// elapsed is the time passed before the command
+		elapsed time.Duration
+	}{
+		{"set k1 0 10 2\r\nv1\r\n", "STORED", 0},
+		{"set k2 0 " + strconv.FormatInt(now.Add(time.Hour).Unix(), 10) + " 2\r\nv2\r\n", "STORED", 0},
+		{"add k3 0 20 2\r\nv3\r\n", "STORED", 0},
+		{"touch k3 5\r\n", "TOUCHED", 0},
+		{"touch none 5\r\n", "NOT_FOUND", 0},
+		{"touch k3 abc\r\n", "CLIENT_ERROR invalid exptime argument", 0},
+		{"get k1\r\n", "VALUE", 9 * time.Second},
+		{"get k1 k3\r\n", "END", time.Second},
+		{"get k2\r\n", "VALUE", 0},
+		{"set k2 0 0 2\r\nv2\r\n", "STORED", 0},
+		{"get k2\r\n", "VALUE", 2 * time.Hour},
+		{"set k2 0 " + strconv.FormatInt(now.Unix(), 10) + " 2\r\nv2\r\n", "STORED", 2 * time.Hour},
+		{"get k2\r\n", "END", 0},
+	} {
+		now = now.Add(c.elapsed)
+		if _, err := client.Write([]byte(c.cmd)); err != nil {
+			t.Fatal(err)
+		}
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		} else if reply := strings.Fields(line)[0]; reply != c.expected && strings.TrimSpace(line) != c.expected {
+			t.Errorf("reply of %q not match %q, expected %q", c.cmd, line, c.expected)
+		}
+		if strings.HasPrefix(line, "VALUE") {
+			// data and END
+			r.ReadString('\n')
+			r.ReadString('\n')
+		}
+	}
+	client.Write([]byte("quit\r\n"))
+	wg.Wait()
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"io"
+	"math"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencySamples is the number of recent samples to calculate quantiles of latency.
+const latencySamples = 1024
+
+// Metric is the metric kept in MetricsRegistry. Counter, Gauge and Histogram are built in, and
+// other metrics are registered by implementing Metric.
+type Metric interface {
+	Name() string
+	Help() string
+	// Type is the type of Prometheus, "counter", "gauge", "histogram" or "summary".
+	Type() string
+	// Samples returns the current samples of the metric.
+	Samples() []Sample
+}
+
+// Sample is the sample of Metric. Suffix is appended to the name of the metric such as "_sum".
+type Sample struct {
+	Suffix string
+	Labels map[string]string
+	Value  float64
+}
+
+// MetricsRegistry keeps metrics updated by the engine independently of any server. Adapters
+// export them in Prometheus text exposition format or as expvar.
+type MetricsRegistry struct {
+	mu      sync.RWMutex
+	metrics []Metric
+	names   map[string]bool
+}
+
+func NewMetricsRegistry() *MetricsRegistry {
+	return &MetricsRegistry{names: make(map[string]bool)}
+}
+
+// Register adds the metric. It fails if the metric of the same name is already registered.
+func (r *MetricsRegistry) Register(m Metric) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.names[m.Name()] {
+		return fmt.Errorf("metric is already registered : %q", m.Name())
+	}
+	r.names[m.Name()] = true
+	r.metrics = append(r.metrics, m)
+	return nil
+}
+
+// mustRegister registers the metric created by the registry, and panics on the duplicate name
+// like expvar.Publish.
+func (r *MetricsRegistry) mustRegister(m Metric) {
+	if err := r.Register(m); err != nil {
+		panic(err)
+	}
+}
+
+// Counter creates and registers a counter.
+func (r *MetricsRegistry) Counter(name, help string) *Counter {
+	c := &Counter{desc: metricDesc{name, help}}
+	r.mustRegister(c)
+	return c
+}
+
+// Gauge creates and registers a gauge.
+func (r *MetricsRegistry) Gauge(name, help string) *Gauge {
+	g := &Gauge{desc: metricDesc{name, help}}
+	r.mustRegister(g)
+	return g
+}
+
+// GaugeFunc registers a gauge whose samples are returned by fn when collected.
+func (r *MetricsRegistry) GaugeFunc(name, help string, fn func() []Sample) {
+	r.mustRegister(&gaugeFunc{desc: metricDesc{name, help}, fn: fn})
+}
+
+// Histogram creates and registers a histogram with the upper bounds of buckets in ascending
+// order. The bucket of +Inf is added implicitly.
+func (r *MetricsRegistry) Histogram(name, help string, buckets []float64) *Histogram {
+	h := &Histogram{desc: metricDesc{name, help}, bounds: buckets, counts: make([]uint64, len(buckets)+1)}
+	r.mustRegister(h)
+	return h
+}
+
+// Metrics returns registered metrics in order of registration.
+func (r *MetricsRegistry) Metrics() []Metric {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]Metric(nil), r.metrics...)
+}
+
+// WritePrometheus writes all metrics in Prometheus text exposition format.
+func (r *MetricsRegistry) WritePrometheus(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, m := range r.Metrics() {
+		samples := m.Samples()
+		if len(samples) == 0 {
+			continue
+		}
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", m.Name(), m.Help(), m.Name(), m.Type())
+		for _, sample := range samples {
+			fmt.Fprintf(bw, "%s%s%s %s\n", m.Name(), sample.Suffix, formatLabels(sample.Labels), formatFloat(sample.Value))
+		}
+	}
+	return bw.Flush()
+}
+
+// Expvar returns the expvar.Var which exports all samples as a JSON object keyed by the name,
+// the suffix and the labels of each sample like Prometheus.
+func (r *MetricsRegistry) Expvar() expvar.Var {
+	return expvar.Func(func() interface{} {
+		values := make(map[string]float64)
+		for _, m := range r.Metrics() {
+			for _, sample := range m.Samples() {
+				values[m.Name()+sample.Suffix+formatLabels(sample.Labels)] = sample.Value
+			}
+		}
+		return values
+	})
+}
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%s=%q", name, labels[name])
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type metricDesc struct {
+	name string
+	help string
+}
+
+func (d *metricDesc) Name() string {
+	return d.name
+}
+
+func (d *metricDesc) Help() string {
+	return d.help
+}
+
+// Counter is the monotonically increasing counter updated atomically.
+type Counter struct {
+	desc metricDesc
+	v    atomic.Uint64
+}
+
+func (c *Counter) Name() string { return c.desc.Name() }
+func (c *Counter) Help() string { return c.desc.Help() }
+func (c *Counter) Type() string { return "counter" }
+
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+
+func (c *Counter) Add(n uint64) {
+	c.v.Add(n)
+}
+
+func (c *Counter) Value() uint64 {
+	return c.v.Load()
+}
+
+func (c *Counter) Samples() []Sample {
+	return []Sample{{Value: float64(c.Value())}}
+}
+
+// Gauge is the value which goes up and down updated atomically.
+type Gauge struct {
+	desc metricDesc
+	bits atomic.Uint64
+}
+
+func (g *Gauge) Name() string { return g.desc.Name() }
+func (g *Gauge) Help() string { return g.desc.Help() }
+func (g *Gauge) Type() string { return "gauge" }
+
+func (g *Gauge) Set(v float64) {
+	g.bits.Store(math.Float64bits(v))
+}
+
+func (g *Gauge) Add(delta float64) {
+	for {
+		old := g.bits.Load()
+		if g.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+delta)) {
+			return
+		}
+	}
+}
+
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(g.bits.Load())
+}
+
+func (g *Gauge) Samples() []Sample {
+	return []Sample{{Value: g.Value()}}
+}
+
+type gaugeFunc struct {
+	desc metricDesc
+	fn   func() []Sample
+}
+
+func (g *gaugeFunc) Name() string      { return g.desc.Name() }
+func (g *gaugeFunc) Help() string      { return g.desc.Help() }
+func (g *gaugeFunc) Type() string      { return "gauge" }
+func (g *gaugeFunc) Samples() []Sample { return g.fn() }
+
+// Histogram counts observations in buckets, and keeps the count and the sum of them.
+type Histogram struct {
+	desc   metricDesc
+	bounds []float64
+	mu     sync.Mutex
+	// counts is the non-cumulative count of each bucket and +Inf.
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (h *Histogram) Name() string { return h.desc.Name() }
+func (h *Histogram) Help() string { return h.desc.Help() }
+func (h *Histogram) Type() string { return "histogram" }
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[i]++
+	h.count++
+	h.sum += v
+}
+
+// ObserveDuration observes the duration in seconds.
+func (h *Histogram) ObserveDuration(d time.Duration) {
+	h.Observe(d.Seconds())
+}
+
+func (h *Histogram) Samples() []Sample {
+	h.mu.Lock()
+	counts := append([]uint64(nil), h.counts...)
+	count, sum := h.count, h.sum
+	h.mu.Unlock()
+
+	samples := make([]Sample, 0, len(counts)+2)
+	var cumulative uint64
+	for i, n := range counts {
+		cumulative += n
+		le := math.Inf(1)
+		if i < len(h.bounds) {
+			le = h.bounds[i]
+		}
+		samples = append(samples, Sample{Suffix: "_bucket", Labels: map[string]string{"le": formatFloat(le)}, Value: float64(cumulative)})
+	}
+	return append(samples, Sample{Suffix: "_sum", Value: sum}, Sample{Suffix: "_count", Value: float64(count)})
+}
+
+// ExponentialBuckets returns n upper bounds of buckets starting from start multiplied by factor.
+func ExponentialBuckets(start, factor float64, n int) []float64 {
+	buckets := make([]float64, n)
+	for i := range buckets {
+		buckets[i] = start
+		start *= factor
+	}
+	return buckets
+}
+
+// latencySummary keeps recent samples to calculate quantiles, and the total of all samples.
+type latencySummary struct {
+	desc    metricDesc
+	mu      sync.Mutex
+	samples [latencySamples]time.Duration
+	count   uint64
+	sum     time.Duration
+}
+
+func (l *latencySummary) Name() string { return l.desc.Name() }
+func (l *latencySummary) Help() string { return l.desc.Help() }
+func (l *latencySummary) Type() string { return "summary" }
+
+func (l *latencySummary) observe(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.samples[l.count%latencySamples] = d
+	l.count++
+	l.sum += d
+}
+
+// quantiles returns the latency of each quantile in recent samples, and the count and the sum
+// of all samples.
+func (l *latencySummary) quantiles(qs ...float64) ([]time.Duration, uint64, time.Duration) {
+	l.mu.Lock()
+	n := l.count
+	if n > latencySamples {
+		n = latencySamples
+	}
+	samples := make([]time.Duration, n)
+	copy(samples, l.samples[:n])
+	count, sum := l.count, l.sum
+	l.mu.Unlock()
+
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	result := make([]time.Duration, len(qs))
+	for i, q := range qs {
+		if len(samples) > 0 {
+			result[i] = samples[int(q*float64(len(samples)-1))]
+		}
+	}
+	return result, count, sum
+}
+
+// Samples returns the latency in seconds of 0.5, 0.9 and 0.99 quantiles.
+func (l *latencySummary) Samples() []Sample {
+	qs := []float64{0.5, 0.9, 0.99}
+	latencies, count, sum := l.quantiles(qs...)
+	samples := make([]Sample, 0, len(qs)+2)
+	for i, q := range qs {
+		samples = append(samples, Sample{Labels: map[string]string{"quantile": formatFloat(q)}, Value: latencies[i].Seconds()})
+	}
+	return append(samples, Sample{Suffix: "_sum", Value: sum.Seconds()}, Sample{Suffix: "_count", Value: float64(count)})
+}
+
+// metrics is the metrics updated by Storage.
+type metrics struct {
+	registry *MetricsRegistry
+	// commits and aborts count transactions which have writes.
+	commits *Counter
+	aborts  *Counter
+	// conflicts counts deadlocks and version mismatches of optimistic updates.
+	conflicts *Counter
+	walBytes  *Counter
+	fsync     *latencySummary
+	// serialize, write, fsyncHist and apply are the latency of each phase of commits.
+	serialize *Histogram
+	write     *Histogram
+	fsyncHist *Histogram
+	apply     *Histogram
+	// expired counts records deleted by the background expiration, and expiredReads counts
+	// reads which found the record whose TTL passes.
+	expired      *Counter
+	expiredReads *Counter
+	// throttled counts commits waiting for the admission control, and rejected counts commits
+	// failed with ErrOverloaded.
+	throttled *Counter
+	rejected  *Counter
+}
+
+func (m *metrics) conflict() {
+	m.conflicts.Inc()
+}
+
+// initMetrics registers metrics of the storage into the new registry.
+func (s *Storage) initMetrics() {
+	r := NewMetricsRegistry()
+	s.metrics = metrics{
+		registry:  r,
+		commits:   r.Counter("txngo_commits_total", "Number of committed transactions which have writes."),
+		aborts:    r.Counter("txngo_aborts_total", "Number of aborted transactions which have writes."),
+		conflicts: r.Counter("txngo_conflicts_total", "Number of deadlocks and version mismatches."),
+		walBytes:  r.Counter("txngo_wal_written_bytes_total", "Bytes written into WAL."),
+		fsync:     &latencySummary{desc: metricDesc{"txngo_wal_fsync_seconds", "Latency of fsync of WAL."}},
+
+		expired:      r.Counter("txngo_expired_keys_total", "Number of records deleted by the background expiration of TTL."),
+		expiredReads: r.Counter("txngo_expired_reads_total", "Number of reads which found records whose TTL passes."),
+		throttled:    r.Counter("txngo_throttled_commits_total", "Number of commits waiting for admission while overloaded."),
+		rejected:     r.Counter("txngo_rejected_commits_total", "Number of commits rejected by ErrOverloaded."),
+	}
+	r.mustRegister(s.metrics.fsync)
+	// 1us to 4s
+	buckets := ExponentialBuckets(1e-6, 4, 12)
+	s.metrics.serialize = r.Histogram("txngo_commit_serialize_seconds", "Latency of serialization of logs into WAL records by commits.", buckets)
+	s.metrics.write = r.Histogram("txngo_commit_write_seconds", "Latency of writes of WAL records by commits.", buckets)
+	s.metrics.fsyncHist = r.Histogram("txngo_commit_fsync_seconds", "Latency of fsync of WAL by commits.", buckets)
+	s.metrics.apply = r.Histogram("txngo_commit_apply_seconds", "Latency of applying logs to the backend by commits.", buckets)
+
+	gauge := func(name, help string, fn func() float64) {
+		r.GaugeFunc(name, help, func() []Sample { return []Sample{{Value: fn()}} })
+	}
+	gauge("txngo_wal_size_bytes", "Current size of WAL.", func() float64 {
+		s.muWAL.Lock()
+		defer s.muWAL.Unlock()
+		return float64(s.walSize)
+	})
+	gauge("txngo_commit_version", "Last commit version.", func() float64 {
+		s.muWAL.Lock()
+		defer s.muWAL.Unlock()
+		return float64(s.version)
+	})
+	gauge("txngo_keys", "Number of keys.", func() float64 {
+		s.muDB.RLock()
+		defer s.muDB.RUnlock()
+		return float64(s.keyCount())
+	})
+	gauge("txngo_memory_heap_bytes", "Bytes of allocated heap objects.", func() float64 {
+		var mem runtime.MemStats
+		runtime.ReadMemStats(&mem)
+		return float64(mem.HeapAlloc)
+	})
+	gauge("txngo_memory_sys_bytes", "Bytes of memory obtained from the OS.", func() float64 {
+		var mem runtime.MemStats
+		runtime.ReadMemStats(&mem)
+		return float64(mem.Sys)
+	})
+
+	// samples of quotas are omitted if no quota is set.
+	quotas := func(fn func(u *QuotaUsage) float64) func() []Sample {
+		return func() []Sample {
+			s.muDB.RLock()
+			defer s.muDB.RUnlock()
+			var samples []Sample
+			for _, u := range s.quotas {
+				samples = append(samples, Sample{Labels: map[string]string{"prefix": u.Prefix}, Value: fn(u)})
+			}
+			return samples
+		}
+	}
+	r.GaugeFunc("txngo_quota_keys", "Number of records of the prefix of the quota.", quotas(func(u *QuotaUsage) float64 {
+		return float64(u.Keys)
+	}))
+	r.GaugeFunc("txngo_quota_bytes", "Total bytes of values of records of the prefix of the quota.", quotas(func(u *QuotaUsage) float64 {
+		return float64(u.Bytes)
+	}))
+
+	// samples of replicas are omitted if no replica is connected.
+	replicas := func(fn func(r ReplicaStatus) float64) func() []Sample {
+		return func() []Sample {
+			var samples []Sample
+			for _, r := range s.Replicas() {
+				samples = append(samples, Sample{Labels: map[string]string{"replica": r.ID}, Value: fn(r)})
+			}
+			return samples
+		}
+	}
+	r.GaugeFunc("txngo_replica_lag_versions", "Number of commit versions the replica is behind.", replicas(func(r ReplicaStatus) float64 {
+		return float64(r.Lag)
+	}))
+	r.GaugeFunc("txngo_replica_connected", "Whether the replica is connected.", replicas(func(r ReplicaStatus) float64 {
+		if r.Connected {
+			return 1
+		}
+		return 0
+	}))
+}
+
+// Metrics returns the registry of metrics of the storage. Applications may register their own
+// metrics into it. It is available even if the admin server is not started.
+func (s *Storage) Metrics() *MetricsRegistry {
+	return s.metrics.registry
+}
+
+// WriteMetrics writes metrics of the storage in Prometheus text exposition format.
+func (s *Storage) WriteMetrics(w io.Writer) error {
+	return s.metrics.registry.WritePrometheus(w)
+}
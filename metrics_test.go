@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStorage_WriteMetrics(t *testing.T) {
+	storage := createTestStorage(t)
+	defer storage.wal.Close()
+	if err := storage.Put("key1", []byte("value1")); err != nil {
+		t.Fatal(err)
+	} else if err = storage.Put("key2", []byte("value2")); err != nil {
+		t.Fatal(err)
+	}
+	txn := storage.NewTxn()
+	if err := txn.Delete("key1"); err != nil {
+		t.Fatal(err)
+	}
+	txn.Abort()
+	txn = storage.NewTxn()
+	if err := txn.UpdateIfVersion("key2", []byte("value3"), 100); err != ErrVersion {
+		t.Fatalf("update with wrong version : %v", err)
+	}
+	txn.Abort()
+
+	var buf bytes.Buffer
+	if err := storage.WriteMetrics(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, line := range []string{
+		"# TYPE txngo_commits_total counter\n",
+		"txngo_commits_total 2\n",
+		"txngo_aborts_total 1\n",
+		"txngo_conflicts_total 1\n",
+		"txngo_wal_fsync_seconds_count 2\n",
+		"# TYPE txngo_commit_serialize_seconds histogram\n",
+		"txngo_commit_serialize_seconds_count 2\n",
+		"txngo_commit_write_seconds_count 2\n",
+		"txngo_commit_fsync_seconds_count 2\n",
+		"txngo_commit_fsync_seconds_bucket{le=\"+Inf\"} 2\n",
+		"txngo_commit_apply_seconds_count 2\n",
+		"txngo_commit_version 2\n",
+		"txngo_keys 2\n",
+	} {
+		if !strings.Contains(out, line) {
+			t.Errorf("metrics does not contain %q :\n%v", line, out)
+		}
+	}
+
+	var l latencySummary
+	for i := 1; i <= 2000; i++ {
+		l.observe(time.Duration(i))
+	}
+	if qs, count, sum := l.quantiles(0, 0.5, 1); qs[0] != 977 || qs[1] != 1488 || qs[2] != 2000 || count != 2000 || sum != 2001000 {
+		t.Errorf("quantiles of recent samples : %v %v %v", qs, count, sum)
+	}
+
+	// metrics is public even if ACL is enabled
+	acl, err := LoadACL(tmpdir + "/test.acl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.EnableACL(acl)
+	srv := httptest.NewServer(NewAdminServer(storage))
+	defer srv.Close()
+	res, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if body, _ := io.ReadAll(res.Body); res.StatusCode != http.StatusOK || !strings.Contains(string(body), "txngo_keys 2\n") {
+		t.Errorf("metrics endpoint : %v %s", res.StatusCode, body)
+	}
+}
+
+func TestMetricsRegistry(t *testing.T) {
+	r := NewMetricsRegistry()
+	c := r.Counter("test_total", "Test counter.")
+	g := r.Gauge("test_gauge", "Test gauge.")
+	h := r.Histogram("test_seconds", "Test histogram.", ExponentialBuckets(0.1, 10, 2))
+	c.Inc()
+	c.Add(2)
+	g.Set(1.5)
+	g.Add(-2)
+	for _, v := range []float64{0.05, 0.1, 0.5, 3} {
+		h.Observe(v)
+	}
+	if err := r.Register(&Counter{desc: metricDesc{"test_total", "duplicate"}}); err == nil {
+		t.Errorf("duplicate metric is registered")
+	}
+
+	var buf bytes.Buffer
+	if err := r.WritePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total 3
+# HELP test_gauge Test gauge.
+# TYPE test_gauge gauge
+test_gauge -0.5
+# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.1"} 2
+test_seconds_bucket{le="1"} 3
+test_seconds_bucket{le="+Inf"} 4
+test_seconds_sum 3.65
+test_seconds_count 4
+`
+	if buf.String() != expected {
+		t.Errorf("prometheus format :\n%v", buf.String())
+	}
+
+	var values map[string]float64
+	if err := json.Unmarshal([]byte(r.Expvar().String()), &values); err != nil {
+		t.Fatal(err)
+	} else if values["test_total"] != 3 || values["test_gauge"] != -0.5 || values[`test_seconds_bucket{le="1"}`] != 3 || values["test_seconds_count"] != 4 {
+		t.Errorf("expvar : %v", values)
+	}
+}
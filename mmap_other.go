@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+
+package main
+
+import "errors"
+
+func mmap(f File, size int) ([]byte, error) {
+	return nil, errors.New("mmap is not supported on this platform")
+}
+
+func munmap(data []byte) error {
+	return nil
+}
@@ -0,0 +1,20 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+func mmap(f File, size int) ([]byte, error) {
+	fd, ok := f.(interface{ Fd() uintptr })
+	if !ok {
+		return nil, errors.New("mmap is not supported by the file system")
+	}
+	return syscall.Mmap(int(fd.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmap(data []byte) error {
+	return syscall.Munmap(data)
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+const (
+	modelPut = iota
+	modelInsert
+	modelUpdate
+	modelDelete
+	modelSetNX
+	modelGetSet
+	// modelTxn runs ops in one transaction, and commits it or aborts it.
+	modelTxn
+	// modelCrash reopens the storage without checkpoint.
+	modelCrash
+	// modelRestart reopens the storage after checkpoint as graceful shutdown.
+	modelRestart
+)
+
+const modelKeys = 8
+
+var modelOpNames = []string{"put", "insert", "update", "delete", "setnx", "getset", "txn", "crash", "restart"}
+
+// modelOp is the operation applied to both of the storage and the reference map.
+type modelOp struct {
+	kind   int
+	key    string
+	value  string
+	ops    []modelOp
+	commit bool
+}
+
+func (op modelOp) String() string {
+	switch op.kind {
+	case modelTxn:
+		return fmt.Sprintf("txn(commit=%v)%v", op.commit, op.ops)
+	case modelCrash, modelRestart, modelDelete:
+		return modelOpNames[op.kind] + " " + op.key
+	}
+	return fmt.Sprintf("%s %s=%s", modelOpNames[op.kind], op.key, op.value)
+}
+
+// modelOps is the random sequence of operations generated by testing/quick.
+type modelOps []modelOp
+
+func genModelOp(rnd *rand.Rand, txn bool) modelOp {
+	kind := rnd.Intn(modelGetSet + 1)
+	if n := rnd.Intn(20); !txn && n < 3 {
+		kind = modelTxn
+	} else if !txn && n == 3 {
+		kind = modelCrash
+	} else if !txn && n == 4 {
+		kind = modelRestart
+	}
+	op := modelOp{kind: kind, key: fmt.Sprintf("key%d", rnd.Intn(modelKeys)), value: fmt.Sprintf("value%d", rnd.Intn(100))}
+	if kind == modelTxn {
+		op.commit = rnd.Intn(4) != 0
+		for i := rnd.Intn(5) + 1; i > 0; i-- {
+			op.ops = append(op.ops, genModelOp(rnd, true))
+		}
+	}
+	return op
+}
+
+func (modelOps) Generate(rnd *rand.Rand, size int) reflect.Value {
+	ops := make(modelOps, rnd.Intn(size+1))
+	for i := range ops {
+		ops[i] = genModelOp(rnd, false)
+	}
+	return reflect.ValueOf(ops)
+}
+
+// applyModel applies the single operation to txn and the model, and returns the error if the
+// results are different.
+func applyModel(txn *Txn, model map[string]string, op modelOp) error {
+	old, exists := model[op.key]
+	var (
+		err      error
+		expected error
+	)
+	switch op.kind {
+	case modelPut:
+		err = txn.Put(op.key, []byte(op.value))
+		model[op.key] = op.value
+	case modelInsert:
+		if err = txn.Insert(op.key, []byte(op.value)); !exists {
+			model[op.key] = op.value
+		} else {
+			expected = ErrExist
+		}
+	case modelUpdate:
+		if err = txn.Update(op.key, []byte(op.value)); exists {
+			model[op.key] = op.value
+		} else {
+			expected = ErrNotExist
+		}
+	case modelDelete:
+		if err = txn.Delete(op.key); exists {
+			delete(model, op.key)
+		} else {
+			expected = ErrNotExist
+		}
+	case modelSetNX:
+		var ok bool
+		ok, err = txn.SetNX(op.key, []byte(op.value))
+		if !exists {
+			model[op.key] = op.value
+		}
+		if ok == exists {
+			return fmt.Errorf("setnx %s is %v", op.key, ok)
+		}
+	case modelGetSet:
+		var v []byte
+		v, err = txn.GetSet(op.key, []byte(op.value))
+		if exists && string(v) != old {
+			return fmt.Errorf("getset %s returned %q, expected %q", op.key, v, old)
+		} else if !exists && v != nil {
+			return fmt.Errorf("getset %s returned %q of not existing key", op.key, v)
+		}
+		model[op.key] = op.value
+	}
+	if err != expected {
+		return fmt.Errorf("%v : %v, expected %v", op, err, expected)
+	}
+	return nil
+}
+
+// checkModel checks that all of visible state of the storage is the same as the model.
+func checkModel(storage *Storage, model map[string]string) error {
+	for i := 0; i < modelKeys; i++ {
+		key := fmt.Sprintf("key%d", i)
+		v, err := storage.Get(key)
+		if expected, ok := model[key]; ok && (err != nil || string(v) != expected) {
+			return fmt.Errorf("%s is %q %v, expected %q", key, v, err, expected)
+		} else if !ok && err != ErrNotExist {
+			return fmt.Errorf("%s is %q %v, expected not exist", key, v, err)
+		}
+	}
+
+	keys := make([]string, 0, len(model))
+	for k := range model {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var scanned []string
+	txn := storage.NewTxn()
+	defer txn.Abort()
+	if err := txn.Scan("", func(key string, value []byte) error {
+		if string(value) != model[key] {
+			return fmt.Errorf("scanned %s=%q, expected %q", key, value, model[key])
+		}
+		scanned = append(scanned, key)
+		return nil
+	}); err != nil {
+		return err
+	} else if strings.Join(scanned, ",") != strings.Join(keys, ",") {
+		return fmt.Errorf("scanned %v, expected %v", scanned, keys)
+	}
+
+	first, _, err := txn.First()
+	last, _, err2 := txn.Last()
+	if len(keys) == 0 {
+		if err != ErrNotExist || err2 != ErrNotExist {
+			return fmt.Errorf("first %q %v and last %q %v of empty storage", first, err, last, err2)
+		}
+	} else if err != nil || err2 != nil || first != keys[0] || last != keys[len(keys)-1] {
+		return fmt.Errorf("first %q %v and last %q %v, expected %q and %q", first, err, last, err2, keys[0], keys[len(keys)-1])
+	}
+	return nil
+}
+
+// runModel runs ops against the storage opened by opts and the model, and checks the state
+// after every step.
+func runModel(opts Options, ops modelOps) error {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	storage, err := Open(opts)
+	if err != nil {
+		return err
+	}
+	defer func() { storage.wal.Close() }()
+	model := make(map[string]string)
+	for i, op := range ops {
+		switch op.kind {
+		case modelTxn:
+			next := make(map[string]string, len(model))
+			for k, v := range model {
+				next[k] = v
+			}
+			txn := storage.NewTxn()
+			for _, sub := range op.ops {
+				if err = applyModel(txn, next, sub); err != nil {
+					txn.Abort()
+					return fmt.Errorf("step %d %v : %w", i, op, err)
+				}
+			}
+			if !op.commit {
+				txn.Abort()
+			} else if err = txn.Commit(); err != nil {
+				return fmt.Errorf("step %d commit : %w", i, err)
+			} else {
+				model = next
+			}
+		case modelCrash, modelRestart:
+			if op.kind == modelRestart {
+				if err = storage.SaveCheckPoint(); err != nil {
+					return err
+				} else if err = storage.ClearWAL(); err != nil {
+					return err
+				}
+			}
+			storage.wal.Close()
+			if storage, err = Open(opts); err != nil {
+				return fmt.Errorf("step %d reopen : %w", i, err)
+			}
+		default:
+			if err = storage.autoCommit(func(txn *Txn) error { return applyModel(txn, model, op) }); err != nil {
+				return fmt.Errorf("step %d : %w", i, err)
+			}
+		}
+		if err = checkModel(storage, model); err != nil {
+			return fmt.Errorf("step %d after %v : %w", i, op, err)
+		}
+	}
+	return nil
+}
+
+func TestStorage_Model(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		opts Options
+	}{
+		{"map", Options{}},
+		{"map-max-memory", Options{MaxMemory: 16}},
+		{"map-values-on-disk", Options{ValuesOnDisk: true}},
+		{"btree", Options{Backend: "btree", CachePages: 4}},
+		{"hash", Options{Backend: "hash"}},
+		{"lsm", Options{Backend: "lsm", CheckpointSize: 256}},
+		{"partitions", Options{Partitions: 3, Compress: true}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			opts.WALPath, opts.DBPath = testWALPath, testDBPath
+			count := 30
+			if testing.Short() {
+				count = 5
+			}
+			var (
+				failed error
+				input  modelOps
+			)
+			if err := quick.Check(func(ops modelOps) bool {
+				failed, input = runModel(opts, ops), ops
+				return failed == nil
+			}, &quick.Config{MaxCount: count, Rand: rand.New(rand.NewSource(1))}); err != nil {
+				t.Fatalf("%v\nops : %v", failed, []modelOp(input))
+			}
+		})
+	}
+}
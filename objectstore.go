@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrObjectNotFound is returned by ObjectStore.Get if the object does not exist.
+var ErrObjectNotFound = errors.New("object is not found")
+
+// ObjectStore stores immutable objects by keys separated by "/", such as S3 compatible storage.
+type ObjectStore interface {
+	// Put writes the object, or replaces the object of the key.
+	Put(ctx context.Context, key string, data []byte) error
+	// Get opens the object, or returns ErrObjectNotFound.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// List returns keys of objects with the prefix in order.
+	List(ctx context.Context, prefix string) ([]string, error)
+	// Delete deletes the object. It succeeds if the object does not exist.
+	Delete(ctx context.Context, key string) error
+}
+
+// OpenObjectStore opens the object store of the URL and returns the prefix of keys in the URL.
+// "s3://bucket/prefix" is S3 compatible storage whose credentials are AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables. The query "endpoint" is the
+// URL of the service (https://s3.<region>.amazonaws.com if empty), and "region" is the region
+// (AWS_REGION or us-east-1 if empty). "file:///path" is the directory of DirObjectStore.
+func OpenObjectStore(rawURL string) (ObjectStore, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, "", err
+	}
+	switch u.Scheme {
+	case "file":
+		if u.Path == "" {
+			return nil, "", fmt.Errorf("object store %q has no directory", rawURL)
+		}
+		return NewDirObjectStore(u.Path), "", nil
+	case "s3":
+		if u.Host == "" {
+			return nil, "", fmt.Errorf("object store %q has no bucket", rawURL)
+		}
+		opts := S3Options{
+			Endpoint:        u.Query().Get("endpoint"),
+			Region:          u.Query().Get("region"),
+			Bucket:          u.Host,
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}
+		if opts.Region == "" {
+			opts.Region = os.Getenv("AWS_REGION")
+		}
+		store, err := NewS3ObjectStore(opts)
+		if err != nil {
+			return nil, "", err
+		}
+		prefix := strings.TrimPrefix(u.Path, "/")
+		if prefix != "" && !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		return store, prefix, nil
+	}
+	return nil, "", fmt.Errorf("object store %q is not supported", rawURL)
+}
+
+// DirObjectStore stores objects as files under the directory, such as the mount of network file
+// systems or tests. Objects are written into temporary files and renamed, so that they appear
+// atomically.
+type DirObjectStore struct {
+	dir string
+}
+
+// NewDirObjectStore returns the object store in dir, which is created by the first Put.
+func NewDirObjectStore(dir string) *DirObjectStore {
+	return &DirObjectStore{dir: dir}
+}
+
+// path returns the path of the key, which must not escape the directory.
+func (d *DirObjectStore) path(key string) (string, error) {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains("/"+key+"/", "/../") || strings.HasSuffix(key, ".tmp") {
+		return "", fmt.Errorf("invalid object key %q", key)
+	}
+	return filepath.Join(d.dir, filepath.FromSlash(key)), nil
+}
+
+func (d *DirObjectStore) Put(ctx context.Context, key string, data []byte) error {
+	path, err := d.path(key)
+	if err != nil {
+		return err
+	} else if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+func (d *DirObjectStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := d.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, ErrObjectNotFound
+	}
+	return f, err
+}
+
+func (d *DirObjectStore) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := filepath.Walk(d.dir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == d.dir {
+			return filepath.SkipDir
+		} else if err != nil {
+			return err
+		} else if info.IsDir() || strings.HasSuffix(path, ".tmp") {
+			return nil
+		}
+		rel, err := filepath.Rel(d.dir, path)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	sort.Strings(keys)
+	return keys, err
+}
+
+func (d *DirObjectStore) Delete(ctx context.Context, key string) error {
+	path, err := d.path(key)
+	if err != nil {
+		return err
+	} else if err = os.Remove(path); os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// S3Options is the options of S3ObjectStore.
+type S3Options struct {
+	// Endpoint is the URL of the service. https://s3.<Region>.amazonaws.com if empty.
+	Endpoint string
+	// Region is the region which requests are signed for. us-east-1 if empty.
+	Region string
+	Bucket string
+	// AccessKeyID and SecretAccessKey sign requests by AWS Signature Version 4, and
+	// SessionToken is added for temporary credentials.
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// Client sends requests. http.DefaultClient is used if nil.
+	Client *http.Client
+}
+
+// S3ObjectStore stores objects in the bucket of S3 compatible storage by path-style requests
+// signed by AWS Signature Version 4.
+type S3ObjectStore struct {
+	opts     S3Options
+	endpoint *url.URL
+	// now returns the time when requests are signed. tests replace it.
+	now func() time.Time
+}
+
+// NewS3ObjectStore returns the object store of the bucket.
+func NewS3ObjectStore(opts S3Options) (*S3ObjectStore, error) {
+	if opts.Bucket == "" {
+		return nil, errors.New("S3 requires the bucket")
+	} else if opts.AccessKeyID == "" || opts.SecretAccessKey == "" {
+		return nil, errors.New("S3 requires the access key id and the secret access key")
+	}
+	if opts.Region == "" {
+		opts.Region = "us-east-1"
+	}
+	if opts.Endpoint == "" {
+		opts.Endpoint = "https://s3." + opts.Region + ".amazonaws.com"
+	}
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	endpoint, err := url.Parse(opts.Endpoint)
+	if err != nil {
+		return nil, err
+	} else if endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		return nil, fmt.Errorf("invalid endpoint of S3 : %q", opts.Endpoint)
+	}
+	return &S3ObjectStore{opts: opts, endpoint: endpoint, now: time.Now}, nil
+}
+
+// do sends the signed request of the key with the query, and returns the response of 2xx.
+func (s *S3ObjectStore) do(ctx context.Context, method, key string, query url.Values, body []byte) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.opts.Bucket + "/" + key
+	u.RawPath = s3Escape(u.Path, false)
+	u.RawQuery = s3Query(query)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(body)
+	s.sign(req, hex.EncodeToString(sum[:]), s.now())
+	res, err := s.opts.Client.Do(req)
+	if err != nil {
+		return nil, err
+	} else if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return res, nil
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound && method == http.MethodGet && key != "" {
+		return nil, ErrObjectNotFound
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	return nil, fmt.Errorf("S3 responds %v to %v %v : %s", res.Status, method, key, bytes.TrimSpace(msg))
+}
+
+// sign signs the request by AWS Signature Version 4 with all headers set.
+func (s *S3ObjectStore) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.opts.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.opts.SessionToken)
+	}
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	names := []string{"host"}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonical strings.Builder
+	fmt.Fprintf(&canonical, "%s\n%s\n%s\n", req.Method, s3Escape(req.URL.Path, false), s3Query(req.URL.Query()))
+	for _, name := range names {
+		fmt.Fprintf(&canonical, "%s:%s\n", name, headers[name])
+	}
+	signed := strings.Join(names, ";")
+	fmt.Fprintf(&canonical, "\n%s\n%s", signed, payloadHash)
+
+	scope := amzDate[:8] + "/" + s.opts.Region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonical.String()))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+	key := []byte("AWS4" + s.opts.SecretAccessKey)
+	for _, part := range []string{amzDate[:8], s.opts.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.opts.AccessKeyID+"/"+scope+", SignedHeaders="+signed+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape escapes s by URI encoding of AWS Signature Version 4, which keeps only unreserved
+// characters and "/" unless slash is true.
+func s3Escape(s string, slash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && !slash {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Query returns the canonical query string sorted by names.
+func s3Query(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var parts []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			parts = append(parts, s3Escape(name, true)+"="+s3Escape(value, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func (s *S3ObjectStore) Put(ctx context.Context, key string, data []byte) error {
+	res, err := s.do(ctx, http.MethodPut, key, nil, data)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+func (s *S3ObjectStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	res, err := s.do(ctx, http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// s3ListResult is the response of ListObjectsV2.
+type s3ListResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (s *S3ObjectStore) List(ctx context.Context, prefix string) ([]string, error) {
+	var (
+		keys  []string
+		token string
+	)
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		res, err := s.do(ctx, http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid response of listing objects : %w", err)
+		}
+		for _, c := range result.Contents {
+			keys = append(keys, c.Key)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *S3ObjectStore) Delete(ctx context.Context, key string) error {
+	res, err := s.do(ctx, http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+)
+
+const (
+	pageSize = 4096
+
+	// values larger than overflowThreshold are stored in overflow pages.
+	overflowThreshold = pageSize / 4
+
+	// header sizes of each page type
+	metaHeaderSize     = 33
+	overflowHeaderSize = 13
+	freelistHeaderSize = 13
+)
+
+const (
+	pageMeta = 1 + iota
+	pageLeaf
+	pageBranch
+	pageOverflow
+	pageFreelist
+	pageBucket
+	pageDirectory
+)
+
+var ErrBrokenPage = errors.New("page is broken")
+
+// pager manages pages of the data file shared by disk-backed engines.
+// Pages are never overwritten until next commit of meta page (copy on write), so the data file
+// is always consistent with the last commit. Page 0 and 1 are meta pages used alternately.
+type pager struct {
+	path  string
+	magic uint32
+	// fs opens the data file.
+	fs FS
+	f  File
+	// pool caches pages of f. nil if cachePages is 0 or useMmap is true.
+	pool       *bufferPool
+	cachePages int
+	// useMmap makes pages read from memory mapped data file and OS page cache
+	// instead of buffer pool. data is remapped at every commit.
+	useMmap bool
+	data    []byte
+	// txid is incremented at every commit and selects the meta page.
+	txid   uint64
+	npages uint64
+	// free is the reusable page ids. pending is the released page ids which is referenced
+	// by the last commit and becomes reusable after next commit.
+	free          []uint64
+	pending       []uint64
+	freelistPages []uint64
+}
+
+func (p *pager) readPage(pgid uint64, buf []byte) error {
+	page, err := p.view(pgid, buf)
+	if err != nil {
+		return err
+	}
+	copy(buf[:pageSize], page)
+	return nil
+}
+
+// view returns the page. the returned page refers the memory mapped data file without copy
+// if it is mapped, otherwise the page is read into buf. the page must not be modified and
+// must not be used after next commit.
+func (p *pager) view(pgid uint64, buf []byte) ([]byte, error) {
+	if pgid < 2 || pgid >= p.npages {
+		return nil, fmt.Errorf("page id is out of range : %v", pgid)
+	}
+	if off := int(pgid) * pageSize; off+pageSize <= len(p.data) {
+		return p.data[off : off+pageSize], nil
+	}
+	return buf[:pageSize], p.read(pgid, buf)
+}
+
+func (p *pager) read(pgid uint64, buf []byte) error {
+	if p.pool != nil {
+		fr, err := p.pool.fetch(pgid, true)
+		if err != nil {
+			return err
+		}
+		copy(buf[:pageSize], fr.buf[:])
+		p.pool.unpin(fr, false)
+		return nil
+	}
+	n, err := p.f.ReadAt(buf[:pageSize], int64(pgid)*pageSize)
+	if n == pageSize {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return ErrBrokenPage
+}
+
+// writePage writes the page into buffer pool. the page is written back to the data file
+// when it is evicted or at commit.
+func (p *pager) writePage(pgid uint64, buf []byte) error {
+	if p.pool != nil {
+		fr, err := p.pool.fetch(pgid, false)
+		if err != nil {
+			return err
+		}
+		copy(fr.buf[:], buf[:pageSize])
+		p.pool.unpin(fr, true)
+		return nil
+	}
+	_, err := p.f.WriteAt(buf[:pageSize], int64(pgid)*pageSize)
+	return err
+}
+
+func (p *pager) setFile(f File) error {
+	p.f = f
+	if p.useMmap {
+		return p.remap()
+	} else if p.cachePages > 0 {
+		p.pool = newBufferPool(f, p.cachePages)
+	}
+	return nil
+}
+
+// DropCaches evicts all pages cached in buffer pool and returns the number of evicted pages.
+func (p *pager) DropCaches() (int, error) {
+	if p.pool == nil {
+		return 0, nil
+	}
+	return p.pool.drop()
+}
+
+// remap maps whole data file into memory.
+func (p *pager) remap() error {
+	if p.data != nil {
+		if err := munmap(p.data); err != nil {
+			return err
+		}
+		p.data = nil
+	}
+	info, err := p.f.Stat()
+	if err != nil {
+		return err
+	} else if info.Size() == 0 {
+		return nil
+	}
+	p.data, err = mmap(p.f, int(info.Size()))
+	return err
+}
+
+func (p *pager) allocate() uint64 {
+	if len(p.free) > 0 {
+		pgid := p.free[len(p.free)-1]
+		p.free = p.free[:len(p.free)-1]
+		return pgid
+	}
+	pgid := p.npages
+	p.npages++
+	return pgid
+}
+
+// release marks the page referenced by the last commit to be reused after next commit.
+func (p *pager) release(pgid uint64) {
+	p.pending = append(p.pending, pgid)
+}
+
+func (p *pager) writeOverflow(value []byte) (uint64, error) {
+	const capacity = pageSize - overflowHeaderSize
+	var (
+		buf  [pageSize]byte
+		next uint64
+	)
+	// write from the tail chunk so that each page knows the next page id
+	nchunks := (len(value) + capacity - 1) / capacity
+	for i := nchunks - 1; i >= 0; i-- {
+		chunk := value[i*capacity:]
+		if len(chunk) > capacity {
+			chunk = chunk[:capacity]
+		}
+		buf[0] = pageOverflow
+		binary.BigEndian.PutUint64(buf[1:9], next)
+		binary.BigEndian.PutUint32(buf[9:13], uint32(len(chunk)))
+		copy(buf[overflowHeaderSize:], chunk)
+		pgid := p.allocate()
+		if err := p.writePage(pgid, buf[:]); err != nil {
+			return 0, err
+		}
+		next = pgid
+	}
+	return next, nil
+}
+
+func (p *pager) readOverflow(pgid uint64, valueLen uint32) ([]byte, error) {
+	var buf [pageSize]byte
+	value := make([]byte, 0, valueLen)
+	for pgid != 0 {
+		page, err := p.view(pgid, buf[:])
+		if err != nil {
+			return nil, err
+		} else if page[0] != pageOverflow {
+			return nil, ErrBrokenPage
+		}
+		size := binary.BigEndian.Uint32(page[9:13])
+		if size > pageSize-overflowHeaderSize || len(value)+int(size) > int(valueLen) {
+			return nil, ErrBrokenPage
+		}
+		value = append(value, page[overflowHeaderSize:overflowHeaderSize+size]...)
+		pgid = binary.BigEndian.Uint64(page[1:9])
+	}
+	if len(value) != int(valueLen) {
+		return nil, ErrBrokenPage
+	}
+	return value, nil
+}
+
+// releaseOverflow releases the overflow pages of the value.
+func (p *pager) releaseOverflow(pgid uint64) error {
+	var buf [pageSize]byte
+	for pgid != 0 {
+		if err := p.readPage(pgid, buf[:]); err != nil {
+			return err
+		}
+		p.release(pgid)
+		pgid = binary.BigEndian.Uint64(buf[1:9])
+	}
+	return nil
+}
+
+func (p *pager) writeFreelist() (uint64, error) {
+	const capacity = (pageSize - freelistHeaderSize) / 8
+	// the pages of current freelist are released after this commit
+	p.pending = append(p.pending, p.freelistPages...)
+
+	// allocating freelist pages from free ids only decreases the ids to write.
+	npages := (len(p.free) + len(p.pending) + capacity - 1) / capacity
+	pages := make([]uint64, npages)
+	for i := range pages {
+		pages[i] = p.allocate()
+	}
+	ids := append(append([]uint64(nil), p.free...), p.pending...)
+
+	var buf [pageSize]byte
+	for i, pgid := range pages {
+		chunk := ids[i*capacity:]
+		if len(chunk) > capacity {
+			chunk = chunk[:capacity]
+		}
+		var next uint64
+		if i+1 < len(pages) {
+			next = pages[i+1]
+		}
+		buf[0] = pageFreelist
+		binary.BigEndian.PutUint64(buf[1:9], next)
+		binary.BigEndian.PutUint32(buf[9:13], uint32(len(chunk)))
+		for j, id := range chunk {
+			binary.BigEndian.PutUint64(buf[freelistHeaderSize+j*8:], id)
+		}
+		if err := p.writePage(pgid, buf[:]); err != nil {
+			return 0, err
+		}
+	}
+	p.freelistPages = pages
+	if len(pages) == 0 {
+		return 0, nil
+	}
+	return pages[0], nil
+}
+
+func (p *pager) readFreelist(pgid uint64) error {
+	var buf [pageSize]byte
+	p.free, p.freelistPages = nil, nil
+	for pgid != 0 {
+		if err := p.readPage(pgid, buf[:]); err != nil {
+			return err
+		} else if buf[0] != pageFreelist {
+			return ErrBrokenPage
+		}
+		count := int(binary.BigEndian.Uint32(buf[9:13]))
+		if freelistHeaderSize+count*8 > pageSize {
+			return ErrBrokenPage
+		}
+		for j := 0; j < count; j++ {
+			p.free = append(p.free, binary.BigEndian.Uint64(buf[freelistHeaderSize+j*8:]))
+		}
+		p.freelistPages = append(p.freelistPages, pgid)
+		pgid = binary.BigEndian.Uint64(buf[1:9])
+	}
+	return nil
+}
+
+// create creates the data file if it is not opened yet.
+func (p *pager) create() error {
+	if p.f != nil {
+		return nil
+	}
+	f, err := p.fs.OpenFile(p.path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	p.npages = 2
+	return p.setFile(f)
+}
+
+// commit writes freelist and the meta page with the payload of the engine.
+// All pages written before commit become durable and the released pages become reusable.
+func (p *pager) commit(payload []byte) error {
+	if metaHeaderSize+len(payload)+4 > pageSize {
+		return fmt.Errorf("meta payload is too large : %v", len(payload))
+	}
+	freelist, err := p.writeFreelist()
+	if err != nil {
+		return err
+	}
+	// all pages must be durable before meta page refers them
+	if p.pool != nil {
+		if err = p.pool.flush(); err != nil {
+			return err
+		}
+	}
+	if err = p.f.Sync(); err != nil {
+		return err
+	}
+
+	// meta layout : type(1) | magic(4) | txid(8) | npages(8) | freelist(8) | payloadLen(4) | payload | crc32(4)
+	var buf [pageSize]byte
+	txid := p.txid + 1
+	buf[0] = pageMeta
+	binary.BigEndian.PutUint32(buf[1:5], p.magic)
+	binary.BigEndian.PutUint64(buf[5:13], txid)
+	binary.BigEndian.PutUint64(buf[13:21], p.npages)
+	binary.BigEndian.PutUint64(buf[21:29], freelist)
+	binary.BigEndian.PutUint32(buf[29:33], uint32(len(payload)))
+	end := metaHeaderSize + copy(buf[metaHeaderSize:], payload)
+	binary.BigEndian.PutUint32(buf[end:], crc32.ChecksumIEEE(buf[:end]))
+	if _, err = p.f.WriteAt(buf[:], int64(txid%2)*pageSize); err != nil {
+		return err
+	} else if err = p.f.Sync(); err != nil {
+		return err
+	}
+	p.txid = txid
+	if p.useMmap {
+		if err = p.remap(); err != nil {
+			return err
+		}
+	}
+
+	// pages referenced by previous commit are not used anymore
+	p.free = append(p.free, p.pending...)
+	p.pending = nil
+	return nil
+}
+
+// open opens the data file and reads the newest valid meta page, then returns its payload.
+func (p *pager) open() ([]byte, error) {
+	f, err := p.fs.OpenFile(p.path, os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		buf      [pageSize]byte
+		payload  []byte
+		freelist uint64
+		found    bool
+	)
+	for i := int64(0); i < 2; i++ {
+		if _, err = f.ReadAt(buf[:], i*pageSize); err != nil {
+			continue
+		} else if buf[0] != pageMeta || binary.BigEndian.Uint32(buf[1:5]) != p.magic {
+			continue
+		}
+		end := metaHeaderSize + int(binary.BigEndian.Uint32(buf[29:33]))
+		if end+4 > pageSize || binary.BigEndian.Uint32(buf[end:]) != crc32.ChecksumIEEE(buf[:end]) {
+			continue
+		}
+		txid := binary.BigEndian.Uint64(buf[5:13])
+		if found && txid <= p.txid {
+			continue
+		}
+		found = true
+		p.txid = txid
+		p.npages = binary.BigEndian.Uint64(buf[13:21])
+		freelist = binary.BigEndian.Uint64(buf[21:29])
+		payload = append([]byte(nil), buf[metaHeaderSize:end]...)
+	}
+	if !found {
+		f.Close()
+		return nil, fmt.Errorf("db file is broken : no valid meta page")
+	}
+
+	p.pending = nil
+	if err = p.setFile(f); err == nil {
+		err = p.readFreelist(freelist)
+	}
+	if err != nil {
+		p.close()
+		p.f, p.pool = nil, nil
+		return nil, err
+	}
+	return payload, nil
+}
+
+func (p *pager) close() error {
+	if p.f == nil {
+		return nil
+	}
+	if p.data != nil {
+		munmap(p.data)
+		p.data = nil
+	}
+	return p.f.Close()
+}
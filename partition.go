@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+var ErrPartitionBroken = errors.New("partition is broken")
+
+// partitionEngine splits keyspace by hash of keys into partitions which have their own
+// engine and files. Partitions are saved and loaded in parallel. A partition whose file
+// is broken is isolated and only operations on its keys fail with ErrPartitionBroken.
+type partitionEngine struct {
+	parts []Backend
+	// broken is the load error of each partition. protected by Storage.muDB.
+	broken []error
+	// log receives logs of the storage.
+	log Logger
+}
+
+// newPartitionEngine creates n partitions by newEngine with the partition index.
+func newPartitionEngine(n int, newEngine func(i int) Backend) *partitionEngine {
+	p := &partitionEngine{
+		parts:  make([]Backend, n),
+		broken: make([]error, n),
+		log:    storeLogger{},
+	}
+	for i := range p.parts {
+		p.parts[i] = newEngine(i)
+	}
+	return p
+}
+
+func (p *partitionEngine) partition(key string) (Backend, error) {
+	i := hashKey(key) % uint64(len(p.parts))
+	if err := p.broken[i]; err != nil {
+		return nil, fmt.Errorf("%w : partition %v : %v", ErrPartitionBroken, i, err)
+	}
+	return p.parts[i], nil
+}
+
+func (p *partitionEngine) Get(key string) (Record, error) {
+	e, err := p.partition(key)
+	if err != nil {
+		return Record{}, err
+	}
+	return e.Get(key)
+}
+
+func (p *partitionEngine) Put(r Record) error {
+	e, err := p.partition(r.Key)
+	if err != nil {
+		return err
+	}
+	return e.Put(r)
+}
+
+func (p *partitionEngine) Delete(key string) error {
+	e, err := p.partition(key)
+	if err != nil {
+		return err
+	}
+	return e.Delete(key)
+}
+
+func (p *partitionEngine) DeleteVersion(key string, version uint64) error {
+	e, err := p.partition(key)
+	if err != nil {
+		return err
+	}
+	if t, ok := tombstoneOf(e); ok {
+		return t.DeleteVersion(key, version)
+	}
+	return e.Delete(key)
+}
+
+// GC collects tombstones of healthy partitions in parallel.
+func (p *partitionEngine) GC(horizon uint64) (GCStats, error) {
+	stats := make([]GCStats, len(p.parts))
+	errs := p.each(func(i int, e Backend) (err error) {
+		t, ok := tombstoneOf(e)
+		if p.broken[i] != nil || !ok {
+			return nil
+		}
+		stats[i], err = t.GC(horizon)
+		return err
+	})
+	var total GCStats
+	for i, err := range errs {
+		if err != nil {
+			return total, fmt.Errorf("failed to collect partition %v : %w", i, err)
+		}
+		total.add(stats[i])
+	}
+	return total, nil
+}
+
+// DropCaches evicts cached pages of healthy partitions.
+func (p *partitionEngine) DropCaches() (int, error) {
+	counts := make([]int, len(p.parts))
+	errs := p.each(func(i int, e Backend) (err error) {
+		c, ok := cacheOf(e)
+		if p.broken[i] != nil || !ok {
+			return nil
+		}
+		counts[i], err = c.DropCaches()
+		return err
+	})
+	var total int
+	for i, err := range errs {
+		if err != nil {
+			return total, fmt.Errorf("failed to drop caches of partition %v : %w", i, err)
+		}
+		total += counts[i]
+	}
+	return total, nil
+}
+
+// Verify checks that keys of each partition belong to it and verifies healthy partitions one by
+// one. Broken partitions are reported.
+func (p *partitionEngine) Verify(ctx context.Context, problem func(VerifyProblem)) (int, error) {
+	var total int
+	for i, e := range p.parts {
+		if err := p.broken[i]; err != nil {
+			problem(VerifyProblem{Check: "partition", Detail: fmt.Sprintf("partition %v is broken : %v", i, err)})
+			continue
+		}
+		if err := e.Keys("", func(key string) bool {
+			if j := hashKey(key) % uint64(len(p.parts)); j != uint64(i) {
+				problem(VerifyProblem{Check: "partition", Key: key, Detail: fmt.Sprintf("key in partition %v belongs to partition %v", i, j)})
+			}
+			return true
+		}); err != nil {
+			problem(VerifyProblem{Check: "partition", Detail: fmt.Sprintf("failed to list keys of partition %v : %v", i, err)})
+		}
+		if v, ok := verifyOf(e); ok {
+			n, err := v.Verify(ctx, problem)
+			total += n
+			if err != nil {
+				return total, err
+			}
+		}
+	}
+	return total, nil
+}
+
+func (p *partitionEngine) Len() int {
+	var n int
+	for _, e := range p.parts {
+		n += e.Len()
+	}
+	return n
+}
+
+func (p *partitionEngine) Keys(prefix string, fn func(key string) bool) error {
+	for i, e := range p.parts {
+		if err := p.broken[i]; err != nil {
+			return fmt.Errorf("%w : partition %v : %v", ErrPartitionBroken, i, err)
+		}
+		stop := false
+		if err := e.Keys(prefix, func(key string) bool {
+			stop = !fn(key)
+			return !stop
+		}); err != nil {
+			return err
+		} else if stop {
+			return nil
+		}
+	}
+	return nil
+}
+
+// each calls fn for each partition in parallel and returns the errors of partitions.
+func (p *partitionEngine) each(fn func(i int, e Backend) error) []error {
+	var (
+		wg   sync.WaitGroup
+		errs = make([]error, len(p.parts))
+	)
+	for i, e := range p.parts {
+		wg.Add(1)
+		go func(i int, e Backend) {
+			defer wg.Done()
+			errs[i] = fn(i, e)
+		}(i, e)
+	}
+	wg.Wait()
+	return errs
+}
+
+// Save saves healthy partitions in parallel. broken partitions are not overwritten.
+func (p *partitionEngine) Save(version uint64) error {
+	errs := p.each(func(i int, e Backend) error {
+		if p.broken[i] != nil {
+			return nil
+		}
+		return e.Save(version)
+	})
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("failed to save partition %v : %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Load loads partitions in parallel and returns the oldest version of partitions.
+// partitions not found are initial, and broken partitions are isolated.
+func (p *partitionEngine) Load() (uint64, error) {
+	versions := make([]uint64, len(p.parts))
+	errs := p.each(func(i int, e Backend) (err error) {
+		versions[i], err = e.Load()
+		return err
+	})
+
+	var (
+		version  uint64
+		loaded   bool
+		notExist error
+	)
+	for i, err := range errs {
+		p.broken[i] = nil
+		if os.IsNotExist(err) {
+			notExist = err
+			continue
+		} else if err != nil {
+			p.log.Error("partition is broken", "partition", i, "err", err)
+			p.broken[i] = err
+			continue
+		}
+		// WAL is replayed from the oldest partition because redo log is idempotent
+		if !loaded || versions[i] < version {
+			version = versions[i]
+		}
+		loaded = true
+	}
+	if !loaded && notExist != nil {
+		for _, err := range p.broken {
+			if err != nil {
+				return 0, err
+			}
+		}
+		return 0, notExist
+	}
+	return version, nil
+}
+
+// Salvage salvages partitions one by one. The partition which can not be loaded is replaced by
+// the empty partition in memory, so that records of the other partitions are read.
+func (p *partitionEngine) Salvage(damage func(SnapshotDamage)) (uint64, error) {
+	for i := range p.broken {
+		p.broken[i] = nil
+	}
+	return salvageEach(p.parts, func(i int) string {
+		return fmt.Sprintf("partition %d", i)
+	}, damage)
+}
+
+func (p *partitionEngine) Close() error {
+	var rerr error
+	for _, e := range p.parts {
+		if err := e.Close(); err != nil && rerr == nil {
+			rerr = err
+		}
+	}
+	return rerr
+}
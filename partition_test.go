@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func createTestPartitionEngine(n int) *partitionEngine {
+	return newPartitionEngine(n, func(i int) Backend {
+		path := fmt.Sprintf("%s.%d", testDBPath, i)
+		return newMapEngine(path, path+".tmp")
+	})
+}
+
+func TestPartitionEngine(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	p := createTestPartitionEngine(4)
+	if _, err := p.Load(); !os.IsNotExist(err) {
+		t.Errorf("partitions unexpectedly exist : %v", err)
+	}
+
+	expected := make(map[string][]byte)
+	for i := 0; i < 100; i++ {
+		key, value := fmt.Sprintf("key%03d", i), []byte(fmt.Sprintf("value%03d", i))
+		if err := p.Put(Record{Key: key, Value: value}); err != nil {
+			t.Fatalf("failed to put : %v", err)
+		}
+		expected[key] = value
+	}
+	for i, e := range p.parts {
+		if e.Len() == 0 {
+			t.Errorf("partition %v is empty", i)
+		}
+	}
+	assertEngine(t, p, expected)
+	if err := p.Save(1); err != nil {
+		t.Fatalf("failed to save : %v", err)
+	}
+
+	p = createTestPartitionEngine(4)
+	if version, err := p.Load(); err != nil {
+		t.Fatalf("failed to load : %v", err)
+	} else if version != 1 {
+		t.Errorf("version not match %v, expected 1", version)
+	}
+	assertEngine(t, p, expected)
+
+	// broken partition does not affect other partitions
+	if err := os.WriteFile(testDBPath+".2", []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p = createTestPartitionEngine(4)
+	if _, err := p.Load(); err != nil {
+		t.Fatalf("failed to load with broken partition : %v", err)
+	}
+	var healthy int
+	for k, v := range expected {
+		r, err := p.Get(k)
+		if errors.Is(err, ErrPartitionBroken) {
+			continue
+		} else if err != nil {
+			t.Fatalf("failed to get %q : %v", k, err)
+		} else if string(r.Value) != string(v) {
+			t.Errorf("value for %q not match %v, expected %v", k, r.Value, v)
+		}
+		healthy++
+	}
+	if healthy == 0 || healthy == len(expected) {
+		t.Errorf("%v of %v keys are in healthy partitions", healthy, len(expected))
+	}
+	if err := p.Keys("", func(string) bool { return true }); !errors.Is(err, ErrPartitionBroken) {
+		t.Errorf("keys with broken partition is not (partition broken) : %v", err)
+	}
+}
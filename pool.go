@@ -0,0 +1,92 @@
+package main
+
+import "sync"
+
+// walBufferSize is the size of the buffer which each log is serialized into before written into
+// WAL. Logs larger than it are serialized into the buffer allocated for the log, and readers of
+// WAL and data files grow their buffers for them.
+const walBufferSize = 4096
+
+// maxPooledBuffer is the max capacity of buffers returned into readBuffers.
+const maxPooledBuffer = 1 << 20
+
+// maxPooledLogs is the max capacity of logs returned into logsPool. Logs of huge transactions
+// are left to GC not to keep the memory of rare bulk writes.
+const maxPooledLogs = 1024
+
+var (
+	// walBuffers is the pool of buffers which logs are serialized into by writeWAL.
+	walBuffers = sync.Pool{New: func() interface{} { return new([walBufferSize]byte) }}
+	// logsPool is the pool of logs of transactions whose records are cleared.
+	logsPool = sync.Pool{New: func() interface{} {
+		logs := make([]RecordLog, 0, 8)
+		return &logs
+	}}
+	// readBuffers is the pool of buffers which View reads values on disk into.
+	readBuffers = sync.Pool{New: func() interface{} { return new([]byte) }}
+	// txnPool is the pool of transactions of single operations with empty read and write sets.
+	txnPool = sync.Pool{New: func() interface{} {
+		return &Txn{readSet: make(map[string]*Record), writeSet: make(map[string]int)}
+	}}
+)
+
+// getReadBuffer returns the buffer from readBuffers, which is returned by putReadBuffer.
+func getReadBuffer() *[]byte {
+	return readBuffers.Get().(*[]byte)
+}
+
+// putReadBuffer returns the buffer into readBuffers unless it has grown too large.
+func putReadBuffer(buf *[]byte) {
+	if cap(*buf) <= maxPooledBuffer {
+		readBuffers.Put(buf)
+	}
+}
+
+// growBuffer returns buf if it has size bytes, or a new buffer of size bytes otherwise.
+func growBuffer(buf []byte, size int) []byte {
+	if len(buf) >= size {
+		return buf
+	}
+	return make([]byte, size)
+}
+
+// newPooledTxn returns the transaction from txnPool, which is returned by putTxn after ended.
+// It is used only by single operations and autoCommit, which do not leak the transaction.
+func (s *Storage) newPooledTxn() *Txn {
+	txn := txnPool.Get().(*Txn)
+	txn.s = s
+	return txn
+}
+
+// putTxn returns the ended transaction into txnPool. The transaction which is still prepared or
+// holds locks is left to GC.
+func putTxn(txn *Txn) {
+	if txn.gid != "" || txn.begun || len(txn.readSet) > 0 || len(txn.writeSet) > 0 {
+		return
+	}
+	txn.recycleLogs()
+	*txn = Txn{readSet: txn.readSet, writeSet: txn.writeSet}
+	txnPool.Put(txn)
+}
+
+// appendLog appends rlog to logs of the transaction taken from logsPool.
+func (txn *Txn) appendLog(rlog RecordLog) {
+	if txn.pooled == nil {
+		txn.pooled = logsPool.Get().(*[]RecordLog)
+		txn.logs = (*txn.pooled)[:0]
+	}
+	txn.logs = append(txn.logs, rlog)
+}
+
+// recycleLogs discards logs of the transaction, and returns them into logsPool if they are
+// taken from it. Keys and values are cleared including the logs appended by commitLogs beyond
+// the length, so that the pool does not retain them.
+func (txn *Txn) recycleLogs() {
+	if txn.pooled != nil && cap(txn.logs) <= maxPooledLogs {
+		logs := txn.logs[:cap(txn.logs)]
+		clear(logs)
+		*txn.pooled = logs[:0]
+		logsPool.Put(txn.pooled)
+	}
+	txn.logs, txn.pooled = nil, nil
+}
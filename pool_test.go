@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestTxn_RecycleLogs(t *testing.T) {
+	storage := createTestStorage(t)
+	defer storage.wal.Close()
+	for _, commit := range []bool{true, false} {
+		txn := storage.NewTxn()
+		if err := txn.Put("key1", []byte("value1")); err != nil {
+			t.Fatal(err)
+		} else if err = txn.Put("key2", []byte("value2")); err != nil {
+			t.Fatal(err)
+		}
+		logs := txn.logs
+		if commit {
+			if err := txn.Commit(); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			txn.Abort()
+		}
+		if txn.logs != nil || txn.pooled != nil {
+			t.Errorf("logs are kept after commit %v", commit)
+		}
+		// the pooled logs do not retain keys and values
+		for i, rlog := range logs[:cap(logs)] {
+			if rlog.Key != "" || rlog.Value != nil {
+				t.Errorf("log %v is not cleared after commit %v : %+v", i, commit, rlog)
+			}
+		}
+	}
+
+	// records applied by the commit are not modified by the reuse of logs
+	if err := storage.Put("key3", []byte("value3")); err != nil {
+		t.Fatal(err)
+	}
+	txn := storage.NewTxn()
+	defer txn.Abort()
+	assertValue(t, txn, "key1", []byte("value1"))
+	assertValue(t, txn, "key2", []byte("value2"))
+	assertValue(t, txn, "key3", []byte("value3"))
+}
+
+func TestPutTxn(t *testing.T) {
+	storage := createTestStorage(t)
+	defer storage.wal.Close()
+	if err := storage.Put("key1", []byte("value1")); err != nil {
+		t.Fatal(err)
+	}
+
+	txn := storage.newPooledTxn()
+	if err := txn.Put("key1", []byte("value2")); err != nil {
+		t.Fatal(err)
+	}
+	// the transaction holding locks is not reset
+	putTxn(txn)
+	if txn.s != storage || len(txn.writeSet) != 1 {
+		t.Fatalf("active transaction is reset")
+	}
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	putTxn(txn)
+	if txn.s != nil || txn.logs != nil || txn.begun || len(txn.readSet) != 0 || len(txn.writeSet) != 0 {
+		t.Errorf("ended transaction is not reset : %+v", txn)
+	}
+
+	read := storage.NewTxn()
+	defer read.Abort()
+	assertValue(t, read, "key1", []byte("value2"))
+}
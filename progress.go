@@ -0,0 +1,89 @@
+package main
+
+import "time"
+
+const (
+	defaultProgressInterval = time.Second
+	// progressCheckLogs is the number of logs between checks of the interval of reports.
+	progressCheckLogs = 256
+)
+
+// RecoveryProgress is the progress of replaying WAL at startup.
+type RecoveryProgress struct {
+	// BytesReplayed is the bytes of WAL read so far, and TotalBytes is the size of WAL.
+	BytesReplayed int64 `json:"bytes_replayed"`
+	TotalBytes    int64 `json:"total_bytes"`
+	// Records is the number of records applied, and Transactions is the number of transactions.
+	Records      int `json:"records"`
+	Transactions int `json:"transactions"`
+	// CorruptLogs is the number of corrupt ranges of WAL truncated or skipped by RecoveryPolicy.
+	CorruptLogs int           `json:"corrupt_logs"`
+	Elapsed     time.Duration `json:"elapsed_ns"`
+	// Remaining is the estimated remaining time by the rate of replay so far.
+	Remaining time.Duration `json:"remaining_ns"`
+	// Done is true for the final summary reported once after WAL is replayed.
+	Done bool `json:"done"`
+}
+
+// recoveryReporter reports the progress of recovery at the interval.
+type recoveryReporter struct {
+	fn       func(RecoveryProgress)
+	interval time.Duration
+	start    time.Time
+	last     time.Time
+	progress RecoveryProgress
+}
+
+func newRecoveryReporter(fn func(RecoveryProgress), interval time.Duration, total int64) *recoveryReporter {
+	if interval <= 0 {
+		interval = defaultProgressInterval
+	}
+	now := time.Now()
+	return &recoveryReporter{fn: fn, interval: interval, start: now, last: now, progress: RecoveryProgress{TotalBytes: total}}
+}
+
+// logged counts the log read from WAL, and reports the progress if the interval passed.
+func (r *recoveryReporter) logged(bytes int64, nlogs int) {
+	if r == nil {
+		return
+	}
+	r.progress.BytesReplayed += bytes
+	if nlogs%progressCheckLogs != 0 {
+		return
+	}
+	if now := time.Now(); now.Sub(r.last) >= r.interval {
+		r.last = now
+		r.report(now, false)
+	}
+}
+
+// applied counts records applied by the transaction.
+func (r *recoveryReporter) applied(records int) {
+	if r != nil {
+		r.progress.Records += records
+		r.progress.Transactions++
+	}
+}
+
+// corrupt counts the corrupt range of WAL which is truncated or skipped.
+func (r *recoveryReporter) corrupt() {
+	if r != nil {
+		r.progress.CorruptLogs++
+	}
+}
+
+func (r *recoveryReporter) done() {
+	if r != nil {
+		r.report(time.Now(), true)
+	}
+}
+
+func (r *recoveryReporter) report(now time.Time, done bool) {
+	p := r.progress
+	p.Elapsed = now.Sub(r.start)
+	p.Done = done
+	if !done && p.BytesReplayed > 0 && p.TotalBytes > p.BytesReplayed {
+		p.Remaining = time.Duration(float64(p.Elapsed) * float64(p.TotalBytes-p.BytesReplayed) / float64(p.BytesReplayed))
+	}
+	r.fn(p)
+}
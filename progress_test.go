@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestOpen_RecoveryProgress(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	storage, err := Open(Options{WALPath: testWALPath, DBPath: testDBPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i++ {
+		if err = storage.Put(fmt.Sprintf("key%d", i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// crash without checkpoint
+	storage.wal.Close()
+
+	var reports []RecoveryProgress
+	storage, err = Open(Options{
+		WALPath:                  testWALPath,
+		DBPath:                   testDBPath,
+		RecoveryProgress:         func(p RecoveryProgress) { reports = append(reports, p) },
+		RecoveryProgressInterval: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.wal.Close()
+	// 1000 logs are checked every 256 logs
+	if len(reports) != 4 {
+		t.Fatalf("reports : %+v", reports)
+	}
+	for i, p := range reports[:3] {
+		if p.Done || p.BytesReplayed == 0 || p.BytesReplayed >= p.TotalBytes || p.Transactions != 128*(i+1)-1 {
+			t.Errorf("progress %d : %+v", i, p)
+		}
+	}
+	if p := reports[3]; !p.Done || p.Records != 500 || p.Transactions != 500 || p.BytesReplayed != p.TotalBytes || p.Remaining != 0 {
+		t.Errorf("summary : %+v", p)
+	}
+	if v, err := storage.Get("key499"); err != nil || string(v) != "value" {
+		t.Errorf("recovered record : %q %v", v, err)
+	}
+}
@@ -0,0 +1,289 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.4.0
+// - protoc             (unknown)
+// source: txngo.proto
+
+package proto
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.62.0 or later.
+const _ = grpc.SupportPackageIsVersion8
+
+const (
+	Txngo_Txn_FullMethodName      = "/txngo.Txngo/Txn"
+	Txngo_Get_FullMethodName      = "/txngo.Txngo/Get"
+	Txngo_Put_FullMethodName      = "/txngo.Txngo/Put"
+	Txngo_BulkLoad_FullMethodName = "/txngo.Txngo/BulkLoad"
+)
+
+// TxngoClient is the client API for Txngo service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type TxngoClient interface {
+	Txn(ctx context.Context, opts ...grpc.CallOption) (Txngo_TxnClient, error)
+	Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*GetResponse, error)
+	Put(ctx context.Context, in *PutRequest, opts ...grpc.CallOption) (*PutResponse, error)
+	BulkLoad(ctx context.Context, opts ...grpc.CallOption) (Txngo_BulkLoadClient, error)
+}
+
+type txngoClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewTxngoClient(cc grpc.ClientConnInterface) TxngoClient {
+	return &txngoClient{cc}
+}
+
+func (c *txngoClient) Txn(ctx context.Context, opts ...grpc.CallOption) (Txngo_TxnClient, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Txngo_ServiceDesc.Streams[0], Txngo_Txn_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &txngoTxnClient{ClientStream: stream}
+	return x, nil
+}
+
+type Txngo_TxnClient interface {
+	Send(*TxnRequest) error
+	Recv() (*TxnResponse, error)
+	grpc.ClientStream
+}
+
+type txngoTxnClient struct {
+	grpc.ClientStream
+}
+
+func (x *txngoTxnClient) Send(m *TxnRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *txngoTxnClient) Recv() (*TxnResponse, error) {
+	m := new(TxnResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *txngoClient) Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*GetResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetResponse)
+	err := c.cc.Invoke(ctx, Txngo_Get_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *txngoClient) Put(ctx context.Context, in *PutRequest, opts ...grpc.CallOption) (*PutResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(PutResponse)
+	err := c.cc.Invoke(ctx, Txngo_Put_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *txngoClient) BulkLoad(ctx context.Context, opts ...grpc.CallOption) (Txngo_BulkLoadClient, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Txngo_ServiceDesc.Streams[1], Txngo_BulkLoad_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &txngoBulkLoadClient{ClientStream: stream}
+	return x, nil
+}
+
+type Txngo_BulkLoadClient interface {
+	Send(*BulkLoadRequest) error
+	Recv() (*BulkLoadResponse, error)
+	grpc.ClientStream
+}
+
+type txngoBulkLoadClient struct {
+	grpc.ClientStream
+}
+
+func (x *txngoBulkLoadClient) Send(m *BulkLoadRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *txngoBulkLoadClient) Recv() (*BulkLoadResponse, error) {
+	m := new(BulkLoadResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// TxngoServer is the server API for Txngo service.
+// All implementations must embed UnimplementedTxngoServer
+// for forward compatibility
+type TxngoServer interface {
+	Txn(Txngo_TxnServer) error
+	Get(context.Context, *GetRequest) (*GetResponse, error)
+	Put(context.Context, *PutRequest) (*PutResponse, error)
+	BulkLoad(Txngo_BulkLoadServer) error
+	mustEmbedUnimplementedTxngoServer()
+}
+
+// UnimplementedTxngoServer must be embedded to have forward compatible implementations.
+type UnimplementedTxngoServer struct {
+}
+
+func (UnimplementedTxngoServer) Txn(Txngo_TxnServer) error {
+	return status.Errorf(codes.Unimplemented, "method Txn not implemented")
+}
+func (UnimplementedTxngoServer) Get(context.Context, *GetRequest) (*GetResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Get not implemented")
+}
+func (UnimplementedTxngoServer) Put(context.Context, *PutRequest) (*PutResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Put not implemented")
+}
+func (UnimplementedTxngoServer) BulkLoad(Txngo_BulkLoadServer) error {
+	return status.Errorf(codes.Unimplemented, "method BulkLoad not implemented")
+}
+func (UnimplementedTxngoServer) mustEmbedUnimplementedTxngoServer() {}
+
+// UnsafeTxngoServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to TxngoServer will
+// result in compilation errors.
+type UnsafeTxngoServer interface {
+	mustEmbedUnimplementedTxngoServer()
+}
+
+func RegisterTxngoServer(s grpc.ServiceRegistrar, srv TxngoServer) {
+	s.RegisterService(&Txngo_ServiceDesc, srv)
+}
+
+func _Txngo_Txn_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(TxngoServer).Txn(&txngoTxnServer{ServerStream: stream})
+}
+
+type Txngo_TxnServer interface {
+	Send(*TxnResponse) error
+	Recv() (*TxnRequest, error)
+	grpc.ServerStream
+}
+
+type txngoTxnServer struct {
+	grpc.ServerStream
+}
+
+func (x *txngoTxnServer) Send(m *TxnResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *txngoTxnServer) Recv() (*TxnRequest, error) {
+	m := new(TxnRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _Txngo_Get_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TxngoServer).Get(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Txngo_Get_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TxngoServer).Get(ctx, req.(*GetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Txngo_Put_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PutRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TxngoServer).Put(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Txngo_Put_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TxngoServer).Put(ctx, req.(*PutRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Txngo_BulkLoad_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(TxngoServer).BulkLoad(&txngoBulkLoadServer{ServerStream: stream})
+}
+
+type Txngo_BulkLoadServer interface {
+	Send(*BulkLoadResponse) error
+	Recv() (*BulkLoadRequest, error)
+	grpc.ServerStream
+}
+
+type txngoBulkLoadServer struct {
+	grpc.ServerStream
+}
+
+func (x *txngoBulkLoadServer) Send(m *BulkLoadResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *txngoBulkLoadServer) Recv() (*BulkLoadRequest, error) {
+	m := new(BulkLoadRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Txngo_ServiceDesc is the grpc.ServiceDesc for Txngo service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Txngo_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "txngo.Txngo",
+	HandlerType: (*TxngoServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Get",
+			Handler:    _Txngo_Get_Handler,
+		},
+		{
+			MethodName: "Put",
+			Handler:    _Txngo_Put_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Txn",
+			Handler:       _Txngo_Txn_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "BulkLoad",
+			Handler:       _Txngo_BulkLoad_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "txngo.proto",
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ErrQuotaExceeded is returned by commits which make records of a prefix exceed its Quota.
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Quota limits records whose keys have Prefix, which is the namespace of a tenant in the
+// shared storage. Keys of the column family have the prefix "\x00<name>\x00", and internal keys
+// of the storage are not counted. 0 disables each limit.
+type Quota struct {
+	Prefix string
+	// MaxKeys is the number of records.
+	MaxKeys int
+	// MaxBytes is the total bytes of values of records.
+	MaxBytes int64
+}
+
+// QuotaUsage is the quota and the current usage of records of its prefix.
+type QuotaUsage struct {
+	Quota
+	Keys  int
+	Bytes int64
+}
+
+// covers returns true if the record of key is limited by the quota. Internal keys of the
+// storage such as TTLs are not counted unless the prefix is internal.
+func (q *Quota) covers(key string) bool {
+	return strings.HasPrefix(key, q.Prefix) && !hiddenKey(q.Prefix, key)
+}
+
+// SetQuota sets the quota of the prefix, which replaces the quota of the same prefix. The quota
+// without any limit removes it. Records already over the limits are kept, and commits which
+// do not grow them further succeed. Commits replicated by Raft are not checked.
+func (s *Storage) SetQuota(q Quota) error {
+	s.muWAL.Lock()
+	defer s.muWAL.Unlock()
+	s.muDB.Lock()
+	defer s.muDB.Unlock()
+	quotas := make([]*QuotaUsage, 0, len(s.quotas)+1)
+	for _, u := range s.quotas {
+		if u.Prefix != q.Prefix {
+			quotas = append(quotas, u)
+		}
+	}
+	if q.MaxKeys > 0 || q.MaxBytes > 0 {
+		u := &QuotaUsage{Quota: q}
+		if err := s.countQuota(u); err != nil {
+			return err
+		}
+		quotas = append(quotas, u)
+	}
+	sort.Slice(quotas, func(i, j int) bool { return quotas[i].Prefix < quotas[j].Prefix })
+	s.quotas = quotas
+	return nil
+}
+
+// newQuotas returns quotas without usage sorted by prefix. The last quota of the same prefix is
+// used.
+func newQuotas(quotas []Quota) []*QuotaUsage {
+	var usages []*QuotaUsage
+	for _, q := range quotas {
+		for i, u := range usages {
+			if u.Prefix == q.Prefix {
+				usages = append(usages[:i], usages[i+1:]...)
+				break
+			}
+		}
+		if q.MaxKeys > 0 || q.MaxBytes > 0 {
+			usages = append(usages, &QuotaUsage{Quota: q})
+		}
+	}
+	sort.Slice(usages, func(i, j int) bool { return usages[i].Prefix < usages[j].Prefix })
+	return usages
+}
+
+// Quotas returns quotas set and their usage in order of prefixes.
+func (s *Storage) Quotas() []QuotaUsage {
+	s.muDB.RLock()
+	defer s.muDB.RUnlock()
+	usages := make([]QuotaUsage, len(s.quotas))
+	for i, u := range s.quotas {
+		usages[i] = *u
+	}
+	return usages
+}
+
+// countQuota counts the usage of records of the prefix in db. It must be called with muDB
+// locked.
+func (s *Storage) countQuota(u *QuotaUsage) error {
+	var keys []string
+	if err := s.db.Keys(u.Prefix, func(key string) bool {
+		if u.covers(key) {
+			keys = append(keys, key)
+		}
+		return true
+	}); err != nil {
+		return err
+	}
+	u.Keys, u.Bytes = 0, 0
+	for _, key := range keys {
+		r, err := s.db.Get(key)
+		if err == ErrNotExist {
+			continue
+		} else if err != nil {
+			return err
+		}
+		u.Keys++
+		u.Bytes += int64(len(r.Value))
+	}
+	return nil
+}
+
+// recountQuotas counts the usage of all quotas after records of db are replaced. It must be
+// called with muDB locked or before the storage is used.
+func (s *Storage) recountQuotas() error {
+	for _, u := range s.quotas {
+		if err := s.countQuota(u); err != nil {
+			return fmt.Errorf("failed to count usage of quota %q : %w", u.Prefix, err)
+		}
+	}
+	return nil
+}
+
+// quotaOf returns true if the key is limited by any quota.
+func (s *Storage) quotaOf(key string) bool {
+	for _, u := range s.quotas {
+		if u.covers(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// sizeOf returns whether the record exists in db and the size of its value.
+func (s *Storage) sizeOf(key string) (bool, int64, error) {
+	r, err := s.db.Get(key)
+	if err == ErrNotExist {
+		return false, 0, nil
+	} else if err != nil {
+		return false, 0, err
+	}
+	return true, int64(len(r.Value)), nil
+}
+
+// addUsage adds the change of the record between before and after to quotas limiting it.
+func (s *Storage) addUsage(key string, existed, exists bool, before, after int64) {
+	var keys int
+	if existed && !exists {
+		keys = -1
+	} else if !existed && exists {
+		keys = 1
+	}
+	for _, u := range s.quotas {
+		if u.covers(key) {
+			u.Keys += keys
+			u.Bytes += after - before
+		}
+	}
+}
+
+// trackQuotas updates the usage of quotas by the log before it is applied. It must be called
+// with muDB locked.
+func (s *Storage) trackQuotas(rlog *RecordLog) error {
+	if len(s.quotas) == 0 || !s.quotaOf(rlog.Key) {
+		return nil
+	}
+	existed, before, err := s.sizeOf(rlog.Key)
+	if err != nil {
+		return err
+	}
+	switch rlog.Action {
+	case LInsert, LUpdate:
+		s.addUsage(rlog.Key, existed, true, before, int64(len(rlog.Value)))
+	case LDelete:
+		s.addUsage(rlog.Key, existed, false, before, 0)
+	}
+	return nil
+}
+
+// checkQuotas returns the error wrapping ErrQuotaExceeded if the commit of logs grows records
+// of any quota beyond its limits. It must be called with muWAL locked.
+func (s *Storage) checkQuotas(logs []RecordLog) error {
+	if len(s.quotas) == 0 {
+		return nil
+	}
+	s.muDB.RLock()
+	defer s.muDB.RUnlock()
+	type state struct {
+		exists bool
+		size   int64
+	}
+	var (
+		written = make(map[string]state)
+		keys    = make([]int, len(s.quotas))
+		bytes   = make([]int64, len(s.quotas))
+	)
+	for _, rlog := range logs {
+		if !s.quotaOf(rlog.Key) {
+			continue
+		}
+		old, ok := written[rlog.Key]
+		if !ok {
+			var err error
+			if old.exists, old.size, err = s.sizeOf(rlog.Key); err != nil {
+				return err
+			}
+		}
+		var cur state
+		if rlog.Action != LDelete {
+			cur = state{exists: true, size: int64(len(rlog.Value))}
+		}
+		written[rlog.Key] = cur
+		for i, u := range s.quotas {
+			if !u.covers(rlog.Key) {
+				continue
+			}
+			if old.exists && !cur.exists {
+				keys[i]--
+			} else if !old.exists && cur.exists {
+				keys[i]++
+			}
+			bytes[i] += cur.size - old.size
+		}
+	}
+	for i, u := range s.quotas {
+		if u.MaxKeys > 0 && keys[i] > 0 && u.Keys+keys[i] > u.MaxKeys {
+			return fmt.Errorf("%w : %d keys of prefix %q over %d", ErrQuotaExceeded, u.Keys+keys[i], u.Prefix, u.MaxKeys)
+		} else if u.MaxBytes > 0 && bytes[i] > 0 && u.Bytes+bytes[i] > u.MaxBytes {
+			return fmt.Errorf("%w : %d bytes of prefix %q over %d", ErrQuotaExceeded, u.Bytes+bytes[i], u.Prefix, u.MaxBytes)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStorage_SetQuota(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	opts := Options{
+		WALPath: testWALPath,
+		DBPath:  testDBPath,
+		Quotas:  []Quota{{Prefix: "tenant1/", MaxKeys: 2}, {Prefix: "tenant2/", MaxBytes: 10}},
+	}
+	storage, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { storage.Close() }()
+	assertQuotas := func(expected ...QuotaUsage) {
+		t.Helper()
+		if usages := storage.Quotas(); !reflect.DeepEqual(usages, expected) {
+			t.Errorf("quotas %+v, expected %+v", usages, expected)
+		}
+	}
+	put := func(key, value string) error {
+		return storage.Put(key, []byte(value))
+	}
+
+	for _, key := range []string{"tenant1/a", "tenant1/b", "other/a", "other/b", "other/c"} {
+		if err = put(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = put("tenant1/c", "value"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("commit over max keys : %v", err)
+	} else if _, err = storage.Get("tenant1/c"); err != ErrNotExist {
+		t.Errorf("commit over quota is applied : %v", err)
+	}
+	// updates and the commit replacing a record in it do not grow the number of keys
+	if err = put("tenant1/a", "new value"); err != nil {
+		t.Fatal(err)
+	} else if err = storage.autoCommit(func(txn *Txn) error {
+		if err := txn.Delete("tenant1/b"); err != nil {
+			return err
+		}
+		return txn.Insert("tenant1/c", []byte("value"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// max bytes counts values
+	if err = put("tenant2/a", "12345"); err != nil {
+		t.Fatal(err)
+	} else if err = put("tenant2/b", "123456"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("commit over max bytes : %v", err)
+	} else if err = put("tenant2/a", "1234567890"); err != nil {
+		t.Fatal(err)
+	}
+	assertQuotas(
+		QuotaUsage{Quota: opts.Quotas[0], Keys: 2, Bytes: 14},
+		QuotaUsage{Quota: opts.Quotas[1], Keys: 1, Bytes: 10},
+	)
+
+	// the quota set over existing records allows commits which do not grow them
+	if err = storage.SetQuota(Quota{Prefix: "other/", MaxKeys: 1}); err != nil {
+		t.Fatal(err)
+	} else if err = put("other/d", "value"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("commit over max keys : %v", err)
+	} else if err = storage.Delete("other/a"); err != nil {
+		t.Fatal(err)
+	} else if err = storage.SetQuota(Quota{Prefix: "tenant2/"}); err != nil {
+		t.Fatal(err)
+	} else if err = put("tenant2/b", "123456"); err != nil {
+		t.Errorf("commit after the quota is removed : %v", err)
+	}
+	var buf bytes.Buffer
+	if err = storage.WriteMetrics(&buf); err != nil {
+		t.Fatal(err)
+	} else if !strings.Contains(buf.String(), `txngo_quota_keys{prefix="other/"} 2`) || !strings.Contains(buf.String(), `txngo_quota_bytes{prefix="tenant1/"} 14`) {
+		t.Errorf("metrics of quotas are not exported :\n%s", buf.String())
+	}
+
+	// usage is counted from data file and WAL after restart
+	if err = put("tenant1/c", "new"); err != nil {
+		t.Fatal(err)
+	} else if err = storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if storage, err = Open(opts); err != nil {
+		t.Fatal(err)
+	}
+	assertQuotas(
+		QuotaUsage{Quota: opts.Quotas[0], Keys: 2, Bytes: 12},
+		QuotaUsage{Quota: opts.Quotas[1], Keys: 2, Bytes: 16},
+	)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// radixTree is the prefix compressed tree of map records. the common prefix of keys is stored
+// only once in the label of the shared node, and full key strings are not retained. labels are
+// cloned from keys so that the tree does not refer the memory of keys given by callers.
+type radixTree struct {
+	root  radixNode
+	count int
+}
+
+type radixNode struct {
+	label string
+	// children is sorted by the first byte of label.
+	children []*radixNode
+	// entry is nil if no key ends at this node.
+	entry *mapEntry
+}
+
+func newRadixTree() *radixTree {
+	return &radixTree{}
+}
+
+func commonPrefixLen(a, b string) int {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
+
+// child returns the index of the child whose label starts with c, and whether it exists.
+func (n *radixNode) child(c byte) (int, bool) {
+	i := sort.Search(len(n.children), func(i int) bool {
+		return n.children[i].label[0] >= c
+	})
+	return i, i < len(n.children) && n.children[i].label[0] == c
+}
+
+func (t *radixTree) len() int {
+	return t.count
+}
+
+func (t *radixTree) get(key string) *mapEntry {
+	n := &t.root
+	for key != "" {
+		i, ok := n.child(key[0])
+		if !ok || !strings.HasPrefix(key, n.children[i].label) {
+			return nil
+		}
+		n = n.children[i]
+		key = key[len(n.label):]
+	}
+	return n.entry
+}
+
+// set sets the entry of the key and returns the old entry.
+func (t *radixTree) set(key string, e *mapEntry) *mapEntry {
+	n := &t.root
+	for key != "" {
+		i, ok := n.child(key[0])
+		if !ok {
+			child := &radixNode{label: strings.Clone(key), entry: e}
+			n.children = append(n.children, nil)
+			copy(n.children[i+1:], n.children[i:])
+			n.children[i] = child
+			t.count++
+			return nil
+		}
+		c := n.children[i]
+		l := commonPrefixLen(c.label, key)
+		if l < len(c.label) {
+			// split the label at the common prefix
+			mid := &radixNode{label: c.label[:l], children: []*radixNode{c}}
+			c.label = c.label[l:]
+			n.children[i] = mid
+			c = mid
+		}
+		n = c
+		key = key[l:]
+	}
+	old := n.entry
+	n.entry = e
+	if old == nil {
+		t.count++
+	}
+	return old
+}
+
+// delete removes the key and returns the removed entry.
+func (t *radixTree) delete(key string) *mapEntry {
+	var (
+		parents []*radixNode
+		n       = &t.root
+	)
+	for key != "" {
+		i, ok := n.child(key[0])
+		if !ok || !strings.HasPrefix(key, n.children[i].label) {
+			return nil
+		}
+		parents = append(parents, n)
+		n = n.children[i]
+		key = key[len(n.label):]
+	}
+	old := n.entry
+	if old == nil {
+		return nil
+	}
+	n.entry = nil
+	t.count--
+
+	// remove empty nodes and merge nodes which have only one child
+	for len(parents) > 0 && n.entry == nil && len(n.children) <= 1 {
+		parent := parents[len(parents)-1]
+		parents = parents[:len(parents)-1]
+		if len(n.children) == 1 {
+			c := n.children[0]
+			n.label += c.label
+			n.children, n.entry = c.children, c.entry
+			break
+		}
+		i, _ := parent.child(n.label[0])
+		parent.children = append(parent.children[:i], parent.children[i+1:]...)
+		n = parent
+	}
+	return old
+}
+
+// walk calls fn for each key with the prefix in ascending or descending order until fn returns false.
+func (t *radixTree) walk(prefix string, reverse bool, fn func(key string, e *mapEntry) bool) {
+	var (
+		buf []byte
+		n   = &t.root
+	)
+	for rest := prefix; rest != ""; {
+		i, ok := n.child(rest[0])
+		if !ok {
+			return
+		}
+		c := n.children[i]
+		l := commonPrefixLen(c.label, rest)
+		if l < len(rest) && l < len(c.label) {
+			return
+		}
+		buf = append(buf, c.label...)
+		rest = rest[l:]
+		n = c
+	}
+	n.walk(buf, reverse, fn)
+}
+
+func (n *radixNode) walk(buf []byte, reverse bool, fn func(key string, e *mapEntry) bool) bool {
+	if !reverse && n.entry != nil && !fn(string(buf), n.entry) {
+		return false
+	}
+	for i := range n.children {
+		c := n.children[i]
+		if reverse {
+			c = n.children[len(n.children)-1-i]
+		}
+		if !c.walk(append(buf, c.label...), reverse, fn) {
+			return false
+		}
+	}
+	if reverse && n.entry != nil && !fn(string(buf), n.entry) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestRadixTree(t *testing.T) {
+	tree := newRadixTree()
+	rnd := rand.New(rand.NewSource(1))
+	expected := make(map[string]*mapEntry)
+	for i := 0; i < 20000; i++ {
+		key := fmt.Sprintf("user:%04d:%v", rnd.Intn(300), []string{"", "name", "mail", "m"}[rnd.Intn(4)])
+		if rnd.Intn(3) == 0 {
+			if removed := tree.delete(key); removed != expected[key] {
+				t.Fatalf("removed entry of %q not match", key)
+			}
+			delete(expected, key)
+			continue
+		}
+		ent := &mapEntry{version: uint64(i)}
+		if old := tree.set(key, ent); old != expected[key] {
+			t.Fatalf("old entry of %q not match", key)
+		}
+		expected[key] = ent
+	}
+	if tree.len() != len(expected) {
+		t.Errorf("len not match %v, expected %v", tree.len(), len(expected))
+	}
+	for k, ent := range expected {
+		if tree.get(k) != ent {
+			t.Fatalf("entry of %q not match", k)
+		}
+	}
+	if tree.get("user:") != nil || tree.get("user:0001:nam") != nil {
+		t.Errorf("entry of prefix is found")
+	}
+
+	for _, prefix := range []string{"", "user:01", "user:0100:m", "user:0100:ma", "none"} {
+		var keys, walked, reversed []string
+		for k := range expected {
+			if strings.HasPrefix(k, prefix) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		tree.walk(prefix, false, func(key string, ent *mapEntry) bool {
+			walked = append(walked, key)
+			return true
+		})
+		tree.walk(prefix, true, func(key string, ent *mapEntry) bool {
+			reversed = append([]string{key}, reversed...)
+			return true
+		})
+		if fmt.Sprint(walked) != fmt.Sprint(keys) || fmt.Sprint(reversed) != fmt.Sprint(keys) {
+			t.Errorf("keys with prefix %q not match (%v, %v), expected %v", prefix, len(walked), len(reversed), len(keys))
+		}
+	}
+
+	// common prefix is shared and removed nodes are merged
+	for k := range expected {
+		tree.delete(k)
+	}
+	tree.set("user:0001:name", &mapEntry{})
+	tree.set("user:0002:name", &mapEntry{})
+	if len(tree.root.children) != 1 || tree.root.children[0].label != "user:000" {
+		t.Errorf("common prefix is not shared : %v children", len(tree.root.children))
+	}
+	tree.delete("user:0001:name")
+	if len(tree.root.children) != 1 || tree.root.children[0].label != "user:0002:name" {
+		t.Errorf("nodes are not merged : %q", tree.root.children[0].label)
+	}
+}
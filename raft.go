@@ -0,0 +1,1116 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotLeader   = errors.New("not the raft leader")
+	ErrRaftTimeout = errors.New("raft entry is not applied in time, the result is unknown")
+)
+
+// RaftEntry is the entry of Raft log. Data is the serialized logs of the committed transaction,
+// or empty for the first entry of the leader.
+type RaftEntry struct {
+	Term  uint64
+	Index uint64
+	Data  []byte
+}
+
+type VoteRequest struct {
+	Term      uint64
+	Candidate string
+	LastIndex uint64
+	LastTerm  uint64
+}
+
+type VoteResponse struct {
+	Term    uint64
+	Granted bool
+}
+
+type AppendRequest struct {
+	Term      uint64
+	Leader    string
+	PrevIndex uint64
+	PrevTerm  uint64
+	Entries   []RaftEntry
+	Commit    uint64
+}
+
+type AppendResponse struct {
+	Term    uint64
+	Success bool
+	// LastIndex is the last index of the follower to find nextIndex quickly on failure.
+	LastIndex uint64
+}
+
+// SnapshotRequest sends all records of the leader applied until Index.
+// TODO: send records in chunks instead of loading all records in memory
+type SnapshotRequest struct {
+	Term     uint64
+	Leader   string
+	Index    uint64
+	LastTerm uint64
+	Records  []Record
+}
+
+type SnapshotResponse struct {
+	Term uint64
+}
+
+// RaftTransport sends RPCs to the peer identified by id.
+type RaftTransport interface {
+	RequestVote(ctx context.Context, peer string, req *VoteRequest) (*VoteResponse, error)
+	AppendEntries(ctx context.Context, peer string, req *AppendRequest) (*AppendResponse, error)
+	InstallSnapshot(ctx context.Context, peer string, req *SnapshotRequest) (*SnapshotResponse, error)
+}
+
+// RaftConfig is the configuration of the node of Raft cluster. Members are static.
+type RaftConfig struct {
+	ID string
+	// Peers is the ids of other members.
+	Peers []string
+	// Dir is the directory of Raft state and log files.
+	Dir       string
+	Transport RaftTransport
+	// ElectionTimeout is randomized between it and twice of it. 300ms if 0.
+	ElectionTimeout time.Duration
+	// HeartbeatInterval is 50ms if 0.
+	HeartbeatInterval time.Duration
+	// SnapshotEntries is the number of applied entries which triggers checkpoint and compaction
+	// of Raft log. 0 disables it.
+	SnapshotEntries uint64
+	// CommitTimeout is the timeout of Txn.Commit waiting for the entry to be applied. 5s if 0.
+	CommitTimeout time.Duration
+}
+
+type raftState int
+
+const (
+	raftFollower raftState = iota
+	raftCandidate
+	raftLeader
+)
+
+type raftWaiter struct {
+	term uint64
+	ch   chan error
+}
+
+// RaftNode replicates transactions of Storage by Raft. Txn.Commit proposes the logs of the
+// transaction at the leader and waits until it is applied. Every node applies committed entries
+// with the index as the commit version, so that versions are the same in all nodes.
+// Reads are served from local records, and may be stale in followers.
+type RaftNode struct {
+	cfg     RaftConfig
+	storage *Storage
+
+	mu       sync.Mutex
+	state    raftState
+	term     uint64
+	votedFor string
+	leader   string
+	// entries is the log after the snapshot.
+	entries     []RaftEntry
+	snapIndex   uint64
+	snapTerm    uint64
+	commitIndex uint64
+	lastApplied uint64
+	// ready is the index of the first entry of the leader. local records may be stale until
+	// it is applied.
+	ready      uint64
+	nextIndex  map[string]uint64
+	matchIndex map[string]uint64
+	inflight   map[string]bool
+	waiters    map[uint64]raftWaiter
+	logFile    *os.File
+
+	// applyMu serializes applying entries and installing snapshot.
+	applyMu sync.Mutex
+	// rnd randomizes election timeout. it is used only by run.
+	rnd     *rand.Rand
+	resetCh chan struct{}
+	applyCh chan struct{}
+	stop    chan struct{}
+	// stopOnce stops the node once by Stop.
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// raftPersistent is the state saved in the state file.
+type raftPersistent struct {
+	Term          uint64 `json:"term"`
+	VotedFor      string `json:"voted_for"`
+	SnapshotIndex uint64 `json:"snapshot_index"`
+	SnapshotTerm  uint64 `json:"snapshot_term"`
+}
+
+// StartRaft starts the Raft node which replicates s. s must be loaded, and all members must
+// start from the same records (e.g. empty).
+func StartRaft(s *Storage, cfg RaftConfig) (*RaftNode, error) {
+	if cfg.ElectionTimeout == 0 {
+		cfg.ElectionTimeout = 300 * time.Millisecond
+	}
+	if cfg.HeartbeatInterval == 0 {
+		cfg.HeartbeatInterval = 50 * time.Millisecond
+	}
+	if cfg.CommitTimeout == 0 {
+		cfg.CommitTimeout = 5 * time.Second
+	}
+	if err := os.MkdirAll(cfg.Dir, 0700); err != nil {
+		return nil, err
+	}
+	n := &RaftNode{
+		cfg:        cfg,
+		storage:    s,
+		nextIndex:  make(map[string]uint64),
+		matchIndex: make(map[string]uint64),
+		inflight:   make(map[string]bool),
+		waiters:    make(map[uint64]raftWaiter),
+		resetCh:    make(chan struct{}, 1),
+		applyCh:    make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+		rnd:        rand.New(rand.NewSource(time.Now().UnixNano() ^ int64(crc32.ChecksumIEEE([]byte(cfg.ID))))),
+	}
+	if err := n.load(); err != nil {
+		return nil, err
+	}
+	// entries until the version of records are already applied
+	s.muWAL.Lock()
+	applied := s.version
+	s.muWAL.Unlock()
+	if applied < n.snapIndex {
+		applied = n.snapIndex
+	}
+	if applied > n.lastIndex() {
+		n.logFile.Close()
+		return nil, fmt.Errorf("records of version %v are newer than raft log of index %v", applied, n.lastIndex())
+	}
+	n.commitIndex, n.lastApplied = applied, applied
+	s.raft = n
+
+	n.wg.Add(2)
+	go n.run()
+	go n.applyLoop()
+	return n, nil
+}
+
+// Stop stops the node. Records are not closed. Stop is called by Storage.Close too.
+func (n *RaftNode) Stop() {
+	n.stopOnce.Do(func() {
+		close(n.stop)
+		n.wg.Wait()
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		for index, w := range n.waiters {
+			w.ch <- ErrNotLeader
+			delete(n.waiters, index)
+		}
+		n.logFile.Close()
+	})
+}
+
+// Leader returns the id of the current leader, or empty if unknown.
+func (n *RaftNode) Leader() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.leader
+}
+
+func (n *RaftNode) statePath() string { return filepath.Join(n.cfg.Dir, "raft.state") }
+func (n *RaftNode) logPath() string   { return filepath.Join(n.cfg.Dir, "raft.log") }
+
+func (n *RaftNode) load() error {
+	buf, err := ioutil.ReadFile(n.statePath())
+	if err == nil {
+		var st raftPersistent
+		if err = json.Unmarshal(buf, &st); err != nil {
+			return fmt.Errorf("broken raft state file : %w", err)
+		}
+		n.term, n.votedFor, n.snapIndex, n.snapTerm = st.Term, st.VotedFor, st.SnapshotIndex, st.SnapshotTerm
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	f, err := os.OpenFile(n.logPath(), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(f)
+	var offset int64
+	for {
+		e, size, err := readRaftEntry(r)
+		if err != nil {
+			// the tail may be broken by crash. it is not acknowledged yet.
+			break
+		}
+		offset += size
+		if e.Index > n.snapIndex && e.Index == n.lastIndex()+1 {
+			n.entries = append(n.entries, e)
+		}
+	}
+	if err = f.Truncate(offset); err != nil {
+		f.Close()
+		return err
+	} else if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	n.logFile = f
+	return nil
+}
+
+// saveState writes the persistent state atomically. n.mu must be locked.
+func (n *RaftNode) saveState() error {
+	buf, err := json.Marshal(raftPersistent{Term: n.term, VotedFor: n.votedFor, SnapshotIndex: n.snapIndex, SnapshotTerm: n.snapTerm})
+	if err != nil {
+		return err
+	}
+	tmpPath := n.statePath() + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(buf); err != nil {
+		f.Close()
+		return err
+	} else if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	} else if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, n.statePath())
+}
+
+// raft log entry is [8 term][8 index][4 data length][data][4 crc32]
+func writeRaftEntry(w io.Writer, e RaftEntry) error {
+	buf := make([]byte, 20+len(e.Data)+4)
+	binary.BigEndian.PutUint64(buf[0:], e.Term)
+	binary.BigEndian.PutUint64(buf[8:], e.Index)
+	binary.BigEndian.PutUint32(buf[16:], uint32(len(e.Data)))
+	copy(buf[20:], e.Data)
+	binary.BigEndian.PutUint32(buf[20+len(e.Data):], crc32.ChecksumIEEE(buf[:20+len(e.Data)]))
+	_, err := w.Write(buf)
+	return err
+}
+
+func readRaftEntry(r io.Reader) (RaftEntry, int64, error) {
+	var head [20]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return RaftEntry{}, 0, err
+	}
+	size := binary.BigEndian.Uint32(head[16:])
+	buf := make([]byte, int(size)+4)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return RaftEntry{}, 0, err
+	}
+	hash := crc32.NewIEEE()
+	hash.Write(head[:])
+	hash.Write(buf[:size])
+	if binary.BigEndian.Uint32(buf[size:]) != hash.Sum32() {
+		return RaftEntry{}, 0, ErrChecksum
+	}
+	e := RaftEntry{
+		Term:  binary.BigEndian.Uint64(head[0:]),
+		Index: binary.BigEndian.Uint64(head[8:]),
+		Data:  buf[:size],
+	}
+	return e, int64(len(head) + len(buf)), nil
+}
+
+// appendLog appends entries to the log file and syncs it. n.mu must be locked.
+func (n *RaftNode) appendLog(entries ...RaftEntry) error {
+	w := bufio.NewWriter(n.logFile)
+	for _, e := range entries {
+		if err := writeRaftEntry(w, e); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	} else if err = n.logFile.Sync(); err != nil {
+		return err
+	}
+	n.entries = append(n.entries, entries...)
+	return nil
+}
+
+// rewriteLog replaces the log file with n.entries after truncation or compaction.
+// n.mu must be locked.
+func (n *RaftNode) rewriteLog() error {
+	tmpPath := n.logPath() + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, e := range n.entries {
+		if err = writeRaftEntry(w, e); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err = w.Flush(); err != nil {
+		f.Close()
+		return err
+	} else if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	} else if err = os.Rename(tmpPath, n.logPath()); err != nil {
+		f.Close()
+		return err
+	}
+	n.logFile.Close()
+	n.logFile = f
+	return nil
+}
+
+func (n *RaftNode) lastIndex() uint64 {
+	return n.snapIndex + uint64(len(n.entries))
+}
+
+// termAt returns the term of the entry at index. 0 if it is compacted.
+func (n *RaftNode) termAt(index uint64) uint64 {
+	if index == n.snapIndex {
+		return n.snapTerm
+	} else if index < n.snapIndex || index > n.lastIndex() {
+		return 0
+	}
+	return n.entries[index-n.snapIndex-1].Term
+}
+
+func (n *RaftNode) quorum() int {
+	return (len(n.cfg.Peers)+1)/2 + 1
+}
+
+func (n *RaftNode) resetTimer() {
+	select {
+	case n.resetCh <- struct{}{}:
+	default:
+	}
+}
+
+func (n *RaftNode) signalApply() {
+	select {
+	case n.applyCh <- struct{}{}:
+	default:
+	}
+}
+
+// stepDown becomes follower of the term. n.mu must be locked.
+func (n *RaftNode) stepDown(term uint64) {
+	if term > n.term {
+		n.term, n.votedFor, n.leader = term, "", ""
+		if err := n.saveState(); err != nil {
+			n.storage.logger().Error("failed to save raft state", "err", err)
+		}
+	}
+	n.state = raftFollower
+}
+
+func (n *RaftNode) run() {
+	defer n.wg.Done()
+	for {
+		n.mu.Lock()
+		state := n.state
+		n.mu.Unlock()
+		if state == raftLeader {
+			select {
+			case <-n.stop:
+				return
+			case <-time.After(n.cfg.HeartbeatInterval):
+				n.broadcast()
+			}
+			continue
+		}
+		timeout := n.cfg.ElectionTimeout + time.Duration(n.rnd.Int63n(int64(n.cfg.ElectionTimeout)))
+		select {
+		case <-n.stop:
+			return
+		case <-n.resetCh:
+		case <-time.After(timeout):
+			n.startElection()
+		}
+	}
+}
+
+func (n *RaftNode) startElection() {
+	n.mu.Lock()
+	n.state = raftCandidate
+	n.term++
+	n.votedFor, n.leader = n.cfg.ID, ""
+	if err := n.saveState(); err != nil {
+		n.storage.logger().Error("failed to save raft state", "err", err)
+		n.state = raftFollower
+		n.mu.Unlock()
+		return
+	}
+	term := n.term
+	req := &VoteRequest{Term: term, Candidate: n.cfg.ID, LastIndex: n.lastIndex(), LastTerm: n.termAt(n.lastIndex())}
+	votes := 1
+	if votes >= n.quorum() {
+		n.becomeLeader()
+	}
+	n.mu.Unlock()
+
+	for _, peer := range n.cfg.Peers {
+		go func(peer string) {
+			ctx, cancel := context.WithTimeout(context.Background(), n.cfg.ElectionTimeout)
+			defer cancel()
+			res, err := n.cfg.Transport.RequestVote(ctx, peer, req)
+			if err != nil {
+				return
+			}
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if res.Term > n.term {
+				n.stepDown(res.Term)
+				return
+			} else if n.state != raftCandidate || n.term != term || !res.Granted {
+				return
+			}
+			votes++
+			if votes >= n.quorum() {
+				n.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+// becomeLeader appends the empty entry of the term to commit entries of previous terms.
+// n.mu must be locked.
+func (n *RaftNode) becomeLeader() {
+	n.state, n.leader = raftLeader, n.cfg.ID
+	for _, peer := range n.cfg.Peers {
+		n.nextIndex[peer] = n.lastIndex() + 1
+		n.matchIndex[peer] = 0
+	}
+	e := RaftEntry{Term: n.term, Index: n.lastIndex() + 1}
+	if err := n.appendLog(e); err != nil {
+		n.storage.logger().Error("failed to append raft log", "err", err)
+		n.stepDown(n.term)
+		return
+	}
+	n.ready = e.Index
+	n.advanceCommit()
+	n.resetTimer()
+	go n.broadcast()
+}
+
+func (n *RaftNode) broadcast() {
+	for _, peer := range n.cfg.Peers {
+		go n.replicate(peer)
+	}
+}
+
+// raftMaxEntries is the max number of entries sent by one AppendEntries.
+const raftMaxEntries = 256
+
+func (n *RaftNode) replicate(peer string) {
+	n.mu.Lock()
+	if n.state != raftLeader || n.inflight[peer] {
+		n.mu.Unlock()
+		return
+	}
+	n.inflight[peer] = true
+	term := n.term
+	next := n.nextIndex[peer]
+	if next <= n.snapIndex {
+		n.mu.Unlock()
+		n.sendSnapshot(peer, term)
+		n.mu.Lock()
+		n.inflight[peer] = false
+		n.mu.Unlock()
+		return
+	}
+	req := &AppendRequest{
+		Term:      term,
+		Leader:    n.cfg.ID,
+		PrevIndex: next - 1,
+		PrevTerm:  n.termAt(next - 1),
+		Commit:    n.commitIndex,
+	}
+	entries := n.entries[next-n.snapIndex-1:]
+	if len(entries) > raftMaxEntries {
+		entries = entries[:raftMaxEntries]
+	}
+	req.Entries = append([]RaftEntry(nil), entries...)
+	n.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), n.cfg.ElectionTimeout)
+	defer cancel()
+	res, err := n.cfg.Transport.AppendEntries(ctx, peer, req)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.inflight[peer] = false
+	if err != nil {
+		return
+	} else if res.Term > n.term {
+		n.stepDown(res.Term)
+		return
+	} else if n.state != raftLeader || n.term != term {
+		return
+	}
+	if res.Success {
+		match := req.PrevIndex + uint64(len(req.Entries))
+		if match > n.matchIndex[peer] {
+			n.matchIndex[peer] = match
+		}
+		n.nextIndex[peer] = match + 1
+		n.advanceCommit()
+		if n.nextIndex[peer] <= n.lastIndex() {
+			go n.replicate(peer)
+		}
+		return
+	}
+	// find the last matched entry
+	if res.LastIndex+1 < n.nextIndex[peer] {
+		n.nextIndex[peer] = res.LastIndex + 1
+	} else if n.nextIndex[peer] > 1 {
+		n.nextIndex[peer]--
+	}
+	go n.replicate(peer)
+}
+
+// advanceCommit commits entries of the current term replicated to majority.
+// n.mu must be locked.
+func (n *RaftNode) advanceCommit() {
+	for index := n.lastIndex(); index > n.commitIndex; index-- {
+		if n.termAt(index) != n.term {
+			// entries of previous terms are committed with the entry of this term
+			return
+		}
+		count := 1
+		for _, peer := range n.cfg.Peers {
+			if n.matchIndex[peer] >= index {
+				count++
+			}
+		}
+		if count >= n.quorum() {
+			n.commitIndex = index
+			n.signalApply()
+			return
+		}
+	}
+}
+
+func (n *RaftNode) sendSnapshot(peer string, term uint64) {
+	records, index, err := n.storage.snapshotRecords()
+	if err != nil {
+		n.storage.logger().Error("failed to read snapshot", "err", err)
+		return
+	}
+	n.mu.Lock()
+	req := &SnapshotRequest{Term: term, Leader: n.cfg.ID, Index: index, LastTerm: n.termAt(index), Records: records}
+	n.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*n.cfg.ElectionTimeout)
+	defer cancel()
+	res, err := n.cfg.Transport.InstallSnapshot(ctx, peer, req)
+	if err != nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if res.Term > n.term {
+		n.stepDown(res.Term)
+	} else if n.state == raftLeader && n.term == term {
+		if index > n.matchIndex[peer] {
+			n.matchIndex[peer] = index
+		}
+		n.nextIndex[peer] = index + 1
+	}
+}
+
+// propose replicates logs of the transaction and waits until they are applied.
+func (n *RaftNode) propose(logs []RecordLog) error {
+	data, err := serializeLogs(logs)
+	if err != nil {
+		return err
+	}
+	n.mu.Lock()
+	if n.state != raftLeader || n.lastApplied < n.ready {
+		leader := n.leader
+		n.mu.Unlock()
+		return fmt.Errorf("%w : leader is %q", ErrNotLeader, leader)
+	}
+	e := RaftEntry{Term: n.term, Index: n.lastIndex() + 1, Data: data}
+	if err = n.appendLog(e); err != nil {
+		n.mu.Unlock()
+		return err
+	}
+	ch := make(chan error, 1)
+	n.waiters[e.Index] = raftWaiter{term: e.Term, ch: ch}
+	n.advanceCommit()
+	n.mu.Unlock()
+	n.broadcast()
+
+	timer := time.NewTimer(n.cfg.CommitTimeout)
+	defer timer.Stop()
+	select {
+	case err = <-ch:
+		return err
+	case <-timer.C:
+	case <-n.stop:
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.waiters[e.Index]; ok {
+		delete(n.waiters, e.Index)
+		return ErrRaftTimeout
+	}
+	// applied just now
+	return <-ch
+}
+
+func (n *RaftNode) applyLoop() {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-n.applyCh:
+		}
+		for n.applyNext() {
+		}
+	}
+}
+
+// applyNext applies the next committed entry and returns false if there is no entry to apply or
+// the storage is corrupted.
+func (n *RaftNode) applyNext() bool {
+	n.applyMu.Lock()
+	n.mu.Lock()
+	if n.lastApplied >= n.commitIndex || n.storage.corrupted.Load() != nil {
+		n.mu.Unlock()
+		n.applyMu.Unlock()
+		return false
+	}
+	index := n.lastApplied + 1
+	e := n.entries[index-n.snapIndex-1]
+	n.mu.Unlock()
+
+	logs, err := deserializeLogs(e.Data)
+	if err == nil {
+		err = n.storage.applyEntry(index, logs)
+	}
+	if err != nil {
+		// the entry is committed in cluster. this node must not diverge, and stops applying
+		// entries until restarted.
+		if !errors.Is(err, ErrCorrupted) {
+			_ = n.storage.corrupt(fmt.Errorf("failed to apply raft entry %d : %w", index, err))
+		}
+		n.applyMu.Unlock()
+		return false
+	}
+
+	n.mu.Lock()
+	n.lastApplied = index
+	if w, ok := n.waiters[index]; ok {
+		delete(n.waiters, index)
+		if w.term == e.Term {
+			w.ch <- nil
+		} else {
+			// the entry of the waiter is overwritten by another leader
+			w.ch <- ErrNotLeader
+		}
+	}
+	snapshot := n.cfg.SnapshotEntries > 0 && n.lastApplied-n.snapIndex >= n.cfg.SnapshotEntries
+	n.mu.Unlock()
+	if snapshot {
+		n.snapshot()
+	}
+	n.applyMu.Unlock()
+	return true
+}
+
+// snapshot checkpoints records and compacts the log until the last applied entry.
+// n.applyMu must be locked.
+func (n *RaftNode) snapshot() {
+	if err := n.storage.Checkpoint(); err != nil {
+		n.storage.logger().Error("failed to checkpoint for raft snapshot", "err", err)
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	index := n.lastApplied
+	term := n.termAt(index)
+	n.entries = append([]RaftEntry(nil), n.entries[index-n.snapIndex:]...)
+	n.snapIndex, n.snapTerm = index, term
+	if err := n.saveState(); err != nil {
+		n.storage.logger().Error("failed to save raft state", "err", err)
+	} else if err = n.rewriteLog(); err != nil {
+		n.storage.logger().Error("failed to compact raft log", "err", err)
+	}
+}
+
+// RequestVote handles the RPC from the candidate.
+func (n *RaftNode) RequestVote(req *VoteRequest) *VoteResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if req.Term < n.term {
+		return &VoteResponse{Term: n.term}
+	} else if req.Term > n.term {
+		n.stepDown(req.Term)
+	}
+	lastIndex := n.lastIndex()
+	lastTerm := n.termAt(lastIndex)
+	upToDate := req.LastTerm > lastTerm || (req.LastTerm == lastTerm && req.LastIndex >= lastIndex)
+	if (n.votedFor == "" || n.votedFor == req.Candidate) && upToDate {
+		n.votedFor = req.Candidate
+		if err := n.saveState(); err != nil {
+			n.storage.logger().Error("failed to save raft state", "err", err)
+			return &VoteResponse{Term: n.term}
+		}
+		n.resetTimer()
+		return &VoteResponse{Term: n.term, Granted: true}
+	}
+	return &VoteResponse{Term: n.term}
+}
+
+// AppendEntries handles the RPC from the leader.
+func (n *RaftNode) AppendEntries(req *AppendRequest) *AppendResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if req.Term < n.term {
+		return &AppendResponse{Term: n.term, LastIndex: n.lastIndex()}
+	}
+	n.stepDown(req.Term)
+	n.leader = req.Leader
+	n.resetTimer()
+
+	if req.PrevIndex > n.lastIndex() {
+		return &AppendResponse{Term: n.term, LastIndex: n.lastIndex()}
+	} else if req.PrevIndex >= n.snapIndex && n.termAt(req.PrevIndex) != req.PrevTerm {
+		return &AppendResponse{Term: n.term, LastIndex: req.PrevIndex - 1}
+	}
+
+	var (
+		appended []RaftEntry
+		truncate bool
+	)
+	for i, e := range req.Entries {
+		if e.Index <= n.snapIndex {
+			continue
+		} else if e.Index <= n.lastIndex() {
+			if n.termAt(e.Index) == e.Term {
+				continue
+			}
+			// conflict. drop the entry and all that follow it
+			n.entries = n.entries[:e.Index-n.snapIndex-1]
+			truncate = true
+		}
+		appended = req.Entries[i:]
+		break
+	}
+	if truncate {
+		for index, w := range n.waiters {
+			if index > n.lastIndex() {
+				w.ch <- ErrNotLeader
+				delete(n.waiters, index)
+			}
+		}
+		n.entries = append(n.entries, appended...)
+		if err := n.rewriteLog(); err != nil {
+			n.storage.logger().Error("failed to rewrite raft log", "err", err)
+			return &AppendResponse{Term: n.term, LastIndex: n.snapIndex}
+		}
+	} else if len(appended) > 0 {
+		if err := n.appendLog(appended...); err != nil {
+			n.storage.logger().Error("failed to append raft log", "err", err)
+			return &AppendResponse{Term: n.term, LastIndex: n.snapIndex}
+		}
+	}
+
+	matched := req.PrevIndex + uint64(len(req.Entries))
+	commit := req.Commit
+	if commit > matched {
+		commit = matched
+	}
+	if commit > n.commitIndex {
+		n.commitIndex = commit
+		n.signalApply()
+	}
+	return &AppendResponse{Term: n.term, Success: true, LastIndex: n.lastIndex()}
+}
+
+// InstallSnapshot handles the RPC from the leader and replaces all records.
+func (n *RaftNode) InstallSnapshot(req *SnapshotRequest) *SnapshotResponse {
+	n.mu.Lock()
+	if req.Term < n.term {
+		defer n.mu.Unlock()
+		return &SnapshotResponse{Term: n.term}
+	}
+	n.stepDown(req.Term)
+	n.leader = req.Leader
+	n.resetTimer()
+	n.mu.Unlock()
+
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if req.Index <= n.lastApplied {
+		return &SnapshotResponse{Term: n.term}
+	}
+	if err := n.storage.restoreSnapshot(req.Records, req.Index); err != nil {
+		// records may be partially replaced. they are replaced again by the next snapshot.
+		n.storage.logger().Error("failed to install raft snapshot", "err", err)
+		return &SnapshotResponse{Term: n.term}
+	}
+	if req.Index < n.lastIndex() && n.termAt(req.Index) == req.LastTerm {
+		n.entries = append([]RaftEntry(nil), n.entries[req.Index-n.snapIndex:]...)
+	} else {
+		n.entries = nil
+	}
+	n.snapIndex, n.snapTerm = req.Index, req.LastTerm
+	n.lastApplied = req.Index
+	if n.commitIndex < req.Index {
+		n.commitIndex = req.Index
+	}
+	if err := n.saveState(); err != nil {
+		n.storage.logger().Error("failed to save raft state", "err", err)
+	} else if err = n.rewriteLog(); err != nil {
+		n.storage.logger().Error("failed to rewrite raft log", "err", err)
+	}
+	return &SnapshotResponse{Term: n.term}
+}
+
+// serializeLogs serializes logs of the transaction into the data of the entry.
+func serializeLogs(logs []RecordLog) ([]byte, error) {
+	// the data is retained by the entry, so that it is allocated at once
+	size := 0
+	for _, rlog := range logs {
+		size += 18 + len(rlog.Key) + len(rlog.Value)
+	}
+	buf, total := make([]byte, size), 0
+	for _, rlog := range logs {
+		n, err := rlog.Serialize(buf[total:])
+		if err != nil {
+			return nil, err
+		}
+		total += n
+	}
+	return buf[:total], nil
+}
+
+func deserializeLogs(data []byte) ([]RecordLog, error) {
+	var logs []RecordLog
+	for len(data) > 0 {
+		var rlog RecordLog
+		n, err := rlog.Deserialize(data)
+		if err != nil {
+			return nil, err
+		}
+		logs = append(logs, rlog)
+		data = data[n:]
+	}
+	return logs, nil
+}
+
+// applyEntry writes logs of the entry to WAL with the index as the commit version, and applies them.
+func (s *Storage) applyEntry(index uint64, logs []RecordLog) error {
+	s.muWAL.Lock()
+	defer s.muWAL.Unlock()
+	if err := s.corrupted.Load(); err != nil {
+		return *err
+	}
+	if len(logs) > 0 {
+		for i := range logs {
+			logs[i].Version = index
+		}
+		if err := s.writeWAL(logs, RecordLog{Action: LCommit}); err != nil {
+			return err
+		} else if err = s.applyCommit(logs); err != nil {
+			return err
+		}
+	}
+	s.version = index
+
+	if s.checkpointSize > 0 && s.walSize >= s.checkpointSize {
+		if err := s.checkpoint(); err != nil {
+			s.logger().Error("failed to checkpoint", "err", err)
+		}
+	}
+	return nil
+}
+
+// snapshotRecords returns all records and the version applied to them.
+func (s *Storage) snapshotRecords() ([]Record, uint64, error) {
+	s.muWAL.Lock()
+	defer s.muWAL.Unlock()
+	s.muDB.RLock()
+	defer s.muDB.RUnlock()
+	// records read by the snapshot are not accessed by users
+	defer s.pauseTiering()()
+	var keys []string
+	if err := s.db.Keys("", func(key string) bool {
+		keys = append(keys, key)
+		return true
+	}); err != nil {
+		return nil, 0, err
+	}
+	records := make([]Record, 0, len(keys))
+	for _, key := range keys {
+		r, err := s.db.Get(key)
+		if err == ErrNotExist {
+			continue
+		} else if err != nil {
+			return nil, 0, err
+		}
+		records = append(records, r)
+	}
+	return records, s.version, nil
+}
+
+// restoreSnapshot replaces all records and checkpoints them with the version.
+func (s *Storage) restoreSnapshot(records []Record, version uint64) error {
+	s.muWAL.Lock()
+	defer s.muWAL.Unlock()
+	s.muDB.Lock()
+	defer s.muDB.Unlock()
+	return s.restoreRecords(records, version)
+}
+
+// restoreRecords must be called with muWAL and muDB locked.
+func (s *Storage) restoreRecords(records []Record, version uint64) error {
+	var keys []string
+	if err := s.db.Keys("", func(key string) bool {
+		keys = append(keys, key)
+		return true
+	}); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := s.db.Delete(key); err != nil {
+			return err
+		}
+	}
+	for _, r := range records {
+		s.markTTL(r.Key)
+		if err := s.db.Put(r); err != nil {
+			return err
+		}
+	}
+	s.version = version
+	s.countInternal()
+	if err := s.recountQuotas(); err != nil {
+		return err
+	} else if err := s.db.Save(version); err != nil {
+		return err
+	} else if err = s.ClearWAL(); err != nil {
+		return err
+	}
+	if s.repl != nil {
+		// restored records are not in retained WAL. replicas need the snapshot.
+		s.repl.mu.Lock()
+		s.repl.base = version
+		s.repl.mu.Unlock()
+	}
+	return nil
+}
+
+// httpRaftTransport sends RPCs as JSON over HTTP to the addresses of peers.
+type httpRaftTransport struct {
+	client *http.Client
+	addrs  map[string]string
+}
+
+// NewHTTPRaftTransport returns the transport to the peers served by RaftNode.ServeHTTP.
+// addrs maps the id of peer to its address (host:port).
+func NewHTTPRaftTransport(addrs map[string]string) RaftTransport {
+	return &httpRaftTransport{client: &http.Client{}, addrs: addrs}
+}
+
+func (t *httpRaftTransport) call(ctx context.Context, peer, path string, req, res interface{}) error {
+	addr, ok := t.addrs[peer]
+	if !ok {
+		return fmt.Errorf("unknown raft peer %q", peer)
+	}
+	buf, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+addr+path, bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	hres, err := t.client.Do(hreq)
+	if err != nil {
+		return err
+	}
+	defer hres.Body.Close()
+	if hres.StatusCode != http.StatusOK {
+		return fmt.Errorf("raft peer %q responds %v", peer, hres.Status)
+	}
+	return json.NewDecoder(hres.Body).Decode(res)
+}
+
+func (t *httpRaftTransport) RequestVote(ctx context.Context, peer string, req *VoteRequest) (*VoteResponse, error) {
+	res := &VoteResponse{}
+	return res, t.call(ctx, peer, "/raft/vote", req, res)
+}
+
+func (t *httpRaftTransport) AppendEntries(ctx context.Context, peer string, req *AppendRequest) (*AppendResponse, error) {
+	res := &AppendResponse{}
+	return res, t.call(ctx, peer, "/raft/append", req, res)
+}
+
+func (t *httpRaftTransport) InstallSnapshot(ctx context.Context, peer string, req *SnapshotRequest) (*SnapshotResponse, error) {
+	res := &SnapshotResponse{}
+	return res, t.call(ctx, peer, "/raft/snapshot", req, res)
+}
+
+// ServeHTTP serves RPCs sent by httpRaftTransport.
+func (n *RaftNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var res interface{}
+	var err error
+	switch r.URL.Path {
+	case "/raft/vote":
+		var req VoteRequest
+		if err = json.NewDecoder(r.Body).Decode(&req); err == nil {
+			res = n.RequestVote(&req)
+		}
+	case "/raft/append":
+		var req AppendRequest
+		if err = json.NewDecoder(r.Body).Decode(&req); err == nil {
+			res = n.AppendEntries(&req)
+		}
+	case "/raft/snapshot":
+		var req SnapshotRequest
+		if err = json.NewDecoder(r.Body).Decode(&req); err == nil {
+			res = n.InstallSnapshot(&req)
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memRaftNetwork connects nodes in memory and can disconnect nodes.
+type memRaftNetwork struct {
+	mu    sync.Mutex
+	nodes map[string]*RaftNode
+	down  map[string]bool
+}
+
+type memRaftTransport struct {
+	net  *memRaftNetwork
+	from string
+}
+
+var errRaftDown = errors.New("node is disconnected")
+
+func (t *memRaftTransport) node(peer string) (*RaftNode, error) {
+	t.net.mu.Lock()
+	defer t.net.mu.Unlock()
+	if t.net.down[t.from] || t.net.down[peer] || t.net.nodes[peer] == nil {
+		return nil, errRaftDown
+	}
+	return t.net.nodes[peer], nil
+}
+
+func (t *memRaftTransport) RequestVote(ctx context.Context, peer string, req *VoteRequest) (*VoteResponse, error) {
+	n, err := t.node(peer)
+	if err != nil {
+		return nil, err
+	}
+	return n.RequestVote(req), nil
+}
+
+func (t *memRaftTransport) AppendEntries(ctx context.Context, peer string, req *AppendRequest) (*AppendResponse, error) {
+	n, err := t.node(peer)
+	if err != nil {
+		return nil, err
+	}
+	return n.AppendEntries(req), nil
+}
+
+func (t *memRaftTransport) InstallSnapshot(ctx context.Context, peer string, req *SnapshotRequest) (*SnapshotResponse, error) {
+	n, err := t.node(peer)
+	if err != nil {
+		return nil, err
+	}
+	return n.InstallSnapshot(req), nil
+}
+
+func (net *memRaftNetwork) setDown(id string, down bool) {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	net.down[id] = down
+}
+
+// waitRaft polls fn until it returns true.
+func waitRaft(t *testing.T, msg string, fn func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if fn() {
+			return
+		}
+	}
+	t.Fatalf("timeout : %v", msg)
+}
+
+func TestRaft(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	ids := []string{"n1", "n2", "n3"}
+	net := &memRaftNetwork{nodes: make(map[string]*RaftNode), down: make(map[string]bool)}
+	storages := make(map[string]*Storage)
+	for _, id := range ids {
+		wal, err := os.OpenFile(filepath.Join(tmpdir, id+".wal"), os.O_CREATE|os.O_APPEND|os.O_RDWR, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer wal.Close()
+		storages[id] = NewStorage(wal, filepath.Join(tmpdir, id+".db"), filepath.Join(tmpdir, id+".db.tmp"))
+		var peers []string
+		for _, peer := range ids {
+			if peer != id {
+				peers = append(peers, peer)
+			}
+		}
+		node, err := StartRaft(storages[id], RaftConfig{
+			ID:                id,
+			Peers:             peers,
+			Dir:               filepath.Join(tmpdir, id+".raft"),
+			Transport:         &memRaftTransport{net: net, from: id},
+			ElectionTimeout:   50 * time.Millisecond,
+			HeartbeatInterval: 10 * time.Millisecond,
+			SnapshotEntries:   5,
+			CommitTimeout:     500 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer node.Stop()
+		net.mu.Lock()
+		net.nodes[id] = node
+		net.mu.Unlock()
+	}
+
+	// leader returns the leader which accepts writes except excluded node
+	leader := func(exclude string) string {
+		var id string
+		waitRaft(t, "leader is elected", func() bool {
+			for _, candidate := range ids {
+				n := net.nodes[candidate]
+				n.mu.Lock()
+				ok := n.state == raftLeader && n.lastApplied >= n.ready
+				n.mu.Unlock()
+				if ok && candidate != exclude {
+					id = candidate
+					return true
+				}
+			}
+			return false
+		})
+		return id
+	}
+	hasValue := func(id, key, value string) func() bool {
+		return func() bool {
+			v, err := storages[id].Get(key)
+			return err == nil && string(v) == value
+		}
+	}
+
+	first := leader("")
+	if err := storages[first].Put("key1", []byte("value1")); err != nil {
+		t.Fatalf("failed to commit in leader : %v", err)
+	}
+	for _, id := range ids {
+		waitRaft(t, "replicated to "+id, hasValue(id, "key1", "value1"))
+	}
+	for _, id := range ids {
+		if id != first {
+			if err := storages[id].Put("key2", []byte("value2")); !errors.Is(err, ErrNotLeader) {
+				t.Errorf("commit in follower %v : %v", id, err)
+			}
+		}
+	}
+
+	// the cluster keeps accepting writes without the leader
+	net.setDown(first, true)
+	if err := storages[first].Put("lost", []byte("lost")); err == nil {
+		t.Errorf("disconnected leader commits")
+	}
+	second := leader(first)
+	for i := 0; i < 10; i++ {
+		if err := storages[second].Put(fmt.Sprintf("key%d", i+2), []byte("value")); err != nil {
+			t.Fatalf("failed to commit in new leader : %v", err)
+		}
+	}
+
+	// the old leader catches up with a snapshot because the log is compacted
+	net.setDown(first, false)
+	waitRaft(t, "old leader catches up", hasValue(first, "key11", "value"))
+	if _, err := storages[first].Get("lost"); err != ErrNotExist {
+		t.Errorf("uncommitted entry of old leader is applied : %v", err)
+	}
+	version := func(id string) uint64 {
+		storages[id].muWAL.Lock()
+		defer storages[id].muWAL.Unlock()
+		return storages[id].version
+	}
+	for _, id := range ids {
+		waitRaft(t, "versions match in "+id, func() bool {
+			return version(id) == version(second)
+		})
+	}
+}
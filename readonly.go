@@ -0,0 +1,220 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+var ErrReadOnly = errors.New("storage is read only")
+
+// OpenReadOnly opens the storage without writing WAL and data files. Committed transactions in
+// WAL are replayed into memory over the records loaded from data files, and WAL is not cleared.
+// WAL is locked shared, so that read only storages open the same files at once but Open by
+// other processes fails with ErrLocked. Commits and checkpoint fail with ErrReadOnly.
+func OpenReadOnly(opts Options) (*Storage, error) {
+	opts.readOnly = true
+	opts.layout()
+	if opts.MasterKey != nil {
+		// the key file is created at the first start
+		if _, err := os.Stat(opts.DBPath + ".keys"); err != nil {
+			return nil, fmt.Errorf("failed to open key file : %w", err)
+		}
+	}
+	return Open(opts)
+}
+
+// overlayEngine keeps records written into the backend in memory, which is used by the read only
+// storage to replay WAL without writing data files.
+type overlayEngine struct {
+	base Backend
+	// changes is the records written after Load. nil is the deleted record.
+	changes map[string]*Record
+	// keys is the sorted keys of changes. nil after changes are modified.
+	keys []string
+	// n is the number of records.
+	n int
+}
+
+// orderedOverlayEngine is overlayEngine over the ordered engine.
+type orderedOverlayEngine struct {
+	*overlayEngine
+	ordered orderedEngine
+}
+
+func newOverlayEngine(base Backend) Backend {
+	o := &overlayEngine{base: base, changes: make(map[string]*Record)}
+	if ordered, ok := orderedOf(base); ok {
+		return &orderedOverlayEngine{overlayEngine: o, ordered: ordered}
+	}
+	return o
+}
+
+func (o *overlayEngine) Get(key string) (Record, error) {
+	if r, ok := o.changes[key]; ok {
+		if r == nil {
+			return Record{}, ErrNotExist
+		}
+		return *r, nil
+	}
+	return o.base.Get(key)
+}
+
+func (o *overlayEngine) exists(key string) (bool, error) {
+	_, err := o.Get(key)
+	if err == ErrNotExist {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (o *overlayEngine) Put(r Record) error {
+	exists, err := o.exists(r.Key)
+	if err != nil {
+		return err
+	} else if !exists {
+		o.n++
+	}
+	if _, ok := o.changes[r.Key]; !ok {
+		o.keys = nil
+	}
+	o.changes[r.Key] = &r
+	return nil
+}
+
+func (o *overlayEngine) Delete(key string) error {
+	exists, err := o.exists(key)
+	if err != nil || !exists {
+		return err
+	}
+	o.n--
+	if _, ok := o.changes[key]; !ok {
+		o.keys = nil
+	}
+	o.changes[key] = nil
+	return nil
+}
+
+func (o *overlayEngine) Len() int {
+	return o.n
+}
+
+// changed returns the sorted keys of changes with the prefix.
+func (o *overlayEngine) changed(prefix string) []string {
+	if o.keys == nil {
+		o.keys = make([]string, 0, len(o.changes))
+		for key := range o.changes {
+			o.keys = append(o.keys, key)
+		}
+		sort.Strings(o.keys)
+	}
+	i := sort.SearchStrings(o.keys, prefix)
+	j := i
+	for j < len(o.keys) && strings.HasPrefix(o.keys[j], prefix) {
+		j++
+	}
+	return o.keys[i:j]
+}
+
+// Keys calls fn for keys of base which are not changed, and then for changed keys.
+func (o *overlayEngine) Keys(prefix string, fn func(key string) bool) error {
+	stopped := false
+	err := o.base.Keys(prefix, func(key string) bool {
+		if _, ok := o.changes[key]; ok {
+			return true
+		}
+		stopped = !fn(key)
+		return !stopped
+	})
+	if err != nil || stopped {
+		return err
+	}
+	for _, key := range o.changed(prefix) {
+		if o.changes[key] != nil && !fn(key) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (o *overlayEngine) Save(version uint64) error {
+	return ErrReadOnly
+}
+
+func (o *overlayEngine) Load() (uint64, error) {
+	version, err := o.base.Load()
+	if err != nil {
+		return 0, err
+	}
+	o.n = o.base.Len()
+	return version, nil
+}
+
+// Salvage salvages records of base, over which records are written in memory.
+func (o *overlayEngine) Salvage(damage func(SnapshotDamage)) (uint64, error) {
+	version, err := salvage(o.base, damage)
+	if err != nil {
+		return 0, err
+	}
+	o.n = o.base.Len()
+	return version, nil
+}
+
+func (o *overlayEngine) Close() error {
+	return o.base.Close()
+}
+
+// Keys merges keys of base and changes in ascending order.
+func (o *orderedOverlayEngine) Keys(prefix string, fn func(key string) bool) error {
+	return o.merge(o.ordered.Keys, prefix, false, fn)
+}
+
+// KeysReverse merges keys of base and changes in descending order.
+func (o *orderedOverlayEngine) KeysReverse(prefix string, fn func(key string) bool) error {
+	return o.merge(o.ordered.KeysReverse, prefix, true, fn)
+}
+
+func (o *orderedOverlayEngine) merge(keys func(string, func(string) bool) error, prefix string, reverse bool, fn func(key string) bool) error {
+	changed := o.changed(prefix)
+	i := 0
+	next := func() string {
+		if reverse {
+			return changed[len(changed)-1-i]
+		}
+		return changed[i]
+	}
+	// emit calls fn for the changed key unless it is deleted
+	emit := func(key string) bool {
+		return o.changes[key] == nil || fn(key)
+	}
+	stopped := false
+	err := keys(prefix, func(key string) bool {
+		for ; i < len(changed); i++ {
+			c := next()
+			if c == key || (c > key) != reverse {
+				break
+			} else if !emit(c) {
+				stopped = true
+				return false
+			}
+		}
+		if i < len(changed) && next() == key {
+			i++
+			stopped = !emit(key)
+		} else {
+			stopped = !fn(key)
+		}
+		return !stopped
+	})
+	if err != nil || stopped {
+		return err
+	}
+	for ; i < len(changed); i++ {
+		if !emit(next()) {
+			return nil
+		}
+	}
+	return nil
+}
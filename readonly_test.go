@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// createChangedStorage saves key0..key9 into the data file, and leaves the transaction which
+// deletes key3, updates key5 and inserts key55 and key99 in WAL.
+func createChangedStorage(t *testing.T, opts Options) Options {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	opts.WALPath, opts.DBPath = testWALPath, testDBPath
+	storage, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.db.Close()
+	defer storage.wal.Close()
+	for i := 0; i < 10; i++ {
+		if err = storage.Put(fmt.Sprintf("key%d", i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = storage.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	err = storage.autoCommit(func(txn *Txn) error {
+		if err := txn.Delete("key3"); err != nil {
+			return err
+		} else if err = txn.Update("key5", []byte("new")); err != nil {
+			return err
+		} else if err = txn.Insert("key55", []byte("new")); err != nil {
+			return err
+		}
+		return txn.Insert("key99", []byte("new"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return opts
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	expected := []string{"key0", "key1", "key2", "key4", "key5", "key55", "key6", "key7", "key8", "key9", "key99"}
+	for _, tt := range []struct {
+		name string
+		opts Options
+	}{
+		{"map", Options{}},
+		{"btree", Options{Backend: "btree"}},
+		{"hash", Options{Backend: "hash"}},
+		{"lsm", Options{Backend: "lsm"}},
+		{"partitions", Options{Partitions: 3, Backend: "btree"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := createChangedStorage(t, tt.opts)
+			before := snapshotFiles(t)
+			storage, err := OpenReadOnly(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// read only storages share the lock
+			other, err := OpenReadOnly(opts)
+			if err != nil {
+				t.Fatal(err)
+			} else if err = other.Close(); err != nil {
+				t.Error(err)
+			}
+			if _, err = Open(opts); err != ErrLocked {
+				t.Errorf("WAL is opened for writes : %v", err)
+			}
+
+			if storage.db.Len() != len(expected) {
+				t.Errorf("%v records, expected %v", storage.db.Len(), len(expected))
+			}
+			var keys []string
+			txn := storage.NewTxn()
+			if err = txn.Scan("key", func(key string, value []byte) error {
+				keys = append(keys, key)
+				if (key == "key5" || key == "key55" || key == "key99") != bytes.Equal(value, []byte("new")) {
+					t.Errorf("value of %v : %s", key, value)
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			} else if !reflect.DeepEqual(keys, expected) {
+				t.Errorf("keys : %v", keys)
+			}
+			if key, _, err := txn.First(); err != nil || key != "key0" {
+				t.Errorf("first : %v %v", key, err)
+			} else if key, _, err = txn.Last(); err != nil || key != "key99" {
+				t.Errorf("last : %v %v", key, err)
+			}
+			txn.Abort()
+			if o, ok := orderedOf(storage.db); ok {
+				keys = nil
+				if err = o.KeysReverse("key5", func(key string) bool {
+					keys = append(keys, key)
+					return true
+				}); err != nil || !reflect.DeepEqual(keys, []string{"key55", "key5"}) {
+					t.Errorf("reverse keys : %v %v", keys, err)
+				}
+			}
+
+			if err = storage.Put("key3", []byte("value")); err != ErrReadOnly {
+				t.Errorf("put : %v", err)
+			} else if err = storage.Checkpoint(); err == nil {
+				t.Errorf("checkpoint succeeds")
+			} else if err = storage.Close(); err != nil {
+				t.Fatal(err)
+			}
+			after := snapshotFiles(t)
+			if len(before) != len(after) {
+				t.Errorf("files are changed from %v to %v", len(before), len(after))
+			}
+			for path, buf := range before {
+				if !bytes.Equal(buf, after[path]) {
+					t.Errorf("%v is modified", path)
+				}
+			}
+		})
+	}
+
+	t.Run("not exist", func(t *testing.T) {
+		_ = os.RemoveAll(tmpdir)
+		_ = os.MkdirAll(tmpdir, 0777)
+		if _, err := OpenReadOnly(Options{WALPath: testWALPath, DBPath: testDBPath}); !os.IsNotExist(err) {
+			t.Errorf("WAL not exist : %v", err)
+		} else if _, err = os.Stat(testWALPath); !os.IsNotExist(err) {
+			t.Errorf("WAL is created : %v", err)
+		}
+	})
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// CorruptLog is the range of WAL truncated or skipped by RecoveryPolicy.
+type CorruptLog struct {
+	Offset int64 `json:"offset"`
+	Bytes  int64 `json:"bytes"`
+	// Action is "truncated" or "skipped".
+	Action string `json:"action"`
+	Err    string `json:"error"`
+}
+
+// RecoveryReport is what recovery from the data file and WAL applies, analyzed by
+// AnalyzeRecovery without modifying them.
+type RecoveryReport struct {
+	Policy string `json:"policy"`
+	// SnapshotVersion is the version saved in the data file, and SnapshotRecords is the number
+	// of records in it. SnapshotExists is false for the initial start.
+	SnapshotExists  bool   `json:"snapshot_exists"`
+	SnapshotVersion uint64 `json:"snapshot_version"`
+	SnapshotRecords int    `json:"snapshot_records"`
+	// WALBytes is the size of WAL, and WALLogs is the number of valid logs in it.
+	WALBytes int64 `json:"wal_bytes"`
+	WALLogs  int   `json:"wal_logs"`
+	// Transactions is the number of committed transactions applied, and Records is the number
+	// of records written by them.
+	Transactions int `json:"transactions"`
+	Records      int `json:"records"`
+	// InDoubt is the number of prepared transactions without decision, which keep their locks.
+	InDoubt int `json:"in_doubt"`
+	// Discarded is the number of transactions discarded because their logs are skipped.
+	Discarded int `json:"discarded"`
+	// LastVersion is the version of the last committed transaction after recovery.
+	LastVersion uint64 `json:"last_version"`
+	// TornBytes is the size of the torn log at the tail of WAL, which any policy discards.
+	TornBytes int64        `json:"torn_bytes"`
+	Corrupt   []CorruptLog `json:"corrupt"`
+	// Error is the reason why recovery fails. empty if recovery succeeds.
+	Error string `json:"error,omitempty"`
+}
+
+// OK returns true if recovery succeeds without discarding any committed transaction.
+func (r *RecoveryReport) OK() bool {
+	return r.Error == "" && len(r.Corrupt) == 0 && r.Discarded == 0
+}
+
+// AnalyzeRecovery loads the data file and replays WAL by opts as Open does, and reports what
+// the recovery applies. Records of WAL are applied to memory, and neither the data file nor WAL
+// is modified. The failure of recovery is reported by RecoveryReport.Error, and error is
+// returned only if opts is invalid.
+func AnalyzeRecovery(opts Options) (*RecoveryReport, error) {
+	newBackend, err := opts.factory("")
+	if err != nil {
+		return nil, err
+	} else if err = opts.validate(); err != nil {
+		return nil, err
+	}
+	opts.readOnly = true
+	report := &RecoveryReport{Policy: opts.RecoveryPolicy, Corrupt: []CorruptLog{}}
+	if report.Policy == "" {
+		report.Policy = RecoveryStrict
+	}
+
+	snapshot := newStorage(nil, opts.newDB(newBackend))
+	defer snapshot.db.Close()
+	if err = snapshot.addFamilies(&opts); err != nil {
+		return nil, err
+	}
+	if err = snapshot.LoadCheckPoint(); err == nil {
+		report.SnapshotExists = true
+		report.SnapshotVersion = snapshot.version
+		report.SnapshotRecords = snapshot.keyCount()
+		report.LastVersion = snapshot.version
+	} else if !os.IsNotExist(err) || opts.MustExist {
+		report.Error = fmt.Sprintf("failed to load data file : %v", err)
+		return report, nil
+	}
+
+	if opts.DisableWAL {
+		return report, nil
+	}
+	wal, err := os.Open(opts.WALPath)
+	if os.IsNotExist(err) {
+		return report, nil
+	} else if err != nil {
+		report.Error = fmt.Sprintf("failed to open WAL file : %v", err)
+		return report, nil
+	}
+	defer wal.Close()
+	info, err := wal.Stat()
+	if err != nil {
+		report.Error = fmt.Sprintf("failed to stat WAL file : %v", err)
+		return report, nil
+	}
+	report.WALBytes = info.Size()
+
+	// records in WAL are applied to the map in memory instead of the backends
+	replayWAL(wal, newMapEngine("", ""), snapshot.version, opts.RecoveryPolicy, report)
+	return report, nil
+}
+
+// replayWAL replays WAL into db over the records of version by policy, and fills report with
+// what is applied. The storage which replayed WAL is returned to read the records.
+func replayWAL(wal File, db Backend, version uint64, policy string, report *RecoveryReport) *Storage {
+	replay := newStorage(wal, db)
+	replay.version = version
+	replay.opts.RecoveryPolicy = policy
+	replay.opts.RecoveryProgress = func(p RecoveryProgress) {
+		if p.Done {
+			report.Transactions, report.Records = p.Transactions, p.Records
+		}
+	}
+	nlogs, err := replay.LoadWAL()
+	if err != nil {
+		report.Error = fmt.Sprintf("failed to load WAL file : %v", err)
+	}
+	report.WALLogs = nlogs
+	report.InDoubt = len(replay.prepared)
+	report.Discarded = replay.discardedTxns
+	report.LastVersion = replay.version
+	report.TornBytes = replay.tornBytes
+	report.Corrupt = append(report.Corrupt, replay.corruptLogs...)
+	return replay
+}
+
+// WriteText writes the report for operators.
+func (r *RecoveryReport) WriteText(w io.Writer) error {
+	fmt.Fprintf(w, "policy            : %s\n", r.Policy)
+	if r.SnapshotExists {
+		fmt.Fprintf(w, "snapshot          : version %d, %d records\n", r.SnapshotVersion, r.SnapshotRecords)
+	} else {
+		fmt.Fprintf(w, "snapshot          : not found (initial start)\n")
+	}
+	fmt.Fprintf(w, "wal               : %d bytes, %d logs\n", r.WALBytes, r.WALLogs)
+	fmt.Fprintf(w, "transactions      : %d committed, %d records\n", r.Transactions, r.Records)
+	fmt.Fprintf(w, "in doubt          : %d prepared transactions\n", r.InDoubt)
+	fmt.Fprintf(w, "discarded         : %d transactions\n", r.Discarded)
+	fmt.Fprintf(w, "last version      : %d\n", r.LastVersion)
+	if r.TornBytes > 0 {
+		fmt.Fprintf(w, "torn tail         : %d bytes\n", r.TornBytes)
+	}
+	for _, c := range r.Corrupt {
+		fmt.Fprintf(w, "corrupt           : %s %d bytes at offset %d : %s\n", c.Action, c.Bytes, c.Offset, c.Err)
+	}
+	if r.Error != "" {
+		fmt.Fprintf(w, "error             : %s\n", r.Error)
+	}
+	_, err := fmt.Fprintf(w, "result            : %s\n", r.result())
+	return err
+}
+
+func (r *RecoveryReport) result() string {
+	switch {
+	case r.Error != "":
+		return "recovery fails"
+	case !r.OK():
+		return "recovery succeeds with data loss"
+	default:
+		return "recovery succeeds"
+	}
+}
+
+// runRecoverCommand runs "txngo [flags] recover [-dry-run] [-json]" and returns the exit status.
+// It reports what recovery applies, and recovers the storage unless -dry-run is given. The
+// status is exitFailure if recovery fails or discards committed transactions.
+func runRecoverCommand(opts Options, args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("recover", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	dryRun := fs.Bool("dry-run", false, "report what recovery applies without modifying data file and WAL")
+	asJSON := fs.Bool("json", false, "write the report as JSON")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	} else if fs.NArg() > 0 {
+		fmt.Fprintln(stderr, "usage : txngo [flags] recover [-dry-run] [-json]")
+		return exitUsage
+	}
+
+	// progress and corruption are reported by the report
+	log.SetOutput(ioutil.Discard)
+	report, err := AnalyzeRecovery(opts)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	}
+	if *asJSON {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	} else {
+		err = report.WriteText(stdout)
+	}
+	if err != nil || report.Error != "" {
+		return exitFailure
+	}
+
+	if !*dryRun {
+		storage, err := Open(opts)
+		if err != nil {
+			fmt.Fprintf(stderr, "failed to recover : %v\n", err)
+			return exitFailure
+		}
+		storage.wal.Close()
+		storage.db.Close()
+	}
+	if !report.OK() {
+		return exitFailure
+	}
+	return exitOK
+}
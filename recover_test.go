@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// createCrashedStorage saves 10 records into the data file and leaves 5 transactions in WAL.
+func createCrashedStorage(t *testing.T, opts Options) Options {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	opts.WALPath, opts.DBPath = testWALPath, testDBPath
+	storage, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.db.Close()
+	defer storage.wal.Close()
+	for i := 0; i < 10; i++ {
+		if err = storage.Put(fmt.Sprintf("key%d", i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = storage.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err = storage.Put(fmt.Sprintf("new%d", i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return opts
+}
+
+// snapshotFiles reads all files in tmpdir.
+func snapshotFiles(t *testing.T) map[string][]byte {
+	files := make(map[string][]byte)
+	err := filepath.Walk(tmpdir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		buf, err := ioutil.ReadFile(path)
+		files[path] = buf
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestAnalyzeRecovery(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		opts Options
+	}{
+		{"map", Options{}},
+		{"btree", Options{Backend: "btree"}},
+		{"lsm", Options{Backend: "lsm"}},
+		{"partitions", Options{Partitions: 3, Backend: "hash"}},
+		{"families", Options{ColumnFamilies: []FamilyOptions{{Name: "cf", Backend: "btree"}}}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := createCrashedStorage(t, tt.opts)
+			if tt.opts.Backend == "lsm" {
+				// the table not listed in manifest is removed only by Open
+				if err := ioutil.WriteFile(filepath.Join(testDBPath, "999999.sst"), []byte("broken"), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			before := snapshotFiles(t)
+			report, err := AnalyzeRecovery(opts)
+			if err != nil {
+				t.Fatal(err)
+			} else if !report.OK() || report.Error != "" {
+				t.Fatalf("report : %+v", report)
+			} else if !report.SnapshotExists || report.SnapshotRecords != 10 || report.SnapshotVersion == 0 {
+				t.Errorf("snapshot : %+v", report)
+			} else if report.Transactions != 5 || report.Records != 5 || report.WALLogs != 10 {
+				t.Errorf("WAL : %+v", report)
+			} else if report.LastVersion != report.SnapshotVersion+5 || report.Policy != RecoveryStrict {
+				t.Errorf("report : %+v", report)
+			}
+			after := snapshotFiles(t)
+			if len(before) != len(after) {
+				t.Errorf("files are changed from %v to %v", len(before), len(after))
+			}
+			for path, buf := range before {
+				if !bytes.Equal(buf, after[path]) {
+					t.Errorf("%v is modified", path)
+				}
+			}
+		})
+	}
+
+	t.Run("initial start", func(t *testing.T) {
+		_ = os.RemoveAll(tmpdir)
+		_ = os.MkdirAll(tmpdir, 0777)
+		report, err := AnalyzeRecovery(Options{WALPath: testWALPath, DBPath: testDBPath})
+		if err != nil {
+			t.Fatal(err)
+		} else if !report.OK() || report.SnapshotExists || report.WALBytes != 0 {
+			t.Errorf("report : %+v", report)
+		} else if _, err = os.Stat(testWALPath); !os.IsNotExist(err) {
+			t.Errorf("WAL is created : %v", err)
+		}
+		if report, err = AnalyzeRecovery(Options{WALPath: testWALPath, DBPath: testDBPath, MustExist: true}); err != nil {
+			t.Fatal(err)
+		} else if report.Error == "" {
+			t.Errorf("data file must exist : %+v", report)
+		}
+	})
+
+	t.Run("corrupt", func(t *testing.T) {
+		opts := createCrashedStorage(t, Options{})
+		info, err := os.Stat(testWALPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// corrupt the insert log of the fourth transaction
+		corruptFile(t, testWALPath, info.Size()*3/5+10)
+
+		if report, err := AnalyzeRecovery(opts); err != nil {
+			t.Fatal(err)
+		} else if report.Error == "" || !strings.Contains(report.Error, ErrChecksum.Error()) {
+			t.Errorf("strict : %+v", report)
+		}
+		opts.RecoveryPolicy = RecoveryTruncate
+		if report, err := AnalyzeRecovery(opts); err != nil {
+			t.Fatal(err)
+		} else if report.Error != "" || report.OK() || report.Transactions != 3 || len(report.Corrupt) != 1 || report.Corrupt[0].Action != "truncated" {
+			t.Errorf("truncate : %+v", report)
+		}
+		opts.RecoveryPolicy = RecoverySkip
+		if report, err := AnalyzeRecovery(opts); err != nil {
+			t.Fatal(err)
+		} else if report.Error != "" || report.Transactions != 4 || report.Discarded != 1 || len(report.Corrupt) != 1 || report.Corrupt[0].Action != "skipped" {
+			t.Errorf("skip : %+v", report)
+		} else if report.Corrupt[0].Offset != info.Size()*3/5 {
+			t.Errorf("offset of corrupt log : %v", report.Corrupt[0].Offset)
+		}
+		opts.RecoveryPolicy = "none"
+		if _, err := AnalyzeRecovery(opts); err == nil {
+			t.Errorf("unknown policy is analyzed")
+		}
+	})
+}
+
+func TestRunRecoverCommand(t *testing.T) {
+	opts := createCrashedStorage(t, Options{Backend: "btree"})
+	var stdout, stderr bytes.Buffer
+	if status := runRecoverCommand(opts, []string{"--dry-run"}, &stdout, &stderr); status != exitOK {
+		t.Fatalf("status : %v (%s)", status, stderr.String())
+	} else if !strings.Contains(stdout.String(), "5 committed, 5 records") || !strings.Contains(stdout.String(), "recovery succeeds\n") {
+		t.Errorf("output :\n%s", stdout.String())
+	} else if info, err := os.Stat(testWALPath); err != nil || info.Size() == 0 {
+		t.Errorf("WAL is cleared by dry run : %v", err)
+	}
+
+	stdout.Reset()
+	if status := runRecoverCommand(opts, []string{"-json"}, &stdout, &stderr); status != exitOK {
+		t.Fatalf("status : %v (%s)", status, stderr.String())
+	}
+	var report RecoveryReport
+	if err := json.Unmarshal(stdout.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	} else if report.Transactions != 5 {
+		t.Errorf("report : %+v", report)
+	} else if info, err := os.Stat(testWALPath); err != nil || info.Size() != 0 {
+		t.Errorf("WAL is not cleared by recovery : %v", err)
+	}
+
+	if err := ioutil.WriteFile(testDBPath, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	stdout.Reset()
+	if status := runRecoverCommand(opts, []string{"-dry-run"}, &stdout, &stderr); status != exitFailure {
+		t.Errorf("status of broken data file : %v :\n%s", status, stdout.String())
+	} else if !strings.Contains(stdout.String(), "recovery fails\n") {
+		t.Errorf("output :\n%s", stdout.String())
+	}
+
+	for _, args := range [][]string{{"-unknown"}, {"arg"}} {
+		if status := runRecoverCommand(opts, args, &stdout, &stderr); status != exitUsage {
+			t.Errorf("status of %v : %v", args, status)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// SnapshotDamage is the damage of data files found by Repair.
+type SnapshotDamage struct {
+	// Source is the data file, the partition or the column family.
+	Source string `json:"source"`
+	// Salvaged is the number of records read before the damage, and Lost is the number of
+	// records after it. Lost is -1 if unknown.
+	Salvaged int    `json:"salvaged"`
+	Lost     int    `json:"lost"`
+	Err      string `json:"error"`
+}
+
+// salvageEngine is the engine which loads readable records of broken data files.
+type salvageEngine interface {
+	// Salvage loads records as Load, and reports the damage instead of failing for broken data
+	// files. os.IsNotExist error is returned for the initial start.
+	Salvage(damage func(SnapshotDamage)) (uint64, error)
+}
+
+// salvageOf returns the salvage engine under the wrappers.
+func salvageOf(e Backend) (salvageEngine, bool) {
+	for {
+		if s, ok := e.(salvageEngine); ok {
+			return s, true
+		} else if w, ok := e.(unwrapper); ok {
+			e = w.unwrap()
+		} else {
+			return nil, false
+		}
+	}
+}
+
+// salvage salvages e if supported, or loads it.
+func salvage(e Backend, damage func(SnapshotDamage)) (uint64, error) {
+	if s, ok := salvageOf(e); ok {
+		return s.Salvage(damage)
+	}
+	return e.Load()
+}
+
+// salvageEach salvages engines one by one and returns the oldest version of them. The engine
+// which can not be loaded is reported and replaced by the empty engine in memory.
+func salvageEach(engines []Backend, source func(i int) string, damage func(SnapshotDamage)) (uint64, error) {
+	var (
+		version  uint64
+		loaded   bool
+		notExist error
+	)
+	for i, e := range engines {
+		v, err := salvage(e, damage)
+		if os.IsNotExist(err) {
+			notExist = err
+			continue
+		} else if err != nil {
+			damage(SnapshotDamage{Source: source(i), Lost: -1, Err: err.Error()})
+			_ = e.Close()
+			engines[i] = newMapEngine("", "")
+			continue
+		}
+		if !loaded || v < version {
+			version = v
+		}
+		loaded = true
+	}
+	if !loaded && notExist != nil {
+		return 0, notExist
+	}
+	return version, nil
+}
+
+// RepairReport is what Repair salvages from the damaged data files and WAL, and what is lost.
+type RepairReport struct {
+	// RecoveryReport is the replay of WAL by RecoverySkip over the salvaged records.
+	RecoveryReport
+	// Damages is the damage of data files. SnapshotRecords is the number of salvaged records.
+	Damages []SnapshotDamage `json:"damages"`
+	// LostKeys is the keys listed in data files whose records can not be read.
+	LostKeys []string `json:"lost_keys"`
+	// Out is the directory of the fresh data files, and Written is the number of records in it.
+	Out     string `json:"out"`
+	Written int    `json:"written"`
+}
+
+// Lost returns true if any record of data files or committed transaction is not salvaged.
+// Prepared transactions without decision are discarded.
+func (r *RepairReport) Lost() bool {
+	return len(r.Damages) > 0 || len(r.LostKeys) > 0 || len(r.Corrupt) > 0 || r.Discarded > 0 || r.InDoubt > 0
+}
+
+// Repair salvages all readable records from the damaged data files and WAL of opts, and writes
+// them into the fresh data files and WAL in the directory out, which must not exist or be empty.
+// Records are read from data files until the damage, and committed transactions replayed by
+// RecoverySkip are applied over them, so that no transaction is applied partially. The files of
+// opts are not modified. Failure after opts is validated is reported by RepairReport.Error.
+// TODO: salvage records of data files by btree, hash and lsm after broken pages
+func Repair(opts Options, out string) (*RepairReport, error) {
+	opts.layout()
+	newBackend, err := opts.factory("")
+	if err != nil {
+		return nil, err
+	} else if err = opts.validate(); err != nil {
+		return nil, err
+	} else if opts.DBPath == "" {
+		return nil, errors.New("data file is required to repair")
+	}
+	if entries, err := ioutil.ReadDir(out); err == nil && len(entries) > 0 {
+		return nil, fmt.Errorf("%v is not empty", out)
+	} else if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if opts.MasterKey != nil {
+		if _, err := os.Stat(opts.DBPath + ".keys"); err != nil {
+			return nil, fmt.Errorf("failed to open key file : %w", err)
+		}
+	}
+	// WAL is locked shared not to repair the running storage
+	var wal *os.File
+	if !opts.DisableWAL {
+		if wal, err = os.Open(opts.WALPath); err == nil {
+			defer wal.Close()
+			if err = lockFile(wal, false); err != nil {
+				return nil, err
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	report := &RepairReport{
+		RecoveryReport: RecoveryReport{Policy: RecoverySkip, Corrupt: []CorruptLog{}},
+		Damages:        []SnapshotDamage{},
+		LostKeys:       []string{},
+		Out:            out,
+	}
+	damage := func(d SnapshotDamage) {
+		opts.logger().Warn("damaged data file", "source", d.Source, "salvaged", d.Salvaged, "lost", d.Lost, "err", d.Err)
+		report.Damages = append(report.Damages, d)
+	}
+	opts.readOnly = true
+	snapshot := newStorage(nil, opts.newDB(newBackend))
+	defer func() {
+		snapshot.db.Close()
+	}()
+	if err = snapshot.setupEngines(&opts); err != nil {
+		return nil, err
+	}
+	// salvaged records are collected in memory
+	records := newMapEngine("", "")
+	version, err := salvage(snapshot.db, damage)
+	if err == nil {
+		report.SnapshotExists, report.SnapshotVersion = true, version
+		var keys []string
+		if err = snapshot.db.Keys("", func(key string) bool {
+			keys = append(keys, key)
+			return true
+		}); err != nil {
+			damage(SnapshotDamage{Source: opts.DBPath, Salvaged: len(keys), Lost: -1, Err: err.Error()})
+		}
+		for _, key := range keys {
+			r, err := snapshot.db.Get(key)
+			if err != nil {
+				opts.logger().Warn("record in data file is lost", "key", key, "err", err)
+				report.LostKeys = append(report.LostKeys, key)
+				continue
+			}
+			r.Key = key
+			if err = records.Put(r); err != nil {
+				return nil, err
+			}
+		}
+		report.SnapshotRecords = records.Len()
+	} else if !os.IsNotExist(err) {
+		report.SnapshotExists = true
+		damage(SnapshotDamage{Source: opts.DBPath, Lost: -1, Err: err.Error()})
+		version = 0
+	}
+	report.LastVersion = version
+
+	if wal != nil {
+		info, err := wal.Stat()
+		if err != nil {
+			report.Error = fmt.Sprintf("failed to stat WAL file : %v", err)
+			return report, nil
+		}
+		report.WALBytes = info.Size()
+		replayWAL(wal, records, version, RecoverySkip, &report.RecoveryReport)
+		if report.Error != "" {
+			return report, nil
+		}
+	}
+
+	var keys []string
+	if err = records.Keys("", func(key string) bool {
+		keys = append(keys, key)
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	all := make([]Record, 0, len(keys))
+	for _, key := range keys {
+		r, err := records.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		r.Key = key
+		all = append(all, r)
+	}
+	if err = writeRepaired(opts, out, all, report.LastVersion); err != nil {
+		report.Error = err.Error()
+		return report, nil
+	}
+	report.Written = len(all)
+	return report, nil
+}
+
+// writeRepaired writes records into the fresh data files and WAL with the names of opts in out,
+// or into the data directory out if opts.Dir is set.
+func writeRepaired(opts Options, out string, records []Record, version uint64) error {
+	if err := os.MkdirAll(out, 0700); err != nil {
+		return err
+	}
+	opts.readOnly, opts.MustExist = false, false
+	opts.RecoveryPolicy, opts.RecoveryProgress = "", nil
+	if opts.Dir != "" {
+		opts.Dir, opts.WALPath, opts.DBPath, opts.legacyDir = out, "", "", false
+	} else {
+		opts.WALPath = filepath.Join(out, filepath.Base(opts.WALPath))
+		opts.DBPath = filepath.Join(out, filepath.Base(opts.DBPath))
+	}
+	storage, err := Open(opts)
+	if err != nil {
+		return fmt.Errorf("failed to open %v : %w", out, err)
+	}
+	err = storage.restoreSnapshot(records, version)
+	if cerr := storage.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %v : %w", out, err)
+	}
+	return nil
+}
+
+// maxReportedKeys is the max number of lost keys listed by WriteText.
+const maxReportedKeys = 20
+
+// WriteText writes the report for operators.
+func (r *RepairReport) WriteText(w io.Writer) error {
+	if r.SnapshotExists {
+		fmt.Fprintf(w, "snapshot          : version %d, %d records salvaged\n", r.SnapshotVersion, r.SnapshotRecords)
+	} else {
+		fmt.Fprintf(w, "snapshot          : not found\n")
+	}
+	for _, d := range r.Damages {
+		lost := fmt.Sprintf("%d", d.Lost)
+		if d.Lost < 0 {
+			lost = "unknown"
+		}
+		fmt.Fprintf(w, "damaged           : %s, %d records salvaged, %s records lost : %s\n", d.Source, d.Salvaged, lost, d.Err)
+	}
+	for i, key := range r.LostKeys {
+		if i == maxReportedKeys {
+			fmt.Fprintf(w, "lost key          : ... and %d keys\n", len(r.LostKeys)-i)
+			break
+		}
+		fmt.Fprintf(w, "lost key          : %q\n", key)
+	}
+	fmt.Fprintf(w, "wal               : %d bytes, %d logs\n", r.WALBytes, r.WALLogs)
+	fmt.Fprintf(w, "transactions      : %d committed, %d records\n", r.Transactions, r.Records)
+	fmt.Fprintf(w, "discarded         : %d transactions, %d prepared transactions in doubt\n", r.Discarded, r.InDoubt)
+	if r.TornBytes > 0 {
+		fmt.Fprintf(w, "torn tail         : %d bytes\n", r.TornBytes)
+	}
+	for _, c := range r.Corrupt {
+		fmt.Fprintf(w, "corrupt           : %s %d bytes at offset %d : %s\n", c.Action, c.Bytes, c.Offset, c.Err)
+	}
+	if r.Error != "" {
+		fmt.Fprintf(w, "error             : %s\n", r.Error)
+	} else {
+		fmt.Fprintf(w, "out               : %s, %d records, version %d\n", r.Out, r.Written, r.LastVersion)
+	}
+	_, err := fmt.Fprintf(w, "result            : %s\n", r.result())
+	return err
+}
+
+func (r *RepairReport) result() string {
+	switch {
+	case r.Error != "":
+		return "repair fails"
+	case r.Lost():
+		return "repaired with data loss"
+	default:
+		return "repaired without data loss"
+	}
+}
+
+// runRepairCommand runs "txngo [flags] repair -out DIR [-json]" and returns the exit status. The
+// status is exitFailure if repair fails or any record is lost.
+func runRepairCommand(opts Options, args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("repair", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	out := fs.String("out", "", "directory to write the fresh data files, which must not exist or be empty")
+	asJSON := fs.Bool("json", false, "write the report as JSON")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	} else if fs.NArg() > 0 || *out == "" {
+		fmt.Fprintln(stderr, "usage : txngo [flags] repair -out DIR [-json]")
+		return exitUsage
+	}
+
+	// damage is reported by the report
+	log.SetOutput(ioutil.Discard)
+	report, err := Repair(opts, *out)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitFailure
+	}
+	if *asJSON {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	} else {
+		err = report.WriteText(stdout)
+	}
+	if err != nil || report.Error != "" || report.Lost() {
+		return exitFailure
+	}
+	return exitOK
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// assertRepaired opens the repaired storage in out and checks that it has only the keys.
+func assertRepaired(t *testing.T, opts Options, out string, keys []string) {
+	t.Helper()
+	opts.WALPath = filepath.Join(out, filepath.Base(opts.WALPath))
+	opts.DBPath = filepath.Join(out, filepath.Base(opts.DBPath))
+	opts.MustExist = true
+	storage, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	if storage.db.Len() != len(keys) {
+		t.Errorf("%v records, expected %v", storage.db.Len(), len(keys))
+	}
+	txn := storage.NewTxn()
+	defer txn.Abort()
+	for _, key := range keys {
+		assertValue(t, txn, key, []byte("value"))
+	}
+}
+
+func TestRepair(t *testing.T) {
+	out := filepath.Join(os.TempDir(), "txngo-repaired")
+	defer os.RemoveAll(out)
+
+	t.Run("map", func(t *testing.T) {
+		_ = os.RemoveAll(out)
+		opts := createCrashedStorage(t, Options{})
+		// the data file is broken at the 6th record, and the log of new2 in WAL is corrupt
+		if err := os.Truncate(testDBPath, 12+22*5+3); err != nil {
+			t.Fatal(err)
+		}
+		wal, err := ioutil.ReadFile(testWALPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		corruptFile(t, testWALPath, int64(bytes.Index(wal, []byte("new2"))))
+		before := snapshotFiles(t)
+
+		report, err := Repair(opts, out)
+		if err != nil {
+			t.Fatal(err)
+		} else if report.Error != "" {
+			t.Fatal(report.Error)
+		} else if !report.Lost() {
+			t.Errorf("data loss is not reported")
+		} else if len(report.Damages) != 1 || report.Damages[0].Salvaged != 5 || report.Damages[0].Lost != 5 {
+			t.Errorf("damages : %+v", report.Damages)
+		} else if report.SnapshotRecords != 5 || report.Transactions != 4 || report.Discarded != 1 || report.Written != 9 {
+			t.Errorf("report : %+v", report)
+		}
+		assertRepaired(t, opts, out, []string{"key0", "key1", "key2", "key3", "key4", "new0", "new1", "new3", "new4"})
+
+		after := snapshotFiles(t)
+		for path, buf := range before {
+			if !bytes.Equal(buf, after[path]) {
+				t.Errorf("%v is modified", path)
+			}
+		}
+		if _, err = Repair(opts, out); err == nil || !strings.Contains(err.Error(), "is not empty") {
+			t.Errorf("repair into the repaired directory : %v", err)
+		}
+	})
+
+	t.Run("partitions", func(t *testing.T) {
+		_ = os.RemoveAll(out)
+		opts := createCrashedStorage(t, Options{Partitions: 3})
+		if err := ioutil.WriteFile(testDBPath+".1", []byte("broken"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		report, err := Repair(opts, out)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(report.Damages) != 1 || report.Damages[0].Source != testDBPath+".1" || report.Damages[0].Lost != -1 {
+			t.Errorf("damages : %+v", report.Damages)
+		} else if report.SnapshotRecords == 0 || report.SnapshotRecords == 10 || report.Written != report.SnapshotRecords+5 {
+			t.Errorf("report : %+v", report)
+		}
+	})
+
+	t.Run("btree", func(t *testing.T) {
+		_ = os.RemoveAll(out)
+		opts := createCrashedStorage(t, Options{Backend: "btree"})
+		storage, err := OpenReadOnly(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = Repair(opts, out); err != nil {
+			t.Errorf("repair while read only storage is open : %v", err)
+		}
+		storage.Close()
+		_ = os.RemoveAll(out)
+
+		report, err := Repair(opts, out)
+		if err != nil {
+			t.Fatal(err)
+		} else if report.Error != "" || report.Lost() || report.Written != 15 {
+			t.Errorf("report : %+v", report)
+		}
+		keys := []string{"new0", "new1", "new2", "new3", "new4"}
+		for i := 0; i < 10; i++ {
+			keys = append(keys, fmt.Sprintf("key%d", i))
+		}
+		assertRepaired(t, opts, out, keys)
+
+		storage = openCloseTestStorage(t)
+		defer storage.Close()
+		if _, err = Repair(opts, filepath.Join(out, "other")); err != ErrLocked {
+			t.Errorf("repair the running storage : %v", err)
+		}
+	})
+}
+
+func TestRunRepairCommand(t *testing.T) {
+	out := filepath.Join(os.TempDir(), "txngo-repaired")
+	_ = os.RemoveAll(out)
+	defer os.RemoveAll(out)
+	opts := createCrashedStorage(t, Options{Backend: "btree"})
+	var stdout, stderr bytes.Buffer
+	if status := runRepairCommand(opts, []string{"-out", out}, &stdout, &stderr); status != exitOK {
+		t.Fatalf("status : %v (%s)", status, stderr.String())
+	} else if !strings.Contains(stdout.String(), "5 committed, 5 records") || !strings.Contains(stdout.String(), "repaired without data loss\n") {
+		t.Errorf("output :\n%s", stdout.String())
+	}
+
+	_ = os.RemoveAll(out)
+	if err := os.Truncate(testDBPath, 100); err != nil {
+		t.Fatal(err)
+	}
+	stdout.Reset()
+	if status := runRepairCommand(opts, []string{"-out", out, "-json"}, &stdout, &stderr); status != exitFailure {
+		t.Errorf("status of broken data file : %v", status)
+	}
+	var report RepairReport
+	if err := json.Unmarshal(stdout.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	} else if len(report.Damages) != 1 || report.Transactions != 5 || report.Written != 5 {
+		t.Errorf("report : %+v", report)
+	}
+
+	for _, args := range [][]string{{}, {"-unknown"}, {"-out", out, "arg"}} {
+		if status := runRepairCommand(opts, args, &stdout, &stderr); status != exitUsage {
+			t.Errorf("status of %v : %v", args, status)
+		}
+	}
+}
@@ -0,0 +1,979 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrReplica = errors.New("replica does not accept writes until promoted")
+	ErrFenced  = errors.New("primary is fenced by the promoted replica")
+	errIdle    = errors.New("no logs are written")
+)
+
+// messages of replication stream from the primary
+const (
+	// replLog is followed by the serialized RecordLog in the same format as WAL.
+	replLog = 'L'
+	// replSnapshot is followed by [8 version][4 count] and count serialized Records. It replaces
+	// all records of the replica which is behind the retained WAL or in the older epoch.
+	replSnapshot = 'S'
+	// replHeartbeat is sent when no logs are written so that the replica knows the primary is alive.
+	replHeartbeat = 'H'
+)
+
+const defaultReplHeartbeat = time.Second
+
+// ReplicationOptions is the options of the primary.
+type ReplicationOptions struct {
+	// Dir is the directory of WAL segments retained for replicas.
+	Dir string
+	// RetainBytes is the max total size of retained segments. Segments are dropped even if some
+	// replicas have not received them, and such replicas receive the snapshot. 0 is unlimited.
+	RetainBytes int64
+	// HeartbeatInterval is the interval of heartbeats while no logs are written. 0 is 1 second.
+	HeartbeatInterval time.Duration
+}
+
+// ReplicaOptions is the options of the replica.
+type ReplicaOptions struct {
+	// FailoverTimeout promotes the replica automatically when it receives nothing from the
+	// primary for the duration. It must be longer than HeartbeatInterval of the primary, and
+	// should be enabled in only one replica. 0 disables automatic failover.
+	FailoverTimeout time.Duration
+	// FenceInterval is the interval to fence the old primary after promoted. 0 is 1 second.
+	FenceInterval time.Duration
+}
+
+// ReplicaStatus is the status of the replica tracked by the primary.
+type ReplicaStatus struct {
+	ID        string
+	Connected bool
+	// Acked is the last commit version applied by the replica.
+	Acked uint64
+	// Lag is the number of commit versions the replica is behind.
+	Lag uint64
+}
+
+type walSegment struct {
+	gen  uint64
+	path string
+	size int64
+	// last is the last commit version in the segment.
+	last uint64
+}
+
+// replication retains WAL cleared by checkpoint as segments, and tracks replicas.
+// The commit version is used as LSN, which is assigned in the order of commits.
+type replication struct {
+	opts    ReplicationOptions
+	walPath string
+	log     Logger
+
+	mu sync.RWMutex
+	// gen is the generation of current WAL. it is archived into the segment of gen by ClearWAL.
+	gen      uint64
+	segments []walSegment
+	// base is the last version which is not retained. replicas behind it need the snapshot.
+	base     uint64
+	replicas map[string]*ReplicaStatus
+	// followers is the followers of WAL by FollowWAL, which retain segments like replicas.
+	followers map[*WALFollower]struct{}
+	// durable is the last commit version written and synced into WAL.
+	durable uint64
+	// changed is closed and replaced when WAL is written or archived.
+	changed chan struct{}
+	// fenced is the epoch of the promoted replica which fenced this primary. 0 if not fenced.
+	fenced uint64
+	// ring decrypts values of logs read from WAL and segments. nil if encryption is disabled.
+	ring *keyring
+}
+
+// EnableReplication retains WAL for replicas served by HandleReplication. Retained segments of
+// previous run are removed because WAL is cleared without being archived at startup.
+func (s *Storage) EnableReplication(opts ReplicationOptions) error {
+	if s.opts.DisableWAL {
+		return errors.New("replication requires WAL")
+	}
+	if err := os.RemoveAll(opts.Dir); err != nil {
+		return err
+	} else if err = os.MkdirAll(opts.Dir, 0700); err != nil {
+		return err
+	}
+	s.muWAL.Lock()
+	defer s.muWAL.Unlock()
+	if opts.HeartbeatInterval == 0 {
+		opts.HeartbeatInterval = defaultReplHeartbeat
+	}
+	s.repl = &replication{
+		opts:      opts,
+		walPath:   s.wal.Name(),
+		log:       s.logger(),
+		gen:       1,
+		base:      s.version,
+		replicas:  make(map[string]*ReplicaStatus),
+		followers: make(map[*WALFollower]struct{}),
+		durable:   s.version,
+		changed:   make(chan struct{}),
+		ring:      s.keyring,
+	}
+	return nil
+}
+
+// Replicas returns the status of replicas in order of ids.
+func (s *Storage) Replicas() []ReplicaStatus {
+	if s.repl == nil {
+		return nil
+	}
+	s.muWAL.Lock()
+	version := s.version
+	s.muWAL.Unlock()
+	s.repl.mu.RLock()
+	defer s.repl.mu.RUnlock()
+	var replicas []ReplicaStatus
+	for _, r := range s.repl.replicas {
+		status := *r
+		if status.Acked < version {
+			status.Lag = version - status.Acked
+		}
+		replicas = append(replicas, status)
+	}
+	sort.Slice(replicas, func(i, j int) bool { return replicas[i].ID < replicas[j].ID })
+	return replicas
+}
+
+// writable returns ErrReplica if this is the replica, ErrFenced if this is the old primary,
+// ErrCorrupted if logs in WAL are not applied, or ErrDiskFull while the disk is full.
+func (s *Storage) writable() error {
+	if s.opts.readOnly {
+		return ErrReadOnly
+	} else if err := s.corrupted.Load(); err != nil {
+		return *err
+	} else if err := s.checkDiskFull(); err != nil {
+		return err
+	} else if s.replica != nil && s.replica.readOnly() {
+		return ErrReplica
+	} else if s.repl != nil {
+		s.repl.mu.RLock()
+		fenced := s.repl.fenced
+		s.repl.mu.RUnlock()
+		if fenced > 0 {
+			return fmt.Errorf("%w of epoch %d", ErrFenced, fenced)
+		}
+	}
+	return nil
+}
+
+// writeEpoch writes the epoch as the header of WAL. muWAL must be locked.
+func (s *Storage) writeEpoch() error {
+	if s.epoch == 0 {
+		return nil
+	}
+	return s.writeWAL(nil, RecordLog{Action: LEpoch, Record: Record{Version: s.epoch}})
+}
+
+// epochPath returns the file which the epoch is kept in while WAL is cleared.
+func (s *Storage) epochPath() string {
+	return s.wal.Name() + ".epoch"
+}
+
+// keepEpoch writes the epoch into the file of epochPath atomically before WAL is cleared, so
+// that the crash before writeEpoch writes it into WAL again does not roll back the epoch
+// which fences the old primary. muWAL must be locked.
+func (s *Storage) keepEpoch() error {
+	if s.epoch == 0 || s.opts.DisableWAL {
+		return nil
+	}
+	// epoch(8) | crc32(4)
+	var buf [12]byte
+	binary.BigEndian.PutUint64(buf[:8], s.epoch)
+	binary.BigEndian.PutUint32(buf[8:], crc32.ChecksumIEEE(buf[:8]))
+	path := s.epochPath()
+	return writeFileAtomic(s.opts.fs(), path, s.opts.tmpPath(path), buf[:])
+}
+
+// loadEpoch reads the epoch kept by keepEpoch, which is overwritten by the epoch in WAL.
+func (s *Storage) loadEpoch() error {
+	if s.opts.DisableWAL {
+		return nil
+	}
+	buf, err := readFile(s.opts.fs(), s.epochPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	} else if len(buf) != 12 || binary.BigEndian.Uint32(buf[8:]) != crc32.ChecksumIEEE(buf[:8]) {
+		return fmt.Errorf("epoch file is broken")
+	}
+	s.epoch = binary.BigEndian.Uint64(buf[:8])
+	return nil
+}
+
+// setEpoch changes the epoch to the epoch of the primary, or increments the epoch if 0 is
+// given when the replica is promoted. It returns the new epoch.
+func (s *Storage) setEpoch(epoch uint64) (uint64, error) {
+	s.muWAL.Lock()
+	defer s.muWAL.Unlock()
+	if epoch == 0 {
+		epoch = s.epoch + 1
+	} else if epoch == s.epoch {
+		return epoch, nil
+	}
+	s.epoch = epoch
+	return epoch, s.writeEpoch()
+}
+
+func (s *Storage) currentEpoch() uint64 {
+	s.muWAL.Lock()
+	defer s.muWAL.Unlock()
+	return s.epoch
+}
+
+// fence fences this primary in the current epoch if epoch of the promoted replica is newer, and
+// returns whether this primary is fenced.
+func (r *replication) fence(current, epoch uint64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if epoch > current && epoch > r.fenced {
+		if r.fenced == 0 {
+			r.log.Warn("primary is fenced by the promoted replica", "epoch", epoch)
+		}
+		r.fenced = epoch
+	}
+	return r.fenced > 0
+}
+
+// notify wakes up streams waiting for new logs, which are durable until the version.
+func (r *replication) notify(version uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if version > r.durable {
+		r.durable = version
+	}
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// archive copies WAL into the segment and truncates WAL, and drops segments which are not
+// needed. WAL is truncated in the lock so that cursors do not read WAL of another generation.
+// muWAL must be locked.
+func (r *replication) archive(wal File, version uint64, truncate func() error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	seg := walSegment{gen: r.gen, path: filepath.Join(r.opts.Dir, fmt.Sprintf("%016x.wal", r.gen)), last: version}
+	f, err := os.OpenFile(seg.path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := wal.Stat()
+	if err == nil {
+		seg.size, err = io.Copy(f, io.NewSectionReader(wal, 0, info.Size()))
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = truncate()
+	}
+	if err != nil {
+		os.Remove(seg.path)
+		return err
+	}
+	r.segments = append(r.segments, seg)
+	r.gen++
+	close(r.changed)
+	r.changed = make(chan struct{})
+
+	// drop segments received by all replicas and followers, or exceeding the retention size
+	acked := version
+	for _, replica := range r.replicas {
+		if replica.Acked < acked {
+			acked = replica.Acked
+		}
+	}
+	for f := range r.followers {
+		if f.version < acked {
+			acked = f.version
+		}
+	}
+	var total int64
+	for _, seg := range r.segments {
+		total += seg.size
+	}
+	for len(r.segments) > 0 {
+		seg := r.segments[0]
+		if seg.last > acked && (r.opts.RetainBytes == 0 || total <= r.opts.RetainBytes) {
+			break
+		}
+		if err := os.Remove(seg.path); err != nil {
+			return err
+		}
+		total -= seg.size
+		r.base = seg.last
+		r.segments = r.segments[1:]
+	}
+	return nil
+}
+
+func (r *replication) ack(id string, version uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if replica, ok := r.replicas[id]; ok && version > replica.Acked {
+		replica.Acked = version
+	}
+}
+
+// walCursor reads logs from retained segments and current WAL in order. Segments are byte
+// copies of WAL, so that the cursor continues at the same offset after WAL is archived.
+type walCursor struct {
+	r      *replication
+	gen    uint64
+	f      *os.File
+	live   bool
+	buf    []byte
+	head   int
+	size   int
+	offset int64
+}
+
+// open opens the segment of gen, or current WAL if gen is not archived yet. r.mu must be locked.
+func (c *walCursor) open(gen uint64, offset int64) error {
+	path := c.r.walPath
+	c.live = true
+	if gen < c.r.gen {
+		i := sort.Search(len(c.r.segments), func(i int) bool { return c.r.segments[i].gen >= gen })
+		if i == len(c.r.segments) || c.r.segments[i].gen != gen {
+			return fmt.Errorf("segment %v is already dropped", gen)
+		}
+		path, c.live = c.r.segments[i].path, false
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	if c.f != nil {
+		c.f.Close()
+	}
+	c.f, c.gen, c.offset = f, gen, offset
+	return nil
+}
+
+func (c *walCursor) Close() error {
+	return c.f.Close()
+}
+
+// next returns the next log. it waits for new logs until done is closed, and returns errIdle if
+// no logs are written in idle.
+func (c *walCursor) next(done <-chan struct{}, idle time.Duration) (RecordLog, error) {
+	timer := time.NewTimer(idle)
+	defer timer.Stop()
+	for {
+		var rlog RecordLog
+		n, err := rlog.Deserialize(c.buf[c.head:c.size])
+		if err == nil {
+			c.head += n
+			return rlog, c.r.ring.openLog(&rlog)
+		} else if err != ErrBufferShort {
+			return rlog, err
+		}
+		copy(c.buf, c.buf[c.head:c.size])
+		c.size -= c.head
+		c.head = 0
+		if c.size == len(c.buf) {
+			// the log is larger than the whole buffer. grow the buffer to read the rest of it.
+			c.buf = append(c.buf, make([]byte, max(len(c.buf), walBufferSize))...)
+		}
+
+		c.r.mu.RLock()
+		changed := c.r.changed
+		if c.live && c.gen < c.r.gen {
+			// current WAL is archived and truncated. continue with the segment.
+			err = c.open(c.gen, c.offset)
+			c.r.mu.RUnlock()
+			if err != nil {
+				return rlog, err
+			}
+			continue
+		}
+		// read under the lock not to read WAL truncated by archive
+		n, err = c.f.Read(c.buf[c.size:])
+		c.size += n
+		c.offset += int64(n)
+		if err == io.EOF && !c.live {
+			// the segment is completed. continue with the next generation.
+			err = c.open(c.gen+1, 0)
+			c.r.mu.RUnlock()
+			if err != nil {
+				return rlog, err
+			}
+			continue
+		}
+		c.r.mu.RUnlock()
+		if n > 0 {
+			continue
+		} else if err != nil && err != io.EOF {
+			return rlog, err
+		}
+		select {
+		case <-changed:
+		case <-done:
+			return rlog, io.EOF
+		case <-timer.C:
+			return rlog, errIdle
+		}
+	}
+}
+
+// HandleReplication streams committed logs to the replica connected by StartReplica.
+// The replica sends "replicate <id> <version> <epoch>" and acks applied versions by
+// "ack <version>". The promoted replica sends "fence <epoch>" to reject commits of this primary.
+func HandleReplication(conn net.Conn, storage *Storage, wg *sync.WaitGroup) error {
+	defer wg.Done()
+	defer conn.Close()
+	r := storage.repl
+	if r == nil {
+		fmt.Fprintf(conn, "replication is not enabled\n")
+		return errors.New("replication is not enabled")
+	}
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	cmd := strings.Fields(line)
+	if len(cmd) == 2 && cmd[0] == "fence" {
+		epoch, err := strconv.ParseUint(cmd[1], 10, 64)
+		if err != nil {
+			fmt.Fprintf(conn, "invalid epoch : %v\n", err)
+			return err
+		}
+		current := storage.currentEpoch()
+		if !r.fence(current, epoch) {
+			fmt.Fprintf(conn, "epoch %d is not newer than %d\n", epoch, current)
+			return nil
+		}
+		_, err = fmt.Fprintf(conn, "fenced\n")
+		return err
+	} else if len(cmd) != 4 || cmd[0] != "replicate" {
+		fmt.Fprintf(conn, "invalid command : replicate <id> <version> <epoch>\n")
+		return fmt.Errorf("invalid replication command %q", line)
+	}
+	id := cmd[1]
+	from, err := strconv.ParseUint(cmd[2], 10, 64)
+	if err != nil {
+		fmt.Fprintf(conn, "invalid version : %v\n", err)
+		return err
+	}
+	replicaEpoch, err := strconv.ParseUint(cmd[3], 10, 64)
+	if err != nil {
+		fmt.Fprintf(conn, "invalid epoch : %v\n", err)
+		return err
+	}
+	// the replica in the newer epoch knows the promoted replica. the history of the fenced
+	// primary must not be replicated.
+	epoch := storage.currentEpoch()
+	if r.fence(epoch, replicaEpoch) {
+		fmt.Fprintf(conn, "primary is fenced\n")
+		return ErrFenced
+	}
+
+	r.mu.Lock()
+	if _, ok := r.replicas[id]; !ok {
+		r.replicas[id] = &ReplicaStatus{ID: id}
+	}
+	status := r.replicas[id]
+	if status.Connected {
+		r.mu.Unlock()
+		fmt.Fprintf(conn, "replica %q is already connected\n", id)
+		return fmt.Errorf("replica %q is already connected", id)
+	}
+	status.Connected, status.Acked = true, from
+	base := r.base
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		status.Connected = false
+		r.mu.Unlock()
+	}()
+	fmt.Fprintf(conn, "streaming %d\n", epoch)
+
+	// receive acks until the replica disconnects
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			var version uint64
+			if _, err = fmt.Sscanf(line, "ack %d\n", &version); err == nil {
+				r.ack(id, version)
+			}
+		}
+	}()
+
+	w := bufio.NewWriter(conn)
+	// the cursor must start before the snapshot not to miss logs committed after it
+	r.mu.Lock()
+	cursor := &walCursor{r: r}
+	if len(r.segments) > 0 {
+		err = cursor.open(r.segments[0].gen, 0)
+	} else {
+		err = cursor.open(r.gen, 0)
+	}
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+
+	// the replica in the older epoch may have logs which are not committed in this epoch
+	if from < base || replicaEpoch < epoch {
+		records, version, err := storage.snapshotRecords()
+		if err != nil {
+			return err
+		} else if err = w.WriteByte(replSnapshot); err != nil {
+			return err
+		} else if err = writeSnapshot(w, records, version); err != nil {
+			return err
+		} else if err = w.Flush(); err != nil {
+			return err
+		}
+		from = version
+	}
+
+	var (
+		buf     = make([]byte, walBufferSize)
+		pending []RecordLog
+	)
+	send := func(logs ...RecordLog) error {
+		for _, rlog := range logs {
+			if size := 1 + rlog.size(); len(buf) < size {
+				buf = make([]byte, size)
+			}
+			buf[0] = replLog
+			n, err := rlog.Serialize(buf[1:])
+			if err != nil {
+				return err
+			} else if _, err = w.Write(buf[:1+n]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for {
+		rlog, err := cursor.next(done, r.opts.HeartbeatInterval)
+		if err == errIdle {
+			if err = w.WriteByte(replHeartbeat); err != nil {
+				return err
+			} else if err = w.Flush(); err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+		switch rlog.Action {
+		case LInsert, LUpdate, LDelete:
+			pending = append(pending, rlog)
+			continue
+		case LCommit:
+			// skip logs already applied by the replica
+			if len(pending) > 0 && pending[0].Version > from {
+				err = send(append(pending, rlog)...)
+			}
+		case LPrepare:
+			// prepared logs do not have the version until the decision
+			err = send(append(pending, rlog)...)
+		case LCommitPrepared:
+			if rlog.Version > from {
+				err = send(rlog)
+			}
+		case LAbortPrepared:
+			err = send(rlog)
+		}
+		clear(pending)
+		pending = pending[:0]
+		if err != nil {
+			return err
+		}
+		if cursor.head == cursor.size {
+			// flush when logs are caught up
+			if err = w.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// writeSnapshot writes [8 version][4 count] and count serialized Records.
+func writeSnapshot(w io.Writer, records []Record, version uint64) error {
+	var head [12]byte
+	binary.BigEndian.PutUint64(head[:], version)
+	binary.BigEndian.PutUint32(head[8:], uint32(len(records)))
+	if _, err := w.Write(head[:]); err != nil {
+		return err
+	}
+	var buf []byte
+	for _, r := range records {
+		if size := 13 + len(r.Key) + len(r.Value); cap(buf) < size {
+			buf = make([]byte, size)
+		}
+		n, err := r.Serialize(buf[:cap(buf)])
+		if err != nil {
+			return err
+		} else if _, err = w.Write(buf[:n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Replica pulls committed logs from the primary and applies them continuously.
+// Commits of Storage fail with ErrReplica until promoted. The promoted replica starts the new
+// epoch and keeps fencing the old primary, so that the old primary rejects commits even if it
+// comes back after failover.
+type Replica struct {
+	s    *Storage
+	id   string
+	dial func() (net.Conn, error)
+	opts ReplicaOptions
+
+	mu        sync.Mutex
+	conn      net.Conn
+	stopped   bool
+	requested bool
+	promoted  bool
+	err       error
+	stop      chan struct{}
+	// promote is closed by Promote to stop replication and promote the replica.
+	promote chan struct{}
+	// promoteDone is closed when the replica is promoted or failed to promote.
+	promoteDone chan struct{}
+	exited      chan struct{}
+	wg          sync.WaitGroup
+}
+
+// StartReplica starts replicating from the primary connected by dial. id identifies the
+// replica in the primary to track its lag. dial is also used to fence the old primary.
+func StartReplica(s *Storage, id string, dial func() (net.Conn, error), opts ReplicaOptions) *Replica {
+	if opts.FenceInterval == 0 {
+		opts.FenceInterval = time.Second
+	}
+	r := &Replica{
+		s:           s,
+		id:          id,
+		dial:        dial,
+		opts:        opts,
+		stop:        make(chan struct{}),
+		promote:     make(chan struct{}),
+		promoteDone: make(chan struct{}),
+		exited:      make(chan struct{}),
+	}
+	s.replica = r
+	r.wg.Add(1)
+	go r.run()
+	return r
+}
+
+// readOnly returns true if the replica is not promoted.
+func (r *Replica) readOnly() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return !r.promoted
+}
+
+// Promote stops replication and accepts writes in the new epoch. Logs not received yet are lost.
+func (r *Replica) Promote() error {
+	r.mu.Lock()
+	if !r.stopped && !r.requested {
+		r.requested = true
+		close(r.promote)
+		if r.conn != nil {
+			r.conn.Close()
+		}
+	}
+	r.mu.Unlock()
+	select {
+	case <-r.promoteDone:
+	case <-r.exited:
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return r.err
+	} else if !r.promoted {
+		return errors.New("replica is already stopped")
+	}
+	return nil
+}
+
+// Stop stops replication, or fencing the old primary if promoted. Writes are still rejected
+// unless promoted.
+func (r *Replica) Stop() {
+	r.mu.Lock()
+	if !r.stopped {
+		r.stopped = true
+		close(r.stop)
+		if r.conn != nil {
+			r.conn.Close()
+		}
+	}
+	r.mu.Unlock()
+	r.wg.Wait()
+}
+
+func (r *Replica) run() {
+	defer r.wg.Done()
+	defer close(r.exited)
+	backoff := 100 * time.Millisecond
+	// contact is the last time when the primary responded
+	contact := time.Now()
+	for {
+		err := r.replicate(&contact)
+		select {
+		case <-r.stop:
+			return
+		case <-r.promote:
+			r.failover()
+			return
+		default:
+		}
+		if r.opts.FailoverTimeout > 0 && time.Since(contact) >= r.opts.FailoverTimeout {
+			r.s.logger().Warn("primary is unreachable", "timeout", r.opts.FailoverTimeout, "err", err)
+			r.failover()
+			return
+		}
+		r.s.logger().Warn("replication is disconnected", "err", err)
+		wait := backoff
+		if r.opts.FailoverTimeout > 0 && wait > time.Until(contact.Add(r.opts.FailoverTimeout)) {
+			wait = time.Until(contact.Add(r.opts.FailoverTimeout))
+		}
+		select {
+		case <-r.stop:
+			return
+		case <-r.promote:
+			r.failover()
+			return
+		case <-time.After(wait):
+		}
+		if backoff < 5*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// failover promotes the replica in the new epoch, and fences the old primary until stopped.
+func (r *Replica) failover() {
+	epoch, err := r.s.setEpoch(0)
+	r.mu.Lock()
+	r.promoted, r.err = err == nil, err
+	r.mu.Unlock()
+	close(r.promoteDone)
+	if err != nil {
+		r.s.logger().Error("failed to promote replica", "err", err)
+		return
+	}
+	r.s.logger().Info("replica is promoted", "epoch", epoch)
+
+	fenced := false
+	for {
+		err := r.fence(epoch)
+		if (err == nil) != fenced {
+			fenced = err == nil
+			if fenced {
+				r.s.logger().Info("old primary is fenced")
+			} else {
+				r.s.logger().Error("failed to fence old primary", "err", err)
+			}
+		}
+		select {
+		case <-r.stop:
+			return
+		case <-time.After(r.opts.FenceInterval):
+		}
+	}
+}
+
+// fence asks the old primary to reject commits in the epoch older than epoch.
+func (r *Replica) fence(epoch uint64) error {
+	conn, err := r.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err = conn.SetDeadline(time.Now().Add(r.opts.FenceInterval)); err != nil {
+		return err
+	} else if _, err = fmt.Fprintf(conn, "fence %d\n", epoch); err != nil {
+		return err
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return err
+	} else if line != "fenced\n" {
+		return fmt.Errorf("primary refused : %v", strings.TrimSpace(line))
+	}
+	return nil
+}
+
+// replicate streams logs from the primary and updates contact when the primary responds.
+func (r *Replica) replicate(contact *time.Time) error {
+	conn, err := r.dial()
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	if r.stopped || r.requested {
+		r.mu.Unlock()
+		conn.Close()
+		return nil
+	}
+	r.conn = conn
+	r.mu.Unlock()
+	defer conn.Close()
+
+	r.s.muWAL.Lock()
+	version, epoch := r.s.version, r.s.epoch
+	r.s.muWAL.Unlock()
+	// the primary not responding within the timeout is regarded as dead
+	deadline := func() error {
+		if r.opts.FailoverTimeout == 0 {
+			return nil
+		}
+		return conn.SetReadDeadline(time.Now().Add(r.opts.FailoverTimeout))
+	}
+	if err = deadline(); err != nil {
+		return err
+	} else if _, err = fmt.Fprintf(conn, "replicate %s %d %d\n", r.id, version, epoch); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	*contact = time.Now()
+	var primaryEpoch uint64
+	if _, err = fmt.Sscanf(line, "streaming %d\n", &primaryEpoch); err != nil {
+		return fmt.Errorf("primary refused : %v", strings.TrimSpace(line))
+	}
+
+	var (
+		pending  []RecordLog
+		prepared = make(map[string][]RecordLog)
+	)
+	apply := func(version uint64, logs []RecordLog) error {
+		if err := r.s.applyEntry(version, logs); err != nil {
+			return err
+		}
+		_, err := fmt.Fprintf(conn, "ack %d\n", version)
+		return err
+	}
+	for {
+		if err = deadline(); err != nil {
+			return err
+		}
+		kind, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		*contact = time.Now()
+		if kind == replHeartbeat {
+			continue
+		} else if kind == replSnapshot {
+			if err = r.readSnapshot(reader); err != nil {
+				return err
+			}
+			// the snapshot is sent first if the epoch is different
+			if _, err = r.s.setEpoch(primaryEpoch); err != nil {
+				return err
+			}
+			continue
+		} else if kind != replLog {
+			return fmt.Errorf("unknown replication message %q", kind)
+		}
+		rlog, err := readRecordLog(reader)
+		if err != nil {
+			return err
+		}
+		switch rlog.Action {
+		case LInsert, LUpdate, LDelete:
+			pending = append(pending, rlog)
+			continue
+		case LCommit:
+			if len(pending) > 0 {
+				err = apply(pending[0].Version, pending)
+			}
+		case LPrepare:
+			prepared[rlog.Key] = pending
+		case LCommitPrepared:
+			if logs, ok := prepared[rlog.Key]; ok {
+				delete(prepared, rlog.Key)
+				err = apply(rlog.Version, logs)
+			}
+		case LAbortPrepared:
+			delete(prepared, rlog.Key)
+		}
+		pending = nil
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readRecordLog reads one serialized RecordLog. the size is known from the header of record.
+func readRecordLog(r io.Reader) (RecordLog, error) {
+	var (
+		rlog RecordLog
+		head [14]byte
+	)
+	if _, err := io.ReadFull(r, head[:1]); err != nil {
+		return rlog, err
+	}
+	n, size := 1, int64(5)
+	if head[0] != LCommit && head[0] != LAbort {
+		if _, err := io.ReadFull(r, head[1:]); err != nil {
+			return rlog, err
+		}
+		n, size = len(head), int64(len(head))+int64(head[1])+int64(binary.BigEndian.Uint32(head[2:]))+4
+	}
+	buf, err := readSized(r, head[:n], size)
+	if err != nil {
+		return rlog, err
+	}
+	_, err = rlog.Deserialize(buf)
+	return rlog, err
+}
+
+func (r *Replica) readSnapshot(reader *bufio.Reader) error {
+	var head [12]byte
+	if _, err := io.ReadFull(reader, head[:]); err != nil {
+		return err
+	}
+	version := binary.BigEndian.Uint64(head[:])
+	records, err := readRecords(reader, binary.BigEndian.Uint32(head[8:]))
+	if err != nil {
+		return err
+	}
+	return r.s.restoreSnapshot(records, version)
+}
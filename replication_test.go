@@ -0,0 +1,225 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// replicationServer serves HandleReplication of the storage until killed.
+type replicationServer struct {
+	l     net.Listener
+	mu    sync.Mutex
+	conns []net.Conn
+	wg    sync.WaitGroup
+}
+
+func serveReplication(t *testing.T, s *Storage, addr string) *replicationServer {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &replicationServer{l: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			srv.mu.Lock()
+			srv.conns = append(srv.conns, conn)
+			srv.mu.Unlock()
+			srv.wg.Add(1)
+			go HandleReplication(conn, s, &srv.wg)
+		}
+	}()
+	return srv
+}
+
+func (srv *replicationServer) dial() (net.Conn, error) {
+	return net.Dial("tcp", srv.l.Addr().String())
+}
+
+// kill closes the listener and all connections as if the server is down.
+func (srv *replicationServer) kill() {
+	srv.l.Close()
+	srv.mu.Lock()
+	for _, conn := range srv.conns {
+		conn.Close()
+	}
+	srv.mu.Unlock()
+	srv.wg.Wait()
+}
+
+func createTestReplica(t *testing.T, name string) *Storage {
+	wal, err := os.OpenFile(filepath.Join(tmpdir, name+".wal"), os.O_CREATE|os.O_APPEND|os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { wal.Close() })
+	return NewStorage(wal, filepath.Join(tmpdir, name+".db"), filepath.Join(tmpdir, name+".db.tmp"))
+}
+
+func storageHasValue(s *Storage, key, value string) func() bool {
+	return func() bool {
+		v, err := s.Get(key)
+		return err == nil && string(v) == value
+	}
+}
+
+func TestReplication(t *testing.T) {
+	primary := createTestStorage(t)
+	defer primary.wal.Close()
+	if err := primary.EnableReplication(ReplicationOptions{Dir: filepath.Join(tmpdir, "replication")}); err != nil {
+		t.Fatal(err)
+	}
+	srv := serveReplication(t, primary, "127.0.0.1:0")
+	defer srv.kill()
+	dial := srv.dial
+	var err error
+
+	// the replica pulls logs from the retained segment and current WAL
+	if err = primary.Put("key1", []byte("value1")); err != nil {
+		t.Fatal(err)
+	} else if err = primary.Checkpoint(); err != nil {
+		t.Fatal(err)
+	} else if err = primary.Put("key2", []byte("value2")); err != nil {
+		t.Fatal(err)
+	}
+	replica1 := createTestReplica(t, "replica1")
+	r1 := StartReplica(replica1, "r1", dial, ReplicaOptions{})
+	defer r1.Stop()
+	waitRaft(t, "replicate retained logs", storageHasValue(replica1, "key2", "value2"))
+	if err = replica1.Put("key3", []byte("value3")); err != ErrReplica {
+		t.Errorf("commit in replica : %v", err)
+	}
+
+	// logs are streamed continuously, including prepared transactions
+	txn := primary.NewTxn()
+	if err = txn.Insert("key3", []byte("value3")); err != nil {
+		t.Fatal(err)
+	} else if err = txn.Prepare("g1"); err != nil {
+		t.Fatal(err)
+	} else if err = primary.Checkpoint(); err != nil {
+		t.Fatal(err)
+	} else if err = primary.CommitPrepared("g1"); err != nil {
+		t.Fatal(err)
+	} else if err = primary.Put("key1", []byte("value4")); err != nil {
+		t.Fatal(err)
+	}
+	waitRaft(t, "replicate new logs", storageHasValue(replica1, "key1", "value4"))
+	waitRaft(t, "replicate prepared transaction", storageHasValue(replica1, "key3", "value3"))
+
+	// logs larger than the buffer of the cursor are streamed
+	large := strings.Repeat("v", 1<<20)
+	if err = primary.Put("large", []byte(large)); err != nil {
+		t.Fatal(err)
+	}
+	waitRaft(t, "replicate large value", storageHasValue(replica1, "large", large))
+	waitRaft(t, "replica catches up", func() bool {
+		replicas := primary.Replicas()
+		return len(replicas) == 1 && replicas[0].ID == "r1" && replicas[0].Connected && replicas[0].Lag == 0
+	})
+
+	// the replica behind dropped segments receives the snapshot
+	primary.repl.mu.Lock()
+	primary.repl.opts.RetainBytes = 1
+	primary.repl.mu.Unlock()
+	if err = primary.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	replica2 := createTestReplica(t, "replica2")
+	r2 := StartReplica(replica2, "r2", dial, ReplicaOptions{})
+	defer r2.Stop()
+	waitRaft(t, "replicate snapshot", storageHasValue(replica2, "key3", "value3"))
+	if err = primary.Put("key4", []byte("value5")); err != nil {
+		t.Fatal(err)
+	}
+	waitRaft(t, "replicate after snapshot", storageHasValue(replica2, "key4", "value5"))
+	if v, err := replica2.Get("key1"); err != nil || string(v) != "value4" {
+		t.Errorf("value in snapshot : %q %v", v, err)
+	}
+
+	// the promoted replica accepts writes
+	if err = r1.Promote(); err != nil {
+		t.Fatal(err)
+	}
+	if err = replica1.Put("key5", []byte("value6")); err != nil {
+		t.Errorf("failed to commit in promoted replica : %v", err)
+	}
+}
+
+func TestReplication_Failover(t *testing.T) {
+	primary := createTestStorage(t)
+	defer primary.wal.Close()
+	err := primary.EnableReplication(ReplicationOptions{Dir: filepath.Join(tmpdir, "replication"), HeartbeatInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := serveReplication(t, primary, "127.0.0.1:0")
+	addr := srv.l.Addr().String()
+	dial := func() (net.Conn, error) {
+		return net.Dial("tcp", addr)
+	}
+
+	// the promoted replica is also the primary of other replicas
+	replica1 := createTestReplica(t, "replica1")
+	if err = replica1.EnableReplication(ReplicationOptions{Dir: filepath.Join(tmpdir, "replication1")}); err != nil {
+		t.Fatal(err)
+	}
+	srv1 := serveReplication(t, replica1, "127.0.0.1:0")
+	defer srv1.kill()
+	r1 := StartReplica(replica1, "r1", dial, ReplicaOptions{FailoverTimeout: 200 * time.Millisecond, FenceInterval: 10 * time.Millisecond})
+	defer r1.Stop()
+	if err = primary.Put("key1", []byte("value1")); err != nil {
+		t.Fatal(err)
+	}
+	waitRaft(t, "replicate logs", storageHasValue(replica1, "key1", "value1"))
+
+	// heartbeats keep the replica while no logs are written
+	time.Sleep(400 * time.Millisecond)
+	if err = replica1.Put("key2", []byte("value2")); err != ErrReplica {
+		t.Fatalf("replica is promoted while the primary is alive : %v", err)
+	}
+
+	// the replica is promoted after the primary is down
+	srv.kill()
+	waitRaft(t, "replica is promoted", func() bool { return !r1.readOnly() })
+	if err = replica1.Put("key2", []byte("value2")); err != nil {
+		t.Fatalf("failed to commit in promoted replica : %v", err)
+	}
+	if epoch := replica1.currentEpoch(); epoch != 1 {
+		t.Errorf("epoch of promoted replica : %v", epoch)
+	}
+
+	// the old primary coming back is fenced by the epoch
+	srv = serveReplication(t, primary, addr)
+	defer srv.kill()
+	waitRaft(t, "old primary is fenced", func() bool {
+		return errors.Is(primary.Put("key3", []byte("value3")), ErrFenced)
+	})
+
+	// the replica of the old epoch receives the snapshot of the new primary
+	replica2 := createTestReplica(t, "replica2")
+	r2 := StartReplica(replica2, "r2", srv1.dial, ReplicaOptions{})
+	defer r2.Stop()
+	waitRaft(t, "replicate snapshot", storageHasValue(replica2, "key2", "value2"))
+	if epoch := replica2.currentEpoch(); epoch != 1 {
+		t.Errorf("epoch of replica : %v", epoch)
+	}
+
+	// the epoch is restored from WAL
+	replica1.muWAL.Lock()
+	replica1.epoch = 0
+	replica1.muWAL.Unlock()
+	if _, err = replica1.LoadWAL(); err != nil {
+		t.Fatal(err)
+	} else if epoch := replica1.currentEpoch(); epoch != 1 {
+		t.Errorf("epoch restored from WAL : %v", epoch)
+	}
+}
@@ -0,0 +1,1135 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errRESPProtocol = errors.New("ERR Protocol error")
+
+// respMaxBatch is the max number of pipelined commands executed in one transaction.
+const respMaxBatch = 128
+
+// respWatchBuffer is the number of keyspace events buffered for the connection. the connection
+// is closed if the client does not read events and the buffer overflows.
+const respWatchBuffer = 1024
+
+// replies of RESP. nil is the null reply, []byte is the bulk string, int64 is the integer,
+// []interface{} is the array and respMap is the map which is an array of pairs in RESP2.
+// respPush is the out-of-band message which is an array in RESP2, and respReplies is the
+// sequence of replies to one command.
+type (
+	respSimple  string
+	respError   string
+	respMap     []interface{}
+	respPush    []interface{}
+	respReplies []interface{}
+)
+
+// respConn is the connection speaking RESP2 or RESP3 which is switched by HELLO.
+type respConn struct {
+	r       *bufio.Reader
+	w       *bufio.Writer
+	storage *Storage
+	proto   int
+	// queue is the commands queued after MULTI. nil if not in MULTI.
+	queue [][]string
+	// dirty is true if an invalid command is queued. EXEC fails.
+	dirty bool
+	// user is the name of authenticated user if ACL is enabled.
+	user string
+	// addr is the address of the client recorded by the audit log.
+	addr string
+	// subs is the glob of keys of each subscribed pattern of keyspace notifications.
+	subs map[string]string
+	// watcher receives events of all keys while any pattern is subscribed.
+	watcher *Watcher
+	// events receives keyspace events readable by the user from watcher.
+	events chan respEvent
+	// closed is closed when the connection is closed to stop the goroutine of watcher.
+	closed chan struct{}
+}
+
+// respEvent is the keyspace event. err is set if the watcher overflowed.
+type respEvent struct {
+	event Event
+	err   error
+}
+
+// HandleRESP serves Redis clients. Each command is executed in its own transaction,
+// and commands between MULTI and EXEC are executed in one transaction.
+func HandleRESP(r io.Reader, w io.WriteCloser, storage *Storage, wg *sync.WaitGroup) error {
+	defer wg.Done()
+	defer w.Close()
+	c := &respConn{r: bufio.NewReader(r), w: bufio.NewWriter(w), storage: storage, proto: 2, addr: remoteAddr(r),
+		subs: make(map[string]string), events: make(chan respEvent), closed: make(chan struct{})}
+	defer c.punsubscribe(nil)
+	defer close(c.closed)
+	// batch is the pipelined data commands which are not executed yet.
+	var batch [][]string
+	for {
+		args, err := c.readCommand()
+		if err != nil {
+			c.runBatch(batch)
+		}
+		if err == io.EOF {
+			c.w.Flush()
+			return nil
+		} else if err == errRESPProtocol {
+			c.write(respError(err.Error()))
+			c.w.Flush()
+			return err
+		} else if err != nil {
+			return err
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if c.batchable(args) {
+			batch = append(batch, args)
+			// parse ahead while commands are pipelined
+			if c.r.Buffered() > 0 && len(batch) < respMaxBatch {
+				continue
+			}
+			args = nil
+		}
+		c.runBatch(batch)
+		batch = batch[:0]
+		if args == nil {
+			if c.r.Buffered() == 0 {
+				if err = c.w.Flush(); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		quit := strings.ToLower(args[0]) == "quit"
+		c.write(c.handle(args))
+		// flush replies when there are no more pipelined commands
+		if c.r.Buffered() == 0 || quit {
+			if err = c.w.Flush(); err != nil {
+				return err
+			}
+		}
+		if quit {
+			return nil
+		}
+		if len(c.subs) > 0 {
+			if quit, err = c.serveSubscribed(); err != nil || quit {
+				c.w.Flush()
+				return err
+			}
+		}
+	}
+}
+
+// batchable returns true if the command can share a transaction with other pipelined commands.
+// commands in MULTI are not batched but queued.
+func (c *respConn) batchable(args []string) bool {
+	cmd := strings.ToLower(args[0])
+	switch cmd {
+	case "get", "set", "del", "exists", "mget", "mset":
+	default:
+		return false
+	}
+	arity := respArity[cmd]
+	if (arity > 0 && len(args) != arity) || (arity < 0 && len(args) < -arity) {
+		return false
+	}
+	return c.queue == nil && (c.storage.acl == nil || c.user != "")
+}
+
+// runBatch executes the pipelined commands in one transaction and writes replies in order,
+// so that they are committed by one WAL write. If the transaction fails, for example by deadlock,
+// each command is executed in its own transaction again.
+func (c *respConn) runBatch(batch [][]string) {
+	if len(batch) == 0 {
+		return
+	} else if len(batch) == 1 {
+		c.write(c.handle(batch[0]))
+		return
+	}
+	replies := make([]interface{}, 0, len(batch))
+	err := c.storage.autoCommitAs(actorOf(c.user, c.addr), func(txn *Txn) error {
+		for _, args := range batch {
+			reply, err := c.exec(txn, args)
+			if err != nil {
+				return err
+			}
+			replies = append(replies, reply)
+		}
+		return nil
+	})
+	if err != nil {
+		for _, args := range batch {
+			c.write(c.handle(args))
+		}
+		return
+	}
+	for _, reply := range replies {
+		c.write(reply)
+	}
+}
+
+// readCommand reads an array of bulk strings or an inline command.
+func (c *respConn) readCommand() ([]string, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > 1024*1024 {
+		return nil, errRESPProtocol
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		if line, err = c.readLine(); err != nil {
+			return nil, err
+		} else if !strings.HasPrefix(line, "$") {
+			return nil, errRESPProtocol
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > 512<<20 {
+			return nil, errRESPProtocol
+		}
+		buf := make([]byte, size+2)
+		if _, err = io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		} else if buf[size] != '\r' || buf[size+1] != '\n' {
+			return nil, errRESPProtocol
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+func (c *respConn) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err == io.EOF && line != "" {
+		return "", io.ErrUnexpectedEOF
+	} else if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (c *respConn) write(reply interface{}) {
+	switch v := reply.(type) {
+	case nil:
+		if c.proto == 3 {
+			c.w.WriteString("_\r\n")
+		} else {
+			c.w.WriteString("$-1\r\n")
+		}
+	case respSimple:
+		fmt.Fprintf(c.w, "+%s\r\n", v)
+	case respError:
+		fmt.Fprintf(c.w, "-%s\r\n", v)
+	case int64:
+		fmt.Fprintf(c.w, ":%d\r\n", v)
+	case []byte:
+		fmt.Fprintf(c.w, "$%d\r\n", len(v))
+		c.w.Write(v)
+		c.w.WriteString("\r\n")
+	case string:
+		c.write([]byte(v))
+	case []interface{}:
+		fmt.Fprintf(c.w, "*%d\r\n", len(v))
+		for _, r := range v {
+			c.write(r)
+		}
+	case respPush:
+		if c.proto == 3 {
+			fmt.Fprintf(c.w, ">%d\r\n", len(v))
+		} else {
+			fmt.Fprintf(c.w, "*%d\r\n", len(v))
+		}
+		for _, r := range v {
+			c.write(r)
+		}
+	case respReplies:
+		for _, r := range v {
+			c.write(r)
+		}
+	case respMap:
+		if c.proto == 3 {
+			fmt.Fprintf(c.w, "%%%d\r\n", len(v)/2)
+		} else {
+			fmt.Fprintf(c.w, "*%d\r\n", len(v))
+		}
+		for _, r := range v {
+			c.write(r)
+		}
+	}
+}
+
+// respArity is the number of arguments of commands including the command name.
+// negative arity means at least the number of arguments.
+var respArity = map[string]int{
+	"get":          2,
+	"set":          -3,
+	"del":          -2,
+	"exists":       -2,
+	"mget":         -2,
+	"mset":         -3,
+	"scan":         -2,
+	"expire":       3,
+	"pexpire":      3,
+	"ttl":          2,
+	"pttl":         2,
+	"persist":      2,
+	"multi":        1,
+	"exec":         1,
+	"discard":      1,
+	"ping":         -1,
+	"echo":         2,
+	"hello":        -1,
+	"select":       2,
+	"command":      -1,
+	"client":       -2,
+	"quit":         1,
+	"auth":         -2,
+	"acl":          -2,
+	"info":         -1,
+	"slowlog":      -2,
+	"psubscribe":   -2,
+	"punsubscribe": -1,
+}
+
+func (c *respConn) handle(args []string) interface{} {
+	cmd := strings.ToLower(args[0])
+	arity, ok := respArity[cmd]
+	if !ok {
+		c.dirty = c.dirty || c.queue != nil
+		return respError(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+	} else if (arity > 0 && len(args) != arity) || (arity < 0 && len(args) < -arity) {
+		c.dirty = c.dirty || c.queue != nil
+		return respError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", cmd))
+	}
+
+	if c.storage.acl != nil && c.user == "" && cmd != "auth" && cmd != "hello" && cmd != "quit" {
+		c.dirty = c.dirty || c.queue != nil
+		return respError("NOAUTH Authentication required.")
+	}
+
+	switch cmd {
+	case "auth":
+		return c.auth(args[1:])
+	case "acl":
+		return c.acl(args[1:])
+	case "multi":
+		if c.queue != nil {
+			return respError("ERR MULTI calls can not be nested")
+		}
+		c.queue = [][]string{}
+		return respSimple("OK")
+	case "exec":
+		if c.queue == nil {
+			return respError("ERR EXEC without MULTI")
+		}
+		queue, dirty := c.queue, c.dirty
+		c.queue, c.dirty = nil, false
+		if dirty {
+			return respError("EXECABORT Transaction discarded because of previous errors.")
+		}
+		var replies []interface{}
+		err := c.storage.autoCommitAs(actorOf(c.user, c.addr), func(txn *Txn) error {
+			for _, args := range queue {
+				reply, err := c.exec(txn, args)
+				if err != nil {
+					return err
+				}
+				replies = append(replies, reply)
+			}
+			return nil
+		})
+		if err != nil {
+			return respError("EXECABORT Transaction discarded because of: " + err.Error())
+		}
+		return replies
+	case "discard":
+		if c.queue == nil {
+			return respError("ERR DISCARD without MULTI")
+		}
+		c.queue, c.dirty = nil, false
+		return respSimple("OK")
+	case "quit":
+		return respSimple("OK")
+	case "ping":
+		if len(args) > 1 {
+			return []byte(args[1])
+		}
+		return respSimple("PONG")
+	case "echo":
+		return []byte(args[1])
+	case "hello":
+		return c.hello(args)
+	case "select":
+		if args[1] != "0" {
+			return respError("ERR DB index is out of range")
+		}
+		return respSimple("OK")
+	case "command":
+		return []interface{}{}
+	case "client":
+		return respSimple("OK")
+	case "info":
+		var buf bytes.Buffer
+		if err := c.storage.Info(&buf, args[1:]...); err != nil {
+			return respError("ERR " + err.Error())
+		}
+		return buf.Bytes()
+	case "slowlog":
+		return c.slowlog(args[1:])
+	case "psubscribe", "punsubscribe":
+		if c.queue != nil {
+			c.dirty = true
+			return respError(fmt.Sprintf("ERR %s inside MULTI is not allowed", strings.ToUpper(cmd)))
+		} else if cmd == "psubscribe" {
+			return c.psubscribe(args[1:])
+		}
+		return c.punsubscribe(args[1:])
+	}
+
+	if c.queue != nil {
+		c.queue = append(c.queue, args)
+		return respSimple("QUEUED")
+	}
+	var reply interface{}
+	if err := c.storage.autoCommitAs(actorOf(c.user, c.addr), func(txn *Txn) (err error) {
+		reply, err = c.exec(txn, args)
+		return err
+	}); err != nil {
+		return respError("ERR " + err.Error())
+	}
+	return reply
+}
+
+// hello supports HELLO [protover [AUTH username password]].
+func (c *respConn) hello(args []string) interface{} {
+	if len(args) > 2 {
+		if len(args) != 5 || strings.ToLower(args[2]) != "auth" {
+			return respError("ERR syntax error")
+		} else if reply := c.auth(args[3:]); reply != respSimple("OK") {
+			return reply
+		}
+	}
+	if len(args) > 1 {
+		switch args[1] {
+		case "2":
+			c.proto = 2
+		case "3":
+			c.proto = 3
+		default:
+			return respError("NOPROTO unsupported protocol version")
+		}
+	}
+	return respMap{
+		"server", "txngo",
+		"version", serverVersion,
+		"proto", int64(c.proto),
+		"id", int64(0),
+		"mode", "standalone",
+		"role", "master",
+		"modules", []interface{}{},
+	}
+}
+
+// auth supports AUTH username password and AUTH token.
+func (c *respConn) auth(args []string) interface{} {
+	acl := c.storage.acl
+	if acl == nil {
+		return respError("ERR AUTH called without ACL enabled")
+	}
+	var err error
+	switch len(args) {
+	case 1:
+		var name string
+		if name, err = acl.AuthenticateToken(args[0]); err == nil {
+			c.user = name
+		}
+	case 2:
+		if err = acl.Authenticate(args[0], args[1]); err == nil {
+			c.user = args[0]
+		}
+	default:
+		return respError("ERR syntax error")
+	}
+	if err != nil {
+		return respError("WRONGPASS invalid username-password pair or user is disabled.")
+	}
+	return respSimple("OK")
+}
+
+// acl supports ACL WHOAMI, LIST, SETUSER, DELUSER and GENTOKEN. Only admin users can manage users.
+//
+//	ACL SETUSER username [>password] [+@admin|-@admin] [resetkeys] [~prefix*] [%R~prefix*] [%W~prefix*]
+//	ACL GENTOKEN username
+func (c *respConn) acl(args []string) interface{} {
+	acl := c.storage.acl
+	if acl == nil {
+		return respError("ERR ACL is not enabled")
+	}
+	sub := strings.ToLower(args[0])
+	if sub == "whoami" {
+		return c.user
+	} else if !acl.IsAdmin(c.user) {
+		return respError("NOPERM this user has no permissions to run the 'acl' command")
+	}
+	switch sub {
+	case "list":
+		var lines []interface{}
+		for _, u := range acl.Users() {
+			line := "user " + u.Name
+			if u.Admin {
+				line += " +@admin"
+			}
+			for _, g := range u.Grants {
+				switch g.Perm {
+				case PermRead:
+					line += " %R~" + g.Prefix + "*"
+				case PermWrite:
+					line += " %W~" + g.Prefix + "*"
+				default:
+					line += " ~" + g.Prefix + "*"
+				}
+			}
+			lines = append(lines, line)
+		}
+		return lines
+	case "setuser":
+		if len(args) < 2 {
+			return respError("ERR wrong number of arguments for 'acl|setuser' command")
+		}
+		if err := c.setUser(args[1], args[2:]); err != nil {
+			return respError("ERR " + err.Error())
+		}
+		return respSimple("OK")
+	case "deluser":
+		var n int64
+		for _, name := range args[1:] {
+			if err := acl.DeleteUser(name); err == nil {
+				n++
+			} else if err != ErrUserNotExist {
+				return respError("ERR " + err.Error())
+			}
+		}
+		return n
+	case "gentoken":
+		if len(args) != 2 {
+			return respError("ERR wrong number of arguments for 'acl|gentoken' command")
+		}
+		token, err := acl.NewToken(args[1])
+		if err != nil {
+			return respError("ERR " + err.Error())
+		}
+		return token
+	}
+	return respError(fmt.Sprintf("ERR unknown subcommand '%s'", args[0]))
+}
+
+// slowlog supports SLOWLOG GET [count], LEN and RESET. The arguments of each entry describe the
+// transaction instead of the command, and the client address and name are empty.
+func (c *respConn) slowlog(args []string) interface{} {
+	if acl := c.storage.acl; acl != nil && !acl.IsAdmin(c.user) {
+		return respError("NOPERM this user has no permissions to run the 'slowlog' command")
+	}
+	switch strings.ToLower(args[0]) {
+	case "get":
+		n := 10
+		if len(args) > 2 {
+			return respError("ERR wrong number of arguments for 'slowlog|get' command")
+		} else if len(args) == 2 {
+			var err error
+			if n, err = strconv.Atoi(args[1]); err != nil || n < -1 {
+				return respError("ERR count should be greater than or equal to -1")
+			}
+		}
+		entries := []interface{}{}
+		for _, e := range c.storage.SlowLog(n) {
+			status := "aborted"
+			if e.Committed {
+				status = "committed"
+			}
+			entries = append(entries, []interface{}{
+				int64(e.ID),
+				e.Start.Unix(),
+				e.Duration.Microseconds(),
+				[]interface{}{
+					status,
+					fmt.Sprintf("reads=%d", e.Reads),
+					fmt.Sprintf("writes=%d", e.Writes),
+					fmt.Sprintf("lock_wait_us=%d", e.LockWait.Microseconds()),
+					fmt.Sprintf("fsync_us=%d", e.Fsync.Microseconds()),
+					fmt.Sprintf("version=%d", e.Version),
+				},
+				"",
+				"",
+			})
+		}
+		return entries
+	case "len":
+		return int64(c.storage.SlowLogLen())
+	case "reset":
+		c.storage.ResetSlowLog()
+		return respSimple("OK")
+	}
+	return respError(fmt.Sprintf("ERR unknown subcommand '%s'", args[0]))
+}
+
+// setUser creates the user if not exists and applies rules in order.
+func (c *respConn) setUser(name string, rules []string) error {
+	acl := c.storage.acl
+	if err := acl.AddUser(name, "", false); err != nil && err != ErrUserExist {
+		return err
+	}
+	for _, rule := range rules {
+		var err error
+		switch {
+		case strings.HasPrefix(rule, ">"):
+			err = acl.SetPassword(name, rule[1:])
+		case rule == "+@admin", rule == "-@admin":
+			err = acl.SetAdmin(name, rule == "+@admin")
+		case strings.ToLower(rule) == "resetkeys":
+			err = acl.Revoke(name)
+		case strings.HasPrefix(rule, "~"):
+			err = acl.Grant(name, strings.TrimSuffix(rule[1:], "*"), PermRead|PermWrite)
+		case strings.HasPrefix(rule, "%R~"):
+			err = acl.Grant(name, strings.TrimSuffix(rule[3:], "*"), PermRead)
+		case strings.HasPrefix(rule, "%W~"):
+			err = acl.Grant(name, strings.TrimSuffix(rule[3:], "*"), PermWrite)
+		case strings.HasPrefix(rule, "%RW~"):
+			err = acl.Grant(name, strings.TrimSuffix(rule[4:], "*"), PermRead|PermWrite)
+		default:
+			return fmt.Errorf("error in ACL SETUSER modifier '%s': syntax error", rule)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// authorize checks the grants of the user on the keys of the data command.
+// keys of SCAN are filtered instead.
+func (c *respConn) authorize(cmd string, args []string) error {
+	perm, keys := PermRead, args[1:]
+	switch cmd {
+	case "get":
+		keys = args[1:2]
+	case "expire", "pexpire", "persist":
+		perm, keys = PermWrite, args[1:2]
+	case "ttl", "pttl":
+		keys = args[1:2]
+	case "set":
+		perm, keys = PermWrite, args[1:2]
+		for _, opt := range args[3:] {
+			if strings.ToLower(opt) == "get" {
+				perm |= PermRead
+			}
+		}
+	case "del":
+		perm = PermWrite
+	case "mset":
+		perm, keys = PermWrite, nil
+		for i := 1; i < len(args); i += 2 {
+			keys = append(keys, args[i])
+		}
+	case "scan":
+		return nil
+	}
+	for _, key := range keys {
+		if err := c.storage.acl.Authorize(c.user, key, perm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exec executes the data command in txn. errors of records are returned as error replies,
+// and other errors are returned to abort the transaction.
+func (c *respConn) exec(txn *Txn, args []string) (interface{}, error) {
+	cmd := strings.ToLower(args[0])
+	if err := c.authorize(cmd, args); err != nil {
+		return respError("NOPERM this user has no permissions to access one of the keys used as arguments"), nil
+	}
+	switch cmd {
+	case "get":
+		v, err := txn.Read(args[1])
+		if err == ErrNotExist {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		return v, nil
+
+	case "set":
+		return c.set(txn, args)
+
+	case "del", "exists":
+		var n int64
+		for _, key := range args[1:] {
+			var err error
+			if cmd == "del" {
+				err = txn.Delete(key)
+			} else {
+				_, err = txn.Read(key)
+			}
+			if err == nil {
+				n++
+			} else if err != ErrNotExist {
+				return nil, err
+			}
+		}
+		return n, nil
+
+	case "mget":
+		var replies []interface{}
+		for _, key := range args[1:] {
+			v, err := txn.Read(key)
+			if err == ErrNotExist {
+				replies = append(replies, nil)
+			} else if err != nil {
+				return nil, err
+			} else {
+				replies = append(replies, v)
+			}
+		}
+		return replies, nil
+
+	case "mset":
+		if len(args)%2 != 1 {
+			return respError("ERR wrong number of arguments for 'mset' command"), nil
+		}
+		for i := 1; i < len(args); i += 2 {
+			if err := txn.Put(args[i], []byte(args[i+1])); err != nil {
+				return nil, err
+			}
+		}
+		return respSimple("OK"), nil
+
+	case "scan":
+		return c.scan(args)
+
+	case "expire", "pexpire":
+		unit := time.Second
+		if cmd == "pexpire" {
+			unit = time.Millisecond
+		}
+		ttl, reply := respTTL(args[2], unit, cmd)
+		if reply != nil {
+			return reply, nil
+		}
+		var err error
+		if ttl <= 0 {
+			// non-positive timeout deletes the key like Redis
+			err = txn.Delete(args[1])
+		} else {
+			err = txn.Expire(args[1], ttl)
+		}
+		if err == ErrNotExist {
+			return int64(0), nil
+		} else if err != nil {
+			return nil, err
+		}
+		return int64(1), nil
+
+	case "ttl", "pttl", "persist":
+		ttl, err := txn.TTL(args[1])
+		if err == ErrNotExist {
+			if cmd == "persist" {
+				return int64(0), nil
+			}
+			return int64(-2), nil
+		} else if err != nil {
+			return nil, err
+		} else if ttl == 0 {
+			if cmd == "persist" {
+				return int64(0), nil
+			}
+			return int64(-1), nil
+		}
+		switch cmd {
+		case "ttl":
+			return int64((ttl + time.Second/2) / time.Second), nil
+		case "pttl":
+			return int64((ttl + time.Millisecond/2) / time.Millisecond), nil
+		}
+		if err = txn.Expire(args[1], 0); err != nil {
+			return nil, err
+		}
+		return int64(1), nil
+	}
+	return respError(fmt.Sprintf("ERR unknown command '%s'", args[0])), nil
+}
+
+// respTTL parses the timeout of the command in unit. The error reply is returned if it is not
+// an integer or overflows.
+func respTTL(arg string, unit time.Duration, cmd string) (time.Duration, interface{}) {
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return 0, respError("ERR value is not an integer or out of range")
+	} else if n > int64(math.MaxInt64/unit) || n < int64(math.MinInt64/unit) {
+		return 0, respError(fmt.Sprintf("ERR invalid expire time in '%s' command", cmd))
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// set supports SET key value [NX|XX] [GET] [EX seconds|PX milliseconds|KEEPTTL]. The TTL of
+// the record is cleared unless EX, PX or KEEPTTL is given like Redis.
+func (c *respConn) set(txn *Txn, args []string) (interface{}, error) {
+	var (
+		nx, xx, get, keepTTL bool
+		ttl                  time.Duration
+	)
+	for i := 3; i < len(args); i++ {
+		switch opt := strings.ToLower(args[i]); opt {
+		case "nx":
+			nx = true
+		case "xx":
+			xx = true
+		case "get":
+			get = true
+		case "keepttl":
+			keepTTL = true
+		case "ex", "px":
+			if i+1 == len(args) || ttl != 0 {
+				return respError("ERR syntax error"), nil
+			}
+			unit := time.Second
+			if opt == "px" {
+				unit = time.Millisecond
+			}
+			i++
+			var reply interface{}
+			if ttl, reply = respTTL(args[i], unit, "set"); reply != nil {
+				return reply, nil
+			} else if ttl <= 0 {
+				return respError("ERR invalid expire time in 'set' command"), nil
+			}
+		default:
+			return respError("ERR syntax error"), nil
+		}
+	}
+	if (nx && xx) || (keepTTL && ttl != 0) {
+		return respError("ERR syntax error"), nil
+	}
+	key, value := args[1], []byte(args[2])
+
+	old, err := txn.Read(key)
+	exists := err == nil
+	if err != nil && err != ErrNotExist {
+		return nil, err
+	}
+	var reply interface{} = respSimple("OK")
+	if get {
+		reply = nil
+		if exists {
+			reply = old
+		}
+	}
+	if (nx && exists) || (xx && !exists) {
+		if get {
+			return reply, nil
+		}
+		return nil, nil
+	}
+	if exists {
+		err = txn.Update(key, value)
+	} else {
+		err = txn.Insert(key, value)
+	}
+	if err == nil && !keepTTL {
+		err = txn.Expire(key, ttl)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// scan supports SCAN cursor [MATCH pattern] [COUNT count]. COUNT is the number of keys examined,
+// and the cursor is resumed after the last examined key by Storage.ScanKeys.
+func (c *respConn) scan(args []string) (interface{}, error) {
+	var (
+		cursor  = args[1]
+		pattern = "*"
+		count   = 10
+		err     error
+	)
+	for i := 2; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return respError("ERR syntax error"), nil
+		}
+		switch strings.ToLower(args[i]) {
+		case "match":
+			pattern = args[i+1]
+		case "count":
+			if count, err = strconv.Atoi(args[i+1]); err != nil || count < 1 {
+				return respError("ERR value is not an integer or out of range"), nil
+			}
+		default:
+			return respError("ERR syntax error"), nil
+		}
+	}
+	// keys before the first meta character are used as the prefix
+	prefix := pattern
+	if i := strings.IndexAny(pattern, "*?[\\"); i >= 0 {
+		prefix = pattern[:i]
+	}
+
+	keys, next, err := c.storage.ScanKeys(cursor, prefix, count, func(key string) bool {
+		return respMatch(pattern, key) && c.storage.acl.Authorize(c.user, key, PermRead) == nil
+	})
+	if err == ErrInvalidCursor {
+		return respError("ERR invalid cursor"), nil
+	} else if err != nil {
+		return nil, err
+	}
+	replies := make([]interface{}, len(keys))
+	for i, key := range keys {
+		replies[i] = key
+	}
+	return []interface{}{next, replies}, nil
+}
+
+// respMatch reports whether key matches the glob pattern of Redis. unlike path.Match,
+// '*' matches any characters including '/'.
+func respMatch(pattern, key string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(key); i++ {
+				if respMatch(pattern, key[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(key) == 0 {
+				return false
+			}
+		case '[':
+			if len(key) == 0 {
+				return false
+			}
+			end := strings.IndexByte(pattern[1:], ']')
+			if end < 0 {
+				// unterminated class is matched literally
+				if key[0] != '[' {
+					return false
+				}
+				break
+			}
+			class := pattern[1 : 1+end]
+			negate := len(class) > 0 && class[0] == '^'
+			if negate {
+				class = class[1:]
+			}
+			matched := false
+			for i := 0; i < len(class); i++ {
+				if i+2 < len(class) && class[i+1] == '-' {
+					lo, hi := class[i], class[i+2]
+					if lo > hi {
+						lo, hi = hi, lo
+					}
+					matched = matched || (lo <= key[0] && key[0] <= hi)
+					i += 2
+				} else {
+					matched = matched || class[i] == key[0]
+				}
+			}
+			if matched == negate {
+				return false
+			}
+			pattern = pattern[end+1:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(key) == 0 || pattern[0] != key[0] {
+				return false
+			}
+		}
+		pattern, key = pattern[1:], key[1:]
+	}
+	return len(key) == 0
+}
+
+// keyspacePrefixes are the prefixes of channels of keyspace notifications like Redis. only the
+// database 0 exists.
+var keyspacePrefixes = []string{"__keyspace@0__:", "__keyspace@*__:"}
+
+// psubscribe supports PSUBSCRIBE __keyspace@0__:pattern [...]. events of writes to the keys
+// matching the pattern are pushed as ["pmessage", pattern, "__keyspace@0__:key", "set" or "del"]
+// in commit order.
+func (c *respConn) psubscribe(patterns []string) interface{} {
+	globs := make([]string, len(patterns))
+	for i, pattern := range patterns {
+		for _, p := range keyspacePrefixes {
+			if strings.HasPrefix(pattern, p) {
+				globs[i] = strings.TrimPrefix(pattern, p)
+				break
+			}
+		}
+		if globs[i] == "" {
+			return respError("ERR only keyspace notifications of __keyspace@0__:<pattern> are supported")
+		}
+	}
+	if c.watcher == nil {
+		c.watcher = c.storage.Watch("", respWatchBuffer)
+		go c.forward(c.user, c.watcher)
+	}
+	var replies respReplies
+	for i, pattern := range patterns {
+		c.subs[pattern] = globs[i]
+		replies = append(replies, respPush{"psubscribe", pattern, int64(len(c.subs))})
+	}
+	return replies
+}
+
+// punsubscribe unsubscribes the patterns, or all patterns if no pattern is given.
+func (c *respConn) punsubscribe(patterns []string) interface{} {
+	if len(patterns) == 0 {
+		for pattern := range c.subs {
+			patterns = append(patterns, pattern)
+		}
+		sort.Strings(patterns)
+	}
+	replies := respReplies{respPush{"punsubscribe", nil, int64(0)}}
+	if len(patterns) > 0 {
+		replies = nil
+	}
+	for _, pattern := range patterns {
+		delete(c.subs, pattern)
+		replies = append(replies, respPush{"punsubscribe", pattern, int64(len(c.subs))})
+	}
+	if len(c.subs) == 0 && c.watcher != nil {
+		c.watcher.Close()
+		c.watcher = nil
+	}
+	return replies
+}
+
+// forward sends events of the watcher readable by the user to the connection until the
+// watcher is closed.
+func (c *respConn) forward(user string, w *Watcher) {
+	for e := range w.C {
+		if c.storage.acl.Authorize(user, e.Key, PermRead) != nil {
+			continue
+		}
+		select {
+		case c.events <- respEvent{event: e}:
+		case <-c.closed:
+			return
+		}
+	}
+	if err := w.Err(); err != nil {
+		select {
+		case c.events <- respEvent{err: err}:
+		case <-c.closed:
+		}
+	}
+}
+
+// serveSubscribed pushes keyspace events while any pattern is subscribed. Only PSUBSCRIBE,
+// PUNSUBSCRIBE, PING and QUIT are allowed like Redis. Commands are read in another goroutine
+// one by one, and reading is handed over again when all patterns are unsubscribed.
+func (c *respConn) serveSubscribed() (quit bool, err error) {
+	type command struct {
+		args []string
+		err  error
+	}
+	commands := make(chan command, 1)
+	next := make(chan bool)
+	go func() {
+		for {
+			args, err := c.readCommand()
+			commands <- command{args, err}
+			if err != nil {
+				return
+			}
+			select {
+			case ok := <-next:
+				if !ok {
+					return
+				}
+			case <-c.closed:
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case ev := <-c.events:
+			if ev.err != nil {
+				return false, ev.err
+			}
+			action := "set"
+			if ev.event.Deleted {
+				action = "del"
+			}
+			patterns := make([]string, 0, len(c.subs))
+			for pattern := range c.subs {
+				patterns = append(patterns, pattern)
+			}
+			sort.Strings(patterns)
+			for _, pattern := range patterns {
+				if respMatch(c.subs[pattern], ev.event.Key) {
+					c.write(respPush{"pmessage", pattern, keyspacePrefixes[0] + ev.event.Key, action})
+				}
+			}
+		case cmd := <-commands:
+			if cmd.err == io.EOF {
+				return true, nil
+			} else if cmd.err == errRESPProtocol {
+				c.write(respError(cmd.err.Error()))
+				return false, cmd.err
+			} else if cmd.err != nil {
+				return false, cmd.err
+			}
+			name := ""
+			if len(cmd.args) > 0 {
+				name = strings.ToLower(cmd.args[0])
+			}
+			switch name {
+			case "":
+			case "psubscribe", "punsubscribe", "ping", "quit":
+				c.write(c.handle(cmd.args))
+				quit = name == "quit"
+			default:
+				c.write(respError(fmt.Sprintf("ERR Can't execute '%s': only PSUBSCRIBE / PUNSUBSCRIBE / PING / QUIT are allowed in this context", name)))
+			}
+			if len(c.subs) == 0 || quit {
+				next <- false
+				return quit, c.w.Flush()
+			}
+			next <- true
+		}
+		if err = c.w.Flush(); err != nil {
+			return false, err
+		}
+	}
+}
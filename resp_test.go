@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// readRESP parses a reply into string, int64, nil, error or []interface{}.
+func readRESP(t *testing.T, r *bufio.Reader) interface{} {
+	t.Helper()
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("failed to read reply : %v", err)
+	}
+	line = line[:len(line)-2]
+	switch line[0] {
+	case '+':
+		return line[1:]
+	case '-':
+		return fmt.Errorf("%s", line[1:])
+	case ':':
+		n, _ := strconv.ParseInt(line[1:], 10, 64)
+		return n
+	case '_':
+		return nil
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return nil
+		}
+		buf := make([]byte, n+2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			t.Fatalf("failed to read bulk : %v", err)
+		}
+		return string(buf[:n])
+	case '*', '%':
+		n, _ := strconv.Atoi(line[1:])
+		if line[0] == '%' {
+			n *= 2
+		}
+		replies := []interface{}{}
+		for i := 0; i < n; i++ {
+			replies = append(replies, readRESP(t, r))
+		}
+		return replies
+	}
+	t.Fatalf("invalid reply %q", line)
+	return nil
+}
+
+func TestHandleRESP(t *testing.T) {
+	storage := createTestStorage(t)
+	defer storage.wal.Close()
+	client, server := net.Pipe()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go HandleRESP(server, server, storage, &wg)
+	defer client.Close()
+	r := bufio.NewReader(client)
+
+	do := func(args ...string) string {
+		t.Helper()
+		cmd := fmt.Sprintf("*%d\r\n", len(args))
+		for _, arg := range args {
+			cmd += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+		}
+		if _, err := client.Write([]byte(cmd)); err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprint(readRESP(t, r))
+	}
+
+	for _, c := range []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"PING"}, "PONG"},
+		{[]string{"SET", "k1", "v1"}, "OK"},
+		{[]string{"SET", "k1", "v2", "NX"}, "<nil>"},
+		{[]string{"SET", "k1", "v2", "XX", "GET"}, "v1"},
+		{[]string{"SET", "k2", "v", "XX"}, "<nil>"},
+		{[]string{"GET", "k1"}, "v2"},
+		{[]string{"GET", "none"}, "<nil>"},
+		{[]string{"MSET", "k2", "v2", "k3", "v3"}, "OK"},
+		{[]string{"MGET", "k1", "none", "k3"}, "[v2 <nil> v3]"},
+		{[]string{"EXISTS", "k1", "k2", "none"}, "2"},
+		{[]string{"DEL", "k2", "none"}, "1"},
+		{[]string{"SCAN", "0", "COUNT", "1"}, "[" + encodeCursor("k1") + " [k1]]"},
+		{[]string{"SCAN", encodeCursor("k1"), "COUNT", "1"}, "[0 [k3]]"},
+		{[]string{"SCAN", "0", "MATCH", "k*3"}, "[0 [k3]]"},
+		{[]string{"SCAN", "1"}, "ERR invalid cursor"},
+		{[]string{"INFO", "keyspace"}, "# Keyspace\r\ndb0:keys=2\r\ncommit_version:4\r\n\r\n"},
+		{[]string{"SLOWLOG", "LEN"}, "0"},
+		{[]string{"SLOWLOG", "GET"}, "[]"},
+		{[]string{"SLOWLOG", "FOO"}, "ERR unknown subcommand 'FOO'"},
+		{[]string{"GET"}, "ERR wrong number of arguments for 'get' command"},
+		{[]string{"FOO"}, "ERR unknown command 'FOO'"},
+
+		// transaction
+		{[]string{"MULTI"}, "OK"},
+		{[]string{"SET", "k4", "v4"}, "QUEUED"},
+		{[]string{"GET", "k4"}, "QUEUED"},
+		{[]string{"DEL", "k1"}, "QUEUED"},
+		{[]string{"EXEC"}, "[OK v4 1]"},
+		{[]string{"MGET", "k1", "k4"}, "[<nil> v4]"},
+		{[]string{"MULTI"}, "OK"},
+		{[]string{"SET", "k5", "v5"}, "QUEUED"},
+		{[]string{"DISCARD"}, "OK"},
+		{[]string{"MULTI"}, "OK"},
+		{[]string{"SET", "k5"}, "ERR wrong number of arguments for 'set' command"},
+		{[]string{"EXEC"}, "EXECABORT Transaction discarded because of previous errors."},
+		{[]string{"EXISTS", "k5"}, "0"},
+
+		// RESP3
+		{[]string{"HELLO", "3"}, "[server txngo version 0.0.0 proto 3 id 0 mode standalone role master modules []]"},
+		{[]string{"GET", "none"}, "<nil>"},
+		{[]string{"QUIT"}, "OK"},
+	} {
+		if reply := do(c.args...); reply != c.expected {
+			t.Errorf("reply of %v not match %q, expected %q", c.args, reply, c.expected)
+		}
+	}
+	wg.Wait()
+
+	// committed records are in storage
+	txn := storage.NewTxn()
+	assertValue(t, txn, "k3", []byte("v3"))
+	assertValue(t, txn, "k4", []byte("v4"))
+	assertNotExist(t, txn, "k1")
+}
+
+func TestRespMatch(t *testing.T) {
+	for _, c := range []struct {
+		pattern  string
+		key      string
+		expected bool
+	}{
+		{"*", "a/b", true},
+		{"a*", "a/b", true},
+		{"a*c", "a/b", false},
+		{"a?b", "a/b", true},
+		{"a[/x]b", "a/b", true},
+		{"a[^/]b", "a/b", false},
+		{"k[0-9]", "k5", true},
+		{"k[0-9]", "kx", false},
+		{"k\\*", "k*", true},
+		{"k\\*", "kx", false},
+		{"k[", "k[", true},
+		{"", "", true},
+		{"", "a", false},
+	} {
+		if matched := respMatch(c.pattern, c.key); matched != c.expected {
+			t.Errorf("match %q with %q : %v, expected %v", c.pattern, c.key, matched, c.expected)
+		}
+	}
+}
+
+func TestHandleRESP_Pipeline(t *testing.T) {
+	storage := createTestStorage(t)
+	defer storage.wal.Close()
+	client, server := net.Pipe()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go HandleRESP(server, server, storage, &wg)
+	defer client.Close()
+	r := bufio.NewReader(client)
+
+	var (
+		cmds     string
+		expected []string
+	)
+	for i := 0; i < 10; i++ {
+		cmds += fmt.Sprintf("SET k%d v%d\r\n", i, i)
+		expected = append(expected, "OK")
+	}
+	cmds += "SET k0 v0 NX\r\nMULTI\r\nSET k1 x\r\nEXEC\r\n"
+	expected = append(expected, "<nil>", "OK", "QUEUED", "[OK]")
+	for i := 0; i < 10; i++ {
+		cmds += fmt.Sprintf("GET k%d\r\n", i)
+		expected = append(expected, fmt.Sprintf("v%d", i))
+	}
+	expected[len(expected)-9] = "x"
+	cmds += "QUIT\r\n"
+	expected = append(expected, "OK")
+
+	go client.Write([]byte(cmds))
+	for i, e := range expected {
+		if reply := fmt.Sprint(readRESP(t, r)); reply != e {
+			t.Errorf("reply %d not match %q, expected %q", i, reply, e)
+		}
+	}
+	wg.Wait()
+
+	// pipelined commands are committed together
+	if storage.version >= 10 {
+		t.Errorf("pipelined commands are not batched : %v commits", storage.version)
+	}
+}
+
+func TestHandleRESP_Expire(t *testing.T) {
+	storage := createTestStorage(t)
+	defer storage.wal.Close()
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	storage.opts.Now = func() time.Time { return now }
+	client, server := net.Pipe()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go HandleRESP(server, server, storage, &wg)
+	defer client.Close()
+	r := bufio.NewReader(client)
+
+	for _, c := range []struct {
+		cmd      string
+		expected string
+		// elapsed is the time passed before the command
+		elapsed time.Duration
+	}{
+		{"SET k1 v1", "OK", 0},
+		{"TTL k1", "-1", 0},
+		{"TTL none", "-2", 0},
+		{"EXPIRE k1 10", "1", 0},
+		{"EXPIRE none 10", "0", 0},
+		{"TTL k1", "10", 0},
+		{"PTTL k1", "9500", 500 * time.Millisecond},
+		{"PEXPIRE k1 20000", "1", 0},
+		{"TTL k1", "20", 0},
+		{"PERSIST k1", "1", 0},
+		{"PERSIST k1", "0", 0},
+		{"TTL k1", "-1", 0},
+		{"EXPIRE k1 abc", "ERR value is not an integer or out of range", 0},
+		{"EXPIRE k1 9223372036854775807", "ERR invalid expire time in 'expire' command", 0},
+
+		// SET with EX, PX and KEEPTTL
+		{"SET k2 v2 EX 5", "OK", 0},
+		{"TTL k2", "5", 0},
+		{"SET k2 v3 KEEPTTL", "OK", 0},
+		{"TTL k2", "5", 0},
+		{"SET k2 v4", "OK", 0},
+		{"TTL k2", "-1", 0},
+		{"SET k2 v5 PX 1500", "OK", 0},
+		{"PTTL k2", "1500", 0},
+		{"SET k2 v6 EX 0", "ERR invalid expire time in 'set' command", 0},
+		{"SET k2 v6 EX 1 KEEPTTL", "ERR syntax error", 0},
+		{"SET k2 v6 EX", "ERR syntax error", 0},
+
+		// expired records are not found
+		{"GET k2", "<nil>", 2 * time.Second},
+		{"TTL k2", "-2", 0},
+		{"EXISTS k2", "0", 0},
+		{"EXPIRE k1 0", "1", 0},
+		{"GET k1", "<nil>", 0},
+		{"QUIT", "OK", 0},
+	} {
+		now = now.Add(c.elapsed)
+		if _, err := client.Write([]byte(c.cmd + "\r\n")); err != nil {
+			t.Fatal(err)
+		} else if reply := fmt.Sprint(readRESP(t, r)); reply != c.expected {
+			t.Errorf("reply of %q not match %q, expected %q", c.cmd, reply, c.expected)
+		}
+	}
+	wg.Wait()
+}
+
+func TestHandleRESP_Keyspace(t *testing.T) {
+	storage := createTestStorage(t)
+	defer storage.wal.Close()
+	client, server := net.Pipe()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go HandleRESP(server, server, storage, &wg)
+	defer client.Close()
+	r := bufio.NewReader(client)
+
+	send := func(args ...string) {
+		t.Helper()
+		cmd := fmt.Sprintf("*%d\r\n", len(args))
+		for _, arg := range args {
+			cmd += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+		}
+		if _, err := client.Write([]byte(cmd)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func() string {
+		t.Helper()
+		return fmt.Sprint(readRESP(t, r))
+	}
+
+	send("PSUBSCRIBE", "__keyspace@0__:k*", "__keyspace@0__:x?")
+	if reply := read(); reply != "[psubscribe __keyspace@0__:k* 1]" {
+		t.Errorf("reply of psubscribe : %v", reply)
+	} else if reply = read(); reply != "[psubscribe __keyspace@0__:x? 2]" {
+		t.Errorf("reply of psubscribe : %v", reply)
+	}
+	for _, key := range []string{"k1", "other", "x1"} {
+		if err := storage.Put(key, []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := storage.Delete("k1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"[pmessage __keyspace@0__:k* __keyspace@0__:k1 set]",
+		"[pmessage __keyspace@0__:x? __keyspace@0__:x1 set]",
+		"[pmessage __keyspace@0__:k* __keyspace@0__:k1 del]",
+	} {
+		if reply := read(); reply != expected {
+			t.Errorf("event not match %q, expected %q", reply, expected)
+		}
+	}
+
+	// only subscription commands are allowed while subscribing
+	send("GET", "k1")
+	if reply := read(); !strings.HasPrefix(reply, "ERR Can't execute 'get'") {
+		t.Errorf("reply of get while subscribing : %v", reply)
+	}
+	send("PUNSUBSCRIBE")
+	if reply := read(); reply != "[punsubscribe __keyspace@0__:k* 1]" {
+		t.Errorf("reply of punsubscribe : %v", reply)
+	} else if reply = read(); reply != "[punsubscribe __keyspace@0__:x? 0]" {
+		t.Errorf("reply of punsubscribe : %v", reply)
+	}
+	send("GET", "x1")
+	if reply := read(); reply != "value" {
+		t.Errorf("reply of get after unsubscribe : %v", reply)
+	}
+	send("PSUBSCRIBE", "news.*")
+	if reply := read(); !strings.HasPrefix(reply, "ERR only keyspace notifications") {
+		t.Errorf("reply of psubscribe to channel : %v", reply)
+	}
+	send("QUIT")
+	if reply := read(); reply != "OK" {
+		t.Errorf("reply of quit : %v", reply)
+	}
+	wg.Wait()
+}
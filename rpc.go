@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"strings"
+	"time"
+
+	pb "github.com/kawasin73/txngo/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// TxnService serves transactions of Storage to remote clients as Txngo service of
+// proto/txngo.proto. The code of the service is generated into the proto package by
+// "make proto".
+type TxnService struct {
+	pb.UnimplementedTxngoServer
+	storage *Storage
+}
+
+func NewTxnService(storage *Storage) *TxnService {
+	return &TxnService{storage: storage}
+}
+
+// NewGRPCServer returns the gRPC server of TxnService. If ACL is enabled, clients authenticate
+// each call by the "authorization" metadata of "Bearer <token>" or "Basic <base64 of
+// user:password>", and calls without it are served as unauthenticated.
+func NewGRPCServer(storage *Storage, opts ...grpc.ServerOption) *grpc.Server {
+	service := NewTxnService(storage)
+	opts = append(opts,
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			ctx, err := service.authenticate(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			ctx, err := service.authenticate(ss.Context())
+			if err != nil {
+				return err
+			}
+			return handler(srv, &authStream{ServerStream: ss, ctx: ctx})
+		}),
+	)
+	server := grpc.NewServer(opts...)
+	pb.RegisterTxngoServer(server, service)
+	return server
+}
+
+// grpcCredentials serves gRPC over TLS of config, whose certificates may be reloaded by
+// GetConfigForClient. gRPC requires HTTP/2 negotiated by ALPN.
+func grpcCredentials(config *tls.Config) credentials.TransportCredentials {
+	if get := config.GetConfigForClient; get != nil {
+		config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			c, err := get(hello)
+			if err != nil || c == nil {
+				return c, err
+			}
+			c = c.Clone()
+			c.NextProtos = []string{"h2"}
+			return c, nil
+		}
+	}
+	return credentials.NewTLS(config)
+}
+
+// authStream is the server stream with the context of the authenticated user.
+type authStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authStream) Context() context.Context { return s.ctx }
+
+// authenticate returns the context of the user authenticated by the metadata of ctx.
+func (s *TxnService) authenticate(ctx context.Context) (context.Context, error) {
+	if s.storage.acl == nil {
+		return ctx, nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	auth := md.Get("authorization")
+	if len(auth) == 0 {
+		return ctx, nil
+	}
+	scheme, credential, _ := strings.Cut(auth[0], " ")
+	switch strings.ToLower(scheme) {
+	case "bearer":
+		name, err := s.storage.acl.AuthenticateToken(credential)
+		if err != nil {
+			return nil, status.Error(codes.Unauthenticated, err.Error())
+		}
+		return ContextWithUser(ctx, name), nil
+	case "basic":
+		b, err := base64.StdEncoding.DecodeString(credential)
+		if err != nil {
+			return nil, status.Error(codes.Unauthenticated, "invalid basic credentials")
+		}
+		name, password, _ := strings.Cut(string(b), ":")
+		if err = s.storage.acl.Authenticate(name, password); err != nil {
+			return nil, status.Error(codes.Unauthenticated, err.Error())
+		}
+		return ContextWithUser(ctx, name), nil
+	default:
+		return nil, status.Error(codes.Unauthenticated, "unsupported authorization scheme")
+	}
+}
+
+// codeOf converts the error of transaction into the code.
+func codeOf(err error) pb.Code {
+	switch err {
+	case nil:
+		return pb.Code_OK
+	case ErrNotExist:
+		return pb.Code_NOT_FOUND
+	case ErrDeadLock, context.Canceled:
+		return pb.Code_ABORTED
+	case context.DeadlineExceeded:
+		return pb.Code_DEADLINE_EXCEEDED
+	case ErrNoAuth:
+		return pb.Code_UNAUTHENTICATED
+	case ErrPermission:
+		return pb.Code_PERMISSION_DENIED
+	default:
+		return pb.Code_INTERNAL
+	}
+}
+
+type userKey struct{}
+
+// ContextWithUser returns the context of the user authenticated by the transport
+// (e.g. by the token in metadata with ACL.AuthenticateToken).
+func ContextWithUser(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, userKey{}, name)
+}
+
+func userOf(ctx context.Context) string {
+	name, _ := ctx.Value(userKey{}).(string)
+	return name
+}
+
+func errorOf(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func (s *TxnService) Get(ctx context.Context, req *pb.GetRequest) (*pb.GetResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, status.FromContextError(err).Err()
+	}
+	var (
+		value   []byte
+		version uint64
+	)
+	err := s.storage.autoCommit(func(txn *Txn) (err error) {
+		txn.SetContext(ctx)
+		if err = s.storage.acl.Authorize(userOf(ctx), req.Key, PermRead); err != nil {
+			return err
+		}
+		value, version, err = txn.ReadVersioned(req.Key)
+		return err
+	})
+	return &pb.GetResponse{Code: codeOf(err), Value: value, Version: version, Error: errorOf(err)}, nil
+}
+
+func (s *TxnService) Put(ctx context.Context, req *pb.PutRequest) (*pb.PutResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, status.FromContextError(err).Err()
+	}
+	err := s.storage.autoCommit(func(txn *Txn) error {
+		txn.SetContext(ctx)
+		if err := s.storage.acl.Authorize(userOf(ctx), req.Key, PermWrite); err != nil {
+			return err
+		}
+		return txn.Put(req.Key, req.Value)
+	})
+	return &pb.PutResponse{Code: codeOf(err), Error: errorOf(err)}, nil
+}
+
+// Txn runs transactions requested over the stream. The transaction is aborted when its
+// deadline passes even while the client does not send requests or the transaction waits for
+// locks, so that locks are released.
+func (s *TxnService) Txn(stream pb.Txngo_TxnServer) error {
+	ctx := stream.Context()
+	user := userOf(ctx)
+	type recv struct {
+		req *pb.TxnRequest
+		err error
+	}
+	chRecv := make(chan recv)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			select {
+			case chRecv <- recv{req: req, err: err}:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var (
+		txn *Txn
+		// expired is closed when the deadline of txn passes.
+		cancel  context.CancelFunc
+		expired <-chan struct{}
+		// timedOut is true if the last transaction is aborted by the deadline.
+		timedOut bool
+	)
+	finish := func() {
+		if cancel != nil {
+			cancel()
+			cancel, expired = nil, nil
+		}
+		txn = nil
+	}
+	defer func() {
+		if txn != nil {
+			txn.Abort()
+			finish()
+		}
+	}()
+
+	for {
+		var r recv
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-expired:
+			txn.Abort()
+			finish()
+			timedOut = true
+			continue
+		case r = <-chRecv:
+		}
+		if r.err == io.EOF {
+			return nil
+		} else if r.err != nil {
+			return r.err
+		}
+
+		res := &pb.TxnResponse{}
+		req := r.req
+		switch {
+		case req.Op == pb.TxnOp_BEGIN:
+			if txn != nil {
+				res.Code, res.Error = pb.Code_INVALID, "transaction is already begun"
+				break
+			}
+			var txnCtx context.Context
+			txnCtx, cancel = txnContext(ctx, req.TimeoutMs)
+			if req.TimeoutMs > 0 {
+				expired = txnCtx.Done()
+			}
+			txn, timedOut = s.storage.NewTxn(), false
+			txn.SetContext(txnCtx)
+		case txn == nil && req.Op == pb.TxnOp_ABORT:
+			// the transaction may be already aborted by the deadline
+		case txn == nil && timedOut:
+			res.Code, res.Error = pb.Code_DEADLINE_EXCEEDED, "transaction is aborted by the deadline"
+		case txn == nil:
+			res.Code, res.Error = pb.Code_INVALID, "transaction is not begun"
+		default:
+			var err error
+			switch req.Op {
+			case pb.TxnOp_READ:
+				if err = s.storage.acl.Authorize(user, req.Key, PermRead); err == nil {
+					res.Value, res.Version, err = txn.ReadVersioned(req.Key)
+				}
+			case pb.TxnOp_WRITE:
+				if err = s.storage.acl.Authorize(user, req.Key, PermWrite); err == nil {
+					err = txn.Put(req.Key, req.Value)
+				}
+			case pb.TxnOp_DELETE:
+				if err = s.storage.acl.Authorize(user, req.Key, PermWrite); err == nil {
+					err = txn.Delete(req.Key)
+				}
+			case pb.TxnOp_COMMIT:
+				if err = txn.Commit(); err != nil {
+					txn.Abort()
+				}
+				finish()
+			case pb.TxnOp_ABORT:
+				txn.Abort()
+				finish()
+			default:
+				res.Code, res.Error = pb.Code_INVALID, "unknown operation"
+			}
+			if err != nil {
+				res.Code, res.Error = codeOf(err), err.Error()
+				switch err {
+				case context.DeadlineExceeded, context.Canceled:
+					// the deadline passes while waiting for locks
+					timedOut = true
+					fallthrough
+				case ErrDeadLock:
+					if txn != nil {
+						txn.Abort()
+						finish()
+					}
+				}
+			}
+		}
+		if err := stream.Send(res); err != nil {
+			return err
+		}
+	}
+}
+
+// txnContext returns the context of the transaction canceled when it ends, with the deadline
+// after timeoutMs if it is positive.
+func txnContext(ctx context.Context, timeoutMs int64) (context.Context, context.CancelFunc) {
+	if timeoutMs <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Duration(timeoutMs)*time.Millisecond)
+}
+
+// BulkLoad loads batches of records by BulkLoader and reports the number of committed records
+// after each request. SkipWal of the first request decides whether WAL is skipped. When the
+// client closes the stream, the rest of records are committed and the response with Done is sent.
+// The stream ends at the first failure, and records committed before it are kept.
+func (s *TxnService) BulkLoad(stream pb.Txngo_BulkLoadServer) error {
+	ctx := stream.Context()
+	user := userOf(ctx)
+	var loader *BulkLoader
+	defer func() {
+		if loader != nil {
+			if err := loader.Abort(); err != nil {
+				s.storage.logger().Error("failed to checkpoint bulk load", "err", err)
+			}
+		}
+	}()
+	fail := func(err error) error {
+		var loaded uint64
+		if loader != nil {
+			loaded = loader.Loaded()
+		}
+		return stream.Send(&pb.BulkLoadResponse{Code: codeOf(err), Loaded: loaded, Error: err.Error()})
+	}
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF && loader != nil {
+			err = loader.Close()
+			res := &pb.BulkLoadResponse{Code: codeOf(err), Loaded: loader.Loaded(), Done: err == nil, Error: errorOf(err)}
+			loader = nil
+			return stream.Send(res)
+		} else if err == io.EOF {
+			return stream.Send(&pb.BulkLoadResponse{Done: true})
+		} else if err != nil {
+			return err
+		} else if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		if loader == nil {
+			if loader, err = s.storage.NewBulkLoader(req.SkipWal); err != nil {
+				return fail(err)
+			}
+		}
+		for _, r := range req.Records {
+			if err = s.storage.acl.Authorize(user, r.Key, PermWrite); err != nil {
+				return fail(err)
+			} else if err = loader.Add(r.Key, r.Value); err != nil {
+				return fail(err)
+			}
+		}
+		if err = stream.Send(&pb.BulkLoadResponse{Loaded: loader.Loaded()}); err != nil {
+			return err
+		}
+	}
+}
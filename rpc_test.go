@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/kawasin73/txngo/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// dialTestGRPC serves the storage by the gRPC server on a local port and returns the client
+// connected to it.
+func dialTestGRPC(t *testing.T, storage *Storage) pb.TxngoClient {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewGRPCServer(storage)
+	go server.Serve(l)
+	t.Cleanup(server.Stop)
+	conn, err := grpc.NewClient(l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewTxngoClient(conn)
+}
+
+// testTxnStream is the client stream of Txn.
+type testTxnStream struct {
+	pb.Txngo_TxnClient
+}
+
+func openTestTxnStream(t *testing.T, ctx context.Context, client pb.TxngoClient) *testTxnStream {
+	t.Helper()
+	stream, err := client.Txn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testTxnStream{Txngo_TxnClient: stream}
+}
+
+func (s *testTxnStream) call(t *testing.T, req *pb.TxnRequest, code pb.Code) *pb.TxnResponse {
+	t.Helper()
+	if err := s.Send(req); err != nil {
+		t.Fatal(err)
+	}
+	res, err := s.Recv()
+	if err != nil {
+		t.Fatal(err)
+	} else if res.Code != code {
+		t.Fatalf("op %v : code %v (%q) != %v", req.Op, res.Code, res.Error, code)
+	}
+	return res
+}
+
+func TestTxnService(t *testing.T) {
+	storage := createTestStorage(t)
+	defer storage.wal.Close()
+	client := dialTestGRPC(t, storage)
+	ctx := context.Background()
+
+	if res, err := client.Put(ctx, &pb.PutRequest{Key: "a", Value: []byte("1")}); err != nil || res.Code != pb.Code_OK {
+		t.Fatalf("put : %v %v", res, err)
+	}
+	if res, err := client.Get(ctx, &pb.GetRequest{Key: "a"}); err != nil || res.Code != pb.Code_OK || !bytes.Equal(res.Value, []byte("1")) {
+		t.Fatalf("get : %v %v", res, err)
+	}
+	if res, err := client.Get(ctx, &pb.GetRequest{Key: "none"}); err != nil || res.Code != pb.Code_NOT_FOUND {
+		t.Fatalf("get not found : %v %v", res, err)
+	}
+
+	stream := openTestTxnStream(t, ctx, client)
+
+	// commit
+	stream.call(t, &pb.TxnRequest{Op: pb.TxnOp_READ, Key: "a"}, pb.Code_INVALID)
+	stream.call(t, &pb.TxnRequest{Op: pb.TxnOp_BEGIN}, pb.Code_OK)
+	stream.call(t, &pb.TxnRequest{Op: pb.TxnOp_BEGIN}, pb.Code_INVALID)
+	stream.call(t, &pb.TxnRequest{Op: pb.TxnOp_WRITE, Key: "b", Value: []byte("2")}, pb.Code_OK)
+	if res := stream.call(t, &pb.TxnRequest{Op: pb.TxnOp_READ, Key: "b"}, pb.Code_OK); !bytes.Equal(res.Value, []byte("2")) {
+		t.Fatalf("read : %q", res.Value)
+	}
+	stream.call(t, &pb.TxnRequest{Op: pb.TxnOp_DELETE, Key: "a"}, pb.Code_OK)
+	stream.call(t, &pb.TxnRequest{Op: pb.TxnOp_COMMIT}, pb.Code_OK)
+	if res, _ := client.Get(ctx, &pb.GetRequest{Key: "b"}); res.Code != pb.Code_OK {
+		t.Fatalf("committed value not found : %v", res.Error)
+	}
+	if res, _ := client.Get(ctx, &pb.GetRequest{Key: "a"}); res.Code != pb.Code_NOT_FOUND {
+		t.Fatalf("deleted value found : %v", res.Code)
+	}
+
+	// abort
+	stream.call(t, &pb.TxnRequest{Op: pb.TxnOp_BEGIN}, pb.Code_OK)
+	stream.call(t, &pb.TxnRequest{Op: pb.TxnOp_WRITE, Key: "c", Value: []byte("3")}, pb.Code_OK)
+	stream.call(t, &pb.TxnRequest{Op: pb.TxnOp_ABORT}, pb.Code_OK)
+	if res, _ := client.Get(ctx, &pb.GetRequest{Key: "c"}); res.Code != pb.Code_NOT_FOUND {
+		t.Fatalf("aborted value found : %v", res.Code)
+	}
+
+	// deadline releases locks while the client is idle
+	stream.call(t, &pb.TxnRequest{Op: pb.TxnOp_BEGIN, TimeoutMs: 50}, pb.Code_OK)
+	stream.call(t, &pb.TxnRequest{Op: pb.TxnOp_WRITE, Key: "b", Value: []byte("4")}, pb.Code_OK)
+	done := make(chan *pb.GetResponse)
+	go func() {
+		res, _ := client.Get(ctx, &pb.GetRequest{Key: "b"})
+		done <- res
+	}()
+	select {
+	case res := <-done:
+		if !bytes.Equal(res.Value, []byte("2")) {
+			t.Fatalf("value of expired transaction is visible : %q", res.Value)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("lock is not released by the deadline")
+	}
+	stream.call(t, &pb.TxnRequest{Op: pb.TxnOp_COMMIT}, pb.Code_DEADLINE_EXCEEDED)
+	stream.call(t, &pb.TxnRequest{Op: pb.TxnOp_ABORT}, pb.Code_OK)
+
+	// deadline aborts the transaction waiting for the lock held by another transaction
+	stream.call(t, &pb.TxnRequest{Op: pb.TxnOp_BEGIN}, pb.Code_OK)
+	stream.call(t, &pb.TxnRequest{Op: pb.TxnOp_WRITE, Key: "b", Value: []byte("5")}, pb.Code_OK)
+	waiting := openTestTxnStream(t, ctx, client)
+	waiting.call(t, &pb.TxnRequest{Op: pb.TxnOp_BEGIN, TimeoutMs: 50}, pb.Code_OK)
+	waiting.call(t, &pb.TxnRequest{Op: pb.TxnOp_READ, Key: "c"}, pb.Code_NOT_FOUND)
+	waiting.call(t, &pb.TxnRequest{Op: pb.TxnOp_WRITE, Key: "b", Value: []byte("6")}, pb.Code_DEADLINE_EXCEEDED)
+	waiting.call(t, &pb.TxnRequest{Op: pb.TxnOp_COMMIT}, pb.Code_DEADLINE_EXCEEDED)
+	stream.call(t, &pb.TxnRequest{Op: pb.TxnOp_COMMIT}, pb.Code_OK)
+	// the lock acquired after the deadline is released
+	if res, err := client.Put(ctx, &pb.PutRequest{Key: "b", Value: []byte("7")}); err != nil || res.Code != pb.Code_OK {
+		t.Fatalf("put after the deadline : %v %v", res, err)
+	}
+
+	// canceled call is reported by the status of gRPC
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := client.Get(canceled, &pb.GetRequest{Key: "b"}); status.Code(err) != codes.Canceled {
+		t.Errorf("canceled get : %v", err)
+	}
+
+	// end of stream aborts the transaction
+	stream.call(t, &pb.TxnRequest{Op: pb.TxnOp_BEGIN}, pb.Code_OK)
+	stream.call(t, &pb.TxnRequest{Op: pb.TxnOp_WRITE, Key: "d", Value: []byte("5")}, pb.Code_OK)
+	if err := stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	} else if _, err = stream.Recv(); err != io.EOF {
+		t.Fatalf("txn stream : %v", err)
+	}
+	for i := 0; ; i++ {
+		res, _ := client.Get(ctx, &pb.GetRequest{Key: "d"})
+		if res.Code == pb.Code_NOT_FOUND {
+			break
+		} else if i == 100 {
+			t.Fatalf("value of unfinished transaction found : %v", res.Code)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTxnService_ACL(t *testing.T) {
+	storage := createTestStorage(t)
+	defer storage.wal.Close()
+	acl, err := LoadACL(filepath.Join(tmpdir, "acl.json"))
+	if err != nil {
+		t.Fatal(err)
+	} else if err = acl.AddUser("alice", "secret", false); err != nil {
+		t.Fatal(err)
+	} else if err = acl.Grant("alice", "alice/", PermRead|PermWrite); err != nil {
+		t.Fatal(err)
+	}
+	token, err := acl.NewToken("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.EnableACL(acl)
+	client := dialTestGRPC(t, storage)
+	put := func(auth, key string) (pb.Code, error) {
+		ctx := context.Background()
+		if auth != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, "authorization", auth)
+		}
+		res, err := client.Put(ctx, &pb.PutRequest{Key: key, Value: []byte("value")})
+		if err != nil {
+			return 0, err
+		}
+		return res.Code, nil
+	}
+
+	if code, err := put("", "alice/a"); err != nil || code != pb.Code_UNAUTHENTICATED {
+		t.Errorf("put without authorization : %v %v", code, err)
+	}
+	if code, err := put("Bearer "+token, "alice/a"); err != nil || code != pb.Code_OK {
+		t.Errorf("put by token : %v %v", code, err)
+	}
+	basic := "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:secret"))
+	if code, err := put(basic, "bob/a"); err != nil || code != pb.Code_PERMISSION_DENIED {
+		t.Errorf("put without grant : %v %v", code, err)
+	}
+	if _, err := put("Bearer invalid", "alice/a"); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("put by invalid token : %v", err)
+	}
+
+	// streams are authenticated by the metadata
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", basic)
+	stream := openTestTxnStream(t, ctx, client)
+	stream.call(t, &pb.TxnRequest{Op: pb.TxnOp_BEGIN}, pb.Code_OK)
+	if res := stream.call(t, &pb.TxnRequest{Op: pb.TxnOp_READ, Key: "alice/a"}, pb.Code_OK); string(res.Value) != "value" {
+		t.Errorf("read : %q", res.Value)
+	}
+	stream.call(t, &pb.TxnRequest{Op: pb.TxnOp_ABORT}, pb.Code_OK)
+}
+
+func TestTxnService_BulkLoad(t *testing.T) {
+	for _, skipWAL := range []bool{false, true} {
+		storage := createTestStorage(t)
+		client := dialTestGRPC(t, storage)
+		stream, err := client.BulkLoad(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var n int
+		for _, size := range []int{bulkLoadBatch + 10, 10} {
+			req := &pb.BulkLoadRequest{SkipWal: skipWAL}
+			for i := 0; i < size; i++ {
+				req.Records = append(req.Records, &pb.KeyValue{Key: fmt.Sprintf("key%05d", n), Value: []byte("value")})
+				n++
+			}
+			if err = stream.Send(req); err != nil {
+				t.Fatal(err)
+			}
+			if res, err := stream.Recv(); err != nil {
+				t.Fatal(err)
+			} else if res.Code != pb.Code_OK || res.Loaded != bulkLoadBatch || res.Done {
+				t.Errorf("progress of bulk load : %+v", res)
+			}
+		}
+		if err = stream.CloseSend(); err != nil {
+			t.Fatal(err)
+		}
+		if res, err := stream.Recv(); err != nil {
+			t.Fatal(err)
+		} else if res.Code != pb.Code_OK || res.Loaded != uint64(n) || !res.Done {
+			t.Errorf("end of bulk load : %+v", res)
+		}
+		if _, err = stream.Recv(); err != io.EOF {
+			t.Errorf("bulk load : %v", err)
+		}
+
+		stats := storage.Stats()
+		if stats.Keys != n || stats.Version != 2 {
+			t.Errorf("stats after bulk load (skip WAL %v) : %+v", skipWAL, stats)
+		} else if skipWAL && (stats.WALBytes != 0 || stats.WALSize != 0) {
+			t.Errorf("WAL is written by bulk load : %+v", stats)
+		} else if !skipWAL && stats.WALSize == 0 {
+			t.Errorf("WAL is not written by bulk load")
+		}
+		if v, err := storage.Get("key04100"); err != nil || string(v) != "value" {
+			t.Errorf("loaded record : %q %v", v, err)
+		}
+		storage.wal.Close()
+	}
+}
+
+func TestTxnService_BulkLoadDenied(t *testing.T) {
+	storage := createTestStorage(t)
+	defer storage.wal.Close()
+	acl, err := LoadACL(filepath.Join(tmpdir, "acl.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.EnableACL(acl)
+	client := dialTestGRPC(t, storage)
+	stream, err := client.BulkLoad(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = stream.Send(&pb.BulkLoadRequest{Records: []*pb.KeyValue{{Key: "key1", Value: []byte("value")}}}); err != nil {
+		t.Fatal(err)
+	}
+	// the stream ends at the failure
+	if res, err := stream.Recv(); err != nil {
+		t.Fatal(err)
+	} else if res.Code != pb.Code_UNAUTHENTICATED || res.Done {
+		t.Errorf("bulk load without authorization : %+v", res)
+	}
+	if _, err = stream.Recv(); err != io.EOF {
+		t.Errorf("bulk load after failure : %v", err)
+	}
+	if _, err = storage.Get("key1"); err != ErrNotExist {
+		t.Errorf("denied record is loaded : %v", err)
+	}
+}
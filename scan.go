@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"sort"
+	"strings"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// scanStart is the cursor which starts the iteration and is returned at the end of it.
+const scanStart = "0"
+
+// encodeCursor returns the opaque cursor which resumes the iteration after key. the cursor is
+// prefixed by "c", so that it is never scanStart even if the key is empty.
+func encodeCursor(key string) string {
+	return "c" + base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+func decodeCursor(cursor string) (after string, started bool, err error) {
+	if cursor == scanStart {
+		return "", false, nil
+	}
+	if !strings.HasPrefix(cursor, "c") {
+		return "", false, ErrInvalidCursor
+	}
+	b, err := base64.RawURLEncoding.DecodeString(cursor[1:])
+	if err != nil {
+		return "", false, ErrInvalidCursor
+	}
+	return string(b), true, nil
+}
+
+// ScanKeys examines committed keys with the prefix after the cursor in key order up to count,
+// and returns the keys accepted by match and the cursor to resume. The cursor is "0" at the
+// start and the end of iteration. The cursor is the last examined key, so that keys which exist
+// during the whole iteration are returned exactly once even if other keys are written
+// concurrently. Internal keys of the storage and records whose TTL passes are skipped. Records
+// are not locked, and only muDB is held while examining one batch.
+func (s *Storage) ScanKeys(cursor, prefix string, count int, match func(key string) bool) ([]string, string, error) {
+	after, started, err := decodeCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	if count < 1 {
+		count = 1
+	}
+	var (
+		examined []string
+		more     bool
+	)
+	s.muDB.RLock()
+	if _, ok := orderedOf(s.db); ok {
+		err = s.db.Keys(prefix, func(key string) bool {
+			if (started && key <= after) || hiddenKey(prefix, key) {
+				return true
+			} else if len(examined) == count {
+				more = true
+				return false
+			}
+			examined = append(examined, key)
+			return true
+		})
+	} else {
+		// all keys after the cursor are sorted to find the batch
+		err = s.db.Keys(prefix, func(key string) bool {
+			if (!started || key > after) && !hiddenKey(prefix, key) {
+				examined = append(examined, key)
+			}
+			return true
+		})
+		if err == nil && len(examined) > count {
+			sort.Strings(examined)
+			examined, more = examined[:count], true
+		}
+	}
+	var live []string
+	if err == nil {
+		// expired records are examined to resume after them, but not returned
+		live, err = s.liveKeys(examined)
+	}
+	s.muDB.RUnlock()
+	if err != nil {
+		return nil, "", err
+	}
+	sort.Strings(examined)
+
+	next := scanStart
+	if more {
+		next = encodeCursor(examined[len(examined)-1])
+	}
+	sort.Strings(live)
+	keys := live[:0]
+	for _, key := range live {
+		if match == nil || match(key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, next, nil
+}
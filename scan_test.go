@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStorage_ScanKeys(t *testing.T) {
+	for _, engine := range []string{"map", "btree"} {
+		t.Run(engine, func(t *testing.T) {
+			storage := createTestStorage(t)
+			defer storage.wal.Close()
+			if engine == "btree" {
+				storage.db = newBTree(testDBPath, defaultCachePages)
+			}
+			for i := 0; i < 10; i++ {
+				if err := storage.Put(fmt.Sprintf("key%d", i), []byte("value")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := storage.Put("other", []byte("value")); err != nil {
+				t.Fatal(err)
+			}
+
+			// keys written between batches do not break the cursor
+			var scanned []string
+			cursor := "0"
+			for i := 0; ; i++ {
+				keys, next, err := storage.ScanKeys(cursor, "key", 3, func(key string) bool {
+					return !strings.HasSuffix(key, "5")
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				scanned = append(scanned, keys...)
+				if next == "0" {
+					break
+				}
+				cursor = next
+				if i == 0 {
+					if err = storage.Delete("key0"); err != nil {
+						t.Fatal(err)
+					} else if err = storage.Delete("key4"); err != nil {
+						t.Fatal(err)
+					} else if err = storage.Put("key00", []byte("value")); err != nil {
+						t.Fatal(err)
+					} else if err = storage.Put("key99", []byte("value")); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			expected := []string{"key0", "key1", "key2", "key3", "key6", "key7", "key8", "key9", "key99"}
+			if !reflect.DeepEqual(scanned, expected) {
+				t.Errorf("scanned keys %v, expected %v", scanned, expected)
+			}
+
+			if _, _, err := storage.ScanKeys("1", "", 1, nil); err != ErrInvalidCursor {
+				t.Errorf("scan with invalid cursor : %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrSelfCheck is returned by Open if the self-check finds fatal problems with
+// Options.SelfCheckStrict.
+var ErrSelfCheck = errors.New("self-check found fatal problems")
+
+// levels of the self-check by Options.SelfCheck.
+const (
+	// SelfCheckOff opens the storage without the self-check.
+	SelfCheckOff = "off"
+	// SelfCheckFast checks continuity of commit versions replayed from WAL, MANIFEST of the data
+	// directory and checksums of records sampled from the engine.
+	SelfCheckFast = "fast"
+	// SelfCheckThorough checks all records, WAL and structures of the engine by Verify in
+	// addition to SelfCheckFast.
+	SelfCheckThorough = "thorough"
+)
+
+// selfCheckSamples is the number of records read by SelfCheckFast.
+const selfCheckSamples = 64
+
+// maxLSNProblems is the number of problems of commit versions kept by LoadWAL.
+const maxLSNProblems = 16
+
+// lsnChecker checks that commit versions replayed from WAL continue from the snapshot version
+// without going back. Gaps are not fatal because commits which failed to be written by the
+// full disk return their versions.
+type lsnChecker struct {
+	// last is the version of the last commit replayed, or of the snapshot.
+	last     uint64
+	replayed bool
+	problems []VerifyProblem
+}
+
+// commit checks the version of the commit log at offset.
+func (c *lsnChecker) commit(version uint64, offset int64) {
+	if version == 0 {
+		return
+	}
+	// commits saved into the snapshot before the crash are replayed again at the head of WAL
+	var p *VerifyProblem
+	if c.replayed && version <= c.last {
+		p = &VerifyProblem{Check: "lsn", Fatal: true, Detail: fmt.Sprintf("commit version %d at offset %d is not after %d", version, offset, c.last)}
+	} else if version > c.last+1 {
+		p = &VerifyProblem{Check: "lsn", Detail: fmt.Sprintf("commit version %d at offset %d skips versions after %d", version, offset, c.last)}
+	}
+	if p != nil && len(c.problems) < maxLSNProblems {
+		c.problems = append(c.problems, *p)
+	}
+	if !c.replayed || version > c.last {
+		c.last = version
+	}
+	c.replayed = true
+}
+
+// selfCheck verifies the storage at the end of Open by opts.SelfCheck, and logs problems found.
+// It returns ErrSelfCheck only if a fatal problem is found with opts.SelfCheckStrict.
+func (s *Storage) selfCheck(opts *Options) error {
+	r := &VerifyReport{Start: time.Now(), Problems: []VerifyProblem{}}
+	s.muWAL.Lock()
+	r.Problems = append(r.Problems, s.lsnProblems...)
+	s.muWAL.Unlock()
+	s.checkManifest(opts, r)
+	if opts.SelfCheck == SelfCheckThorough {
+		v, err := s.Verify(context.Background())
+		if err != nil {
+			return err
+		}
+		for _, p := range v.Problems {
+			p.Fatal = true
+			r.problem(p)
+		}
+		r.Records, r.Pages, r.WALLogs, r.WALBytes = v.Records, v.Pages, v.WALLogs, v.WALBytes
+	} else {
+		s.sampleRecords(r)
+	}
+	r.Elapsed = time.Since(r.Start)
+
+	var fatal *VerifyProblem
+	for i, p := range r.Problems {
+		if p.Fatal {
+			s.logger().Error("self-check found fatal problem", "check", p.Check, "key", p.Key, "detail", p.Detail)
+			if fatal == nil {
+				fatal = &r.Problems[i]
+			}
+		} else {
+			s.logger().Warn("self-check found problem", "check", p.Check, "key", p.Key, "detail", p.Detail)
+		}
+	}
+	s.logger().Info("self-check is done", "level", opts.SelfCheck, "records", r.Records, "problems", len(r.Problems), "elapsed", r.Elapsed)
+	if fatal != nil && opts.SelfCheckStrict {
+		return fmt.Errorf("%w : %v", ErrSelfCheck, fatal.Detail)
+	}
+	return nil
+}
+
+// checkManifest checks that MANIFEST of the data directory is readable and names the files
+// opened. The backend and partitions in it are checked by Open regardless of the self-check.
+func (s *Storage) checkManifest(opts *Options, r *VerifyReport) {
+	if opts.Dir == "" || opts.readOnly {
+		return
+	}
+	m, err := readManifest(opts.fs(), opts.Dir)
+	if err != nil {
+		r.problem(VerifyProblem{Check: "manifest", Fatal: true, Detail: fmt.Sprintf("failed to read : %v", err)})
+		return
+	}
+	expected := opts.newManifest()
+	if m.WAL != expected.WAL && !opts.DisableWAL {
+		r.problem(VerifyProblem{Check: "manifest", Detail: fmt.Sprintf("WAL is %v, but %v is opened", m.WAL, expected.WAL)})
+	}
+	if m.Snapshot != expected.Snapshot {
+		r.problem(VerifyProblem{Check: "manifest", Detail: fmt.Sprintf("data file is %v, but %v is opened", m.Snapshot, expected.Snapshot)})
+	}
+}
+
+// sampleRecords reads records at even intervals of keys, so that checksums of pages or values
+// are verified by the engine.
+func (s *Storage) sampleRecords(r *VerifyReport) {
+	s.muWAL.Lock()
+	version := s.version
+	s.muWAL.Unlock()
+	var keys []string
+	s.muDB.RLock()
+	defer s.muDB.RUnlock()
+	stride := s.db.Len()/selfCheckSamples + 1
+	i := 0
+	err := s.db.Keys("", func(key string) bool {
+		if i%stride == 0 {
+			keys = append(keys, key)
+		}
+		i++
+		return true
+	})
+	if err != nil {
+		r.problem(VerifyProblem{Check: "record", Fatal: true, Detail: fmt.Sprintf("failed to list keys : %v", err)})
+		return
+	}
+	for _, key := range keys {
+		rec, err := s.db.Get(key)
+		if err != nil {
+			r.problem(VerifyProblem{Check: "record", Key: key, Fatal: true, Detail: fmt.Sprintf("failed to read : %v", err)})
+			continue
+		}
+		r.Records++
+		if rec.Version > version {
+			r.problem(VerifyProblem{Check: "record", Key: key, Fatal: true, Detail: fmt.Sprintf("record has version %d newer than committed version %d", rec.Version, version)})
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLSNChecker(t *testing.T) {
+	c := lsnChecker{last: 5}
+	// commits before the snapshot are replayed again after the crash
+	for _, version := range []uint64{4, 5, 6, 8, 7, 9} {
+		c.commit(version, int64(version))
+	}
+	if len(c.problems) != 2 {
+		t.Fatalf("problems : %+v", c.problems)
+	} else if p := c.problems[0]; p.Fatal || !strings.Contains(p.Detail, "skips versions after 6") {
+		t.Errorf("gap : %+v", p)
+	} else if p = c.problems[1]; !p.Fatal || !strings.Contains(p.Detail, "7 at offset 7 is not after 8") {
+		t.Errorf("version going back : %+v", p)
+	}
+}
+
+func TestOpen_SelfCheck(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	opts := Options{Dir: tmpdir, Backend: "btree", SelfCheck: SelfCheckFast, SelfCheckStrict: true}
+	storage, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i++ {
+		if err = storage.Put(fmt.Sprintf("key%03d", i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, level := range []string{SelfCheckFast, SelfCheckThorough} {
+		opts.SelfCheck = level
+		if storage, err = Open(opts); err != nil {
+			t.Fatalf("self-check %v of consistent storage : %v", level, err)
+		} else if err = storage.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// corrupt the record at the tail of the first leaf which is written before the root
+	corruptFile(t, storage.opts.DBPath, 3*pageSize-1)
+	for _, level := range []string{SelfCheckFast, SelfCheckThorough} {
+		opts.SelfCheck = level
+		if _, err = Open(opts); !errors.Is(err, ErrSelfCheck) {
+			t.Errorf("self-check %v of broken storage : %v", level, err)
+		}
+	}
+	l := &testLogger{}
+	opts.SelfCheckStrict, opts.Logger = false, l
+	storage, err = Open(opts)
+	if err != nil {
+		t.Fatalf("open without strict self-check : %v", err)
+	}
+	defer storage.wal.Close()
+	found := false
+	for _, log := range l.logs {
+		found = found || strings.HasPrefix(log, "ERROR self-check found fatal problem")
+	}
+	if !found {
+		t.Errorf("logs : %q", l.logs)
+	}
+}
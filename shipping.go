@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSegmentBytes     = 16 << 20
+	defaultSegmentInterval  = time.Minute
+	defaultSnapshotInterval = time.Hour
+	defaultRetainSnapshots  = 2
+	defaultShipRetry        = time.Second
+	defaultShipMaxRetry     = time.Minute
+)
+
+// ShippingOptions is the options of Shipper.
+type ShippingOptions struct {
+	// Prefix is the prefix of keys of objects, such as "node1/". Objects are
+	// "<Prefix>snapshots/<version>" written by Backup and "<Prefix>wal/<first>-<last>" of
+	// serialized logs of transactions committed from the first version to the last version,
+	// whose versions are 16 hex digits.
+	Prefix string
+	// SegmentBytes is the size of logs which seals the segment. 16 MiB if 0.
+	SegmentBytes int
+	// SegmentInterval is the max interval between the first commit of the segment and its
+	// upload, which bounds commits lost with the disk. 1 minute if 0.
+	SegmentInterval time.Duration
+	// SnapshotInterval is the interval of uploading snapshots. 1 hour if 0.
+	SnapshotInterval time.Duration
+	// RetainSnapshots is the number of snapshots kept with the segments after the oldest of
+	// them. Older objects are deleted. 2 if 0.
+	RetainSnapshots int
+	// RetryInterval is the first interval of retry after failure. It is doubled for each
+	// failure up to MaxRetryInterval.
+	RetryInterval    time.Duration
+	MaxRetryInterval time.Duration
+}
+
+// Shipper uploads sealed segments of WAL and snapshots of the primary to the object store, so
+// that Bootstrap restores a new node from the store after the node and its disk are lost.
+// Commits are shipped after they are durable, and the segment being filled is lost with the
+// node.
+type Shipper struct {
+	s     *Storage
+	store ObjectStore
+	opts  ShippingOptions
+
+	follower *WALFollower
+	// shipped is the last version in the store, and segment is the logs of transactions after
+	// it which are not uploaded yet.
+	shipped  uint64
+	segment  []byte
+	first    uint64
+	last     uint64
+	sealAt   time.Time
+	snapshot time.Time
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// StartShipping starts shipping to the store. WAL is followed by FollowWAL, so that it requires
+// EnableReplication. Shipping resumes after the last version in the store, and the snapshot is
+// uploaded first if logs after it are not retained.
+func (s *Storage) StartShipping(store ObjectStore, opts ShippingOptions) (*Shipper, error) {
+	if s.repl == nil {
+		return nil, errors.New("shipping WAL requires replication to retain WAL")
+	}
+	if opts.SegmentBytes == 0 {
+		opts.SegmentBytes = defaultSegmentBytes
+	}
+	if opts.SegmentInterval == 0 {
+		opts.SegmentInterval = defaultSegmentInterval
+	}
+	if opts.SnapshotInterval == 0 {
+		opts.SnapshotInterval = defaultSnapshotInterval
+	}
+	if opts.RetainSnapshots == 0 {
+		opts.RetainSnapshots = defaultRetainSnapshots
+	}
+	if opts.RetryInterval == 0 {
+		opts.RetryInterval = defaultShipRetry
+	}
+	if opts.MaxRetryInterval == 0 {
+		opts.MaxRetryInterval = defaultShipMaxRetry
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	sh := &Shipper{s: s, store: store, opts: opts, snapshot: time.Now(), cancel: cancel}
+	snapshots, segments, err := sh.list(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if len(snapshots) > 0 {
+		sh.shipped = snapshots[len(snapshots)-1]
+	}
+	if len(segments) > 0 && segments[len(segments)-1].last > sh.shipped {
+		sh.shipped = segments[len(segments)-1].last
+	}
+	s.muWAL.Lock()
+	version := s.version
+	s.muWAL.Unlock()
+	if sh.shipped > version {
+		cancel()
+		return nil, fmt.Errorf("store has version %d newer than the storage %d", sh.shipped, version)
+	}
+	sh.wg.Add(1)
+	go sh.run(ctx)
+	return sh, nil
+}
+
+// Stop stops shipping, and uploads the segment being filled.
+func (sh *Shipper) Stop() error {
+	sh.cancel()
+	sh.wg.Wait()
+	if sh.follower != nil {
+		sh.follower.Close()
+	}
+	if len(sh.segment) == 0 {
+		return nil
+	}
+	return sh.seal(context.Background())
+}
+
+// Shipped returns the last version uploaded to the store. It must not be called while running.
+func (sh *Shipper) Shipped() uint64 {
+	return sh.shipped
+}
+
+// run ships until ctx is done.
+func (sh *Shipper) run(ctx context.Context) {
+	defer sh.wg.Done()
+	retry := sh.opts.RetryInterval
+	for {
+		err := sh.ship(ctx)
+		if ctx.Err() != nil {
+			return
+		} else if err == nil {
+			retry = sh.opts.RetryInterval
+			continue
+		}
+		sh.s.logger().Error("failed to ship WAL", "err", err)
+		select {
+		case <-time.After(retry):
+		case <-ctx.Done():
+			return
+		}
+		if retry *= 2; retry > sh.opts.MaxRetryInterval {
+			retry = sh.opts.MaxRetryInterval
+		}
+	}
+}
+
+// ship does one step of shipping, which uploads the snapshot or the sealed segment, or reads
+// the next transaction into the segment.
+func (sh *Shipper) ship(ctx context.Context) error {
+	if sh.follower == nil {
+		from := sh.shipped
+		if sh.last > from {
+			from = sh.last
+		}
+		f, err := sh.s.FollowWAL(from)
+		if errors.Is(err, ErrFollowBehind) {
+			// logs before the snapshot are not needed by Bootstrap
+			return sh.uploadSnapshot(ctx)
+		} else if err != nil {
+			return err
+		}
+		sh.follower = f
+	}
+	now := time.Now()
+	if !now.Before(sh.snapshot.Add(sh.opts.SnapshotInterval)) {
+		return sh.uploadSnapshot(ctx)
+	} else if len(sh.segment) >= sh.opts.SegmentBytes || len(sh.segment) > 0 && !now.Before(sh.sealAt) {
+		return sh.seal(ctx)
+	}
+
+	deadline := sh.snapshot.Add(sh.opts.SnapshotInterval)
+	if len(sh.segment) > 0 && sh.sealAt.Before(deadline) {
+		deadline = sh.sealAt
+	}
+	wctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	logs, err := sh.follower.next(wctx)
+	if err == context.DeadlineExceeded && ctx.Err() == nil {
+		return nil
+	} else if err != nil {
+		if ctx.Err() == nil {
+			// the follower is opened again, or the snapshot is uploaded if logs are lost
+			sh.follower.Close()
+			sh.follower = nil
+		}
+		return err
+	}
+	buf, err := serializeLogs(append(logs, RecordLog{Action: LCommit}))
+	if err != nil {
+		return err
+	}
+	if len(sh.segment) == 0 {
+		sh.first = logs[0].Version
+		sh.sealAt = now.Add(sh.opts.SegmentInterval)
+	}
+	sh.segment = append(sh.segment, buf...)
+	sh.last = logs[0].Version
+	return nil
+}
+
+// seal uploads the segment.
+func (sh *Shipper) seal(ctx context.Context) error {
+	key := fmt.Sprintf("%swal/%016x-%016x", sh.opts.Prefix, sh.first, sh.last)
+	if err := sh.store.Put(ctx, key, sh.segment); err != nil {
+		return err
+	}
+	sh.shipped = sh.last
+	sh.segment = sh.segment[:0]
+	return nil
+}
+
+// uploadSnapshot uploads the snapshot by Backup, and deletes objects older than the retained
+// snapshots.
+func (sh *Shipper) uploadSnapshot(ctx context.Context) error {
+	var buf bytes.Buffer
+	version, err := sh.s.Backup(&buf)
+	if err != nil {
+		return err
+	} else if err = sh.store.Put(ctx, fmt.Sprintf("%ssnapshots/%016x", sh.opts.Prefix, version), buf.Bytes()); err != nil {
+		return err
+	}
+	sh.snapshot = time.Now()
+	if version > sh.shipped {
+		sh.shipped = version
+	}
+	sh.s.logger().Info("snapshot is shipped", "version", version, "size", buf.Len())
+
+	snapshots, segments, err := sh.list(ctx)
+	if err != nil || len(snapshots) <= sh.opts.RetainSnapshots {
+		return err
+	}
+	oldest := snapshots[len(snapshots)-sh.opts.RetainSnapshots]
+	for _, v := range snapshots[:len(snapshots)-sh.opts.RetainSnapshots] {
+		if err = sh.store.Delete(ctx, fmt.Sprintf("%ssnapshots/%016x", sh.opts.Prefix, v)); err != nil {
+			return err
+		}
+	}
+	for _, seg := range segments {
+		if seg.last <= oldest {
+			if err = sh.store.Delete(ctx, seg.key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// shippedSegment is the segment of WAL in the store.
+type shippedSegment struct {
+	key         string
+	first, last uint64
+}
+
+// list returns versions of snapshots and segments in the store ordered by versions.
+func (sh *Shipper) list(ctx context.Context) ([]uint64, []shippedSegment, error) {
+	return listShipped(ctx, sh.store, sh.opts.Prefix)
+}
+
+func listShipped(ctx context.Context, store ObjectStore, prefix string) ([]uint64, []shippedSegment, error) {
+	keys, err := store.List(ctx, prefix+"snapshots/")
+	if err != nil {
+		return nil, nil, err
+	}
+	var snapshots []uint64
+	for _, key := range keys {
+		if v, err := strconv.ParseUint(strings.TrimPrefix(key, prefix+"snapshots/"), 16, 64); err == nil {
+			snapshots = append(snapshots, v)
+		}
+	}
+	if keys, err = store.List(ctx, prefix+"wal/"); err != nil {
+		return nil, nil, err
+	}
+	var segments []shippedSegment
+	for _, key := range keys {
+		name := strings.TrimPrefix(key, prefix+"wal/")
+		if len(name) != 33 || name[16] != '-' {
+			continue
+		}
+		first, err1 := strconv.ParseUint(name[:16], 16, 64)
+		last, err2 := strconv.ParseUint(name[17:], 16, 64)
+		if err1 == nil && err2 == nil && first <= last {
+			segments = append(segments, shippedSegment{key: key, first: first, last: last})
+		}
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i] < snapshots[j] })
+	sort.Slice(segments, func(i, j int) bool { return segments[i].first < segments[j].first })
+	return snapshots, segments, nil
+}
+
+// Bootstrap restores the empty storage from objects shipped with the prefix. The latest
+// snapshot is restored by Restore, and transactions of segments after it are applied in order
+// and written into WAL. It returns the last version restored, and fails if any segment after
+// the snapshot is missing.
+func (s *Storage) Bootstrap(ctx context.Context, store ObjectStore, prefix string) (uint64, error) {
+	snapshots, segments, err := listShipped(ctx, store, prefix)
+	if err != nil {
+		return 0, err
+	} else if len(snapshots) == 0 && len(segments) == 0 {
+		return 0, fmt.Errorf("no objects are shipped with prefix %q", prefix)
+	}
+	var version uint64
+	if len(snapshots) > 0 {
+		r, err := store.Get(ctx, fmt.Sprintf("%ssnapshots/%016x", prefix, snapshots[len(snapshots)-1]))
+		if err != nil {
+			return 0, err
+		}
+		version, err = s.Restore(r)
+		r.Close()
+		if err != nil {
+			return 0, err
+		}
+	} else if err = s.writable(); err != nil {
+		return 0, err
+	} else {
+		s.muWAL.Lock()
+		s.muDB.RLock()
+		err = s.checkEmpty()
+		s.muDB.RUnlock()
+		s.muWAL.Unlock()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	for _, seg := range segments {
+		if seg.last <= version {
+			continue
+		} else if seg.first > version+1 {
+			return version, fmt.Errorf("segments from version %d to %d are missing", version+1, seg.first-1)
+		}
+		r, err := store.Get(ctx, seg.key)
+		if err != nil {
+			return version, err
+		}
+		data, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return version, err
+		}
+		logs, err := deserializeLogs(data)
+		if err != nil {
+			return version, fmt.Errorf("invalid segment %v : %w", seg.key, err)
+		}
+		var pending []RecordLog
+		for _, rlog := range logs {
+			if rlog.Action != LCommit {
+				pending = append(pending, rlog)
+				continue
+			}
+			if len(pending) > 0 && pending[0].Version > version {
+				if err = s.applyEntry(pending[0].Version, pending); err != nil {
+					return version, err
+				}
+				version = pending[0].Version
+			}
+			pending = nil
+		}
+		if len(pending) > 0 || version != seg.last {
+			return version, fmt.Errorf("segment %v is truncated at version %d", seg.key, version)
+		}
+	}
+	return version, s.Checkpoint()
+}
+
+// runBootstrapCommand runs "txngo [flags] bootstrap [-prefix prefix] <url>" and returns the
+// exit status. It restores the empty storage from objects shipped to the object store of the
+// URL, which is given as -ship-to of the lost node.
+func runBootstrapCommand(opts Options, args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("bootstrap", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	prefix := fs.String("prefix", "", "prefix of objects added to the prefix of the URL")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	} else if fs.NArg() != 1 {
+		fmt.Fprintln(stderr, "usage : txngo [flags] bootstrap [-prefix prefix] <url>")
+		return exitUsage
+	}
+	store, base, err := OpenObjectStore(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	}
+	storage, err := Open(opts)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitFailure
+	}
+	version, err := storage.Bootstrap(context.Background(), store, base+*prefix)
+	if cerr := storage.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to bootstrap : %v\n", err)
+		return exitFailure
+	}
+	fmt.Fprintf(stdout, "bootstrapped to version %d\n", version)
+	return exitOK
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// openShipping opens the storage of the name with replication enabled.
+func openShipping(t *testing.T, name string) *Storage {
+	t.Helper()
+	storage, err := Open(Options{WALPath: filepath.Join(tmpdir, name+".wal"), DBPath: filepath.Join(tmpdir, name+".db")})
+	if err != nil {
+		t.Fatal(err)
+	} else if err = storage.EnableReplication(ReplicationOptions{Dir: filepath.Join(tmpdir, name+".replication")}); err != nil {
+		t.Fatal(err)
+	}
+	return storage
+}
+
+// assertBootstrap bootstraps the new storage of the name from the prefix, and compares it with
+// expected.
+func assertBootstrap(t *testing.T, store ObjectStore, prefix, name string, expected *Storage) {
+	t.Helper()
+	storage, err := Open(Options{WALPath: filepath.Join(tmpdir, name+".wal"), DBPath: filepath.Join(tmpdir, name+".db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	version, err := storage.Bootstrap(context.Background(), store, prefix)
+	if err != nil {
+		t.Fatalf("failed to bootstrap : %v", err)
+	} else if version != expected.version || storage.version != version {
+		t.Errorf("bootstrapped to version %v, expected %v", version, expected.version)
+	}
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key%v", i)
+		want, werr := expected.Get(key)
+		got, gerr := storage.Get(key)
+		if werr != gerr || !bytes.Equal(want, got) {
+			t.Errorf("%v : %q %v, expected %q %v", key, got, gerr, want, werr)
+		}
+	}
+	if _, err = storage.Bootstrap(context.Background(), store, prefix); err != ErrNotEmpty {
+		t.Errorf("bootstrap of bootstrapped storage : %v", err)
+	}
+}
+
+func TestStorage_StartShipping(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	store := NewDirObjectStore(filepath.Join(tmpdir, "objects"))
+	opts := ShippingOptions{Prefix: "node1/", SegmentInterval: 10 * time.Millisecond}
+
+	// logs before restart are not retained, so that shipping starts from the snapshot
+	storage, err := Open(Options{WALPath: filepath.Join(tmpdir, "primary.wal"), DBPath: filepath.Join(tmpdir, "primary.db")})
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err = storage.StartShipping(store, opts); err == nil {
+		t.Errorf("shipping is started without replication")
+	}
+	for i := 0; i < 3; i++ {
+		if err = storage.Put(fmt.Sprintf("key%v", i), []byte("old")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+	storage = openShipping(t, "primary")
+	defer storage.Close()
+	shipper, err := storage.StartShipping(store, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 2; i < 6; i++ {
+		if err = storage.Put(fmt.Sprintf("key%v", i), []byte("new")); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err = storage.Delete("key0"); err != nil {
+		t.Fatal(err)
+	} else if err = shipper.Stop(); err != nil {
+		t.Fatal(err)
+	} else if shipper.Shipped() != storage.version {
+		t.Errorf("shipped %v, expected %v", shipper.Shipped(), storage.version)
+	}
+	snapshots, segments, err := listShipped(context.Background(), store, opts.Prefix)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(snapshots) != 1 || snapshots[0] < 3 {
+		t.Fatalf("snapshots %v", snapshots)
+	} else if len(segments) < 2 || segments[0].first != snapshots[0]+1 || segments[len(segments)-1].last != storage.version {
+		t.Errorf("segments %+v", segments)
+	}
+	assertBootstrap(t, store, opts.Prefix, "restored1", storage)
+
+	// shipping resumes after the last segment
+	if shipper, err = storage.StartShipping(store, opts); err != nil {
+		t.Fatal(err)
+	} else if err = storage.Put("key6", []byte("new")); err != nil {
+		t.Fatal(err)
+	} else if err = shipper.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	_, resumed, err := listShipped(context.Background(), store, opts.Prefix)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(resumed) != len(segments)+1 || resumed[len(segments)].first != storage.version {
+		t.Errorf("segments after resume %+v", resumed)
+	}
+	assertBootstrap(t, store, opts.Prefix, "restored2", storage)
+
+	// the missing segment fails bootstrap
+	if err = store.Delete(context.Background(), segments[0].key); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := Open(Options{WALPath: filepath.Join(tmpdir, "restored3.wal"), DBPath: filepath.Join(tmpdir, "restored3.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	if _, err = restored.Bootstrap(context.Background(), store, opts.Prefix); err == nil {
+		t.Errorf("bootstrap succeeds without the segment")
+	}
+
+	// the store of another storage is rejected
+	other := openShipping(t, "other")
+	defer other.Close()
+	if _, err = other.StartShipping(store, opts); err == nil {
+		t.Errorf("shipping to the store ahead of the storage is started")
+	}
+}
+
+func TestShipper_uploadSnapshot(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	store := NewDirObjectStore(filepath.Join(tmpdir, "objects"))
+	storage := openShipping(t, "primary")
+	defer storage.Close()
+	shipper, err := storage.StartShipping(store, ShippingOptions{
+		SegmentInterval:  time.Millisecond,
+		SnapshotInterval: 30 * time.Millisecond,
+		RetainSnapshots:  1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err = storage.Put(fmt.Sprintf("key%v", i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err = shipper.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	snapshots, segments, err := listShipped(context.Background(), store, "")
+	if err != nil {
+		t.Fatal(err)
+	} else if len(snapshots) != 1 {
+		t.Fatalf("snapshots %v are not deleted", snapshots)
+	} else if len(segments) == 0 && snapshots[0] != storage.version || len(segments) > 0 && segments[0].first > snapshots[0]+1 {
+		t.Errorf("segments %+v after the snapshot %v", segments, snapshots[0])
+	}
+	assertBootstrap(t, store, "", "restored", storage)
+}
+
+// failingStore fails puts while fail is set.
+type failingStore struct {
+	ObjectStore
+	fail atomic.Bool
+}
+
+func (s *failingStore) Put(ctx context.Context, key string, data []byte) error {
+	if s.fail.Load() {
+		return errors.New("unavailable")
+	}
+	return s.ObjectStore.Put(ctx, key, data)
+}
+
+func TestShipper_Stop(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	store := &failingStore{ObjectStore: NewDirObjectStore(filepath.Join(tmpdir, "objects"))}
+	store.fail.Store(true)
+	storage := openShipping(t, "primary")
+	defer storage.Close()
+	shipper, err := storage.StartShipping(store, ShippingOptions{SegmentInterval: time.Millisecond, RetryInterval: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	} else if err = storage.Put("key1", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	// the segment failed to upload is kept and uploaded by Stop
+	store.fail.Store(false)
+	if err = shipper.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	assertBootstrap(t, store, "", "restored", storage)
+}
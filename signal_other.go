@@ -0,0 +1,8 @@
+//go:build windows || plan9
+
+package main
+
+import "os"
+
+// promoteSignals is empty because SIGUSR1 is not available on this platform.
+var promoteSignals []os.Signal
@@ -0,0 +1,11 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// promoteSignals promotes the replica.
+var promoteSignals = []os.Signal{syscall.SIGUSR1}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	simSeed  = flag.Int64("sim.seed", 0, "seed of the simulation to replay. seeds from 1 to -sim.seeds if 0")
+	simSeeds = flag.Int("sim.seeds", 20, "number of seeds simulated")
+	simSteps = flag.Int("sim.steps", 400, "number of steps of each simulation")
+)
+
+const (
+	simKeys      = 12
+	simMaxTxns   = 4
+	simStepLimit = 10 * time.Second
+)
+
+// simClock is the mock clock advanced by the simulator.
+type simClock struct {
+	now time.Time
+}
+
+func (c *simClock) Now() time.Time {
+	return c.now
+}
+
+// simTxn is the open transaction and the locks which the simulator expects it to hold.
+type simTxn struct {
+	id  int
+	txn *Txn
+	// writes is the value written by the transaction, or nil if deleted.
+	writes map[string]*string
+	// locks is true for exclusive lock, false for shared lock.
+	locks  map[string]bool
+	logged bool
+}
+
+// simulator drives the randomized workload of one seed. All choices come from rng and the
+// clock only advances by the simulator, so that a failing seed is replayed deterministically.
+// Operations which would block on record locks are not issued; the transaction is aborted
+// instead as no-wait policy, so that concurrent transactions are interleaved in one goroutine.
+type simulator struct {
+	t     *testing.T
+	seed  int64
+	rng   *rand.Rand
+	clock *simClock
+	fs    *faultFS
+	opts  Options
+
+	storage   *Storage
+	audit     *AuditLog
+	auditPath string
+	// auditTime is the time of the last commit which writes the audit entry.
+	auditTime time.Time
+
+	// model is the committed state which must be recovered.
+	model  map[string]string
+	txns   []*simTxn
+	nextID int
+	trace  []string
+}
+
+func newSimulator(t *testing.T, seed int64) *simulator {
+	clock := &simClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	fs := newFaultFS()
+	return &simulator{
+		t:         t,
+		seed:      seed,
+		rng:       rand.New(rand.NewSource(seed)),
+		clock:     clock,
+		fs:        fs,
+		opts:      Options{WALPath: testWALPath, DBPath: testDBPath, FS: fs, Now: clock.Now},
+		auditPath: filepath.Join(tmpdir, "audit.log"),
+		model:     make(map[string]string),
+	}
+}
+
+func (sim *simulator) logf(format string, args ...interface{}) {
+	sim.trace = append(sim.trace, fmt.Sprintf(format, args...))
+}
+
+func (sim *simulator) fatalf(format string, args ...interface{}) {
+	sim.t.Helper()
+	trace := sim.trace
+	if len(trace) > 50 {
+		trace = trace[len(trace)-50:]
+	}
+	sim.t.Fatalf("seed %d : %s\nreplay with -run TestSimulation -sim.seed=%d\nlast steps:\n%s",
+		sim.seed, fmt.Sprintf(format, args...), sim.seed, strings.Join(trace, "\n"))
+}
+
+// do runs the operation and fails if it is blocked, which means the simulator expects locks
+// wrongly or the storage is deadlocked.
+func (sim *simulator) do(fn func()) {
+	sim.t.Helper()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn()
+	}()
+	select {
+	case <-done:
+	case <-time.After(simStepLimit):
+		sim.fatalf("operation is blocked")
+	}
+}
+
+func (sim *simulator) open() {
+	sim.t.Helper()
+	var err error
+	sim.do(func() { sim.storage, err = Open(sim.opts) })
+	if err != nil {
+		sim.fatalf("failed to open : %v", err)
+	}
+	if sim.audit, err = OpenAuditLog(sim.auditPath, false); err != nil {
+		sim.fatalf("failed to open audit log : %v", err)
+	} else if err = sim.storage.EnableAudit(sim.audit); err != nil {
+		sim.fatalf("failed to enable audit log : %v", err)
+	}
+	sim.verify()
+}
+
+// verify checks that the storage has exactly the committed state, and the audit log ends with
+// the entry at the time of the last commit.
+func (sim *simulator) verify() {
+	sim.t.Helper()
+	for i := 0; i < simKeys; i++ {
+		key := simKey(i)
+		v, err := sim.storage.Get(key)
+		if expected, ok := sim.model[key]; ok && (err != nil || string(v) != expected) {
+			sim.fatalf("%s is %q %v, expected %q", key, v, err, expected)
+		} else if !ok && err != ErrNotExist {
+			sim.fatalf("%s is %q %v, expected not exist", key, v, err)
+		}
+	}
+	f, err := os.Open(sim.auditPath)
+	if err != nil {
+		sim.fatalf("failed to open audit log : %v", err)
+	}
+	last, err := VerifyAuditLog(f)
+	f.Close()
+	if err != nil {
+		sim.fatalf("broken audit log : %v", err)
+	} else if !last.Time.Equal(sim.auditTime) {
+		sim.fatalf("last audit entry at %v, expected %v", last.Time, sim.auditTime)
+	}
+}
+
+// crash simulates the power loss. open transactions are lost with the storage.
+func (sim *simulator) crash() {
+	sim.t.Helper()
+	torn := sim.rng.Intn(2) == 0
+	sim.logf("power loss torn=%v", torn)
+	sim.audit.Close()
+	sim.fs.powerLoss(torn)
+	sim.txns = nil
+	sim.open()
+}
+
+func simKey(i int) string {
+	return fmt.Sprintf("key%02d", i)
+}
+
+// conflicts returns true if txn can not take the lock of key without blocking.
+func (sim *simulator) conflicts(txn *simTxn, key string, exclusive bool) bool {
+	for _, other := range sim.txns {
+		if other == txn {
+			continue
+		} else if x, ok := other.locks[key]; ok && (x || exclusive) {
+			return true
+		}
+	}
+	return false
+}
+
+// view returns the value of key seen by txn.
+func (sim *simulator) view(txn *simTxn, key string) (string, bool) {
+	if v, ok := txn.writes[key]; ok {
+		if v == nil {
+			return "", false
+		}
+		return *v, true
+	}
+	v, ok := sim.model[key]
+	return v, ok
+}
+
+func (sim *simulator) remove(txn *simTxn) {
+	for i, other := range sim.txns {
+		if other == txn {
+			sim.txns = append(sim.txns[:i:i], sim.txns[i+1:]...)
+			return
+		}
+	}
+}
+
+func (sim *simulator) abort(txn *simTxn) {
+	sim.logf("txn %d : abort", txn.id)
+	sim.do(txn.txn.Abort)
+	sim.remove(txn)
+}
+
+// step advances the clock and runs one random operation.
+func (sim *simulator) step() {
+	sim.t.Helper()
+	sim.clock.now = sim.clock.now.Add(time.Duration(sim.rng.Intn(1000)) * time.Millisecond)
+
+	switch n := sim.rng.Intn(100); {
+	case n < 3:
+		// the next few writes or syncs of WAL fail
+		sim.fs.crashAt = sim.fs.ops + 1 + sim.rng.Intn(4)
+		sim.fs.partial = sim.rng.Intn(2) == 0
+		sim.logf("inject crash at op %d partial=%v", sim.fs.crashAt, sim.fs.partial)
+		return
+	case n < 4:
+		sim.crash()
+		return
+	case n < 5:
+		sim.checkpoint()
+		return
+	case n < 20 || len(sim.txns) == 0:
+		if len(sim.txns) < simMaxTxns {
+			sim.nextID++
+			txn := &simTxn{id: sim.nextID, txn: sim.storage.NewTxn(), writes: make(map[string]*string), locks: make(map[string]bool)}
+			sim.txns = append(sim.txns, txn)
+			sim.logf("txn %d : begin", txn.id)
+			return
+		}
+	}
+
+	txn := sim.txns[sim.rng.Intn(len(sim.txns))]
+	key := simKey(sim.rng.Intn(simKeys))
+	switch n := sim.rng.Intn(100); {
+	case n < 35:
+		sim.read(txn, key)
+	case n < 65:
+		sim.put(txn, key, fmt.Sprintf("value%d-%d", txn.id, sim.rng.Intn(1000)))
+	case n < 80:
+		sim.delete(txn, key)
+	case n < 95:
+		sim.commit(txn)
+	default:
+		sim.abort(txn)
+	}
+}
+
+func (sim *simulator) read(txn *simTxn, key string) {
+	sim.t.Helper()
+	if sim.conflicts(txn, key, false) {
+		sim.logf("txn %d : read %s conflicts", txn.id, key)
+		sim.abort(txn)
+		return
+	}
+	var (
+		v   []byte
+		err error
+	)
+	sim.do(func() { v, err = txn.txn.Read(key) })
+	sim.logf("txn %d : read %s = %q %v", txn.id, key, v, err)
+	if expected, ok := sim.view(txn, key); ok && (err != nil || string(v) != expected) {
+		sim.fatalf("txn %d read %s = %q %v, expected %q", txn.id, key, v, err, expected)
+	} else if !ok && err != ErrNotExist {
+		sim.fatalf("txn %d read %s = %q %v, expected not exist", txn.id, key, v, err)
+	}
+	if _, ok := txn.locks[key]; !ok {
+		txn.locks[key] = false
+	}
+}
+
+func (sim *simulator) put(txn *simTxn, key, value string) {
+	sim.t.Helper()
+	if sim.conflicts(txn, key, true) {
+		sim.logf("txn %d : put %s conflicts", txn.id, key)
+		sim.abort(txn)
+		return
+	}
+	var err error
+	sim.do(func() { err = txn.txn.Put(key, []byte(value)) })
+	sim.logf("txn %d : put %s %q %v", txn.id, key, value, err)
+	if err != nil {
+		sim.fatalf("txn %d put %s : %v", txn.id, key, err)
+	}
+	txn.writes[key] = &value
+	txn.locks[key] = true
+	txn.logged = true
+}
+
+func (sim *simulator) delete(txn *simTxn, key string) {
+	sim.t.Helper()
+	if sim.conflicts(txn, key, true) {
+		sim.logf("txn %d : delete %s conflicts", txn.id, key)
+		sim.abort(txn)
+		return
+	}
+	var err error
+	sim.do(func() { err = txn.txn.Delete(key) })
+	sim.logf("txn %d : delete %s %v", txn.id, key, err)
+	if _, ok := sim.view(txn, key); ok {
+		if err != nil {
+			sim.fatalf("txn %d delete %s : %v", txn.id, key, err)
+		}
+		txn.writes[key] = nil
+		txn.locks[key] = true
+		txn.logged = true
+	} else if err != ErrNotExist {
+		sim.fatalf("txn %d delete %s = %v, expected not exist", txn.id, key, err)
+	} else if _, ok := txn.locks[key]; !ok {
+		txn.locks[key] = false
+	}
+}
+
+func (sim *simulator) commit(txn *simTxn) {
+	sim.t.Helper()
+	var err error
+	sim.do(func() { err = txn.txn.Commit() })
+	sim.logf("txn %d : commit %v", txn.id, err)
+	if txn.logged {
+		// the audit entry is written before WAL even if the commit fails
+		sim.auditTime = sim.clock.now
+	}
+	if errors.Is(err, errInjected) {
+		// the storage is broken by the failure of WAL
+		sim.crash()
+		return
+	} else if err != nil {
+		sim.fatalf("txn %d commit : %v", txn.id, err)
+	}
+	for key, v := range txn.writes {
+		if v == nil {
+			delete(sim.model, key)
+		} else {
+			sim.model[key] = *v
+		}
+	}
+	sim.remove(txn)
+}
+
+// checkpoint aborts open transactions, and saves the data file and clears WAL.
+func (sim *simulator) checkpoint() {
+	sim.t.Helper()
+	for len(sim.txns) > 0 {
+		sim.abort(sim.txns[0])
+	}
+	var err error
+	sim.do(func() {
+		if err = sim.storage.SaveCheckPoint(); err == nil {
+			err = sim.storage.ClearWAL()
+		}
+	})
+	sim.logf("checkpoint %v", err)
+	if errors.Is(err, errInjected) {
+		sim.crash()
+	} else if err != nil {
+		sim.fatalf("checkpoint : %v", err)
+	}
+}
+
+func (sim *simulator) run(steps int) {
+	sim.t.Helper()
+	sim.open()
+	for i := 0; i < steps; i++ {
+		sim.step()
+	}
+	for len(sim.txns) > 0 {
+		sim.commit(sim.txns[0])
+	}
+	sim.crash()
+}
+
+func TestSimulation(t *testing.T) {
+	seeds := []int64{*simSeed}
+	if *simSeed == 0 {
+		n := *simSeeds
+		if testing.Short() {
+			n = 3
+		}
+		seeds = seeds[:0]
+		for i := 1; i <= n; i++ {
+			seeds = append(seeds, int64(i))
+		}
+	}
+	for _, seed := range seeds {
+		t.Run(fmt.Sprintf("seed=%d", seed), func(t *testing.T) {
+			_ = os.RemoveAll(tmpdir)
+			_ = os.MkdirAll(tmpdir, 0777)
+			newSimulator(t, seed).run(*simSteps)
+		})
+	}
+}
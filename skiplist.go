@@ -0,0 +1,180 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+)
+
+const (
+	skiplistMaxLevel = 16
+	// each level have 1/skiplistBranch nodes of the lower level
+	skiplistBranch = 4
+)
+
+type skipNode struct {
+	entry lsmEntry
+	next  []*skipNode
+	// prev is the previous node at level 0. nil for the first node.
+	prev *skipNode
+}
+
+// skiplist is the sorted list of entries which is safe for concurrent use.
+// entries are iterated in key order without sorting.
+type skiplist struct {
+	mu    sync.RWMutex
+	head  *skipNode
+	tail  *skipNode
+	level int
+	n     int
+	rnd   *rand.Rand
+}
+
+func newSkiplist() *skiplist {
+	return &skiplist{
+		head:  &skipNode{next: make([]*skipNode, skiplistMaxLevel)},
+		level: 1,
+		rnd:   rand.New(rand.NewSource(1)),
+	}
+}
+
+func (s *skiplist) randomLevel() int {
+	level := 1
+	for level < skiplistMaxLevel && s.rnd.Intn(skiplistBranch) == 0 {
+		level++
+	}
+	return level
+}
+
+// findGreaterOrEqual returns the first node not less than the key.
+// if prev is not nil, prev[i] is set to the last node less than the key at level i.
+func (s *skiplist) findGreaterOrEqual(key string, prev []*skipNode) *skipNode {
+	x := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].entry.Key < key {
+			x = x.next[i]
+		}
+		if prev != nil {
+			prev[i] = x
+		}
+	}
+	return x.next[0]
+}
+
+func (s *skiplist) get(key string) (lsmEntry, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if x := s.findGreaterOrEqual(key, nil); x != nil && x.entry.Key == key {
+		return x.entry, true
+	}
+	return lsmEntry{}, false
+}
+
+// set inserts or replaces the entry and returns the replaced entry.
+func (s *skiplist) set(e lsmEntry) (lsmEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var prev [skiplistMaxLevel]*skipNode
+	x := s.findGreaterOrEqual(e.Key, prev[:])
+	if x != nil && x.entry.Key == e.Key {
+		old := x.entry
+		x.entry = e
+		return old, true
+	}
+
+	level := s.randomLevel()
+	if level > s.level {
+		for i := s.level; i < level; i++ {
+			prev[i] = s.head
+		}
+		s.level = level
+	}
+	x = &skipNode{entry: e, next: make([]*skipNode, level)}
+	for i := 0; i < level; i++ {
+		x.next[i] = prev[i].next[i]
+		prev[i].next[i] = x
+	}
+	if prev[0] != s.head {
+		x.prev = prev[0]
+	}
+	if x.next[0] != nil {
+		x.next[0].prev = x
+	} else {
+		s.tail = x
+	}
+	s.n++
+	return lsmEntry{}, false
+}
+
+// delete removes the entry of the key and returns true if it exists.
+func (s *skiplist) delete(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var prev [skiplistMaxLevel]*skipNode
+	x := s.findGreaterOrEqual(key, prev[:])
+	if x == nil || x.entry.Key != key {
+		return false
+	}
+	for i := range x.next {
+		prev[i].next[i] = x.next[i]
+	}
+	if x.next[0] != nil {
+		x.next[0].prev = x.prev
+	} else {
+		s.tail = x.prev
+	}
+	s.n--
+	return true
+}
+
+func (s *skiplist) len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.n
+}
+
+// seek returns the iterator of entries not less than the key.
+func (s *skiplist) seek(key string) *skipIter {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return &skipIter{s: s, nextNode: s.findGreaterOrEqual(key, nil)}
+}
+
+// seekReverse returns the iterator of entries less than the upper key in descending order.
+// if upper is empty, all entries are iterated from the tail.
+func (s *skiplist) seekReverse(upper string) *skipIter {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	it := &skipIter{s: s, reverse: true, nextNode: s.tail}
+	if upper != "" {
+		if x := s.findGreaterOrEqual(upper, nil); x != nil {
+			it.nextNode = x.prev
+		}
+	}
+	return it
+}
+
+type skipIter struct {
+	s        *skiplist
+	reverse  bool
+	nextNode *skipNode
+	cur      lsmEntry
+}
+
+func (it *skipIter) next() (bool, error) {
+	it.s.mu.RLock()
+	defer it.s.mu.RUnlock()
+	if it.nextNode == nil {
+		return false, nil
+	}
+	it.cur = it.nextNode.entry
+	if it.reverse {
+		it.nextNode = it.nextNode.prev
+	} else {
+		it.nextNode = it.nextNode.next[0]
+	}
+	return true, nil
+}
+
+func (it *skipIter) entry() *lsmEntry {
+	return &it.cur
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestSkiplist(t *testing.T) {
+	s := newSkiplist()
+	rnd := rand.New(rand.NewSource(1))
+	expected := make(map[string]string)
+	for i := 0; i < 3000; i++ {
+		key, value := fmt.Sprintf("key%04d", rnd.Intn(1000)), fmt.Sprintf("value%v", i)
+		_, replaced := s.set(lsmEntry{Record: Record{Key: key, Value: []byte(value)}})
+		if _, ok := expected[key]; ok != replaced {
+			t.Fatalf("replaced %v for %q, expected %v", replaced, key, ok)
+		}
+		expected[key] = value
+	}
+	if s.len() != len(expected) {
+		t.Errorf("len not match %v, expected %v", s.len(), len(expected))
+	}
+
+	var keys []string
+	for k, v := range expected {
+		keys = append(keys, k)
+		if e, ok := s.get(k); !ok || string(e.Value) != v {
+			t.Fatalf("value for %q not match %q, expected %q", k, e.Value, v)
+		}
+	}
+	sort.Strings(keys)
+
+	// iterate from the middle in key order
+	iter := s.seek(keys[len(keys)/2])
+	for _, k := range keys[len(keys)/2:] {
+		if ok, _ := iter.next(); !ok {
+			t.Fatalf("iterator ends before %q", k)
+		} else if iter.entry().Key != k {
+			t.Fatalf("key not match %q, expected %q", iter.entry().Key, k)
+		}
+	}
+	if ok, _ := iter.next(); ok {
+		t.Errorf("iterator does not end")
+	}
+}
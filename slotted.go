@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
+const (
+	// header layout : type(1) | count(2) | dataStart(2) | version(8) | crc32(4)
+	slottedHeaderSize = 17
+	// slot layout : offset(2) | length(2)
+	slotSize = 4
+)
+
+var ErrPageFull = errors.New("page is full")
+
+// slottedPage is the page of variable length records. The slot array grows from the header
+// and records grow from the end of the page, so that records can be inserted, updated and
+// deleted in place without moving other records. Each page have the version of the
+// checkpoint which wrote it and the checksum of the whole page.
+type slottedPage []byte
+
+func initSlottedPage(buf []byte, typ uint8) slottedPage {
+	p := slottedPage(buf[:pageSize])
+	for i := range p[:slottedHeaderSize] {
+		p[i] = 0
+	}
+	p[0] = typ
+	p.setDataStart(pageSize)
+	return p
+}
+
+func (p slottedPage) count() int {
+	return int(binary.BigEndian.Uint16(p[1:3]))
+}
+
+func (p slottedPage) setCount(n int) {
+	binary.BigEndian.PutUint16(p[1:3], uint16(n))
+}
+
+func (p slottedPage) dataStart() int {
+	return int(binary.BigEndian.Uint16(p[3:5]))
+}
+
+func (p slottedPage) setDataStart(off int) {
+	binary.BigEndian.PutUint16(p[3:5], uint16(off))
+}
+
+func (p slottedPage) slot(i int) (int, int) {
+	s := slottedHeaderSize + i*slotSize
+	return int(binary.BigEndian.Uint16(p[s:])), int(binary.BigEndian.Uint16(p[s+2:]))
+}
+
+func (p slottedPage) setSlot(i, offset, length int) {
+	s := slottedHeaderSize + i*slotSize
+	binary.BigEndian.PutUint16(p[s:], uint16(offset))
+	binary.BigEndian.PutUint16(p[s+2:], uint16(length))
+}
+
+// freeSpace returns the contiguous free space between slot array and records.
+func (p slottedPage) freeSpace() int {
+	return p.dataStart() - slottedHeaderSize - p.count()*slotSize
+}
+
+// record returns i th record. the returned slice refers the page.
+func (p slottedPage) record(i int) []byte {
+	offset, length := p.slot(i)
+	return p[offset : offset+length]
+}
+
+// insert inserts the record at i th slot.
+func (p slottedPage) insert(i int, rec []byte) error {
+	n := p.count()
+	if i < 0 || i > n {
+		return ErrBrokenPage
+	}
+	if p.freeSpace() < len(rec)+slotSize {
+		p.compact()
+		if p.freeSpace() < len(rec)+slotSize {
+			return ErrPageFull
+		}
+	}
+	offset := p.dataStart() - len(rec)
+	copy(p[offset:], rec)
+	p.setDataStart(offset)
+	// shift slots after i
+	s := slottedHeaderSize + i*slotSize
+	copy(p[s+slotSize:], p[s:slottedHeaderSize+n*slotSize])
+	p.setSlot(i, offset, len(rec))
+	p.setCount(n + 1)
+	return nil
+}
+
+// update replaces i th record. the record is overwritten in place if it is not larger.
+func (p slottedPage) update(i int, rec []byte) error {
+	offset, length := p.slot(i)
+	if len(rec) <= length {
+		copy(p[offset:], rec)
+		p.setSlot(i, offset, len(rec))
+		return nil
+	}
+
+	var err error
+	if p.freeSpace() < len(rec) {
+		// reclaim the old record and others by compaction
+		old := append([]byte(nil), p[offset:offset+length]...)
+		p.setSlot(i, 0, 0)
+		p.compact()
+		if p.freeSpace() < len(rec) {
+			// restore the old record
+			rec, err = old, ErrPageFull
+		}
+	}
+	start := p.dataStart() - len(rec)
+	copy(p[start:], rec)
+	p.setDataStart(start)
+	p.setSlot(i, start, len(rec))
+	return err
+}
+
+// delete removes i th slot. the space of the record is reclaimed by compaction.
+func (p slottedPage) delete(i int) {
+	n := p.count()
+	s := slottedHeaderSize + i*slotSize
+	copy(p[s:], p[s+slotSize:slottedHeaderSize+n*slotSize])
+	p.setCount(n - 1)
+}
+
+// compact packs all records to the end of the page to make free space contiguous.
+func (p slottedPage) compact() {
+	var (
+		buf [pageSize]byte
+		end = pageSize
+	)
+	for i := 0; i < p.count(); i++ {
+		offset, length := p.slot(i)
+		end -= length
+		copy(buf[end:], p[offset:offset+length])
+		p.setSlot(i, end, length)
+	}
+	copy(p[end:], buf[end:])
+	p.setDataStart(end)
+}
+
+func (p slottedPage) version() uint64 {
+	return binary.BigEndian.Uint64(p[5:13])
+}
+
+// seal sets the version and the checksum of the page.
+func (p slottedPage) seal(version uint64) {
+	binary.BigEndian.PutUint64(p[5:13], version)
+	binary.BigEndian.PutUint32(p[13:17], p.checksum())
+}
+
+// checksum calculates crc32 of the page whose checksum field is zero.
+// the page is not modified because it may be memory mapped read only.
+func (p slottedPage) checksum() uint32 {
+	var zero [4]byte
+	sum := crc32.ChecksumIEEE(p[:13])
+	sum = crc32.Update(sum, crc32.IEEETable, zero[:])
+	return crc32.Update(sum, crc32.IEEETable, p[17:])
+}
+
+// verify checks the checksum and the slot array of the page.
+func (p slottedPage) verify() error {
+	if binary.BigEndian.Uint32(p[13:17]) != p.checksum() {
+		return ErrChecksum
+	}
+	if p.freeSpace() < 0 || p.dataStart() > pageSize {
+		return ErrBrokenPage
+	}
+	for i := 0; i < p.count(); i++ {
+		offset, length := p.slot(i)
+		if offset < p.dataStart() || offset+length > pageSize {
+			return ErrBrokenPage
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func assertSlottedPage(t *testing.T, p slottedPage, expected [][]byte) {
+	t.Helper()
+	if p.count() != len(expected) {
+		t.Fatalf("count not match %v, expected %v", p.count(), len(expected))
+	}
+	for i, rec := range expected {
+		if !bytes.Equal(p.record(i), rec) {
+			t.Errorf("record %v not match %q, expected %q", i, p.record(i), rec)
+		}
+	}
+}
+
+func TestSlottedPage(t *testing.T) {
+	var buf [pageSize]byte
+	p := initSlottedPage(buf[:], pageLeaf)
+
+	var expected [][]byte
+	for i := 0; i < 10; i++ {
+		rec := []byte(fmt.Sprintf("record%v", i))
+		// insert at the head to shift slots
+		if err := p.insert(0, rec); err != nil {
+			t.Fatalf("failed to insert : %v", err)
+		}
+		expected = append([][]byte{rec}, expected...)
+	}
+	assertSlottedPage(t, p, expected)
+
+	// update in place
+	free := p.freeSpace()
+	expected[3] = []byte("short")
+	if err := p.update(3, expected[3]); err != nil {
+		t.Fatalf("failed to update : %v", err)
+	} else if p.freeSpace() != free {
+		t.Errorf("free space changed by update in place %v, expected %v", p.freeSpace(), free)
+	}
+	// update with larger record
+	expected[5] = bytes.Repeat([]byte("large"), 10)
+	if err := p.update(5, expected[5]); err != nil {
+		t.Fatalf("failed to update : %v", err)
+	}
+	assertSlottedPage(t, p, expected)
+
+	p.delete(0)
+	expected = expected[1:]
+	assertSlottedPage(t, p, expected)
+
+	// fill the page and the space of old records is reclaimed by compaction
+	for p.freeSpace() >= 100+slotSize {
+		rec := bytes.Repeat([]byte{byte(p.count())}, 100)
+		if err := p.insert(p.count(), rec); err != nil {
+			t.Fatalf("failed to insert : %v", err)
+		}
+		expected = append(expected, rec)
+	}
+	if err := p.insert(0, make([]byte, pageSize)); err != ErrPageFull {
+		t.Errorf("insert into full page is not (page full) : %v", err)
+	}
+	if err := p.update(0, make([]byte, pageSize)); err != ErrPageFull {
+		t.Errorf("update in full page is not (page full) : %v", err)
+	}
+	assertSlottedPage(t, p, expected)
+
+	p.seal(7)
+	if err := p.verify(); err != nil {
+		t.Fatalf("failed to verify : %v", err)
+	} else if p.version() != 7 {
+		t.Errorf("version not match %v, expected 7", p.version())
+	}
+	p[pageSize-1] ^= 0xff
+	if err := p.verify(); err != ErrChecksum {
+		t.Errorf("corrupted page is not (checksum) : %v", err)
+	}
+}
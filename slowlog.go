@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+const defaultSlowLogSize = 128
+
+// SlowLogOptions is the thresholds of the slow log. A transaction is recorded if any of
+// enabled thresholds is exceeded. 0 disables each threshold.
+type SlowLogOptions struct {
+	// Duration is the threshold of the time from the start of the transaction to the end.
+	Duration time.Duration
+	// LockWait is the threshold of the total time waiting for record locks.
+	LockWait time.Duration
+	// Fsync is the threshold of the latency of fsync of WAL by the commit.
+	Fsync time.Duration
+	// Size is the number of recent entries kept in the ring buffer. 0 is 128.
+	Size int
+}
+
+// SlowTxn is the entry of the slow log.
+type SlowTxn struct {
+	// ID is the unique number increasing for each entry.
+	ID       uint64        `json:"id"`
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration_ns"`
+	LockWait time.Duration `json:"lock_wait_ns"`
+	Fsync    time.Duration `json:"fsync_ns"`
+	// Reads and Writes are the number of keys in the read set and the write set.
+	Reads  int `json:"reads"`
+	Writes int `json:"writes"`
+	// Version is the commit version, or 0 if the transaction is aborted or read only.
+	Version   uint64 `json:"version,omitempty"`
+	Committed bool   `json:"committed"`
+}
+
+// slowLog keeps recent slow transactions in the ring buffer.
+type slowLog struct {
+	opts SlowLogOptions
+
+	mu      sync.Mutex
+	entries []SlowTxn
+	// next is the index of entries which the next entry is written.
+	next int
+	id   uint64
+}
+
+// EnableSlowLog starts recording slow transactions with thresholds of opts. It replaces the
+// slow log already enabled, and discards its entries.
+func (s *Storage) EnableSlowLog(opts SlowLogOptions) error {
+	if opts.Duration <= 0 && opts.LockWait <= 0 && opts.Fsync <= 0 {
+		return errors.New("no threshold of slow log is enabled")
+	}
+	if opts.Size <= 0 {
+		opts.Size = defaultSlowLogSize
+	}
+	s.slow.Store(&slowLog{opts: opts})
+	return nil
+}
+
+// SlowLog returns recorded slow transactions from the newest up to n entries. n < 0 returns all.
+func (s *Storage) SlowLog(n int) []SlowTxn {
+	l := s.slow.Load()
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if n < 0 || n > len(l.entries) {
+		n = len(l.entries)
+	}
+	result := make([]SlowTxn, n)
+	for i := range result {
+		result[i] = l.entries[(l.next-1-i+len(l.entries))%len(l.entries)]
+	}
+	return result
+}
+
+// SlowLogLen returns the number of entries in the slow log.
+func (s *Storage) SlowLogLen() int {
+	l := s.slow.Load()
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.entries)
+}
+
+// ResetSlowLog discards all entries in the slow log.
+func (s *Storage) ResetSlowLog() {
+	if l := s.slow.Load(); l != nil {
+		l.mu.Lock()
+		l.entries, l.next = nil, 0
+		l.mu.Unlock()
+	}
+}
+
+// DumpSlowLog writes all entries in the slow log from the newest as JSON lines.
+func (s *Storage) DumpSlowLog(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	for _, entry := range s.SlowLog(-1) {
+		if err := enc.Encode(&entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *slowLog) slow(entry *SlowTxn) bool {
+	return (l.opts.Duration > 0 && entry.Duration >= l.opts.Duration) ||
+		(l.opts.LockWait > 0 && entry.LockWait >= l.opts.LockWait) ||
+		(l.opts.Fsync > 0 && entry.Fsync >= l.opts.Fsync)
+}
+
+func (l *slowLog) record(entry SlowTxn) {
+	if !l.slow(&entry) {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.id++
+	entry.ID = l.id
+	if len(l.entries) < l.opts.Size {
+		l.entries = append(l.entries, entry)
+	} else {
+		l.entries[l.next] = entry
+	}
+	l.next = (l.next + 1) % l.opts.Size
+}
+
+// waitStart returns the time before waiting for a record lock, or zero if the transaction is
+// not traced by the slow log.
+func (txn *Txn) waitStart() time.Time {
+	if txn.start.IsZero() {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// waited adds the time waiting for the lock since start.
+func (txn *Txn) waited(start time.Time) {
+	if !start.IsZero() {
+		txn.lockWait += time.Since(start)
+	}
+}
+
+// traceEnd records the transaction into the slow log if it is slow.
+func (txn *Txn) traceEnd(reads, writes int, version uint64, fsync time.Duration, committed bool) {
+	if txn.start.IsZero() {
+		return
+	}
+	if l := txn.s.slow.Load(); l != nil {
+		l.record(SlowTxn{
+			Start:     txn.start,
+			Duration:  time.Since(txn.start),
+			LockWait:  txn.lockWait,
+			Fsync:     fsync,
+			Reads:     reads,
+			Writes:    writes,
+			Version:   version,
+			Committed: committed,
+		})
+	}
+}
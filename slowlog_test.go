@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStorage_SlowLog(t *testing.T) {
+	storage := createTestStorage(t)
+	defer storage.wal.Close()
+	if err := storage.EnableSlowLog(SlowLogOptions{}); err == nil {
+		t.Errorf("slow log without thresholds is enabled")
+	} else if err = storage.EnableSlowLog(SlowLogOptions{LockWait: 20 * time.Millisecond, Size: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the transaction waiting for the lock is recorded
+	txn1 := storage.NewTxn()
+	if err := txn1.Insert("key1", []byte("value1")); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		txn2 := storage.NewTxn()
+		if _, err := txn2.Read("key1"); err != nil {
+			done <- err
+			return
+		}
+		done <- txn2.Commit()
+	}()
+	time.Sleep(30 * time.Millisecond)
+	if err := txn1.Commit(); err != nil {
+		t.Fatal(err)
+	} else if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	entries := storage.SlowLog(-1)
+	if len(entries) != 1 || entries[0].ID != 1 || entries[0].LockWait < 20*time.Millisecond || entries[0].Reads != 1 || entries[0].Writes != 0 || !entries[0].Committed {
+		t.Fatalf("slow log : %+v", entries)
+	}
+
+	// fast transactions are not recorded, and old entries are dropped from the ring buffer
+	if err := storage.Put("key2", []byte("value2")); err != nil {
+		t.Fatal(err)
+	} else if storage.SlowLogLen() != 1 {
+		t.Errorf("fast transaction is recorded : %+v", storage.SlowLog(-1))
+	}
+	if err := storage.EnableSlowLog(SlowLogOptions{Duration: time.Nanosecond, Size: 2}); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"key3", "key4", "key5"} {
+		if err := storage.Put(key, []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	txn := storage.NewTxn()
+	if err := txn.Delete("key3"); err != nil {
+		t.Fatal(err)
+	}
+	txn.Abort()
+	entries = storage.SlowLog(-1)
+	if len(entries) != 2 || entries[0].ID != 4 || entries[0].Committed || entries[0].Writes != 1 || entries[1].ID != 3 || entries[1].Version != 5 {
+		t.Errorf("ring buffer of slow log : %+v", entries)
+	} else if entries = storage.SlowLog(1); len(entries) != 1 || entries[0].ID != 4 {
+		t.Errorf("newest entry of slow log : %+v", entries)
+	}
+
+	var buf bytes.Buffer
+	if err := storage.DumpSlowLog(&buf); err != nil {
+		t.Fatal(err)
+	} else if lines := strings.Split(strings.TrimSpace(buf.String()), "\n"); len(lines) != 2 || !strings.HasPrefix(lines[0], `{"id":4,`) {
+		t.Errorf("dump of slow log : %v", buf.String())
+	}
+
+	srv := httptest.NewServer(NewAdminServer(storage))
+	defer srv.Close()
+	res, err := http.Get(srv.URL + "/slowlog?count=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if err = json.NewDecoder(res.Body).Decode(&entries); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 1 || entries[0].ID != 4 {
+		t.Errorf("slow log of admin server : %+v", entries)
+	}
+	req, _ := http.NewRequest(http.MethodDelete, srv.URL+"/slowlog", nil)
+	if res, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	} else if res.Body.Close(); res.StatusCode != http.StatusNoContent || storage.SlowLogLen() != 0 {
+		t.Errorf("reset slow log : %v %v", res.StatusCode, storage.SlowLogLen())
+	}
+}
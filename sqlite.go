@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+)
+
+// SQLite database file format written by ExportSQLite. Records are rows of the rowid table in the
+// order of keys, and the table B-tree is built from leaf pages to the root. Integers are big endian.
+// See https://www.sqlite.org/fileformat2.html
+const (
+	sqlitePageSize   = 4096
+	sqliteHeaderSize = 100
+	sqliteLeafTable  = 0x0d
+	sqliteInterior   = 0x05
+	// sqliteVersion is SQLITE_VERSION_NUMBER written in the header.
+	sqliteVersion = 3045000
+
+	// sqliteTable is the table of exported records.
+	sqliteTable       = "records"
+	sqliteCreateTable = "CREATE TABLE records(key TEXT, value BLOB)"
+)
+
+// sqliteChild is the page in the B-tree and the max rowid in it.
+type sqliteChild struct {
+	page  uint32
+	rowid int64
+}
+
+// sqliteWriter writes pages of the SQLite database file. Page 1 has the header and the schema
+// table, and is written at the end.
+type sqliteWriter struct {
+	w        io.WriterAt
+	pages    uint32
+	leaf     []byte
+	cells    int
+	content  int
+	children []sqliteChild
+	rowid    int64
+}
+
+func newSQLiteWriter(w io.WriterAt) *sqliteWriter {
+	return &sqliteWriter{w: w, pages: 1}
+}
+
+func (sw *sqliteWriter) writePage(page uint32, buf []byte) error {
+	_, err := sw.w.WriteAt(buf, int64(page-1)*sqlitePageSize)
+	return err
+}
+
+// appendSQLiteVarint appends the varint of SQLite, which is big endian 7 bits per byte and 8 bits
+// of the 9th byte.
+func appendSQLiteVarint(buf []byte, v uint64) []byte {
+	if v > 1<<56-1 {
+		var b [9]byte
+		b[8] = byte(v)
+		v >>= 8
+		for i := 7; i >= 0; i-- {
+			b[i] = byte(v&0x7f) | 0x80
+			v >>= 7
+		}
+		return append(buf, b[:]...)
+	}
+	var b [8]byte
+	i := len(b) - 1
+	b[i] = byte(v & 0x7f)
+	for v >>= 7; v > 0; v >>= 7 {
+		i--
+		b[i] = byte(v&0x7f) | 0x80
+	}
+	return append(buf, b[i:]...)
+}
+
+// sqliteRecord encodes the row of columns in the record format. A column is the string of TEXT,
+// the []byte of BLOB or the uint32 of INTEGER.
+func sqliteRecord(columns ...interface{}) []byte {
+	var types, body []byte
+	for _, c := range columns {
+		switch c := c.(type) {
+		case string:
+			types = appendSQLiteVarint(types, uint64(len(c))*2+13)
+			body = append(body, c...)
+		case []byte:
+			types = appendSQLiteVarint(types, uint64(len(c))*2+12)
+			body = append(body, c...)
+		case uint32:
+			types = appendSQLiteVarint(types, 4)
+			body = binary.BigEndian.AppendUint32(body, c)
+		}
+	}
+	// the size of the header includes its varint
+	size := len(types) + 1
+	if len(appendSQLiteVarint(nil, uint64(size))) > 1 {
+		size = len(types) + len(appendSQLiteVarint(nil, uint64(len(types)+2)))
+	}
+	record := appendSQLiteVarint(nil, uint64(size))
+	record = append(record, types...)
+	return append(record, body...)
+}
+
+// cell returns the cell of the table leaf for the row, writing the payload which does not fit in
+// the page into overflow pages.
+func (sw *sqliteWriter) cell(rowid int64, payload []byte) ([]byte, error) {
+	cell := appendSQLiteVarint(nil, uint64(len(payload)))
+	cell = appendSQLiteVarint(cell, uint64(rowid))
+	const (
+		usable   = sqlitePageSize
+		maxLocal = usable - 35
+		minLocal = (usable-12)*32/255 - 23
+	)
+	if len(payload) <= maxLocal {
+		return append(cell, payload...), nil
+	}
+	local := minLocal + (len(payload)-minLocal)%(usable-4)
+	if local > maxLocal {
+		local = minLocal
+	}
+	cell = append(cell, payload[:local]...)
+	cell = binary.BigEndian.AppendUint32(cell, sw.pages+1)
+	buf := make([]byte, sqlitePageSize)
+	for rest := payload[local:]; len(rest) > 0; {
+		sw.pages++
+		for i := range buf {
+			buf[i] = 0
+		}
+		n := copy(buf[4:], rest)
+		if rest = rest[n:]; len(rest) > 0 {
+			binary.BigEndian.PutUint32(buf, sw.pages+1)
+		}
+		if err := sw.writePage(sw.pages, buf); err != nil {
+			return nil, err
+		}
+	}
+	return cell, nil
+}
+
+// Add appends the row of the record to the table.
+func (sw *sqliteWriter) Add(r Record) error {
+	// sw.rowid is the last row of the leaf until the row is added
+	cell, err := sw.cell(sw.rowid+1, sqliteRecord(r.Key, r.Value))
+	if err != nil {
+		return err
+	}
+	if sw.leaf != nil && 8+2*(sw.cells+1)+len(cell) > sw.content {
+		if err = sw.flushLeaf(); err != nil {
+			return err
+		}
+	}
+	if sw.leaf == nil {
+		sw.leaf = make([]byte, sqlitePageSize)
+		sw.leaf[0] = sqliteLeafTable
+		sw.cells, sw.content = 0, sqlitePageSize
+	}
+	sw.content -= len(cell)
+	copy(sw.leaf[sw.content:], cell)
+	binary.BigEndian.PutUint16(sw.leaf[8+2*sw.cells:], uint16(sw.content))
+	sw.cells++
+	sw.rowid++
+	return nil
+}
+
+func (sw *sqliteWriter) flushLeaf() error {
+	binary.BigEndian.PutUint16(sw.leaf[3:], uint16(sw.cells))
+	binary.BigEndian.PutUint16(sw.leaf[5:], uint16(sw.content))
+	sw.pages++
+	if err := sw.writePage(sw.pages, sw.leaf); err != nil {
+		return err
+	}
+	sw.children = append(sw.children, sqliteChild{page: sw.pages, rowid: sw.rowid})
+	sw.leaf = nil
+	return nil
+}
+
+// root writes interior pages over the leaf pages until one page remains, and returns the root.
+func (sw *sqliteWriter) root() (uint32, error) {
+	if sw.leaf != nil || len(sw.children) == 0 {
+		if sw.leaf == nil {
+			// the empty table is the empty leaf page
+			sw.leaf = make([]byte, sqlitePageSize)
+			sw.leaf[0] = sqliteLeafTable
+			sw.cells, sw.content = 0, sqlitePageSize
+		}
+		if err := sw.flushLeaf(); err != nil {
+			return 0, err
+		}
+	}
+	children := sw.children
+	for len(children) > 1 {
+		var parents []sqliteChild
+		for len(children) > 0 {
+			page := make([]byte, sqlitePageSize)
+			page[0] = sqliteInterior
+			cells, content := 0, sqlitePageSize
+			// the last child of the page is the right most pointer
+			for len(children) > 1 {
+				cell := binary.BigEndian.AppendUint32(nil, children[0].page)
+				cell = appendSQLiteVarint(cell, uint64(children[0].rowid))
+				if 12+2*(cells+1)+len(cell) > content {
+					break
+				}
+				content -= len(cell)
+				copy(page[content:], cell)
+				binary.BigEndian.PutUint16(page[12+2*cells:], uint16(content))
+				cells++
+				children = children[1:]
+			}
+			right := children[0]
+			children = children[1:]
+			binary.BigEndian.PutUint16(page[3:], uint16(cells))
+			binary.BigEndian.PutUint16(page[5:], uint16(content))
+			binary.BigEndian.PutUint32(page[8:], right.page)
+			sw.pages++
+			if err := sw.writePage(sw.pages, page); err != nil {
+				return 0, err
+			}
+			parents = append(parents, sqliteChild{page: sw.pages, rowid: right.rowid})
+		}
+		children = parents
+	}
+	return children[0].page, nil
+}
+
+// Close writes the B-tree of the table and page 1 with the header and the schema table.
+func (sw *sqliteWriter) Close() error {
+	root, err := sw.root()
+	if err != nil {
+		return err
+	}
+	page := make([]byte, sqlitePageSize)
+	copy(page, "SQLite format 3\x00")
+	binary.BigEndian.PutUint16(page[16:], sqlitePageSize)
+	// file format versions, reserved bytes and payload fractions
+	copy(page[18:], []byte{1, 1, 0, 64, 32, 32})
+	// file change counter and the size of the database file in pages
+	binary.BigEndian.PutUint32(page[24:], 1)
+	binary.BigEndian.PutUint32(page[28:], sw.pages)
+	// schema cookie, schema format and UTF-8
+	binary.BigEndian.PutUint32(page[40:], 1)
+	binary.BigEndian.PutUint32(page[44:], 4)
+	binary.BigEndian.PutUint32(page[56:], 1)
+	// version valid for the change counter
+	binary.BigEndian.PutUint32(page[92:], 1)
+	binary.BigEndian.PutUint32(page[96:], sqliteVersion)
+
+	payload := sqliteRecord("table", sqliteTable, sqliteTable, root, sqliteCreateTable)
+	cell := appendSQLiteVarint(nil, uint64(len(payload)))
+	cell = appendSQLiteVarint(cell, 1)
+	cell = append(cell, payload...)
+	content := sqlitePageSize - len(cell)
+	copy(page[content:], cell)
+	leaf := page[sqliteHeaderSize:]
+	leaf[0] = sqliteLeafTable
+	binary.BigEndian.PutUint16(leaf[3:], 1)
+	binary.BigEndian.PutUint16(leaf[5:], uint16(content))
+	binary.BigEndian.PutUint16(leaf[8:], uint16(content))
+	return sw.writePage(1, page)
+}
+
+// ExportSQLite writes all committed records into the table "records" of the new SQLite database
+// file at path, whose columns are key TEXT and value BLOB, and returns the number of records.
+// Internal keys of the storage are not exported. Rows are in the order of keys. Commits are
+// blocked only while copying records. path must not exist.
+// TODO: stream records without copying all of them in memory
+func (s *Storage) ExportSQLite(path string) (int, error) {
+	records, _, err := s.snapshotRecords()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, r := range records {
+		if !hiddenKey("", r.Key) {
+			records[n] = r
+			n++
+		}
+	}
+	records = records[:n]
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Key < records[j].Key
+	})
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	if err = writeSQLite(f, records); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(path)
+		return 0, err
+	}
+	return len(records), nil
+}
+
+func writeSQLite(w io.WriterAt, records []Record) error {
+	sw := newSQLiteWriter(w)
+	for _, r := range records {
+		if err := sw.Add(r); err != nil {
+			return err
+		}
+	}
+	return sw.Close()
+}
+
+// runExportCommand runs "txngo [flags] export [-format sqlite] OUT" and returns the exit status.
+// The storage is opened read only, so that WAL is replayed without being cleared.
+func runExportCommand(opts Options, args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	format := fs.String("format", "sqlite", "format of OUT : sqlite")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	} else if fs.NArg() != 1 || *format != "sqlite" {
+		fmt.Fprintln(stderr, "usage : txngo [flags] export [-format sqlite] OUT")
+		return exitUsage
+	}
+
+	log.SetOutput(ioutil.Discard)
+	storage, err := OpenReadOnly(opts)
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to open : %v\n", err)
+		return exitFailure
+	}
+	defer storage.Close()
+	n, err := storage.ExportSQLite(fs.Arg(0))
+	if errors.Is(err, os.ErrExist) {
+		fmt.Fprintf(stderr, "%v already exists\n", fs.Arg(0))
+		return exitFailure
+	} else if err != nil {
+		fmt.Fprintf(stderr, "failed to export : %v\n", err)
+		return exitFailure
+	}
+	fmt.Fprintf(stdout, "%d records exported\n", n)
+	return exitOK
+}
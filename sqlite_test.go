@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// readSQLiteVarint reads the varint of SQLite.
+func readSQLiteVarint(buf []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < 8; i++ {
+		v = v<<7 | uint64(buf[i]&0x7f)
+		if buf[i]&0x80 == 0 {
+			return v, i + 1
+		}
+	}
+	return v<<8 | uint64(buf[8]), 9
+}
+
+// readTestSQLite reads rows of the table of the root page in the database file written by
+// ExportSQLite.
+func readTestSQLite(t *testing.T, db []byte, root uint32) (rowids []uint64, rows [][][]byte) {
+	page := db[(root-1)*sqlitePageSize : root*sqlitePageSize]
+	head := page
+	if root == 1 {
+		head = page[sqliteHeaderSize:]
+	}
+	cells := int(binary.BigEndian.Uint16(head[3:]))
+	switch head[0] {
+	case sqliteInterior:
+		for i := 0; i <= cells; i++ {
+			var child uint32
+			if i == cells {
+				child = binary.BigEndian.Uint32(head[8:])
+			} else {
+				child = binary.BigEndian.Uint32(page[binary.BigEndian.Uint16(head[12+2*i:]):])
+			}
+			ids, r := readTestSQLite(t, db, child)
+			rowids, rows = append(rowids, ids...), append(rows, r...)
+		}
+	case sqliteLeafTable:
+		for i := 0; i < cells; i++ {
+			cell := page[binary.BigEndian.Uint16(head[8+2*i:]):]
+			size, n := readSQLiteVarint(cell)
+			rowid, m := readSQLiteVarint(cell[n:])
+			cell = cell[n+m:]
+			payload := cell
+			if size > sqlitePageSize-35 {
+				minLocal := (sqlitePageSize-12)*32/255 - 23
+				local := minLocal + (int(size)-minLocal)%(sqlitePageSize-4)
+				if local > sqlitePageSize-35 {
+					local = minLocal
+				}
+				payload = append([]byte(nil), cell[:local]...)
+				for next := binary.BigEndian.Uint32(cell[local:]); next != 0; {
+					overflow := db[(next-1)*sqlitePageSize : next*sqlitePageSize]
+					payload = append(payload, overflow[4:]...)
+					next = binary.BigEndian.Uint32(overflow)
+				}
+			}
+			payload = payload[:size]
+			hsize, n := readSQLiteVarint(payload)
+			body := payload[hsize:]
+			var row [][]byte
+			for types := payload[n:hsize]; len(types) > 0; {
+				typ, m := readSQLiteVarint(types)
+				types = types[m:]
+				size := int(typ-12) / 2
+				if typ == 4 {
+					size = 4
+				}
+				row = append(row, body[:size])
+				body = body[size:]
+			}
+			rowids, rows = append(rowids, rowid), append(rows, row)
+		}
+	default:
+		t.Fatalf("page %v is not table : %x", root, head[0])
+	}
+	return rowids, rows
+}
+
+func TestStorage_ExportSQLite(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	storage, err := Open(Options{WALPath: testWALPath, DBPath: testDBPath, Backend: "hash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	// values overflow pages and leaf pages are split into interior pages
+	values := make(map[string][]byte)
+	for i := 0; i < 3000; i++ {
+		value := []byte(fmt.Sprintf("value%d", i))
+		if i%100 == 0 {
+			value = bytes.Repeat([]byte{byte(i)}, 4000)
+		}
+		values[fmt.Sprintf("key%04d", i)] = value
+		if err = storage.Put(fmt.Sprintf("key%04d", i), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := filepath.Join(tmpdir, "export.db")
+	if n, err := storage.ExportSQLite(path); err != nil {
+		t.Fatal(err)
+	} else if n != len(values) {
+		t.Errorf("exported %v records", n)
+	}
+	db, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.HasPrefix(db, []byte("SQLite format 3\x00")) {
+		t.Fatalf("header : %q", db[:16])
+	} else if pages := binary.BigEndian.Uint32(db[28:]); len(db) != int(pages)*sqlitePageSize {
+		t.Errorf("%v bytes of %v pages", len(db), pages)
+	}
+	_, schema := readTestSQLite(t, db, 1)
+	if len(schema) != 1 || string(schema[0][1]) != sqliteTable || string(schema[0][4]) != sqliteCreateTable {
+		t.Fatalf("schema : %q", schema)
+	}
+	rowids, rows := readTestSQLite(t, db, binary.BigEndian.Uint32(schema[0][3]))
+	if len(rows) != len(values) {
+		t.Fatalf("%v rows", len(rows))
+	}
+	for i, row := range rows {
+		if rowids[i] != uint64(i+1) {
+			t.Errorf("rowid of row %v : %v", i, rowids[i])
+		} else if key := fmt.Sprintf("key%04d", i); string(row[0]) != key || !bytes.Equal(row[1], values[key]) {
+			t.Errorf("row %v : %q", i, row[0])
+		}
+	}
+
+	if _, err = storage.ExportSQLite(path); !os.IsExist(err) {
+		t.Errorf("export into the existing file : %v", err)
+	}
+}
+
+func TestRunExportCommand(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	opts := Options{WALPath: testWALPath, DBPath: testDBPath, Backend: "btree"}
+	storage := openCloseTestStorage(t)
+	if err := storage.Put("key1", []byte("value1")); err != nil {
+		t.Fatal(err)
+	} else if err = storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(tmpdir, "export.db")
+	var stdout, stderr bytes.Buffer
+	if status := runExportCommand(opts, []string{"-format=sqlite", path}, &stdout, &stderr); status != exitOK {
+		t.Fatalf("status : %v (%s)", status, stderr.String())
+	} else if stdout.String() != "1 records exported\n" {
+		t.Errorf("output : %q", stdout.String())
+	}
+	if status := runExportCommand(opts, []string{path}, &stdout, &stderr); status != exitFailure {
+		t.Errorf("status of existing file : %v", status)
+	} else if !strings.Contains(stderr.String(), "already exists") {
+		t.Errorf("output : %q", stderr.String())
+	}
+	for _, args := range [][]string{{}, {"-format=csv", path}, {"a", "b"}} {
+		if status := runExportCommand(opts, args, &stdout, &stderr); status != exitUsage {
+			t.Errorf("status of %v : %v", args, status)
+		}
+	}
+}
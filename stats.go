@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DataStats is the statistics of the data files and WAL collected by CollectStats without
+// serving them.
+type DataStats struct {
+	Engine string `json:"engine"`
+	// Keys is the number of records, and ValueBytes is the total size of their values.
+	// Records of column families are counted with their encoded keys.
+	Keys          int     `json:"keys"`
+	ValueBytes    int64   `json:"value_bytes"`
+	AvgValueBytes float64 `json:"avg_value_bytes"`
+	MaxValueBytes int     `json:"max_value_bytes"`
+	MaxValueKey   string  `json:"max_value_key,omitempty"`
+	// Version is the last commit version after WAL is replayed.
+	Version uint64 `json:"version"`
+	// SnapshotVersion is the version saved in data files, and SnapshotTime is when they are
+	// modified last. SnapshotExists is false before the first checkpoint.
+	SnapshotExists  bool          `json:"snapshot_exists"`
+	SnapshotVersion uint64        `json:"snapshot_version"`
+	SnapshotBytes   int64         `json:"snapshot_bytes"`
+	SnapshotTime    time.Time     `json:"snapshot_time"`
+	SnapshotAge     time.Duration `json:"snapshot_age"`
+	// WALBytes is the size of WAL. WALSegments and WALSegmentBytes are the number and the size
+	// of WAL segments retained for replicas and archived by RotateWAL.
+	WALBytes        int64 `json:"wal_bytes"`
+	WALSegments     int   `json:"wal_segments"`
+	WALSegmentBytes int64 `json:"wal_segment_bytes"`
+	// Prefixes is the breakdown by prefixes of keys in descending order of the number of keys.
+	Prefixes []PrefixStats `json:"prefixes"`
+}
+
+// PrefixStats is the statistics of records whose keys have the prefix.
+type PrefixStats struct {
+	Prefix        string `json:"prefix"`
+	Keys          int    `json:"keys"`
+	ValueBytes    int64  `json:"value_bytes"`
+	MaxValueBytes int    `json:"max_value_bytes"`
+}
+
+// StatsOptions is the options of CollectStats.
+type StatsOptions struct {
+	// Separator and Depth select the prefix of each key for the breakdown, which ends with the
+	// Depth-th Separator. Keys with fewer separators are counted by the prefix to the last one.
+	// Depth 0 disables the breakdown.
+	Separator string
+	Depth     int
+	// Top is the number of prefixes reported. 0 reports all.
+	Top int
+	// ReplicationDir is the directory of WAL segments retained for replicas. Not counted if
+	// empty.
+	ReplicationDir string
+}
+
+// CollectStats opens the storage of opts read only as OpenReadOnly, and collects the
+// statistics of records by reading them one by one from the engine. It is run against the data
+// directory while no process serves it, or against the copy of it.
+func CollectStats(opts Options, so StatsOptions) (*DataStats, error) {
+	storage, err := OpenReadOnly(opts)
+	if err != nil {
+		return nil, err
+	}
+	defer storage.Close()
+	opts = storage.opts
+	stats := &DataStats{Engine: opts.Backend, Prefixes: []PrefixStats{}}
+	if stats.Engine == "" {
+		stats.Engine = "map"
+	}
+
+	storage.muWAL.Lock()
+	stats.Version, stats.SnapshotVersion, stats.WALBytes = storage.version, storage.snapshotVersion, storage.walSize
+	storage.muWAL.Unlock()
+	paths, _ := filepath.Glob(opts.DBPath + "*")
+	for _, path := range paths {
+		if path != opts.DBPath && !strings.HasPrefix(path, opts.DBPath+".") {
+			continue
+		}
+		size, modified, err := treeSize(path)
+		if err != nil {
+			return nil, err
+		}
+		stats.SnapshotExists = true
+		stats.SnapshotBytes += size
+		if modified.After(stats.SnapshotTime) {
+			stats.SnapshotTime = modified
+		}
+	}
+	if stats.SnapshotExists {
+		stats.SnapshotAge = time.Since(stats.SnapshotTime)
+	}
+	segments, _ := filepath.Glob(opts.WALPath + ".????????????????")
+	if so.ReplicationDir != "" {
+		replicated, _ := filepath.Glob(filepath.Join(so.ReplicationDir, "*.wal"))
+		segments = append(segments, replicated...)
+	}
+	for _, path := range segments {
+		if info, err := os.Stat(path); err == nil {
+			stats.WALSegments++
+			stats.WALSegmentBytes += info.Size()
+		}
+	}
+
+	var keys []string
+	storage.muDB.RLock()
+	defer storage.muDB.RUnlock()
+	err = storage.db.Keys("", func(key string) bool {
+		if !strings.HasPrefix(key, internalPrefix) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	prefixes := make(map[string]*PrefixStats)
+	for _, key := range keys {
+		r, err := storage.db.Get(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %q : %w", key, err)
+		}
+		size := len(r.Value)
+		stats.Keys++
+		stats.ValueBytes += int64(size)
+		if size > stats.MaxValueBytes || stats.Keys == 1 {
+			stats.MaxValueBytes, stats.MaxValueKey = size, key
+		}
+		if so.Depth <= 0 {
+			continue
+		}
+		prefix := keyPrefix(key, so.Separator, so.Depth)
+		p, ok := prefixes[prefix]
+		if !ok {
+			p = &PrefixStats{Prefix: prefix}
+			prefixes[prefix] = p
+		}
+		p.Keys++
+		p.ValueBytes += int64(size)
+		if size > p.MaxValueBytes {
+			p.MaxValueBytes = size
+		}
+	}
+	if stats.Keys > 0 {
+		stats.AvgValueBytes = float64(stats.ValueBytes) / float64(stats.Keys)
+	}
+	for _, p := range prefixes {
+		stats.Prefixes = append(stats.Prefixes, *p)
+	}
+	sort.Slice(stats.Prefixes, func(i, j int) bool {
+		if a, b := stats.Prefixes[i], stats.Prefixes[j]; a.Keys != b.Keys {
+			return a.Keys > b.Keys
+		}
+		return stats.Prefixes[i].Prefix < stats.Prefixes[j].Prefix
+	})
+	if so.Top > 0 && len(stats.Prefixes) > so.Top {
+		stats.Prefixes = stats.Prefixes[:so.Top]
+	}
+	return stats, nil
+}
+
+// keyPrefix returns the prefix of key which ends with the depth-th sep, or with the last sep if
+// key has fewer separators. It is empty if key has no sep.
+func keyPrefix(key, sep string, depth int) string {
+	end := 0
+	for i := 0; i < depth && sep != ""; i++ {
+		j := strings.Index(key[end:], sep)
+		if j < 0 {
+			break
+		}
+		end += j + len(sep)
+	}
+	return key[:end]
+}
+
+// treeSize returns the total size of the file, or of files under the directory, and the latest
+// modification time of them.
+func treeSize(path string) (int64, time.Time, error) {
+	var size int64
+	var modified time.Time
+	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if info.IsDir() {
+			return nil
+		}
+		size += info.Size()
+		if info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+		return nil
+	})
+	return size, modified, err
+}
+
+// WriteText writes the statistics in the human readable format.
+func (s *DataStats) WriteText(w io.Writer) error {
+	fmt.Fprintf(w, "engine            : %s\n", s.Engine)
+	fmt.Fprintf(w, "keys              : %d\n", s.Keys)
+	fmt.Fprintf(w, "values            : %d bytes, %.1f bytes on average\n", s.ValueBytes, s.AvgValueBytes)
+	if s.Keys > 0 {
+		fmt.Fprintf(w, "max value         : %d bytes of %q\n", s.MaxValueBytes, s.MaxValueKey)
+	}
+	fmt.Fprintf(w, "version           : %d\n", s.Version)
+	if s.SnapshotExists {
+		fmt.Fprintf(w, "snapshot          : version %d, %d bytes, saved %s ago\n", s.SnapshotVersion, s.SnapshotBytes, s.SnapshotAge.Round(time.Second))
+	} else {
+		fmt.Fprintf(w, "snapshot          : not found\n")
+	}
+	fmt.Fprintf(w, "wal               : %d bytes\n", s.WALBytes)
+	fmt.Fprintf(w, "wal segments      : %d, %d bytes\n", s.WALSegments, s.WALSegmentBytes)
+	for _, p := range s.Prefixes {
+		fmt.Fprintf(w, "prefix            : %q %d keys, %d bytes, max %d bytes\n", p.Prefix, p.Keys, p.ValueBytes, p.MaxValueBytes)
+	}
+	return nil
+}
+
+// runStatsCommand runs "txngo [flags] stats [-separator SEP] [-depth N] [-top N] [-json]" and
+// returns the exit status.
+func runStatsCommand(opts Options, replicationDir string, args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	separator := fs.String("separator", ":", "separator of prefixes of keys for the breakdown")
+	depth := fs.Int("depth", 1, "number of separators in prefixes of the breakdown (0 disables)")
+	top := fs.Int("top", 20, "number of prefixes with the most keys reported (0 reports all)")
+	asJSON := fs.Bool("json", false, "write the statistics as JSON")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	} else if fs.NArg() > 0 {
+		fmt.Fprintln(stderr, "usage : txngo [flags] stats [-separator SEP] [-depth N] [-top N] [-json]")
+		return exitUsage
+	}
+
+	log.SetOutput(ioutil.Discard)
+	stats, err := CollectStats(opts, StatsOptions{Separator: *separator, Depth: *depth, Top: *top, ReplicationDir: replicationDir})
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to collect statistics : %v\n", err)
+		return exitFailure
+	}
+	if *asJSON {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(stats)
+	} else {
+		err = stats.WriteText(stdout)
+	}
+	if err != nil {
+		return exitFailure
+	}
+	return exitOK
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestKeyPrefix(t *testing.T) {
+	for _, tc := range []struct {
+		key, sep string
+		depth    int
+		prefix   string
+	}{
+		{"user:1:name", ":", 1, "user:"},
+		{"user:1:name", ":", 2, "user:1:"},
+		{"user:1", ":", 3, "user:"},
+		{"plain", ":", 1, ""},
+		{"a//b", "//", 1, "a//"},
+		{"user:1", "", 1, ""},
+	} {
+		if prefix := keyPrefix(tc.key, tc.sep, tc.depth); prefix != tc.prefix {
+			t.Errorf("keyPrefix(%q, %q, %v) : %q, expected %q", tc.key, tc.sep, tc.depth, prefix, tc.prefix)
+		}
+	}
+}
+
+func TestCollectStats(t *testing.T) {
+	for _, backend := range []string{"map", "btree", "hash", "lsm"} {
+		t.Run(backend, func(t *testing.T) {
+			_ = os.RemoveAll(tmpdir)
+			_ = os.MkdirAll(tmpdir, 0777)
+			dir := filepath.Join(tmpdir, "data")
+			storage, err := Open(Options{Dir: dir, Backend: backend})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, kv := range [][2]string{{"user:1", "alice"}, {"user:2", "bob"}, {"item:1", "apple pie"}, {"plain", ""}} {
+				if err = storage.Put(kv[0], []byte(kv[1])); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err = storage.SaveCheckPoint(); err != nil {
+				t.Fatal(err)
+			} else if err = storage.Put("user:3", []byte("carol")); err != nil {
+				t.Fatal(err)
+			} else if err = storage.Delete("plain"); err != nil {
+				t.Fatal(err)
+			}
+			// statistics are not collected while the writer holds the directory
+			if _, err = CollectStats(Options{Dir: dir, Backend: backend}, StatsOptions{}); err != ErrLocked {
+				t.Errorf("collect statistics of the locked directory : %v", err)
+			}
+			// the storage crashes without checkpoint
+			storage.wal.Close()
+			storage.db.Close()
+			storage.dirLock.Close()
+
+			stats, err := CollectStats(Options{Dir: dir, Backend: backend}, StatsOptions{Separator: ":", Depth: 1, Top: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.Keys != 4 || stats.ValueBytes != 22 || stats.MaxValueBytes != 9 || stats.MaxValueKey != "item:1" || stats.AvgValueBytes != 5.5 {
+				t.Errorf("records : %+v", stats)
+			} else if stats.Version != 6 || !stats.SnapshotExists || stats.SnapshotVersion != 4 || stats.SnapshotBytes == 0 || stats.WALBytes == 0 {
+				t.Errorf("files : %+v", stats)
+			} else if len(stats.Prefixes) != 1 || stats.Prefixes[0] != (PrefixStats{Prefix: "user:", Keys: 3, ValueBytes: 13, MaxValueBytes: 5}) {
+				t.Errorf("prefixes : %+v", stats.Prefixes)
+			}
+		})
+	}
+}
+
+func TestRunStatsCommand(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	opts := Options{Dir: filepath.Join(tmpdir, "data")}
+	storage, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = storage.Put("user:1", []byte("alice")); err != nil {
+		t.Fatal(err)
+	} else if err = storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	if status := runStatsCommand(opts, "", nil, &stdout, &stderr); status != exitOK {
+		t.Fatalf("status : %v (%s)", status, stderr.String())
+	} else if !strings.Contains(stdout.String(), "keys              : 1\n") || !strings.Contains(stdout.String(), "snapshot          : version 1, ") {
+		t.Errorf("output :\n%s", stdout.String())
+	}
+
+	stdout.Reset()
+	if status := runStatsCommand(opts, "", []string{"-depth", "0", "-json"}, &stdout, &stderr); status != exitOK {
+		t.Fatalf("status : %v (%s)", status, stderr.String())
+	}
+	var stats DataStats
+	if err = json.Unmarshal(stdout.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	} else if stats.Keys != 1 || stats.MaxValueKey != "user:1" || len(stats.Prefixes) != 0 {
+		t.Errorf("stats : %+v", stats)
+	}
+
+	for _, args := range [][]string{{"-unknown"}, {"arg"}} {
+		if status := runStatsCommand(opts, "", args, &stdout, &stderr); status != exitUsage {
+			t.Errorf("status of %v : %v", args, status)
+		}
+	}
+}
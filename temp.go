@@ -0,0 +1,38 @@
+package main
+
+import "context"
+
+// TB is the subset of testing.TB used by OpenTemp, so that the storage does not import testing.
+type TB interface {
+	Helper()
+	TempDir() string
+	Cleanup(func())
+	Errorf(format string, args ...interface{})
+	Fatalf(format string, args ...interface{})
+}
+
+// OpenTemp opens the storage for tests, and closes it by t.Cleanup. Records are kept only in
+// memory if opts.DisableWAL is true with map backend. Otherwise empty WALPath and DBPath are set
+// to files in t.TempDir, which is removed after the storage is closed. Transactions left running
+// by the test are aborted at cleanup.
+func OpenTemp(t TB, opts Options) *Storage {
+	t.Helper()
+	inMemory := opts.DisableWAL && (opts.Backend == "" || opts.Backend == "map")
+	if !inMemory {
+		dir := t.TempDir()
+		opts.WALPath = inDir(dir, opts.WALPath, defaultWALName)
+		opts.DBPath = inDir(dir, opts.DBPath, defaultDBName)
+	}
+	storage, err := Open(opts)
+	if err != nil {
+		t.Fatalf("failed to open temporary storage : %v", err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := storage.Shutdown(ctx, false); err != nil && err != ErrClosed && err != context.Canceled {
+			t.Errorf("failed to close temporary storage : %v", err)
+		}
+	})
+	return storage
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestOpenTemp(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		opts Options
+	}{
+		{"map", Options{}},
+		{"btree", Options{Backend: "btree"}},
+		{"in memory", Options{DisableWAL: true}},
+	} {
+		var storage *Storage
+		t.Run(tt.name, func(t *testing.T) {
+			storage = OpenTemp(t, tt.opts)
+			if err := storage.Put("key1", []byte("value1")); err != nil {
+				t.Fatal(err)
+			}
+			// the transaction left running is aborted at cleanup
+			txn := storage.NewTxn()
+			assertValue(t, txn, "key1", []byte("value1"))
+			if tt.opts.DisableWAL {
+				if storage.opts.WALPath != "" || storage.opts.DBPath != "" {
+					t.Errorf("files of storage in memory : %v %v", storage.opts.WALPath, storage.opts.DBPath)
+				}
+			} else if _, err := os.Stat(storage.opts.WALPath); err != nil {
+				t.Error(err)
+			}
+		})
+		if err := storage.Put("key2", []byte("value2")); err != ErrClosed {
+			t.Errorf("%v : storage is not closed : %v", tt.name, err)
+		} else if tt.opts.DisableWAL {
+			continue
+		}
+		if _, err := os.Stat(storage.opts.WALPath); !os.IsNotExist(err) {
+			t.Errorf("%v : temporary directory is not removed : %v", tt.name, err)
+		}
+	}
+}
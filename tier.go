@@ -0,0 +1,792 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultColdAfter is the default of -cold-after.
+const defaultColdAfter = 24 * time.Hour
+
+// fileTierGarbage is the garbage bytes of the file tier which triggers rewriting it when they
+// exceed live bytes.
+const fileTierGarbage = 1 << 20
+
+// TierPolicy decides records demoted from the backend, which is the hot tier, into the cold tier
+// at checkpoint. Records not read nor written within ColdAfter are demoted, and least recently
+// accessed records beyond MaxHotRecords are demoted. Each of them is disabled if 0. Access times
+// are kept in memory and reset to the time of Load by restart. Keys used by the storage itself
+// are never demoted.
+type TierPolicy struct {
+	ColdAfter     time.Duration
+	MaxHotRecords int
+}
+
+// TierStats is the statistics of tiers.
+type TierStats struct {
+	HotRecords  int
+	ColdRecords int
+	// HotHits and ColdHits are the number of reads served by each tier. Records read from the
+	// cold tier are promoted into the hot tier.
+	HotHits  uint64
+	ColdHits uint64
+	// Demotions is the number of records demoted into the cold tier.
+	Demotions uint64
+}
+
+// coldTier is the slower tier which keeps records demoted from the hot tier. Writes are durable
+// when they return.
+type coldTier interface {
+	// Load opens the tier and reads the index of keys.
+	Load() error
+	Has(key string) bool
+	// Get returns the record or ErrNotExist.
+	Get(key string) (Record, error)
+	// Put writes records replacing the records of the same keys.
+	Put(records []Record) error
+	Delete(keys []string) error
+	Len() int
+	// Keys returns the sorted keys with the prefix.
+	Keys(prefix string) []string
+	Close() error
+}
+
+// openColdTier opens the cold tier of Options.ColdTier for the backend at dbPath. The file of
+// "file" is opened by fs.
+func openColdTier(fs FS, name, dbPath string) (coldTier, error) {
+	if name == "file" {
+		return &fileTier{path: dbPath + ".cold", fs: fs}, nil
+	}
+	store, prefix, err := OpenObjectStore(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cold tier : %w", err)
+	}
+	return &objectTier{store: store, prefix: prefix}, nil
+}
+
+// tieredEngine keeps recently accessed records in the hot engine and demotes cold records into
+// the cold tier at Save. Reads of the cold tier promote the record, which is kept in promoting
+// until the next write or Save writes it into the hot engine under the exclusive lock of the
+// storage, because Get is called under shared lock.
+//
+// Every key of the cold tier is only in the cold tier, or in stale or promoted. Cold copies of
+// stale keys were overwritten or deleted by commits since the last Save, and are deleted before
+// the hot engine is saved because WAL has the commits until then. Cold copies of promoted keys are
+// deleted after the hot engine is saved. Demoted records are written durably into the cold tier
+// before they are deleted from the hot engine, so that the crash keeps them in either tier, and
+// keys found in both tiers by Load are promoted.
+type tieredEngine struct {
+	hot    Backend
+	cold   coldTier
+	policy TierPolicy
+	now    func() time.Time
+	// readOnly keeps the cold tier as is, because Save of the read only storage fails.
+	readOnly bool
+
+	// mu protects access and promoting which are modified by Get under shared lock. The cold
+	// tier, stale and promoted are modified only under the exclusive lock, so that Get and Keys
+	// read them without mu.
+	mu sync.Mutex
+	// access is the last access time of keys of the hot engine.
+	access    map[string]time.Time
+	promoting map[string]Record
+	stale     map[string]bool
+	promoted  map[string]bool
+	// scans pauses promotion while reads of all records by snapshots are running.
+	scans atomic.Int32
+
+	hotHits, coldHits, demotions *Counter
+}
+
+// orderedTieredEngine is tieredEngine over the ordered engine.
+type orderedTieredEngine struct {
+	*tieredEngine
+	ordered orderedEngine
+}
+
+func newTieredEngine(hot Backend, cold coldTier, policy TierPolicy, r *MetricsRegistry) Backend {
+	t := &tieredEngine{
+		hot:       hot,
+		cold:      cold,
+		policy:    policy,
+		now:       time.Now,
+		access:    make(map[string]time.Time),
+		promoting: make(map[string]Record),
+		stale:     make(map[string]bool),
+		promoted:  make(map[string]bool),
+		hotHits:   r.Counter("txngo_tier_hot_hits_total", "Number of reads served by the hot tier."),
+		coldHits:  r.Counter("txngo_tier_cold_hits_total", "Number of reads served by the cold tier, which promote records."),
+		demotions: r.Counter("txngo_tier_demotions_total", "Number of records demoted into the cold tier."),
+	}
+	if ordered, ok := orderedOf(hot); ok {
+		return &orderedTieredEngine{tieredEngine: t, ordered: ordered}
+	}
+	return t
+}
+
+// tierOf returns the tiered engine under the wrappers.
+func tierOf(e Backend) (*tieredEngine, bool) {
+	for {
+		switch t := e.(type) {
+		case *tieredEngine:
+			return t, true
+		case *orderedTieredEngine:
+			return t.tieredEngine, true
+		}
+		w, ok := e.(unwrapper)
+		if !ok {
+			return nil, false
+		}
+		e = w.unwrap()
+	}
+}
+
+func (t *tieredEngine) Get(key string) (Record, error) {
+	r, err := t.hot.Get(key)
+	if err != ErrNotExist {
+		if err == nil {
+			t.hotHits.Inc()
+			t.touch(key)
+		}
+		return r, err
+	}
+	t.mu.Lock()
+	r, ok := t.promoting[key]
+	if ok {
+		t.access[key] = t.now()
+	}
+	t.mu.Unlock()
+	if ok {
+		t.hotHits.Inc()
+		return r, nil
+	} else if t.stale[key] || !t.cold.Has(key) {
+		return Record{}, ErrNotExist
+	}
+	// the cold tier is modified only under the exclusive lock, and is read without mu
+	if r, err = t.cold.Get(key); err != nil {
+		return r, err
+	}
+	t.coldHits.Inc()
+	if t.scans.Load() == 0 {
+		t.mu.Lock()
+		t.promoting[key] = r
+		t.access[key] = t.now()
+		t.mu.Unlock()
+	}
+	return r, nil
+}
+
+// touch records the access to the key of the hot engine.
+func (t *tieredEngine) touch(key string) {
+	t.mu.Lock()
+	t.access[key] = t.now()
+	t.mu.Unlock()
+}
+
+// promote writes promoting records into the hot engine. It must be called under the exclusive
+// lock.
+func (t *tieredEngine) promote() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, r := range t.promoting {
+		if err := t.hot.Put(r); err != nil {
+			return err
+		}
+		t.promoted[key] = true
+		delete(t.promoting, key)
+	}
+	return nil
+}
+
+// invalidate marks the cold copy of the key stale by the commit.
+func (t *tieredEngine) invalidate(key string) {
+	if t.cold.Has(key) {
+		t.stale[key] = true
+		delete(t.promoted, key)
+	}
+}
+
+func (t *tieredEngine) Put(r Record) error {
+	if err := t.promote(); err != nil {
+		return err
+	} else if err = t.hot.Put(r); err != nil {
+		return err
+	}
+	t.invalidate(r.Key)
+	t.touch(r.Key)
+	return nil
+}
+
+func (t *tieredEngine) Delete(key string) error {
+	if err := t.promote(); err != nil {
+		return err
+	} else if err = t.hot.Delete(key); err != nil {
+		return err
+	}
+	t.invalidate(key)
+	t.mu.Lock()
+	delete(t.access, key)
+	t.mu.Unlock()
+	return nil
+}
+
+func (t *tieredEngine) Len() int {
+	return t.hot.Len() + t.cold.Len() - len(t.stale) - len(t.promoted)
+}
+
+// coldKeys returns the sorted keys with the prefix which are only in the cold tier.
+func (t *tieredEngine) coldKeys(prefix string) []string {
+	keys := t.cold.Keys(prefix)
+	if len(t.stale) == 0 && len(t.promoted) == 0 {
+		return keys
+	}
+	only := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if !t.stale[key] && !t.promoted[key] {
+			only = append(only, key)
+		}
+	}
+	return only
+}
+
+// Keys calls fn for keys of the hot engine, and then for keys only in the cold tier.
+func (t *tieredEngine) Keys(prefix string, fn func(key string) bool) error {
+	stopped := false
+	err := t.hot.Keys(prefix, func(key string) bool {
+		stopped = !fn(key)
+		return !stopped
+	})
+	if err != nil || stopped {
+		return err
+	}
+	for _, key := range t.coldKeys(prefix) {
+		if !fn(key) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Save demotes cold records and deletes stale copies of the cold tier, saves the hot engine, and
+// deletes copies of promoted records from the cold tier.
+func (t *tieredEngine) Save(version uint64) error {
+	if err := t.promote(); err != nil {
+		return err
+	} else if t.readOnly {
+		return t.hot.Save(version)
+	} else if err = t.demote(); err != nil {
+		return err
+	}
+	if err := t.cold.Delete(sortedSet(t.stale)); err != nil {
+		return err
+	}
+	t.stale = make(map[string]bool)
+	if err := t.hot.Save(version); err != nil {
+		return err
+	} else if err = t.cold.Delete(sortedSet(t.promoted)); err != nil {
+		return err
+	}
+	t.promoted = make(map[string]bool)
+	return nil
+}
+
+// demote moves records decided by the policy from the hot engine into the cold tier.
+func (t *tieredEngine) demote() error {
+	t.mu.Lock()
+	type hotKey struct {
+		key string
+		at  time.Time
+	}
+	keys := make([]hotKey, 0, len(t.access))
+	for key, at := range t.access {
+		if !strings.HasPrefix(key, internalPrefix) {
+			keys = append(keys, hotKey{key: key, at: at})
+		}
+	}
+	t.mu.Unlock()
+	sort.Slice(keys, func(i, j int) bool { return keys[i].at.Before(keys[j].at) })
+	n := 0
+	if t.policy.MaxHotRecords > 0 && len(keys) > t.policy.MaxHotRecords {
+		n = len(keys) - t.policy.MaxHotRecords
+	}
+	if t.policy.ColdAfter > 0 {
+		deadline := t.now().Add(-t.policy.ColdAfter)
+		for n < len(keys) && keys[n].at.Before(deadline) {
+			n++
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+	records := make([]Record, 0, n)
+	for _, k := range keys[:n] {
+		r, err := t.hot.Get(k.key)
+		if err == ErrNotExist {
+			continue
+		} else if err != nil {
+			return err
+		}
+		records = append(records, r)
+	}
+	if err := t.cold.Put(records); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, r := range records {
+		if err := t.hot.Delete(r.Key); err != nil {
+			return err
+		}
+		delete(t.access, r.Key)
+		delete(t.stale, r.Key)
+		delete(t.promoted, r.Key)
+	}
+	t.demotions.Add(uint64(len(records)))
+	return nil
+}
+
+// sortedSet returns the sorted keys of the set.
+func sortedSet(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Load loads the hot engine and the index of the cold tier. All keys of the hot engine are
+// accessed at the time of Load.
+func (t *tieredEngine) Load() (uint64, error) {
+	// the cold tier is loaded at the initial start without data file
+	version, err := t.hot.Load()
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	} else if cerr := t.cold.Load(); cerr != nil {
+		return 0, cerr
+	}
+	t.access = make(map[string]time.Time)
+	t.promoting = make(map[string]Record)
+	t.stale = make(map[string]bool)
+	t.promoted = make(map[string]bool)
+	now := t.now()
+	if kerr := t.hot.Keys("", func(key string) bool {
+		t.access[key] = now
+		return true
+	}); kerr != nil {
+		return 0, kerr
+	}
+	for _, key := range t.cold.Keys("") {
+		// the crash after demotion or promotion leaves records in both tiers
+		if _, ok := t.access[key]; ok {
+			t.promoted[key] = true
+		}
+	}
+	return version, err
+}
+
+func (t *tieredEngine) Close() error {
+	err := t.hot.Close()
+	if cerr := t.cold.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// stats returns the statistics of tiers.
+func (t *tieredEngine) stats() TierStats {
+	cold := t.cold.Len() - len(t.stale) - len(t.promoted)
+	return TierStats{
+		HotRecords:  t.Len() - cold,
+		ColdRecords: cold,
+		HotHits:     t.hotHits.Value(),
+		ColdHits:    t.coldHits.Value(),
+		Demotions:   t.demotions.Value(),
+	}
+}
+
+// Keys merges keys of the hot engine and the cold tier in ascending order.
+func (t *orderedTieredEngine) Keys(prefix string, fn func(key string) bool) error {
+	return t.merge(t.ordered.Keys, prefix, false, fn)
+}
+
+// KeysReverse merges keys of the hot engine and the cold tier in descending order.
+func (t *orderedTieredEngine) KeysReverse(prefix string, fn func(key string) bool) error {
+	return t.merge(t.ordered.KeysReverse, prefix, true, fn)
+}
+
+func (t *orderedTieredEngine) merge(keys func(string, func(string) bool) error, prefix string, reverse bool, fn func(key string) bool) error {
+	cold := t.coldKeys(prefix)
+	i := 0
+	next := func() string {
+		if reverse {
+			return cold[len(cold)-1-i]
+		}
+		return cold[i]
+	}
+	stopped := false
+	err := keys(prefix, func(key string) bool {
+		for ; i < len(cold); i++ {
+			if c := next(); (c > key) != reverse {
+				break
+			} else if !fn(c) {
+				stopped = true
+				return false
+			}
+		}
+		stopped = !fn(key)
+		return !stopped
+	})
+	if err != nil || stopped {
+		return err
+	}
+	for ; i < len(cold); i++ {
+		if !fn(next()) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// pauseTiering stops promotion by reads until the returned function is called, so that reads of
+// all records by snapshots do not promote them.
+func (s *Storage) pauseTiering() func() {
+	t, ok := tierOf(s.db)
+	if !ok {
+		return func() {}
+	}
+	t.scans.Add(1)
+	return func() { t.scans.Add(-1) }
+}
+
+// TierStats returns the statistics of tiers of Options.ColdTier.
+func (s *Storage) TierStats() (TierStats, error) {
+	s.muDB.RLock()
+	defer s.muDB.RUnlock()
+	t, ok := tierOf(s.db)
+	if !ok {
+		return TierStats{}, errors.New("cold tier is not enabled")
+	}
+	return t.stats(), nil
+}
+
+// prefixRange returns the range of sorted keys with the prefix.
+func prefixRange(keys []string, prefix string) []string {
+	i := sort.SearchStrings(keys, prefix)
+	j := i
+	for j < len(keys) && strings.HasPrefix(keys[j], prefix) {
+		j++
+	}
+	return keys[i:j]
+}
+
+// fileTier keeps records in the append-only file of logs, whose values are compressed. Put and
+// Delete append logs and sync them, and the file is rewritten with only live records when
+// garbage exceeds live bytes. The torn log at the tail is discarded by Load.
+type fileTier struct {
+	path string
+	fs   FS
+	f    File
+	size int64
+	// index locates the log of each key, and sorted is the sorted keys of index which is
+	// updated by writes, so that Keys is called under shared lock.
+	index   map[string]fileTierEntry
+	sorted  []string
+	live    int64
+	garbage int64
+}
+
+type fileTierEntry struct {
+	offset int64
+	size   int
+}
+
+func (ft *fileTier) Load() error {
+	if ft.f != nil {
+		ft.f.Close()
+	}
+	f, err := ft.fs.OpenFile(ft.path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	ft.f, ft.size, ft.index, ft.live, ft.garbage = f, 0, make(map[string]fileTierEntry), 0, 0
+	r := &countReader{r: bufio.NewReader(f)}
+	for {
+		offset := r.n
+		rlog, err := readRecordLog(r)
+		if err == io.EOF {
+			break
+		} else if err == io.ErrUnexpectedEOF || errors.Is(err, ErrChecksum) {
+			// the torn log of the crash while appending
+			if err = f.Truncate(offset); err != nil {
+				return err
+			}
+			ft.size = offset
+			break
+		} else if err != nil {
+			return fmt.Errorf("failed to load cold tier : %w", err)
+		}
+		ft.apply(rlog, offset, int(r.n-offset))
+		ft.size = r.n
+	}
+	ft.sorted = sortedKeys(ft.index)
+	return nil
+}
+
+// apply updates the index by the log at the offset.
+func (ft *fileTier) apply(rlog RecordLog, offset int64, size int) {
+	if old, ok := ft.index[rlog.Key]; ok {
+		ft.live -= int64(old.size)
+		ft.garbage += int64(old.size)
+	}
+	if rlog.Action == LDelete {
+		delete(ft.index, rlog.Key)
+		ft.garbage += int64(size)
+	} else {
+		ft.index[rlog.Key] = fileTierEntry{offset: offset, size: size}
+		ft.live += int64(size)
+	}
+}
+
+func (ft *fileTier) Has(key string) bool {
+	_, ok := ft.index[key]
+	return ok
+}
+
+func (ft *fileTier) Get(key string) (Record, error) {
+	ent, ok := ft.index[key]
+	if !ok {
+		return Record{}, ErrNotExist
+	}
+	buf := make([]byte, ent.size)
+	if _, err := ft.f.ReadAt(buf, ent.offset); err != nil {
+		return Record{}, err
+	}
+	var rlog RecordLog
+	if _, err := rlog.Deserialize(buf); err != nil {
+		return Record{}, err
+	}
+	value, err := decompressValue(rlog.Value)
+	if err != nil {
+		return Record{}, err
+	}
+	return Record{Key: key, Value: value, Version: rlog.Version}, nil
+}
+
+func (ft *fileTier) Put(records []Record) error {
+	logs := make([]RecordLog, len(records))
+	for i, r := range records {
+		r.Value = compressValue(r.Value)
+		logs[i] = RecordLog{Action: LInsert, Record: r}
+	}
+	return ft.append(logs)
+}
+
+func (ft *fileTier) Delete(keys []string) error {
+	var logs []RecordLog
+	for _, key := range keys {
+		if ft.Has(key) {
+			logs = append(logs, RecordLog{Action: LDelete, Record: Record{Key: key}})
+		}
+	}
+	if err := ft.append(logs); err != nil {
+		return err
+	} else if ft.garbage > fileTierGarbage && ft.garbage > ft.live {
+		return ft.rewrite()
+	}
+	return nil
+}
+
+// append writes logs at the tail of the file and syncs it.
+func (ft *fileTier) append(logs []RecordLog) error {
+	if len(logs) == 0 {
+		return nil
+	}
+	buf, err := serializeLogs(logs)
+	if err != nil {
+		return err
+	} else if _, err = ft.f.WriteAt(buf, ft.size); err != nil {
+		return err
+	} else if err = ft.f.Sync(); err != nil {
+		return err
+	}
+	for len(buf) > 0 {
+		var rlog RecordLog
+		n, _ := rlog.Deserialize(buf)
+		ft.apply(rlog, ft.size, n)
+		ft.size += int64(n)
+		buf = buf[n:]
+	}
+	ft.sorted = sortedKeys(ft.index)
+	return nil
+}
+
+// rewrite writes live records into the new file and replaces the file by it.
+func (ft *fileTier) rewrite() error {
+	tmp := ft.path + ".tmp"
+	f, err := ft.fs.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, key := range ft.Keys("") {
+		ent := ft.index[key]
+		buf := make([]byte, ent.size)
+		if _, err = ft.f.ReadAt(buf, ent.offset); err != nil {
+			break
+		} else if _, err = w.Write(buf); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = ft.fs.Rename(tmp, ft.path)
+	}
+	if err != nil {
+		ft.fs.Remove(tmp)
+		return err
+	}
+	return ft.Load()
+}
+
+func (ft *fileTier) Len() int {
+	return len(ft.index)
+}
+
+func (ft *fileTier) Keys(prefix string) []string {
+	return prefixRange(ft.sorted, prefix)
+}
+
+func sortedKeys(index map[string]fileTierEntry) []string {
+	keys := make([]string, 0, len(index))
+	for key := range index {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (ft *fileTier) Close() error {
+	if ft.f == nil {
+		return nil
+	}
+	return ft.f.Close()
+}
+
+// objectTier keeps each record in the object "<prefix><hex encoded key>", which keeps the order of
+// keys, as the serialized record with the compressed value. Keys are listed by Load.
+type objectTier struct {
+	store  ObjectStore
+	prefix string
+	// keys is the index of objects, and sorted is the sorted keys of it.
+	keys   map[string]bool
+	sorted []string
+}
+
+func (ot *objectTier) Load() error {
+	names, err := ot.store.List(context.Background(), ot.prefix)
+	if err != nil {
+		return fmt.Errorf("failed to load cold tier : %w", err)
+	}
+	ot.keys = make(map[string]bool, len(names))
+	for _, name := range names {
+		key, err := hex.DecodeString(strings.TrimPrefix(name, ot.prefix))
+		if err != nil {
+			continue
+		}
+		ot.keys[string(key)] = true
+	}
+	ot.sorted = sortedSet(ot.keys)
+	return nil
+}
+
+func (ot *objectTier) object(key string) string {
+	return ot.prefix + hex.EncodeToString([]byte(key))
+}
+
+func (ot *objectTier) Has(key string) bool {
+	return ot.keys[key]
+}
+
+func (ot *objectTier) Get(key string) (Record, error) {
+	if !ot.keys[key] {
+		return Record{}, ErrNotExist
+	}
+	body, err := ot.store.Get(context.Background(), ot.object(key))
+	if err != nil {
+		return Record{}, err
+	}
+	data, err := ioutil.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return Record{}, err
+	} else if data, err = decompressValue(data); err != nil {
+		return Record{}, err
+	}
+	var r Record
+	if _, err = r.Deserialize(data); err != nil {
+		return Record{}, err
+	} else if r.Key != key {
+		return Record{}, fmt.Errorf("object of key %q has key %q", key, r.Key)
+	}
+	return r, nil
+}
+
+func (ot *objectTier) Put(records []Record) error {
+	defer func() { ot.sorted = sortedSet(ot.keys) }()
+	for _, r := range records {
+		buf := make([]byte, 13+len(r.Key)+len(r.Value))
+		n, err := r.Serialize(buf)
+		if err != nil {
+			return err
+		} else if err = ot.store.Put(context.Background(), ot.object(r.Key), compressValue(buf[:n])); err != nil {
+			return err
+		}
+		ot.keys[r.Key] = true
+	}
+	return nil
+}
+
+func (ot *objectTier) Delete(keys []string) error {
+	defer func() { ot.sorted = sortedSet(ot.keys) }()
+	for _, key := range keys {
+		if !ot.keys[key] {
+			continue
+		} else if err := ot.store.Delete(context.Background(), ot.object(key)); err != nil {
+			return err
+		}
+		delete(ot.keys, key)
+	}
+	return nil
+}
+
+func (ot *objectTier) Len() int {
+	return len(ot.keys)
+}
+
+func (ot *objectTier) Keys(prefix string) []string {
+	return prefixRange(ot.sorted, prefix)
+}
+
+func (ot *objectTier) Close() error {
+	return nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStorage_ColdTier(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		backend string
+		cold    string
+	}{
+		{name: "map", cold: "file"},
+		{name: "btree", backend: "btree", cold: "file"},
+		{name: "objects", backend: "lsm", cold: "objects"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_ = os.RemoveAll(tmpdir)
+			_ = os.MkdirAll(tmpdir, 0777)
+			now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+			opts := Options{
+				WALPath:    testWALPath,
+				DBPath:     testDBPath,
+				Backend:    tt.backend,
+				ColdTier:   tt.cold,
+				TierPolicy: TierPolicy{ColdAfter: time.Hour, MaxHotRecords: 3},
+				Now:        func() time.Time { return now },
+			}
+			if tt.cold == "objects" {
+				dir, _ := filepath.Abs(filepath.Join(tmpdir, "objects"))
+				opts.ColdTier = "file://" + dir
+			}
+			storage, err := Open(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { storage.Close() }()
+			assertStats := func(hot, cold int) {
+				t.Helper()
+				if stats, err := storage.TierStats(); err != nil {
+					t.Fatal(err)
+				} else if stats.HotRecords != hot || stats.ColdRecords != cold {
+					t.Errorf("stats %+v, expected %v hot and %v cold", stats, hot, cold)
+				}
+			}
+			assertGet := func(key, value string) {
+				t.Helper()
+				if v, err := storage.Get(key); err != nil || string(v) != value {
+					t.Errorf("%v : %q %v, expected %q", key, v, err, value)
+				}
+			}
+			for i := 0; i < 5; i++ {
+				now = now.Add(time.Second)
+				if err = storage.Put(fmt.Sprintf("key%v", i), []byte(fmt.Sprintf("value%v", i))); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// least recently accessed records are demoted
+			if err = storage.Checkpoint(); err != nil {
+				t.Fatal(err)
+			}
+			assertStats(3, 2)
+
+			// read of cold records promotes them, and scan merges tiers
+			assertGet("key0", "value0")
+			if keys, _, err := storage.ScanKeys(scanStart, "key", 10, nil); err != nil || !reflect.DeepEqual(keys, []string{"key0", "key1", "key2", "key3", "key4"}) {
+				t.Errorf("scanned %q %v", keys, err)
+			}
+			if err = storage.Checkpoint(); err != nil {
+				t.Fatal(err)
+			}
+			assertStats(3, 2)
+			if _, err = storage.Backup(ioutilDiscard{}); err != nil {
+				t.Fatal(err)
+			} else if err = storage.Checkpoint(); err != nil {
+				t.Fatal(err)
+			}
+			assertStats(3, 2)
+			if stats, _ := storage.TierStats(); stats.ColdHits != 3 || stats.Demotions != 3 {
+				t.Errorf("stats %+v, expected 3 cold hits and 3 demotions", stats)
+			}
+
+			// commits overwrite and delete cold records
+			if err = storage.Put("key1", []byte("new")); err != nil {
+				t.Fatal(err)
+			} else if err = storage.Delete("key2"); err != nil {
+				t.Fatal(err)
+			} else if _, err = storage.Get("key2"); err != ErrNotExist {
+				t.Errorf("deleted cold record : %v", err)
+			}
+			assertGet("key1", "new")
+
+			// records not accessed for ColdAfter are demoted, and survive restart
+			now = now.Add(2 * time.Hour)
+			if err = storage.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if storage, err = Open(opts); err != nil {
+				t.Fatal(err)
+			}
+			assertStats(0, 4)
+			for key, value := range map[string]string{"key0": "value0", "key1": "new", "key3": "value3", "key4": "value4"} {
+				assertGet(key, value)
+			}
+			if _, err = storage.Get("key2"); err != ErrNotExist {
+				t.Errorf("deleted cold record after restart : %v", err)
+			}
+			var buf bytes.Buffer
+			if err = storage.WriteMetrics(&buf); err != nil {
+				t.Fatal(err)
+			} else if !strings.Contains(buf.String(), `txngo_tier_records{tier="cold"} 4`) || !strings.Contains(buf.String(), "txngo_tier_cold_hits_total 4") {
+				t.Errorf("metrics of tiers are not exported :\n%s", buf.String())
+			}
+		})
+	}
+}
+
+type ioutilDiscard struct{}
+
+func (ioutilDiscard) Write(p []byte) (int, error) { return len(p), nil }
+
+func TestTieredEngine_Load(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	// the crash after demotion leaves the record in both tiers
+	hot := newMapEngine(testDBPath, testTmpPath)
+	cold := &fileTier{path: testDBPath + ".cold", fs: osFS{}}
+	if err := cold.Load(); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b"} {
+		if err := hot.Put(Record{Key: key, Value: []byte("hot")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cold.Put([]Record{{Key: "b", Value: []byte("cold")}, {Key: "c", Value: []byte("cold")}}); err != nil {
+		t.Fatal(err)
+	} else if err = hot.Save(1); err != nil {
+		t.Fatal(err)
+	} else if err = cold.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	e := newTieredEngine(newMapEngine(testDBPath, testTmpPath), &fileTier{path: testDBPath + ".cold", fs: osFS{}}, TierPolicy{}, NewMetricsRegistry())
+	defer e.Close()
+	if _, err := e.Load(); err != nil {
+		t.Fatal(err)
+	} else if e.Len() != 3 {
+		t.Errorf("len %v", e.Len())
+	}
+	var keys []string
+	e.Keys("", func(key string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if !reflect.DeepEqual(keys, []string{"a", "b", "c"}) {
+		t.Errorf("keys %q", keys)
+	}
+	if r, err := e.Get("b"); err != nil || string(r.Value) != "hot" {
+		t.Errorf("b : %q %v", r.Value, err)
+	}
+	// the copy in the cold tier is deleted after the hot tier is saved
+	if err := e.Save(2); err != nil {
+		t.Fatal(err)
+	} else if tier, _ := tierOf(e); tier.cold.Has("b") || !tier.cold.Has("c") {
+		t.Errorf("cold keys %q", tier.cold.Keys(""))
+	}
+}
+
+func TestFileTier(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	path := filepath.Join(tmpdir, "test.cold")
+	ft := &fileTier{path: path, fs: osFS{}}
+	if err := ft.Load(); err != nil {
+		t.Fatal(err)
+	}
+	// random values are not compressed
+	value := make([]byte, 100<<10)
+	rand.New(rand.NewSource(1)).Read(value)
+	var records []Record
+	for i := 0; i < 20; i++ {
+		records = append(records, Record{Key: fmt.Sprintf("key%02d", i), Value: value, Version: uint64(i)})
+	}
+	if err := ft.Put(records); err != nil {
+		t.Fatal(err)
+	}
+	before := ft.size
+	var deleted []string
+	for i := 0; i < 15; i++ {
+		deleted = append(deleted, fmt.Sprintf("key%02d", i))
+	}
+	// garbage larger than live records rewrites the file
+	if err := ft.Delete(deleted); err != nil {
+		t.Fatal(err)
+	} else if ft.size >= before/2 || ft.Len() != 5 {
+		t.Errorf("size %v of %v records after rewrite, before %v", ft.size, ft.Len(), before)
+	}
+	if r, err := ft.Get("key19"); err != nil || !bytes.Equal(r.Value, value) || r.Version != 19 {
+		t.Errorf("key19 : %v %v", r.Version, err)
+	} else if _, err = ft.Get("key00"); err != ErrNotExist {
+		t.Errorf("deleted key : %v", err)
+	}
+	size := ft.size
+	ft.Close()
+
+	// the torn log at the tail is discarded
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{LInsert, 10, 0, 0})
+	f.Close()
+	ft = &fileTier{path: path, fs: osFS{}}
+	defer ft.Close()
+	if err = ft.Load(); err != nil {
+		t.Fatal(err)
+	} else if ft.size != size || !reflect.DeepEqual(ft.Keys("key1"), []string{"key15", "key16", "key17", "key18", "key19"}) {
+		t.Errorf("loaded %v bytes of %q, expected %v", ft.size, ft.Keys(""), size)
+	} else if info, _ := os.Stat(path); info.Size() != size {
+		t.Errorf("torn log is not truncated : %v", info.Size())
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"sync"
+)
+
+// tlsReloader keeps the TLS config loaded from files. Certificates can be reloaded while
+// serving, and new connections use the reloaded ones.
+type tlsReloader struct {
+	certFile string
+	keyFile  string
+	// caFile is the CA certificates to verify client certificates. empty disables client auth.
+	caFile string
+
+	mu     sync.RWMutex
+	config *tls.Config
+}
+
+func newTLSReloader(certFile, keyFile, caFile string) (*tlsReloader, error) {
+	r := &tlsReloader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload loads the certificates. the current config is kept if failed.
+func (r *tlsReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if r.caFile != "" {
+		pem, err := ioutil.ReadFile(r.caFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("no CA certificate is found in " + r.caFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	r.mu.Lock()
+	r.config = config
+	r.mu.Unlock()
+	return nil
+}
+
+// Config returns the config for listeners which uses the latest loaded config for each handshake.
+func (r *tlsReloader) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			return r.config, nil
+		},
+	}
+}
+
+// ClientConfig returns the config to connect other servers (e.g. the primary of replication).
+// The certificate is sent as the client certificate, and the CA certificates verify servers.
+func (r *tlsReloader) ClientConfig() *tls.Config {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return &tls.Config{
+		Certificates: r.config.Certificates,
+		RootCAs:      r.config.ClientCAs,
+		MinVersion:   tls.VersionTLS12,
+	}
+}
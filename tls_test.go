@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes the certificate and the key signed by parent into files.
+// the certificate is self signed if parent is nil.
+func writeTestCert(t *testing.T, name string, serial int64, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		template.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err = ioutil.WriteFile(filepath.Join(tmpdir, name+".crt"), certPEM, 0600); err != nil {
+		t.Fatal(err)
+	} else if err = ioutil.WriteFile(filepath.Join(tmpdir, name+".key"), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestTLSReloader(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	ca, caKey := writeTestCert(t, "ca", 1, nil, nil)
+	writeTestCert(t, "server", 2, ca, caKey)
+	writeTestCert(t, "client", 3, ca, caKey)
+	path := func(name string) string { return filepath.Join(tmpdir, name) }
+
+	reloader, err := newTLSReloader(path("server.crt"), path("server.key"), path("ca.crt"))
+	if err != nil {
+		t.Fatalf("failed to load : %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l = tls.NewListener(l, reloader.Config())
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write([]byte("ok"))
+			}()
+		}
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	clientCert, err := tls.LoadX509KeyPair(path("client.crt"), path("client.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// dial returns the serial number of server certificate
+	dial := func(certs []tls.Certificate) (int64, error) {
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{RootCAs: roots, Certificates: certs, ServerName: "localhost"})
+		if err != nil {
+			return 0, err
+		}
+		defer conn.Close()
+		// the handshake error of client certificate is found by read in TLS 1.3
+		if _, err = conn.Read(make([]byte, 2)); err != nil {
+			return 0, err
+		}
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64(), nil
+	}
+
+	if serial, err := dial([]tls.Certificate{clientCert}); err != nil {
+		t.Fatalf("failed to connect with client certificate : %v", err)
+	} else if serial != 2 {
+		t.Errorf("serial %v != 2", serial)
+	}
+	if _, err = dial(nil); err == nil {
+		t.Error("connected without client certificate")
+	}
+
+	// reloaded certificate is used by new connections
+	writeTestCert(t, "server", 4, ca, caKey)
+	if err = reloader.reload(); err != nil {
+		t.Fatalf("failed to reload : %v", err)
+	}
+	if serial, err := dial([]tls.Certificate{clientCert}); err != nil {
+		t.Fatalf("failed to connect after reload : %v", err)
+	} else if serial != 4 {
+		t.Errorf("serial %v != 4 after reload", serial)
+	}
+
+	// current certificate is kept if reload failed
+	if err = ioutil.WriteFile(path("server.crt"), []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = reloader.reload(); err == nil {
+		t.Error("reload broken certificate")
+	}
+	if serial, err := dial([]tls.Certificate{clientCert}); err != nil || serial != 4 {
+		t.Errorf("certificate is not kept : serial %v, %v", serial, err)
+	}
+}
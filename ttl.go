@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/binary"
+	"strings"
+	"time"
+)
+
+// ttlPrefix is the prefix of TTLs of records set by Txn.Expire. Values are the deadline in unix
+// nanoseconds, and keys are ttlPrefix followed by the key of the record.
+const ttlPrefix = internalPrefix + "ttl/"
+
+const (
+	// defaultExpireInterval is the interval of the background expiration if
+	// Options.ExpireInterval is 0.
+	defaultExpireInterval = time.Second
+	// defaultExpireBatch is the number of records deleted by each round of the background
+	// expiration if Options.ExpireBatch is 0.
+	defaultExpireBatch = 100
+)
+
+// Expire sets the TTL of the record, after which reads do not find the record and the
+// background expiration deletes it by the logged commit. ttl of 0 or less clears the TTL.
+// Update keeps the TTL, and Insert and Delete clear it, so that the record inserted again over
+// the expired one lives without TTL.
+func (txn *Txn) Expire(key string, ttl time.Duration) error {
+	if _, err := txn.Read(key); err != nil {
+		return err
+	} else if ttl <= 0 {
+		return txn.clearTTL(key)
+	}
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, uint64(txn.s.now().Add(ttl).UnixNano()))
+	// reads after the commit look up TTLs
+	txn.s.expiring.Store(true)
+	return txn.Put(ttlPrefix+key, value)
+}
+
+// TTL returns the remaining time until the record expires, or 0 if the record has no TTL.
+func (txn *Txn) TTL(key string) (time.Duration, error) {
+	if _, err := txn.Read(key); err != nil {
+		return 0, err
+	}
+	deadline, ok, err := txn.deadline(key)
+	if err != nil || !ok {
+		return 0, err
+	}
+	return deadline.Sub(txn.s.now()), nil
+}
+
+// deadline reads the TTL of the record by the transaction.
+func (txn *Txn) deadline(key string) (time.Time, bool, error) {
+	value, err := txn.Read(ttlPrefix + key)
+	if err == ErrNotExist {
+		return time.Time{}, false, nil
+	} else if err != nil {
+		return time.Time{}, false, err
+	}
+	return decodeDeadline(value), true, nil
+}
+
+// clearTTL deletes the TTL of the record written by the transaction if it may exist.
+func (txn *Txn) clearTTL(key string) error {
+	if !txn.s.expiring.Load() || strings.HasPrefix(key, internalPrefix) {
+		return nil
+	} else if err := txn.Delete(ttlPrefix + key); err != ErrNotExist {
+		return err
+	}
+	return nil
+}
+
+// getLive reads the record from db, and hides the record whose TTL passes unless the
+// transaction is the background expiration. It must be called with muDB read locked.
+func (txn *Txn) getLive(key string) (Record, error) {
+	r, err := txn.s.db.Get(key)
+	if err != nil || txn.sweeping {
+		return r, err
+	} else if expired, err := txn.s.expiredLocked(key); err != nil {
+		return Record{}, err
+	} else if expired {
+		txn.s.metrics.expiredReads.Inc()
+		return Record{}, ErrNotExist
+	}
+	return r, nil
+}
+
+// expiredLocked returns true if the TTL of the record passes. It must be called with muDB read
+// locked, and must not be called while iterating keys of db.
+func (s *Storage) expiredLocked(key string) (bool, error) {
+	if !s.expiring.Load() || strings.HasPrefix(key, internalPrefix) {
+		return false, nil
+	}
+	ttl, err := s.db.Get(ttlPrefix + key)
+	if err == ErrNotExist {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return !s.now().Before(decodeDeadline(ttl.Value)), nil
+}
+
+// liveKeys returns keys except the records whose TTL passes, which are hidden until the
+// background expiration deletes them. keys are returned as is if no record has TTL. It must be
+// called with muDB read locked.
+func (s *Storage) liveKeys(keys []string) ([]string, error) {
+	if !s.expiring.Load() {
+		return keys, nil
+	}
+	live := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if expired, err := s.expiredLocked(key); err != nil {
+			return nil, err
+		} else if !expired {
+			live = append(live, key)
+		}
+	}
+	return live, nil
+}
+
+func decodeDeadline(value []byte) time.Time {
+	if len(value) != 8 {
+		// broken TTL expires the record
+		return time.Time{}
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(value)))
+}
+
+// markTTL enables lookup of TTLs by reads if the key is the TTL of a record. It is called for
+// records written into db.
+func (s *Storage) markTTL(key string) {
+	if strings.HasPrefix(key, ttlPrefix) {
+		s.expiring.Store(true)
+	}
+}
+
+// detectTTL enables lookup of TTLs by reads if db has any TTL, or if keys of the broken db fail
+// to be listed.
+func (s *Storage) detectTTL() {
+	if err := s.db.Keys(ttlPrefix, func(key string) bool {
+		s.expiring.Store(true)
+		return false
+	}); err != nil {
+		s.expiring.Store(true)
+	}
+}
+
+// startExpirer deletes records whose TTL passes in background at the interval. It is stopped by
+// Shutdown.
+func (s *Storage) startExpirer(interval time.Duration, batch int) {
+	s.stopExpirer, s.expirerDone = make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(s.expirerDone)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stopExpirer:
+				return
+			case <-ticker.C:
+			}
+			if _, err := s.expire(batch); err != nil {
+				// records left are deleted by the next round
+				s.logger().Warn("failed to expire records", "err", err)
+			}
+		}
+	}()
+}
+
+// expire deletes at most batch records whose TTL passes by one commit, calls Hooks.OnRemove
+// for them, and returns the number of deleted records. Replicas and Raft followers delete them
+// by the logs of the primary and the leader.
+func (s *Storage) expire(batch int) (int, error) {
+	if !s.expiring.Load() {
+		return 0, nil
+	}
+	s.muWAL.Lock()
+	follower := s.replica != nil || s.raft != nil || s.corrupted.Load() != nil
+	s.muWAL.Unlock()
+	if follower {
+		return 0, nil
+	}
+
+	var (
+		now     = s.now()
+		ttls    []string
+		expired []string
+	)
+	s.muDB.RLock()
+	err := s.db.Keys(ttlPrefix, func(key string) bool {
+		ttls = append(ttls, key)
+		return true
+	})
+	for _, key := range ttls {
+		if err != nil || len(expired) >= batch {
+			break
+		}
+		var r Record
+		if r, err = s.db.Get(key); err == ErrNotExist {
+			err = nil
+		} else if err == nil && !now.Before(decodeDeadline(r.Value)) {
+			expired = append(expired, strings.TrimPrefix(key, ttlPrefix))
+		}
+	}
+	s.muDB.RUnlock()
+	if err != nil || len(expired) == 0 {
+		return 0, err
+	}
+
+	var removed []Removal
+	if err = s.autoCommit(func(txn *Txn) error {
+		txn.sweeping = true
+		removed = removed[:0]
+		for _, key := range expired {
+			// TTL may be extended or cleared by commits since the lookup
+			if deadline, ok, err := txn.deadline(key); err != nil {
+				return err
+			} else if !ok || now.Before(deadline) {
+				continue
+			}
+			value, err := txn.Read(key)
+			if err == ErrNotExist {
+				// TTL left without the record
+				if err = txn.Delete(ttlPrefix + key); err != nil && err != ErrNotExist {
+					return err
+				}
+				continue
+			} else if err != nil {
+				return err
+			} else if err = txn.Delete(key); err != nil {
+				return err
+			}
+			removed = append(removed, Removal{Key: key, Value: clone(value), Reason: RemovedExpired})
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	s.metrics.expired.Add(uint64(len(removed)))
+	if h := s.hooks.Load(); h != nil && h.OnRemove != nil {
+		for _, r := range removed {
+			h.OnRemove(r)
+		}
+	}
+	return len(removed), nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTxn_Expire(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	opts := Options{
+		WALPath:        testWALPath,
+		DBPath:         testDBPath,
+		ExpireInterval: -1,
+		Now:            func() time.Time { return now },
+		Quotas:         []Quota{{MaxKeys: 100}},
+	}
+	storage, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { storage.Close() }()
+	for i := 0; i < 5; i++ {
+		if err = storage.Put(fmt.Sprintf("key%v", i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = storage.autoCommit(func(txn *Txn) error {
+		for i := 0; i < 4; i++ {
+			if err := txn.Expire(fmt.Sprintf("key%v", i), time.Minute); err != nil {
+				return err
+			}
+		}
+		if err := txn.Insert("last", []byte("value")); err != nil {
+			return err
+		} else if err = txn.Expire("last", time.Minute); err != nil {
+			return err
+		}
+		return txn.Expire("key4", time.Hour)
+	}); err != nil {
+		t.Fatal(err)
+	} else if err = storage.autoCommit(func(txn *Txn) error { return txn.Expire("missing", time.Minute) }); err != ErrNotExist {
+		t.Errorf("expire of missing record : %v", err)
+	}
+	assertTTL := func(key string, expected time.Duration) {
+		t.Helper()
+		txn := storage.NewTxn()
+		defer txn.Abort()
+		if ttl, err := txn.TTL(key); err != nil || ttl != expected {
+			t.Errorf("TTL of %v : %v %v, expected %v", key, ttl, err, expected)
+		}
+	}
+	assertTTL("key0", time.Minute)
+
+	// TTLs are not records of users
+	txn := storage.NewTxn()
+	var keys []string
+	if err = txn.Scan("", func(key string, value []byte) error {
+		keys = append(keys, key)
+		return nil
+	}); err != nil || len(keys) != 6 || keys[0] != "key0" || keys[5] != "last" {
+		t.Errorf("scanned %q %v", keys, err)
+	} else if key, _, err := txn.First(); err != nil || key != "key0" {
+		t.Errorf("first %q %v", key, err)
+	}
+	txn.Abort()
+	if n := storage.Stats().Keys; n != 6 {
+		t.Errorf("%v keys", n)
+	} else if usages := storage.Quotas(); usages[0].Keys != 6 {
+		t.Errorf("quota counts %v keys", usages[0].Keys)
+	}
+
+	// update keeps TTL, and insert after delete clears it
+	if err = storage.Put("key4", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	assertTTL("key4", time.Hour)
+	if err = storage.Delete("key4"); err != nil {
+		t.Fatal(err)
+	} else if err = storage.Put("key4", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	assertTTL("key4", 0)
+
+	// expired records are hidden from reads before deleted
+	now = now.Add(time.Minute)
+	if _, err = storage.Get("key0"); err != ErrNotExist {
+		t.Errorf("read of expired record : %v", err)
+	}
+	txn = storage.NewTxn()
+	if key, _, err := txn.Last(); err != nil || key != "key4" {
+		t.Errorf("last %q %v", key, err)
+	}
+	keys = nil
+	if err = txn.Scan("key", func(key string, value []byte) error {
+		keys = append(keys, key)
+		return nil
+	}); err != nil || len(keys) != 1 {
+		t.Errorf("scanned %q %v", keys, err)
+	}
+	txn.Abort()
+	if err = storage.View("key0", func(value []byte) error { return nil }); err != ErrNotExist {
+		t.Errorf("view of expired record : %v", err)
+	} else if err = storage.View("key4", func(value []byte) error { return nil }); err != nil {
+		t.Errorf("view of live record : %v", err)
+	}
+	// scan examines expired records to resume after them
+	keys = nil
+	for cursor := scanStart; ; {
+		var batch []string
+		if batch, cursor, err = storage.ScanKeys(cursor, "", 2, nil); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, batch...)
+		if cursor == scanStart {
+			break
+		}
+	}
+	if len(keys) != 1 || keys[0] != "key4" {
+		t.Errorf("scanned keys %q", keys)
+	}
+
+	// the record inserted over the expired one lives without TTL
+	if err = storage.Put("key3", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	assertTTL("key3", 0)
+
+	// expiration deletes records by the bounded batch
+	if n, err := storage.expire(2); err != nil || n != 2 {
+		t.Errorf("expired %v %v", n, err)
+	} else if n, err = storage.expire(2); err != nil || n != 2 {
+		t.Errorf("expired %v %v", n, err)
+	} else if n, err = storage.expire(2); err != nil || n != 0 {
+		t.Errorf("expired %v %v", n, err)
+	}
+	storage.muDB.RLock()
+	for _, key := range []string{"key0", ttlPrefix + "key0", ttlPrefix + "key2"} {
+		if _, err = storage.db.Get(key); err != ErrNotExist {
+			t.Errorf("%q is not deleted : %v", key, err)
+		}
+	}
+	storage.muDB.RUnlock()
+	var buf bytes.Buffer
+	if err = storage.WriteMetrics(&buf); err != nil {
+		t.Fatal(err)
+	} else if !strings.Contains(buf.String(), "txngo_expired_keys_total 4") || storage.metrics.expiredReads.Value() == 0 {
+		t.Errorf("metrics of expiration are not exported :\n%s", buf.String())
+	}
+
+	// TTLs survive restart
+	if err = storage.autoCommit(func(txn *Txn) error { return txn.Expire("key4", time.Minute) }); err != nil {
+		t.Fatal(err)
+	} else if err = storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Minute)
+	if storage, err = Open(opts); err != nil {
+		t.Fatal(err)
+	} else if _, err = storage.Get("key4"); err != ErrNotExist {
+		t.Errorf("read of expired record after restart : %v", err)
+	}
+	txn = storage.NewTxn()
+	defer txn.Abort()
+	assertValue(t, txn, "key3", []byte("new"))
+}
+
+func TestStorage_startExpirer(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	storage, err := Open(Options{WALPath: testWALPath, DBPath: testDBPath, ExpireInterval: time.Millisecond, ExpireBatch: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	if err = storage.autoCommit(func(txn *Txn) error {
+		for _, key := range []string{"key1", "key2"} {
+			if err := txn.Insert(key, []byte("value")); err != nil {
+				return err
+			} else if err = txn.Expire(key, time.Millisecond); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		storage.muDB.RLock()
+		n := storage.db.Len()
+		storage.muDB.RUnlock()
+		if n == 0 {
+			break
+		} else if i == 100 {
+			t.Fatalf("%v records are left", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if v := storage.metrics.expired.Value(); v != 2 {
+		t.Errorf("expired %v records", v)
+	}
+}
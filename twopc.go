@@ -0,0 +1,243 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrPrepared    = errors.New("global transaction id is already prepared")
+	ErrNotPrepared = errors.New("global transaction id is not prepared")
+)
+
+// Prepare makes the transaction durable in WAL without committing it, as the participant of
+// two-phase commit. Read locks are released, and write locks are held until the transaction is
+// decided by CommitPrepared or AbortPrepared with gid. Prepared transactions survive restart.
+// After prepared, the transaction must not be used except Commit and Abort.
+func (txn *Txn) Prepare(gid string) error {
+	if gid == "" || len(gid) > 255 || strings.ContainsAny(gid, " \t\r\n") {
+		return fmt.Errorf("invalid global transaction id %q", gid)
+	} else if txn.gid != "" {
+		return ErrPrepared
+	} else if txn.s.raft != nil {
+		return errors.New("two-phase commit is not supported with raft")
+	} else if err := txn.s.writable(); err != nil {
+		return err
+	} else if _, err = txn.hookPreCommit(); err != nil {
+		return err
+	}
+	s := txn.s
+	s.muWAL.Lock()
+	defer s.muWAL.Unlock()
+	if _, ok := s.prepared[gid]; ok {
+		return ErrPrepared
+	}
+
+	// no more locks are acquired. read locks can be released (S2PL)
+	for key := range txn.readSet {
+		s.lock.RUnlock(key)
+		delete(txn.readSet, key)
+	}
+
+	// the commit version is assigned at the decision
+	err := s.writeWAL(txn.logs, RecordLog{Action: LPrepare, Record: Record{Key: gid}})
+	if err != nil {
+		return err
+	}
+	txn.gid = gid
+	s.prepared[gid] = txn
+	txn.leave()
+	return nil
+}
+
+// CommitPrepared commits the prepared transaction.
+func (s *Storage) CommitPrepared(gid string) error {
+	txn, err := s.decide(gid, LCommitPrepared)
+	if err != nil {
+		return err
+	}
+	s.metrics.commits.Inc()
+	var version uint64
+	if len(txn.logs) > 0 {
+		version = txn.logs[0].Version
+	}
+	txn.hookPostCommit(nil, version)
+	txn.end()
+	txn.release()
+	return nil
+}
+
+// AbortPrepared aborts the prepared transaction.
+func (s *Storage) AbortPrepared(gid string) error {
+	txn, err := s.decide(gid, LAbortPrepared)
+	if err != nil {
+		return err
+	}
+	s.metrics.aborts.Inc()
+	txn.hookAbort()
+	txn.end()
+	txn.release()
+	return nil
+}
+
+// decide writes the decision of the prepared transaction and applies its logs if committed.
+func (s *Storage) decide(gid string, action uint8) (*Txn, error) {
+	s.muWAL.Lock()
+	defer s.muWAL.Unlock()
+	txn, ok := s.prepared[gid]
+	if !ok {
+		return nil, ErrNotPrepared
+	}
+	end := RecordLog{Action: action, Record: Record{Key: gid}}
+	if action == LCommitPrepared && s.audit != nil && len(txn.logs) > 0 {
+		// the head of the audit log is updated by the next commit because the decision
+		// writes no records.
+		if _, err := s.audit.record(txn.logs, s.version+1, txn.actor, s.now()); err != nil {
+			return nil, err
+		}
+	}
+	if action == LCommitPrepared && len(txn.logs) > 0 {
+		s.assignVersion(txn.logs)
+		end.Version = s.version
+	}
+	if err := s.writeWAL(nil, end); err != nil {
+		return nil, err
+	}
+	delete(s.prepared, gid)
+	txn.gid = ""
+	if action == LCommitPrepared {
+		if err := s.applyCommit(txn.logs); err != nil {
+			return nil, err
+		}
+		if s.checkpointSize > 0 && s.walSize >= s.checkpointSize {
+			if err := s.checkpoint(); err != nil {
+				s.logger().Error("failed to checkpoint", "err", err)
+			}
+		}
+	}
+	return txn, nil
+}
+
+// Prepared returns the global transaction ids of prepared transactions in order.
+// After restart, they are in doubt and must be resolved by the coordinator.
+func (s *Storage) Prepared() []string {
+	s.muWAL.Lock()
+	defer s.muWAL.Unlock()
+	return s.preparedLocked()
+}
+
+func (s *Storage) preparedLocked() []string {
+	gids := make([]string, 0, len(s.prepared))
+	for gid := range s.prepared {
+		gids = append(gids, gid)
+	}
+	sort.Strings(gids)
+	return gids
+}
+
+// restorePrepared restores the prepared transaction loaded from WAL with its write locks.
+func (s *Storage) restorePrepared(gid string, logs []RecordLog) {
+	txn := s.NewTxn()
+	for i, rlog := range logs {
+		if _, ok := txn.writeSet[rlog.Key]; !ok {
+			s.lock.Lock(rlog.Key)
+		}
+		txn.writeSet[rlog.Key] = i
+	}
+	txn.logs = logs
+	txn.gid = gid
+	s.prepared[gid] = txn
+}
+
+// preparedPath returns the file which prepared transactions are kept in while WAL is cleared.
+func (s *Storage) preparedPath() string {
+	return s.wal.Name() + ".prepared"
+}
+
+// keepPrepared writes prepared transactions into the file of preparedPath atomically before WAL
+// is cleared, so that they are not lost by the crash before savePrepared writes them into WAL
+// again. The file is removed if no transaction is prepared.
+func (s *Storage) keepPrepared() error {
+	if s.opts.DisableWAL {
+		return nil
+	}
+	fs, path := s.opts.fs(), s.preparedPath()
+	if len(s.prepared) == 0 {
+		if err := fs.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	// logs are serialized in the same format as WAL
+	var data []byte
+	write := func(rlog RecordLog) error {
+		rlog, err := s.keyring.sealLog(rlog)
+		if err != nil {
+			return err
+		}
+		buf := make([]byte, rlog.size())
+		if _, err = rlog.Serialize(buf); err != nil {
+			return err
+		}
+		data = append(data, buf...)
+		return nil
+	}
+	for _, gid := range s.preparedLocked() {
+		for _, rlog := range s.prepared[gid].logs {
+			if err := write(rlog); err != nil {
+				return err
+			}
+		}
+		if err := write(RecordLog{Action: LPrepare, Record: Record{Key: gid}}); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(fs, path, s.opts.tmpPath(path), data)
+}
+
+// loadPrepared reads prepared transactions kept by keepPrepared into prepared. They are
+// overwritten by the logs of the same transactions written into WAL again by savePrepared.
+func (s *Storage) loadPrepared(prepared map[string][]RecordLog) error {
+	if s.opts.DisableWAL {
+		return nil
+	}
+	buf, err := readFile(s.opts.fs(), s.preparedPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var logs []RecordLog
+	for len(buf) > 0 {
+		var rlog RecordLog
+		n, err := rlog.Deserialize(buf)
+		if err != nil {
+			return fmt.Errorf("file of prepared transactions is broken : %w", err)
+		}
+		buf = buf[n:]
+		switch rlog.Action {
+		case LInsert, LUpdate, LDelete:
+			if err = s.keyring.openLog(&rlog); err != nil {
+				return err
+			}
+			logs = append(logs, rlog)
+		case LPrepare:
+			prepared[rlog.Key], logs = logs, nil
+		}
+	}
+	return nil
+}
+
+// savePrepared writes prepared transactions into WAL again after WAL is cleared.
+func (s *Storage) savePrepared() error {
+	for _, gid := range s.preparedLocked() {
+		txn := s.prepared[gid]
+		if err := s.writeWAL(txn.logs, RecordLog{Action: LPrepare, Record: Record{Key: gid}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestTxn_Prepare(t *testing.T) {
+	storage := createTestStorage(t)
+	defer storage.wal.Close()
+	if err := storage.Put("key1", []byte("value1")); err != nil {
+		t.Fatal(err)
+	}
+
+	txn := storage.NewTxn()
+	if err := txn.Update("key1", []byte("value2")); err != nil {
+		t.Fatal(err)
+	} else if err = txn.Insert("key2", []byte("value3")); err != nil {
+		t.Fatal(err)
+	} else if err = txn.Prepare("g1"); err != nil {
+		t.Fatalf("failed to prepare : %v", err)
+	}
+	other := storage.NewTxn()
+	if err := other.Prepare("g1"); err != ErrPrepared {
+		t.Errorf("prepare duplicate gid : %v", err)
+	} else if err = other.Prepare("g 2"); err == nil {
+		t.Errorf("prepare invalid gid")
+	}
+	other.Abort()
+	aborted := storage.NewTxn()
+	if err := aborted.Insert("key3", []byte("value4")); err != nil {
+		t.Fatal(err)
+	} else if err = aborted.Prepare("g2"); err != nil {
+		t.Fatal(err)
+	} else if err = storage.AbortPrepared("g2"); err != nil {
+		t.Fatalf("failed to abort prepared : %v", err)
+	}
+
+	// prepared transaction survives checkpoint and restart
+	if err := storage.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	storage.wal.Close()
+	wal, err := os.OpenFile(testWALPath, os.O_APPEND|os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage = NewStorage(wal, testDBPath, testTmpPath)
+	defer storage.wal.Close()
+	if err = storage.LoadCheckPoint(); err != nil {
+		t.Fatal(err)
+	} else if _, err = storage.LoadWAL(); err != nil {
+		t.Fatal(err)
+	}
+	if gids := storage.Prepared(); !reflect.DeepEqual(gids, []string{"g1"}) {
+		t.Fatalf("prepared transactions %v, expected [g1]", gids)
+	}
+	// keys written by the prepared transaction are locked
+	check := storage.NewTxn()
+	assertNotExist(t, check, "key3")
+	check.Abort()
+
+	if err = storage.CommitPrepared("g1"); err != nil {
+		t.Fatalf("failed to commit prepared : %v", err)
+	} else if err = storage.CommitPrepared("g1"); err != ErrNotPrepared {
+		t.Errorf("commit prepared twice : %v", err)
+	}
+	check = storage.NewTxn()
+	assertValue(t, check, "key1", []byte("value2"))
+	assertValue(t, check, "key2", []byte("value3"))
+	check.Abort()
+	if gids := storage.Prepared(); len(gids) != 0 {
+		t.Errorf("prepared transactions are left : %v", gids)
+	}
+}
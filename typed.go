@@ -0,0 +1,67 @@
+package main
+
+import "encoding/json"
+
+// Codec encodes and decodes the value of TypedStorage.
+type Codec[V any] interface {
+	Encode(v V) ([]byte, error)
+	Decode(b []byte) (V, error)
+}
+
+// JSONCodec is Codec using encoding/json.
+type JSONCodec[V any] struct{}
+
+func (JSONCodec[V]) Encode(v V) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec[V]) Decode(b []byte) (V, error) {
+	var v V
+	err := json.Unmarshal(b, &v)
+	return v, err
+}
+
+// TypedStorage is strongly typed facade of Storage.
+// Each operation is executed in its own transaction.
+type TypedStorage[K ~string, V any] struct {
+	s     *Storage
+	codec Codec[V]
+}
+
+func Typed[K ~string, V any](s *Storage, codec Codec[V]) *TypedStorage[K, V] {
+	return &TypedStorage[K, V]{s: s, codec: codec}
+}
+
+func (t *TypedStorage[K, V]) Get(key K) (V, error) {
+	b, err := t.s.Get(string(key))
+	if err != nil {
+		var v V
+		return v, err
+	}
+	return t.codec.Decode(b)
+}
+
+func (t *TypedStorage[K, V]) Put(key K, value V) error {
+	b, err := t.codec.Encode(value)
+	if err != nil {
+		return err
+	}
+	return t.s.Put(string(key), b)
+}
+
+func (t *TypedStorage[K, V]) Delete(key K) error {
+	return t.s.Delete(string(key))
+}
+
+// Scan calls fn for each record whose key has the prefix in key order.
+func (t *TypedStorage[K, V]) Scan(prefix K, fn func(key K, value V) error) error {
+	txn := t.s.NewTxn()
+	defer txn.Abort()
+	return txn.Scan(string(prefix), func(key string, b []byte) error {
+		v, err := t.codec.Decode(b)
+		if err != nil {
+			return err
+		}
+		return fn(K(key), v)
+	})
+}
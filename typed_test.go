@@ -0,0 +1,58 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTypedStorage(t *testing.T) {
+	type UserID string
+	type User struct {
+		Name string
+		Age  int
+	}
+	storage := createTestStorage(t)
+	defer storage.wal.Close()
+	users := Typed[UserID, User](storage, JSONCodec[User]{})
+
+	if _, err := users.Get("user:1"); err != ErrNotExist {
+		t.Errorf("user:1 is not (not exist) : %v", err)
+	}
+	expected := map[UserID]User{
+		"user:1": {Name: "alice", Age: 20},
+		"user:2": {Name: "bob", Age: 30},
+	}
+	for id, u := range expected {
+		if err := users.Put(id, u); err != nil {
+			t.Errorf("failed to put %v : %v", id, err)
+		}
+	}
+	if err := storage.Put("other", []byte("not json")); err != nil {
+		t.Errorf("failed to put other : %v", err)
+	}
+	if u, err := users.Get("user:1"); err != nil {
+		t.Errorf("failed to get user:1 : %v", err)
+	} else if u != expected["user:1"] {
+		t.Errorf("user not match %v", u)
+	}
+
+	scanned := make(map[UserID]User)
+	var order []UserID
+	if err := users.Scan("user:", func(id UserID, u User) error {
+		scanned[id] = u
+		order = append(order, id)
+		return nil
+	}); err != nil {
+		t.Errorf("failed to scan : %v", err)
+	}
+	if !reflect.DeepEqual(scanned, expected) {
+		t.Errorf("scanned users not match %v", scanned)
+	} else if order[0] != "user:1" || order[1] != "user:2" {
+		t.Errorf("scanned order not match %v", order)
+	}
+
+	// decode error
+	if _, err := Typed[string, User](storage, JSONCodec[User]{}).Get("other"); err == nil {
+		t.Errorf("unexpectedly success to decode invalid value")
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// stages of the upgrade recorded in UPGRADE of the data directory.
+const (
+	// upgradeBackup copies the originals into the backup. The partial backup is taken again
+	// when resumed.
+	upgradeBackup = "backup"
+	// upgradeConvert rewrites the data directory after the backup is complete. Open recovers
+	// the conversion interrupted by the crash, so that it is run again when resumed.
+	upgradeConvert = "convert"
+)
+
+// UpgradeReport is the result of Upgrade, which has the formats found before the upgrade.
+type UpgradeReport struct {
+	Dir string `json:"dir"`
+	// Layout is the format of MANIFEST, or 0 for the loose files written before the layout.
+	Layout int `json:"layout"`
+	// WALFormat is the format of logs in WAL, and SnapshotFormat is the oldest format of data
+	// files of map. SnapshotFormat is 0 if no data file of map is found.
+	WALFormat      int `json:"wal_format"`
+	SnapshotFormat int `json:"snapshot_format"`
+	// Upgraded is false if the data directory is already in the current formats.
+	Upgraded bool `json:"upgraded"`
+	// Resumed is true if the upgrade interrupted before is resumed.
+	Resumed bool `json:"resumed"`
+	// Backup is the directory which has the copy of the originals.
+	Backup string `json:"backup,omitempty"`
+}
+
+// current returns true if all formats found are the current ones.
+func (r *UpgradeReport) current() bool {
+	return r.Layout == manifestFormat && r.WALFormat == currentFormat && (r.SnapshotFormat == 0 || r.SnapshotFormat == currentFormat)
+}
+
+// upgradeState is the content of UPGRADE in JSON.
+type upgradeState struct {
+	Stage  string        `json:"stage"`
+	Report UpgradeReport `json:"report"`
+}
+
+// Upgrade converts the data directory opts.Dir written by older releases into the current
+// layout and formats while no process serves it. The originals are copied into backup, or into
+// Dir.backup if it is empty, which must not exist. Loose files are moved into the layout, and
+// logs replayed from WAL and records of data files are rewritten in the current format. The
+// stage is recorded in UPGRADE so that the upgrade interrupted by the crash is resumed by
+// calling it again. It does nothing if the directory is already in the current formats. Files
+// are read and written in the file system of the operating system, and Options.FS is ignored.
+func Upgrade(opts Options, backup string) (*UpgradeReport, error) {
+	opts.FS = nil
+	if opts.Dir == "" {
+		return nil, errors.New("upgrade requires the data directory")
+	} else if backup == "" {
+		backup = opts.Dir + ".backup"
+	}
+	backup, err := filepath.Abs(backup)
+	if err != nil {
+		return nil, err
+	} else if dir, err := filepath.Abs(opts.Dir); err != nil {
+		return nil, err
+	} else if rel, err := filepath.Rel(dir, backup); err == nil && !strings.HasPrefix(rel, "..") {
+		return nil, fmt.Errorf("backup %v is in the data directory", backup)
+	}
+	opts.layout()
+	opts.MustExist = false
+
+	var state upgradeState
+	data, err := ioutil.ReadFile(filepath.Join(opts.Dir, dataDirUpgrade))
+	if os.IsNotExist(err) {
+		report, err := detectFormats(opts)
+		if err != nil {
+			return nil, err
+		} else if report.current() {
+			return report, nil
+		} else if _, err = os.Stat(backup); !os.IsNotExist(err) {
+			return nil, fmt.Errorf("backup %v already exists", backup)
+		}
+		report.Backup = backup
+		state = upgradeState{Stage: upgradeBackup, Report: *report}
+		if err = os.MkdirAll(filepath.Join(opts.Dir, dataDirTmp), 0700); err != nil {
+			return nil, err
+		} else if err = writeJSONFile(osFS{}, opts.Dir, dataDirUpgrade, state); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	} else if err = json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("%v is broken : %w", dataDirUpgrade, err)
+	} else {
+		state.Report.Resumed = true
+		opts.logger().Info("upgrade is resumed", "stage", state.Stage, "backup", state.Report.Backup)
+	}
+	report := &state.Report
+
+	if state.Stage == upgradeBackup {
+		if err = os.RemoveAll(report.Backup); err != nil {
+			return nil, err
+		} else if err = copyDataDir(opts.Dir, report.Backup); err != nil {
+			return nil, fmt.Errorf("failed to back up %v : %w", opts.Dir, err)
+		}
+		state.Stage = upgradeConvert
+		if err = writeJSONFile(osFS{}, opts.Dir, dataDirUpgrade, state); err != nil {
+			return nil, err
+		}
+		opts.logger().Info("originals are backed up", "backup", report.Backup)
+	}
+	if err = convertDataDir(opts); err != nil {
+		return nil, fmt.Errorf("failed to convert %v (originals are in %v) : %w", opts.Dir, report.Backup, err)
+	} else if err = os.Remove(filepath.Join(opts.Dir, dataDirUpgrade)); err != nil {
+		return nil, err
+	}
+	report.Upgraded = true
+	opts.logger().Info("data directory is upgraded", "dir", opts.Dir)
+	return report, nil
+}
+
+// detectFormats opens the data directory read only, and reports the formats of it.
+func detectFormats(opts Options) (*UpgradeReport, error) {
+	report := &UpgradeReport{Dir: opts.Dir}
+	if m, err := readManifest(osFS{}, opts.Dir); err == nil {
+		report.Layout = m.Format
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	} else if !opts.legacyDir {
+		return nil, fmt.Errorf("%v is not a data directory", opts.Dir)
+	}
+	storage, err := OpenReadOnly(opts)
+	if err != nil {
+		return nil, err
+	}
+	defer storage.Close()
+	report.WALFormat = currentFormat
+	if storage.wal != nil {
+		storage.muWAL.Lock()
+		report.WALFormat, err = storage.walFormat()
+		storage.muWAL.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+	storage.muDB.RLock()
+	report.SnapshotFormat = snapshotFormat(storage.db)
+	storage.muDB.RUnlock()
+	return report, nil
+}
+
+// snapshotFormat returns the oldest format of data files of map loaded under e, or 0 if no data
+// file of map is loaded.
+func snapshotFormat(e Backend) int {
+	oldest := func(engines []Backend) int {
+		format := 0
+		for _, e := range engines {
+			if f := snapshotFormat(e); f != 0 && (format == 0 || f < format) {
+				format = f
+			}
+		}
+		return format
+	}
+	switch e := e.(type) {
+	case *mapEngine:
+		return e.format
+	case *overlayEngine:
+		return snapshotFormat(e.base)
+	case *orderedOverlayEngine:
+		return snapshotFormat(e.base)
+	case *partitionEngine:
+		return oldest(e.parts)
+	case *familyEngine:
+		return oldest(e.engines())
+	case unwrapper:
+		return snapshotFormat(e.unwrap())
+	}
+	return 0
+}
+
+// copyDataDir copies files in dir into backup except LOCK, UPGRADE and temporary files.
+func copyDataDir(dir, backup string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		switch {
+		case rel == dataDirLock || rel == dataDirUpgrade:
+			return nil
+		case rel == dataDirTmp && info.IsDir():
+			return filepath.SkipDir
+		case info.IsDir():
+			return os.MkdirAll(filepath.Join(backup, rel), 0700)
+		case !info.Mode().IsRegular():
+			return nil
+		}
+		return copyFile(path, filepath.Join(backup, rel))
+	})
+}
+
+// copyFile copies the file at src into dst and syncs it.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// convertDataDir opens the data directory, which moves loose files into the layout and replays
+// WAL, and checkpoints so that WAL is cleared and data files are written in the current format.
+func convertDataDir(opts Options) error {
+	storage, err := Open(opts)
+	if err != nil {
+		return err
+	}
+	if err = storage.Checkpoint(); err != nil {
+		storage.Close()
+		return err
+	}
+	return storage.Close()
+}
+
+// WriteText writes the report in the human readable format.
+func (r *UpgradeReport) WriteText(w io.Writer) error {
+	layout := "loose files"
+	if r.Layout > 0 {
+		layout = fmt.Sprintf("%d", r.Layout)
+	}
+	fmt.Fprintf(w, "dir               : %s\n", r.Dir)
+	fmt.Fprintf(w, "layout            : %s, current %d\n", layout, manifestFormat)
+	fmt.Fprintf(w, "wal format        : %d, current %d\n", r.WALFormat, currentFormat)
+	if r.SnapshotFormat > 0 {
+		fmt.Fprintf(w, "snapshot format   : %d, current %d\n", r.SnapshotFormat, currentFormat)
+	}
+	if r.Backup != "" {
+		fmt.Fprintf(w, "backup            : %s\n", r.Backup)
+	}
+	status := "upgraded"
+	if !r.Upgraded {
+		status = "already up to date"
+	} else if r.Resumed {
+		status = "upgraded by resuming the interrupted upgrade"
+	}
+	_, err := fmt.Fprintln(w, status)
+	return err
+}
+
+// runUpgradeCommand runs "txngo [flags] upgrade [-backup DIR] [-json] PATH" and returns the exit
+// status. PATH is upgraded as the data directory, and the engine flags must be the ones it is
+// served with.
+func runUpgradeCommand(opts Options, args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("upgrade", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	backup := fs.String("backup", "", "directory to copy the originals into, which must not exist (default PATH.backup)")
+	asJSON := fs.Bool("json", false, "write the report as JSON")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	} else if fs.NArg() != 1 {
+		fmt.Fprintln(stderr, "usage : txngo [flags] upgrade [-backup DIR] [-json] PATH")
+		return exitUsage
+	}
+	opts.Dir, opts.WALPath, opts.DBPath, opts.legacyDir = fs.Arg(0), "", "", false
+
+	log.SetOutput(ioutil.Discard)
+	report, err := Upgrade(opts, *backup)
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to upgrade : %v\n", err)
+		return exitFailure
+	}
+	if *asJSON {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	} else {
+		err = report.WriteText(stdout)
+	}
+	if err != nil {
+		return exitFailure
+	}
+	return exitOK
+}
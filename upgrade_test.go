@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// loadUpgradeFixture copies the fixture of formatV1 written by map into tmpdir/data as the data
+// directory of the first release, and returns it.
+func loadUpgradeFixture(t *testing.T) string {
+	loadFormatFixture(t, "testdata/format/v1/map")
+	dir := filepath.Join(tmpdir, "data")
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{fixtureWAL, fixtureDB} {
+		if err := os.Rename(filepath.Join(tmpdir, name), filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// assertUpgraded checks that dir is in the current formats and has the records of the fixture.
+func assertUpgraded(t *testing.T, dir string) {
+	t.Helper()
+	if _, err := os.Stat(filepath.Join(dir, dataDirUpgrade)); !os.IsNotExist(err) {
+		t.Errorf("%v is not removed : %v", dataDirUpgrade, err)
+	}
+	info, err := os.Stat(filepath.Join(dir, dataDirWAL, fixtureWAL))
+	if err != nil {
+		t.Fatal(err)
+	} else if info.Size() != 0 {
+		t.Errorf("WAL is not cleared : %v bytes", info.Size())
+	}
+	report, err := detectFormats(Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	} else if !report.current() {
+		t.Errorf("formats after upgrade : %+v", report)
+	}
+	storage, err := Open(Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	expected := formatExpected["v1"]
+	if storage.version != expected.version || storage.db.Len() != len(expected.records) {
+		t.Errorf("version %v and %v records", storage.version, storage.db.Len())
+	}
+	for _, r := range expected.records {
+		if actual, err := storage.db.Get(r.Key); err != nil {
+			t.Errorf("failed to get %v : %v", r.Key, err)
+		} else if string(actual.Value) != string(r.Value) || actual.Version != r.Version {
+			t.Errorf("record : %+v, expected %+v", actual, r)
+		}
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	dir := loadUpgradeFixture(t)
+	backup := filepath.Join(tmpdir, "data.backup")
+	if _, err := Upgrade(Options{Dir: dir}, filepath.Join(dir, "backup")); err == nil {
+		t.Errorf("backup in the data directory is accepted")
+	}
+
+	report, err := Upgrade(Options{Dir: dir}, "")
+	if err != nil {
+		t.Fatal(err)
+	} else if report.Layout != 0 || report.WALFormat != formatV1 || report.SnapshotFormat != formatV1 || !report.Upgraded || report.Resumed {
+		t.Errorf("report : %+v", report)
+	} else if abs, _ := filepath.Abs(backup); report.Backup != abs {
+		t.Errorf("backup : %v, expected %v", report.Backup, abs)
+	}
+	for _, name := range []string{fixtureWAL, fixtureDB} {
+		actual, err := ioutil.ReadFile(filepath.Join(backup, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		original, _ := formatFixtures.ReadFile("testdata/format/v1/map/" + name)
+		if !bytes.Equal(actual, original) {
+			t.Errorf("backup of %v does not match the original", name)
+		}
+	}
+	assertUpgraded(t, dir)
+
+	// the upgraded directory is not upgraded again
+	report, err = Upgrade(Options{Dir: dir}, "")
+	if err != nil {
+		t.Fatal(err)
+	} else if report.Upgraded || report.Backup != "" {
+		t.Errorf("report of the current formats : %+v", report)
+	}
+}
+
+func TestUpgrade_Resume(t *testing.T) {
+	for _, stage := range []string{upgradeBackup, upgradeConvert} {
+		t.Run(stage, func(t *testing.T) {
+			dir := loadUpgradeFixture(t)
+			backup, _ := filepath.Abs(filepath.Join(tmpdir, "data.backup"))
+			if err := copyDataDir(dir, backup); err != nil {
+				t.Fatal(err)
+			}
+			if stage == upgradeBackup {
+				// the backup is interrupted after the data file is copied
+				if err := os.Remove(filepath.Join(backup, fixtureWAL)); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				// the migration is interrupted after WAL is moved
+				if err := os.MkdirAll(filepath.Join(dir, dataDirWAL), 0777); err != nil {
+					t.Fatal(err)
+				} else if err = os.Rename(filepath.Join(dir, fixtureWAL), filepath.Join(dir, dataDirWAL, fixtureWAL)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.MkdirAll(filepath.Join(dir, dataDirTmp), 0777); err != nil {
+				t.Fatal(err)
+			}
+			state := upgradeState{Stage: stage, Report: UpgradeReport{Dir: dir, WALFormat: formatV1, SnapshotFormat: formatV1, Backup: backup}}
+			if err := writeJSONFile(osFS{}, dir, dataDirUpgrade, state); err != nil {
+				t.Fatal(err)
+			}
+
+			report, err := Upgrade(Options{Dir: dir}, "")
+			if err != nil {
+				t.Fatal(err)
+			} else if !report.Upgraded || !report.Resumed || report.Backup != backup {
+				t.Errorf("report : %+v", report)
+			} else if _, err = os.Stat(filepath.Join(backup, fixtureWAL)); err != nil {
+				t.Errorf("WAL is not backed up : %v", err)
+			}
+			assertUpgraded(t, dir)
+		})
+	}
+}
+
+func TestRunUpgradeCommand(t *testing.T) {
+	dir := loadUpgradeFixture(t)
+	var stdout, stderr bytes.Buffer
+	if status := runUpgradeCommand(Options{}, []string{"-json", dir}, &stdout, &stderr); status != exitOK {
+		t.Fatalf("status : %v (%s)", status, stderr.String())
+	}
+	var report UpgradeReport
+	if err := json.Unmarshal(stdout.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	} else if !report.Upgraded || report.WALFormat != formatV1 {
+		t.Errorf("report : %+v", report)
+	}
+
+	stdout.Reset()
+	if status := runUpgradeCommand(Options{}, []string{dir}, &stdout, &stderr); status != exitOK {
+		t.Fatalf("status : %v (%s)", status, stderr.String())
+	} else if !strings.Contains(stdout.String(), "already up to date\n") {
+		t.Errorf("output :\n%s", stdout.String())
+	}
+
+	if status := runUpgradeCommand(Options{}, []string{filepath.Join(tmpdir, "none")}, &stdout, &stderr); status != exitFailure {
+		t.Errorf("status of missing directory : %v", status)
+	}
+	for _, args := range [][]string{{"-unknown", dir}, {}, {dir, "arg"}} {
+		if status := runUpgradeCommand(Options{}, args, &stdout, &stderr); status != exitUsage {
+			t.Errorf("status of %v : %v", args, status)
+		}
+	}
+}
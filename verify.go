@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
+
+// VerifyReport is the result of the online consistency check by Storage.Verify.
+type VerifyReport struct {
+	Start   time.Time     `json:"start"`
+	Elapsed time.Duration `json:"elapsed"`
+	// Records is the number of records read through the engine.
+	Records int `json:"records"`
+	// Pages is the number of nodes, buckets or tables verified by the engine. 0 if the engine
+	// has no structure to verify other than records.
+	Pages int `json:"pages"`
+	// WALLogs and WALBytes are the number of logs and bytes in WAL which are verified.
+	WALLogs  int   `json:"wal_logs"`
+	WALBytes int64 `json:"wal_bytes"`
+	// Problems is the inconsistencies found. empty if the storage is consistent.
+	Problems []VerifyProblem `json:"problems"`
+}
+
+// VerifyProblem is the inconsistency found by Verify.
+type VerifyProblem struct {
+	// Check is the name of the failed check. "wal", "record", "count" and "order" are checked
+	// for all engines, and "btree", "hash", "lsm" and "partition" are of the engines. The
+	// self-check on open adds "lsn" and "manifest".
+	Check string `json:"check"`
+	// Key is the key of the broken record if known.
+	Key    string `json:"key,omitempty"`
+	Detail string `json:"detail"`
+	// Fatal is set by the self-check on open for problems which refuse to start in strict mode.
+	Fatal bool `json:"fatal,omitempty"`
+}
+
+// OK returns true if no problem is found.
+func (r *VerifyReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *VerifyReport) problem(p VerifyProblem) {
+	r.Problems = append(r.Problems, p)
+}
+
+// verifyEngine is the engine which verifies its own structures such as checksums of pages and
+// the index of records.
+type verifyEngine interface {
+	Backend
+	// Verify walks all structures and calls problem for each inconsistency. It returns the
+	// number of nodes, buckets or tables verified. It is called with Storage.muDB read locked,
+	// and returns error only if ctx is done.
+	Verify(ctx context.Context, problem func(VerifyProblem)) (int, error)
+}
+
+// verifyOf returns the verify engine under the wrappers.
+func verifyOf(e Backend) (verifyEngine, bool) {
+	for {
+		if v, ok := e.(verifyEngine); ok {
+			return v, true
+		} else if w, ok := e.(unwrapper); ok {
+			e = w.unwrap()
+		} else {
+			return nil, false
+		}
+	}
+}
+
+// Verify checks the consistency of the storage while it is open, and returns the report of
+// problems found. It re-verifies checksums of WAL, reads all records through the index of the
+// engine, and walks pages or tables of the engine to cross-check them with the index.
+// Commits wait while WAL or the structures of the engine are verified, but records are read
+// one by one. Pages cached in buffer pool are not read again, so DropCaches before Verify checks
+// all pages on disk. It returns error only if ctx is done.
+func (s *Storage) Verify(ctx context.Context) (*VerifyReport, error) {
+	r := &VerifyReport{Start: time.Now(), Problems: []VerifyProblem{}}
+	if err := s.verifyRecords(ctx, r); err != nil {
+		return nil, err
+	}
+	if err := s.verifyWAL(ctx, r); err != nil {
+		return nil, err
+	}
+	if v, ok := verifyOf(s.db); ok {
+		s.muDB.RLock()
+		n, err := v.Verify(ctx, r.problem)
+		s.muDB.RUnlock()
+		if err != nil {
+			return nil, err
+		}
+		r.Pages = n
+	}
+	r.Elapsed = time.Since(r.Start)
+	if !r.OK() {
+		s.logger().Warn("storage is inconsistent", "problems", len(r.Problems), "first", r.Problems[0].Detail)
+	}
+	return r, nil
+}
+
+// verifyRecords reads all records by the keys listed by the engine, and checks the count and
+// the order of keys.
+func (s *Storage) verifyRecords(ctx context.Context, r *VerifyReport) error {
+	var keys []string
+	s.muDB.RLock()
+	count := s.db.Len()
+	err := s.db.Keys("", func(key string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if err == nil {
+		if o, ok := orderedOf(s.db); ok {
+			i := len(keys)
+			err = o.KeysReverse("", func(key string) bool {
+				if i--; i < 0 || keys[i] != key {
+					r.problem(VerifyProblem{Check: "order", Key: key, Detail: "reverse iteration does not match forward iteration"})
+					return false
+				}
+				return true
+			})
+			if err == nil && i > 0 {
+				r.problem(VerifyProblem{Check: "order", Detail: fmt.Sprintf("reverse iteration misses %d keys", i)})
+			}
+		}
+	}
+	s.muDB.RUnlock()
+	if err != nil {
+		r.problem(VerifyProblem{Check: "record", Detail: fmt.Sprintf("failed to list keys : %v", err)})
+		return nil
+	}
+
+	if count != len(keys) {
+		r.problem(VerifyProblem{Check: "count", Detail: fmt.Sprintf("engine counts %d records, but lists %d keys", count, len(keys))})
+	}
+	_, ordered := orderedOf(s.db)
+	seen := make(map[string]struct{}, len(keys))
+	for i, key := range keys {
+		if _, ok := seen[key]; ok {
+			r.problem(VerifyProblem{Check: "order", Key: key, Detail: "key is listed twice"})
+		} else if ordered && i > 0 && keys[i-1] > key {
+			r.problem(VerifyProblem{Check: "order", Key: key, Detail: fmt.Sprintf("key is listed after %q", keys[i-1])})
+		}
+		seen[key] = struct{}{}
+	}
+
+	var maxVersion uint64
+	for i, key := range keys {
+		if i%256 == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		deleted := false
+		s.muDB.RLock()
+		rec, err := s.db.Get(key)
+		if err == ErrNotExist {
+			// the record may be deleted after listed
+			deleted = true
+			if kerr := s.db.Keys(key, func(k string) bool {
+				deleted = k != key
+				return deleted
+			}); kerr != nil {
+				deleted, err = false, kerr
+			}
+		}
+		s.muDB.RUnlock()
+		if deleted {
+			continue
+		} else if err == ErrNotExist {
+			r.problem(VerifyProblem{Check: "record", Key: key, Detail: "listed key is not found"})
+			continue
+		} else if err != nil {
+			r.problem(VerifyProblem{Check: "record", Key: key, Detail: fmt.Sprintf("failed to read : %v", err)})
+			continue
+		}
+		r.Records++
+		if rec.Key != key {
+			r.problem(VerifyProblem{Check: "record", Key: key, Detail: fmt.Sprintf("record has key %q", rec.Key)})
+		}
+		if rec.Version > maxVersion {
+			maxVersion = rec.Version
+		}
+	}
+
+	// versions read before are not newer than the version committed by now
+	s.muWAL.Lock()
+	version := s.version
+	s.muWAL.Unlock()
+	if maxVersion > version {
+		r.problem(VerifyProblem{Check: "record", Detail: fmt.Sprintf("record has version %d newer than committed version %d", maxVersion, version)})
+	}
+	return nil
+}
+
+// verifyWAL reads all logs in WAL and verifies their checksums.
+func (s *Storage) verifyWAL(ctx context.Context, r *VerifyReport) error {
+	s.muWAL.Lock()
+	defer s.muWAL.Unlock()
+	info, err := s.wal.Stat()
+	if err != nil {
+		r.problem(VerifyProblem{Check: "wal", Detail: fmt.Sprintf("failed to stat : %v", err)})
+		return nil
+	} else if info.Size() != s.walSize {
+		r.problem(VerifyProblem{Check: "wal", Detail: fmt.Sprintf("file size is %d, but %d bytes are logged", info.Size(), s.walSize)})
+	}
+
+	cr := &countReader{r: io.NewSectionReader(s.wal, 0, s.walSize)}
+	br := bufio.NewReader(cr)
+	for {
+		if r.WALLogs%256 == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		offset := cr.n - int64(br.Buffered())
+		rlog, err := readRecordLog(br)
+		if err == io.EOF {
+			break
+		} else if err == io.ErrUnexpectedEOF {
+			r.problem(VerifyProblem{Check: "wal", Detail: fmt.Sprintf("log at offset %d is torn", offset)})
+			break
+		} else if err != nil {
+			// logs after the broken log can not be located
+			r.problem(VerifyProblem{Check: "wal", Detail: fmt.Sprintf("log at offset %d is broken : %v", offset, err)})
+			break
+		}
+		r.WALLogs++
+		if rlog.Action != LEpoch && rlog.Version > s.version {
+			r.problem(VerifyProblem{Check: "wal", Key: rlog.Key, Detail: fmt.Sprintf("log at offset %d has version %d newer than committed version %d", offset, rlog.Version, s.version)})
+		}
+	}
+	r.WALBytes = cr.n - int64(br.Buffered())
+	return nil
+}
+
+// countReader counts bytes read from r.
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestStorage_Verify(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		opts  Options
+		pages bool
+	}{
+		{"map", Options{}, false},
+		{"btree", Options{Backend: "btree", CachePages: 4}, true},
+		{"hash", Options{Backend: "hash"}, true},
+		{"lsm", Options{Backend: "lsm", CheckpointSize: 4096}, true},
+		{"partitions", Options{Partitions: 3, Backend: "btree", Compress: true}, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_ = os.RemoveAll(tmpdir)
+			_ = os.MkdirAll(tmpdir, 0777)
+			opts := tt.opts
+			opts.WALPath, opts.DBPath = testWALPath, testDBPath
+			storage, err := Open(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer storage.wal.Close()
+			large := strings.Repeat("v", 2*overflowThreshold)
+			for i := 0; i < 500; i++ {
+				value := "value"
+				if i%50 == 0 {
+					value = large
+				}
+				if err = storage.Put(fmt.Sprintf("key%03d", i), []byte(value)); err != nil {
+					t.Fatal(err)
+				}
+				if i == 250 {
+					if err = storage.Checkpoint(); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			for i := 0; i < 500; i += 7 {
+				if err = storage.Delete(fmt.Sprintf("key%03d", i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			report, err := storage.Verify(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			} else if !report.OK() {
+				t.Fatalf("problems of consistent storage : %+v", report.Problems)
+			} else if report.Records != 500-72 || report.WALLogs == 0 || report.WALBytes != storage.walSize {
+				t.Errorf("report : %+v", report)
+			} else if tt.pages != (report.Pages > 0) {
+				t.Errorf("verified %d pages", report.Pages)
+			}
+		})
+	}
+}
+
+func TestStorage_Verify_WAL(t *testing.T) {
+	storage := createTestStorage(t)
+	defer storage.wal.Close()
+	for i := 0; i < 10; i++ {
+		if err := storage.Put(fmt.Sprintf("key%d", i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := os.OpenFile(testWALPath, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// corrupt the checksum of the last insert log followed by the commit log
+	if _, err = f.WriteAt([]byte("X"), storage.walSize-6); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := storage.Verify(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	} else if len(report.Problems) != 1 || report.Problems[0].Check != "wal" {
+		t.Fatalf("problems of broken WAL : %+v", report.Problems)
+	} else if !strings.Contains(report.Problems[0].Detail, ErrChecksum.Error()) {
+		t.Errorf("problem : %+v", report.Problems[0])
+	} else if report.WALBytes >= storage.walSize {
+		t.Errorf("verified %d bytes of broken WAL", report.WALBytes)
+	}
+}
+
+func TestStorage_Verify_BTree(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	storage, err := Open(Options{WALPath: testWALPath, DBPath: testDBPath, Backend: "btree", CachePages: defaultCachePages})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.wal.Close()
+	for i := 0; i < 500; i++ {
+		if err = storage.Put(fmt.Sprintf("key%03d", i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = storage.Checkpoint(); err != nil {
+		t.Fatal(err)
+	} else if _, err = storage.DropCaches(); err != nil {
+		t.Fatal(err)
+	}
+
+	tree := storage.db.(*BTree)
+	tree.count++
+	report, err := storage.Verify(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	} else if !hasProblem(report, "count") || !hasProblem(report, "btree") {
+		t.Errorf("problems of wrong count : %+v", report.Problems)
+	}
+	tree.count--
+
+	// corrupt the record at the tail of the first leaf which is written before the root
+	f, err := os.OpenFile(testDBPath, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err = f.WriteAt([]byte("X"), 3*pageSize-1); err != nil {
+		t.Fatal(err)
+	} else if _, err = storage.DropCaches(); err != nil {
+		t.Fatal(err)
+	}
+	if report, err = storage.Verify(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if !hasProblem(report, "btree") || !hasProblem(report, "record") {
+		t.Errorf("problems of broken page : %+v", report.Problems)
+	}
+}
+
+func TestStorage_Verify_Concurrent(t *testing.T) {
+	for _, engine := range []string{"map", "btree", "hash"} {
+		t.Run(engine, func(t *testing.T) {
+			_ = os.RemoveAll(tmpdir)
+			_ = os.MkdirAll(tmpdir, 0777)
+			storage, err := Open(Options{WALPath: testWALPath, DBPath: testDBPath, Backend: engine, CheckpointSize: 4096})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer storage.wal.Close()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for i := 0; i < 1000; i++ {
+					key := fmt.Sprintf("key%d", i%100)
+					if i%3 == 0 {
+						_ = storage.Delete(key)
+					} else if err := storage.Put(key, []byte("value")); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}()
+			for running := true; running; {
+				select {
+				case <-done:
+					running = false
+				default:
+				}
+				if report, err := storage.Verify(context.Background()); err != nil {
+					t.Fatal(err)
+				} else if !report.OK() {
+					t.Fatalf("problems while committing : %+v", report.Problems)
+				}
+			}
+		})
+	}
+}
+
+func TestStorage_Verify_Canceled(t *testing.T) {
+	storage := createTestStorage(t)
+	defer storage.wal.Close()
+	if err := storage.Put("key1", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := storage.Verify(ctx); err != context.Canceled {
+		t.Errorf("verify canceled : %v", err)
+	}
+}
+
+func hasProblem(report *VerifyReport, check string) bool {
+	for _, p := range report.Problems {
+		if p.Check == check {
+			return true
+		}
+	}
+	return false
+}
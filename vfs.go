@@ -0,0 +1,120 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// File is the file used by Storage. *os.File implements it.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.WriterAt
+	io.Seeker
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// FS opens files of Storage, so that tests inject faults of writes and fsync, or power loss.
+// Methods other than OpenFile follow the functions of the os package of the same names.
+type FS interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Stat(name string) (os.FileInfo, error)
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+	RemoveAll(path string) error
+	MkdirAll(path string, perm os.FileMode) error
+	// ReadDir returns entries of the directory sorted by their names.
+	ReadDir(name string) ([]os.FileInfo, error)
+}
+
+// openFile opens the file for reading.
+func openFile(fs FS, name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// createFile creates or truncates the file for writing.
+func createFile(fs FS, name string) (File, error) {
+	return fs.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0600)
+}
+
+// readFile reads the whole content of the file.
+func readFile(fs FS, name string) ([]byte, error) {
+	f, err := openFile(fs, name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// writeFileAtomic writes data into the file at path atomically by writing and syncing it into
+// tmpPath and renaming it.
+func writeFileAtomic(fs FS, path, tmpPath string, data []byte) error {
+	f, err := createFile(fs, tmpPath)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	} else if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	} else if err = f.Close(); err != nil {
+		return err
+	}
+	return fs.Rename(tmpPath, path)
+}
+
+// nullFile is WAL of the storage whose WAL is disabled. Writes are discarded and reads return
+// EOF.
+type nullFile struct{}
+
+func (nullFile) Read(p []byte) (int, error)                   { return 0, io.EOF }
+func (nullFile) ReadAt(p []byte, off int64) (int, error)      { return 0, io.EOF }
+func (nullFile) Write(p []byte) (int, error)                  { return len(p), nil }
+func (nullFile) WriteAt(p []byte, off int64) (int, error)     { return len(p), nil }
+func (nullFile) Seek(offset int64, whence int) (int64, error) { return 0, nil }
+func (nullFile) Close() error                                 { return nil }
+func (nullFile) Name() string                                 { return os.DevNull }
+func (nullFile) Stat() (os.FileInfo, error)                   { return nullFileInfo{}, nil }
+func (nullFile) Sync() error                                  { return nil }
+func (nullFile) Truncate(size int64) error                    { return nil }
+
+// nullFileInfo is the empty file.
+type nullFileInfo struct{}
+
+func (nullFileInfo) Name() string       { return os.DevNull }
+func (nullFileInfo) Size() int64        { return 0 }
+func (nullFileInfo) Mode() os.FileMode  { return 0600 }
+func (nullFileInfo) ModTime() time.Time { return time.Time{} }
+func (nullFileInfo) IsDir() bool        { return false }
+func (nullFileInfo) Sys() interface{}   { return nil }
+
+// osFS is FS of the operating system.
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error)        { return os.Stat(name) }
+func (osFS) Rename(oldpath, newpath string) error         { return os.Rename(oldpath, newpath) }
+func (osFS) Remove(name string) error                     { return os.Remove(name) }
+func (osFS) RemoveAll(path string) error                  { return os.RemoveAll(path) }
+func (osFS) MkdirAll(path string, perm os.FileMode) error { return os.MkdirAll(path, perm) }
+
+func (osFS) ReadDir(name string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(name)
+}
@@ -0,0 +1,618 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+var errInjected = errors.New("injected fault")
+
+// faultFS is the in-memory FS which injects faults into writes and fsync. Only synced content
+// of files survives powerLoss, while renames and removals of files are durable when they return
+// as on journaling file systems.
+type faultFS struct {
+	mu    sync.Mutex
+	files map[string]*memFile
+	dirs  map[string]bool
+	// ops is the number of writes, syncs, renames and removals. The crashAt-th op and all after
+	// it fail as if the power is lost at the point. 0 disables it.
+	ops     int
+	crashAt int
+	crashed bool
+	// failAt makes only the failAt-th op fail without the crash. 0 disables it.
+	failAt int
+	// partial makes the crashing write complete only the first half of the data.
+	partial bool
+	// dropSync makes Sync succeed without persisting the content.
+	dropSync bool
+	// full makes writes complete only the first half of the data and fail by ENOSPC.
+	full bool
+}
+
+// memFile is the content of the file. durable is the content at the last successful sync.
+type memFile struct {
+	data    []byte
+	durable []byte
+}
+
+func newFaultFS() *faultFS {
+	return &faultFS{files: make(map[string]*memFile), dirs: make(map[string]bool)}
+}
+
+func (fs *faultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	name = filepath.Clean(name)
+	f, ok := fs.files[name]
+	if !ok {
+		if flag&os.O_CREATE == 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		f = &memFile{}
+		fs.files[name] = f
+	}
+	if flag&os.O_TRUNC != 0 {
+		f.data = nil
+	}
+	return &faultFile{fs: fs, name: name, f: f, append: flag&os.O_APPEND != 0}, nil
+}
+
+func (fs *faultFS) Stat(name string) (os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	name = filepath.Clean(name)
+	if f, ok := fs.files[name]; ok {
+		return memFileInfo{name: filepath.Base(name), size: int64(len(f.data))}, nil
+	} else if fs.dirs[name] {
+		return memFileInfo{name: filepath.Base(name), dir: true}, nil
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+func (fs *faultFS) Rename(oldpath, newpath string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	f, ok := fs.files[oldpath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	} else if err := fs.fault(); err != nil {
+		return err
+	}
+	delete(fs.files, oldpath)
+	fs.files[newpath] = f
+	return nil
+}
+
+func (fs *faultFS) Remove(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	name = filepath.Clean(name)
+	if _, ok := fs.files[name]; !ok && !fs.dirs[name] {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	} else if err := fs.fault(); err != nil {
+		return err
+	}
+	delete(fs.files, name)
+	delete(fs.dirs, name)
+	return nil
+}
+
+func (fs *faultFS) RemoveAll(path string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	path = filepath.Clean(path)
+	if err := fs.fault(); err != nil {
+		return err
+	}
+	prefix := path + string(filepath.Separator)
+	for name := range fs.files {
+		if name == path || strings.HasPrefix(name, prefix) {
+			delete(fs.files, name)
+		}
+	}
+	for name := range fs.dirs {
+		if name == path || strings.HasPrefix(name, prefix) {
+			delete(fs.dirs, name)
+		}
+	}
+	return nil
+}
+
+func (fs *faultFS) MkdirAll(path string, perm os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for path = filepath.Clean(path); path != "." && path != string(filepath.Separator); path = filepath.Dir(path) {
+		fs.dirs[path] = true
+	}
+	return nil
+}
+
+func (fs *faultFS) ReadDir(name string) ([]os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	name = filepath.Clean(name)
+	if !fs.dirs[name] {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	var entries []os.FileInfo
+	for path, f := range fs.files {
+		if filepath.Dir(path) == name {
+			entries = append(entries, memFileInfo{name: filepath.Base(path), size: int64(len(f.data))})
+		}
+	}
+	for path := range fs.dirs {
+		if filepath.Dir(path) == name {
+			entries = append(entries, memFileInfo{name: filepath.Base(path), dir: true})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// fault counts the op and returns the error if it is after the crash point. it is called with
+// mu locked.
+func (fs *faultFS) fault() error {
+	fs.ops++
+	if fs.failAt > 0 && fs.ops == fs.failAt {
+		return errInjected
+	} else if fs.crashed {
+		return errInjected
+	} else if fs.crashAt > 0 && fs.ops >= fs.crashAt {
+		fs.crashed = true
+		return errInjected
+	}
+	return nil
+}
+
+// powerLoss discards content not synced, and heals faults. If torn is true, the first half of
+// unsynced appended data is kept as if it is flushed by the OS before the loss. Files opened
+// before must not be used after it.
+func (fs *faultFS) powerLoss(torn bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for _, f := range fs.files {
+		keep := len(f.durable)
+		if torn && len(f.data) > len(f.durable) && bytes.HasPrefix(f.data, f.durable) {
+			keep += (len(f.data) - len(f.durable)) / 2
+			f.data = append(f.durable[:0:0], f.data[:keep]...)
+		} else {
+			f.data = append([]byte(nil), f.durable...)
+		}
+		f.durable = append([]byte(nil), f.data...)
+	}
+	fs.ops, fs.crashAt, fs.crashed, fs.failAt = 0, 0, false, 0
+}
+
+type faultFile struct {
+	fs     *faultFS
+	name   string
+	f      *memFile
+	off    int64
+	append bool
+}
+
+func (f *faultFile) Name() string {
+	return f.name
+}
+
+func (f *faultFile) Read(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.off >= int64(len(f.f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.f.data[f.off:])
+	f.off += int64(n)
+	return n, nil
+}
+
+func (f *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if off >= int64(len(f.f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.f.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.append {
+		f.off = int64(len(f.f.data))
+	}
+	n, err := f.writeAt(p, f.off)
+	f.off += int64(n)
+	return n, err
+}
+
+func (f *faultFile) WriteAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	return f.writeAt(p, off)
+}
+
+// writeAt writes p at off with the fault injected. it is called with mu locked.
+func (f *faultFile) writeAt(p []byte, off int64) (int, error) {
+	crashing := !f.fs.crashed
+	err := f.fs.fault()
+	if err == nil && f.fs.full {
+		err = &os.PathError{Op: "write", Path: f.name, Err: syscall.ENOSPC}
+		p = p[:len(p)/2]
+	} else if err != nil {
+		if !crashing || !f.fs.partial {
+			return 0, err
+		}
+		p = p[:len(p)/2]
+	}
+	if end := off + int64(len(p)); end > int64(len(f.f.data)) {
+		f.f.data = append(f.f.data, make([]byte, end-int64(len(f.f.data)))...)
+	}
+	return copy(f.f.data[off:], p), err
+}
+
+func (f *faultFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += int64(len(f.f.data))
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.fs.fault(); err != nil {
+		return err
+	}
+	if size < int64(len(f.f.data)) {
+		f.f.data = f.f.data[:size]
+	} else {
+		f.f.data = append(f.f.data, make([]byte, size-int64(len(f.f.data)))...)
+	}
+	return nil
+}
+
+func (f *faultFile) Sync() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.fs.fault(); err != nil {
+		return err
+	} else if !f.fs.dropSync {
+		f.f.durable = append(f.f.durable[:0], f.f.data...)
+	}
+	return nil
+}
+
+func (f *faultFile) Stat() (os.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	return memFileInfo{name: f.name, size: int64(len(f.f.data))}, nil
+}
+
+func (f *faultFile) Close() error {
+	return nil
+}
+
+type memFileInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (i memFileInfo) Name() string { return i.name }
+func (i memFileInfo) Size() int64  { return i.size }
+func (i memFileInfo) Mode() os.FileMode {
+	if i.dir {
+		return os.ModeDir | 0700
+	}
+	return 0600
+}
+func (i memFileInfo) ModTime() time.Time { return time.Time{} }
+func (i memFileInfo) IsDir() bool        { return i.dir }
+func (i memFileInfo) Sys() interface{}   { return nil }
+
+// assertRecovered checks that exactly first n keys of "key<i>" are recovered.
+func assertRecovered(t *testing.T, storage *Storage, n, total int) {
+	t.Helper()
+	for i := 0; i < total; i++ {
+		v, err := storage.Get(fmt.Sprintf("key%d", i))
+		if i < n && (err != nil || string(v) != "value") {
+			t.Errorf("committed key%d : %q %v", i, v, err)
+		} else if i >= n && err != ErrNotExist {
+			t.Errorf("key%d of failed commit : %q %v", i, v, err)
+		}
+	}
+}
+
+func TestOpen_PowerLoss(t *testing.T) {
+	const total = 10
+	for _, torn := range []bool{false, true} {
+		// each commit writes WAL once and syncs once
+		for crashAt := 1; crashAt <= 2*total; crashAt++ {
+			t.Run(fmt.Sprintf("torn=%v/crash=%d", torn, crashAt), func(t *testing.T) {
+				_ = os.RemoveAll(tmpdir)
+				_ = os.MkdirAll(tmpdir, 0777)
+				fs := newFaultFS()
+				fs.partial = torn
+				opts := Options{WALPath: testWALPath, DBPath: testDBPath, FS: fs}
+				storage, err := Open(opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				fs.crashAt = crashAt
+				committed := 0
+				for ; committed < total; committed++ {
+					if err = storage.Put(fmt.Sprintf("key%d", committed), []byte("value")); err != nil {
+						break
+					}
+				}
+				if !errors.Is(err, errInjected) {
+					t.Fatalf("commit %d : %v", committed, err)
+				}
+				fs.powerLoss(torn)
+
+				if storage, err = Open(opts); err != nil {
+					t.Fatalf("failed to recover : %v", err)
+				}
+				assertRecovered(t, storage, committed, total)
+
+				// commits after recovery are not broken by the torn log
+				if err = storage.Put(fmt.Sprintf("key%d", committed), []byte("value")); err != nil {
+					t.Fatal(err)
+				}
+				fs.powerLoss(false)
+				if storage, err = Open(opts); err != nil {
+					t.Fatalf("failed to recover again : %v", err)
+				}
+				assertRecovered(t, storage, committed+1, total)
+			})
+		}
+	}
+}
+
+func TestOpen_DroppedSync(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	fs := newFaultFS()
+	opts := Options{WALPath: testWALPath, DBPath: testDBPath, FS: fs}
+	storage, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		// the disk lies about fsync after 5 commits
+		fs.dropSync = i >= 5
+		if err = storage.Put(fmt.Sprintf("key%d", i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs.powerLoss(false)
+	fs.dropSync = false
+
+	if storage, err = Open(opts); err != nil {
+		t.Fatal(err)
+	}
+	assertRecovered(t, storage, 5, 10)
+}
+
+func TestOpen_SyncMode(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	fs := newFaultFS()
+	opts := Options{WALPath: testWALPath, DBPath: testDBPath, FS: fs, SyncMode: SyncNone}
+	storage, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err = storage.Put(fmt.Sprintf("key%d", i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// commits not synced are lost by the crash of the OS
+	fs.powerLoss(false)
+	if storage, err = Open(opts); err != nil {
+		t.Fatal(err)
+	}
+	assertRecovered(t, storage, 0, 5)
+
+	for i := 0; i < 5; i++ {
+		if err = storage.Put(fmt.Sprintf("key%d", i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// shutdown syncs WAL without checkpoint
+	if err = storage.Shutdown(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+	fs.powerLoss(false)
+	if storage, err = Open(opts); err != nil {
+		t.Fatal(err)
+	}
+	assertRecovered(t, storage, 5, 5)
+
+	opts.SyncMode = "sometimes"
+	if _, err = Open(opts); err == nil {
+		t.Errorf("unknown sync mode is opened")
+	}
+}
+
+func TestOpen_CrashDuringCheckpoint(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	for _, backend := range []string{"map", "btree", "hash", "lsm"} {
+		// each op of the checkpoint crashes until it finishes
+		for crashAt, done := 1, false; !done; crashAt++ {
+			fs := newFaultFS()
+			fs.partial = true
+			opts := Options{Dir: tmpdir, Backend: backend, FS: fs}
+			storage, err := Open(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the second checkpoint replaces the data files of the first one
+			for i := 0; i < 10; i++ {
+				if err = storage.Put(fmt.Sprintf("key%d", i), []byte("value")); err != nil {
+					t.Fatal(err)
+				} else if i == 4 {
+					if err = storage.Checkpoint(); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			fs.crashAt = fs.ops + crashAt
+			if err = storage.Checkpoint(); err == nil {
+				done = true
+			} else if !errors.Is(err, errInjected) {
+				t.Fatalf("%v crash at %d : %v", backend, crashAt, err)
+			}
+			// the crashed process writes nothing after the crash
+			fs.crashAt = fs.ops + 1
+			storage.Close()
+			fs.powerLoss(true)
+
+			if storage, err = Open(opts); err != nil {
+				t.Fatalf("%v failed to recover from crash at %d : %v", backend, crashAt, err)
+			}
+			assertRecovered(t, storage, 10, 10)
+			if err = storage.Close(); err != nil {
+				t.Fatal(err)
+			} else if t.Failed() {
+				t.Fatalf("%v crash at %d", backend, crashAt)
+			}
+		}
+	}
+	// all files of the data directory are written into FS
+	if _, err := os.Stat(tmpdir); !os.IsNotExist(err) {
+		t.Errorf("files are written out of FS : %v", err)
+	}
+}
+
+func TestOpen_CrashDuringClearWAL(t *testing.T) {
+	// each op of the checkpoint crashes until it finishes
+	for crashAt, done := 1, false; !done; crashAt++ {
+		fs := newFaultFS()
+		opts := Options{Dir: tmpdir, FS: fs}
+		storage, err := Open(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		txn := storage.NewTxn()
+		if err = storage.Put("key", []byte("value")); err != nil {
+			t.Fatal(err)
+		} else if err = txn.Insert("prepared", []byte("value")); err != nil {
+			t.Fatal(err)
+		} else if err = txn.Prepare("g1"); err != nil {
+			t.Fatal(err)
+		} else if _, err = storage.setEpoch(3); err != nil {
+			t.Fatal(err)
+		}
+		fs.crashAt = fs.ops + crashAt
+		if err = storage.Checkpoint(); err == nil {
+			done = true
+		} else if !errors.Is(err, errInjected) {
+			t.Fatalf("crash at %d : %v", crashAt, err)
+		}
+		fs.crashAt = fs.ops + 1
+		storage.Close()
+		fs.powerLoss(true)
+
+		// the epoch and the prepared transaction survive the crash between truncating WAL and
+		// writing them again
+		if storage, err = Open(opts); err != nil {
+			t.Fatalf("failed to recover from crash at %d : %v", crashAt, err)
+		} else if epoch := storage.currentEpoch(); epoch != 3 {
+			t.Errorf("epoch %d after crash at %d, expected 3", epoch, crashAt)
+		}
+		if gids := storage.Prepared(); len(gids) != 1 || gids[0] != "g1" {
+			t.Errorf("prepared transactions %v after crash at %d, expected [g1]", gids, crashAt)
+		} else if err = storage.CommitPrepared("g1"); err != nil {
+			t.Errorf("failed to commit prepared transaction after crash at %d : %v", crashAt, err)
+		}
+		for _, key := range []string{"key", "prepared"} {
+			if v, err := storage.Get(key); err != nil || string(v) != "value" {
+				t.Errorf("value of %v after crash at %d : %q %v", key, crashAt, v, err)
+			}
+		}
+		if err = storage.Close(); err != nil {
+			t.Fatal(err)
+		} else if t.Failed() {
+			t.FailNow()
+		}
+	}
+}
+
+func TestStorage_FailedCommit(t *testing.T) {
+	_ = os.RemoveAll(tmpdir)
+	_ = os.MkdirAll(tmpdir, 0777)
+	fs := newFaultFS()
+	opts := Options{WALPath: testWALPath, DBPath: testDBPath, FS: fs}
+	storage, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	} else if err = storage.Put("a", []byte("committed")); err != nil {
+		t.Fatal(err)
+	}
+	walSize := len(fs.files[testWALPath].data)
+
+	// the write after the first log of the transaction fails
+	txn := storage.NewTxn()
+	if err = txn.Put("a", []byte("aborted")); err != nil {
+		t.Fatal(err)
+	} else if err = txn.Put("b", []byte("aborted")); err != nil {
+		t.Fatal(err)
+	}
+	fs.failAt = fs.ops + 2
+	if err = txn.Commit(); !errors.Is(err, errInjected) {
+		t.Fatalf("commit : %v", err)
+	}
+	txn.Abort()
+	if len(fs.files[testWALPath].data) != walSize {
+		t.Errorf("logs of failed commit are left : %v bytes, expected %v", len(fs.files[testWALPath].data), walSize)
+	}
+	if err = storage.Put("c", []byte("committed")); err != nil {
+		t.Fatal(err)
+	} else if err = storage.Shutdown(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+
+	// WAL is replayed without the failed transaction
+	if storage, err = Open(opts); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	txn = storage.NewTxn()
+	defer txn.Abort()
+	assertValue(t, txn, "a", []byte("committed"))
+	assertValue(t, txn, "c", []byte("committed"))
+	if _, err = txn.Read("b"); err != ErrNotExist {
+		t.Errorf("read record of failed commit : %v", err)
+	}
+	if v := storage.Stats().Version; v != 2 {
+		t.Errorf("version after failed commit : %v", v)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+// ValueFunc receives the value lent by View. The value refers to the memory of the engine or to
+// a buffer reused after it returns, so that it must not be modified or retained. Copy it to keep
+// it.
+type ValueFunc func(value []byte) error
+
+// viewEngine is the engine which lends values to View without allocating them.
+type viewEngine interface {
+	Backend
+	// View calls fn with the value of the record, which is valid only until fn returns. It is
+	// called with Storage.muDB locked shared.
+	View(key string, fn ValueFunc) error
+}
+
+// viewRecord lends the value of the record in e by View if e is viewEngine, or by Get.
+func viewRecord(e Backend, key string, fn ValueFunc) error {
+	if v, ok := e.(viewEngine); ok {
+		return v.View(key, fn)
+	}
+	r, err := e.Get(key)
+	if err != nil {
+		return err
+	}
+	return fn(r.Value)
+}
+
+// View reads the committed value of the record in a single operation without copying it, and
+// calls fn with the value under the read lock of the record. It returns ErrNotExist without
+// calling fn if the record does not exist or its TTL passes, or the error of fn. No Txn is
+// created for the hot path, so that hooks and the slow log do not see it. Commits applying
+// records wait until fn returns, so that fn must be short and must not write the storage.
+func (s *Storage) View(key string, fn ValueFunc) error {
+	if err := s.enter(); err != nil {
+		return err
+	}
+	defer s.leave()
+	s.lock.RLock(key)
+	defer s.lock.RUnlock(key)
+	s.muDB.RLock()
+	defer s.muDB.RUnlock()
+	if expired, err := s.expiredLocked(key); err != nil {
+		return err
+	} else if expired {
+		s.metrics.expiredReads.Inc()
+		return ErrNotExist
+	}
+	return viewRecord(s.db, key, fn)
+}
+
+// View lends the value in memory. The value kept on disk by Options.ValuesOnDisk is read into
+// the reused buffer, and the value evicted by Options.MaxMemory is cached as Get.
+func (e *mapEngine) View(key string, fn ValueFunc) error {
+	e.mu.Lock()
+	ent := e.records.get(key)
+	if ent == nil || !ent.cold || e.vlog == nil {
+		e.mu.Unlock()
+		r, err := e.Get(key)
+		if err != nil {
+			return err
+		}
+		return fn(r.Value)
+	}
+	buf := getReadBuffer()
+	defer putReadBuffer(buf)
+	value, err := e.readValueInto(ent, buf)
+	e.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return fn(value)
+}
+
+// View lends the value in memory, or reads the value in value log into the reused buffer.
+func (l *LSM) View(key string, fn ValueFunc) error {
+	buf := getReadBuffer()
+	defer putReadBuffer(buf)
+	r, err := l.get(key, buf)
+	if err != nil {
+		return err
+	}
+	return fn(r.Value)
+}
+
+// View lends the value by the partition of the key.
+func (p *partitionEngine) View(key string, fn ValueFunc) error {
+	e, err := p.partition(key)
+	if err != nil {
+		return err
+	}
+	return viewRecord(e, key, fn)
+}
+
+// View lends the value by the engine of the column family of the key.
+func (f *familyEngine) View(key string, fn ValueFunc) error {
+	e, k := f.route(key)
+	return viewRecord(e, k, fn)
+}
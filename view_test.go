@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+// viewValue returns the copy of the value lent by View.
+func viewValue(storage *Storage, key string) ([]byte, error) {
+	var value []byte
+	err := storage.View(key, func(v []byte) error {
+		value = append([]byte{}, v...)
+		return nil
+	})
+	return value, err
+}
+
+func TestStorage_View(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		opts Options
+	}{
+		{"map", Options{}},
+		{"map-values-on-disk", Options{ValuesOnDisk: true}},
+		{"btree", Options{Backend: "btree", CachePages: 4}},
+		{"lsm", Options{Backend: "lsm"}},
+		{"partitions", Options{Partitions: 3, Backend: "lsm"}},
+		{"compress", Options{Backend: "lsm", Compress: true}},
+		{"families", Options{ColumnFamilies: []FamilyOptions{{Name: "cf", Backend: "btree"}}}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_ = os.RemoveAll(tmpdir)
+			_ = os.MkdirAll(tmpdir, 0777)
+			opts := tt.opts
+			opts.WALPath, opts.DBPath = testWALPath, testDBPath
+			storage, err := Open(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer storage.wal.Close()
+
+			// values larger than vlogThreshold are read from value log into the reused buffer
+			expected := make(map[string][]byte)
+			for i := 0; i < 20; i++ {
+				key, value := fmt.Sprintf("key%02d", i), bytes.Repeat([]byte{byte(i)}, 100*i)
+				if err := storage.Put(key, value); err != nil {
+					t.Fatal(err)
+				}
+				expected[key] = value
+			}
+			for _, checkpoint := range []bool{false, true} {
+				if checkpoint {
+					if err := storage.Checkpoint(); err != nil {
+						t.Fatal(err)
+					}
+				}
+				for i := 0; i < 20; i++ {
+					key := fmt.Sprintf("key%02d", i)
+					if value, err := viewValue(storage, key); err != nil {
+						t.Fatalf("failed to view %v : %v", key, err)
+					} else if !bytes.Equal(value, expected[key]) {
+						t.Errorf("value of %v : %v bytes, expected %v bytes", key, len(value), len(expected[key]))
+					}
+				}
+			}
+
+			called := false
+			if err := storage.View("none", func([]byte) error { called = true; return nil }); err != ErrNotExist {
+				t.Errorf("view of not existing record : %v", err)
+			} else if called {
+				t.Errorf("fn is called for not existing record")
+			}
+			errFn := errors.New("fn")
+			if err := storage.View("key01", func([]byte) error { return errFn }); err != errFn {
+				t.Errorf("error of fn : %v", err)
+			}
+		})
+	}
+}
+
+func TestStorage_View_Closed(t *testing.T) {
+	storage := createTestStorage(t)
+	if err := storage.Put("key1", []byte("value1")); err != nil {
+		t.Fatal(err)
+	} else if err = storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.View("key1", func([]byte) error { return nil }); err != ErrClosed {
+		t.Errorf("view of closed storage : %v", err)
+	}
+}
+
+func TestRecord_DeserializeUnsafe(t *testing.T) {
+	r := Record{Key: "key1", Value: []byte("value1"), Version: 3}
+	buf := make([]byte, 64)
+	n, err := r.Serialize(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var safe, unsafe Record
+	if _, err = safe.Deserialize(buf[:n]); err != nil {
+		t.Fatal(err)
+	} else if m, err := unsafe.DeserializeUnsafe(buf[:n]); err != nil || m != n {
+		t.Fatalf("deserialize unsafe : %v bytes, %v", m, err)
+	} else if unsafe.Key != r.Key || !bytes.Equal(unsafe.Value, r.Value) || unsafe.Version != r.Version {
+		t.Fatalf("record : %+v, expected %+v", unsafe, r)
+	}
+	// the value refers to buf without capacity to be appended over it
+	copy(buf[n-len(r.Value):n], "VALUE1")
+	if string(unsafe.Value) != "VALUE1" || string(safe.Value) != "value1" {
+		t.Errorf("values after buf is modified : unsafe %q, safe %q", unsafe.Value, safe.Value)
+	} else if cap(unsafe.Value) != len(unsafe.Value) {
+		t.Errorf("capacity of value : %v", cap(unsafe.Value))
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"sync"
+)
+
+const (
+	// values larger than vlogThreshold are separated from sstables into value log.
+	vlogThreshold = 1024
+
+	vlogHeaderSize   = 8
+	valuePointerSize = 12
+)
+
+// valuePointer is the location of the value in value log.
+type valuePointer struct {
+	offset int64
+	length uint32
+}
+
+func (p valuePointer) encode() []byte {
+	var buf [valuePointerSize]byte
+	binary.BigEndian.PutUint64(buf[0:8], uint64(p.offset))
+	binary.BigEndian.PutUint32(buf[8:12], p.length)
+	return buf[:]
+}
+
+func decodeValuePointer(buf []byte) (valuePointer, error) {
+	if len(buf) != valuePointerSize {
+		return valuePointer{}, ErrBrokenTable
+	}
+	return valuePointer{
+		offset: int64(binary.BigEndian.Uint64(buf[0:8])),
+		length: binary.BigEndian.Uint32(buf[8:12]),
+	}, nil
+}
+
+// valueLog is the append-only file of large values like WiscKey. sstables keep only
+// the pointers of the values, so that compaction does not rewrite large values.
+// Values not referenced by crash before manifest update are left as garbage.
+// TODO: garbage collection of overwritten or deleted values
+type valueLog struct {
+	path string
+	fs   FS
+	mu   sync.Mutex
+	f    File
+	size int64
+}
+
+func (v *valueLog) open() error {
+	if v.f != nil {
+		return nil
+	}
+	f, err := v.fs.OpenFile(v.path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	v.f, v.size = f, info.Size()
+	return nil
+}
+
+// append layout : length(4) | crc32(4) | value
+func (v *valueLog) append(value []byte) (valuePointer, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if err := v.open(); err != nil {
+		return valuePointer{}, err
+	}
+	buf := make([]byte, vlogHeaderSize+len(value))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(value)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(value))
+	copy(buf[vlogHeaderSize:], value)
+	if _, err := v.f.WriteAt(buf, v.size); err != nil {
+		return valuePointer{}, err
+	}
+	p := valuePointer{offset: v.size, length: uint32(len(value))}
+	v.size += int64(len(buf))
+	return p, nil
+}
+
+func (v *valueLog) sync() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.f == nil {
+		return nil
+	}
+	return v.f.Sync()
+}
+
+func (v *valueLog) read(p valuePointer) ([]byte, error) {
+	return v.readInto(p, nil)
+}
+
+// readInto reads the value into the buffer *reuse if it is not nil, which is grown if it is short.
+func (v *valueLog) readInto(p valuePointer, reuse *[]byte) ([]byte, error) {
+	v.mu.Lock()
+	err := v.open()
+	f := v.f
+	v.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	var buf []byte
+	if size := vlogHeaderSize + int(p.length); reuse == nil {
+		buf = make([]byte, size)
+	} else {
+		if cap(*reuse) < size {
+			*reuse = make([]byte, size)
+		}
+		buf = (*reuse)[:size]
+	}
+	if _, err = f.ReadAt(buf, p.offset); err != nil {
+		return nil, err
+	} else if binary.BigEndian.Uint32(buf[0:4]) != p.length {
+		return nil, ErrBrokenTable
+	} else if binary.BigEndian.Uint32(buf[4:8]) != crc32.ChecksumIEEE(buf[vlogHeaderSize:]) {
+		return nil, ErrChecksum
+	}
+	return buf[vlogHeaderSize:], nil
+}
+
+// truncate removes all values in value log.
+func (v *valueLog) truncate() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if err := v.open(); err != nil {
+		return err
+	} else if err = v.f.Truncate(0); err != nil {
+		return err
+	}
+	v.size = 0
+	return nil
+}
+
+func (v *valueLog) close() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.f == nil {
+		return nil
+	}
+	err := v.f.Close()
+	v.f = nil
+	return err
+}
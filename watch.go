@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+var ErrWatchOverflow = errors.New("watcher is too slow to receive events")
+
+// Event is the change of the key committed by a transaction.
+type Event struct {
+	Key string
+	// Value is the new value, nil if the key is deleted. it must not be modified.
+	Value   []byte
+	Version uint64
+	Deleted bool
+}
+
+// Watcher receives events of keys with the prefix in commit order. Events are sent after the
+// transaction is written to WAL. If the buffer of C is full, C is closed and Err returns
+// ErrWatchOverflow, so that the slow watcher does not block commits and can resync.
+type Watcher struct {
+	C <-chan Event
+
+	ch     chan Event
+	prefix string
+	hub    *watchHub
+	// err is the reason why ch is closed. protected by hub.mu.
+	err error
+}
+
+// watchHub dispatches events of applied logs to watchers. the zero value is ready to use.
+type watchHub struct {
+	mu       sync.Mutex
+	watchers map[*Watcher]struct{}
+}
+
+// Watch registers the watcher of keys with the prefix. buffer is the number of events buffered
+// in C. Watcher must be closed after use.
+func (s *Storage) Watch(prefix string, buffer int) *Watcher {
+	ch := make(chan Event, buffer)
+	w := &Watcher{C: ch, ch: ch, prefix: prefix, hub: &s.watch}
+	s.watch.mu.Lock()
+	defer s.watch.mu.Unlock()
+	if s.watch.watchers == nil {
+		s.watch.watchers = make(map[*Watcher]struct{})
+	}
+	s.watch.watchers[w] = struct{}{}
+	return w
+}
+
+// Close unregisters the watcher and closes C.
+func (w *Watcher) Close() {
+	w.hub.mu.Lock()
+	defer w.hub.mu.Unlock()
+	w.hub.remove(w, nil)
+}
+
+// Err returns ErrWatchOverflow if C is closed because events overflowed.
+func (w *Watcher) Err() error {
+	w.hub.mu.Lock()
+	defer w.hub.mu.Unlock()
+	return w.err
+}
+
+// remove closes ch of the registered watcher. hub.mu must be locked.
+func (h *watchHub) remove(w *Watcher, err error) {
+	if _, ok := h.watchers[w]; ok {
+		delete(h.watchers, w)
+		w.err = err
+		close(w.ch)
+	}
+}
+
+// notify sends events of logs to watchers. it is called in the order of commits.
+func (h *watchHub) notify(logs []RecordLog) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.watchers) == 0 {
+		return
+	}
+	for _, rlog := range logs {
+		var e Event
+		switch rlog.Action {
+		case LInsert, LUpdate:
+			e = Event{Key: rlog.Key, Value: rlog.Value, Version: rlog.Version}
+		case LDelete:
+			e = Event{Key: rlog.Key, Version: rlog.Version, Deleted: true}
+		default:
+			continue
+		}
+		for w := range h.watchers {
+			if !strings.HasPrefix(e.Key, w.prefix) {
+				continue
+			}
+			select {
+			case w.ch <- e:
+			default:
+				h.remove(w, ErrWatchOverflow)
+			}
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestStorage_Watch(t *testing.T) {
+	storage := createTestStorage(t)
+	defer storage.wal.Close()
+	w := storage.Watch("key", 2)
+	defer w.Close()
+
+	txn := storage.NewTxn()
+	if err := txn.Insert("key1", []byte("value1")); err != nil {
+		t.Fatal(err)
+	} else if err = txn.Insert("other", []byte("value")); err != nil {
+		t.Fatal(err)
+	} else if err = txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	// aborted writes are not notified
+	txn = storage.NewTxn()
+	if err := txn.Insert("key2", []byte("value2")); err != nil {
+		t.Fatal(err)
+	}
+	txn.Abort()
+	if err := storage.Delete("key1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if e := <-w.C; e.Key != "key1" || string(e.Value) != "value1" || e.Version != 1 || e.Deleted {
+		t.Errorf("insert event : %+v", e)
+	} else if e = <-w.C; e.Key != "key1" || e.Version != 2 || !e.Deleted {
+		t.Errorf("delete event : %+v", e)
+	}
+
+	// the slow watcher is closed instead of blocking commits
+	for _, key := range []string{"key1", "key2", "key3"} {
+		if err := storage.Put(key, []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var n int
+	for range w.C {
+		n++
+	}
+	if n != 2 || w.Err() != ErrWatchOverflow {
+		t.Errorf("overflowed watcher received %v events : %v", n, w.Err())
+	}
+	w.Close()
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const defaultWebhookTimeout = 10 * time.Second
+
+// Webhook is the HTTP endpoint which receives the summary of each committed transaction which
+// writes the keys with any of the prefixes, or any keys if Prefixes is empty.
+type Webhook struct {
+	Name     string
+	URL      string
+	Prefixes []string
+}
+
+// WebhookOptions is the options of delivery of webhooks.
+type WebhookOptions struct {
+	// RetryInterval is the first interval of retry after failure. It is doubled for each
+	// failure up to MaxRetryInterval.
+	RetryInterval    time.Duration
+	MaxRetryInterval time.Duration
+	// Client sends requests. The client with 10 seconds timeout is used if nil.
+	Client *http.Client
+}
+
+// WebhookEvent is the JSON body posted to webhooks.
+type WebhookEvent struct {
+	Version uint64            `json:"version"`
+	Time    time.Time         `json:"time"`
+	Writes  []WebhookKeyWrite `json:"writes"`
+}
+
+type WebhookKeyWrite struct {
+	Key string `json:"key"`
+	// Op is "set" or "del".
+	Op string `json:"op"`
+}
+
+// Webhooks delivers summaries of commits at least once by the feed of each webhook, so that
+// undelivered summaries are retried after restart.
+type Webhooks struct {
+	feeds []*Feed
+}
+
+// StartWebhooks starts delivery of webhooks of the primary. The names of webhooks must be unique
+// and kept across restarts to deliver the outbox.
+func StartWebhooks(s *Storage, hooks []Webhook, opts WebhookOptions) (*Webhooks, error) {
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: defaultWebhookTimeout}
+	}
+	w := &Webhooks{}
+	names := make(map[string]bool)
+	for _, hook := range hooks {
+		if hook.Name == "" || strings.Contains(hook.Name, "/") || names[hook.Name] {
+			return nil, fmt.Errorf("invalid or duplicate name of webhook : %q", hook.Name)
+		}
+		names[hook.Name] = true
+	}
+	for _, hook := range hooks {
+		f, err := StartFeed(s, hook.Name, &webhookSink{hook: hook, client: opts.Client}, FeedOptions{
+			Prefixes:         hook.Prefixes,
+			RetryInterval:    opts.RetryInterval,
+			MaxRetryInterval: opts.MaxRetryInterval,
+		})
+		if err != nil {
+			w.Stop()
+			return nil, err
+		}
+		w.feeds = append(w.feeds, f)
+	}
+	return w, nil
+}
+
+// Stop stops delivery. Undelivered summaries are kept in the outbox.
+func (w *Webhooks) Stop() {
+	for _, f := range w.feeds {
+		f.Stop()
+	}
+}
+
+// webhookSink posts the summary of each transaction in changes.
+type webhookSink struct {
+	hook   Webhook
+	client *http.Client
+}
+
+func (s *webhookSink) Write(changes []Change) error {
+	for len(changes) > 0 {
+		event := WebhookEvent{Version: changes[0].Version, Time: changes[0].Time}
+		for len(changes) > 0 && changes[0].Version == event.Version {
+			op := "set"
+			if changes[0].Deleted {
+				op = "del"
+			}
+			event.Writes = append(event.Writes, WebhookKeyWrite{Key: changes[0].Key, Op: op})
+			changes = changes[1:]
+		}
+		if err := s.post(&event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *webhookSink) post(event *WebhookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Txngo-Webhook", s.hook.Name)
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("webhook responds %v", res.Status)
+	}
+	return nil
+}
+
+func (s *webhookSink) Close() error {
+	return nil
+}
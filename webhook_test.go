@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhooks(t *testing.T) {
+	storage := createTestStorage(t)
+	defer storage.wal.Close()
+	var (
+		mu       sync.Mutex
+		failing  = true
+		received []WebhookEvent
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failing {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		var e WebhookEvent
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil || r.Header.Get("X-Txngo-Webhook") != "orders" {
+			t.Errorf("invalid webhook request : %v", err)
+		}
+		received = append(received, e)
+	}))
+	defer srv.Close()
+	opts := WebhookOptions{RetryInterval: 10 * time.Millisecond, MaxRetryInterval: 10 * time.Millisecond}
+	hooks := []Webhook{{Name: "orders", URL: srv.URL, Prefixes: []string{"order/"}}}
+	webhooks, err := StartWebhooks(storage, hooks, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	txn := storage.NewTxn()
+	if err = txn.Insert("order/1", []byte("a")); err != nil {
+		t.Fatal(err)
+	} else if err = txn.Insert("user/1", []byte("b")); err != nil {
+		t.Fatal(err)
+	} else if err = txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err = storage.Put("user/2", []byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	// undelivered summaries are kept in the outbox while the webhook fails
+	time.Sleep(50 * time.Millisecond)
+	webhooks.Stop()
+	if _, err = storage.Get(outboxKey("orders", 1)); err != nil {
+		t.Fatalf("outbox of failed webhook : %v", err)
+	}
+
+	mu.Lock()
+	failing = false
+	mu.Unlock()
+	if webhooks, err = StartWebhooks(storage, hooks, opts); err != nil {
+		t.Fatal(err)
+	}
+	defer webhooks.Stop()
+	if err = storage.Delete("order/1"); err != nil {
+		t.Fatal(err)
+	}
+	waitRaft(t, "webhooks are delivered", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received) == 2
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	if received[0].Version != 1 || !reflect.DeepEqual(received[0].Writes, []WebhookKeyWrite{{Key: "order/1", Op: "set"}}) {
+		t.Errorf("first webhook : %+v", received[0])
+	} else if received[1].Version != 3 || !reflect.DeepEqual(received[1].Writes, []WebhookKeyWrite{{Key: "order/1", Op: "del"}}) {
+		t.Errorf("second webhook : %+v", received[1])
+	}
+	waitRaft(t, "outbox is cleared", func() bool {
+		keys, _, err := storage.ScanKeys(scanStart, outboxPrefix, 10, nil)
+		return err == nil && len(keys) == 0
+	})
+
+	if _, err = StartWebhooks(storage, []Webhook{{Name: "a"}, {Name: "a"}}, opts); err == nil {
+		t.Errorf("duplicate names of webhooks are accepted")
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// max sizes of the global transaction id and the branch qualifier of XID by the XA specification.
+const (
+	maxGlobalIDSize        = 64
+	maxBranchQualifierSize = 64
+)
+
+// xidPrefix is the prefix of global transaction ids of two-phase commit which XID is encoded into.
+const xidPrefix = "xa."
+
+var (
+	// ErrUnknownXID is returned when the transaction branch is neither started nor prepared, as
+	// XAER_NOTA of XA.
+	ErrUnknownXID = errors.New("transaction branch is unknown")
+	// ErrDuplicateXID is returned when the transaction branch is already started or prepared, as
+	// XAER_DUPID of XA.
+	ErrDuplicateXID = errors.New("transaction branch already exists")
+)
+
+// XID identifies the transaction branch by the external transaction manager of XA.
+type XID struct {
+	FormatID        int32
+	GlobalID        []byte
+	BranchQualifier []byte
+}
+
+// String encodes the XID into the global transaction id of two-phase commit, which fits in the
+// key of the prepare log.
+func (x XID) String() string {
+	enc := base64.RawURLEncoding
+	return xidPrefix + strconv.FormatInt(int64(x.FormatID), 10) + "." + enc.EncodeToString(x.GlobalID) + "." + enc.EncodeToString(x.BranchQualifier)
+}
+
+func (x XID) validate() error {
+	if len(x.GlobalID) == 0 || len(x.GlobalID) > maxGlobalIDSize {
+		return fmt.Errorf("invalid global transaction id of %v bytes", len(x.GlobalID))
+	} else if len(x.BranchQualifier) > maxBranchQualifierSize {
+		return fmt.Errorf("invalid branch qualifier of %v bytes", len(x.BranchQualifier))
+	}
+	return nil
+}
+
+// ParseXID decodes the global transaction id encoded by XID.String.
+func ParseXID(gid string) (XID, error) {
+	parts := strings.Split(strings.TrimPrefix(gid, xidPrefix), ".")
+	if !strings.HasPrefix(gid, xidPrefix) || len(parts) != 3 {
+		return XID{}, fmt.Errorf("invalid XID %q", gid)
+	}
+	format, err := strconv.ParseInt(parts[0], 10, 32)
+	if err != nil {
+		return XID{}, fmt.Errorf("invalid format id of XID %q : %w", gid, err)
+	}
+	xid := XID{FormatID: int32(format)}
+	if xid.GlobalID, err = base64.RawURLEncoding.DecodeString(parts[1]); err != nil {
+		return XID{}, fmt.Errorf("invalid global transaction id of XID %q : %w", gid, err)
+	} else if xid.BranchQualifier, err = base64.RawURLEncoding.DecodeString(parts[2]); err != nil {
+		return XID{}, fmt.Errorf("invalid branch qualifier of XID %q : %w", gid, err)
+	}
+	return xid, xid.validate()
+}
+
+// XAResource is the resource manager of the storage for external transaction managers of the
+// XA model. Transaction branches are started by Start, and decided by Prepare and Commit or by
+// Rollback. Prepared branches are persisted in WAL by two-phase commit of the storage, survive
+// checkpoint and restart, and are listed by Recover. Branches started but not prepared are lost
+// by restart, which the transaction manager sees as rolled back. The storage must have one
+// XAResource.
+type XAResource struct {
+	s *Storage
+	// mu protects active, which is the transactions of branches started and not prepared yet.
+	mu     sync.Mutex
+	active map[string]*Txn
+}
+
+// NewXAResource returns the resource manager of the storage.
+func NewXAResource(s *Storage) *XAResource {
+	return &XAResource{s: s, active: make(map[string]*Txn)}
+}
+
+// Start starts the transaction branch, and returns the transaction which does the work of it.
+// The transaction must not be committed or aborted by itself.
+func (r *XAResource) Start(xid XID) (*Txn, error) {
+	if err := xid.validate(); err != nil {
+		return nil, err
+	}
+	gid := xid.String()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.active[gid]; ok {
+		return nil, ErrDuplicateXID
+	} else if r.prepared(gid) {
+		return nil, ErrDuplicateXID
+	}
+	txn := r.s.NewTxn()
+	r.active[gid] = txn
+	return txn, nil
+}
+
+// Prepare prepares the started branch. If it fails, the branch is rolled back.
+func (r *XAResource) Prepare(xid XID) error {
+	gid := xid.String()
+	txn, err := r.take(gid)
+	if err != nil {
+		return err
+	} else if err = txn.Prepare(gid); err != nil {
+		txn.Abort()
+		if err == ErrPrepared {
+			return ErrDuplicateXID
+		}
+		return err
+	}
+	return nil
+}
+
+// Commit commits the prepared branch. If onePhase is true, the started branch is committed
+// without being prepared by the one-phase optimization of the transaction manager.
+func (r *XAResource) Commit(xid XID, onePhase bool) error {
+	gid := xid.String()
+	if onePhase {
+		txn, err := r.take(gid)
+		if err != nil {
+			return err
+		} else if err = txn.Commit(); err != nil {
+			txn.Abort()
+			return err
+		}
+		return nil
+	}
+	if err := r.s.CommitPrepared(gid); err == ErrNotPrepared {
+		return ErrUnknownXID
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Rollback rolls back the started or prepared branch.
+func (r *XAResource) Rollback(xid XID) error {
+	gid := xid.String()
+	if txn, err := r.take(gid); err == nil {
+		txn.Abort()
+		return nil
+	}
+	if err := r.s.AbortPrepared(gid); err == ErrNotPrepared {
+		return ErrUnknownXID
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Recover returns XIDs of the prepared branches, which are in doubt after restart and must be
+// decided by the transaction manager. Prepared transactions whose global transaction ids are
+// not XIDs are excluded.
+func (r *XAResource) Recover() []XID {
+	var xids []XID
+	for _, gid := range r.s.Prepared() {
+		if xid, err := ParseXID(gid); err == nil {
+			xids = append(xids, xid)
+		}
+	}
+	return xids
+}
+
+// take removes the started branch from active and returns its transaction.
+func (r *XAResource) take(gid string) (*Txn, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	txn, ok := r.active[gid]
+	if !ok {
+		if r.prepared(gid) {
+			return nil, ErrPrepared
+		}
+		return nil, ErrUnknownXID
+	}
+	delete(r.active, gid)
+	return txn, nil
+}
+
+// prepared returns true if the branch is prepared.
+func (r *XAResource) prepared(gid string) bool {
+	r.s.muWAL.Lock()
+	defer r.s.muWAL.Unlock()
+	_, ok := r.s.prepared[gid]
+	return ok
+}
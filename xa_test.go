@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestParseXID(t *testing.T) {
+	for _, xid := range []XID{
+		{FormatID: 0x1234, GlobalID: []byte("global"), BranchQualifier: []byte("branch")},
+		{FormatID: -1, GlobalID: []byte{0, '.', ' ', 0xff}},
+		{FormatID: 1, GlobalID: bytes.Repeat([]byte{0xff}, maxGlobalIDSize), BranchQualifier: bytes.Repeat([]byte{0xff}, maxBranchQualifierSize)},
+	} {
+		gid := xid.String()
+		if len(gid) > 255 {
+			t.Errorf("gid of %v bytes does not fit in the key", len(gid))
+		}
+		actual, err := ParseXID(gid)
+		if err != nil {
+			t.Errorf("failed to parse %q : %v", gid, err)
+		} else if actual.FormatID != xid.FormatID || !bytes.Equal(actual.GlobalID, xid.GlobalID) || !bytes.Equal(actual.BranchQualifier, xid.BranchQualifier) {
+			t.Errorf("parsed %+v, expected %+v", actual, xid)
+		}
+	}
+	for _, gid := range []string{"g1", "xa.1.Z2xvYmFs", "xa.x.Z2xvYmFs.", "xa.1..", "xa.1.Z2xvYmFs.!"} {
+		if _, err := ParseXID(gid); err == nil {
+			t.Errorf("invalid XID %q is parsed", gid)
+		}
+	}
+}
+
+func TestXAResource(t *testing.T) {
+	storage := createTestStorage(t)
+	defer storage.wal.Close()
+	xa := NewXAResource(storage)
+	xid := func(branch string) XID {
+		return XID{FormatID: 1, GlobalID: []byte("global"), BranchQualifier: []byte(branch)}
+	}
+	start := func(branch, key string) {
+		t.Helper()
+		txn, err := xa.Start(xid(branch))
+		if err != nil {
+			t.Fatal(err)
+		} else if err = txn.Put(key, []byte(branch)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	start("b1", "key1")
+	if _, err := xa.Start(xid("b1")); err != ErrDuplicateXID {
+		t.Errorf("start of started branch : %v", err)
+	} else if err = xa.Prepare(xid("b1")); err != nil {
+		t.Fatalf("failed to prepare : %v", err)
+	} else if _, err = xa.Start(xid("b1")); err != ErrDuplicateXID {
+		t.Errorf("start of prepared branch : %v", err)
+	} else if _, err = xa.Start(XID{}); err == nil {
+		t.Errorf("XID without global transaction id is started")
+	}
+
+	// started branches are committed by one phase or rolled back
+	start("b2", "key2")
+	start("b3", "key3")
+	if err := xa.Commit(xid("b2"), true); err != nil {
+		t.Fatalf("failed to commit one phase : %v", err)
+	} else if err = xa.Rollback(xid("b3")); err != nil {
+		t.Fatalf("failed to roll back started branch : %v", err)
+	}
+	start("b4", "key4")
+	if err := xa.Prepare(xid("b4")); err != nil {
+		t.Fatal(err)
+	} else if err = xa.Rollback(xid("b4")); err != nil {
+		t.Fatalf("failed to roll back prepared branch : %v", err)
+	}
+	for _, err := range []error{xa.Prepare(xid("b5")), xa.Commit(xid("b5"), false), xa.Commit(xid("b5"), true), xa.Rollback(xid("b5"))} {
+		if err != ErrUnknownXID {
+			t.Errorf("decision of unknown branch : %v", err)
+		}
+	}
+
+	// prepared branches survive restart, and transactions prepared without XID are excluded
+	txn := storage.NewTxn()
+	if err := txn.Put("key6", []byte("g")); err != nil {
+		t.Fatal(err)
+	} else if err = txn.Prepare("g1"); err != nil {
+		t.Fatal(err)
+	}
+	storage.wal.Close()
+	wal, err := os.OpenFile(testWALPath, os.O_APPEND|os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage = NewStorage(wal, testDBPath, testTmpPath)
+	defer storage.wal.Close()
+	if _, err = storage.LoadWAL(); err != nil {
+		t.Fatal(err)
+	}
+	xa = NewXAResource(storage)
+	if xids := xa.Recover(); len(xids) != 1 || !reflect.DeepEqual(xids[0], xid("b1")) {
+		t.Fatalf("recovered %+v", xids)
+	} else if err = xa.Commit(xids[0], false); err != nil {
+		t.Fatalf("failed to commit recovered branch : %v", err)
+	}
+	check := storage.NewTxn()
+	defer check.Abort()
+	assertValue(t, check, "key1", []byte("b1"))
+	assertValue(t, check, "key2", []byte("b2"))
+	for _, key := range []string{"key3", "key4"} {
+		if _, err := check.Read(key); err != ErrNotExist {
+			t.Errorf("%v of rolled back branch : %v", key, err)
+		}
+	}
+}